@@ -0,0 +1,40 @@
+//! Build info for `lotel version`: the git commit and the compiler that built the binary.
+
+use std::path::Path;
+use std::process::Command;
+
+fn main() {
+    // Builds from a source tarball have no git checkout; packagers can pass the commit.
+    println!("cargo:rerun-if-env-changed=LOTEL_COMMIT");
+    let commit = std::env::var("LOTEL_COMMIT")
+        .ok()
+        .filter(|c| !c.is_empty())
+        .or_else(|| output("git", &["rev-parse", "--short=12", "HEAD"]))
+        .unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=LOTEL_COMMIT={commit}");
+
+    let rustc = std::env::var("RUSTC").unwrap_or_else(|_| "rustc".to_string());
+    let rustc_version = output(&rustc, &["--version"]).unwrap_or_else(|| "unknown".to_string());
+    println!("cargo:rustc-env=LOTEL_RUSTC_VERSION={rustc_version}");
+    let target = std::env::var("TARGET").unwrap_or_default();
+    println!("cargo:rustc-env=LOTEL_TARGET={target}");
+
+    // Rebuild when HEAD moves: on checkout (HEAD) and on commit (the branch's ref).
+    let git_dir = Path::new("../../.git");
+    if git_dir.join("HEAD").exists() {
+        println!("cargo:rerun-if-changed=../../.git/HEAD");
+        if let Ok(head) = std::fs::read_to_string(git_dir.join("HEAD"))
+            && let Some(branch) = head.trim().strip_prefix("ref: ")
+        {
+            println!("cargo:rerun-if-changed=../../.git/{branch}");
+        }
+    }
+}
+
+fn output(program: &str, args: &[&str]) -> Option<String> {
+    let out = Command::new(program).args(args).output().ok()?;
+    out.status
+        .success()
+        .then(|| String::from_utf8_lossy(&out.stdout).trim().to_string())
+        .filter(|s| !s.is_empty())
+}
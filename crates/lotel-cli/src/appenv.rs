@@ -0,0 +1,140 @@
+//! `lotel env` and `lotel run`: the standard `OTEL_*` SDK variables that point an
+//! instrumented app at the local collector, as shell commands or set on a child process.
+
+use std::path::Path;
+
+use clap::ValueEnum;
+
+/// Shells `lotel env` prints commands for.
+#[derive(Debug, Clone, Copy, PartialEq, ValueEnum)]
+pub enum Shell {
+    /// Also zsh and other POSIX shells
+    Bash,
+    Fish,
+    Powershell,
+}
+
+/// What the variables say about the collector and the app.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AppEnv {
+    /// The collector's OTLP/HTTP base URL, e.g. `http://localhost:4318`.
+    pub endpoint: String,
+    /// The bearer token of an `--auth` collector.
+    pub token: Option<String>,
+    /// `service.name`, unless the app already sets one.
+    pub service: Option<String>,
+    /// `OTEL_RESOURCE_ATTRIBUTES`, unless the app already sets them.
+    pub resource_attributes: bool,
+}
+
+impl AppEnv {
+    /// The variables, in the order they are printed.
+    pub fn vars(&self) -> Vec<(&'static str, String)> {
+        let mut vars = vec![
+            ("OTEL_EXPORTER_OTLP_ENDPOINT", self.endpoint.clone()),
+            ("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf".to_string()),
+        ];
+        if let Some(token) = &self.token {
+            // Header values are percent-decoded by the SDKs, so the space is encoded.
+            vars.push((
+                "OTEL_EXPORTER_OTLP_HEADERS",
+                format!("authorization=Bearer%20{token}"),
+            ));
+        }
+        if let Some(service) = &self.service {
+            vars.push(("OTEL_SERVICE_NAME", service.clone()));
+        }
+        if self.resource_attributes {
+            vars.push((
+                "OTEL_RESOURCE_ATTRIBUTES",
+                "deployment.environment.name=local".to_string(),
+            ));
+        }
+        vars
+    }
+}
+
+/// A service name suggested by the project directory: its name in lowercase, with runs of
+/// anything but letters and digits turned into `-`.
+pub fn service_name_for(dir: &Path) -> Option<String> {
+    let name = dir.file_name()?.to_string_lossy().to_lowercase();
+    let name = name
+        .split(|c: char| !c.is_ascii_alphanumeric())
+        .filter(|part| !part.is_empty())
+        .collect::<Vec<_>>()
+        .join("-");
+    Some(name).filter(|n| !n.is_empty())
+}
+
+/// Commands that set `vars` in `shell`, one per line.
+pub fn script(vars: &[(&str, String)], shell: Shell) -> String {
+    vars.iter()
+        .map(|(key, value)| match shell {
+            Shell::Bash => format!("export {key}='{}'\n", value.replace('\'', r"'\''")),
+            Shell::Fish => format!(
+                "set -gx {key} '{}'\n",
+                value.replace('\\', r"\\").replace('\'', r"\'")
+            ),
+            Shell::Powershell => format!("$env:{key} = '{}'\n", value.replace('\'', "''")),
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn lists_the_sdk_variables() {
+        let env = AppEnv {
+            endpoint: "http://localhost:4318".to_string(),
+            token: Some("abc".to_string()),
+            service: Some("checkout".to_string()),
+            resource_attributes: true,
+        };
+        let keys: Vec<_> = env.vars().iter().map(|(key, _)| *key).collect();
+        assert_eq!(
+            keys,
+            [
+                "OTEL_EXPORTER_OTLP_ENDPOINT",
+                "OTEL_EXPORTER_OTLP_PROTOCOL",
+                "OTEL_EXPORTER_OTLP_HEADERS",
+                "OTEL_SERVICE_NAME",
+                "OTEL_RESOURCE_ATTRIBUTES",
+            ]
+        );
+        let bare = AppEnv {
+            token: None,
+            service: None,
+            resource_attributes: false,
+            ..env
+        };
+        assert_eq!(bare.vars().len(), 2);
+    }
+
+    #[test]
+    fn suggests_a_service_name() {
+        assert_eq!(
+            service_name_for(Path::new("/src/My_Web App")),
+            Some("my-web-app".to_string())
+        );
+        assert_eq!(service_name_for(Path::new("/")), None);
+    }
+
+    #[test]
+    fn quotes_for_each_shell() {
+        let vars = [("OTEL_SERVICE_NAME", r"it's a\b".to_string())];
+        assert_eq!(
+            script(&vars, Shell::Bash),
+            "export OTEL_SERVICE_NAME='it'\\''s a\\b'\n"
+        );
+        assert_eq!(
+            script(&vars, Shell::Fish),
+            "set -gx OTEL_SERVICE_NAME 'it\\'s a\\\\b'\n"
+        );
+        assert_eq!(
+            script(&vars, Shell::Powershell),
+            "$env:OTEL_SERVICE_NAME = 'it''s a\\b'\n"
+        );
+    }
+}
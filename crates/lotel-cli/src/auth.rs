@@ -0,0 +1,57 @@
+//! The bearer token of `lotel start --auth`: generated once per collector and kept next to
+//! its state file, so apps configured with it keep working across restarts.
+
+use std::io::{Read, Write};
+use std::path::Path;
+
+use anyhow::{Context, Result};
+
+const TOKEN_FILE: &str = "auth.token";
+
+/// The token in `dir`, generating one unless it is already there.
+pub fn ensure_token(dir: &Path) -> Result<String> {
+    if let Some(token) = read_token(dir)? {
+        return Ok(token);
+    }
+    let mut bytes = [0u8; 32];
+    std::fs::File::open("/dev/urandom")
+        .and_then(|mut random| random.read_exact(&mut bytes))
+        .context("reading /dev/urandom for an auth token")?;
+    let token = hex::encode(bytes);
+    std::fs::create_dir_all(dir)?;
+    let path = dir.join(TOKEN_FILE);
+    let mut options = std::fs::OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+    options
+        .open(&path)
+        .and_then(|mut file| file.write_all(token.as_bytes()))
+        .with_context(|| format!("writing {}", path.display()))?;
+    Ok(token)
+}
+
+/// The token in `dir`, if one was generated.
+pub fn read_token(dir: &Path) -> Result<Option<String>> {
+    match std::fs::read_to_string(dir.join(TOKEN_FILE)) {
+        Ok(token) => Ok(Some(token.trim().to_string()).filter(|t| !t.is_empty())),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).context("reading the collector's auth token"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn generates_a_token_once() {
+        let dir = std::env::temp_dir().join(format!("lotel-auth-{}", std::process::id()));
+        assert_eq!(read_token(&dir).unwrap(), None);
+        let token = ensure_token(&dir).unwrap();
+        assert_eq!(token.len(), 64);
+        assert_eq!(ensure_token(&dir).unwrap(), token);
+        assert_eq!(read_token(&dir).unwrap(), Some(token));
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,291 @@
+//! `lotel bench ingest` and `lotel bench query`: time the ingest path and filtered queries
+//! on reproducible synthetic JSONL.
+
+use std::fs::{self, File};
+use std::io::{BufWriter, Write};
+use std::path::Path;
+use std::time::Instant;
+
+use anyhow::{Context, Result, bail};
+use chrono::NaiveDateTime;
+use serde::Serialize;
+
+use crate::generate::{Generator, MAX_BATCH};
+
+/// Timestamp of the first generated batch; fixed so runs with the same seed match.
+const BENCH_EPOCH_NS: u64 = 1_710_000_000_000_000_000;
+
+/// Error rate of the generated traffic, matching the `gen` default.
+const BENCH_ERROR_RATE: f64 = 0.05;
+
+/// Runs per query; the median is reported.
+const QUERY_RUNS: usize = 5;
+
+#[derive(Debug, Serialize)]
+pub struct IngestBenchReport {
+    pub rows: u64,
+    pub spans: u64,
+    pub logs: u64,
+    pub metric_points: u64,
+    pub jsonl_bytes: u64,
+    pub generate_secs: f64,
+    pub ingest_secs: f64,
+    pub rows_per_sec: f64,
+    pub db_bytes: u64,
+    pub workers: usize,
+    pub read_json: bool,
+}
+
+#[derive(Debug, Serialize)]
+pub struct QueryBenchReport {
+    pub rows: u64,
+    pub spans: u64,
+    pub ingest_secs: f64,
+    pub queries: Vec<QueryTiming>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct QueryTiming {
+    pub query: &'static str,
+    pub matched: i64,
+    /// Median over the spans as ingest stores them: clustered by service and time, with
+    /// the trace_id index.
+    pub stored_ms: f64,
+    /// Median over a shuffled copy of the same spans without indexes.
+    pub baseline_ms: f64,
+    pub speedup: f64,
+}
+
+/// Parse a row count such as `500000`, `250k`, or `1M`.
+pub fn parse_count(s: &str) -> Result<u64> {
+    let s = s.trim();
+    let (digits, scale) = match s.char_indices().last() {
+        Some((i, 'k' | 'K')) => (&s[..i], 1_000.0),
+        Some((i, 'm' | 'M')) => (&s[..i], 1_000_000.0),
+        _ => (s, 1.0),
+    };
+    match digits.parse::<f64>() {
+        Ok(n) if n > 0.0 => Ok((n * scale).round() as u64),
+        _ => bail!("invalid row count {s:?} (expected e.g. 100000, 250k, 1M)"),
+    }
+}
+
+/// Write at least `rows` rows of synthetic JSONL under `dir`, ingest them into a fresh
+/// database there, and report timings and sizes.
+pub fn run_ingest(
+    dir: &Path,
+    rows: u64,
+    workers: Option<usize>,
+    seed: u64,
+    read_json: bool,
+) -> Result<IngestBenchReport> {
+    let start = Instant::now();
+    let (spans, logs, metric_points) = write_jsonl(dir, rows, seed)?;
+    let generate_secs = start.elapsed().as_secs_f64();
+    let jsonl_bytes = ["traces", "metrics", "logs"]
+        .iter()
+        .map(|signal| file_size(&dir.join(signal).join(format!("{signal}.jsonl"))))
+        .sum();
+
+    let db_path = dir.join("lotel.db");
+    let conn = lotel_storage::open_db(&db_path)?;
+    let workers = workers.unwrap_or_else(lotel_storage::default_workers);
+    let mut ingester = lotel_storage::IncrementalIngester::new()
+        .with_workers(workers)
+        .with_read_json(read_json);
+    let start = Instant::now();
+    let report = ingester.ingest_new(&conn, dir)?;
+    // Flush the WAL so the file size reflects the stored data.
+    conn.execute_batch("CHECKPOINT")?;
+    let ingest_secs = start.elapsed().as_secs_f64();
+
+    let ingested = report.total() as u64;
+    Ok(IngestBenchReport {
+        rows: ingested,
+        spans,
+        logs,
+        metric_points,
+        jsonl_bytes,
+        generate_secs,
+        ingest_secs,
+        rows_per_sec: ingested as f64 / ingest_secs.max(f64::EPSILON),
+        db_bytes: file_size(&db_path) + file_size(&db_path.with_extension("db.wal")),
+        workers,
+        read_json,
+    })
+}
+
+/// Ingest generated data as [`run_ingest`] does, then time service-, time-, and
+/// trace-filtered span queries against the stored table and an unclustered, unindexed copy.
+pub fn run_query(dir: &Path, rows: u64, seed: u64) -> Result<QueryBenchReport> {
+    let ingest = run_ingest(dir, rows, None, seed, false)?;
+    let conn = lotel_storage::open_db(&dir.join("lotel.db"))?;
+    conn.execute_batch(
+        "CREATE OR REPLACE TABLE traces_baseline AS SELECT * FROM traces ORDER BY random()",
+    )?;
+
+    // The least common service, a trace from the middle of the run, and the middle tenth of
+    // the time range keep each filter selective.
+    let service: String = conn.query_row(
+        "SELECT service_name FROM traces GROUP BY 1 ORDER BY COUNT(*), 1 LIMIT 1",
+        [],
+        |row| row.get(0),
+    )?;
+    let trace_id: String = conn.query_row(
+        "SELECT trace_id FROM traces ORDER BY start_time, trace_id
+         LIMIT 1 OFFSET (SELECT COUNT(*) / 2 FROM traces)",
+        [],
+        |row| row.get(0),
+    )?;
+    let (first, last): (NaiveDateTime, NaiveDateTime) = conn.query_row(
+        "SELECT MIN(start_time), MAX(start_time) FROM traces",
+        [],
+        |row| Ok((row.get(0)?, row.get(1)?)),
+    )?;
+    let tenth = (last - first) / 10;
+    let from = first + tenth * 5;
+    let to = from + tenth;
+
+    let cases: [(&'static str, &str, Vec<&dyn duckdb::ToSql>); 4] = [
+        ("trace_id", "trace_id = ?", vec![&trace_id]),
+        ("service", "service_name = ?", vec![&service]),
+        (
+            "time_window",
+            "start_time >= ? AND start_time < ?",
+            vec![&from, &to],
+        ),
+        (
+            "service_and_time",
+            "service_name = ? AND start_time >= ? AND start_time < ?",
+            vec![&service, &from, &to],
+        ),
+    ];
+    let mut queries = Vec::new();
+    for (query, filter, params) in &cases {
+        let (matched, stored_ms) = time_query(
+            &conn,
+            &format!("SELECT COUNT(*) FROM traces WHERE {filter}"),
+            params,
+        )?;
+        let (_, baseline_ms) = time_query(
+            &conn,
+            &format!("SELECT COUNT(*) FROM traces_baseline WHERE {filter}"),
+            params,
+        )?;
+        queries.push(QueryTiming {
+            query,
+            matched,
+            stored_ms,
+            baseline_ms,
+            speedup: baseline_ms / stored_ms.max(f64::EPSILON),
+        });
+    }
+    conn.execute_batch("DROP TABLE traces_baseline")?;
+
+    Ok(QueryBenchReport {
+        rows: ingest.rows,
+        spans: ingest.spans,
+        ingest_secs: ingest.ingest_secs,
+        queries,
+    })
+}
+
+/// Returns the row count and the median time in milliseconds over [`QUERY_RUNS`] runs.
+fn time_query(
+    conn: &duckdb::Connection,
+    sql: &str,
+    params: &[&dyn duckdb::ToSql],
+) -> Result<(i64, f64)> {
+    let mut matched = 0;
+    let mut times = Vec::with_capacity(QUERY_RUNS);
+    for _ in 0..QUERY_RUNS {
+        let start = Instant::now();
+        matched = conn.query_row(sql, params, |row| row.get(0))?;
+        times.push(start.elapsed().as_secs_f64() * 1000.0);
+    }
+    times.sort_by(f64::total_cmp);
+    Ok((matched, times[times.len() / 2]))
+}
+
+/// Returns the number of spans, logs, and metric points written.
+fn write_jsonl(dir: &Path, rows: u64, seed: u64) -> Result<(u64, u64, u64)> {
+    let open = |signal: &str| -> Result<BufWriter<File>> {
+        let sub = dir.join(signal);
+        fs::create_dir_all(&sub).with_context(|| format!("creating {}", sub.display()))?;
+        let path = sub.join(format!("{signal}.jsonl"));
+        let file = File::create(&path).with_context(|| format!("creating {}", path.display()))?;
+        Ok(BufWriter::new(file))
+    };
+    let (mut traces, mut metrics, mut logs) = (open("traces")?, open("metrics")?, open("logs")?);
+
+    let mut generator = Generator::new(seed, BENCH_ERROR_RATE);
+    let (mut spans, mut log_count, mut points) = (0, 0, 0);
+    let mut now_ns = BENCH_EPOCH_NS;
+    while spans + log_count + points < rows {
+        let batch = generator.batch(MAX_BATCH, now_ns);
+        serde_json::to_writer(&mut traces, &batch.traces)?;
+        writeln!(traces)?;
+        serde_json::to_writer(&mut logs, &batch.log_records)?;
+        writeln!(logs)?;
+        serde_json::to_writer(&mut metrics, &batch.metrics)?;
+        writeln!(metrics)?;
+        spans += batch.spans;
+        log_count += batch.logs;
+        points += batch.metric_points;
+        now_ns += 1_000_000_000;
+    }
+    for mut writer in [traces, metrics, logs] {
+        writer.flush()?;
+    }
+    Ok((spans, log_count, points))
+}
+
+fn file_size(path: &Path) -> u64 {
+    fs::metadata(path).map(|m| m.len()).unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_count_suffixes() {
+        assert_eq!(parse_count("1M").unwrap(), 1_000_000);
+        assert_eq!(parse_count("250k").unwrap(), 250_000);
+        assert_eq!(parse_count("1.5m").unwrap(), 1_500_000);
+        assert_eq!(parse_count("42").unwrap(), 42);
+        assert!(parse_count("0").is_err());
+        assert!(parse_count("lots").is_err());
+    }
+
+    #[test]
+    fn ingest_bench_ingests_every_generated_row() {
+        for read_json in [false, true] {
+            let dir = std::env::temp_dir().join(format!(
+                "lotel-bench-test-{}-{read_json}",
+                std::process::id()
+            ));
+            let report = run_ingest(&dir, 2_000, Some(2), 1, read_json);
+            let _ = fs::remove_dir_all(&dir);
+            let report = report.unwrap();
+            assert!(report.rows >= 2_000);
+            assert_eq!(
+                report.rows,
+                report.spans + report.logs + report.metric_points
+            );
+            assert!(report.jsonl_bytes > 0 && report.db_bytes > 0);
+        }
+    }
+
+    #[test]
+    fn query_bench_matches_the_same_rows_in_both_layouts() {
+        let dir =
+            std::env::temp_dir().join(format!("lotel-bench-query-test-{}", std::process::id()));
+        let report = run_query(&dir, 5_000, 1);
+        let _ = fs::remove_dir_all(&dir);
+        let report = report.unwrap();
+        assert_eq!(report.queries.len(), 4);
+        assert!(report.queries.iter().all(|q| q.matched > 0));
+        assert!(report.queries[0].matched <= report.spans as i64);
+    }
+}
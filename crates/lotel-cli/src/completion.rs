@@ -0,0 +1,391 @@
+//! `completion bash|zsh|fish`: shell completion scripts generated from the clap command
+//! tree. Subcommands, flags, and enum values are completed statically; `--service` and
+//! `--metric` values come from the database at completion time through the hidden
+//! `__complete` command, so completion follows what has been captured.
+
+use std::fmt::Write;
+
+use clap::{Command, ValueEnum};
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+pub enum Shell {
+    Bash,
+    Zsh,
+    Fish,
+}
+
+/// Values `__complete` looks up in the database.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+pub enum Lookup {
+    Service,
+    Metric,
+}
+
+impl Lookup {
+    /// The lookup for a flag's values, by the flag's long name.
+    fn for_flag(long: &str) -> Option<Self> {
+        match long {
+            "service" => Some(Self::Service),
+            "metric" => Some(Self::Metric),
+            _ => None,
+        }
+    }
+
+    fn name(self) -> &'static str {
+        match self {
+            Self::Service => "service",
+            Self::Metric => "metric",
+        }
+    }
+}
+
+/// A (sub)command: its full path (`lotel-cli query traces`), subcommands, and flags.
+struct Node {
+    path: String,
+    subcommands: Vec<(String, String)>,
+    flags: Vec<Flag>,
+}
+
+struct Flag {
+    long: Option<String>,
+    short: Option<char>,
+    help: String,
+    value: Value,
+}
+
+enum Value {
+    None,
+    /// Free-form; the shell falls back to file names.
+    Any,
+    Choices(Vec<String>),
+    Lookup(Lookup),
+}
+
+impl Flag {
+    /// `--long` and `-s`, as typed.
+    fn spellings(&self) -> Vec<String> {
+        let long = self.long.iter().map(|l| format!("--{l}"));
+        let short = self.short.iter().map(|s| format!("-{s}"));
+        long.chain(short).collect()
+    }
+}
+
+/// The completion script for `shell`, completing the binary `bin`.
+pub fn script(mut cmd: Command, bin: &str, shell: Shell) -> String {
+    // Building propagates global flags to every subcommand.
+    cmd.build();
+    let mut nodes = Vec::new();
+    collect(&cmd, bin.to_string(), &mut nodes);
+    match shell {
+        Shell::Bash => bash(bin, &nodes),
+        Shell::Zsh => zsh(bin, &nodes),
+        Shell::Fish => fish(bin, &nodes),
+    }
+}
+
+fn collect(cmd: &Command, path: String, nodes: &mut Vec<Node>) {
+    let visible: Vec<&Command> = cmd
+        .get_subcommands()
+        .filter(|c| !c.is_hide_set() && c.get_name() != "help")
+        .collect();
+    let flags = cmd
+        .get_arguments()
+        .filter(|a| !a.is_positional() && !a.is_hide_set())
+        .map(|a| {
+            let long = a.get_long().map(String::from);
+            let choices: Vec<String> = a
+                .get_possible_values()
+                .iter()
+                .filter(|v| !v.is_hide_set())
+                .map(|v| v.get_name().to_string())
+                .collect();
+            let value = if !a.get_action().takes_values() {
+                Value::None
+            } else if let Some(lookup) = long.as_deref().and_then(Lookup::for_flag) {
+                Value::Lookup(lookup)
+            } else if choices.is_empty() {
+                Value::Any
+            } else {
+                Value::Choices(choices)
+            };
+            Flag {
+                long,
+                short: a.get_short(),
+                help: first_line(a.get_help().map(|h| h.to_string()).unwrap_or_default()),
+                value,
+            }
+        })
+        .collect();
+    nodes.push(Node {
+        path: path.clone(),
+        subcommands: visible
+            .iter()
+            .map(|c| {
+                let about = c.get_about().map(|h| h.to_string()).unwrap_or_default();
+                (c.get_name().to_string(), first_line(about))
+            })
+            .collect(),
+        flags,
+    });
+    for sub in visible {
+        collect(sub, format!("{path} {}", sub.get_name()), nodes);
+    }
+}
+
+fn first_line(s: String) -> String {
+    s.lines().next().unwrap_or_default().to_string()
+}
+
+/// Shell function name for `bin`, e.g. `_lotel_cli`.
+fn function_name(bin: &str) -> String {
+    format!("_{}", bin.replace('-', "_"))
+}
+
+/// Case patterns of every subcommand path below the root: `"lotel-cli query"|...`.
+fn subcommand_paths(nodes: &[Node]) -> String {
+    nodes[1..]
+        .iter()
+        .map(|n| format!("\"{}\"", n.path))
+        .collect::<Vec<_>>()
+        .join("|")
+}
+
+/// Words offered at `node`: its subcommands, then its flags.
+fn words(node: &Node) -> String {
+    let subcommands = node.subcommands.iter().map(|(name, _)| name.clone());
+    let flags = node.flags.iter().flat_map(Flag::spellings);
+    subcommands.chain(flags).collect::<Vec<_>>().join(" ")
+}
+
+/// `"path --flag"|"path -f"` for one flag of `node`.
+fn flag_patterns(node: &Node, flag: &Flag) -> String {
+    flag.spellings()
+        .iter()
+        .map(|s| format!("\"{} {s}\"", node.path))
+        .collect::<Vec<_>>()
+        .join("|")
+}
+
+fn bash(bin: &str, nodes: &[Node]) -> String {
+    let func = function_name(bin);
+    let mut s = String::new();
+    let _ = writeln!(s, "{func}() {{");
+    s.push_str(
+        "    local cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n",
+    );
+    let _ = writeln!(s, "    local cmdpath=\"{bin}\" i");
+    s.push_str("    for ((i = 1; i < COMP_CWORD; i++)); do\n");
+    s.push_str("        case \"$cmdpath ${COMP_WORDS[i]}\" in\n");
+    let _ = writeln!(
+        s,
+        "            {}) cmdpath=\"$cmdpath ${{COMP_WORDS[i]}}\" ;;",
+        subcommand_paths(nodes)
+    );
+    s.push_str("        esac\n    done\n");
+    s.push_str("    case \"$cmdpath $prev\" in\n");
+    for node in nodes {
+        for flag in &node.flags {
+            let action = match &flag.value {
+                Value::None => continue,
+                Value::Any => "return".to_string(),
+                Value::Choices(choices) => format!(
+                    "COMPREPLY=($(compgen -W \"{}\" -- \"$cur\")); return",
+                    choices.join(" ")
+                ),
+                Value::Lookup(lookup) => format!(
+                    "COMPREPLY=($(compgen -W \"$({bin} __complete {} \"$cur\" 2>/dev/null)\" -- \"$cur\")); return",
+                    lookup.name()
+                ),
+            };
+            let _ = writeln!(s, "        {}) {action} ;;", flag_patterns(node, flag));
+        }
+    }
+    s.push_str("    esac\n    case \"$cmdpath\" in\n");
+    for node in nodes {
+        let _ = writeln!(
+            s,
+            "        \"{}\") COMPREPLY=($(compgen -W \"{}\" -- \"$cur\")) ;;",
+            node.path,
+            words(node)
+        );
+    }
+    s.push_str("    esac\n}\n\n");
+    let _ = writeln!(s, "complete -o default -F {func} {bin}");
+    s
+}
+
+fn zsh(bin: &str, nodes: &[Node]) -> String {
+    let func = function_name(bin);
+    let mut s = String::new();
+    let _ = writeln!(s, "#compdef {bin}\n");
+    let _ = writeln!(s, "{func}() {{");
+    s.push_str("    local cur=\"${words[CURRENT]}\" prev=\"${words[CURRENT-1]}\"\n");
+    let _ = writeln!(s, "    local cmdpath=\"{bin}\" i");
+    s.push_str("    local -a values\n");
+    s.push_str("    for ((i = 2; i < CURRENT; i++)); do\n");
+    s.push_str("        case \"$cmdpath ${words[i]}\" in\n");
+    let _ = writeln!(
+        s,
+        "            ({}) cmdpath=\"$cmdpath ${{words[i]}}\" ;;",
+        subcommand_paths(nodes)
+    );
+    s.push_str("        esac\n    done\n");
+    s.push_str("    case \"$cmdpath $prev\" in\n");
+    for node in nodes {
+        for flag in &node.flags {
+            let action = match &flag.value {
+                Value::None => continue,
+                Value::Any => "_files; return".to_string(),
+                Value::Choices(choices) => format!("compadd -- {}; return", choices.join(" ")),
+                Value::Lookup(lookup) => format!(
+                    "values=(${{(f)\"$({bin} __complete {} \"$cur\" 2>/dev/null)\"}}); compadd -a values; return",
+                    lookup.name()
+                ),
+            };
+            let _ = writeln!(s, "        ({}) {action} ;;", flag_patterns(node, flag));
+        }
+    }
+    s.push_str("    esac\n    case \"$cmdpath\" in\n");
+    for node in nodes {
+        let _ = writeln!(
+            s,
+            "        (\"{}\") compadd -- {} ;;",
+            node.path,
+            words(node)
+        );
+    }
+    s.push_str("    esac\n}\n\n");
+    let _ = writeln!(s, "compdef {func} {bin}");
+    s
+}
+
+fn fish(bin: &str, nodes: &[Node]) -> String {
+    let func = format!("_{}_path", function_name(bin));
+    let mut s = String::new();
+    let _ = writeln!(s, "function {func}");
+    let _ = writeln!(s, "    set -l cmdpath {bin}");
+    s.push_str("    for w in (commandline -opc)[2..-1]\n");
+    s.push_str("        switch \"$cmdpath $w\"\n");
+    let cases: Vec<String> = nodes[1..].iter().map(|n| format!("'{}'", n.path)).collect();
+    let _ = writeln!(s, "            case {}", cases.join(" "));
+    s.push_str("                set cmdpath \"$cmdpath $w\"\n");
+    s.push_str("        end\n    end\n    echo $cmdpath\nend\n\n");
+    let _ = writeln!(s, "complete -c {bin} -f");
+    for node in nodes {
+        let at = format!("-n 'test ({func}) = \"{}\"'", node.path);
+        for (name, about) in &node.subcommands {
+            let _ = writeln!(
+                s,
+                "complete -c {bin} {at} -a {name} -d {}",
+                fish_quote(about)
+            );
+        }
+        for flag in &node.flags {
+            let mut line = format!("complete -c {bin} {at}");
+            if let Some(long) = &flag.long {
+                let _ = write!(line, " -l {long}");
+            }
+            if let Some(short) = flag.short {
+                let _ = write!(line, " -s {short}");
+            }
+            match &flag.value {
+                Value::None => {}
+                Value::Any => line.push_str(" -r -F"),
+                Value::Choices(choices) => {
+                    let _ = write!(line, " -x -a {}", fish_quote(&choices.join(" ")));
+                }
+                Value::Lookup(lookup) => {
+                    let _ = write!(
+                        line,
+                        " -x -a '({bin} __complete {} (commandline -ct) 2>/dev/null)'",
+                        lookup.name()
+                    );
+                }
+            }
+            if !flag.help.is_empty() {
+                let _ = write!(line, " -d {}", fish_quote(&flag.help));
+            }
+            let _ = writeln!(s, "{line}");
+        }
+    }
+    s
+}
+
+fn fish_quote(s: &str) -> String {
+    format!("'{}'", s.replace('\\', "\\\\").replace('\'', "\\'"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use clap::{Arg, ArgAction};
+
+    fn cli() -> Command {
+        Command::new("lotel")
+            .arg(
+                Arg::new("quiet")
+                    .long("quiet")
+                    .short('q')
+                    .global(true)
+                    .action(ArgAction::SetTrue),
+            )
+            .subcommand(
+                Command::new("query").subcommand(
+                    Command::new("traces")
+                        .about("Query trace spans")
+                        .arg(Arg::new("service").long("service"))
+                        .arg(Arg::new("limit").long("limit")),
+                ),
+            )
+            .subcommand(
+                Command::new("graph").arg(
+                    Arg::new("format")
+                        .long("format")
+                        .value_parser(["json", "dot"]),
+                ),
+            )
+            .subcommand(Command::new("__complete").hide(true))
+    }
+
+    #[test]
+    fn bash_completes_paths_flags_and_values() {
+        let script = script(cli(), "lotel-cli", Shell::Bash);
+        assert!(
+            script.contains(
+                r#""lotel-cli query"|"lotel-cli query traces"|"lotel-cli graph") cmdpath="#
+            )
+        );
+        assert!(script.contains(r#""lotel-cli") COMPREPLY=($(compgen -W "query graph --quiet -q"#));
+        // Global flags reach subcommands.
+        assert!(script.contains(
+            r#""lotel-cli query traces") COMPREPLY=($(compgen -W "--service --limit --quiet -q"#
+        ));
+        assert!(script.contains(
+            r#""lotel-cli query traces --service") COMPREPLY=($(compgen -W "$(lotel-cli __complete service "$cur" 2>/dev/null)""#
+        ));
+        assert!(
+            script.contains(r#""lotel-cli graph --format") COMPREPLY=($(compgen -W "json dot""#)
+        );
+        assert!(script.contains(r#""lotel-cli query traces --limit") return ;;"#));
+        assert!(!script.contains("__complete\")"));
+        assert!(script.ends_with("complete -o default -F _lotel_cli lotel-cli\n"));
+    }
+
+    #[test]
+    fn zsh_and_fish_cover_the_same_tree() {
+        let zsh = script(cli(), "lotel-cli", Shell::Zsh);
+        assert!(zsh.starts_with("#compdef lotel-cli\n"));
+        assert!(zsh.contains(r#"("lotel-cli graph --format") compadd -- json dot; return ;;"#));
+        assert!(zsh.contains("__complete service"));
+
+        let fish = script(cli(), "lotel-cli", Shell::Fish);
+        assert!(fish.contains(
+            r#"complete -c lotel-cli -n 'test (__lotel_cli_path) = "lotel-cli query"' -a traces -d 'Query trace spans'"#
+        ));
+        assert!(fish.contains(
+            "-l service -x -a '(lotel-cli __complete service (commandline -ct) 2>/dev/null)'"
+        ));
+        assert!(fish.contains("-l format -x -a 'json dot'"));
+        assert!(fish.contains("-l quiet -s q"));
+    }
+}
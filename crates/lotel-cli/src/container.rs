@@ -0,0 +1,266 @@
+//! `lotel generate compose|devcontainer`: a docker-compose service that runs the collector
+//! with the user's config, and the devcontainer.json settings that start it next to a dev
+//! container. No lotel image is published, so the service builds one from the lotel source.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+
+/// The compose service name, and the collector's host name on the compose networks.
+pub const SERVICE: &str = "lotel-collector";
+/// The network the service joins besides the project's default one, so containers outside
+/// the compose project (a dev container) can reach it too.
+pub const NETWORK: &str = "lotel";
+/// Where the generated devcontainer.json expects the compose file.
+pub const DEVCONTAINER_COMPOSE_FILE: &str = ".devcontainer/lotel-compose.yml";
+
+const CONFIG_MOUNT: &str = "/etc/lotel/collector.yaml";
+
+// Cargo.lock is not tracked, so the build resolves dependencies as `cargo install` would.
+const DOCKERFILE: &str = "\
+FROM rust:1-bookworm AS build
+ARG LOTEL_COMMIT
+WORKDIR /src
+COPY Cargo.toml rust-toolchain.toml ./
+COPY crates crates
+COPY proto proto
+RUN cargo build --release -p lotel-cli
+FROM debian:bookworm-slim
+COPY --from=build /src/target/release/lotel-cli /usr/local/bin/lotel-cli
+";
+
+/// What the generated service runs.
+#[derive(Debug, Clone, PartialEq)]
+pub struct CollectorService {
+    /// The lotel checkout the image is built from.
+    pub source: PathBuf,
+    /// The collector config, mounted read-only.
+    pub config: PathBuf,
+    /// The host data directory, mounted at the same path so `lotel ingest` on the host reads
+    /// what the container writes and exporter paths resolve as they do on the host.
+    pub data: PathBuf,
+    /// The host home directory, `HOME` in the container, so `~/` exporter paths resolve into
+    /// the mounted data directory.
+    pub home: PathBuf,
+    /// Published ports by receiver or extension name, in the order they are listed.
+    pub ports: Vec<(&'static str, u16)>,
+    /// The config's `environment` entries.
+    pub env: Vec<(String, String)>,
+    /// `uid:gid` to run as, so the data files stay owned by the user.
+    pub user: String,
+}
+
+/// The lotel checkout this binary was built from, if it is still there.
+pub fn default_source() -> Option<PathBuf> {
+    let root = Path::new(env!("CARGO_MANIFEST_DIR")).ancestors().nth(2)?;
+    check_source(root).ok()
+}
+
+/// Check that `dir` is a lotel checkout the Dockerfile can build.
+pub fn check_source(dir: &Path) -> Result<PathBuf> {
+    let dir = std::path::absolute(dir)?;
+    let manifest = dir.join("crates/lotel-cli/Cargo.toml");
+    std::fs::metadata(&manifest)
+        .with_context(|| format!("{} is not a lotel checkout", dir.display()))?;
+    Ok(dir)
+}
+
+/// The port of a `host:port` endpoint, unless the container could not publish it: the
+/// endpoint is a unix socket, or listens on loopback only, which port mappings do not reach.
+pub fn published_port(endpoint: &str) -> Option<u16> {
+    if endpoint.starts_with(lotel_collector::config::UNIX_SCHEME) {
+        return None;
+    }
+    let (host, port) = endpoint.rsplit_once(':')?;
+    let host = host.trim_matches(['[', ']']);
+    if host == "localhost" || host == "::1" || host.starts_with("127.") {
+        return None;
+    }
+    port.parse().ok()
+}
+
+impl CollectorService {
+    /// A docker-compose file with the collector service.
+    pub fn compose(&self) -> String {
+        let mut out = String::new();
+        out.push_str("# Generated by `lotel-cli generate compose`.\n");
+        if let Some(port) = self.port("http") {
+            out.push_str(&format!(
+                "# Apps on the same networks export OTLP/HTTP to http://{SERVICE}:{port}"
+            ));
+            if let Some(port) = self.port("grpc") {
+                out.push_str(&format!(" or OTLP/gRPC to {SERVICE}:{port}"));
+            }
+            out.push_str(".\n");
+        }
+        out.push_str("# Ingest and query on the host as usual; the data directory is shared.\n");
+        out.push_str("services:\n");
+        out.push_str(&format!("  {SERVICE}:\n"));
+        out.push_str("    build:\n");
+        out.push_str(&format!(
+            "      context: {}\n",
+            quote(&self.source.display().to_string())
+        ));
+        out.push_str("      dockerfile_inline: |\n");
+        for line in DOCKERFILE.lines() {
+            out.push_str(&format!("        {line}\n"));
+        }
+        out.push_str("      args:\n");
+        out.push_str(&format!(
+            "        LOTEL_COMMIT: {}\n",
+            quote(env!("LOTEL_COMMIT"))
+        ));
+        out.push_str(&format!(
+            "    image: {}\n",
+            quote(&format!("lotel-collector:{}", crate::version::VERSION))
+        ));
+        let data = self.data.display().to_string();
+        let command = [
+            "lotel-cli",
+            "run-collector",
+            "--config",
+            CONFIG_MOUNT,
+            "--data",
+            &data,
+        ];
+        let command: Vec<String> = command.iter().map(|arg| quote(arg)).collect();
+        out.push_str(&format!("    command: [{}]\n", command.join(", ")));
+        out.push_str(&format!("    user: {}\n", quote(&self.user)));
+        out.push_str("    environment:\n");
+        let paths = [
+            ("HOME".to_string(), self.home.display().to_string()),
+            (lotel_storage::DATA_DIR_ENV.to_string(), data.clone()),
+        ];
+        for (key, value) in paths.iter().chain(&self.env) {
+            out.push_str(&format!("      {key}: {}\n", quote(value)));
+        }
+        out.push_str("    volumes:\n");
+        let volumes = [
+            format!("{}:{CONFIG_MOUNT}:ro", self.config.display()),
+            format!("{data}:{data}"),
+        ];
+        for volume in volumes {
+            out.push_str(&format!("      - {}\n", quote(&volume)));
+        }
+        if !self.ports.is_empty() {
+            out.push_str("    ports:\n");
+            for (_, port) in &self.ports {
+                out.push_str(&format!(
+                    "      - {}\n",
+                    quote(&format!("127.0.0.1:{port}:{port}"))
+                ));
+            }
+        }
+        out.push_str(&format!("    networks: [default, {NETWORK}]\n"));
+        // run-collector shuts down gracefully on Ctrl-C, flushing its batches.
+        out.push_str("    stop_signal: SIGINT\n");
+        out.push_str("    restart: unless-stopped\n");
+        out.push_str("networks:\n");
+        out.push_str(&format!("  {NETWORK}:\n"));
+        out.push_str(&format!("    name: {NETWORK}\n"));
+        out
+    }
+
+    /// The devcontainer.json settings that start the service from
+    /// [`DEVCONTAINER_COMPOSE_FILE`] before the dev container and point its SDKs at it.
+    pub fn devcontainer(&self) -> serde_json::Value {
+        let mut env = serde_json::Map::new();
+        if let Some(port) = self.port("http") {
+            env.insert(
+                "OTEL_EXPORTER_OTLP_ENDPOINT".into(),
+                format!("http://{SERVICE}:{port}").into(),
+            );
+            env.insert("OTEL_EXPORTER_OTLP_PROTOCOL".into(), "http/protobuf".into());
+        } else if let Some(port) = self.port("grpc") {
+            env.insert(
+                "OTEL_EXPORTER_OTLP_ENDPOINT".into(),
+                format!("http://{SERVICE}:{port}").into(),
+            );
+            env.insert("OTEL_EXPORTER_OTLP_PROTOCOL".into(), "grpc".into());
+        }
+        serde_json::json!({
+            "initializeCommand":
+                format!("docker compose -p {NETWORK} -f {DEVCONTAINER_COMPOSE_FILE} up -d --build"),
+            "runArgs": [format!("--network={NETWORK}")],
+            "containerEnv": env,
+        })
+    }
+
+    fn port(&self, name: &str) -> Option<u16> {
+        self.ports
+            .iter()
+            .find(|(n, _)| *n == name)
+            .map(|(_, port)| *port)
+    }
+}
+
+/// A YAML double-quoted scalar; JSON string syntax is valid YAML.
+fn quote(s: &str) -> String {
+    serde_json::Value::from(s).to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn service() -> CollectorService {
+        CollectorService {
+            source: PathBuf::from("/src/lotel"),
+            config: PathBuf::from("/home/me/.lotel/collector-config.yaml"),
+            data: PathBuf::from("/home/me/.lotel/data"),
+            home: PathBuf::from("/home/me"),
+            ports: vec![("grpc", 4317), ("http", 4318), ("health", 13133)],
+            env: vec![("TZ".to_string(), "Europe/Berlin".to_string())],
+            user: "1000:1000".to_string(),
+        }
+    }
+
+    #[test]
+    fn publishes_only_reachable_endpoints() {
+        assert_eq!(published_port("0.0.0.0:4317"), Some(4317));
+        assert_eq!(published_port("[::]:4318"), Some(4318));
+        assert_eq!(published_port("localhost:55679"), None);
+        assert_eq!(published_port("127.0.0.1:13133"), None);
+        assert_eq!(published_port("unix:///tmp/otlp.sock"), None);
+    }
+
+    #[test]
+    fn compose_runs_the_collector_with_the_config() {
+        let compose = service().compose();
+        for line in [
+            "# Apps on the same networks export OTLP/HTTP to http://lotel-collector:4318 or OTLP/gRPC to lotel-collector:4317.",
+            "      context: \"/src/lotel\"",
+            "        RUN cargo build --release -p lotel-cli",
+            "    command: [\"lotel-cli\", \"run-collector\", \"--config\", \"/etc/lotel/collector.yaml\", \"--data\", \"/home/me/.lotel/data\"]",
+            "    user: \"1000:1000\"",
+            "      HOME: \"/home/me\"",
+            "      LOTEL_DATA_DIR: \"/home/me/.lotel/data\"",
+            "      TZ: \"Europe/Berlin\"",
+            "      - \"/home/me/.lotel/collector-config.yaml:/etc/lotel/collector.yaml:ro\"",
+            "      - \"/home/me/.lotel/data:/home/me/.lotel/data\"",
+            "      - \"127.0.0.1:13133:13133\"",
+            "    networks: [default, lotel]",
+        ] {
+            assert!(compose.lines().any(|l| l == line), "{line}\n{compose}");
+        }
+    }
+
+    #[test]
+    fn devcontainer_joins_the_collector_network() {
+        let devcontainer = service().devcontainer();
+        assert_eq!(
+            devcontainer["runArgs"],
+            serde_json::json!(["--network=lotel"])
+        );
+        assert_eq!(
+            devcontainer["containerEnv"]["OTEL_EXPORTER_OTLP_ENDPOINT"],
+            "http://lotel-collector:4318"
+        );
+        assert!(
+            devcontainer["initializeCommand"]
+                .as_str()
+                .unwrap()
+                .contains(DEVCONTAINER_COMPOSE_FILE)
+        );
+    }
+}
@@ -13,22 +13,211 @@ pub struct CollectorState {
     pub started_at: String,
     pub config_path: String,
     pub data_path: String,
+    /// lotel release that started the collector; absent in state files of older releases.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub version: Option<String>,
+    /// Git commit of that build; absent in state files of older releases.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub commit: Option<String>,
+    #[serde(flatten)]
+    pub identity: ProcessIdentity,
+    #[serde(flatten)]
+    pub options: LaunchOptions,
 }
 
-fn state_file_path() -> Result<PathBuf> {
+/// What tells the collector apart from a later process that the OS gave the same PID.
+/// Fields that could not be read are left out, and state files of older releases have none.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ProcessIdentity {
+    /// When the process started, as the OS reports it (clock ticks since boot on Linux).
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub process_started: Option<String>,
+    /// SHA-256 of the path of the process's executable.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub exe_hash: Option<String>,
+}
+
+impl ProcessIdentity {
+    /// Whether `current` can be the same process: every field both sides know agrees.
+    fn matches(&self, current: &ProcessIdentity) -> bool {
+        let agree = |recorded: &Option<String>, now: &Option<String>| match (recorded, now) {
+            (Some(recorded), Some(now)) => recorded == now,
+            _ => true,
+        };
+        agree(&self.process_started, &current.process_started)
+            && agree(&self.exe_hash, &current.exe_hash)
+    }
+}
+
+/// How `lotel start` launched a collector, kept in its state so `lotel upgrade` launches it
+/// the same way.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct LaunchOptions {
+    /// Named collectors keep their state, log, and data under `~/.lotel/collectors/<name>`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub name: Option<String>,
+    #[serde(flatten)]
+    pub limits: ResourceLimits,
+    #[serde(flatten)]
+    pub ports: PortOverrides,
+    /// `--env` entries.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub env: Vec<String>,
+    #[serde(flatten)]
+    pub receivers: ReceiverOptions,
+}
+
+/// How the receivers accept exports; the files each option uses are in `instance_dir`.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize, Deserialize)]
+pub struct ReceiverOptions {
+    /// OTLP/gRPC is served over TLS with the certificates in [`tls_dir`].
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub tls: bool,
+    /// The receivers require the bearer token in `instance_dir`.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub auth: bool,
+    /// OTLP/gRPC listens on [`socket_path`] instead of a port.
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub unix_socket: bool,
+}
+
+impl ReceiverOptions {
+    /// The `run-collector` flags that apply these options.
+    fn args(&self) -> Vec<&'static str> {
+        [
+            ("--tls", self.tls),
+            ("--auth", self.auth),
+            ("--unix-socket", self.unix_socket),
+        ]
+        .into_iter()
+        .filter_map(|(flag, on)| on.then_some(flag))
+        .collect()
+    }
+}
+
+/// CPU and memory limits for the collector process.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ResourceLimits {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub memory_mib: Option<u64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub cpus: Option<usize>,
+}
+
+impl ResourceLimits {
+    /// The `run-collector` flags that apply these limits.
+    fn args(&self) -> Vec<String> {
+        let mut args = Vec::new();
+        if let Some(mib) = self.memory_mib {
+            args.extend(["--memory".to_string(), format!("{mib}m")]);
+        }
+        if let Some(cpus) = self.cpus {
+            args.extend(["--cpus".to_string(), cpus.to_string()]);
+        }
+        args
+    }
+}
+
+/// Ports that replace the config's, so several collectors can run side by side.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct PortOverrides {
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub otlp_grpc_port: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub otlp_http_port: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub health_port: Option<u16>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub zpages_port: Option<u16>,
+}
+
+impl PortOverrides {
+    /// The `run-collector` flags that apply these ports.
+    fn args(&self) -> Vec<String> {
+        [
+            ("--otlp-grpc-port", self.otlp_grpc_port),
+            ("--otlp-http-port", self.otlp_http_port),
+            ("--health-port", self.health_port),
+            ("--zpages-port", self.zpages_port),
+        ]
+        .into_iter()
+        .filter_map(|(flag, port)| port.map(|p| [flag.to_string(), p.to_string()]))
+        .flatten()
+        .collect()
+    }
+}
+
+/// Collector names become directory names, so they are limited to letters, digits, `-`,
+/// and `_`.
+pub fn validate_name(name: &str) -> Result<()> {
+    if name.is_empty()
+        || !name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_')
+    {
+        anyhow::bail!("invalid collector name {name:?}: use letters, digits, '-', and '_'");
+    }
+    Ok(())
+}
+
+/// Parse a memory size such as `512m` or `2g` (units `k`, `m`, `g`, optionally followed by
+/// `b` or `ib`) into MiB.
+pub fn parse_memory_mib(s: &str) -> Result<u64> {
+    let invalid =
+        || anyhow::anyhow!("invalid memory size {s:?} (expected e.g. \"512m\" or \"2g\")");
+    let lower = s.trim().to_ascii_lowercase();
+    let unit_start = lower
+        .find(|c: char| !c.is_ascii_digit() && c != '.')
+        .ok_or_else(invalid)?;
+    let value: f64 = lower[..unit_start].parse().map_err(|_| invalid())?;
+    let unit = lower[unit_start..]
+        .trim_end_matches("ib")
+        .trim_end_matches('b');
+    let mib = match unit {
+        "k" => value / 1024.0,
+        "m" => value,
+        "g" => value * 1024.0,
+        _ => return Err(invalid()),
+    };
+    if mib < 1.0 {
+        anyhow::bail!("memory size {s:?} is below 1 MiB");
+    }
+    Ok(mib as u64)
+}
+
+/// Where a collector keeps its state file and log: `~/.lotel`, or
+/// `~/.lotel/collectors/<name>` for a named one, which also holds its `data` directory.
+pub fn instance_dir(name: Option<&str>) -> Result<PathBuf> {
     let home = dirs::home_dir().context("cannot determine home directory")?;
-    Ok(home.join(".lotel").join("collector.state"))
+    Ok(match name {
+        Some(name) => home.join(".lotel").join("collectors").join(name),
+        None => home.join(".lotel"),
+    })
+}
+
+/// Where `start --tls` keeps a collector's CA and server certificate.
+pub fn tls_dir(name: Option<&str>) -> Result<PathBuf> {
+    Ok(instance_dir(name)?.join("tls"))
+}
+
+/// The OTLP/gRPC socket of `start --unix-socket`.
+pub fn socket_path(name: Option<&str>) -> Result<PathBuf> {
+    Ok(instance_dir(name)?.join("otlp.sock"))
 }
 
-fn lotel_dir() -> Result<PathBuf> {
+fn state_file_path(name: Option<&str>) -> Result<PathBuf> {
+    Ok(instance_dir(name)?.join("collector.state"))
+}
+
+pub fn lotel_dir() -> Result<PathBuf> {
     let home = dirs::home_dir().context("cannot determine home directory")?;
     let dir = home.join(".lotel");
     fs::create_dir_all(&dir)?;
     Ok(dir)
 }
 
-pub fn read_state() -> Result<Option<CollectorState>> {
-    let path = state_file_path()?;
+pub fn read_state(name: Option<&str>) -> Result<Option<CollectorState>> {
+    let path = state_file_path(name)?;
     if !path.exists() {
         return Ok(None);
     }
@@ -37,7 +226,7 @@ pub fn read_state() -> Result<Option<CollectorState>> {
         Ok(state) => Ok(Some(state)),
         Err(_) => {
             // State file is from an incompatible version; discard it.
-            eprintln!("Warning: collector.state has incompatible format, removing it.");
+            tracing::warn!("collector.state has incompatible format, removing it.");
             fs::remove_file(&path)?;
             Ok(None)
         }
@@ -45,27 +234,156 @@ pub fn read_state() -> Result<Option<CollectorState>> {
 }
 
 pub fn write_state(state: &CollectorState) -> Result<()> {
-    let path = state_file_path()?;
+    let path = state_file_path(state.options.name.as_deref())?;
     if let Some(parent) = path.parent() {
         fs::create_dir_all(parent)?;
     }
     // Write to temp file then rename for atomicity.
     let tmp_path = path.with_extension("tmp");
-    let mut file = fs::File::create(&tmp_path)?;
+    let mut options = fs::OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    // `--env` entries may be credentials; keep the file private.
+    #[cfg(unix)]
+    std::os::unix::fs::OpenOptionsExt::mode(&mut options, 0o600);
+    let mut file = options.open(&tmp_path)?;
     file.write_all(serde_json::to_string_pretty(state)?.as_bytes())?;
     file.flush()?;
     fs::rename(&tmp_path, &path)?;
     Ok(())
 }
 
-pub fn remove_state() -> Result<()> {
-    let path = state_file_path()?;
+pub fn remove_state(name: Option<&str>) -> Result<()> {
+    let path = state_file_path(name)?;
     if path.exists() {
         fs::remove_file(&path)?;
     }
     Ok(())
 }
 
+/// Whether the collector `state` describes is still running: its PID is alive and, when
+/// the state recorded them, the process's start time and executable are unchanged.
+pub fn is_running(state: &CollectorState) -> bool {
+    is_pid_alive(state.pid) && state.identity.matches(&process_identity(state.pid))
+}
+
+/// Whether the collector `state` describes runs this build: the release and commit match,
+/// and it was started from this executable. A rebuild at the same version does not, nor does
+/// a collector whose state file predates the commit being recorded.
+pub fn runs_this_build(state: &CollectorState) -> bool {
+    let exe_hash = process_identity(std::process::id()).exe_hash;
+    state.version.as_deref() == Some(crate::version::VERSION)
+        && state.commit.as_deref() == Some(env!("LOTEL_COMMIT"))
+        && state.identity.exe_hash.is_some()
+        && state.identity.exe_hash == exe_hash
+}
+
+/// Read the identity of process `pid`.
+pub fn process_identity(pid: u32) -> ProcessIdentity {
+    let exe_hash = process_exe(pid).map(|exe| {
+        use sha2::{Digest, Sha256};
+        hex::encode(Sha256::digest(exe.as_bytes()))
+    });
+    ProcessIdentity {
+        process_started: process_start_time(pid),
+        exe_hash,
+    }
+}
+
+#[cfg(target_os = "linux")]
+fn process_start_time(pid: u32) -> Option<String> {
+    // Field 22 of stat; the command name before it is parenthesized and may hold spaces.
+    let stat = fs::read_to_string(format!("/proc/{pid}/stat")).ok()?;
+    let (_, fields) = stat.rsplit_once(')')?;
+    fields.split_whitespace().nth(19).map(String::from)
+}
+
+#[cfg(target_os = "linux")]
+fn process_exe(pid: u32) -> Option<String> {
+    let exe = fs::read_link(format!("/proc/{pid}/exe")).ok()?;
+    let exe = exe.to_string_lossy();
+    // A binary replaced by an install still runs, under its old path marked as deleted.
+    Some(exe.strip_suffix(" (deleted)").unwrap_or(&exe).to_string())
+}
+
+#[cfg(not(target_os = "linux"))]
+fn process_start_time(pid: u32) -> Option<String> {
+    ps_field(pid, "lstart=")
+}
+
+#[cfg(not(target_os = "linux"))]
+fn process_exe(pid: u32) -> Option<String> {
+    // macOS and the BSDs report the full executable path as `comm`.
+    ps_field(pid, "comm=")
+}
+
+#[cfg(not(target_os = "linux"))]
+fn ps_field(pid: u32, field: &str) -> Option<String> {
+    let output = Command::new("ps")
+        .args(["-o", field, "-p", &pid.to_string()])
+        .output()
+        .ok()?;
+    let value = String::from_utf8(output.stdout).ok()?.trim().to_string();
+    (output.status.success() && !value.is_empty()).then_some(value)
+}
+
+/// PIDs and command lines of this user's `run-collector` processes.
+pub fn find_collector_processes() -> Vec<(u32, Vec<String>)> {
+    list_processes()
+        .into_iter()
+        .filter(|(pid, args)| {
+            *pid != std::process::id() && args.get(1).is_some_and(|a| a == "run-collector")
+        })
+        .collect()
+}
+
+#[cfg(target_os = "linux")]
+fn list_processes() -> Vec<(u32, Vec<String>)> {
+    use std::os::unix::fs::MetadataExt;
+    let uid = unsafe { libc::getuid() };
+    let Ok(entries) = fs::read_dir("/proc") else {
+        return Vec::new();
+    };
+    entries
+        .flatten()
+        .filter_map(|entry| {
+            let pid: u32 = entry.file_name().to_str()?.parse().ok()?;
+            if entry.metadata().ok()?.uid() != uid {
+                return None;
+            }
+            let cmdline = fs::read(entry.path().join("cmdline")).ok()?;
+            let args = cmdline
+                .split(|&b| b == 0)
+                .filter(|arg| !arg.is_empty())
+                .map(|arg| String::from_utf8_lossy(arg).into_owned())
+                .collect();
+            Some((pid, args))
+        })
+        .collect()
+}
+
+/// From `ps`, which joins arguments with spaces; paths containing spaces do not survive.
+#[cfg(not(target_os = "linux"))]
+fn list_processes() -> Vec<(u32, Vec<String>)> {
+    let uid = unsafe { libc::getuid() }.to_string();
+    let Ok(output) = Command::new("ps")
+        .args(["-axo", "uid=,pid=,args="])
+        .output()
+    else {
+        return Vec::new();
+    };
+    String::from_utf8_lossy(&output.stdout)
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split_whitespace();
+            if fields.next()? != uid {
+                return None;
+            }
+            let pid = fields.next()?.parse().ok()?;
+            Some((pid, fields.map(String::from).collect()))
+        })
+        .collect()
+}
+
 pub fn is_pid_alive(pid: u32) -> bool {
     let cmdline_path = format!("/proc/{pid}/cmdline");
     if let Ok(cmdline) = fs::read_to_string(&cmdline_path) {
@@ -100,27 +418,53 @@ pub fn stop_process(pid: u32, timeout: Duration) -> Result<()> {
     Ok(())
 }
 
-pub fn cleanup_stale_state() -> Result<()> {
-    if let Some(state) = read_state()?
-        && !is_pid_alive(state.pid)
+pub fn cleanup_stale_state(name: Option<&str>) -> Result<()> {
+    if let Some(state) = read_state(name)?
+        && !is_running(&state)
     {
-        remove_state()?;
+        remove_state(name)?;
     }
     Ok(())
 }
 
-pub fn spawn_collector(config_path: &Path, data_path: &Path) -> Result<u32> {
+/// The `run-collector` invocation of this binary for the given settings. `env` holds the
+/// resolved variables; the data directory is passed in `LOTEL_DATA_DIR` so `${DATA_DIR}`
+/// in the config resolves to it.
+fn collector_command(
+    config_path: &Path,
+    data_path: &Path,
+    options: &LaunchOptions,
+    env: &[(String, String)],
+) -> Result<Command> {
     let exe = std::env::current_exe().context("cannot determine current executable")?;
-    let lotel_dir = lotel_dir()?;
-    let log_file = fs::File::create(lotel_dir.join("collector.log"))?;
-    let stderr_file = log_file.try_clone()?;
-
-    let child = Command::new(exe)
+    let mut command = Command::new(exe);
+    command
         .arg("run-collector")
         .arg("--config")
         .arg(config_path)
         .arg("--data")
         .arg(data_path)
+        .args(options.name.iter().flat_map(|name| ["--name", name]))
+        .args(options.limits.args())
+        .args(options.ports.args())
+        .args(options.receivers.args())
+        .envs(env.iter().map(|(k, v)| (k, v)))
+        .env(lotel_storage::DATA_DIR_ENV, data_path);
+    Ok(command)
+}
+
+pub fn spawn_collector(
+    config_path: &Path,
+    data_path: &Path,
+    options: &LaunchOptions,
+    env: &[(String, String)],
+) -> Result<u32> {
+    let dir = instance_dir(options.name.as_deref())?;
+    fs::create_dir_all(&dir)?;
+    let log_file = fs::File::create(dir.join("collector.log"))?;
+    let stderr_file = log_file.try_clone()?;
+
+    let child = collector_command(config_path, data_path, options, env)?
         .stdout(Stdio::from(log_file))
         .stderr(Stdio::from(stderr_file))
         .spawn()
@@ -128,3 +472,132 @@ pub fn spawn_collector(config_path: &Path, data_path: &Path) -> Result<u32> {
 
     Ok(child.id())
 }
+
+/// Run the collector attached to the terminal until it exits. Ctrl-C reaches the collector
+/// too (same process group) and it shuts down gracefully; this process keeps waiting for it
+/// rather than exiting first.
+pub fn run_collector_attached(
+    config_path: &Path,
+    data_path: &Path,
+    options: &LaunchOptions,
+    env: &[(String, String)],
+) -> Result<std::process::ExitStatus> {
+    let mut command = collector_command(config_path, data_path, options, env)?;
+    // Marks it as not adoptable: nothing should record state for or stop a foreground run.
+    command.arg("--attached");
+    let mut command = tokio::process::Command::from(command);
+    let rt = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()?;
+    rt.block_on(async {
+        let mut child = command
+            .spawn()
+            .context("failed to spawn collector process")?;
+        loop {
+            tokio::select! {
+                status = child.wait() => return Ok(status?),
+                _ = tokio::signal::ctrl_c() => {}
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_memory_sizes() {
+        assert_eq!(parse_memory_mib("512m").unwrap(), 512);
+        assert_eq!(parse_memory_mib("2G").unwrap(), 2048);
+        assert_eq!(parse_memory_mib("1.5gb").unwrap(), 1536);
+        assert_eq!(parse_memory_mib("256MiB").unwrap(), 256);
+        assert_eq!(parse_memory_mib("4096k").unwrap(), 4);
+        for bad in ["512", "m", "12x", "100k", ""] {
+            assert!(parse_memory_mib(bad).is_err(), "{bad}");
+        }
+    }
+
+    #[test]
+    fn state_without_limits_still_parses() {
+        let state: CollectorState =
+            serde_json::from_str(r#"{"pid":1,"started_at":"t","config_path":"c","data_path":"d"}"#)
+                .unwrap();
+        assert_eq!(state.options, LaunchOptions::default());
+        let limits = ResourceLimits {
+            memory_mib: Some(512),
+            cpus: Some(2),
+        };
+        assert_eq!(limits.args(), ["--memory", "512m", "--cpus", "2"]);
+    }
+
+    #[test]
+    fn launch_options_round_trip_flat() {
+        let options = LaunchOptions {
+            name: Some("payments".into()),
+            ports: PortOverrides {
+                otlp_http_port: Some(4320),
+                ..Default::default()
+            },
+            receivers: ReceiverOptions {
+                unix_socket: true,
+                ..Default::default()
+            },
+            ..Default::default()
+        };
+        let json = serde_json::to_value(&options).unwrap();
+        assert_eq!(
+            json,
+            serde_json::json!({"name": "payments", "otlp_http_port": 4320, "unix_socket": true})
+        );
+        assert_eq!(
+            serde_json::from_value::<LaunchOptions>(json).unwrap(),
+            options
+        );
+        assert_eq!(options.ports.args(), ["--otlp-http-port", "4320"]);
+        assert_eq!(options.receivers.args(), ["--unix-socket"]);
+    }
+
+    #[test]
+    fn identity_detects_a_reused_pid() {
+        let me = process_identity(std::process::id());
+        assert!(me.process_started.is_some());
+        assert!(me.matches(&process_identity(std::process::id())));
+
+        let other = ProcessIdentity {
+            process_started: Some("1".into()),
+            ..me.clone()
+        };
+        assert!(!other.matches(&me));
+        // Older state files recorded nothing, so only the PID is checked.
+        assert!(ProcessIdentity::default().matches(&me));
+    }
+
+    #[test]
+    fn detects_a_collector_on_another_build() {
+        let mut state = CollectorState {
+            pid: std::process::id(),
+            started_at: "2024-03-09T16:00:00Z".into(),
+            config_path: "/tmp/config.yaml".into(),
+            data_path: "/tmp/data".into(),
+            version: Some(crate::version::VERSION.into()),
+            commit: Some(env!("LOTEL_COMMIT").into()),
+            identity: process_identity(std::process::id()),
+            options: LaunchOptions::default(),
+        };
+        assert!(runs_this_build(&state));
+        state.identity.exe_hash = Some("0".repeat(64));
+        assert!(!runs_this_build(&state));
+        state.identity = process_identity(std::process::id());
+        state.commit = None;
+        assert!(!runs_this_build(&state));
+    }
+
+    #[test]
+    fn validates_collector_names() {
+        assert!(validate_name("payments-v2_a").is_ok());
+        for bad in ["", "../x", "a b", "a/b"] {
+            assert!(validate_name(bad).is_err(), "{bad}");
+        }
+    }
+}
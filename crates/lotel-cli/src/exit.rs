@@ -0,0 +1,215 @@
+//! Exit statuses and the final error report. Each kind of failure has its own status, and
+//! `--error-format json` reports the error as one JSON object on stderr, so wrappers can
+//! branch on the failure instead of parsing messages.
+
+use clap::{Parser, ValueEnum};
+use serde::Serialize;
+
+/// Why a command failed. The statuses are stable; new kinds get new numbers.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum ExitKind {
+    /// Any failure not classified below.
+    Error,
+    /// Invalid flags or flag combinations (clap's usage errors use the same status).
+    BadArgs,
+    /// The collector is not running.
+    NotRunning,
+    /// The collector or the store is up but failing its health check.
+    Unhealthy,
+    /// Nothing matched: no database, trace, metric, or spans to report on.
+    NoData,
+    /// `assert` or `diff` found a failed check or a regression, or a `smoke` stage failed.
+    AssertionFailed,
+    /// Ctrl-C.
+    Interrupted,
+}
+
+impl ExitKind {
+    pub fn code(self) -> i32 {
+        match self {
+            ExitKind::Error => 1,
+            ExitKind::BadArgs => 2,
+            ExitKind::NotRunning => 3,
+            ExitKind::Unhealthy => 4,
+            ExitKind::NoData => 5,
+            ExitKind::AssertionFailed => 6,
+            ExitKind::Interrupted => 130,
+        }
+    }
+}
+
+/// An error that exits with its kind's status. Context added on top keeps the kind.
+#[derive(Debug)]
+pub struct Failure {
+    pub kind: ExitKind,
+    pub message: String,
+}
+
+impl std::fmt::Display for Failure {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(&self.message)
+    }
+}
+
+impl std::error::Error for Failure {}
+
+pub fn fail(kind: ExitKind, message: impl Into<String>) -> anyhow::Error {
+    Failure {
+        kind,
+        message: message.into(),
+    }
+    .into()
+}
+
+/// `bail!` for invalid flags: return a [`ExitKind::BadArgs`] failure.
+macro_rules! bad_args {
+    ($($arg:tt)*) => {
+        return Err($crate::exit::fail($crate::exit::ExitKind::BadArgs, format!($($arg)*)))
+    };
+}
+pub(crate) use bad_args;
+
+/// Exit with `kind`'s status after the command already printed its result, such as a
+/// failed assertion report.
+pub fn exit(kind: ExitKind) -> ! {
+    std::process::exit(kind.code())
+}
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+pub enum ErrorFormat {
+    /// `error: message: cause`
+    Text,
+    /// `{"error": kind, "exit_code": N, "message": ..., "causes": [...]}`
+    Json,
+}
+
+/// Environment variable equivalent of `--error-format`.
+pub const ERROR_FORMAT_ENV: &str = "LOTEL_ERROR_FORMAT";
+
+/// The kind of `err`: the innermost [`Failure`], [`ExitKind::Interrupted`] for cancelled
+/// storage work, otherwise [`ExitKind::Error`].
+pub fn classify(err: &anyhow::Error) -> ExitKind {
+    if let Some(failure) = err.downcast_ref::<Failure>() {
+        failure.kind
+    } else if err.is::<lotel_storage::Cancelled>() {
+        ExitKind::Interrupted
+    } else {
+        ExitKind::Error
+    }
+}
+
+#[derive(Debug, Serialize)]
+struct ErrorReport {
+    error: ExitKind,
+    exit_code: i32,
+    message: String,
+    causes: Vec<String>,
+}
+
+/// Print `err` to stderr in `format` and exit with its status.
+pub fn report(err: &anyhow::Error, format: ErrorFormat) -> ! {
+    let kind = classify(err);
+    match format {
+        ErrorFormat::Text => eprintln!("error: {err:#}"),
+        ErrorFormat::Json => {
+            let report = ErrorReport {
+                error: kind,
+                exit_code: kind.code(),
+                message: err.to_string(),
+                causes: err.chain().skip(1).map(|c| c.to_string()).collect(),
+            };
+            eprintln!("{}", serde_json::to_string(&report).unwrap_or_default());
+        }
+    }
+    exit(kind)
+}
+
+/// Parse the command line. Usage errors exit with [`ExitKind::BadArgs`], as JSON when
+/// `--error-format json` appears among the arguments (it may not have parsed).
+pub fn parse_args<C: Parser>() -> C {
+    let args: Vec<String> = std::env::args().collect();
+    match C::try_parse_from(&args) {
+        Ok(cli) => cli,
+        Err(e) if !e.use_stderr() || requested_format(&args) == ErrorFormat::Text => e.exit(),
+        Err(e) => report(
+            &fail(ExitKind::BadArgs, first_line(&e.to_string())),
+            ErrorFormat::Json,
+        ),
+    }
+}
+
+fn first_line(s: &str) -> &str {
+    s.trim()
+        .lines()
+        .next()
+        .unwrap_or_default()
+        .trim_start_matches("error: ")
+}
+
+fn requested_format(args: &[String]) -> ErrorFormat {
+    let flag = args
+        .iter()
+        .position(|a| a == "--error-format")
+        .and_then(|i| args.get(i + 1).cloned())
+        .or_else(|| {
+            args.iter()
+                .find_map(|a| a.strip_prefix("--error-format=").map(String::from))
+        })
+        .or_else(|| std::env::var(ERROR_FORMAT_ENV).ok());
+    match flag.as_deref() {
+        Some("json") => ErrorFormat::Json,
+        _ => ErrorFormat::Text,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::Context;
+
+    #[test]
+    fn kinds_survive_context() {
+        let err = Err::<(), _>(fail(ExitKind::NoData, "no spans found for trace abc"))
+            .context("rendering waterfall")
+            .unwrap_err();
+        assert_eq!(classify(&err), ExitKind::NoData);
+        assert_eq!(classify(&anyhow::anyhow!("disk full")), ExitKind::Error);
+        let cancelled = anyhow::Error::from(lotel_storage::Cancelled).context("ingesting traces");
+        assert_eq!(classify(&cancelled), ExitKind::Interrupted);
+    }
+
+    #[test]
+    fn codes_are_distinct() {
+        let kinds = [
+            ExitKind::Error,
+            ExitKind::BadArgs,
+            ExitKind::NotRunning,
+            ExitKind::Unhealthy,
+            ExitKind::NoData,
+            ExitKind::AssertionFailed,
+            ExitKind::Interrupted,
+        ];
+        let mut codes: Vec<i32> = kinds.iter().map(|k| k.code()).collect();
+        codes.sort();
+        codes.dedup();
+        assert_eq!(codes.len(), kinds.len());
+        assert_eq!(
+            serde_json::to_value(ExitKind::AssertionFailed).unwrap(),
+            "assertion_failed"
+        );
+    }
+
+    #[test]
+    fn finds_the_requested_format() {
+        let args = |s: &str| -> Vec<String> { s.split(' ').map(String::from).collect() };
+        assert_eq!(
+            requested_format(&args("lotel --error-format json query")),
+            ErrorFormat::Json
+        );
+        assert_eq!(
+            requested_format(&args("lotel --error-format=json query")),
+            ErrorFormat::Json
+        );
+    }
+}
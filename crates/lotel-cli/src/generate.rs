@@ -0,0 +1,548 @@
+//! Synthetic OTLP traffic for `lotel gen`: multi-service traces with variable latency and
+//! errors, plus correlated logs and request counters, exported over gRPC.
+
+use std::collections::BTreeMap;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use anyhow::{Context, Result};
+use opentelemetry_proto::tonic::collector::logs::v1::ExportLogsServiceRequest;
+use opentelemetry_proto::tonic::collector::logs::v1::logs_service_client::LogsServiceClient;
+use opentelemetry_proto::tonic::collector::metrics::v1::ExportMetricsServiceRequest;
+use opentelemetry_proto::tonic::collector::metrics::v1::metrics_service_client::MetricsServiceClient;
+use opentelemetry_proto::tonic::collector::trace::v1::ExportTraceServiceRequest;
+use opentelemetry_proto::tonic::collector::trace::v1::trace_service_client::TraceServiceClient;
+use opentelemetry_proto::tonic::common::v1::{AnyValue, KeyValue, any_value};
+use opentelemetry_proto::tonic::logs::v1::{LogRecord, ResourceLogs, ScopeLogs};
+use opentelemetry_proto::tonic::metrics::v1::{
+    Metric, NumberDataPoint, ResourceMetrics, ScopeMetrics, Sum, metric, number_data_point,
+};
+use opentelemetry_proto::tonic::resource::v1::Resource;
+use opentelemetry_proto::tonic::trace::v1::{ResourceSpans, ScopeSpans, Span, Status};
+use serde::Serialize;
+
+/// Traces per export request, keeping messages well under gRPC size limits.
+pub const MAX_BATCH: usize = 200;
+
+const KIND_SERVER: i32 = 2;
+const KIND_CLIENT: i32 = 3;
+const STATUS_ERROR: i32 = 2;
+const SEVERITY_INFO: i32 = 9;
+const SEVERITY_ERROR: i32 = 17;
+const CUMULATIVE: i32 = 2;
+
+/// One operation in the simulated topology: a server span in `service`, preceded by a
+/// client span in the caller. Leaf operations with `db` set are uninstrumented
+/// dependencies and only get the caller's client span.
+struct Op {
+    service: &'static str,
+    name: &'static str,
+    /// Median time spent in the operation itself, excluding calls.
+    median_ms: f64,
+    /// Whether this operation can fail on its own.
+    fallible: bool,
+    db: Option<&'static str>,
+    calls: &'static [Op],
+}
+
+const fn op(service: &'static str, name: &'static str, median_ms: f64) -> Op {
+    Op {
+        service,
+        name,
+        median_ms,
+        fallible: false,
+        db: None,
+        calls: &[],
+    }
+}
+
+const fn db(system: &'static str, service: &'static str, name: &'static str, ms: f64) -> Op {
+    Op {
+        db: Some(system),
+        ..op(service, name, ms)
+    }
+}
+
+const ROUTES: &[Op] = &[
+    Op {
+        calls: &[db("redis", "cache", "GET session", 1.0)],
+        ..op("frontend", "GET /", 8.0)
+    },
+    Op {
+        calls: &[Op {
+            calls: &[db("postgresql", "postgres", "SELECT products", 6.0)],
+            ..op("catalog", "GET /products/{id}", 12.0)
+        }],
+        ..op("frontend", "GET /product/{id}", 10.0)
+    },
+    Op {
+        calls: &[Op {
+            calls: &[
+                op("inventory", "GET /stock", 15.0),
+                Op {
+                    fallible: true,
+                    ..op("payments", "POST /charge", 60.0)
+                },
+                db("postgresql", "postgres", "INSERT orders", 8.0),
+            ],
+            ..op("checkout", "POST /orders", 20.0)
+        }],
+        ..op("frontend", "POST /checkout", 15.0)
+    },
+];
+
+pub struct GenConfig {
+    pub endpoint: String,
+    /// Traces per second.
+    pub rate: f64,
+    /// Stop after this long; run until Ctrl-C when unset.
+    pub duration: Option<Duration>,
+    /// Fraction of fallible operations that fail.
+    pub error_rate: f64,
+    pub seed: u64,
+}
+
+/// Totals sent, printed when the generator stops.
+#[derive(Debug, Default, Serialize)]
+pub struct GenReport {
+    pub traces: u64,
+    pub spans: u64,
+    pub error_traces: u64,
+    pub logs: u64,
+    pub metric_points: u64,
+    pub elapsed_secs: f64,
+}
+
+/// Send traffic to `config.endpoint` until the duration elapses or Ctrl-C.
+pub async fn run(config: &GenConfig) -> Result<GenReport> {
+    let channel = tonic::transport::Endpoint::from_shared(config.endpoint.clone())
+        .with_context(|| format!("invalid endpoint {:?}", config.endpoint))?
+        .connect()
+        .await
+        .with_context(|| format!("connecting to {}", config.endpoint))?;
+    let mut traces = TraceServiceClient::new(channel.clone());
+    let mut logs = LogsServiceClient::new(channel.clone());
+    let mut metrics = MetricsServiceClient::new(channel);
+
+    let mut generator = Generator::new(config.seed, config.error_rate);
+    let mut report = GenReport::default();
+    let start = Instant::now();
+    let mut ticker = tokio::time::interval(Duration::from_secs(1));
+    let ctrl_c = tokio::signal::ctrl_c();
+    tokio::pin!(ctrl_c);
+    let mut due = 0.0;
+
+    loop {
+        tokio::select! {
+            _ = ticker.tick() => {}
+            _ = &mut ctrl_c => break,
+        }
+        if config.duration.is_some_and(|d| start.elapsed() >= d) {
+            break;
+        }
+        due += config.rate;
+        let mut pending = due.floor() as usize;
+        due -= pending as f64;
+        while pending > 0 {
+            let n = pending.min(MAX_BATCH);
+            pending -= n;
+            let batch = generator.batch(n, unix_nanos());
+            report.traces += n as u64;
+            report.spans += batch.spans;
+            report.error_traces += batch.error_traces;
+            report.logs += batch.logs;
+            report.metric_points += batch.metric_points;
+            traces
+                .export(batch.traces)
+                .await
+                .context("exporting traces")?;
+            logs.export(batch.log_records)
+                .await
+                .context("exporting logs")?;
+            metrics
+                .export(batch.metrics)
+                .await
+                .context("exporting metrics")?;
+        }
+    }
+    report.elapsed_secs = start.elapsed().as_secs_f64();
+    Ok(report)
+}
+
+pub(crate) fn unix_nanos() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_nanos() as u64)
+        .unwrap_or_default()
+}
+
+/// One export's worth of generated telemetry.
+pub struct Batch {
+    pub traces: ExportTraceServiceRequest,
+    pub log_records: ExportLogsServiceRequest,
+    pub metrics: ExportMetricsServiceRequest,
+    pub spans: u64,
+    pub error_traces: u64,
+    pub logs: u64,
+    pub metric_points: u64,
+}
+
+/// Builds traces from [`ROUTES`] and keeps per-service cumulative request counters.
+pub struct Generator {
+    rng: Rng,
+    error_rate: f64,
+    started_ns: u64,
+    requests: BTreeMap<&'static str, u64>,
+}
+
+/// Telemetry of the trace being built, grouped by service.
+#[derive(Default)]
+struct TraceParts {
+    spans: BTreeMap<&'static str, Vec<Span>>,
+    logs: BTreeMap<&'static str, Vec<LogRecord>>,
+}
+
+impl Generator {
+    pub fn new(seed: u64, error_rate: f64) -> Self {
+        Self {
+            rng: Rng(seed),
+            error_rate,
+            started_ns: 0,
+            requests: BTreeMap::new(),
+        }
+    }
+
+    /// Generate `n` traces that started within the second before `now_ns`.
+    pub fn batch(&mut self, n: usize, now_ns: u64) -> Batch {
+        if self.started_ns == 0 {
+            self.started_ns = now_ns;
+        }
+        let mut parts = TraceParts::default();
+        let mut error_traces = 0;
+        for _ in 0..n {
+            let route = &ROUTES[self.rng.below(ROUTES.len())];
+            let trace_id = self.rng.bytes(16);
+            let start = now_ns.saturating_sub((self.rng.f64() * 1e9) as u64);
+            let (_, failed) = self.server_span(route, &trace_id, Vec::new(), start, &mut parts);
+            error_traces += u64::from(failed);
+        }
+
+        let spans = parts.spans.values().map(|s| s.len() as u64).sum();
+        let logs = parts.logs.values().map(|l| l.len() as u64).sum();
+        let metrics = self.counters(now_ns);
+        Batch {
+            traces: ExportTraceServiceRequest {
+                resource_spans: parts
+                    .spans
+                    .into_iter()
+                    .map(|(service, spans)| ResourceSpans {
+                        resource: Some(resource(service)),
+                        scope_spans: vec![ScopeSpans {
+                            spans,
+                            ..Default::default()
+                        }],
+                        ..Default::default()
+                    })
+                    .collect(),
+            },
+            log_records: ExportLogsServiceRequest {
+                resource_logs: parts
+                    .logs
+                    .into_iter()
+                    .map(|(service, log_records)| ResourceLogs {
+                        resource: Some(resource(service)),
+                        scope_logs: vec![ScopeLogs {
+                            log_records,
+                            ..Default::default()
+                        }],
+                        ..Default::default()
+                    })
+                    .collect(),
+            },
+            metric_points: metrics.len() as u64,
+            metrics: ExportMetricsServiceRequest {
+                resource_metrics: metrics,
+            },
+            spans,
+            error_traces,
+            logs,
+        }
+    }
+
+    /// Emit the server span for `op` and everything it calls. Returns its end time and
+    /// whether it failed.
+    fn server_span(
+        &mut self,
+        op: &Op,
+        trace_id: &[u8],
+        parent_span_id: Vec<u8>,
+        start: u64,
+        parts: &mut TraceParts,
+    ) -> (u64, bool) {
+        let span_id = self.rng.bytes(8);
+        let self_ns = self.latency_ns(op.median_ms);
+        let mut cursor = start + self_ns / 2;
+        let mut failed = op.fallible && self.rng.f64() < self.error_rate;
+
+        for call in op.calls {
+            let (end, call_failed) = self.client_span(op, call, trace_id, &span_id, cursor, parts);
+            cursor = end;
+            failed |= call_failed;
+        }
+        let end = cursor + self_ns / 2;
+
+        let status_code = if failed { 500 } else { 200 };
+        let (method, route) = op.name.split_once(' ').unwrap_or(("GET", op.name));
+        parts.spans.entry(op.service).or_default().push(Span {
+            trace_id: trace_id.to_vec(),
+            span_id: span_id.clone(),
+            parent_span_id,
+            name: op.name.to_string(),
+            kind: KIND_SERVER,
+            start_time_unix_nano: start,
+            end_time_unix_nano: end,
+            attributes: vec![
+                string_attr("http.request.method", method),
+                string_attr("http.route", route),
+                int_attr("http.response.status_code", status_code),
+            ],
+            status: failed.then(|| Status {
+                code: STATUS_ERROR,
+                message: format!("{} failed", op.name),
+            }),
+            ..Default::default()
+        });
+
+        let (severity_number, severity_text, body) = if failed {
+            (
+                SEVERITY_ERROR,
+                "ERROR",
+                format!("{} failed with status 500", op.name),
+            )
+        } else {
+            let ms = (end - start) as f64 / 1e6;
+            (
+                SEVERITY_INFO,
+                "INFO",
+                format!("{} completed in {ms:.1}ms", op.name),
+            )
+        };
+        parts.logs.entry(op.service).or_default().push(LogRecord {
+            time_unix_nano: end,
+            observed_time_unix_nano: end,
+            severity_number,
+            severity_text: severity_text.to_string(),
+            body: Some(AnyValue {
+                value: Some(any_value::Value::StringValue(body)),
+            }),
+            trace_id: trace_id.to_vec(),
+            span_id,
+            ..Default::default()
+        });
+        *self.requests.entry(op.service).or_default() += 1;
+        (end, failed)
+    }
+
+    /// Emit the caller's client span for `call`, and the callee's server span unless it is
+    /// an uninstrumented database.
+    fn client_span(
+        &mut self,
+        caller: &Op,
+        call: &Op,
+        trace_id: &[u8],
+        parent_span_id: &[u8],
+        start: u64,
+        parts: &mut TraceParts,
+    ) -> (u64, bool) {
+        let span_id = self.rng.bytes(8);
+        let network_ns = self.latency_ns(0.5);
+        let mut attributes = vec![string_attr("peer.service", call.service)];
+        let (end, failed) = match call.db {
+            Some(system) => {
+                attributes.push(string_attr("db.system", system));
+                let failed = call.fallible && self.rng.f64() < self.error_rate;
+                (start + network_ns + self.latency_ns(call.median_ms), failed)
+            }
+            None => {
+                let (end, failed) = self.server_span(
+                    call,
+                    trace_id,
+                    span_id.clone(),
+                    start + network_ns / 2,
+                    parts,
+                );
+                (end + network_ns / 2, failed)
+            }
+        };
+        parts.spans.entry(caller.service).or_default().push(Span {
+            trace_id: trace_id.to_vec(),
+            span_id,
+            parent_span_id: parent_span_id.to_vec(),
+            name: call.name.to_string(),
+            kind: KIND_CLIENT,
+            start_time_unix_nano: start,
+            end_time_unix_nano: end,
+            attributes,
+            status: failed.then(|| Status {
+                code: STATUS_ERROR,
+                message: format!("{} failed", call.name),
+            }),
+            ..Default::default()
+        });
+        (end, failed)
+    }
+
+    /// Log-normal latency around `median_ms`, giving a long tail.
+    fn latency_ns(&mut self, median_ms: f64) -> u64 {
+        (median_ms * (0.5 * self.rng.normal()).exp() * 1e6) as u64
+    }
+
+    /// Cumulative `http.server.request.count` per service.
+    fn counters(&self, now_ns: u64) -> Vec<ResourceMetrics> {
+        self.requests
+            .iter()
+            .map(|(service, count)| ResourceMetrics {
+                resource: Some(resource(service)),
+                scope_metrics: vec![ScopeMetrics {
+                    metrics: vec![Metric {
+                        name: "http.server.request.count".into(),
+                        unit: "{request}".into(),
+                        data: Some(metric::Data::Sum(Sum {
+                            data_points: vec![NumberDataPoint {
+                                start_time_unix_nano: self.started_ns,
+                                time_unix_nano: now_ns,
+                                value: Some(number_data_point::Value::AsInt(*count as i64)),
+                                ..Default::default()
+                            }],
+                            aggregation_temporality: CUMULATIVE,
+                            is_monotonic: true,
+                        })),
+                        ..Default::default()
+                    }],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            })
+            .collect()
+    }
+}
+
+pub(crate) fn resource(service: &str) -> Resource {
+    Resource {
+        attributes: vec![string_attr("service.name", service)],
+        ..Default::default()
+    }
+}
+
+pub(crate) fn string_attr(key: &str, value: &str) -> KeyValue {
+    KeyValue {
+        key: key.into(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::StringValue(value.into())),
+        }),
+    }
+}
+
+pub(crate) fn int_attr(key: &str, value: i64) -> KeyValue {
+    KeyValue {
+        key: key.into(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::IntValue(value)),
+        }),
+    }
+}
+
+/// SplitMix64: small, seedable, and good enough for synthetic traffic.
+struct Rng(u64);
+
+impl Rng {
+    fn next_u64(&mut self) -> u64 {
+        self.0 = self.0.wrapping_add(0x9E37_79B9_7F4A_7C15);
+        let mut z = self.0;
+        z = (z ^ (z >> 30)).wrapping_mul(0xBF58_476D_1CE4_E5B9);
+        z = (z ^ (z >> 27)).wrapping_mul(0x94D0_49BB_1331_11EB);
+        z ^ (z >> 31)
+    }
+
+    /// Uniform in [0, 1).
+    fn f64(&mut self) -> f64 {
+        (self.next_u64() >> 11) as f64 / (1u64 << 53) as f64
+    }
+
+    fn below(&mut self, n: usize) -> usize {
+        (self.next_u64() % n as u64) as usize
+    }
+
+    /// Standard normal via Box-Muller.
+    fn normal(&mut self) -> f64 {
+        let u = 1.0 - self.f64();
+        let v = self.f64();
+        (-2.0 * u.ln()).sqrt() * (std::f64::consts::TAU * v).cos()
+    }
+
+    fn bytes(&mut self, n: usize) -> Vec<u8> {
+        (0..n).map(|_| self.next_u64() as u8).collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn all_spans(batch: &Batch) -> Vec<&Span> {
+        batch
+            .traces
+            .resource_spans
+            .iter()
+            .flat_map(|rs| &rs.scope_spans)
+            .flat_map(|ss| &ss.spans)
+            .collect()
+    }
+
+    #[test]
+    fn spans_form_connected_traces() {
+        let batch = Generator::new(7, 0.0).batch(50, 1_710_000_000_000_000_000);
+        let spans = all_spans(&batch);
+        assert_eq!(spans.len() as u64, batch.spans);
+        assert_eq!(
+            spans.iter().filter(|s| s.parent_span_id.is_empty()).count(),
+            50
+        );
+        for span in &spans {
+            assert!(span.end_time_unix_nano >= span.start_time_unix_nano);
+            if !span.parent_span_id.is_empty() {
+                assert!(
+                    spans
+                        .iter()
+                        .any(|p| p.trace_id == span.trace_id && p.span_id == span.parent_span_id)
+                );
+            }
+        }
+        assert_eq!(batch.error_traces, 0);
+        assert!(batch.metric_points > 0);
+    }
+
+    #[test]
+    fn errors_propagate_to_root() {
+        let mut generator = Generator::new(7, 1.0);
+        let batch = generator.batch(30, 1_710_000_000_000_000_000);
+        let spans = all_spans(&batch);
+        let failed_roots = spans
+            .iter()
+            .filter(|s| s.parent_span_id.is_empty() && s.status.is_some())
+            .count();
+        assert!(failed_roots > 0);
+        assert_eq!(failed_roots as u64, batch.error_traces);
+        assert!(
+            spans
+                .iter()
+                .all(|s| s.name != "GET /" || s.status.is_none())
+        );
+    }
+
+    #[test]
+    fn seed_makes_traffic_reproducible() {
+        let a = Generator::new(42, 0.1).batch(5, 1_710_000_000_000_000_000);
+        let b = Generator::new(42, 0.1).batch(5, 1_710_000_000_000_000_000);
+        assert_eq!(a.traces, b.traces);
+    }
+}
@@ -0,0 +1,281 @@
+//! `lotel serve --grpc`: `lotel.query.v1.QueryService` over the local store. The message
+//! types and the client are generated in the `lotel-proto` crate.
+
+use std::net::SocketAddr;
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, NaiveDateTime};
+use lotel_proto::prost_types::Timestamp;
+use lotel_proto::query::v1 as pb;
+use pb::query_service_server::{QueryService, QueryServiceServer};
+use tonic::{Request, Response, Status};
+
+use crate::daemon;
+use crate::serve::with_store;
+
+/// Rows returned when a request leaves `limit` at 0, as `lotel query` does.
+const DEFAULT_LIMIT: usize = 100;
+
+/// Serve the query service until Ctrl-C.
+pub async fn serve(addr: SocketAddr) -> Result<()> {
+    tonic::transport::Server::builder()
+        .add_service(QueryServiceServer::new(QueryApi))
+        .serve_with_shutdown(addr, async {
+            let _ = tokio::signal::ctrl_c().await;
+        })
+        .await
+        .with_context(|| format!("serving gRPC on {addr}"))
+}
+
+struct QueryApi;
+
+#[tonic::async_trait]
+impl QueryService for QueryApi {
+    async fn query_traces(
+        &self,
+        request: Request<pb::QueryRequest>,
+    ) -> Result<Response<pb::QueryTracesResponse>, Status> {
+        let opts = query_opts(request.into_inner())?;
+        let spans = with_store(move |conn| lotel_storage::query_traces(conn, &opts))
+            .await
+            .map_err(query_failed)?;
+        Ok(Response::new(pb::QueryTracesResponse {
+            spans: spans.into_iter().map(span).collect(),
+        }))
+    }
+
+    async fn query_metrics(
+        &self,
+        request: Request<pb::QueryRequest>,
+    ) -> Result<Response<pb::QueryMetricsResponse>, Status> {
+        let opts = query_opts(request.into_inner())?;
+        let points = with_store(move |conn| lotel_storage::query_metrics(conn, &opts))
+            .await
+            .map_err(query_failed)?;
+        Ok(Response::new(pb::QueryMetricsResponse {
+            points: points.into_iter().map(metric_point).collect(),
+        }))
+    }
+
+    async fn query_logs(
+        &self,
+        request: Request<pb::QueryRequest>,
+    ) -> Result<Response<pb::QueryLogsResponse>, Status> {
+        let opts = query_opts(request.into_inner())?;
+        let records = with_store(move |conn| lotel_storage::query_logs(conn, &opts))
+            .await
+            .map_err(query_failed)?;
+        Ok(Response::new(pb::QueryLogsResponse {
+            records: records.into_iter().map(log_record).collect(),
+        }))
+    }
+
+    async fn aggregate(
+        &self,
+        request: Request<pb::AggregateRequest>,
+    ) -> Result<Response<pb::AggregateResponse>, Status> {
+        let request = request.into_inner();
+        if request.metrics.is_empty() {
+            return Err(Status::invalid_argument(
+                "metrics must name at least one metric",
+            ));
+        }
+        let opts = query_opts(request.filter.unwrap_or_default())?;
+        let aggregations = with_store(move |conn| {
+            lotel_storage::metric_names(conn, &opts, &request.metrics)?
+                .iter()
+                .map(|name| lotel_storage::aggregate_metrics(conn, &opts, name))
+                .collect::<Result<Vec<_>>>()
+        })
+        .await
+        .map_err(query_failed)?;
+        Ok(Response::new(pb::AggregateResponse {
+            aggregations: aggregations
+                .into_iter()
+                .map(|a| pb::MetricAggregation {
+                    metric_name: a.metric_name,
+                    service_name: a.service_name,
+                    count: a.count,
+                    avg: a.avg,
+                    min: a.min,
+                    max: a.max,
+                })
+                .collect(),
+        }))
+    }
+
+    async fn status(
+        &self,
+        _request: Request<pb::StatusRequest>,
+    ) -> Result<Response<pb::StatusResponse>, Status> {
+        let state = tokio::task::spawn_blocking(|| crate::collector_state(None))
+            .await
+            .map_err(|e| Status::internal(e.to_string()))?
+            .map_err(|e| Status::internal(format!("{e:#}")))?;
+        let Some(state) = state else {
+            return Ok(Response::new(pb::StatusResponse::default()));
+        };
+        let running = daemon::is_running(&state);
+        let healthy = running && crate::check_health(&crate::health_url(&state)).await;
+        Ok(Response::new(pb::StatusResponse {
+            running,
+            healthy,
+            pid: Some(state.pid),
+            started_at: DateTime::parse_from_rfc3339(&state.started_at)
+                .ok()
+                .map(|t| timestamp(t.naive_utc())),
+            config_path: Some(state.config_path),
+            data_path: Some(state.data_path),
+        }))
+    }
+}
+
+/// The store filters a request asks for.
+fn query_opts(request: pb::QueryRequest) -> Result<lotel_storage::QueryOptions, Status> {
+    let attrs = request
+        .attrs
+        .iter()
+        .map(|attr| {
+            let op = match attr.op() {
+                pb::attr_filter::Op::Unspecified | pb::attr_filter::Op::Eq => {
+                    lotel_storage::AttrOp::Eq
+                }
+                pb::attr_filter::Op::Ne => lotel_storage::AttrOp::Ne,
+                pb::attr_filter::Op::Gt => lotel_storage::AttrOp::Gt,
+                pb::attr_filter::Op::Ge => lotel_storage::AttrOp::Ge,
+                pb::attr_filter::Op::Lt => lotel_storage::AttrOp::Lt,
+                pb::attr_filter::Op::Le => lotel_storage::AttrOp::Le,
+            };
+            lotel_storage::AttrFilter {
+                key: attr.key.clone(),
+                op,
+                value: attr.value.clone(),
+            }
+        })
+        .collect();
+    Ok(lotel_storage::QueryOptions {
+        service: request.service,
+        since: request.since.map(naive_time).transpose()?,
+        until: request.until.map(naive_time).transpose()?,
+        limit: Some(match request.limit {
+            0 => DEFAULT_LIMIT,
+            limit => limit as usize,
+        }),
+        attrs,
+        trace_id: request.trace_id,
+        kind: request.kind,
+        status_code: request.status_code,
+        min_severity: request.min_severity,
+        min_duration_ns: request.min_duration_ns,
+        ..Default::default()
+    })
+}
+
+fn query_failed(err: anyhow::Error) -> Status {
+    if err.is::<lotel_storage::Cancelled>() {
+        return Status::deadline_exceeded("query timed out");
+    }
+    Status::internal(format!("{err:#}"))
+}
+
+fn naive_time(ts: Timestamp) -> Result<NaiveDateTime, Status> {
+    u32::try_from(ts.nanos)
+        .ok()
+        .and_then(|nanos| DateTime::from_timestamp(ts.seconds, nanos))
+        .map(|t| t.naive_utc())
+        .ok_or_else(|| Status::invalid_argument(format!("invalid timestamp {ts:?}")))
+}
+
+fn timestamp(t: NaiveDateTime) -> Timestamp {
+    let t = t.and_utc();
+    Timestamp {
+        seconds: t.timestamp(),
+        nanos: t.timestamp_subsec_nanos() as i32,
+    }
+}
+
+/// Attributes as a JSON object, `{}` when there are none.
+fn attributes_json(attributes: Option<serde_json::Value>) -> String {
+    attributes.map_or_else(|| "{}".to_string(), |a| a.to_string())
+}
+
+fn span(span: lotel_storage::TraceResult) -> pb::Span {
+    pb::Span {
+        trace_id: span.trace_id,
+        span_id: span.span_id,
+        parent_span_id: span.parent_span_id,
+        name: span.name,
+        kind: span.kind,
+        start_time: Some(timestamp(span.start_time)),
+        end_time: span.end_time.map(timestamp),
+        duration_ns: span.duration_ns,
+        status_code: span.status_code,
+        service_name: span.service_name,
+        attributes: attributes_json(span.attributes),
+    }
+}
+
+fn metric_point(point: lotel_storage::MetricResult) -> pb::MetricPoint {
+    pb::MetricPoint {
+        metric_name: point.metric_name,
+        metric_type: point.metric_type,
+        value: point.value,
+        timestamp: Some(timestamp(point.timestamp)),
+        service_name: point.service_name,
+        aggregation_temporality: point.aggregation_temporality,
+        is_monotonic: point.is_monotonic,
+        unit: point.unit,
+        attributes: attributes_json(point.attributes),
+    }
+}
+
+fn log_record(log: lotel_storage::LogResult) -> pb::LogRecord {
+    pb::LogRecord {
+        timestamp: Some(timestamp(log.timestamp)),
+        severity: log.severity,
+        severity_number: log.severity_number,
+        body: log.body,
+        service_name: log.service_name,
+        trace_id: log.trace_id,
+        span_id: log.span_id,
+        attributes: attributes_json(log.attributes),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn maps_requests_onto_query_options() {
+        let opts = query_opts(pb::QueryRequest {
+            service: Some("checkout".to_string()),
+            since: Some(Timestamp {
+                seconds: 1_700_000_000,
+                nanos: 5,
+            }),
+            attrs: vec![pb::AttrFilter {
+                key: "retries".to_string(),
+                op: pb::attr_filter::Op::Gt as i32,
+                value: "3".to_string(),
+            }],
+            ..Default::default()
+        })
+        .unwrap();
+        assert_eq!(opts.service.as_deref(), Some("checkout"));
+        assert_eq!(opts.limit, Some(DEFAULT_LIMIT));
+        assert_eq!(opts.attrs[0].op, lotel_storage::AttrOp::Gt);
+        let since = opts.since.unwrap();
+        assert_eq!(timestamp(since).seconds, 1_700_000_000);
+        assert_eq!(timestamp(since).nanos, 5);
+
+        let bad = pb::QueryRequest {
+            until: Some(Timestamp {
+                seconds: 0,
+                nanos: -1,
+            }),
+            ..Default::default()
+        };
+        assert!(query_opts(bad).is_err());
+    }
+}
@@ -0,0 +1,258 @@
+//! lotel's own log output: status and progress messages go to stderr through `tracing`,
+//! filtered by `--verbose`/`--quiet` (or `LOTEL_LOG`) and written as plain lines or, with
+//! `--log-format json`, one JSON object per line. Results stay on stdout, so scripts and CI
+//! can pipe them and still parse or silence the messages.
+
+use std::fmt;
+
+use anyhow::{Context, Result};
+use clap::ValueEnum;
+use serde_json::Value;
+use tracing::field::{Field, Visit};
+use tracing::{Event, Level, Subscriber};
+use tracing_subscriber::filter::{LevelFilter, Targets};
+use tracing_subscriber::fmt::format::Writer;
+use tracing_subscriber::fmt::{FmtContext, FormatEvent, FormatFields};
+use tracing_subscriber::prelude::*;
+use tracing_subscriber::registry::LookupSpan;
+
+use crate::json::Json;
+
+/// Overrides the verbosity flags with `tracing` target directives, e.g.
+/// `lotel_storage=debug,info`.
+pub const LOG_ENV: &str = "LOTEL_LOG";
+
+/// Crates whose messages the verbosity flags control; dependencies only log warnings
+/// until `-vv`.
+pub(crate) const OWN_TARGETS: [&str; 4] =
+    ["lotel", "lotel_cli", "lotel_collector", "lotel_storage"];
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+pub enum LogFormat {
+    /// Plain messages; warnings and errors are prefixed with their level
+    Text,
+    /// One JSON object per line: timestamp, level, target, message, and fields
+    Json,
+}
+
+/// Install the stderr logger. `quiet` keeps warnings and errors; each `verbose` step adds
+/// a level (debug, then trace for every crate). `recorder` also collects lotel's spans for
+/// self-instrumentation.
+pub fn init(
+    verbose: u8,
+    quiet: bool,
+    format: LogFormat,
+    recorder: Option<crate::selftel::Recorder>,
+) -> Result<()> {
+    let filter = match std::env::var(LOG_ENV) {
+        Ok(directives) if !directives.trim().is_empty() => directives
+            .parse::<Targets>()
+            .with_context(|| format!("invalid {LOG_ENV} value {directives:?}"))?,
+        _ => verbosity_filter(verbose, quiet),
+    };
+    let layer = tracing_subscriber::fmt::layer()
+        .event_format(Lines { format })
+        .with_writer(std::io::stderr)
+        .with_filter(filter);
+    tracing_subscriber::registry()
+        .with(layer)
+        .with(recorder.map(|r| r.with_filter(crate::selftel::filter())))
+        .try_init()
+        .context("installing the logger")
+}
+
+fn verbosity_filter(verbose: u8, quiet: bool) -> Targets {
+    let (own, deps) = match (quiet, verbose) {
+        (true, _) => (LevelFilter::WARN, LevelFilter::WARN),
+        (false, 0) => (LevelFilter::INFO, LevelFilter::WARN),
+        (false, 1) => (LevelFilter::DEBUG, LevelFilter::WARN),
+        (false, _) => (LevelFilter::TRACE, LevelFilter::TRACE),
+    };
+    Targets::new()
+        .with_default(deps)
+        .with_targets(OWN_TARGETS.map(|target| (target, own)))
+}
+
+/// Event formatter for both output formats. Spans are not rendered: lotel logs events only.
+struct Lines {
+    format: LogFormat,
+}
+
+impl<S, N> FormatEvent<S, N> for Lines
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+    N: for<'a> FormatFields<'a> + 'static,
+{
+    fn format_event(
+        &self,
+        _ctx: &FmtContext<'_, S, N>,
+        mut writer: Writer<'_>,
+        event: &Event<'_>,
+    ) -> fmt::Result {
+        let mut fields = Fields::default();
+        event.record(&mut fields);
+        let meta = event.metadata();
+        match self.format {
+            LogFormat::Text => writeln!(writer, "{}", text_line(meta.level(), &fields)),
+            LogFormat::Json => {
+                let mut line = vec![
+                    (
+                        "timestamp".to_string(),
+                        Json::String(
+                            chrono::Utc::now().to_rfc3339_opts(chrono::SecondsFormat::Millis, true),
+                        ),
+                    ),
+                    (
+                        "level".to_string(),
+                        Json::String(meta.level().as_str().to_lowercase()),
+                    ),
+                    (
+                        "target".to_string(),
+                        Json::String(meta.target().to_string()),
+                    ),
+                    ("message".to_string(), Json::String(fields.message)),
+                ];
+                line.extend(fields.values.into_iter().map(|(k, v)| (k, Json::from(v))));
+                writeln!(writer, "{}", Json::Object(line))
+            }
+        }
+    }
+}
+
+/// `warning: message key=value ...`; informational messages have no prefix, so they read
+/// like the plain status lines they replace.
+fn text_line(level: &Level, fields: &Fields) -> String {
+    let prefix = match *level {
+        Level::ERROR => "error: ",
+        Level::WARN => "warning: ",
+        Level::INFO => "",
+        Level::DEBUG => "debug: ",
+        Level::TRACE => "trace: ",
+    };
+    let mut line = format!("{prefix}{}", fields.message);
+    for (key, value) in &fields.values {
+        match value {
+            Value::String(s) => line.push_str(&format!(" {key}={s}")),
+            other => line.push_str(&format!(" {key}={other}")),
+        }
+    }
+    line
+}
+
+/// An event's message and its other fields, in the order they were written.
+#[derive(Default)]
+struct Fields {
+    message: String,
+    values: Vec<(String, Value)>,
+}
+
+impl Fields {
+    fn insert(&mut self, field: &Field, value: Value) {
+        if field.name() == "message" {
+            self.message = match value {
+                Value::String(s) => s,
+                other => other.to_string(),
+            };
+        } else {
+            self.values.push((field.name().to_string(), value));
+        }
+    }
+}
+
+impl Visit for Fields {
+    fn record_debug(&mut self, field: &Field, value: &dyn fmt::Debug) {
+        self.insert(field, format!("{value:?}").into());
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        self.insert(field, value.into());
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.insert(field, value.into());
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.insert(field, value.into());
+    }
+
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        self.insert(field, value.into());
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.insert(field, value.into());
+    }
+
+    fn record_error(&mut self, field: &Field, value: &(dyn std::error::Error + 'static)) {
+        self.insert(field, value.to_string().into());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::{Arc, Mutex};
+
+    /// Collects formatted output in memory.
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl std::io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> std::io::Result<usize> {
+            self.0.lock().unwrap().write(buf)
+        }
+
+        fn flush(&mut self) -> std::io::Result<()> {
+            Ok(())
+        }
+    }
+
+    fn capture(format: LogFormat, verbose: u8, quiet: bool) -> String {
+        let buffer = Buffer::default();
+        let writer = buffer.clone();
+        let subscriber = tracing_subscriber::registry().with(
+            tracing_subscriber::fmt::layer()
+                .event_format(Lines { format })
+                .with_writer(move || writer.clone())
+                .with_filter(verbosity_filter(verbose, quiet)),
+        );
+        tracing::subscriber::with_default(subscriber, || {
+            tracing::info!(rows = 3, "Ingestion complete");
+            tracing::warn!(path = "a b", "Skipping");
+            tracing::debug!("details");
+            tracing::info!(target: "hyper", "dependency chatter");
+        });
+        String::from_utf8(buffer.0.lock().unwrap().clone()).unwrap()
+    }
+
+    #[test]
+    fn verbosity_selects_levels() {
+        assert_eq!(
+            capture(LogFormat::Text, 0, false),
+            "Ingestion complete rows=3\nwarning: Skipping path=a b\n"
+        );
+        assert_eq!(
+            capture(LogFormat::Text, 0, true),
+            "warning: Skipping path=a b\n"
+        );
+        assert!(capture(LogFormat::Text, 1, false).ends_with("debug: details\n"));
+        assert!(capture(LogFormat::Text, 2, false).contains("dependency chatter"));
+    }
+
+    #[test]
+    fn json_lines_carry_fields() {
+        let out = capture(LogFormat::Json, 0, false);
+        let lines: Vec<Value> = out
+            .lines()
+            .map(|l| serde_json::from_str(l).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[0]["level"], "info");
+        assert_eq!(lines[0]["message"], "Ingestion complete");
+        assert_eq!(lines[0]["rows"], 3);
+        assert_eq!(lines[1]["level"], "warn");
+        assert_eq!(lines[1]["target"], "lotel_cli::log::tests");
+        assert!(lines[1]["timestamp"].as_str().unwrap().ends_with('Z'));
+    }
+}
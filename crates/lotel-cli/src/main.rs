@@ -1,11 +1,34 @@
+mod appenv;
+mod auth;
+mod bench;
+mod completion;
+mod container;
 mod daemon;
+mod exit;
+mod generate;
+mod grpc;
+mod json;
+mod log;
+mod output;
+mod rules;
+mod selftel;
+mod serve;
+mod shell;
+mod smoke;
+mod style;
+mod table;
+mod tail;
 mod time;
+mod tls;
+mod version;
+mod waterfall;
 
-use std::path::PathBuf;
+use std::io::{IsTerminal, Write};
+use std::path::{Path, PathBuf};
 use std::time::Duration;
 
-use anyhow::{Result, bail};
-use clap::{Parser, Subcommand};
+use anyhow::{Context, Result, bail};
+use clap::{Args, Parser, Subcommand, ValueEnum};
 use serde::Serialize;
 
 #[derive(Parser)]
@@ -14,6 +37,30 @@ use serde::Serialize;
     about = "Local OpenTelemetry — manage a collector and query telemetry"
 )]
 struct Cli {
+    /// Time zone for output timestamps and for today/yesterday: local, UTC, or an IANA name
+    #[arg(long, global = true, env = "LOTEL_TZ", default_value = "UTC")]
+    tz: String,
+    /// DuckDB memory cap (e.g. 1GB); overrides storage.memory_limit in the config
+    #[arg(long, global = true, env = "LOTEL_MEMORY_LIMIT")]
+    memory_limit: Option<String>,
+    /// DuckDB worker threads; overrides storage.threads in the config
+    #[arg(long, global = true, env = "LOTEL_THREADS")]
+    threads: Option<usize>,
+    /// More log output on stderr: -v for debug, -vv for trace including dependencies
+    #[arg(short, long, global = true, action = clap::ArgAction::Count, conflicts_with = "quiet")]
+    verbose: u8,
+    /// Only log warnings and errors on stderr
+    #[arg(short, long, global = true)]
+    quiet: bool,
+    /// Format of log lines on stderr
+    #[arg(long, global = true, value_enum, env = "LOTEL_LOG_FORMAT", default_value_t = log::LogFormat::Text)]
+    log_format: log::LogFormat,
+    /// Format of the error report on stderr; json prints one object with the exit kind
+    #[arg(long, global = true, value_enum, env = exit::ERROR_FORMAT_ENV, default_value_t = exit::ErrorFormat::Text)]
+    error_format: exit::ErrorFormat,
+    /// Print JSON in this schema version's field names (1 to the current version, or latest)
+    #[arg(long, global = true, env = output::OUTPUT_VERSION_ENV, default_value = "latest", value_parser = output::parse_version)]
+    output_version: u32,
     #[command(subcommand)]
     command: Command,
 }
@@ -25,39 +72,357 @@ enum Command {
         /// Wait for collector to become healthy before returning
         #[arg(long)]
         wait: bool,
+        /// Run attached to the terminal, logging there, until Ctrl-C; no state file is written
+        /// and `stop`/`status` do not see it
+        #[arg(long, conflicts_with = "wait")]
+        foreground: bool,
+        /// Start a separate, named collector with its own state, log, and data directory
+        /// under ~/.lotel/collectors/<name>; needs --config
+        #[arg(long)]
+        name: Option<String>,
+        /// Collector config to run instead of ./lotel-collector.yaml or
+        /// ~/.lotel/collector-config.yaml
+        #[arg(long)]
+        config: Option<PathBuf>,
+        #[command(flatten)]
+        limits: LimitArgs,
+        #[command(flatten)]
+        ports: PortArgs,
+        /// Set an environment variable in the collector process (repeatable); added to
+        /// the config's `environment` list, overriding entries with the same name
+        #[arg(long = "env", value_name = "KEY=VALUE")]
+        env: Vec<String>,
+        #[command(flatten)]
+        receivers: ReceiverArgs,
     },
     /// Stop the OTel Collector
-    Stop,
+    Stop {
+        /// The named collector (default: the unnamed one)
+        #[arg(long)]
+        name: Option<String>,
+    },
+    /// Restart the running collector on this lotel build and check its health (JSON)
+    Upgrade {
+        /// Restart even if the collector already runs this version
+        #[arg(long)]
+        force: bool,
+        /// The named collector (default: the unnamed one)
+        #[arg(long)]
+        name: Option<String>,
+    },
+    /// Record state for a collector process that is running without it (JSON)
+    Adopt {
+        /// The named collector (default: the unnamed one)
+        #[arg(long)]
+        name: Option<String>,
+    },
     /// Show collector status (JSON)
-    Status,
+    Status {
+        /// The named collector (default: the unnamed one)
+        #[arg(long)]
+        name: Option<String>,
+    },
     /// Check collector health (exit 0 if healthy, 1 if not)
-    Health,
+    Health {
+        /// The named collector (default: the unnamed one)
+        #[arg(long)]
+        name: Option<String>,
+    },
+    /// Inspect the running collector's internals, e.g. to find where its pipeline stalls
+    Collector {
+        #[command(subcommand)]
+        subcommand: CollectorCommand,
+    },
+    /// Print the OTEL_* variables that point an instrumented app at the collector, e.g.
+    /// `eval "$(lotel-cli env)"`
+    Env {
+        /// Shell syntax to print
+        #[arg(long, value_enum, default_value = "bash")]
+        shell: appenv::Shell,
+        #[command(flatten)]
+        app: AppEnvArgs,
+    },
+    /// Run a command with the OTEL_* variables of `env` set, e.g. `lotel-cli run -- npm start`;
+    /// exits with its status
+    Run {
+        #[command(flatten)]
+        app: AppEnvArgs,
+        /// The command and its arguments
+        #[arg(last = true, required = true, value_name = "COMMAND")]
+        command: Vec<std::ffi::OsString>,
+    },
     /// Ingest JSONL telemetry files into the query database
     Ingest {
-        /// Re-ingest all data from the beginning.
-        /// Clears existing telemetry data before re-ingesting.
+        #[command(subcommand)]
+        subcommand: Option<IngestCommand>,
+        #[command(flatten)]
+        args: IngestArgs,
+    },
+    /// Import telemetry exported by other tools into the query database
+    Import {
+        /// Format of the file
+        #[arg(long, value_enum)]
+        format: ImportFormat,
+        /// File to import ("-" reads stdin)
+        file: PathBuf,
+        /// Wait for a concurrent ingest to finish instead of failing
         #[arg(long)]
-        full: bool,
+        wait: bool,
     },
     /// Query telemetry data
     Query {
+        /// Run an incremental ingest before querying so results include the latest telemetry
+        #[arg(long, global = true, env = "LOTEL_QUERY_FRESH")]
+        fresh: bool,
+        /// Write one JSON object per line as rows are scanned instead of a JSON array
+        #[arg(long, global = true)]
+        stream: bool,
+        /// Only select and output these comma-separated columns, e.g. trace_id,name,duration_ns
+        #[arg(long, global = true)]
+        fields: Option<String>,
+        /// Print the generated SQL, bound parameters, and DuckDB's EXPLAIN ANALYZE plan
+        /// instead of the results
+        #[arg(long, global = true)]
+        explain: bool,
+        /// Re-run the query on this interval (e.g. 5s) and redraw the results as a table
+        #[arg(long, global = true, value_name = "INTERVAL")]
+        watch: Option<String>,
         #[command(subcommand)]
         subcommand: QueryCommand,
     },
+    /// Derive a service dependency graph from parent/child spans and peer.service
+    Graph {
+        #[arg(long)]
+        since: Option<String>,
+        #[arg(long)]
+        until: Option<String>,
+        /// Output format
+        #[arg(long, value_enum, default_value_t = GraphFormat::Json)]
+        format: GraphFormat,
+    },
+    /// List orphan spans (parent not in the store) and traces without exactly one root (JSON)
+    Orphans {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Maximum entries in each list
+        #[arg(long, default_value_t = 100)]
+        limit: usize,
+    },
+    /// Rank span names per service by p95 latency, call count, or error rate
+    TopSpans {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Ranking
+        #[arg(long, value_enum, default_value_t = TopSort::P95)]
+        sort: TopSort,
+        #[arg(long, default_value_t = 10)]
+        limit: usize,
+    },
+    /// Rate, errors, and duration per service from server/entry spans (JSON output)
+    Red {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Break each service down by http.route (or span name)
+        #[arg(long)]
+        by_route: bool,
+    },
+    /// Apdex score and SLO error-budget burn per service (JSON output)
+    Slo {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Latency a request must meet to count as good (e.g. 300ms)
+        #[arg(long)]
+        target_latency: String,
+        /// Required fraction of good requests (e.g. 99% or 0.99)
+        #[arg(long, default_value = "99%")]
+        objective: String,
+    },
+    /// Compare rate, error rate, and latency between two windows; exit 6 on regression
+    Diff {
+        /// Baseline window, e.g. 2h..1h
+        #[arg(long)]
+        baseline: String,
+        /// Current window, e.g. 1h..now
+        #[arg(long, default_value = "1h..now")]
+        current: String,
+        #[arg(long)]
+        service: Option<String>,
+        /// Relative increase in latency or error rate that counts as a regression
+        #[arg(long, default_value = "10%")]
+        threshold: String,
+    },
+    /// Check telemetry against assertions; prints a JSON report and exits 6 on failure
+    Assert {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Fail if any matching span has status ERROR
+        #[arg(long)]
+        no_error_spans: bool,
+        /// Fail if the p95 span duration exceeds this (e.g. 500ms)
+        #[arg(long)]
+        max_p95: Option<String>,
+        /// Fail if fewer spans than this were captured
+        #[arg(long)]
+        min_spans: Option<i64>,
+        /// Fail if any matching log is ERROR or worse
+        #[arg(long)]
+        no_error_logs: bool,
+        /// Fail if fewer logs than this were captured
+        #[arg(long)]
+        min_logs: Option<i64>,
+        /// Evaluate the named rules in this YAML file instead of the checks above; the
+        /// filters apply to rules that do not set their own
+        #[arg(long, conflicts_with_all = ["no_error_spans", "max_p95", "min_spans", "no_error_logs", "min_logs"])]
+        rules: Option<PathBuf>,
+        /// Also write the results as a JUnit XML report to this path
+        #[arg(long)]
+        junit: Option<PathBuf>,
+        /// Print failures as GitHub Actions annotations instead of JSON
+        #[arg(long)]
+        github: bool,
+    },
+    /// Measure performance on synthetic data (JSON output)
+    Bench {
+        #[command(subcommand)]
+        subcommand: BenchCommand,
+    },
+    /// Follow telemetry as it arrives, one line per record
+    Tail {
+        #[command(subcommand)]
+        subcommand: TailCommand,
+    },
+    /// Interactive prompt for query commands and SQL with history and tab completion
+    Shell,
+    /// Serve the store to other tools until Ctrl-C
+    Serve {
+        /// Prometheus exposition of stored and span-derived metrics at /metrics (e.g. :9464)
+        #[arg(long, value_name = "ADDR")]
+        prom: Option<String>,
+        /// HTTP API, including a Grafana JSON datasource at / (e.g. :8080)
+        #[arg(long, value_name = "ADDR")]
+        http: Option<String>,
+        /// gRPC query API, `lotel.query.v1.QueryService` (e.g. :4320)
+        #[arg(long, value_name = "ADDR")]
+        grpc: Option<String>,
+        /// Responses kept for repeated scrapes and dashboard refreshes until the next ingest
+        /// (0 disables caching)
+        #[arg(long, default_value_t = 256)]
+        cache_entries: usize,
+        /// Interrupt a request's query after this long (0s waits indefinitely)
+        #[arg(long, default_value = "30s", value_name = "DURATION")]
+        query_timeout: String,
+    },
+    /// Inspect and maintain the telemetry database
+    Db {
+        #[command(subcommand)]
+        subcommand: DbCommand,
+    },
+    /// Reports over captured logs
+    Logs {
+        #[command(subcommand)]
+        subcommand: LogsCommand,
+    },
+    /// Write captured telemetry in formats other tools read
+    Export {
+        #[command(subcommand)]
+        subcommand: ExportCommand,
+    },
+    /// Send synthetic multi-service traces, logs, and counters to a collector
+    Gen {
+        /// OTLP gRPC endpoint
+        #[arg(long, default_value = "http://localhost:4317")]
+        endpoint: String,
+        /// Traces per second
+        #[arg(long, default_value_t = 10.0)]
+        rate: f64,
+        /// Stop after this long (e.g. 30s, 5m); runs until Ctrl-C otherwise
+        #[arg(long)]
+        duration: Option<String>,
+        /// Fraction of payment calls that fail (e.g. 5% or 0.05; 0 disables errors)
+        #[arg(long, default_value = "5%")]
+        error_rate: String,
+        /// Seed for reproducible traffic
+        #[arg(long)]
+        seed: Option<u64>,
+    },
+    /// Move telemetry older than a threshold to Parquet in object storage; queries still
+    /// read it
+    Archive {
+        /// Age threshold (e.g., '7d', '24h', '2w', '1d12h')
+        #[arg(long)]
+        older_than: String,
+        /// Destination: s3://bucket/prefix, another DuckDB httpfs URL, or a local directory
+        #[arg(long)]
+        to: String,
+        /// Show what would be archived without moving anything
+        #[arg(long)]
+        dry_run: bool,
+    },
     /// Delete telemetry data older than a threshold
     Prune {
-        /// Age threshold (e.g., '7d', '24h', '1h')
+        #[command(subcommand)]
+        subcommand: Option<PruneCommand>,
+        /// Age threshold (e.g., '7d', '24h', '2w', '1d12h')
         #[arg(long)]
         older_than: Option<String>,
         /// Limit pruning to a specific service
         #[arg(long)]
         service: Option<String>,
+        /// Only spans or metrics with this name; `*` matches any text (e.g. 'health*')
+        #[arg(long)]
+        name: Option<String>,
+        /// Only records with this attribute: key=value, key!=value, or numeric key>3, key<=10
+        /// (repeatable)
+        #[arg(long = "attr", value_name = "FILTER")]
+        attrs: Vec<String>,
         /// Show what would be pruned without deleting
         #[arg(long)]
         dry_run: bool,
         /// Delete all telemetry data
         #[arg(long)]
         all: bool,
+        /// Also remove the raw JSONL export lines older than the threshold
+        #[arg(long)]
+        include_files: bool,
+        #[command(flatten)]
+        keep: KeepArgs,
+    },
+    /// Send a test span, metric, and log through the collector, files, ingest, and query,
+    /// reporting PASS/FAIL per stage
+    Smoke {
+        /// OTLP gRPC endpoint of the collector
+        #[arg(long, default_value = "http://localhost:4317")]
+        endpoint: String,
+        /// How long to wait for the data to reach the files, and then the database
+        #[arg(long, default_value = "30s")]
+        timeout: String,
+        /// Print the report as JSON
+        #[arg(long)]
+        json: bool,
+        /// Disable colors (also off when NO_COLOR is set or stdout is not a terminal)
+        #[arg(long)]
+        no_color: bool,
+    },
+    /// Build info and the running collector's version, with compatibility warnings (JSON)
+    Version,
+    /// Print a docker-compose service or devcontainer settings that run the collector with
+    /// the current config in a container
+    Generate {
+        #[command(subcommand)]
+        subcommand: GenerateCommand,
+    },
+    /// Print a shell completion script, e.g. `source <(lotel-cli completion bash)`
+    Completion {
+        #[arg(value_enum)]
+        shell: completion::Shell,
+    },
+    /// List stored values for shell completion (internal, used by the completion scripts)
+    #[command(name = "__complete", hide = true)]
+    Complete {
+        #[arg(value_enum)]
+        lookup: completion::Lookup,
+        #[arg(default_value = "")]
+        prefix: String,
     },
     /// Run the collector directly (internal, used for daemon self-spawn)
     #[command(hide = true)]
@@ -68,345 +433,3114 @@ enum Command {
         /// Path to data directory
         #[arg(long)]
         data: PathBuf,
+        #[command(flatten)]
+        limits: LimitArgs,
+        #[command(flatten)]
+        ports: PortArgs,
+        /// Name of a named collector, so `adopt` can tell collectors apart
+        #[arg(long)]
+        name: Option<String>,
+        /// Started by `start --foreground`; never adopted
+        #[arg(long)]
+        attached: bool,
+        #[command(flatten)]
+        receivers: ReceiverArgs,
     },
 }
 
+#[derive(Clone, Copy, ValueEnum)]
+enum ImportFormat {
+    /// Jaeger trace JSON, as downloaded from the UI or returned by its query API
+    Jaeger,
+    /// Zipkin v2 JSON: a span array or an array of traces
+    Zipkin,
+    /// Prometheus text exposition or OpenMetrics, e.g. a saved scrape
+    Openmetrics,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum GraphFormat {
+    Json,
+    Dot,
+    Mermaid,
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum TopSort {
+    P95,
+    Calls,
+    ErrorRate,
+}
+
+impl From<TopSort> for lotel_storage::SpanSort {
+    fn from(sort: TopSort) -> Self {
+        match sort {
+            TopSort::P95 => Self::P95,
+            TopSort::Calls => Self::Calls,
+            TopSort::ErrorRate => Self::ErrorRate,
+        }
+    }
+}
+
 #[derive(Subcommand)]
-enum QueryCommand {
-    /// Query traces (JSON output)
-    Traces {
-        #[arg(long)]
-        service: Option<String>,
+enum BenchCommand {
+    /// Time ingest of generated JSONL into a scratch database; reports rows/sec and DB size
+    Ingest {
+        /// Rows to generate across spans, logs, and metric points (e.g. 100k, 1M)
+        #[arg(long, default_value = "100k")]
+        rows: String,
+        /// Number of threads used to parse JSONL lines (defaults to the CPU count)
         #[arg(long)]
-        since: Option<String>,
+        workers: Option<usize>,
+        /// Seed for the generated data; keep it fixed to compare runs
+        #[arg(long, default_value_t = 1)]
+        seed: u64,
+        /// Keep the generated JSONL and database in this directory instead of a scratch dir
         #[arg(long)]
-        until: Option<String>,
+        dir: Option<PathBuf>,
+        /// Parse trace files with DuckDB's read_json, as `ingest --read-json` does
         #[arg(long)]
-        limit: Option<usize>,
+        read_json: bool,
     },
-    /// Query metrics (JSON output)
-    Metrics {
-        #[arg(long)]
-        service: Option<String>,
-        #[arg(long)]
-        since: Option<String>,
-        #[arg(long)]
-        until: Option<String>,
+    /// Time service-, time-, and trace-filtered span queries on generated data against an
+    /// unclustered, unindexed copy (JSON)
+    Query {
+        /// Rows to generate across spans, logs, and metric points (e.g. 100k, 1M)
+        #[arg(long, default_value = "1M")]
+        rows: String,
+        /// Seed for the generated data; keep it fixed to compare runs
+        #[arg(long, default_value_t = 1)]
+        seed: u64,
+        /// Keep the generated JSONL and database in this directory instead of a scratch dir
         #[arg(long)]
-        limit: Option<usize>,
+        dir: Option<PathBuf>,
     },
-    /// Query logs (JSON output)
+}
+
+#[derive(Subcommand)]
+enum IngestCommand {
+    /// Show past ingest runs (JSON output, newest first)
+    History {
+        #[arg(long, default_value_t = 20)]
+        limit: usize,
+    },
+}
+
+#[derive(Subcommand)]
+enum PruneCommand {
+    /// Show past prune runs, scheduled and manual (JSON output, newest first)
+    History {
+        #[arg(long, default_value_t = 20)]
+        limit: usize,
+    },
+}
+
+#[derive(Subcommand)]
+enum TailCommand {
+    /// Print new log records with colored severity and their trace IDs
     Logs {
+        #[command(flatten)]
+        follow: FollowArgs,
+        /// Only records at or above this severity: trace, debug, info, warn, error, fatal, or 1-24
         #[arg(long)]
-        service: Option<String>,
+        min_severity: Option<String>,
+    },
+    /// Print new spans on one line each: status, service, name, duration, trace ID
+    Traces {
+        #[command(flatten)]
+        follow: FollowArgs,
+        /// Only spans with status ERROR
+        #[arg(long, conflicts_with = "status")]
+        errors_only: bool,
+        /// Only spans with this status: unset, ok, error
         #[arg(long)]
-        since: Option<String>,
+        status: Option<String>,
+        /// Only spans of this kind: server, client, internal, producer, consumer
         #[arg(long)]
-        until: Option<String>,
+        kind: Option<String>,
+        /// Only spans lasting at least this long (e.g. 100ms)
         #[arg(long)]
-        limit: Option<usize>,
+        min_duration: Option<String>,
     },
-    /// Compute avg/min/max for a metric over a time window
-    Aggregate {
-        #[arg(long)]
-        metric: String,
+}
+
+#[derive(Subcommand)]
+enum CollectorCommand {
+    /// Fetch a zPages page from the collector (JSON), or open it in the browser
+    Zpages {
+        #[arg(value_enum, default_value = "pipelinez")]
+        page: ZPage,
+        /// Open the page in the browser instead of printing it
         #[arg(long)]
-        service: Option<String>,
+        open: bool,
+        /// The named collector (default: the unnamed one)
         #[arg(long)]
-        since: Option<String>,
+        name: Option<String>,
+    },
+    /// Sample the CPU time of each collector thread (JSON, busiest first; Linux only)
+    Pprof {
+        /// How long to sample
+        #[arg(long, default_value_t = 5, value_parser = clap::value_parser!(u64).range(1..=300))]
+        seconds: u64,
+        /// The named collector (default: the unnamed one)
         #[arg(long)]
-        until: Option<String>,
+        name: Option<String>,
     },
 }
 
-fn print_json<T: Serialize>(value: &T) {
-    let data = serde_json::to_string_pretty(value).expect("json serialization");
-    println!("{data}");
+#[derive(Args)]
+struct AppEnvArgs {
+    /// OTEL_SERVICE_NAME to set (default: the current directory's name, unless
+    /// OTEL_SERVICE_NAME is already set)
+    #[arg(long)]
+    service: Option<String>,
+    /// The named collector (default: the unnamed one)
+    #[arg(long)]
+    name: Option<String>,
 }
 
-fn main() -> Result<()> {
-    let cli = Cli::parse();
+#[derive(Subcommand)]
+enum GenerateCommand {
+    /// A docker-compose file with a `lotel-collector` service, built from the lotel source
+    Compose {
+        #[command(flatten)]
+        args: ContainerArgs,
+    },
+    /// devcontainer.json settings that start the compose service (saved as
+    /// .devcontainer/lotel-compose.yml) and point the dev container's SDKs at it (JSON)
+    Devcontainer {
+        #[command(flatten)]
+        args: ContainerArgs,
+    },
+}
 
-    match cli.command {
-        Command::Start { wait } => cmd_start(wait)?,
-        Command::Stop => cmd_stop()?,
-        Command::Status => cmd_status()?,
-        Command::Health => cmd_health()?,
-        Command::Ingest { full } => cmd_ingest(full)?,
-        Command::Query { subcommand } => cmd_query(subcommand)?,
-        Command::Prune {
-            older_than,
-            service,
-            dry_run,
-            all,
-        } => cmd_prune(older_than, service, dry_run, all)?,
-        Command::RunCollector { config, data: _ } => {
-            cmd_run_collector(&config)?;
-        }
-    }
+#[derive(Args)]
+struct ContainerArgs {
+    /// Collector config to run instead of ./lotel-collector.yaml or
+    /// ~/.lotel/collector-config.yaml
+    #[arg(long)]
+    config: Option<PathBuf>,
+    /// The lotel checkout to build the image from (default: the one this lotel was built
+    /// from)
+    #[arg(long)]
+    source: Option<PathBuf>,
+}
 
-    Ok(())
+#[derive(Clone, Copy, ValueEnum)]
+enum ZPage {
+    /// Exports accepted and refused per receiver, and how full the pipeline's queues are
+    Pipelinez,
+    /// Uptime, endpoints, memory use, and whether the memory limiter refuses exports
+    Servicez,
+}
+
+#[derive(Subcommand)]
+enum DbCommand {
+    /// Attribute keys by distinct-value count and rows carrying them, per signal (JSON)
+    Cardinality {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only this signal; all three by default
+        #[arg(long, value_enum)]
+        signal: Option<SignalArg>,
+        /// Keys to list per signal, highest cardinality first
+        #[arg(long, default_value_t = 20)]
+        limit: usize,
+    },
+    /// Encrypt an existing unencrypted database with the key in LOTEL_DB_KEY
+    Encrypt,
+    /// Rewrite the database to reclaim space left by pruned rows; reports sizes (JSON)
+    Compact {
+        /// Also re-sort telemetry by day, service, and time
+        #[arg(long)]
+        sort: bool,
+    },
+    /// Check that the configured store opens and answers a query (JSON; exit 4 if not)
+    Health,
 }
 
-fn cmd_start(wait: bool) -> Result<()> {
-    daemon::cleanup_stale_state()?;
+#[derive(Clone, Copy, ValueEnum)]
+enum SignalArg {
+    Traces,
+    Metrics,
+    Logs,
+}
 
-    if let Some(state) = daemon::read_state()? {
-        if daemon::is_pid_alive(state.pid) {
-            eprintln!("Collector is already running (PID {}).", state.pid);
-            return Ok(());
+impl From<SignalArg> for lotel_storage::Signal {
+    fn from(signal: SignalArg) -> Self {
+        match signal {
+            SignalArg::Traces => Self::Traces,
+            SignalArg::Metrics => Self::Metrics,
+            SignalArg::Logs => Self::Logs,
         }
-        daemon::remove_state()?;
     }
+}
 
-    let config_path =
-        lotel_collector::config::resolve_config_path().map_err(|e| anyhow::anyhow!("{e}"))?;
-    let data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
-
-    let pid = daemon::spawn_collector(&config_path, &data_path)?;
+#[derive(Subcommand)]
+enum LogsCommand {
+    /// Group log bodies by template (numbers, IDs, and IPs masked) and count each (JSON)
+    Patterns {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only records at or above this severity: trace, debug, info, warn, error, fatal, or 1-24
+        #[arg(long)]
+        min_severity: Option<String>,
+        /// Number of patterns to show, most frequent first
+        #[arg(long, default_value_t = 20)]
+        limit: usize,
+    },
+}
 
-    let state = daemon::CollectorState {
-        pid,
-        started_at: chrono::Utc::now().to_rfc3339(),
-        config_path: config_path.display().to_string(),
-        data_path: data_path.display().to_string(),
-    };
-    daemon::write_state(&state)?;
+#[derive(Subcommand)]
+enum ExportCommand {
+    /// Folded stacks of span self time (µs) for flamegraph.pl, inferno, or speedscope
+    Flamegraph {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only this trace (hex or base64); otherwise stacks are summed across traces
+        #[arg(long)]
+        trace_id: Option<String>,
+        /// Maximum number of traces to fold
+        #[arg(long)]
+        limit: Option<usize>,
+    },
+    /// OTLP JSON lines (resourceSpans/resourceMetrics/resourceLogs), the inverse of ingest
+    OtlpJson {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only this signal; all three by default
+        #[arg(long, value_enum)]
+        signal: Option<SignalArg>,
+    },
+}
 
-    eprintln!("Collector started (PID {pid}).");
+/// Resource limits of `lotel start`.
+#[derive(Args)]
+struct LimitArgs {
+    /// Refuse exports while the collector uses more memory than this (e.g. 512m, 2g); SDKs
+    /// retry them later
+    #[arg(long)]
+    memory: Option<String>,
+    /// Worker threads for the collector and its DuckDB connections
+    #[arg(long)]
+    cpus: Option<usize>,
+}
 
-    if wait {
-        eprint!("Waiting for collector to become healthy...");
-        let rt = tokio::runtime::Runtime::new()?;
-        let healthy = rt.block_on(async {
-            let client = reqwest::Client::new();
-            let start = std::time::Instant::now();
-            loop {
-                if start.elapsed() > Duration::from_secs(30) {
-                    return false;
-                }
-                match client.get("http://localhost:13133/").send().await {
-                    Ok(resp) if resp.status().is_success() => return true,
-                    _ => {}
-                }
-                tokio::time::sleep(Duration::from_millis(500)).await;
-            }
-        });
-        if healthy {
-            eprintln!(" OK");
-        } else {
-            eprintln!(" FAILED");
-            bail!("collector did not become healthy within 30s");
+impl LimitArgs {
+    fn limits(&self) -> Result<daemon::ResourceLimits> {
+        if self.cpus == Some(0) {
+            exit::bad_args!("--cpus must be at least 1");
         }
+        let memory_mib = match &self.memory {
+            Some(memory) => match daemon::parse_memory_mib(memory) {
+                Ok(mib) => Some(mib),
+                Err(e) => exit::bad_args!("--memory: {e}"),
+            },
+            None => None,
+        };
+        Ok(daemon::ResourceLimits {
+            memory_mib,
+            cpus: self.cpus,
+        })
     }
+}
 
-    Ok(())
+/// Port overrides of `lotel start`, for running several collectors at once.
+#[derive(Args)]
+struct PortArgs {
+    /// Listen for OTLP/gRPC on this port instead of the config's
+    #[arg(long, value_parser = clap::value_parser!(u16).range(1..))]
+    otlp_grpc_port: Option<u16>,
+    /// Listen for OTLP/HTTP on this port instead of the config's
+    #[arg(long, value_parser = clap::value_parser!(u16).range(1..))]
+    otlp_http_port: Option<u16>,
+    /// Serve the health check on this port instead of the config's
+    #[arg(long, value_parser = clap::value_parser!(u16).range(1..))]
+    health_port: Option<u16>,
+    /// Serve zPages on this port instead of the config's
+    #[arg(long, value_parser = clap::value_parser!(u16).range(1..))]
+    zpages_port: Option<u16>,
 }
 
-fn cmd_stop() -> Result<()> {
-    let state = daemon::read_state()?;
-    match state {
-        Some(state) if daemon::is_pid_alive(state.pid) => {
-            daemon::stop_process(state.pid, Duration::from_secs(10))?;
-            daemon::remove_state()?;
-            eprintln!("Collector stopped.");
-        }
-        Some(_) => {
-            daemon::remove_state()?;
-            eprintln!("Collector was not running (cleaned up stale state).");
-        }
-        None => {
-            eprintln!("Collector is not running.");
+impl PortArgs {
+    fn ports(&self) -> daemon::PortOverrides {
+        daemon::PortOverrides {
+            otlp_grpc_port: self.otlp_grpc_port,
+            otlp_http_port: self.otlp_http_port,
+            health_port: self.health_port,
+            zpages_port: self.zpages_port,
         }
     }
-    Ok(())
 }
 
-fn cmd_status() -> Result<()> {
-    let state = daemon::read_state()?;
-    match state {
-        Some(state) => {
-            let running = daemon::is_pid_alive(state.pid);
-            let healthy = if running { check_health_sync() } else { false };
-            print_json(&serde_json::json!({
-                "running": running,
-                "healthy": healthy,
-                "pid": state.pid,
-                "started_at": state.started_at,
-                "config_path": state.config_path,
-                "data_path": state.data_path,
-            }));
-            if !running {
-                std::process::exit(1);
-            }
-        }
-        None => {
-            print_json(&serde_json::json!({
-                "running": false,
-                "healthy": false,
-            }));
-            std::process::exit(1);
-        }
-    }
-    Ok(())
+/// How the receivers of `lotel start` accept exports.
+#[derive(Args)]
+struct ReceiverArgs {
+    /// Serve OTLP/gRPC over TLS with a certificate from a generated local CA; prints the CA
+    /// certificate path for SDKs to trust
+    #[arg(long)]
+    tls: bool,
+    /// Require a bearer token on exports; generates the token once and prints it
+    #[arg(long)]
+    auth: bool,
+    /// Listen for OTLP/gRPC on a unix socket in the collector's directory instead of a port;
+    /// `status` shows its path
+    #[arg(long, conflicts_with = "otlp_grpc_port")]
+    unix_socket: bool,
 }
 
-fn cmd_health() -> Result<()> {
-    let state = daemon::read_state()?;
-    match state {
-        Some(state) if daemon::is_pid_alive(state.pid) => {
-            if check_health_sync() {
-                eprintln!("Collector is healthy.");
-            } else {
-                eprintln!("Collector is running but not healthy.");
-                std::process::exit(1);
-            }
-        }
-        _ => {
-            eprintln!("Collector is not running.");
-            std::process::exit(1);
+impl ReceiverArgs {
+    fn options(&self) -> daemon::ReceiverOptions {
+        daemon::ReceiverOptions {
+            tls: self.tls,
+            auth: self.auth,
+            unix_socket: self.unix_socket,
         }
     }
-    Ok(())
 }
 
-fn cmd_run_collector(config: &std::path::Path) -> Result<()> {
-    let rt = tokio::runtime::Runtime::new()?;
-    rt.block_on(async {
-        let collector = lotel_collector::Collector::from_config_file(config)
-            .map_err(|e| anyhow::anyhow!("{e}"))?;
-        let handle = collector.start().map_err(|e| anyhow::anyhow!("{e}"))?;
+/// Options of `lotel ingest`.
+#[derive(Args)]
+struct IngestArgs {
+    /// Re-ingest all data from the beginning.
+    /// Clears existing telemetry data before re-ingesting.
+    #[arg(long)]
+    full: bool,
+    /// Number of threads used to parse JSONL lines (defaults to the CPU count)
+    #[arg(long)]
+    workers: Option<usize>,
+    /// Truncate the ingested portion of the JSONL files after committing
+    #[arg(long)]
+    consume: bool,
+    /// Archive consumed JSONL data into this directory instead of discarding it
+    #[arg(long, requires = "consume")]
+    archive_dir: Option<PathBuf>,
+    /// Wait for a concurrent ingest to finish instead of failing
+    #[arg(long)]
+    wait: bool,
+    /// Keep only this fraction of traces and logs (e.g. "10%"); errors are always kept
+    #[arg(long)]
+    sample: Option<String>,
+    /// Commit after this many rows so a failure keeps earlier batches (0 commits each file
+    /// once; defaults to 50000 or `ingestion.batch_rows`)
+    #[arg(long)]
+    batch_rows: Option<usize>,
+    /// Parse trace files with DuckDB's read_json, faster on large files (or
+    /// `ingestion.read_json`)
+    #[arg(long)]
+    read_json: bool,
+}
 
-        // Wait for SIGTERM/SIGINT.
-        tokio::signal::ctrl_c().await?;
-        eprintln!("Shutting down collector...");
-        handle.shutdown().await;
-        Ok(())
-    })
+/// Keep-last-N limits of `lotel prune`.
+#[derive(Args)]
+struct KeepArgs {
+    /// Keep only the newest N spans
+    #[arg(long, value_name = "N", value_parser = clap::value_parser!(u64).range(1..))]
+    keep_traces: Option<u64>,
+    /// Keep only the newest N metric points
+    #[arg(long, value_name = "N", value_parser = clap::value_parser!(u64).range(1..))]
+    keep_metrics: Option<u64>,
+    /// Keep only the newest N log records
+    #[arg(long, value_name = "N", value_parser = clap::value_parser!(u64).range(1..))]
+    keep_logs: Option<u64>,
+    /// Apply the --keep-* limits to each service separately
+    #[arg(long)]
+    per_service: bool,
 }
 
-fn cmd_ingest(full: bool) -> Result<()> {
-    let data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
-    let conn = lotel_storage::default_db()?;
-    let mut ingester = lotel_storage::IncrementalIngester::new();
-    if full {
-        lotel_storage::clear_signal_tables(&conn)?;
-        lotel_storage::clear_ingest_cursors(&conn)?;
-    } else {
-        ingester.load_cursors(&conn)?;
+impl KeepArgs {
+    fn limits(&self) -> Vec<(lotel_storage::Signal, u64)> {
+        [
+            (lotel_storage::Signal::Traces, self.keep_traces),
+            (lotel_storage::Signal::Metrics, self.keep_metrics),
+            (lotel_storage::Signal::Logs, self.keep_logs),
+        ]
+        .into_iter()
+        .filter_map(|(signal, keep)| Some((signal, keep?)))
+        .collect()
     }
-    let report = ingester.ingest_new(&conn, &data_path)?;
-    eprintln!("Ingestion complete: {report}");
-    Ok(())
 }
 
-fn cmd_query(subcommand: QueryCommand) -> Result<()> {
-    let conn = lotel_storage::default_db()?;
+/// Options shared by the `tail` subcommands.
+#[derive(Args)]
+struct FollowArgs {
+    #[arg(long)]
+    service: Option<String>,
+    /// Also show records from this far back (e.g. 5m) before following
+    #[arg(long)]
+    since: Option<String>,
+    /// Attribute filter: key=value, key!=value, or numeric key>3, key<=10 (repeatable)
+    #[arg(long = "attr", value_name = "FILTER")]
+    attrs: Vec<String>,
+    /// How often to ingest and poll for new records
+    #[arg(long, default_value = "1s")]
+    interval: String,
+    /// Disable colors (also off when NO_COLOR is set or stdout is not a terminal)
+    #[arg(long)]
+    no_color: bool,
+}
 
-    match subcommand {
-        QueryCommand::Traces {
-            service,
-            since,
-            until,
+impl FollowArgs {
+    fn settings(&self) -> Result<tail::Follow> {
+        let interval = time::parse_duration(&self.interval)?
+            .to_std()
+            .ok()
+            .filter(|d| !d.is_zero())
+            .context("--interval must be positive")?;
+        Ok(tail::Follow {
+            interval,
+            since: self.since.as_deref().map(time::parse_time).transpose()?,
+            color: style::color_enabled(self.no_color),
+            ingest: || fresh_ingest(true),
+        })
+    }
+
+    fn query_opts(&self) -> Result<lotel_storage::QueryOptions> {
+        Ok(lotel_storage::QueryOptions {
+            service: self.service.clone(),
+            attrs: self
+                .attrs
+                .iter()
+                .map(|a| lotel_storage::AttrFilter::parse(a))
+                .collect::<Result<_>>()?,
+            ..Default::default()
+        })
+    }
+}
+
+/// Filters shared by every query subcommand.
+#[derive(Clone, Default, Args)]
+struct FilterArgs {
+    #[arg(long)]
+    service: Option<String>,
+    /// Start time: RFC3339, a duration ago (1h, 7d), today, or yesterday
+    #[arg(long)]
+    since: Option<String>,
+    /// End time, in the same forms as --since (e.g. 30m for 30 minutes ago)
+    #[arg(long)]
+    until: Option<String>,
+    /// Shorthand for both bounds: a duration up to now (15m), today, or yesterday
+    #[arg(long, conflicts_with_all = ["since", "until"])]
+    last: Option<String>,
+    /// Attribute filter: key=value, key!=value, or numeric key>3, key<=10 (repeatable)
+    #[arg(long = "attr", value_name = "FILTER")]
+    attrs: Vec<String>,
+}
+
+#[derive(Clone, Subcommand)]
+enum QueryCommand {
+    /// Query traces (JSON output)
+    Traces {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only spans of this trace (hex or base64)
+        #[arg(long)]
+        trace_id: Option<String>,
+        /// Only spans of this kind: server, client, internal, producer, consumer
+        #[arg(long)]
+        kind: Option<String>,
+        /// Only spans with this status: unset, ok, error
+        #[arg(long)]
+        status: Option<String>,
+        /// Return one record per matching trace (root span, span count, duration, errors)
+        #[arg(long)]
+        roots: bool,
+        #[arg(long)]
+        limit: Option<usize>,
+    },
+    /// All spans of one trace (JSON output, or a text waterfall)
+    Trace {
+        /// Trace ID (hex or base64)
+        trace_id: String,
+        /// Render spans as nested, time-aligned duration bars instead of JSON
+        #[arg(long)]
+        waterfall: bool,
+        /// Width of the waterfall's bar column
+        #[arg(long, default_value_t = 60, value_parser = clap::value_parser!(u16).range(10..))]
+        width: u16,
+        /// Disable colors (also off when NO_COLOR is set or stdout is not a terminal)
+        #[arg(long)]
+        no_color: bool,
+    },
+    /// Query metrics (JSON output)
+    Metrics {
+        #[command(flatten)]
+        filter: FilterArgs,
+        #[arg(long)]
+        limit: Option<usize>,
+        /// Rewrite sum and histogram points to this temporality so mixed SDKs compare
+        #[arg(long, value_enum)]
+        temporality: Option<TemporalityArg>,
+    },
+    /// Query logs (JSON output)
+    Logs {
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Only logs correlated with this trace (hex or base64)
+        #[arg(long)]
+        trace_id: Option<String>,
+        /// Filter on a structured body field by dotted path, e.g. user.id=42 (repeatable)
+        #[arg(long = "body-field", value_name = "FILTER")]
+        body_fields: Vec<String>,
+        #[arg(long)]
+        limit: Option<usize>,
+    },
+    /// Compute avg/min/max for a metric over a time window
+    Aggregate {
+        /// Metric name or glob (e.g. 'http_*'); repeatable, one result per matching metric
+        #[arg(long, required = true)]
+        metric: Vec<String>,
+        #[command(flatten)]
+        filter: FilterArgs,
+        /// Aggregation instead of count/avg/min/max; `rate` is per-second increase of a counter
+        #[arg(long = "fn", value_enum)]
+        func: Option<AggregateFn>,
+        /// Attribute key whose distinct values --fn count-distinct counts
+        #[arg(long, required_if_eq("func", "count-distinct"))]
+        attribute: Option<String>,
+        /// Bucket width for --fn rate (e.g. 1m)
+        #[arg(long, default_value = "1m")]
+        bucket: String,
+    },
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum TemporalityArg {
+    Delta,
+    Cumulative,
+}
+
+impl From<TemporalityArg> for lotel_storage::Temporality {
+    fn from(temporality: TemporalityArg) -> Self {
+        match temporality {
+            TemporalityArg::Delta => Self::Delta,
+            TemporalityArg::Cumulative => Self::Cumulative,
+        }
+    }
+}
+
+#[derive(Clone, Copy, ValueEnum)]
+enum AggregateFn {
+    Rate,
+    Last,
+    Sum,
+    Stddev,
+    CountDistinct,
+}
+
+fn print_json<T: Serialize>(value: &T) {
+    let mut value = json::Json::from_serialize(value).expect("json serialization");
+    time::localize_json(&mut value);
+    output::downgrade(&mut value);
+    let data = serde_json::to_string_pretty(&value).expect("json serialization");
+    println!("{data}");
+}
+
+/// How [`run_query`] prints its results.
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum QueryOutput {
+    /// Pretty-printed JSON array (the default).
+    Json,
+    /// One JSON object per line, written while rows are scanned (`--stream`).
+    Ndjson,
+    /// Aligned columns, one row per result (`--watch`).
+    Table,
+}
+
+impl QueryOutput {
+    /// Print collected results; [`QueryOutput::Ndjson`] callers stream rows themselves and
+    /// only land here for outputs that cannot stream.
+    fn print<T: Serialize>(self, value: &T) {
+        match self {
+            Self::Json | Self::Ndjson => print_json(value),
+            Self::Table => {
+                let mut value = json::Json::from_serialize(value).expect("json serialization");
+                time::localize_json(&mut value);
+                let (headers, rows) = table::from_json(&value);
+                print!("{}", table::render(&headers, &rows));
+            }
+        }
+    }
+
+    /// Print `results[0]` alone when `single`, else the whole list.
+    fn print_one_or_all<T: Serialize>(self, mut results: Vec<T>, single: bool) {
+        if single && results.len() == 1 {
+            self.print(&results.remove(0));
+        } else {
+            self.print(&results);
+        }
+    }
+}
+
+/// Buffered NDJSON output for `query --stream`: one compact JSON object per line.
+struct NdjsonWriter<W: Write> {
+    out: W,
+}
+
+impl NdjsonWriter<std::io::BufWriter<std::io::StdoutLock<'static>>> {
+    fn stdout() -> Self {
+        Self {
+            out: std::io::BufWriter::new(std::io::stdout().lock()),
+        }
+    }
+}
+
+impl<W: Write> NdjsonWriter<W> {
+    fn write<T: Serialize>(&mut self, row: &T) -> Result<()> {
+        if time::display_tz() == time::DisplayTz::Utc && !output::is_pinned() {
+            serde_json::to_writer(&mut self.out, row)?;
+        } else {
+            let mut value = json::Json::from_serialize(row)?;
+            time::localize_json(&mut value);
+            output::downgrade(&mut value);
+            serde_json::to_writer(&mut self.out, &value)?;
+        }
+        self.out.write_all(b"\n")?;
+        Ok(())
+    }
+
+    fn finish(mut self) -> Result<()> {
+        self.out.flush()?;
+        Ok(())
+    }
+}
+
+fn main() {
+    let cli: Cli = exit::parse_args();
+    let error_format = cli.error_format;
+    let self_telemetry = selftel::endpoint()
+        .filter(|_| self_instrumented(&cli.command))
+        .map(|endpoint| (endpoint, selftel::Recorder::default()));
+    let recorder = self_telemetry.as_ref().map(|(_, r)| r.clone());
+    if let Err(e) = log::init(cli.verbose, cli.quiet, cli.log_format, recorder) {
+        exit::report(&e, error_format);
+    }
+    if handles_interrupt(&cli.command) {
+        install_interrupt_handler();
+    }
+    let result = run(cli);
+    if let Some((endpoint, recorder)) = &self_telemetry {
+        recorder.flush(endpoint);
+    }
+    if let Err(e) = result {
+        // Whatever failed after Ctrl-C failed because of it; report the interrupt instead.
+        if interrupt().is_cancelled() {
+            exit::report(
+                &exit::fail(exit::ExitKind::Interrupted, "interrupted"),
+                error_format,
+            );
+        }
+        exit::report(&e, error_format);
+    }
+}
+
+fn run(cli: Cli) -> Result<()> {
+    time::set_display_tz(time::DisplayTz::parse(&cli.tz)?);
+    output::set_version(cli.output_version);
+    let _ = LIMIT_FLAGS.set((cli.memory_limit.clone(), cli.threads));
+    if needs_duckdb(&cli.command) && !storage_config()?.backend.uses_duckdb() {
+        bail!(
+            "this command needs the duckdb or parquet storage backend (storage.backend in the config)"
+        );
+    }
+
+    match cli.command {
+        Command::Start {
+            wait,
+            foreground,
+            name,
+            config,
+            limits,
+            ports,
+            env,
+            receivers,
+        } => {
+            let options = launch_options(name, &limits, &ports, env, &receivers)?;
+            if foreground {
+                cmd_start_foreground(config.as_deref(), &options)?;
+            } else {
+                cmd_start(wait, config.as_deref(), &options)?;
+            }
+        }
+        Command::Upgrade { force, name } => cmd_upgrade(force, collector_name(&name)?)?,
+        Command::Stop { name } => cmd_stop(collector_name(&name)?)?,
+        Command::Adopt { name } => cmd_adopt(collector_name(&name)?)?,
+        Command::Status { name } => cmd_status(collector_name(&name)?)?,
+        Command::Health { name } => cmd_health(collector_name(&name)?)?,
+        Command::Collector {
+            subcommand: CollectorCommand::Zpages { page, open, name },
+        } => cmd_zpages(page, open, collector_name(&name)?)?,
+        Command::Collector {
+            subcommand: CollectorCommand::Pprof { seconds, name },
+        } => cmd_pprof(seconds, collector_name(&name)?)?,
+        Command::Ingest {
+            subcommand: Some(IngestCommand::History { limit }),
+            ..
+        } => cmd_ingest_history(limit)?,
+        Command::Ingest {
+            subcommand: None,
+            args,
+        } => selftel::in_span(
+            tracing::info_span!(
+                "ingest",
+                full = args.full,
+                traces = tracing::field::Empty,
+                metrics = tracing::field::Empty,
+                logs = tracing::field::Empty,
+                error = tracing::field::Empty,
+            ),
+            || cmd_ingest(&args),
+        )?,
+        Command::Import { format, file, wait } => cmd_import(format, &file, wait)?,
+        Command::Query {
+            fresh,
+            stream,
+            fields,
+            explain,
+            watch,
+            subcommand,
+        } => selftel::in_span(
+            tracing::info_span!("query", stream, error = tracing::field::Empty),
+            || {
+                cmd_query(
+                    fresh,
+                    stream,
+                    fields.as_deref(),
+                    explain,
+                    watch.as_deref(),
+                    subcommand,
+                )
+            },
+        )?,
+        Command::Graph {
+            since,
+            until,
+            format,
+        } => cmd_graph(since, until, format)?,
+        Command::Orphans { filter, limit } => {
+            let opts = build_query_opts(filter, Some(limit))?;
+            let conn = query_db()?;
+            print_json(&lotel_storage::trace_completeness(&conn, &opts)?);
+        }
+        Command::TopSpans {
+            filter,
+            sort,
+            limit,
+        } => {
+            let opts = build_query_opts(filter, Some(limit))?;
+            let conn = query_db()?;
+            print_json(&lotel_storage::top_spans(&conn, &opts, sort.into())?);
+        }
+        Command::Red { filter, by_route } => {
+            let opts = build_query_opts(filter, None)?;
+            let conn = query_db()?;
+            print_json(&lotel_storage::red_metrics(&conn, &opts, by_route)?);
+        }
+        Command::Slo {
+            filter,
+            target_latency,
+            objective,
+        } => {
+            let opts = build_query_opts(filter, None)?;
+            let target = lotel_storage::SloTarget {
+                latency_ms: time::parse_millis(&target_latency)?,
+                objective: match parse_fraction(&objective)? {
+                    o if o < 1.0 => o,
+                    _ => exit::bad_args!("--objective must be below 100%"),
+                },
+            };
+            let conn = query_db()?;
+            print_json(&lotel_storage::slo_report(&conn, &opts, &target)?);
+        }
+        Command::Diff {
+            baseline,
+            current,
+            service,
+            threshold,
+        } => cmd_diff(&baseline, &current, service, &threshold)?,
+        Command::Assert {
+            filter,
+            no_error_spans,
+            max_p95,
+            min_spans,
+            no_error_logs,
+            min_logs,
+            rules,
+            junit,
+            github,
+        } => {
+            let assertion = lotel_storage::Assertion {
+                no_error_spans,
+                max_p95_ms: max_p95.as_deref().map(time::parse_millis).transpose()?,
+                min_spans,
+                no_error_logs,
+                min_logs,
+            };
+            cmd_assert(
+                filter,
+                &assertion,
+                rules.as_deref(),
+                junit.as_deref(),
+                github,
+            )?
+        }
+        Command::Bench {
+            subcommand:
+                BenchCommand::Ingest {
+                    rows,
+                    workers,
+                    seed,
+                    dir,
+                    read_json,
+                },
+        } => cmd_bench_ingest(&rows, workers, seed, dir, read_json)?,
+        Command::Bench {
+            subcommand: BenchCommand::Query { rows, seed, dir },
+        } => cmd_bench_query(&rows, seed, dir)?,
+        Command::Tail {
+            subcommand:
+                TailCommand::Logs {
+                    follow,
+                    min_severity,
+                },
+        } => {
+            let settings = follow.settings()?;
+            let mut opts = follow.query_opts()?;
+            opts.min_severity = min_severity
+                .as_deref()
+                .map(lotel_storage::parse_severity)
+                .transpose()?;
+            tail::follow(
+                &settings,
+                lotel_storage::Signal::Logs,
+                opts,
+                lotel_storage::query_logs,
+                |log| {
+                    (
+                        log.timestamp,
+                        log.service_name.clone(),
+                        log.span_id.clone(),
+                        log.body.clone(),
+                    )
+                },
+                |log| log.timestamp,
+                |log| tail::render_log(log, settings.color),
+            )?;
+        }
+        Command::Tail {
+            subcommand:
+                TailCommand::Traces {
+                    follow,
+                    errors_only,
+                    status,
+                    kind,
+                    min_duration,
+                },
+        } => {
+            let settings = follow.settings()?;
+            let mut opts = follow.query_opts()?;
+            let status = if errors_only {
+                Some("error")
+            } else {
+                status.as_deref()
+            };
+            opts.status_code = status.map(lotel_storage::parse_status_code).transpose()?;
+            opts.kind = kind
+                .as_deref()
+                .map(lotel_storage::parse_span_kind)
+                .transpose()?;
+            opts.min_duration_ns = min_duration
+                .as_deref()
+                .map(time::parse_duration)
+                .transpose()?
+                .map(|d| d.num_nanoseconds().unwrap_or(i64::MAX));
+            tail::follow(
+                &settings,
+                lotel_storage::Signal::Traces,
+                opts,
+                lotel_storage::query_traces,
+                |span| (span.trace_id.clone(), span.span_id.clone()),
+                |span| span.start_time,
+                |span| tail::render_span(span, settings.color),
+            )?;
+        }
+        Command::Shell => shell::run()?,
+        Command::Serve {
+            prom,
+            http,
+            grpc,
+            cache_entries,
+            query_timeout,
+        } => {
+            let query_timeout = time::parse_duration(&query_timeout)?.to_std()?;
+            let config = serve::ServeConfig {
+                prom: prom.as_deref().map(serve::parse_listen_addr).transpose()?,
+                http: http.as_deref().map(serve::parse_listen_addr).transpose()?,
+                grpc: grpc.as_deref().map(serve::parse_listen_addr).transpose()?,
+                cache_entries,
+                query_timeout: (!query_timeout.is_zero()).then_some(query_timeout),
+            };
+            let rt = tokio::runtime::Runtime::new()?;
+            rt.block_on(serve::run(config))?;
+        }
+        Command::Db {
+            subcommand:
+                DbCommand::Cardinality {
+                    filter,
+                    signal,
+                    limit,
+                },
+        } => {
+            let opts = build_query_opts(filter, Some(limit))?;
+            let signals = match signal {
+                Some(signal) => vec![signal.into()],
+                None => vec![
+                    lotel_storage::Signal::Traces,
+                    lotel_storage::Signal::Metrics,
+                    lotel_storage::Signal::Logs,
+                ],
+            };
+            let conn = query_db()?;
+            let mut keys = Vec::new();
+            for signal in signals {
+                keys.extend(lotel_storage::attribute_cardinality(&conn, signal, &opts)?);
+            }
+            print_json(&keys);
+        }
+        Command::Db {
+            subcommand: DbCommand::Encrypt,
+        } => cmd_db_encrypt()?,
+        Command::Db {
+            subcommand: DbCommand::Compact { sort },
+        } => cmd_db_compact(sort)?,
+        Command::Db {
+            subcommand: DbCommand::Health,
+        } => cmd_db_health()?,
+        Command::Logs {
+            subcommand:
+                LogsCommand::Patterns {
+                    filter,
+                    min_severity,
+                    limit,
+                },
+        } => {
+            let mut opts = build_query_opts(filter, Some(limit))?;
+            opts.min_severity = min_severity
+                .as_deref()
+                .map(lotel_storage::parse_severity)
+                .transpose()?;
+            let conn = query_db()?;
+            print_json(&lotel_storage::log_patterns(&conn, &opts)?);
+        }
+        Command::Export {
+            subcommand:
+                ExportCommand::Flamegraph {
+                    filter,
+                    trace_id,
+                    limit,
+                },
+        } => {
+            let mut opts = build_query_opts(filter, limit)?;
+            opts.trace_id = trace_id;
+            let conn = query_db()?;
+            let stacks = lotel_storage::folded_stacks(&conn, &opts)?;
+            if stacks.is_empty() {
+                tracing::warn!("No spans matched");
+            }
+            print!("{}", lotel_storage::to_folded(&stacks));
+        }
+        Command::Export {
+            subcommand: ExportCommand::OtlpJson { filter, signal },
+        } => {
+            let opts = build_query_opts(filter, None)?;
+            let signals = match signal {
+                Some(signal) => vec![signal.into()],
+                None => vec![
+                    lotel_storage::Signal::Traces,
+                    lotel_storage::Signal::Metrics,
+                    lotel_storage::Signal::Logs,
+                ],
+            };
+            let conn = query_db()?;
+            let mut out = std::io::BufWriter::new(std::io::stdout().lock());
+            let mut written = 0;
+            for signal in signals {
+                written += lotel_storage::export_otlp_json(&conn, signal, &opts, &mut out)?;
+            }
+            tracing::info!("Exported {written} records");
+        }
+        Command::Gen {
+            endpoint,
+            rate,
+            duration,
+            error_rate,
+            seed,
+        } => cmd_gen(endpoint, rate, duration.as_deref(), &error_rate, seed)?,
+        Command::Archive {
+            older_than,
+            to,
+            dry_run,
+        } => cmd_archive(&older_than, &to, dry_run)?,
+        Command::Prune {
+            subcommand: Some(PruneCommand::History { limit }),
+            ..
+        } => cmd_prune_history(limit)?,
+        Command::Prune {
+            subcommand: None,
+            older_than,
+            service,
+            name,
+            attrs,
+            dry_run,
+            all,
+            include_files,
+            keep,
+        } => selftel::in_span(
+            tracing::info_span!(
+                "prune",
+                dry_run,
+                deleted = tracing::field::Empty,
+                error = tracing::field::Empty,
+            ),
+            || {
+                let filter = lotel_storage::PruneFilter {
+                    service,
+                    name,
+                    attrs: attrs
+                        .iter()
+                        .map(|a| lotel_storage::AttrFilter::parse(a))
+                        .collect::<Result<_>>()?,
+                };
+                cmd_prune(older_than, &filter, dry_run, all, include_files, &keep)
+            },
+        )?,
+        Command::Smoke {
+            endpoint,
+            timeout,
+            json,
+            no_color,
+        } => cmd_smoke(&endpoint, &timeout, json, no_color)?,
+        Command::Version => cmd_version()?,
+        Command::Env { shell, app } => {
+            print!("{}", appenv::script(&app_env(&app)?.vars(), shell));
+        }
+        Command::Run { app, command } => cmd_run(&app, &command)?,
+        Command::Generate {
+            subcommand: GenerateCommand::Compose { args },
+        } => print!("{}", container_service(&args)?.compose()),
+        Command::Generate {
+            subcommand: GenerateCommand::Devcontainer { args },
+        } => {
+            let devcontainer = container_service(&args)?.devcontainer();
+            println!("{}", serde_json::to_string_pretty(&devcontainer)?);
+        }
+        Command::Completion { shell } => {
+            use clap::CommandFactory;
+            let bin = env!("CARGO_BIN_NAME");
+            print!("{}", completion::script(Cli::command(), bin, shell));
+        }
+        Command::Complete { lookup, prefix } => cmd_complete(lookup, &prefix),
+        Command::RunCollector {
+            config,
+            data: _,
+            limits,
+            ports,
+            name,
+            receivers,
+            ..
+        } => {
+            cmd_run_collector(
+                &config,
+                name.as_deref(),
+                &limits.limits()?,
+                &ports.ports(),
+                &receivers.options(),
+            )?;
+        }
+    }
+
+    Ok(())
+}
+
+fn cmd_smoke(endpoint: &str, timeout: &str, json: bool, no_color: bool) -> Result<()> {
+    let timeout = time::parse_duration(timeout)?
+        .to_std()
+        .ok()
+        .filter(|d| !d.is_zero())
+        .context("--timeout must be positive")?;
+    let report = smoke::run(endpoint, timeout);
+    if json {
+        print_json(&report);
+    } else {
+        print!("{}", report.render(style::color_enabled(no_color)));
+    }
+    if !report.passed {
+        exit::exit(exit::ExitKind::AssertionFailed);
+    }
+    Ok(())
+}
+
+fn cmd_version() -> Result<()> {
+    let state = daemon::read_state(None)?;
+    let running = state.as_ref().is_some_and(daemon::is_running);
+    // Build info is still worth printing when the config is broken.
+    let exporters = match lotel_collector::config::load_config() {
+        Ok(config) => config.exporters,
+        Err(e) => {
+            tracing::warn!("Could not read the collector config: {e}");
+            Default::default()
+        }
+    };
+    let report = version::report(state.as_ref(), running, &exporters);
+    for warning in &report.warnings {
+        tracing::warn!("{warning}");
+    }
+    print_json(&report);
+    Ok(())
+}
+
+/// Print the stored values for `lookup` starting with `prefix`, one per line. Completion
+/// must not get in the way, so a missing, locked, or non-DuckDB store prints nothing.
+fn cmd_complete(lookup: completion::Lookup, prefix: &str) {
+    let Ok(conn) = query_db() else {
+        return;
+    };
+    let values = match lookup {
+        completion::Lookup::Service => lotel_storage::service_names(&conn, prefix),
+        completion::Lookup::Metric => lotel_storage::metric_names(
+            &conn,
+            &lotel_storage::QueryOptions::default(),
+            &[format!("{prefix}*")],
+        ),
+    };
+    for value in values.unwrap_or_default() {
+        println!("{value}");
+    }
+}
+
+fn cmd_start(
+    wait: bool,
+    config: Option<&std::path::Path>,
+    options: &daemon::LaunchOptions,
+) -> Result<()> {
+    let name = options.name.as_deref();
+    daemon::cleanup_stale_state(name)?;
+
+    if let Some(state) = collector_state(name)? {
+        if daemon::is_running(&state) {
+            tracing::info!("Collector is already running (PID {}).", state.pid);
+            return Ok(());
+        }
+        daemon::remove_state(name)?;
+    }
+
+    let (config_path, data_path) = start_paths(config, name)?;
+    prepare_receivers(options)?;
+    launch_collector(&config_path, &data_path, options, wait)?;
+    Ok(())
+}
+
+/// `lotel start --foreground`: the collector runs attached, and its exit status is ours.
+fn cmd_start_foreground(
+    config: Option<&std::path::Path>,
+    options: &daemon::LaunchOptions,
+) -> Result<()> {
+    let name = options.name.as_deref();
+    daemon::cleanup_stale_state(name)?;
+    if let Some(state) = collector_state(name)?.filter(daemon::is_running) {
+        bail!(
+            "collector is already running in the background (PID {}); stop it with `lotel-cli stop{}` first",
+            state.pid,
+            name.map(|n| format!(" --name {n}")).unwrap_or_default()
+        );
+    }
+
+    let (config_path, data_path) = start_paths(config, name)?;
+    prepare_receivers(options)?;
+    tracing::info!(
+        "Running collector in the foreground with {}; press Ctrl-C to stop.",
+        config_path.display()
+    );
+    let status = daemon::run_collector_attached(
+        &config_path,
+        &data_path,
+        options,
+        &collector_env(&config_path, &options.env)?,
+    )?;
+    if !status.success() {
+        bail!("collector exited with {status}");
+    }
+    Ok(())
+}
+
+/// Create what the `start --tls/--auth/--unix-socket` receivers need, the certificates and
+/// token only unless the collector already has them, and say how SDKs reach the collector.
+fn prepare_receivers(options: &daemon::LaunchOptions) -> Result<()> {
+    let name = options.name.as_deref();
+    let receivers = &options.receivers;
+    if receivers.unix_socket {
+        tracing::info!(
+            "OTLP/gRPC listens on {}{}.",
+            lotel_collector::config::UNIX_SCHEME,
+            daemon::socket_path(name)?.display()
+        );
+    }
+    if receivers.tls {
+        let files = tls::ensure_certificates(&daemon::tls_dir(name)?)?;
+        tracing::info!(
+            "OTLP/gRPC uses TLS; set OTEL_EXPORTER_OTLP_CERTIFICATE={}.",
+            files.ca_cert.display()
+        );
+    }
+    if receivers.auth {
+        let token = auth::ensure_token(&daemon::instance_dir(name)?)?;
+        tracing::info!(
+            "Exports need the bearer token; set OTEL_EXPORTER_OTLP_HEADERS=\"authorization=Bearer {token}\"."
+        );
+    }
+    Ok(())
+}
+
+/// Validate the `lotel start` flags that are recorded in the collector's state.
+fn launch_options(
+    name: Option<String>,
+    limits: &LimitArgs,
+    ports: &PortArgs,
+    env: Vec<String>,
+    receivers: &ReceiverArgs,
+) -> Result<daemon::LaunchOptions> {
+    collector_name(&name)?;
+    for entry in &env {
+        if let Err(e) = lotel_collector::config::parse_env_var(entry) {
+            exit::bad_args!("--env: {e}");
+        }
+    }
+    Ok(daemon::LaunchOptions {
+        name,
+        limits: limits.limits()?,
+        ports: ports.ports(),
+        env,
+        receivers: receivers.options(),
+    })
+}
+
+/// The validated `--name` of a collector command.
+fn collector_name(name: &Option<String>) -> Result<Option<&str>> {
+    if let Some(name) = name
+        && let Err(e) = daemon::validate_name(name)
+    {
+        exit::bad_args!("--name: {e}");
+    }
+    Ok(name.as_deref())
+}
+
+/// The config and data directory a new collector runs with. A named collector gets its own
+/// data directory and must be given its config, since the default one writes to
+/// ~/.lotel/data.
+fn start_paths(config: Option<&std::path::Path>, name: Option<&str>) -> Result<(PathBuf, PathBuf)> {
+    let config_path = match config {
+        Some(path) => {
+            if !path.is_file() {
+                exit::bad_args!("--config: {} is not a file", path.display());
+            }
+            std::path::absolute(path)?
+        }
+        None if name.is_some() => {
+            exit::bad_args!(
+                "--name needs --config with a config whose exporter paths use ${{DATA_DIR}}"
+            )
+        }
+        None => {
+            lotel_collector::config::resolve_config_path().map_err(|e| anyhow::anyhow!("{e}"))?
+        }
+    };
+    let data_path = match name {
+        Some(_) => daemon::instance_dir(name)?.join("data"),
+        None => lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?,
+    };
+    Ok((config_path, data_path))
+}
+
+/// Spawn the collector, record its state, and with `wait` block until it is healthy.
+fn launch_collector(
+    config_path: &std::path::Path,
+    data_path: &std::path::Path,
+    options: &daemon::LaunchOptions,
+    wait: bool,
+) -> Result<u32> {
+    let pid = daemon::spawn_collector(
+        config_path,
+        data_path,
+        options,
+        &collector_env(config_path, &options.env)?,
+    )?;
+
+    let state = daemon::CollectorState {
+        pid,
+        started_at: chrono::Utc::now().to_rfc3339(),
+        config_path: config_path.display().to_string(),
+        data_path: data_path.display().to_string(),
+        version: Some(version::VERSION.to_string()),
+        commit: Some(env!("LOTEL_COMMIT").to_string()),
+        identity: daemon::process_identity(pid),
+        options: options.clone(),
+    };
+    daemon::write_state(&state)?;
+
+    tracing::info!("Collector started (PID {pid}).");
+
+    if wait {
+        tracing::info!("Waiting for collector to become healthy...");
+        let url = health_url(&state);
+        let rt = tokio::runtime::Runtime::new()?;
+        let healthy = rt.block_on(async {
+            let client = reqwest::Client::new();
+            let start = std::time::Instant::now();
+            loop {
+                if start.elapsed() > Duration::from_secs(30) {
+                    return false;
+                }
+                match client.get(&url).send().await {
+                    Ok(resp) if resp.status().is_success() => return true,
+                    _ => {}
+                }
+                tokio::time::sleep(Duration::from_millis(500)).await;
+            }
+        });
+        if healthy {
+            tracing::info!("Collector is healthy.");
+        } else {
+            bail!("collector did not become healthy within 30s");
+        }
+    }
+
+    Ok(pid)
+}
+
+/// The variables to set in the collector process: the config's `environment` list, then
+/// `--env` entries, which win for a repeated name. A config that does not parse contributes
+/// nothing; the collector reports it in its log.
+fn collector_env(config_path: &std::path::Path, env: &[String]) -> Result<Vec<(String, String)>> {
+    let configured = std::fs::read_to_string(config_path)
+        .ok()
+        .and_then(|content| lotel_collector::config::parse_config(&content).ok())
+        .map(|config| config.environment)
+        .unwrap_or_default();
+    let mut vars: Vec<(String, String)> = Vec::new();
+    for entry in configured.iter().chain(env) {
+        let (key, value) =
+            lotel_collector::config::parse_env_var(entry).map_err(|e| anyhow::anyhow!(e))?;
+        vars.retain(|(k, _)| *k != key);
+        vars.push((key, value));
+    }
+    Ok(vars)
+}
+
+/// The SDK variables of `lotel env` and `lotel run`: the OTLP/HTTP endpoint and token of
+/// the collector, and a service name and resource attributes unless the environment has them.
+fn app_env(args: &AppEnvArgs) -> Result<appenv::AppEnv> {
+    let name = collector_name(&args.name)?;
+    let state = collector_state(name)?;
+    if !state.as_ref().is_some_and(daemon::is_running) {
+        tracing::warn!(
+            "collector is not running; apps will fail to export until `lotel-cli start{}`",
+            name.map(|n| format!(" --name {n}")).unwrap_or_default()
+        );
+    }
+    let port = state
+        .as_ref()
+        .and_then(collector_endpoints)
+        .and_then(|endpoints| {
+            let (_, port) = endpoints["http"].as_str()?.rsplit_once(':')?;
+            Some(port.to_string())
+        })
+        .unwrap_or_else(|| "4318".to_string());
+    let token = match state.as_ref().is_some_and(|s| s.options.receivers.auth) {
+        true => auth::read_token(&daemon::instance_dir(name)?)?,
+        false => None,
+    };
+    let unset = |key: &str| std::env::var_os(key).is_none_or(|v| v.is_empty());
+    let service = match &args.service {
+        Some(service) => Some(service.clone()),
+        None if unset("OTEL_SERVICE_NAME") => appenv::service_name_for(&std::env::current_dir()?),
+        None => None,
+    };
+    Ok(appenv::AppEnv {
+        endpoint: format!("http://localhost:{port}"),
+        token,
+        service,
+        resource_attributes: unset("OTEL_RESOURCE_ATTRIBUTES"),
+    })
+}
+
+/// `lotel run`: the command gets the `lotel env` variables and the terminal; Ctrl-C reaches
+/// it too (same process group), and this process waits for it and exits with its status.
+fn cmd_run(args: &AppEnvArgs, command: &[std::ffi::OsString]) -> Result<()> {
+    let vars = app_env(args)?.vars();
+    let rt = tokio::runtime::Builder::new_current_thread()
+        .enable_all()
+        .build()?;
+    let status = rt.block_on(async {
+        let mut child = tokio::process::Command::new(&command[0])
+            .args(&command[1..])
+            .envs(vars)
+            .spawn()
+            .with_context(|| format!("running {}", command[0].to_string_lossy()))?;
+        loop {
+            tokio::select! {
+                status = child.wait() => return Ok::<_, anyhow::Error>(status?),
+                _ = tokio::signal::ctrl_c() => {}
+            }
+        }
+    })?;
+    use std::os::unix::process::ExitStatusExt;
+    std::process::exit(
+        status
+            .code()
+            .or_else(|| status.signal().map(|signal| 128 + signal))
+            .unwrap_or(1),
+    );
+}
+
+/// The compose service for `lotel generate`: the config `start` would run, its endpoints
+/// that a port mapping can reach, and the default data directory. The data directory is the
+/// only host directory the container writes, so exporters must write inside it.
+fn container_service(args: &ContainerArgs) -> Result<container::CollectorService> {
+    let (config_path, data_path) = start_paths(args.config.as_deref(), None)?;
+    let data_path = std::path::absolute(data_path)?;
+    let source = match &args.source {
+        Some(dir) => container::check_source(dir)?,
+        None => container::default_source().context(
+            "the lotel checkout this binary was built from is gone; pass --source with one",
+        )?,
+    };
+    let content = std::fs::read_to_string(&config_path)
+        .with_context(|| format!("reading {}", config_path.display()))?;
+    let config =
+        lotel_collector::config::parse_config(&content).map_err(|e| anyhow::anyhow!("{e}"))?;
+    let mut exporters: Vec<_> = config.exporters.iter().collect();
+    exporters.sort_by_key(|(name, _)| name.as_str());
+    for (name, exporter) in exporters {
+        let path = lotel_collector::config::resolve_path(&exporter.path)
+            .map_err(|e| anyhow::anyhow!("{e}"))?;
+        if !std::path::absolute(&path)?.starts_with(&data_path) {
+            exit::bad_args!(
+                "exporter {name} writes {}, outside the data directory {} the container \
+                 mounts; use ${{DATA_DIR}} in its path",
+                path.display(),
+                data_path.display()
+            );
+        }
+    }
+    let protocols = &config.receivers.otlp.protocols;
+    let mut endpoints = vec![
+        ("grpc", protocols.grpc.endpoint.as_str()),
+        ("http", protocols.http.endpoint.as_str()),
+        ("health", config.extensions.health_check.endpoint.as_str()),
+    ];
+    if let Some(zpages) = &config.extensions.zpages {
+        endpoints.push(("zpages", zpages.endpoint.as_str()));
+    }
+    let mut ports = Vec::new();
+    for (name, endpoint) in endpoints {
+        match container::published_port(endpoint) {
+            Some(port) => ports.push((name, port)),
+            None => tracing::warn!(
+                "{name} listens on {endpoint}, which a container port mapping cannot reach; \
+                 use 0.0.0.0:<port> in the config to publish it"
+            ),
+        }
+    }
+    // SAFETY: getuid and getgid cannot fail.
+    let user = unsafe { format!("{}:{}", libc::getuid(), libc::getgid()) };
+    Ok(container::CollectorService {
+        source,
+        env: collector_env(&config_path, &[])?,
+        config: config_path,
+        data: data_path,
+        home: dirs::home_dir().context("getting home directory")?,
+        ports,
+        user,
+    })
+}
+
+/// Restart the running collector on this binary, keeping its config and data paths. The
+/// collector is lotel itself, so installing a new lotel-cli and running this upgrades it.
+fn cmd_upgrade(force: bool, name: Option<&str>) -> Result<()> {
+    let Some(state) = collector_state(name)?.filter(daemon::is_running) else {
+        return Err(exit::fail(
+            exit::ExitKind::NotRunning,
+            "collector is not running; start it with `lotel-cli start`",
+        ));
+    };
+    if daemon::runs_this_build(&state) && !force {
+        tracing::info!(
+            "Collector already runs this build of lotel {}; use --force to restart it anyway.",
+            version::VERSION
+        );
+        print_json(&serde_json::json!({
+            "from": state.version,
+            "to": version::VERSION,
+            "restarted": false,
+            "pid": state.pid,
+        }));
+        return Ok(());
+    }
+
+    daemon::stop_process(state.pid, Duration::from_secs(10))?;
+    daemon::remove_state(name)?;
+    let pid = launch_collector(
+        std::path::Path::new(&state.config_path),
+        std::path::Path::new(&state.data_path),
+        &state.options,
+        true,
+    )?;
+    print_json(&serde_json::json!({
+        "from": state.version,
+        "to": version::VERSION,
+        "restarted": true,
+        "pid": pid,
+    }));
+    Ok(())
+}
+
+fn cmd_stop(name: Option<&str>) -> Result<()> {
+    let state = collector_state(name)?;
+    match state {
+        Some(state) if daemon::is_running(&state) => {
+            daemon::stop_process(state.pid, Duration::from_secs(10))?;
+            daemon::remove_state(name)?;
+            tracing::info!("Collector stopped.");
+        }
+        Some(_) => {
+            daemon::remove_state(name)?;
+            tracing::info!("Collector was not running (cleaned up stale state).");
+        }
+        None => {
+            tracing::info!("Collector is not running.");
+        }
+    }
+    Ok(())
+}
+
+/// Record state for a collector that runs without any, e.g. after its state file was
+/// deleted or `lotel start` was killed before writing it.
+fn cmd_adopt(name: Option<&str>) -> Result<()> {
+    if let Some(state) = daemon::read_state(name)?.filter(daemon::is_running) {
+        tracing::info!("Collector (PID {}) is already tracked.", state.pid);
+        print_json(&serde_json::json!({ "adopted": false, "pid": state.pid }));
+        return Ok(());
+    }
+    let Some(state) = adopt_orphan(name)? else {
+        return Err(exit::fail(
+            exit::ExitKind::NotRunning,
+            "no untracked collector process found",
+        ));
+    };
+    print_json(&serde_json::json!({
+        "adopted": true,
+        "pid": state.pid,
+        "config_path": state.config_path,
+        "data_path": state.data_path,
+    }));
+    Ok(())
+}
+
+/// The collector's state: the state file while its process runs, else the state rebuilt
+/// from a running collector that lacks one, else the stale state file, if any.
+fn collector_state(name: Option<&str>) -> Result<Option<daemon::CollectorState>> {
+    match daemon::read_state(name)? {
+        Some(state) if daemon::is_running(&state) => Ok(Some(state)),
+        state => Ok(adopt_orphan(name)?.or(state)),
+    }
+}
+
+/// Find a running `run-collector` process of collector `name` (not a foreground one) and
+/// write its state, rebuilt from its command line. The lotel version and `--env` entries
+/// that started it are unknown, so `started_at` is the adoption time and `upgrade` restarts
+/// it without them.
+fn adopt_orphan(name: Option<&str>) -> Result<Option<daemon::CollectorState>> {
+    for (pid, args) in daemon::find_collector_processes() {
+        let Ok(Cli {
+            command:
+                Command::RunCollector {
+                    config,
+                    data,
+                    limits,
+                    ports,
+                    name: process_name,
+                    attached: false,
+                    receivers,
+                },
+            ..
+        }) = Cli::try_parse_from(&args)
+        else {
+            continue;
+        };
+        let Ok(limits) = limits.limits() else {
+            continue;
+        };
+        if process_name.as_deref() != name {
+            continue;
+        }
+        let state = daemon::CollectorState {
+            pid,
+            started_at: chrono::Utc::now().to_rfc3339(),
+            config_path: config.display().to_string(),
+            data_path: data.display().to_string(),
+            version: None,
+            commit: None,
+            identity: daemon::process_identity(pid),
+            options: daemon::LaunchOptions {
+                name: process_name,
+                limits,
+                ports: ports.ports(),
+                env: Vec::new(),
+                receivers: receivers.options(),
+            },
+        };
+        daemon::write_state(&state)?;
+        tracing::info!("Adopted collector process {pid}, which had no state file.");
+        return Ok(Some(state));
+    }
+    Ok(None)
+}
+
+fn cmd_status(name: Option<&str>) -> Result<()> {
+    let state = collector_state(name)?;
+    match state {
+        Some(state) => {
+            let running = daemon::is_running(&state);
+            let healthy = running && check_health_sync(&health_url(&state));
+            let mut status = serde_json::json!({
+                "running": running,
+                "healthy": healthy,
+                "pid": state.pid,
+                "started_at": state.started_at,
+                "config_path": state.config_path,
+                "data_path": state.data_path,
+            });
+            // Collectors started by releases before version recording have none.
+            if let Some(version) = &state.version {
+                status["version"] = version.as_str().into();
+            }
+            if let Some(name) = &state.options.name {
+                status["name"] = name.as_str().into();
+            }
+            if let Some(endpoints) = collector_endpoints(&state) {
+                status["endpoints"] = endpoints;
+            }
+            if state.options.receivers.tls {
+                let ca = tls::TlsFiles::in_dir(&daemon::tls_dir(name)?).ca_cert;
+                status["tls_ca"] = ca.display().to_string().into();
+            }
+            if state.options.receivers.auth
+                && let Some(token) = auth::read_token(&daemon::instance_dir(name)?)?
+            {
+                status["auth_token"] = token.into();
+            }
+            print_json(&status);
+            if !running {
+                exit::exit(exit::ExitKind::NotRunning);
+            }
+        }
+        None => {
+            print_json(&serde_json::json!({
+                "running": false,
+                "healthy": false,
+            }));
+            exit::exit(exit::ExitKind::NotRunning);
+        }
+    }
+    Ok(())
+}
+
+/// The addresses the collector listens on: the config it was started with, after any
+/// `start` port overrides; `None` if that file is gone or no longer parses.
+fn collector_endpoints(state: &daemon::CollectorState) -> Option<serde_json::Value> {
+    let content = std::fs::read_to_string(&state.config_path).ok()?;
+    let config = lotel_collector::config::parse_config(&content).ok()?;
+    let protocols = &config.receivers.otlp.protocols;
+    let ports = &state.options.ports;
+    let endpoint = |endpoint: &str, port: Option<u16>| match port {
+        Some(port) => lotel_collector::config::with_port(endpoint, port),
+        None => endpoint.to_string(),
+    };
+    let grpc = match state.options.receivers.unix_socket {
+        true => {
+            let socket = daemon::socket_path(state.options.name.as_deref()).ok()?;
+            format!(
+                "{}{}",
+                lotel_collector::config::UNIX_SCHEME,
+                socket.display()
+            )
+        }
+        false => endpoint(&protocols.grpc.endpoint, ports.otlp_grpc_port),
+    };
+    let mut endpoints = serde_json::json!({
+        "grpc": grpc,
+        "http": endpoint(&protocols.http.endpoint, ports.otlp_http_port),
+        "health": endpoint(&config.extensions.health_check.endpoint, ports.health_port),
+    });
+    if let Some(zpages) = &config.extensions.zpages {
+        endpoints["zpages"] = endpoint(&zpages.endpoint, ports.zpages_port).into();
+    }
+    Some(endpoints)
+}
+
+/// The collector's health check URL on localhost, at the port of its health endpoint.
+fn health_url(state: &daemon::CollectorState) -> String {
+    let port = collector_endpoints(state)
+        .and_then(|endpoints| {
+            let (_, port) = endpoints["health"].as_str()?.rsplit_once(':')?;
+            Some(port.to_string())
+        })
+        .unwrap_or_else(|| state.options.ports.health_port.unwrap_or(13133).to_string());
+    format!("http://localhost:{port}/")
+}
+
+/// The base URL of the running collector's zPages on localhost.
+fn zpages_url(name: Option<&str>) -> Result<String> {
+    let Some(state) = collector_state(name)?.filter(daemon::is_running) else {
+        return Err(exit::fail(
+            exit::ExitKind::NotRunning,
+            "collector is not running",
+        ));
+    };
+    let Some(port) = collector_endpoints(&state).and_then(|endpoints| {
+        let (_, port) = endpoints["zpages"].as_str()?.rsplit_once(':')?;
+        Some(port.to_string())
+    }) else {
+        bail!(
+            "the collector's config has no extensions.zpages section; add one with \
+             `endpoint: localhost:55679` and restart it"
+        );
+    };
+    Ok(format!("http://localhost:{port}/debug"))
+}
+
+fn cmd_zpages(page: ZPage, open: bool, name: Option<&str>) -> Result<()> {
+    let page = match page {
+        ZPage::Pipelinez => "pipelinez",
+        ZPage::Servicez => "servicez",
+    };
+    let url = format!("{}/{page}", zpages_url(name)?);
+    if open {
+        let opener = if cfg!(target_os = "macos") {
+            "open"
+        } else {
+            "xdg-open"
+        };
+        let status = std::process::Command::new(opener)
+            .arg(&url)
+            .status()
+            .with_context(|| format!("running {opener}; open {url} yourself"))?;
+        if !status.success() {
+            bail!("{opener} failed; open {url} yourself");
+        }
+        return Ok(());
+    }
+    print_json(&fetch_json(&url, Duration::from_secs(5))?);
+    Ok(())
+}
+
+fn cmd_pprof(seconds: u64, name: Option<&str>) -> Result<()> {
+    let url = format!("{}/pprof/threads?seconds={seconds}", zpages_url(name)?);
+    tracing::info!("Sampling collector threads for {seconds}s...");
+    print_json(&fetch_json(
+        &url,
+        Duration::from_secs(seconds) + Duration::from_secs(5),
+    )?);
+    Ok(())
+}
+
+/// GET `url` and parse its JSON body; a non-success status is an error with the body as
+/// its message.
+fn fetch_json(url: &str, timeout: Duration) -> Result<serde_json::Value> {
+    let rt = tokio::runtime::Runtime::new()?;
+    rt.block_on(async {
+        let client = reqwest::Client::builder().timeout(timeout).build()?;
+        let resp = client
+            .get(url)
+            .send()
+            .await
+            .with_context(|| format!("fetching {url}"))?;
+        let status = resp.status();
+        if !status.is_success() {
+            bail!("{url} returned {status}: {}", resp.text().await?.trim());
+        }
+        Ok(resp.json().await?)
+    })
+}
+
+fn cmd_health(name: Option<&str>) -> Result<()> {
+    let state = collector_state(name)?;
+    match state {
+        Some(state) if daemon::is_running(&state) => {
+            if !check_health_sync(&health_url(&state)) {
+                return Err(exit::fail(
+                    exit::ExitKind::Unhealthy,
+                    "collector is running but not healthy",
+                ));
+            }
+            tracing::info!("Collector is healthy.");
+        }
+        _ => {
+            return Err(exit::fail(
+                exit::ExitKind::NotRunning,
+                "collector is not running",
+            ));
+        }
+    }
+    Ok(())
+}
+
+fn cmd_run_collector(
+    config: &std::path::Path,
+    name: Option<&str>,
+    limits: &daemon::ResourceLimits,
+    ports: &daemon::PortOverrides,
+    receivers: &daemon::ReceiverOptions,
+) -> Result<()> {
+    let token = match receivers.auth {
+        true => Some(
+            auth::read_token(&daemon::instance_dir(name)?)?
+                .context("no auth token; start the collector with `start --auth`")?,
+        ),
+        false => None,
+    };
+    let mut runtime = tokio::runtime::Builder::new_multi_thread();
+    if let Some(cpus) = limits.cpus {
+        runtime.worker_threads(cpus);
+    }
+    let rt = runtime.enable_all().build()?;
+    rt.block_on(async {
+        let mut collector = lotel_collector::Collector::from_config_file(config)
+            .map_err(|e| anyhow::anyhow!("{e}"))?
+            .with_resource_limits(limits.memory_mib, limits.cpus)
+            .with_ports(
+                ports.otlp_grpc_port,
+                ports.otlp_http_port,
+                ports.health_port,
+                ports.zpages_port,
+            );
+        if receivers.tls {
+            let files = tls::TlsFiles::in_dir(&daemon::tls_dir(name)?);
+            collector = collector.with_tls(&files.server_cert, &files.server_key);
+        }
+        if let Some(token) = &token {
+            collector = collector.with_bearer_token(token);
+        }
+        if receivers.unix_socket {
+            collector = collector.with_unix_socket(&daemon::socket_path(name)?);
+        }
+        let handle = collector.start().map_err(|e| anyhow::anyhow!("{e}"))?;
+
+        // Wait for SIGTERM/SIGINT.
+        tokio::signal::ctrl_c().await?;
+        tracing::info!("Shutting down collector...");
+        handle.shutdown().await;
+        Ok(())
+    })
+}
+
+fn cmd_ingest(args: &IngestArgs) -> Result<()> {
+    let data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
+    let storage = storage_config()?;
+    let db_path = lotel_storage::backend_db_path(storage.backend)?;
+    let _lock = if args.wait {
+        lotel_storage::IngestLock::acquire(&db_path)?
+    } else {
+        lotel_storage::IngestLock::try_acquire(&db_path)?
+    };
+    let store = lotel_storage::Store::open_default(&storage, false)?.with_cancel(interrupt());
+    let mut ingester = configured_ingester()?;
+    if let Some(workers) = args.workers {
+        ingester = ingester.with_workers(workers);
+    }
+    if let Some(rate) = &args.sample {
+        ingester = ingester.with_sampler(lotel_storage::Sampler::parse(rate)?);
+    }
+    if let Some(rows) = args.batch_rows {
+        ingester = ingester.with_batch_rows(rows);
+    }
+    if args.read_json {
+        ingester = ingester.with_read_json(true);
+    }
+    let backend = store.backend();
+    if args.full {
+        backend.clear()?;
+    } else {
+        backend.load_cursors(&mut ingester)?;
+    }
+    let report = backend.ingest_new(&mut ingester, &data_path)?;
+    let span = tracing::Span::current();
+    span.record("traces", report.traces);
+    span.record("metrics", report.metrics);
+    span.record("logs", report.logs);
+    tracing::info!("Ingestion complete: {report}");
+    if args.consume {
+        let reclaimed = backend.consume(&mut ingester, &data_path, args.archive_dir.as_deref())?;
+        tracing::info!("Consumed {reclaimed} bytes of ingested JSONL");
+    }
+    store.close()
+}
+
+/// `--memory-limit` and `--threads`, set once at startup.
+static LIMIT_FLAGS: std::sync::OnceLock<(Option<String>, Option<usize>)> =
+    std::sync::OnceLock::new();
+
+/// The `storage` section of the collector config, selecting the backend, with the limit
+/// flags applied. Also installs the resulting DuckDB limits for every connection this
+/// process opens.
+fn storage_config() -> Result<lotel_storage::StorageConfig> {
+    let config = lotel_collector::config::load_config().map_err(|e| anyhow::anyhow!("{e}"))?;
+    let mut storage = config.storage;
+    if let Some((memory_limit, threads)) = LIMIT_FLAGS.get() {
+        storage.memory_limit = memory_limit.clone().or(storage.memory_limit);
+        storage.threads = threads.or(storage.threads);
+    }
+    lotel_storage::set_resource_limits(storage.resource_limits());
+    Ok(storage)
+}
+
+/// Read-only DuckDB connection for the analytics commands, over the configured backend.
+fn query_db() -> Result<QueryDb> {
+    let conn = lotel_storage::open_query_db(&storage_config()?)?;
+    let watch = interrupt().watch(&conn);
+    Ok(QueryDb {
+        conn,
+        _watch: watch,
+    })
+}
+
+/// A [`query_db`] connection whose queries Ctrl-C interrupts.
+struct QueryDb {
+    conn: duckdb::Connection,
+    _watch: lotel_storage::cancel::Watch,
+}
+
+impl std::ops::Deref for QueryDb {
+    type Target = duckdb::Connection;
+
+    fn deref(&self) -> &duckdb::Connection {
+        &self.conn
+    }
+}
+
+/// Cancelled by Ctrl-C (see [`install_interrupt_handler`]). Stores and connections opened
+/// for a command watch it, so the running query stops and the command unwinds normally:
+/// the open ingest batch rolls back and locks are released.
+fn interrupt() -> &'static lotel_storage::Cancel {
+    static INTERRUPT: std::sync::OnceLock<lotel_storage::Cancel> = std::sync::OnceLock::new();
+    INTERRUPT.get_or_init(lotel_storage::Cancel::new)
+}
+
+/// How long after Ctrl-C a command gets to unwind before the process exits anyway.
+const INTERRUPT_GRACE: std::time::Duration = std::time::Duration::from_secs(5);
+
+/// On Ctrl-C, cancel [`interrupt`]; on a second Ctrl-C, or if the command is still running
+/// after [`INTERRUPT_GRACE`] (e.g. sleeping between polls), exit with status 130.
+fn install_interrupt_handler() {
+    std::thread::spawn(|| {
+        let Ok(rt) = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()
+        else {
+            return;
+        };
+        rt.block_on(async {
+            if tokio::signal::ctrl_c().await.is_err() {
+                return;
+            }
+            interrupt().cancel();
+            tokio::select! {
+                _ = tokio::signal::ctrl_c() => {}
+                _ = tokio::time::sleep(INTERRUPT_GRACE) => {}
+            }
+            tracing::warn!("Interrupted");
+            exit::exit(exit::ExitKind::Interrupted);
+        });
+    });
+}
+
+/// Commands that handle Ctrl-C themselves: servers (including a foreground collector) and
+/// generators shut down gracefully, and the shell's line editor reads it as input.
+fn handles_interrupt(command: &Command) -> bool {
+    !matches!(
+        command,
+        Command::Serve { .. }
+            | Command::RunCollector { .. }
+            | Command::Start {
+                foreground: true,
+                ..
+            }
+            | Command::Gen { .. }
+            | Command::Run { .. }
+            | Command::Shell
+    )
+}
+
+/// Commands whose spans are sent with `LOTEL_SELF_TELEMETRY`. Long-running ones (the
+/// collector, `serve`, `tail`, `query --watch`) are left out: spans would pile up unsent.
+fn self_instrumented(command: &Command) -> bool {
+    matches!(
+        command,
+        Command::Ingest {
+            subcommand: None,
+            ..
+        } | Command::Query { watch: None, .. }
+            | Command::Prune {
+                subcommand: None,
+                ..
+            }
+    )
+}
+
+/// Commands that run DuckDB SQL. Every backend supports the collector commands, ingest,
+/// prune, and the row queries (checked further in [`cmd_query`]).
+fn needs_duckdb(command: &Command) -> bool {
+    !matches!(
+        command,
+        Command::Start { .. }
+            | Command::Stop { .. }
+            | Command::Adopt { .. }
+            | Command::Upgrade { .. }
+            | Command::Status { .. }
+            | Command::Health { .. }
+            | Command::Collector { .. }
+            | Command::Env { .. }
+            | Command::Run { .. }
+            | Command::Ingest {
+                subcommand: None,
+                ..
+            }
+            | Command::Query { .. }
+            | Command::Gen { .. }
+            | Command::Prune { .. }
+            | Command::Db {
+                subcommand: DbCommand::Health
+            }
+            | Command::Smoke { .. }
+            | Command::Version
+            | Command::Generate { .. }
+            | Command::Completion { .. }
+            | Command::Complete { .. }
+            | Command::RunCollector { .. }
+    )
+}
+
+/// Build an ingester with the rules from the `ingestion` section of the collector config.
+fn configured_ingester() -> Result<lotel_storage::IncrementalIngester> {
+    let config = lotel_collector::config::load_config().map_err(|e| anyhow::anyhow!("{e}"))?;
+    let mut ingester = lotel_storage::IncrementalIngester::new().with_cancel(interrupt().clone());
+    let Some(ingestion) = config.ingestion else {
+        return Ok(ingester);
+    };
+    if let Some(rules) = &ingestion.scrub {
+        ingester = ingester.with_scrubber(lotel_storage::Scrubber::new(rules)?);
+    }
+    if let Some(rate) = &ingestion.sample {
+        ingester = ingester.with_sampler(lotel_storage::Sampler::parse(rate)?);
+    }
+    if let Some(rows) = ingestion.batch_rows {
+        ingester = ingester.with_batch_rows(rows);
+    }
+    Ok(ingester.with_read_json(ingestion.read_json))
+}
+
+fn cmd_import(format: ImportFormat, file: &Path, wait: bool) -> Result<()> {
+    let input = if file == Path::new("-") {
+        std::io::read_to_string(std::io::stdin()).context("reading stdin")?
+    } else {
+        std::fs::read_to_string(file).with_context(|| format!("reading {}", file.display()))?
+    };
+    // Imported spans go through the same scrub rules as collected ones.
+    let config = lotel_collector::config::load_config().map_err(|e| anyhow::anyhow!("{e}"))?;
+    let scrubber = match config.ingestion.and_then(|i| i.scrub) {
+        Some(rules) => lotel_storage::Scrubber::new(&rules)?,
+        None => lotel_storage::Scrubber::default(),
+    };
+
+    // Imports append through DuckDB's own tables, which the Parquet mode only stages.
+    if storage_config()?.backend != lotel_storage::BackendKind::Duckdb {
+        bail!("import needs the duckdb storage backend");
+    }
+    let db_path = lotel_storage::default_db_path()?;
+    let _lock = if wait {
+        lotel_storage::IngestLock::acquire(&db_path)?
+    } else {
+        lotel_storage::IngestLock::try_acquire(&db_path)?
+    };
+    let conn = lotel_storage::open_db(&db_path)?;
+    let report = match format {
+        ImportFormat::Jaeger => lotel_storage::import_jaeger(&conn, &input, &scrubber)?,
+        ImportFormat::Zipkin => lotel_storage::import_zipkin(&conn, &input, &scrubber)?,
+        ImportFormat::Openmetrics => {
+            let now = chrono::Utc::now().naive_utc();
+            lotel_storage::import_openmetrics(&conn, &input, now, &scrubber)?
+        }
+    };
+    tracing::info!("Import complete: {report}");
+    Ok(())
+}
+
+fn cmd_db_encrypt() -> Result<()> {
+    let Some(key) = std::env::var(lotel_storage::ENCRYPTION_KEY_ENV)
+        .ok()
+        .filter(|k| !k.is_empty())
+    else {
+        bail!(
+            "set {} to the key to encrypt with",
+            lotel_storage::ENCRYPTION_KEY_ENV
+        );
+    };
+    let backend = storage_config()?.backend;
+    if backend != lotel_storage::BackendKind::Duckdb {
+        exit::bad_args!("db encrypt needs the duckdb storage backend");
+    }
+    let db_path = lotel_storage::backend_db_path(backend)?;
+    if !db_path.exists() {
+        bail!(
+            "no database at {}; new databases are created encrypted while {} is set",
+            db_path.display(),
+            lotel_storage::ENCRYPTION_KEY_ENV
+        );
+    }
+    let _lock = lotel_storage::IngestLock::try_acquire(&db_path)?;
+    lotel_storage::encrypt_db(&db_path, &key)?;
+    tracing::info!(
+        "Encrypted {}. Keep {} set for `lotel start` and every query.",
+        db_path.display(),
+        lotel_storage::ENCRYPTION_KEY_ENV
+    );
+    Ok(())
+}
+
+fn cmd_db_compact(sort: bool) -> Result<()> {
+    let backend = storage_config()?.backend;
+    if backend != lotel_storage::BackendKind::Duckdb {
+        exit::bad_args!("db compact needs the duckdb storage backend");
+    }
+    let db_path = lotel_storage::backend_db_path(backend)?;
+    if !db_path.exists() {
+        return Err(exit::fail(
+            exit::ExitKind::NoData,
+            format!("no database at {}", db_path.display()),
+        ));
+    }
+    let _lock = lotel_storage::IngestLock::try_acquire(&db_path)?;
+    let report = lotel_storage::compact_db(&db_path, &lotel_storage::DbConfig::default(), sort)?;
+    tracing::info!(
+        "Compacted {}: {} -> {} bytes",
+        report.path,
+        report.before_bytes,
+        report.after_bytes
+    );
+    print_json(&report);
+    Ok(())
+}
+
+fn cmd_db_health() -> Result<()> {
+    let storage = storage_config()?;
+    let health = match lotel_storage::Store::open_default(&storage, true) {
+        Ok(store) => {
+            let health = store.health();
+            store.close()?;
+            health
+        }
+        Err(e) => lotel_storage::StoreHealth {
+            backend: storage.backend,
+            path: lotel_storage::backend_db_path(storage.backend)?
+                .display()
+                .to_string(),
+            read_only: true,
+            healthy: false,
+            error: Some(format!("{e:#}")),
+        },
+    };
+    print_json(&health);
+    if !health.healthy {
+        exit::exit(exit::ExitKind::Unhealthy);
+    }
+    Ok(())
+}
+
+fn cmd_ingest_history(limit: usize) -> Result<()> {
+    // History stays in the backend's DuckDB file, Parquet mode included.
+    let db_path = lotel_storage::backend_db_path(storage_config()?.backend)?;
+    let conn = lotel_storage::open_db_with(&db_path, &lotel_storage::DbConfig::read_only())?;
+    let entries = lotel_storage::ingest_history(&conn, limit)?;
+    print_json(&entries);
+    Ok(())
+}
+
+fn cmd_query(
+    fresh: bool,
+    stream: bool,
+    fields: Option<&str>,
+    explain: bool,
+    watch: Option<&str>,
+    subcommand: QueryCommand,
+) -> Result<()> {
+    let storage = storage_config()?;
+    if !storage.backend.uses_duckdb() && (fields.is_some() || explain || watch.is_some()) {
+        bail!("--fields, --explain, and --watch need the duckdb or parquet storage backend");
+    }
+    if let Some(watch) = watch {
+        if stream || explain {
+            exit::bad_args!("--watch cannot be combined with --stream or --explain");
+        }
+        return watch_query(fresh, fields, watch, subcommand);
+    }
+    if fresh {
+        fresh_ingest(false)?;
+    }
+    let output = if stream {
+        QueryOutput::Ndjson
+    } else {
+        QueryOutput::Json
+    };
+    let store = lotel_storage::Store::open_default(&storage, true)?.with_cancel(interrupt());
+    match store.backend().duckdb() {
+        Some(conn) => run_query(conn, output, fields, explain, subcommand)?,
+        None => run_backend_query(store.backend(), output, subcommand)?,
+    }
+    store.close()
+}
+
+/// The row queries on a backend without DuckDB, which returns them collected.
+fn run_backend_query(
+    store: &dyn lotel_storage::Backend,
+    output: QueryOutput,
+    subcommand: QueryCommand,
+) -> Result<()> {
+    fn print_rows<T: Serialize>(output: QueryOutput, rows: Vec<T>) -> Result<()> {
+        if output != QueryOutput::Ndjson {
+            output.print(&rows);
+            return Ok(());
+        }
+        let mut out = NdjsonWriter::stdout();
+        for row in &rows {
+            out.write(row)?;
+        }
+        out.finish()
+    }
+
+    match subcommand {
+        QueryCommand::Traces {
+            filter,
+            trace_id,
+            kind,
+            status,
+            roots: false,
             limit,
         } => {
-            let opts = build_query_opts(service, since, until, limit)?;
-            let results = lotel_storage::query_traces(&conn, &opts)?;
-            print_json(&results);
+            let mut opts = build_query_opts(filter, limit)?;
+            opts.trace_id = trace_id;
+            opts.kind = kind
+                .as_deref()
+                .map(lotel_storage::parse_span_kind)
+                .transpose()?;
+            opts.status_code = status
+                .as_deref()
+                .map(lotel_storage::parse_status_code)
+                .transpose()?;
+            print_rows(output, store.query_traces(&opts)?)
+        }
+        QueryCommand::Trace {
+            trace_id,
+            waterfall: false,
+            ..
+        } => {
+            let opts = lotel_storage::QueryOptions {
+                trace_id: Some(trace_id),
+                ..Default::default()
+            };
+            print_rows(output, store.query_traces(&opts)?)
         }
         QueryCommand::Metrics {
-            service,
-            since,
-            until,
+            filter,
             limit,
+            temporality,
         } => {
-            let opts = build_query_opts(service, since, until, limit)?;
-            let results = lotel_storage::query_metrics(&conn, &opts)?;
-            print_json(&results);
+            let opts = build_query_opts(filter, limit)?;
+            let mut metrics = store.query_metrics(&opts)?;
+            if let Some(t) = temporality {
+                let mut converter = lotel_storage::TemporalityConverter::new(t.into());
+                metrics = metrics
+                    .into_iter()
+                    .filter_map(|r| converter.convert(r))
+                    .collect();
+            }
+            print_rows(output, metrics)
         }
         QueryCommand::Logs {
-            service,
-            since,
-            until,
+            filter,
+            trace_id,
+            body_fields,
+            limit,
+        } => {
+            let mut opts = build_query_opts(filter, limit)?;
+            opts.trace_id = trace_id;
+            opts.body_fields = body_fields
+                .iter()
+                .map(|f| lotel_storage::AttrFilter::parse(f))
+                .collect::<Result<_>>()?;
+            print_rows(output, store.query_logs(&opts)?)
+        }
+        QueryCommand::Traces { roots: true, .. } => {
+            bail!("--roots needs the duckdb storage backend")
+        }
+        QueryCommand::Trace {
+            waterfall: true, ..
+        } => bail!("--waterfall needs the duckdb storage backend"),
+        QueryCommand::Aggregate { .. } => {
+            bail!("query aggregate needs the duckdb storage backend")
+        }
+    }
+}
+
+/// Incremental ingest for `--fresh` and follow modes, skipped when another ingest holds the
+/// lock. `quiet` suppresses the progress and skip messages.
+fn fresh_ingest(quiet: bool) -> Result<()> {
+    let data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
+    let storage = storage_config()?;
+    let db_path = lotel_storage::backend_db_path(storage.backend)?;
+    match lotel_storage::IngestLock::try_acquire(&db_path) {
+        Ok(_lock) => {
+            let store =
+                lotel_storage::Store::open_default(&storage, false)?.with_cancel(interrupt());
+            let mut ingester = configured_ingester()?;
+            store.backend().load_cursors(&mut ingester)?;
+            let report = store.backend().ingest_new(&mut ingester, &data_path)?;
+            // Release the writer before the read-only query store opens.
+            store.close()?;
+            if report.total() > 0 && !quiet {
+                tracing::info!("Ingested {report}");
+            }
+        }
+        Err(e) if !quiet => tracing::info!("Skipping --fresh ingest: {e}"),
+        Err(_) => {}
+    }
+    Ok(())
+}
+
+/// `query --watch`: re-run the query every interval and redraw it as a table until Ctrl-C.
+fn watch_query(
+    fresh: bool,
+    fields: Option<&str>,
+    interval: &str,
+    subcommand: QueryCommand,
+) -> Result<()> {
+    let interval = time::parse_duration(interval)?
+        .to_std()
+        .ok()
+        .filter(|d| !d.is_zero())
+        .context("--watch interval must be positive")?;
+    let terminal = std::io::stdout().is_terminal();
+    loop {
+        if fresh {
+            fresh_ingest(false)?;
+        }
+        if terminal {
+            // Clear the screen and move the cursor home.
+            print!("\x1b[2J\x1b[H");
+        }
+        println!(
+            "Every {}s — {} (Ctrl-C to exit)\n",
+            interval.as_secs_f64(),
+            time::display_tz().render(chrono::Utc::now().naive_utc())
+        );
+        {
+            // Reopened each round and closed while sleeping, so ingests (ours or the
+            // collector's) can take the write lock.
+            let conn = query_db()?;
+            run_query(&conn, QueryOutput::Table, fields, false, subcommand.clone())?;
+        }
+        std::io::stdout().flush()?;
+        std::thread::sleep(interval);
+    }
+}
+
+/// Run a `query` subcommand on an open connection and print its results.
+fn run_query(
+    conn: &duckdb::Connection,
+    output: QueryOutput,
+    fields: Option<&str>,
+    explain: bool,
+    subcommand: QueryCommand,
+) -> Result<()> {
+    match subcommand {
+        QueryCommand::Traces {
+            filter,
+            trace_id,
+            kind,
+            status,
+            roots,
+            limit,
+        } => {
+            let mut opts = build_query_opts(filter, limit)?;
+            opts.trace_id = trace_id;
+            opts.kind = kind
+                .as_deref()
+                .map(lotel_storage::parse_span_kind)
+                .transpose()?;
+            opts.status_code = status
+                .as_deref()
+                .map(lotel_storage::parse_status_code)
+                .transpose()?;
+            if roots && (fields.is_some() || explain) {
+                exit::bad_args!("--fields and --explain cannot be combined with --roots");
+            }
+            if explain {
+                return print_explain(conn, lotel_storage::Signal::Traces, &opts, fields);
+            }
+            if let Some(fields) = fields {
+                return print_projected(conn, lotel_storage::Signal::Traces, &opts, fields, output);
+            }
+            match (roots, output == QueryOutput::Ndjson) {
+                (true, true) => {
+                    let mut out = NdjsonWriter::stdout();
+                    lotel_storage::for_each_trace_root(conn, &opts, |r| out.write(&r))?;
+                    out.finish()?;
+                }
+                (true, false) => output.print(&lotel_storage::query_trace_roots(conn, &opts)?),
+                (false, true) => {
+                    let mut out = NdjsonWriter::stdout();
+                    lotel_storage::for_each_trace(conn, &opts, |r| out.write(&r))?;
+                    out.finish()?;
+                }
+                (false, false) => output.print(&lotel_storage::query_traces(conn, &opts)?),
+            }
+        }
+        QueryCommand::Metrics {
+            filter,
+            limit,
+            temporality,
+        } => {
+            let opts = build_query_opts(filter, limit)?;
+            if temporality.is_some() && (fields.is_some() || explain) {
+                exit::bad_args!("--temporality cannot be combined with --fields or --explain");
+            }
+            if explain {
+                return print_explain(conn, lotel_storage::Signal::Metrics, &opts, fields);
+            }
+            if let Some(fields) = fields {
+                return print_projected(
+                    conn,
+                    lotel_storage::Signal::Metrics,
+                    &opts,
+                    fields,
+                    output,
+                );
+            }
+            let mut converter =
+                temporality.map(|t| lotel_storage::TemporalityConverter::new(t.into()));
+            let mut convert = |r| match &mut converter {
+                Some(converter) => converter.convert(r),
+                None => Some(r),
+            };
+            if output == QueryOutput::Ndjson {
+                let mut out = NdjsonWriter::stdout();
+                lotel_storage::for_each_metric(conn, &opts, |r| match convert(r) {
+                    Some(r) => out.write(&r),
+                    None => Ok(()),
+                })?;
+                out.finish()?;
+            } else {
+                let metrics: Vec<_> = lotel_storage::query_metrics(conn, &opts)?
+                    .into_iter()
+                    .filter_map(convert)
+                    .collect();
+                output.print(&metrics);
+            }
+        }
+        QueryCommand::Logs {
+            filter,
+            trace_id,
+            body_fields,
             limit,
         } => {
-            let opts = build_query_opts(service, since, until, limit)?;
-            let results = lotel_storage::query_logs(&conn, &opts)?;
-            print_json(&results);
+            let mut opts = build_query_opts(filter, limit)?;
+            opts.trace_id = trace_id;
+            opts.body_fields = body_fields
+                .iter()
+                .map(|f| lotel_storage::AttrFilter::parse(f))
+                .collect::<Result<_>>()?;
+            if explain {
+                return print_explain(conn, lotel_storage::Signal::Logs, &opts, fields);
+            }
+            if let Some(fields) = fields {
+                return print_projected(conn, lotel_storage::Signal::Logs, &opts, fields, output);
+            }
+            if output == QueryOutput::Ndjson {
+                let mut out = NdjsonWriter::stdout();
+                lotel_storage::for_each_log(conn, &opts, |r| out.write(&r))?;
+                out.finish()?;
+            } else {
+                output.print(&lotel_storage::query_logs(conn, &opts)?);
+            }
+        }
+        QueryCommand::Trace {
+            trace_id,
+            waterfall: false,
+            ..
+        } => run_query(
+            conn,
+            output,
+            fields,
+            explain,
+            QueryCommand::Traces {
+                filter: FilterArgs::default(),
+                trace_id: Some(trace_id),
+                kind: None,
+                status: None,
+                roots: false,
+                limit: None,
+            },
+        )?,
+        QueryCommand::Trace {
+            trace_id,
+            waterfall: true,
+            width,
+            no_color,
+        } => {
+            if fields.is_some() || explain || output == QueryOutput::Ndjson {
+                exit::bad_args!(
+                    "--waterfall cannot be combined with --fields, --explain, or --stream"
+                );
+            }
+            let opts = lotel_storage::QueryOptions {
+                trace_id: Some(trace_id.clone()),
+                ..Default::default()
+            };
+            let spans = lotel_storage::query_traces(conn, &opts)?;
+            if spans.is_empty() {
+                return Err(exit::fail(
+                    exit::ExitKind::NoData,
+                    format!("no spans found for trace {trace_id}"),
+                ));
+            }
+            print!(
+                "{}",
+                waterfall::render(&spans, width.into(), style::color_enabled(no_color))
+            );
         }
         QueryCommand::Aggregate {
             metric,
-            service,
-            since,
-            until,
+            filter,
+            func,
+            attribute,
+            bucket,
         } => {
-            let opts = build_query_opts(service, since, until, None)?;
-            let result = lotel_storage::aggregate_metrics(&conn, &opts, &metric)?;
-            print_json(&result);
+            if fields.is_some() || explain {
+                exit::bad_args!("--fields and --explain do not apply to query aggregate");
+            }
+            if matches!(func, Some(AggregateFn::CountDistinct)) && attribute.is_none() {
+                exit::bad_args!("--fn count-distinct needs --attribute");
+            }
+            let opts = build_query_opts(filter, None)?;
+            let names = lotel_storage::metric_names(conn, &opts, &metric)?;
+            if names.is_empty() {
+                return Err(exit::fail(
+                    exit::ExitKind::NoData,
+                    format!("no metrics match {}", metric.join(", ")),
+                ));
+            }
+            // A single exact name keeps printing one object rather than an array.
+            let single = metric.len() == 1 && !metric[0].contains('*');
+            match func {
+                None => {
+                    let results = names
+                        .iter()
+                        .map(|m| lotel_storage::aggregate_metrics(conn, &opts, m))
+                        .collect::<Result<Vec<_>>>()?;
+                    output.print_one_or_all(results, single);
+                }
+                Some(AggregateFn::Rate) => {
+                    let bucket = time::parse_duration(&bucket)?;
+                    let mut points = Vec::new();
+                    for name in &names {
+                        points.extend(lotel_storage::counter_rate(conn, &opts, name, bucket)?);
+                    }
+                    output.print(&points);
+                }
+                Some(func) => {
+                    let func = match func {
+                        AggregateFn::Last => lotel_storage::MetricFn::Last,
+                        AggregateFn::Sum => lotel_storage::MetricFn::Sum,
+                        AggregateFn::Stddev => lotel_storage::MetricFn::Stddev,
+                        AggregateFn::CountDistinct => lotel_storage::MetricFn::CountDistinct(
+                            attribute.expect("checked above"),
+                        ),
+                        AggregateFn::Rate => unreachable!("handled above"),
+                    };
+                    let results = names
+                        .iter()
+                        .map(|m| lotel_storage::aggregate_metric_fn(conn, &opts, m, &func))
+                        .collect::<Result<Vec<_>>>()?;
+                    output.print_one_or_all(results, single);
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Output only the `--fields` columns of a traces, metrics, or logs query.
+fn print_projected(
+    conn: &duckdb::Connection,
+    signal: lotel_storage::Signal,
+    opts: &lotel_storage::QueryOptions,
+    fields: &str,
+    output: QueryOutput,
+) -> Result<()> {
+    let fields = lotel_storage::parse_fields(signal, fields)?;
+    if output == QueryOutput::Ndjson {
+        let mut out = NdjsonWriter::stdout();
+        lotel_storage::for_each_projected(conn, signal, opts, &fields, |r| out.write(&r))?;
+        out.finish()
+    } else {
+        output.print(&lotel_storage::query_projected(
+            conn, signal, opts, &fields,
+        )?);
+        Ok(())
+    }
+}
+
+/// Show how a traces, metrics, or logs query runs instead of its results.
+fn print_explain(
+    conn: &duckdb::Connection,
+    signal: lotel_storage::Signal,
+    opts: &lotel_storage::QueryOptions,
+    fields: Option<&str>,
+) -> Result<()> {
+    let fields = fields
+        .map(|f| lotel_storage::parse_fields(signal, f))
+        .transpose()?;
+    let explain = lotel_storage::explain_query(conn, signal, opts, fields.as_deref())?;
+    println!("-- SQL\n{}\n", explain.sql);
+    println!("-- Parameters");
+    if explain.params.is_empty() {
+        println!("(none)");
+    }
+    for (i, param) in explain.params.iter().enumerate() {
+        println!("${} = {param}", i + 1);
+    }
+    println!("\n-- Plan (EXPLAIN ANALYZE)\n{}", explain.plan);
+    Ok(())
+}
+
+fn cmd_graph(since: Option<String>, until: Option<String>, format: GraphFormat) -> Result<()> {
+    let opts = lotel_storage::QueryOptions {
+        since: since.map(|s| time::parse_time(&s)).transpose()?,
+        until: until.map(|s| time::parse_time(&s)).transpose()?,
+        ..Default::default()
+    };
+    let conn = query_db()?;
+    let edges = lotel_storage::service_graph(&conn, &opts)?;
+    match format {
+        GraphFormat::Json => print_json(&edges),
+        GraphFormat::Dot => print!("{}", lotel_storage::graph_to_dot(&edges)),
+        GraphFormat::Mermaid => print!("{}", lotel_storage::graph_to_mermaid(&edges)),
+    }
+    Ok(())
+}
+
+fn cmd_diff(baseline: &str, current: &str, service: Option<String>, threshold: &str) -> Result<()> {
+    let window = |s: &str| -> Result<lotel_storage::QueryOptions> {
+        let (since, until) = time::parse_window(s)?;
+        Ok(lotel_storage::QueryOptions {
+            service: service.clone(),
+            since: Some(since),
+            until: Some(until),
+            ..Default::default()
+        })
+    };
+    let threshold = parse_fraction(threshold)?;
+    let conn = query_db()?;
+    let diffs =
+        lotel_storage::diff_windows(&conn, &window(baseline)?, &window(current)?, threshold)?;
+    print_json(&diffs);
+    if diffs.iter().any(|d| d.regression) {
+        exit::exit(exit::ExitKind::AssertionFailed);
+    }
+    Ok(())
+}
+
+fn cmd_assert(
+    filter: FilterArgs,
+    assertion: &lotel_storage::Assertion,
+    rules_path: Option<&Path>,
+    junit: Option<&Path>,
+    github: bool,
+) -> Result<()> {
+    let outcomes = match rules_path {
+        Some(path) => {
+            let file = rules::load_rules(path)?;
+            let defaults = build_query_opts(filter, None)?;
+            let conn = query_db()?;
+            let mut outcomes = Vec::new();
+            for rule in &file.rules {
+                let report = lotel_storage::evaluate_assertion(
+                    &conn,
+                    &rule.query_opts(&defaults)?,
+                    &rule.assertion()?,
+                )
+                .with_context(|| format!("evaluating rule {:?}", rule.name))?;
+                outcomes.push(rules::RuleOutcome {
+                    rule: rule.name.clone(),
+                    report,
+                });
+            }
+            outcomes
+        }
+        None => {
+            if assertion.is_empty() {
+                bail!(
+                    "no assertions given (e.g. --no-error-spans, --max-p95 500ms, --min-spans 10, --rules FILE)"
+                );
+            }
+            let opts = build_query_opts(filter, None)?;
+            let conn = query_db()?;
+            vec![rules::RuleOutcome {
+                rule: "assert".into(),
+                report: lotel_storage::evaluate_assertion(&conn, &opts, assertion)?,
+            }]
+        }
+    };
+
+    if let Some(path) = junit {
+        std::fs::write(path, rules::junit_xml(&outcomes))
+            .with_context(|| format!("writing {}", path.display()))?;
+    }
+    if github {
+        print!("{}", rules::github_annotations(&outcomes));
+    } else if rules_path.is_some() {
+        print_json(&outcomes);
+    } else {
+        print_json(&outcomes[0].report);
+    }
+    if outcomes.iter().any(|o| !o.report.passed) {
+        exit::exit(exit::ExitKind::AssertionFailed);
+    }
+    Ok(())
+}
+
+fn cmd_bench_ingest(
+    rows: &str,
+    workers: Option<usize>,
+    seed: u64,
+    dir: Option<PathBuf>,
+    read_json: bool,
+) -> Result<()> {
+    let rows = bench::parse_count(rows)?;
+    let (dir, scratch) = bench_dir(dir)?;
+
+    tracing::info!("Generating {rows} rows in {}...", dir.display());
+    let report = bench::run_ingest(&dir, rows, workers, seed, read_json);
+    if scratch {
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+    let report = report?;
+    tracing::info!(
+        "Ingested {} rows in {:.2}s ({:.0} rows/sec)",
+        report.rows,
+        report.ingest_secs,
+        report.rows_per_sec
+    );
+    print_json(&report);
+    Ok(())
+}
+
+fn cmd_bench_query(rows: &str, seed: u64, dir: Option<PathBuf>) -> Result<()> {
+    let rows = bench::parse_count(rows)?;
+    let (dir, scratch) = bench_dir(dir)?;
+
+    tracing::info!(
+        "Generating and ingesting {rows} rows in {}...",
+        dir.display()
+    );
+    let report = bench::run_query(&dir, rows, seed);
+    if scratch {
+        let _ = std::fs::remove_dir_all(&dir);
+    }
+    let report = report?;
+    for q in &report.queries {
+        tracing::info!(
+            "{:<17} {:>8.2}ms stored, {:>8.2}ms baseline ({:.1}x)",
+            q.query,
+            q.stored_ms,
+            q.baseline_ms,
+            q.speedup
+        );
+    }
+    print_json(&report);
+    Ok(())
+}
+
+/// The bench directory and whether it is a scratch dir to remove afterwards.
+fn bench_dir(dir: Option<PathBuf>) -> Result<(PathBuf, bool)> {
+    Ok(match dir {
+        Some(dir) => {
+            if dir.join("lotel.db").exists() {
+                bail!("{} already contains a lotel.db", dir.display());
+            }
+            (dir, false)
         }
+        None => (
+            std::env::temp_dir().join(format!("lotel-bench-{}", std::process::id())),
+            true,
+        ),
+    })
+}
+
+fn cmd_gen(
+    endpoint: String,
+    rate: f64,
+    duration: Option<&str>,
+    error_rate: &str,
+    seed: Option<u64>,
+) -> Result<()> {
+    if !rate.is_finite() || rate <= 0.0 {
+        exit::bad_args!("--rate must be positive");
     }
+    let error_rate = match error_rate.trim().trim_end_matches('%').parse::<f64>() {
+        Ok(0.0) => 0.0,
+        _ => match parse_fraction(error_rate)? {
+            r if r <= 1.0 => r,
+            _ => exit::bad_args!("--error-rate must be at most 100%"),
+        },
+    };
+    let config = generate::GenConfig {
+        endpoint,
+        rate,
+        duration: duration
+            .map(time::parse_duration)
+            .transpose()?
+            .map(|d| d.to_std())
+            .transpose()?,
+        error_rate,
+        seed: seed.unwrap_or_else(|| {
+            std::time::SystemTime::now()
+                .duration_since(std::time::UNIX_EPOCH)
+                .map(|d| d.as_nanos() as u64)
+                .unwrap_or_default()
+        }),
+    };
+
+    tracing::info!(
+        "Sending ~{rate} traces/s to {} (Ctrl-C to stop)...",
+        config.endpoint
+    );
+    let rt = tokio::runtime::Runtime::new()?;
+    let report = rt.block_on(generate::run(&config))?;
+    print_json(&report);
     Ok(())
 }
 
 fn cmd_prune(
     older_than: Option<String>,
-    service: Option<String>,
+    filter: &lotel_storage::PruneFilter,
     dry_run: bool,
     all: bool,
+    include_files: bool,
+    keep: &KeepArgs,
 ) -> Result<()> {
+    let limits = keep.limits();
     if all && older_than.is_some() {
-        bail!("--all and --older-than are mutually exclusive");
+        exit::bad_args!("--all and --older-than are mutually exclusive");
+    }
+    if all && !limits.is_empty() {
+        exit::bad_args!("--all and --keep-* are mutually exclusive");
     }
-    if !all && older_than.is_none() {
-        bail!("--older-than or --all is required (e.g., '7d', '24h')");
+    if let Some((signal, _)) = limits.iter().find(|(s, _)| !filter.applies_to(*s)) {
+        exit::bad_args!(
+            "--name matches span and metric names; {} have none",
+            signal.table()
+        );
+    }
+    if keep.per_service && limits.is_empty() {
+        exit::bad_args!("--per-service needs --keep-traces, --keep-metrics, or --keep-logs");
+    }
+    if !all && older_than.is_none() && limits.is_empty() {
+        exit::bad_args!(
+            "--older-than, --keep-traces/--keep-metrics/--keep-logs, or --all is required \
+             (e.g., --older-than 7d, --keep-traces 10000)"
+        );
+    }
+
+    if include_files && !all && older_than.is_none() {
+        exit::bad_args!("--include-files needs --older-than or --all");
+    }
+    if include_files
+        && (filter.service.is_some() || filter.name.is_some() || !filter.attrs.is_empty())
+    {
+        // An export line mixes services and names, so only age can drop it whole.
+        exit::bad_args!("--include-files cannot be combined with --service, --name, or --attr");
     }
 
-    let cutoff = if all {
+    let cutoff = match older_than.as_deref() {
         // Future cutoff catches everything.
-        chrono::Utc::now().naive_utc() + chrono::Duration::hours(1)
+        _ if all => Some(chrono::Utc::now().naive_utc() + chrono::Duration::hours(1)),
+        Some(age) => Some(chrono::Utc::now().naive_utc() - time::parse_duration(age)?),
+        None => None,
+    };
+    // Trimming files rotates them and moves ingest cursors, so no ingest may run meanwhile.
+    let storage = storage_config()?;
+    let _lock = if include_files {
+        Some(lotel_storage::IngestLock::acquire(
+            &lotel_storage::backend_db_path(storage.backend)?,
+        )?)
+    } else {
+        None
+    };
+
+    let started_at = chrono::Utc::now().naive_utc();
+    let store = lotel_storage::Store::open_default(&storage, false)?.with_cancel(interrupt());
+    let mut reports = match cutoff {
+        Some(cutoff) => store.backend().prune_matching(cutoff, filter, dry_run)?,
+        None => Vec::new(),
+    };
+    // Count limits apply to what the age threshold left.
+    for (signal, n) in limits {
+        reports.extend(
+            store
+                .backend()
+                .prune_keep(signal, n, filter, keep.per_service, dry_run)?,
+        );
+    }
+    if !dry_run {
+        let run = lotel_storage::PruneRun::from_reports(started_at, "manual", &reports);
+        store.backend().record_prune(&run)?;
+    }
+    if include_files && let Some(cutoff) = cutoff {
+        let data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
+        let mut ingester = lotel_storage::IncrementalIngester::new();
+        store.backend().load_cursors(&mut ingester)?;
+        for trim in store
+            .backend()
+            .trim_files(&mut ingester, &data_path, cutoff, dry_run)?
+        {
+            tracing::info!(
+                "{} {} ({} lines, {} bytes)",
+                if dry_run { "Would remove" } else { "Removed" },
+                trim.file_path,
+                trim.lines,
+                trim.bytes
+            );
+        }
+    }
+    store.close()?;
+    let deleted: i64 = reports.iter().map(|r| r.deleted).sum();
+    tracing::Span::current().record("deleted", deleted);
+
+    if dry_run {
+        tracing::info!("Dry run — no data was deleted.");
+    }
+    print_json(&reports);
+    Ok(())
+}
+
+fn cmd_prune_history(limit: usize) -> Result<()> {
+    let storage = storage_config()?;
+    let runs = if storage.backend.uses_duckdb() {
+        // Like ingest history, the log stays in the backend's DuckDB file.
+        let db_path = lotel_storage::backend_db_path(storage.backend)?;
+        let conn = lotel_storage::open_db_with(&db_path, &lotel_storage::DbConfig::read_only())?;
+        lotel_storage::prune_history(&conn, limit)?
     } else {
-        let dur = time::parse_duration(older_than.as_deref().unwrap())?;
-        chrono::Utc::now().naive_utc() - dur
+        let store = lotel_storage::Store::open_default(&storage, true)?;
+        let runs = store.backend().prune_history(limit)?;
+        store.close()?;
+        runs
     };
+    print_json(&runs);
+    Ok(())
+}
 
-    let conn = lotel_storage::default_db()?;
-    let reports = lotel_storage::prune(&conn, cutoff, service.as_deref(), dry_run)?;
+fn cmd_archive(older_than: &str, to: &str, dry_run: bool) -> Result<()> {
+    // Archived files are unioned back in by DuckDB queries over lotel.db.
+    if storage_config()?.backend != lotel_storage::BackendKind::Duckdb {
+        bail!("archive needs the duckdb storage backend");
+    }
+    // Archives are plain Parquet; writing them would undo the database's encryption.
+    if !dry_run && std::env::var(lotel_storage::ENCRYPTION_KEY_ENV).is_ok_and(|k| !k.is_empty()) {
+        exit::bad_args!(
+            "archive writes unencrypted Parquet; unset {} to archive",
+            lotel_storage::ENCRYPTION_KEY_ENV
+        );
+    }
+    let cutoff = chrono::Utc::now().naive_utc() - time::parse_duration(older_than)?;
+    let conn = lotel_storage::open_db(&lotel_storage::default_db_path()?)?;
+    let reports = lotel_storage::archive(&conn, cutoff, to, dry_run)?;
 
     if dry_run {
-        eprintln!("Dry run — no data was deleted.");
+        tracing::info!("Dry run — nothing was archived.");
     }
     print_json(&reports);
     Ok(())
 }
 
+/// Parse a positive fraction written as a percentage ("20%") or a ratio ("0.2").
+fn parse_fraction(s: &str) -> Result<f64> {
+    let s = s.trim();
+    let value = match s.strip_suffix('%') {
+        Some(pct) => pct.trim().parse::<f64>().map(|p| p / 100.0),
+        None => s.parse::<f64>(),
+    };
+    match value {
+        Ok(v) if v > 0.0 => Ok(v),
+        _ => bail!("invalid fraction {s:?} (expected e.g. \"20%\" or \"0.2\")"),
+    }
+}
+
 fn build_query_opts(
-    service: Option<String>,
-    since: Option<String>,
-    until: Option<String>,
+    filter: FilterArgs,
     limit: Option<usize>,
 ) -> Result<lotel_storage::QueryOptions> {
-    let since_dt = since.map(|s| time::parse_time(&s)).transpose()?;
-    let until_dt = until.map(|s| time::parse_time(&s)).transpose()?;
+    let (since_dt, until_dt) = match filter.last {
+        Some(last) => {
+            let (since, until) = time::parse_last(&last)?;
+            (Some(since), Some(until))
+        }
+        None => (
+            filter.since.map(|s| time::parse_time(&s)).transpose()?,
+            filter.until.map(|s| time::parse_time(&s)).transpose()?,
+        ),
+    };
+    let attrs = filter
+        .attrs
+        .iter()
+        .map(|a| lotel_storage::AttrFilter::parse(a))
+        .collect::<Result<_>>()?;
     Ok(lotel_storage::QueryOptions {
-        service,
+        service: filter.service,
         since: since_dt,
         until: until_dt,
         limit,
+        attrs,
+        ..Default::default()
     })
 }
 
-fn check_health_sync() -> bool {
+fn check_health_sync(url: &str) -> bool {
     let rt = match tokio::runtime::Runtime::new() {
         Ok(rt) => rt,
         Err(_) => return false,
     };
-    rt.block_on(async {
+    rt.block_on(check_health(url))
+}
+
+async fn check_health(url: &str) -> bool {
+    let healthy = async {
         let client = reqwest::Client::builder()
             .timeout(Duration::from_secs(2))
             .build()
             .ok()?;
-        let resp = client.get("http://localhost:13133/").send().await.ok()?;
+        let resp = client.get(url).send().await.ok()?;
         Some(resp.status().is_success())
-    })
-    .unwrap_or(false)
+    };
+    healthy.await.unwrap_or(false)
 }
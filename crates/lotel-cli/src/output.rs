@@ -0,0 +1,215 @@
+//! Versioned JSON output. The structure of `query` and `status` output is documented as a
+//! numbered version (README, "Output Contract"): new fields may appear within a version, but
+//! renaming or removing one bumps it. `--output-version N` keeps printing version N's field
+//! names, so scripts written against it keep working after an upgrade.
+
+use std::sync::OnceLock;
+
+use anyhow::{Result, bail};
+
+use crate::json::Json;
+
+/// The version lotel prints by default.
+pub const CURRENT_VERSION: u32 = 1;
+
+/// Environment variable equivalent of `--output-version`.
+pub const OUTPUT_VERSION_ENV: &str = "LOTEL_OUTPUT_VERSION";
+
+/// Field renames, as `(version, old name, new name)`: from `version` on the field is printed
+/// as `new name`, and pinning an earlier version prints `old name` again. Renames apply to
+/// object keys at any depth. Removed fields cannot be restored, so fields are only removed
+/// together with a rename here or after the versions that had them stop being supported.
+const RENAMES: &[(u32, &str, &str)] = &[];
+
+/// Parse `--output-version`: a supported version number, or `latest`.
+pub fn parse_version(s: &str) -> Result<u32> {
+    if s.eq_ignore_ascii_case("latest") {
+        return Ok(CURRENT_VERSION);
+    }
+    match s.parse::<u32>() {
+        Ok(v) if (1..=CURRENT_VERSION).contains(&v) => Ok(v),
+        _ => bail!("unsupported output version {s:?} (expected 1 to {CURRENT_VERSION} or latest)"),
+    }
+}
+
+static OUTPUT_VERSION: OnceLock<u32> = OnceLock::new();
+
+/// Set the process-wide `--output-version`; called once at startup.
+pub fn set_version(version: u32) {
+    let _ = OUTPUT_VERSION.set(version);
+}
+
+pub fn version() -> u32 {
+    OUTPUT_VERSION.get().copied().unwrap_or(CURRENT_VERSION)
+}
+
+/// Whether output needs rewriting for the pinned version.
+pub fn is_pinned() -> bool {
+    RENAMES.iter().any(|&(since, ..)| version() < since)
+}
+
+/// Rewrite serialized output into the pinned version's field names.
+pub fn downgrade(value: &mut Json) {
+    downgrade_to(version(), RENAMES, value);
+}
+
+fn downgrade_to(version: u32, renames: &[(u32, &str, &str)], value: &mut Json) {
+    match value {
+        Json::Object(entries) => {
+            for (key, v) in entries.iter_mut() {
+                // Newest first, so a field renamed twice ends at its oldest name.
+                for &(_, old, new) in renames.iter().rev().filter(|r| version < r.0) {
+                    if key == new {
+                        *key = old.to_string();
+                    }
+                }
+                downgrade_to(version, renames, v);
+            }
+        }
+        Json::Array(items) => items
+            .iter_mut()
+            .for_each(|v| downgrade_to(version, renames, v)),
+        _ => {}
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde::Serialize;
+    use serde::de::DeserializeOwned;
+    use serde_json::json;
+
+    /// Round-trip `full` (every field set) through `T` and return the printed keys.
+    fn keys<T: Serialize + DeserializeOwned>(full: serde_json::Value) -> Vec<String> {
+        let value = serde_json::to_value(serde_json::from_value::<T>(full).unwrap()).unwrap();
+        let mut keys: Vec<String> = value.as_object().unwrap().keys().cloned().collect();
+        keys.sort();
+        keys
+    }
+
+    fn sorted(fields: &[&str]) -> Vec<String> {
+        let mut fields: Vec<String> = fields.iter().map(|f| f.to_string()).collect();
+        fields.sort();
+        fields
+    }
+
+    /// Version 1 as documented in the README. A failure here means a field was renamed or
+    /// removed: add it to `RENAMES` and bump `CURRENT_VERSION`, or put the field back.
+    #[test]
+    fn version_1_fields_are_printed() {
+        let ts = "2024-03-09T16:00:00.123";
+        let span = keys::<lotel_storage::TraceResult>(json!({
+            "trace_id": "t", "span_id": "s", "parent_span_id": "p", "name": "GET /",
+            "kind": 2, "kind_name": "SERVER", "start_time": ts, "end_time": ts,
+            "duration_ns": 5, "status_code": 2, "status": "ERROR", "service_name": "api",
+            "attributes": {"k": "v"}, "trace_state": "k=v", "flags": 1,
+            "dropped_attributes_count": 1, "dropped_events_count": 1, "dropped_links_count": 1,
+        }));
+        let version_1 = [
+            "trace_id",
+            "span_id",
+            "parent_span_id",
+            "name",
+            "kind",
+            "kind_name",
+            "start_time",
+            "end_time",
+            "duration_ns",
+            "status_code",
+            "status",
+            "service_name",
+            "attributes",
+            "trace_state",
+            "flags",
+            "dropped_attributes_count",
+            "dropped_events_count",
+            "dropped_links_count",
+        ];
+        assert!(sorted(&version_1).iter().all(|f| span.contains(f)));
+
+        let root = keys::<lotel_storage::TraceSummary>(json!({
+            "trace_id": "t", "root_name": "GET /", "root_service": "api", "start_time": ts,
+            "end_time": ts, "duration_ns": 5, "span_count": 3, "has_error": false,
+            "services": ["api"],
+        }));
+        let version_1 = [
+            "trace_id",
+            "root_name",
+            "root_service",
+            "start_time",
+            "end_time",
+            "duration_ns",
+            "span_count",
+            "has_error",
+            "services",
+        ];
+        assert!(sorted(&version_1).iter().all(|f| root.contains(f)));
+
+        let metric = keys::<lotel_storage::MetricResult>(json!({
+            "metric_name": "m", "metric_type": "sum", "value": 1.5, "timestamp": ts,
+            "service_name": "api", "aggregation_temporality": 2, "is_monotonic": true,
+            "unit": "ms", "attributes": {"k": "v"},
+        }));
+        let version_1 = [
+            "metric_name",
+            "metric_type",
+            "value",
+            "timestamp",
+            "service_name",
+            "aggregation_temporality",
+            "is_monotonic",
+            "unit",
+            "attributes",
+        ];
+        assert!(sorted(&version_1).iter().all(|f| metric.contains(f)));
+
+        let log = keys::<lotel_storage::LogResult>(json!({
+            "timestamp": ts, "severity": "ERROR", "severity_number": 17, "body": "boom",
+            "service_name": "api", "trace_id": "t", "span_id": "s", "attributes": {"k": "v"},
+        }));
+        let version_1 = [
+            "timestamp",
+            "severity",
+            "severity_number",
+            "body",
+            "service_name",
+            "trace_id",
+            "span_id",
+            "attributes",
+        ];
+        assert!(sorted(&version_1).iter().all(|f| log.contains(f)));
+    }
+
+    #[test]
+    fn pinned_versions_get_old_names() {
+        let renames = [(2, "duration_ns", "duration"), (3, "duration", "elapsed")];
+        let printed = Json::from(json!([{"elapsed": 5, "children": [{"elapsed": 1}]}]));
+
+        let mut v1 = printed.clone();
+        downgrade_to(1, &renames, &mut v1);
+        assert_eq!(
+            v1,
+            Json::from(json!([{"duration_ns": 5, "children": [{"duration_ns": 1}]}]))
+        );
+
+        let mut v2 = printed.clone();
+        downgrade_to(2, &renames, &mut v2);
+        assert_eq!(
+            v2,
+            Json::from(json!([{"duration": 5, "children": [{"duration": 1}]}]))
+        );
+
+        let mut v3 = printed.clone();
+        downgrade_to(3, &renames, &mut v3);
+        assert_eq!(v3, printed);
+    }
+
+    #[test]
+    fn parses_supported_versions() {
+        assert_eq!(parse_version("1").unwrap(), 1);
+        assert_eq!(parse_version("latest").unwrap(), CURRENT_VERSION);
+        assert!(parse_version("0").is_err());
+        assert!(parse_version(&(CURRENT_VERSION + 1).to_string()).is_err());
+    }
+}
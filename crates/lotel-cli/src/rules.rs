@@ -0,0 +1,257 @@
+//! Assertion rules files for `lotel assert --rules`, and the CI report formats
+//! (JUnit XML, GitHub Actions annotations) for their outcomes.
+
+use std::path::Path;
+
+use anyhow::{Context, Result, bail};
+use serde::{Deserialize, Serialize};
+
+use crate::time;
+
+/// Top level of a rules file.
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct RulesFile {
+    pub rules: Vec<Rule>,
+}
+
+/// One named set of checks, scoped by service, time window, and attribute filters.
+#[derive(Debug, Deserialize)]
+#[serde(deny_unknown_fields)]
+pub struct Rule {
+    pub name: String,
+    #[serde(default)]
+    pub service: Option<String>,
+    #[serde(default)]
+    pub since: Option<String>,
+    #[serde(default)]
+    pub until: Option<String>,
+    /// Attribute filters in `--attr` syntax.
+    #[serde(default)]
+    pub attrs: Vec<String>,
+    #[serde(default)]
+    pub no_error_spans: bool,
+    /// p95 span duration limit, e.g. `500ms`.
+    #[serde(default)]
+    pub max_p95: Option<String>,
+    #[serde(default)]
+    pub min_spans: Option<i64>,
+    #[serde(default)]
+    pub no_error_logs: bool,
+    #[serde(default)]
+    pub min_logs: Option<i64>,
+}
+
+impl Rule {
+    /// The rule's filters. Those it leaves out come from `defaults`, the command-line
+    /// filters, whose attribute filters apply on top of the rule's own.
+    pub fn query_opts(
+        &self,
+        defaults: &lotel_storage::QueryOptions,
+    ) -> Result<lotel_storage::QueryOptions> {
+        let mut attrs = defaults.attrs.clone();
+        for attr in &self.attrs {
+            attrs.push(lotel_storage::AttrFilter::parse(attr)?);
+        }
+        Ok(lotel_storage::QueryOptions {
+            service: self.service.clone().or_else(|| defaults.service.clone()),
+            since: match &self.since {
+                Some(since) => Some(time::parse_time(since)?),
+                None => defaults.since,
+            },
+            until: match &self.until {
+                Some(until) => Some(time::parse_time(until)?),
+                None => defaults.until,
+            },
+            attrs,
+            ..Default::default()
+        })
+    }
+
+    pub fn assertion(&self) -> Result<lotel_storage::Assertion> {
+        Ok(lotel_storage::Assertion {
+            no_error_spans: self.no_error_spans,
+            max_p95_ms: self
+                .max_p95
+                .as_deref()
+                .map(time::parse_millis)
+                .transpose()?,
+            min_spans: self.min_spans,
+            no_error_logs: self.no_error_logs,
+            min_logs: self.min_logs,
+        })
+    }
+}
+
+/// Report of one rule (or of the ad-hoc flags, named `assert`).
+#[derive(Debug, Serialize)]
+pub struct RuleOutcome {
+    pub rule: String,
+    #[serde(flatten)]
+    pub report: lotel_storage::AssertReport,
+}
+
+pub fn load_rules(path: &Path) -> Result<RulesFile> {
+    let contents =
+        std::fs::read_to_string(path).with_context(|| format!("reading {}", path.display()))?;
+    parse_rules(&contents).with_context(|| format!("parsing {}", path.display()))
+}
+
+fn parse_rules(contents: &str) -> Result<RulesFile> {
+    let file: RulesFile = serde_yaml::from_str(contents)?;
+    if file.rules.is_empty() {
+        bail!("no rules defined");
+    }
+    for rule in &file.rules {
+        if rule.assertion()?.is_empty() {
+            bail!("rule {:?} has no checks", rule.name);
+        }
+    }
+    Ok(file)
+}
+
+/// Render outcomes as JUnit XML: one test case per check, grouped by rule.
+pub fn junit_xml(outcomes: &[RuleOutcome]) -> String {
+    let checks = || outcomes.iter().flat_map(|o| &o.report.checks);
+    let tests = checks().count();
+    let failures = checks().filter(|c| !c.passed).count();
+
+    let mut out = String::from("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n");
+    out.push_str(&format!(
+        "<testsuites name=\"lotel\" tests=\"{tests}\" failures=\"{failures}\">\n"
+    ));
+    out.push_str(&format!(
+        "  <testsuite name=\"lotel assert\" tests=\"{tests}\" failures=\"{failures}\">\n"
+    ));
+    for outcome in outcomes {
+        for check in &outcome.report.checks {
+            let case = format!(
+                "    <testcase classname=\"{}\" name=\"{}\"",
+                xml_escape(&outcome.rule),
+                xml_escape(&check.check)
+            );
+            if check.passed {
+                out.push_str(&format!("{case}/>\n"));
+            } else {
+                out.push_str(&format!(
+                    "{case}>\n      <failure message=\"{}\"/>\n    </testcase>\n",
+                    xml_escape(&check.message)
+                ));
+            }
+        }
+    }
+    out.push_str("  </testsuite>\n</testsuites>\n");
+    out
+}
+
+/// Render failed checks as GitHub Actions `::error` workflow commands.
+pub fn github_annotations(outcomes: &[RuleOutcome]) -> String {
+    let mut out = String::new();
+    for outcome in outcomes {
+        for check in outcome.report.checks.iter().filter(|c| !c.passed) {
+            out.push_str(&format!(
+                "::error title={}::{}\n",
+                escape_property(&format!("lotel assert: {}", outcome.rule)),
+                escape_data(&check.message)
+            ));
+        }
+    }
+    out
+}
+
+fn xml_escape(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+fn escape_data(s: &str) -> String {
+    s.replace('%', "%25")
+        .replace('\r', "%0D")
+        .replace('\n', "%0A")
+}
+
+fn escape_property(s: &str) -> String {
+    escape_data(s).replace(':', "%3A").replace(',', "%2C")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn outcome(passed: bool) -> RuleOutcome {
+        RuleOutcome {
+            rule: "checkout <healthy>".into(),
+            report: lotel_storage::AssertReport {
+                passed,
+                checks: vec![lotel_storage::CheckResult {
+                    check: "no_error_spans".into(),
+                    passed,
+                    actual: if passed { 0.0 } else { 2.0 },
+                    limit: 0.0,
+                    message: "2 error spans (expected none)".into(),
+                }],
+            },
+        }
+    }
+
+    #[test]
+    fn parses_rules_file() {
+        let file = parse_rules(
+            r#"
+rules:
+  - name: checkout is healthy
+    service: checkout
+    since: 10m
+    no_error_spans: true
+    max_p95: 500ms
+  - name: no error logs
+    no_error_logs: true
+    min_logs: 1
+"#,
+        )
+        .unwrap();
+        assert_eq!(file.rules.len(), 2);
+        assert_eq!(file.rules[0].assertion().unwrap().max_p95_ms, Some(500.0));
+        let defaults = lotel_storage::QueryOptions {
+            service: Some("payments".to_string()),
+            attrs: vec![lotel_storage::AttrFilter::parse("env=ci").unwrap()],
+            ..Default::default()
+        };
+        let opts = file.rules[0].query_opts(&defaults).unwrap();
+        assert_eq!(opts.service.as_deref(), Some("checkout"));
+        assert_eq!(opts.attrs.len(), 1);
+        let opts = file.rules[1].query_opts(&defaults).unwrap();
+        assert_eq!(opts.service.as_deref(), Some("payments"));
+        assert!(opts.since.is_none());
+        assert!(file.rules[1].assertion().unwrap().no_error_logs);
+    }
+
+    #[test]
+    fn rejects_rules_without_checks() {
+        let err = parse_rules("rules:\n  - name: empty\n").unwrap_err();
+        assert!(err.to_string().contains("has no checks"));
+        assert!(parse_rules("rules:\n  - name: x\n    typo: true\n").is_err());
+    }
+
+    #[test]
+    fn renders_junit() {
+        let xml = junit_xml(&[outcome(false)]);
+        assert!(xml.contains("tests=\"1\" failures=\"1\""));
+        assert!(xml.contains("classname=\"checkout &lt;healthy&gt;\""));
+        assert!(xml.contains("<failure message=\"2 error spans (expected none)\"/>"));
+
+        let xml = junit_xml(&[outcome(true)]);
+        assert!(xml.contains("name=\"no_error_spans\"/>"));
+    }
+
+    #[test]
+    fn renders_github_annotations() {
+        assert_eq!(
+            github_annotations(&[outcome(false)]),
+            "::error title=lotel assert%3A checkout <healthy>::2 error spans (expected none)\n"
+        );
+        assert!(github_annotations(&[outcome(true)]).is_empty());
+    }
+}
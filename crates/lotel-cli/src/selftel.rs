@@ -0,0 +1,367 @@
+//! Self-instrumentation. With `LOTEL_SELF_TELEMETRY` set, lotel records the `tracing` spans of
+//! its own operations (ingest, query, prune, and their steps) and, when the command finishes,
+//! sends them over OTLP to the local collector together with one duration point per
+//! operation. lotel then shows up in its own database as service `lotel`, so its
+//! performance can be debugged with `lotel-cli query traces --service lotel`.
+
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use anyhow::{Context as _, Result};
+use opentelemetry_proto::tonic::collector::metrics::v1::ExportMetricsServiceRequest;
+use opentelemetry_proto::tonic::collector::metrics::v1::metrics_service_client::MetricsServiceClient;
+use opentelemetry_proto::tonic::collector::trace::v1::ExportTraceServiceRequest;
+use opentelemetry_proto::tonic::collector::trace::v1::trace_service_client::TraceServiceClient;
+use opentelemetry_proto::tonic::common::v1::{AnyValue, KeyValue, any_value};
+use opentelemetry_proto::tonic::metrics::v1::{
+    Gauge, Metric, NumberDataPoint, ResourceMetrics, ScopeMetrics, metric, number_data_point,
+};
+use opentelemetry_proto::tonic::trace::v1::{ResourceSpans, ScopeSpans, Span, Status};
+use tracing::field::{Field, Visit};
+use tracing::span::{Attributes, Id, Record};
+use tracing::{Level, Subscriber};
+use tracing_subscriber::layer::Context;
+use tracing_subscriber::registry::LookupSpan;
+
+use crate::generate::{int_attr, resource, string_attr, unix_nanos};
+
+/// `1` or `true` to send to the local collector, or an OTLP gRPC endpoint URL.
+pub const SELF_TELEMETRY_ENV: &str = "LOTEL_SELF_TELEMETRY";
+
+/// `service.name` of lotel's own telemetry.
+pub const SERVICE_NAME: &str = "lotel";
+
+const DEFAULT_ENDPOINT: &str = "http://127.0.0.1:4317";
+
+/// Sending must never hold up the command for long, e.g. when no collector is running.
+const EXPORT_TIMEOUT: Duration = Duration::from_secs(3);
+
+const KIND_INTERNAL: i32 = 1;
+const STATUS_ERROR: i32 = 2;
+
+/// Where to send lotel's own telemetry, or `None` when self-instrumentation is off.
+pub fn endpoint() -> Option<String> {
+    endpoint_from(std::env::var(SELF_TELEMETRY_ENV).ok().as_deref())
+}
+
+fn endpoint_from(value: Option<&str>) -> Option<String> {
+    match value.map(str::trim) {
+        None | Some("" | "0" | "false") => None,
+        Some("1" | "true") => Some(DEFAULT_ENDPOINT.to_string()),
+        Some(url) => Some(url.to_string()),
+    }
+}
+
+/// `tracing` layer collecting finished spans as OTLP. Clones share what was recorded.
+#[derive(Clone, Default)]
+pub struct Recorder {
+    finished: Arc<Mutex<Finished>>,
+}
+
+#[derive(Default)]
+struct Finished {
+    spans: Vec<Span>,
+    /// `lotel.operation.duration` points, one per root span.
+    durations: Vec<NumberDataPoint>,
+}
+
+/// A span in progress, kept in the registry's span extensions.
+struct Open {
+    trace_id: [u8; 16],
+    span_id: [u8; 8],
+    parent_span_id: Vec<u8>,
+    start_ns: u64,
+    attributes: Vec<KeyValue>,
+    /// From an `error` field: the span failed with this message.
+    error: Option<String>,
+}
+
+impl Visit for Open {
+    fn record_debug(&mut self, field: &Field, value: &dyn std::fmt::Debug) {
+        self.record_str(field, &format!("{value:?}"));
+    }
+
+    fn record_str(&mut self, field: &Field, value: &str) {
+        if field.name() == "error" {
+            self.error = Some(value.to_string());
+        } else {
+            self.attributes.push(string_attr(field.name(), value));
+        }
+    }
+
+    fn record_i64(&mut self, field: &Field, value: i64) {
+        self.attributes.push(int_attr(field.name(), value));
+    }
+
+    fn record_u64(&mut self, field: &Field, value: u64) {
+        self.attributes
+            .push(int_attr(field.name(), value.min(i64::MAX as u64) as i64));
+    }
+
+    fn record_f64(&mut self, field: &Field, value: f64) {
+        self.attributes
+            .push(attr(field.name(), any_value::Value::DoubleValue(value)));
+    }
+
+    fn record_bool(&mut self, field: &Field, value: bool) {
+        self.attributes
+            .push(attr(field.name(), any_value::Value::BoolValue(value)));
+    }
+}
+
+impl<S> tracing_subscriber::Layer<S> for Recorder
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+{
+    fn on_new_span(&self, attrs: &Attributes<'_>, id: &Id, ctx: Context<'_, S>) {
+        let Some(span) = ctx.span(id) else {
+            return;
+        };
+        let parent = span.parent().and_then(|p| {
+            p.extensions()
+                .get::<Open>()
+                .map(|o| (o.trace_id, o.span_id))
+        });
+        let (trace_id, parent_span_id) = match parent {
+            Some((trace_id, span_id)) => (trace_id, span_id.to_vec()),
+            None => (random_id(), Vec::new()),
+        };
+        let mut open = Open {
+            trace_id,
+            span_id: random_id(),
+            parent_span_id,
+            start_ns: unix_nanos(),
+            attributes: Vec::new(),
+            error: None,
+        };
+        attrs.record(&mut open);
+        span.extensions_mut().insert(open);
+    }
+
+    fn on_record(&self, id: &Id, values: &Record<'_>, ctx: Context<'_, S>) {
+        if let Some(span) = ctx.span(id)
+            && let Some(open) = span.extensions_mut().get_mut::<Open>()
+        {
+            values.record(open);
+        }
+    }
+
+    fn on_close(&self, id: Id, ctx: Context<'_, S>) {
+        let Some(span) = ctx.span(&id) else {
+            return;
+        };
+        let Some(open) = span.extensions_mut().remove::<Open>() else {
+            return;
+        };
+        let end_ns = unix_nanos();
+        let mut finished = self.finished.lock().unwrap_or_else(|e| e.into_inner());
+        if open.parent_span_id.is_empty() {
+            let outcome = if open.error.is_some() { "error" } else { "ok" };
+            finished.durations.push(NumberDataPoint {
+                attributes: vec![
+                    string_attr("operation", span.name()),
+                    string_attr("outcome", outcome),
+                ],
+                start_time_unix_nano: open.start_ns,
+                time_unix_nano: end_ns,
+                value: Some(number_data_point::Value::AsDouble(
+                    end_ns.saturating_sub(open.start_ns) as f64 / 1e6,
+                )),
+                ..Default::default()
+            });
+        }
+        finished.spans.push(Span {
+            trace_id: open.trace_id.to_vec(),
+            span_id: open.span_id.to_vec(),
+            parent_span_id: open.parent_span_id,
+            name: span.name().to_string(),
+            kind: KIND_INTERNAL,
+            start_time_unix_nano: open.start_ns,
+            end_time_unix_nano: end_ns,
+            attributes: open.attributes,
+            status: open.error.map(|message| Status {
+                message,
+                code: STATUS_ERROR,
+            }),
+            ..Default::default()
+        });
+    }
+}
+
+impl Recorder {
+    /// Send what was recorded to `endpoint`. Failures are logged, never returned: lotel's
+    /// own telemetry must not fail the command it describes.
+    pub fn flush(&self, endpoint: &str) {
+        let finished =
+            std::mem::take(&mut *self.finished.lock().unwrap_or_else(|e| e.into_inner()));
+        if finished.spans.is_empty() {
+            return;
+        }
+        let sent = tokio::runtime::Builder::new_current_thread()
+            .enable_all()
+            .build()
+            .context("starting the export runtime")
+            .and_then(|rt| {
+                rt.block_on(async {
+                    tokio::time::timeout(EXPORT_TIMEOUT, export(endpoint, finished))
+                        .await
+                        .unwrap_or_else(|_| {
+                            Err(anyhow::anyhow!("timed out after {EXPORT_TIMEOUT:?}"))
+                        })
+                })
+            });
+        if let Err(e) = sent {
+            tracing::debug!("Could not send self-telemetry to {endpoint}: {e:#}");
+        }
+    }
+}
+
+async fn export(endpoint: &str, finished: Finished) -> Result<()> {
+    let channel = tonic::transport::Endpoint::from_shared(endpoint.to_string())
+        .with_context(|| format!("invalid endpoint {endpoint:?}"))?
+        .connect()
+        .await
+        .with_context(|| format!("connecting to {endpoint}"))?;
+    let (traces, metrics) = requests(finished);
+    TraceServiceClient::new(channel.clone())
+        .export(traces)
+        .await
+        .context("exporting traces")?;
+    MetricsServiceClient::new(channel)
+        .export(metrics)
+        .await
+        .context("exporting metrics")?;
+    Ok(())
+}
+
+fn requests(finished: Finished) -> (ExportTraceServiceRequest, ExportMetricsServiceRequest) {
+    let mut resource = resource(SERVICE_NAME);
+    resource
+        .attributes
+        .push(string_attr("service.version", crate::version::VERSION));
+    let traces = ExportTraceServiceRequest {
+        resource_spans: vec![ResourceSpans {
+            resource: Some(resource.clone()),
+            scope_spans: vec![ScopeSpans {
+                spans: finished.spans,
+                ..Default::default()
+            }],
+            ..Default::default()
+        }],
+    };
+    let metrics = ExportMetricsServiceRequest {
+        resource_metrics: vec![ResourceMetrics {
+            resource: Some(resource),
+            scope_metrics: vec![ScopeMetrics {
+                metrics: vec![Metric {
+                    name: "lotel.operation.duration".into(),
+                    description: "Duration of a lotel operation".into(),
+                    unit: "ms".into(),
+                    data: Some(metric::Data::Gauge(Gauge {
+                        data_points: finished.durations,
+                    })),
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }],
+    };
+    (traces, metrics)
+}
+
+/// Run `f` in `span`, recording its error, if any, on the span's `error` field (declare it
+/// with `error = tracing::field::Empty`).
+pub fn in_span<T>(span: tracing::Span, f: impl FnOnce() -> Result<T>) -> Result<T> {
+    let result = span.in_scope(f);
+    if let Err(e) = &result {
+        span.record("error", format!("{e:#}"));
+    }
+    result
+}
+
+/// Only lotel's own spans are recorded, not those of its dependencies.
+pub fn filter() -> tracing_subscriber::filter::Targets {
+    tracing_subscriber::filter::Targets::new()
+        .with_targets(crate::log::OWN_TARGETS.map(|target| (target, Level::INFO)))
+}
+
+fn attr(key: &str, value: any_value::Value) -> KeyValue {
+    KeyValue {
+        key: key.into(),
+        value: Some(AnyValue { value: Some(value) }),
+    }
+}
+
+/// A random ID; only needs to be unique, not unpredictable.
+pub(crate) fn random_id<const N: usize>() -> [u8; N] {
+    static COUNTER: AtomicU64 = AtomicU64::new(0);
+    let mut id = [0u8; N];
+    for chunk in id.chunks_mut(8) {
+        let mut hasher = RandomState::new().build_hasher();
+        hasher.write_u64(COUNTER.fetch_add(1, Ordering::Relaxed));
+        hasher.write_u64(unix_nanos());
+        chunk.copy_from_slice(&hasher.finish().to_le_bytes()[..chunk.len()]);
+    }
+    id
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tracing_subscriber::prelude::*;
+
+    #[test]
+    fn records_nested_operations() {
+        let recorder = Recorder::default();
+        let subscriber = tracing_subscriber::registry().with(recorder.clone());
+        tracing::subscriber::with_default(subscriber, || {
+            let ingest = tracing::info_span!("ingest", rows = tracing::field::Empty);
+            let _entered = ingest.enter();
+            {
+                let file = tracing::info_span!(
+                    "ingest_file",
+                    signal = "traces",
+                    error = tracing::field::Empty
+                );
+                let _entered = file.enter();
+                file.record("error", "disk full");
+            }
+            ingest.record("rows", 42);
+        });
+
+        let finished = recorder.finished.lock().unwrap();
+        assert_eq!(finished.spans.len(), 2);
+        let (file, ingest) = (&finished.spans[0], &finished.spans[1]);
+        assert_eq!(file.name, "ingest_file");
+        assert_eq!(file.trace_id, ingest.trace_id);
+        assert_eq!(file.parent_span_id, ingest.span_id);
+        assert!(ingest.parent_span_id.is_empty());
+        assert_eq!(file.status.as_ref().unwrap().code, STATUS_ERROR);
+        assert!(ingest.status.is_none());
+        assert!(ingest.attributes.iter().any(|a| a.key == "rows"));
+        assert!(ingest.end_time_unix_nano >= ingest.start_time_unix_nano);
+
+        // One duration point per operation, for the root span only.
+        assert_eq!(finished.durations.len(), 1);
+        assert_eq!(finished.durations[0].attributes[0].key, "operation");
+    }
+
+    #[test]
+    fn endpoint_from_env_value() {
+        assert_eq!(endpoint_from(None), None);
+        assert_eq!(endpoint_from(Some("0")), None);
+        assert_eq!(
+            endpoint_from(Some("true")).as_deref(),
+            Some(DEFAULT_ENDPOINT)
+        );
+        assert_eq!(
+            endpoint_from(Some("http://collector:4317")).as_deref(),
+            Some("http://collector:4317")
+        );
+        assert_ne!(random_id::<16>(), random_id::<16>());
+    }
+}
@@ -0,0 +1,636 @@
+//! `lotel serve`: read-only network endpoints over the local store, for tools such as
+//! Prometheus and Grafana to pull from.
+
+use std::convert::Infallible;
+use std::hash::Hash;
+use std::net::SocketAddr;
+use std::sync::{Arc, Mutex, OnceLock};
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use axum::extract::Query;
+use axum::http::{StatusCode, header};
+use axum::response::sse::{Event, KeepAlive, Sse};
+use axum::response::{IntoResponse, Response};
+use axum::routing::{MethodRouter, get, post};
+use axum::{Json, Router};
+use chrono::{DateTime, NaiveDateTime, Utc};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+use tokio_stream::wrappers::ReceiverStream;
+
+use crate::tail::Cursor;
+
+/// OpenAPI 3 description of the `--http` API, served at `/openapi.yaml`.
+pub const OPENAPI: &str = include_str!("openapi.yaml");
+
+/// How often the live streams poll the store for new records.
+const STREAM_POLL: Duration = Duration::from_secs(1);
+
+/// Which endpoints to serve, and where.
+pub struct ServeConfig {
+    /// Prometheus exposition (`/metrics`).
+    pub prom: Option<SocketAddr>,
+    /// HTTP API: the Grafana JSON datasource (`/`, `/search`, `/query`) and the live
+    /// streams under `/api/stream/`.
+    pub http: Option<SocketAddr>,
+    /// gRPC query API (see [`crate::grpc`]).
+    pub grpc: Option<SocketAddr>,
+    /// Cached responses for `/metrics`, `/search`, and `/query`; 0 disables the cache.
+    pub cache_entries: usize,
+    /// Interrupt a request's query after this long; `None` lets queries run to completion.
+    pub query_timeout: Option<Duration>,
+}
+
+/// Rendered responses, reused until an ingest changes the database. The live streams poll
+/// for new rows and bypass it.
+static CACHE: OnceLock<lotel_storage::QueryCache<String>> = OnceLock::new();
+
+/// [`ServeConfig::query_timeout`].
+static QUERY_TIMEOUT: OnceLock<Option<Duration>> = OnceLock::new();
+
+/// Parse a listen address. `:9464` binds localhost only; pass `0.0.0.0:9464` to listen on
+/// every interface.
+pub fn parse_listen_addr(s: &str) -> Result<SocketAddr> {
+    let full = match s.strip_prefix(':') {
+        Some(port) => format!("127.0.0.1:{port}"),
+        None => s.to_string(),
+    };
+    full.parse()
+        .with_context(|| format!("invalid listen address {s:?} (expected :PORT or HOST:PORT)"))
+}
+
+/// Serve until Ctrl-C, or until a listener fails.
+pub async fn run(config: ServeConfig) -> Result<()> {
+    let db_path = lotel_storage::backend_db_path(crate::storage_config()?.backend)?;
+    let _ = CACHE.set(lotel_storage::QueryCache::new(
+        db_path,
+        config.cache_entries,
+    ));
+    let _ = QUERY_TIMEOUT.set(config.query_timeout);
+    let mut servers = tokio::task::JoinSet::new();
+    if let Some(addr) = config.prom {
+        let app = Router::new().route("/metrics", get(prom_metrics));
+        tracing::info!("Serving Prometheus metrics on http://{addr}/metrics");
+        servers.spawn(serve_http(addr, app));
+    }
+    if let Some(addr) = config.http {
+        tracing::info!("Serving the HTTP API on http://{addr}/");
+        servers.spawn(serve_http(addr, http_app()));
+    }
+    if let Some(addr) = config.grpc {
+        tracing::info!("Serving the gRPC query API on {addr}");
+        servers.spawn(crate::grpc::serve(addr));
+    }
+    if servers.is_empty() {
+        crate::exit::bad_args!(
+            "nothing to serve; pass --prom ADDR, --http ADDR, and/or --grpc ADDR"
+        );
+    }
+    while let Some(result) = servers.join_next().await {
+        result.context("server task panicked")??;
+    }
+    Ok(())
+}
+
+/// The `--http` routes, in the order [`OPENAPI`] documents them.
+fn http_routes() -> Vec<(&'static str, MethodRouter)> {
+    vec![
+        ("/", get(|| async { "OK" })),
+        ("/search", post(grafana_search)),
+        ("/query", post(grafana_query)),
+        ("/api/stream/logs", get(stream_logs)),
+        ("/api/stream/traces", get(stream_traces)),
+        ("/openapi.yaml", get(openapi)),
+    ]
+}
+
+fn http_app() -> Router {
+    http_routes()
+        .into_iter()
+        .fold(Router::new(), |app, (path, route)| app.route(path, route))
+}
+
+async fn serve_http(addr: SocketAddr, app: Router) -> Result<()> {
+    let listener = tokio::net::TcpListener::bind(addr)
+        .await
+        .with_context(|| format!("binding {addr}"))?;
+    axum::serve(listener, app)
+        .with_graceful_shutdown(async {
+            let _ = tokio::signal::ctrl_c().await;
+        })
+        .await
+        .with_context(|| format!("serving on {addr}"))
+}
+
+/// Run a store query on the blocking pool with a fresh read-only connection, so requests
+/// never hold the database open between scrapes (the collector's ingests need the write lock).
+pub(crate) async fn with_store<T: Send + 'static>(
+    f: impl FnOnce(&duckdb::Connection) -> Result<T> + Send + 'static,
+) -> Result<T> {
+    tokio::task::spawn_blocking(move || timed_query(f))
+        .await
+        .context("query task panicked")?
+}
+
+/// [`with_store`] through the response cache: `f` renders the body for `key`.
+async fn cached_store(
+    key: String,
+    f: impl FnOnce(&duckdb::Connection) -> Result<String> + Send + 'static,
+) -> Result<String> {
+    tokio::task::spawn_blocking(move || {
+        let compute = || timed_query(f);
+        match CACHE.get() {
+            Some(cache) => cache.get_or_try_insert(&key, compute),
+            None => compute(),
+        }
+    })
+    .await
+    .context("query task panicked")?
+}
+
+/// Run `f` with a fresh read-only connection, interrupting it after the query timeout.
+fn timed_query<T>(f: impl FnOnce(&Connection) -> Result<T>) -> Result<T> {
+    let conn = lotel_storage::open_query_db(&crate::storage_config()?)?;
+    let cancel = lotel_storage::Cancel::new();
+    let _watch = cancel.watch(&conn);
+    let _deadline = QUERY_TIMEOUT
+        .get()
+        .copied()
+        .flatten()
+        .map(|timeout| cancel.deadline(timeout));
+    cancel.run(|| f(&conn))
+}
+
+fn json_response(body: String) -> Response {
+    ([(header::CONTENT_TYPE, "application/json")], body).into_response()
+}
+
+fn error_response(err: anyhow::Error) -> Response {
+    if err.is::<lotel_storage::Cancelled>() {
+        let timeout = QUERY_TIMEOUT.get().copied().flatten().unwrap_or_default();
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            format!("query timed out after {}s\n", timeout.as_secs_f64()),
+        )
+            .into_response();
+    }
+    (StatusCode::INTERNAL_SERVER_ERROR, format!("{err:#}\n")).into_response()
+}
+
+fn bad_request(err: anyhow::Error) -> Response {
+    (StatusCode::BAD_REQUEST, format!("{err:#}\n")).into_response()
+}
+
+async fn prom_metrics() -> Response {
+    let key = lotel_storage::cache_key("prometheus_exposition", &());
+    match cached_store(key, lotel_storage::prometheus_exposition).await {
+        Ok(body) => (
+            [(
+                header::CONTENT_TYPE,
+                "text/plain; version=0.0.4; charset=utf-8",
+            )],
+            body,
+        )
+            .into_response(),
+        Err(err) => error_response(err),
+    }
+}
+
+async fn openapi() -> Response {
+    ([(header::CONTENT_TYPE, "application/yaml")], OPENAPI).into_response()
+}
+
+#[derive(Deserialize)]
+struct SearchRequest {
+    #[serde(default)]
+    target: String,
+}
+
+/// Grafana's metric picker: stored metric names containing the typed text, which may also be
+/// a `*` glob.
+async fn grafana_search(Json(req): Json<SearchRequest>) -> Response {
+    let pattern = search_pattern(&req.target);
+    let key = lotel_storage::cache_key("metric_names", &pattern);
+    let opts = lotel_storage::QueryOptions::default();
+    let result = cached_store(key, move |conn| {
+        let names = lotel_storage::metric_names(conn, &opts, &[pattern])?;
+        Ok(serde_json::to_string(&names)?)
+    })
+    .await;
+    match result {
+        Ok(body) => json_response(body),
+        Err(err) => error_response(err),
+    }
+}
+
+fn search_pattern(target: &str) -> String {
+    let target = target.trim();
+    if target.is_empty() {
+        "*".to_string()
+    } else if target.contains('*') {
+        target.to_string()
+    } else {
+        format!("*{target}*")
+    }
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct QueryRequest {
+    range: QueryRange,
+    #[serde(default)]
+    interval_ms: i64,
+    #[serde(default)]
+    targets: Vec<QueryTarget>,
+}
+
+#[derive(Deserialize)]
+struct QueryRange {
+    from: DateTime<Utc>,
+    to: DateTime<Utc>,
+}
+
+#[derive(Deserialize)]
+struct QueryTarget {
+    #[serde(default)]
+    target: String,
+    #[serde(default)]
+    hide: bool,
+}
+
+#[derive(Serialize)]
+struct TimeSeries {
+    target: String,
+    /// `[value, unix milliseconds]` pairs.
+    datapoints: Vec<(f64, i64)>,
+}
+
+/// One time series per stored series of every metric a target names (globs allowed), averaged
+/// or summed into Grafana's interval over the dashboard range.
+async fn grafana_query(Json(req): Json<QueryRequest>) -> Response {
+    let bucket = chrono::Duration::milliseconds(req.interval_ms.max(1000));
+    let (since, until) = bucket_range(req.range.from, req.range.to, bucket);
+    let opts = lotel_storage::QueryOptions {
+        since: Some(since),
+        until: Some(until),
+        ..Default::default()
+    };
+    let targets: Vec<String> = req
+        .targets
+        .into_iter()
+        .filter(|t| !t.hide && !t.target.is_empty())
+        .map(|t| t.target)
+        .collect();
+    let key =
+        lotel_storage::cache_key("grafana_query", &(&targets, opts.since, opts.until, bucket));
+    let result = cached_store(key, move |conn| {
+        let names = lotel_storage::metric_names(conn, &opts, &targets)?;
+        let mut out = Vec::new();
+        for name in names {
+            for series in lotel_storage::bucketed_series(conn, &opts, &name, bucket)? {
+                out.push(TimeSeries {
+                    target: series.name,
+                    datapoints: series
+                        .points
+                        .into_iter()
+                        .map(|(t, v)| (v, t.and_utc().timestamp_millis()))
+                        .collect(),
+                });
+            }
+        }
+        Ok(serde_json::to_string(&out)?)
+    })
+    .await;
+    match result {
+        Ok(body) => json_response(body),
+        Err(err) => error_response(err),
+    }
+}
+
+/// `[from, to]` widened to whole buckets. A dashboard slides its range on every refresh, but
+/// the widened range, and so the cache key, only moves when it crosses a bucket boundary.
+fn bucket_range(
+    from: DateTime<Utc>,
+    to: DateTime<Utc>,
+    bucket: chrono::Duration,
+) -> (NaiveDateTime, NaiveDateTime) {
+    let width = bucket.num_milliseconds().max(1);
+    let start = from.timestamp_millis().div_euclid(width) * width;
+    // The last millisecond of the bucket `to` falls in; bounds are inclusive.
+    let end = (to.timestamp_millis().div_euclid(width) + 1) * width - 1;
+    let at = |ms| {
+        DateTime::from_timestamp_millis(ms)
+            .unwrap_or_default()
+            .naive_utc()
+    };
+    (at(start), at(end))
+}
+
+/// Query parameters of the live streams.
+#[derive(Default, Deserialize)]
+struct StreamParams {
+    service: Option<String>,
+    /// Replay from this time (RFC3339 or relative, e.g. `5m`) instead of starting at now.
+    since: Option<String>,
+    /// Logs only: severity floor, e.g. `warn`.
+    min_severity: Option<String>,
+    /// Traces only: `ok`, `error`, or `unset`.
+    status: Option<String>,
+}
+
+impl StreamParams {
+    fn query_opts(&self) -> Result<lotel_storage::QueryOptions> {
+        Ok(lotel_storage::QueryOptions {
+            service: self.service.clone(),
+            min_severity: self
+                .min_severity
+                .as_deref()
+                .map(lotel_storage::parse_severity)
+                .transpose()?,
+            status_code: self
+                .status
+                .as_deref()
+                .map(lotel_storage::parse_status_code)
+                .transpose()?,
+            ..Default::default()
+        })
+    }
+
+    fn since(&self) -> Result<Option<NaiveDateTime>> {
+        self.since
+            .as_deref()
+            .map(crate::time::parse_time)
+            .transpose()
+    }
+}
+
+/// `/api/stream/logs`: each newly ingested log record as a `log` server-sent event.
+async fn stream_logs(Query(params): Query<StreamParams>) -> Response {
+    let (opts, since) = match params.query_opts().and_then(|o| Ok((o, params.since()?))) {
+        Ok(parsed) => parsed,
+        Err(err) => return bad_request(err),
+    };
+    live_stream(
+        "log",
+        lotel_storage::Signal::Logs,
+        opts,
+        since,
+        lotel_storage::query_logs,
+        |log| {
+            (
+                log.timestamp,
+                log.service_name.clone(),
+                log.span_id.clone(),
+                log.body.clone(),
+            )
+        },
+        |log| log.timestamp,
+    )
+}
+
+/// `/api/stream/traces`: each newly ingested span as a `span` server-sent event.
+async fn stream_traces(Query(params): Query<StreamParams>) -> Response {
+    let (opts, since) = match params.query_opts().and_then(|o| Ok((o, params.since()?))) {
+        Ok(parsed) => parsed,
+        Err(err) => return bad_request(err),
+    };
+    live_stream(
+        "span",
+        lotel_storage::Signal::Traces,
+        opts,
+        since,
+        lotel_storage::query_traces,
+        |span| (span.trace_id.clone(), span.span_id.clone()),
+        |span| span.start_time,
+    )
+}
+
+/// Poll the store like `lotel tail` and push each new record as a JSON event named `event`
+/// until the client disconnects. Query failures (e.g. the database is briefly locked by an
+/// ingest) are sent as `error` events and retried on the next poll.
+fn live_stream<T, K>(
+    event: &'static str,
+    signal: lotel_storage::Signal,
+    opts: lotel_storage::QueryOptions,
+    since: Option<NaiveDateTime>,
+    fetch: fn(&Connection, &lotel_storage::QueryOptions) -> Result<Vec<T>>,
+    key: fn(&T) -> K,
+    time_of: fn(&T) -> NaiveDateTime,
+) -> Response
+where
+    T: Serialize + Send + 'static,
+    K: Eq + Hash + Send + 'static,
+{
+    let (tx, rx) = tokio::sync::mpsc::channel::<Result<Event, Infallible>>(256);
+    tokio::spawn(async move {
+        // Shared with each poll's blocking task, and kept when opening the store fails.
+        let cursor = Arc::new(Mutex::new(Cursor::new(signal, since)));
+        while !tx.is_closed() {
+            let (cursor, query) = (cursor.clone(), opts.clone());
+            let polled = with_store(move |conn| {
+                let mut cursor = cursor.lock().unwrap_or_else(|e| e.into_inner());
+                cursor.poll(conn, &query, fetch, key, time_of)
+            })
+            .await;
+            match polled {
+                Ok(records) => {
+                    for record in records {
+                        let Ok(data) = Event::default().event(event).json_data(&record) else {
+                            continue;
+                        };
+                        if tx.send(Ok(data)).await.is_err() {
+                            return;
+                        }
+                    }
+                }
+                Err(err) => {
+                    let data = Event::default().event("error").data(format!("{err:#}"));
+                    if tx.send(Ok(data)).await.is_err() {
+                        return;
+                    }
+                }
+            }
+            tokio::time::sleep(STREAM_POLL).await;
+        }
+    });
+    Sse::new(ReceiverStream::new(rx))
+        .keep_alive(KeepAlive::default())
+        .into_response()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn widens_dashboard_ranges_to_buckets() {
+        let at = |s: &str| s.parse::<DateTime<Utc>>().unwrap();
+        let bucket = chrono::Duration::minutes(1);
+        let range = bucket_range(
+            at("2024-03-09T16:00:10Z"),
+            at("2024-03-09T17:00:10Z"),
+            bucket,
+        );
+        assert_eq!(
+            range,
+            (
+                at("2024-03-09T16:00:00Z").naive_utc(),
+                at("2024-03-09T17:00:59.999Z").naive_utc()
+            )
+        );
+        // A refresh a few seconds later queries, and caches, the same range.
+        let later = bucket_range(
+            at("2024-03-09T16:00:25Z"),
+            at("2024-03-09T17:00:25Z"),
+            bucket,
+        );
+        assert_eq!(later, range);
+    }
+
+    #[test]
+    fn parses_listen_addresses() {
+        assert_eq!(
+            parse_listen_addr(":9464").unwrap(),
+            "127.0.0.1:9464".parse().unwrap()
+        );
+        assert_eq!(
+            parse_listen_addr("0.0.0.0:9464").unwrap(),
+            "0.0.0.0:9464".parse().unwrap()
+        );
+        assert!(parse_listen_addr("9464").is_err());
+    }
+
+    fn openapi_doc() -> serde_json::Value {
+        serde_yaml::from_str(OPENAPI).unwrap()
+    }
+
+    /// The property names of a schema under `components/schemas`.
+    fn schema_properties(doc: &serde_json::Value, schema: &str) -> Vec<String> {
+        let mut properties: Vec<String> = doc["components"]["schemas"][schema]["properties"]
+            .as_object()
+            .unwrap()
+            .keys()
+            .cloned()
+            .collect();
+        properties.sort();
+        properties
+    }
+
+    fn keys(value: &serde_json::Value) -> Vec<String> {
+        let mut keys: Vec<String> = value.as_object().unwrap().keys().cloned().collect();
+        keys.sort();
+        keys
+    }
+
+    #[test]
+    fn openapi_documents_every_route() {
+        let doc = openapi_doc();
+        let documented: Vec<&str> = doc["paths"]
+            .as_object()
+            .unwrap()
+            .keys()
+            .map(String::as_str)
+            .collect();
+        let served: Vec<&str> = http_routes().into_iter().map(|(path, _)| path).collect();
+        assert_eq!(documented, served);
+    }
+
+    #[tokio::test]
+    async fn openapi_methods_reach_the_handlers() {
+        use tower::ServiceExt;
+
+        let doc = openapi_doc();
+        for (path, operations) in doc["paths"].as_object().unwrap() {
+            for method in operations.as_object().unwrap().keys() {
+                // Malformed bodies and times are rejected before a handler opens the store.
+                let uri = match path.as_str() {
+                    "/api/stream/logs" | "/api/stream/traces" => format!("{path}?since=not-a-time"),
+                    _ => path.clone(),
+                };
+                let request = axum::http::Request::builder()
+                    .method(method.to_uppercase().as_str())
+                    .uri(uri)
+                    .header(header::CONTENT_TYPE, "application/json")
+                    .body(axum::body::Body::from("{"))
+                    .unwrap();
+                let status = http_app().oneshot(request).await.unwrap().status();
+                assert!(
+                    status != StatusCode::NOT_FOUND && status != StatusCode::METHOD_NOT_ALLOWED,
+                    "{method} {path}: {status}"
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn openapi_schemas_match_the_responses() {
+        let doc = openapi_doc();
+        let time =
+            NaiveDateTime::parse_from_str("2024-03-09 16:00:00", "%Y-%m-%d %H:%M:%S").unwrap();
+        let span = lotel_storage::TraceResult {
+            trace_id: "t".to_string(),
+            span_id: "s".to_string(),
+            parent_span_id: Some("p".to_string()),
+            name: "GET /".to_string(),
+            kind: 2,
+            kind_name: "SERVER".to_string(),
+            start_time: time,
+            end_time: Some(time),
+            duration_ns: 0,
+            status_code: 0,
+            status: "UNSET".to_string(),
+            service_name: "svc".to_string(),
+            attributes: Some(serde_json::json!({})),
+            trace_state: Some(String::new()),
+            flags: Some(1),
+            dropped_attributes_count: Some(0),
+            dropped_events_count: Some(0),
+            dropped_links_count: Some(0),
+        };
+        let span = serde_json::to_value(&span).unwrap();
+        assert_eq!(keys(&span), schema_properties(&doc, "Span"));
+
+        let log = lotel_storage::LogResult {
+            timestamp: time,
+            severity: Some("INFO".to_string()),
+            severity_number: Some(9),
+            body: Some("hello".to_string()),
+            service_name: "svc".to_string(),
+            trace_id: Some("t".to_string()),
+            span_id: Some("s".to_string()),
+            attributes: Some(serde_json::json!({})),
+        };
+        let log = serde_json::to_value(&log).unwrap();
+        assert_eq!(keys(&log), schema_properties(&doc, "Log"));
+
+        let series = serde_json::to_value(TimeSeries {
+            target: "m".to_string(),
+            datapoints: vec![(1.0, 0)],
+        })
+        .unwrap();
+        assert_eq!(keys(&series), schema_properties(&doc, "TimeSeries"));
+
+        // Every documented request field is one the handler reads (or Grafana sends and the
+        // handler ignores, like refId).
+        let request: QueryRequest = serde_json::from_value(serde_json::json!({
+            "range": {"from": "2024-03-09T16:00:00Z", "to": "2024-03-09T17:00:00Z"},
+            "intervalMs": 60000,
+            "targets": [{"target": "http.*", "refId": "A", "hide": false}],
+        }))
+        .unwrap();
+        assert_eq!(request.interval_ms, 60000);
+        assert_eq!(request.targets[0].target, "http.*");
+        assert_eq!(
+            schema_properties(&doc, "QueryRequest"),
+            ["intervalMs", "range", "targets"]
+        );
+    }
+
+    #[test]
+    fn search_matches_substrings_or_globs() {
+        assert_eq!(search_pattern(""), "*");
+        assert_eq!(search_pattern("http"), "*http*");
+        assert_eq!(search_pattern("http.*"), "http.*");
+    }
+}
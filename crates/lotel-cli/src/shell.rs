@@ -0,0 +1,311 @@
+//! `lotel shell`: an interactive prompt for `query` commands and raw SQL, each run on its
+//! own read-only connection.
+
+use anyhow::{Context as _, Result};
+use clap::Parser;
+use duckdb::Connection;
+use duckdb::types::{TimeUnit, Value};
+use rustyline::completion::{Completer, Pair};
+use rustyline::error::ReadlineError;
+use rustyline::highlight::Highlighter;
+use rustyline::hint::Hinter;
+use rustyline::history::DefaultHistory;
+use rustyline::validate::Validator;
+use rustyline::{Context, Editor, Helper};
+
+use crate::{Cli, Command, QueryOutput, daemon, run_query, table, time};
+
+const HELP: &str = "\
+Commands:
+  query traces|trace|metrics|logs|aggregate ...   same flags as `lotel query`
+  traces|trace|metrics|logs|aggregate ...         shorthand for the above
+  <SQL>                                           run SQL against the store (read-only)
+  help                                            show this message
+  exit, quit                                      leave the shell (or Ctrl-D)";
+
+/// Words offered by tab completion.
+const WORDS: &[&str] = &[
+    "query",
+    "traces",
+    "metrics",
+    "logs",
+    "aggregate",
+    "help",
+    "exit",
+    "--service",
+    "--since",
+    "--until",
+    "--last",
+    "--limit",
+    "--attr",
+    "--fields",
+    "--explain",
+    "--stream",
+    "--trace-id",
+    "--kind",
+    "--status",
+    "--roots",
+    "--body-field",
+    "--metric",
+    "--fn",
+    "--bucket",
+    "--temporality",
+    "--waterfall",
+    "SELECT",
+    "FROM",
+    "WHERE",
+    "GROUP BY",
+    "ORDER BY",
+    "LIMIT",
+    "COUNT(*)",
+    "service_name",
+    "start_time",
+    "duration_ns",
+    "timestamp",
+    "metric_name",
+    "attributes",
+];
+
+struct ShellHelper;
+
+impl Completer for ShellHelper {
+    type Candidate = Pair;
+
+    fn complete(
+        &self,
+        line: &str,
+        pos: usize,
+        _ctx: &Context<'_>,
+    ) -> rustyline::Result<(usize, Vec<Pair>)> {
+        let start = line[..pos].rfind(char::is_whitespace).map_or(0, |i| i + 1);
+        Ok((start, complete_word(&line[start..pos])))
+    }
+}
+
+impl Hinter for ShellHelper {
+    type Hint = String;
+}
+
+impl Highlighter for ShellHelper {}
+
+impl Validator for ShellHelper {}
+
+impl Helper for ShellHelper {}
+
+fn complete_word(prefix: &str) -> Vec<Pair> {
+    if prefix.is_empty() {
+        return Vec::new();
+    }
+    let lower = prefix.to_ascii_lowercase();
+    WORDS
+        .iter()
+        .filter(|w| w.to_ascii_lowercase().starts_with(&lower))
+        .map(|w| Pair {
+            display: w.to_string(),
+            replacement: w.to_string(),
+        })
+        .collect()
+}
+
+pub fn run() -> Result<()> {
+    let mut editor: Editor<ShellHelper, DefaultHistory> =
+        Editor::new().context("starting line editor")?;
+    editor.set_helper(Some(ShellHelper));
+    let history = daemon::lotel_dir()?.join("shell_history");
+    // Missing on first run.
+    let _ = editor.load_history(&history);
+
+    eprintln!("lotel shell — type `help` for commands, Ctrl-D to exit");
+    loop {
+        let line = match editor.readline("lotel> ") {
+            Ok(line) => line,
+            Err(ReadlineError::Interrupted) => continue,
+            Err(ReadlineError::Eof) => break,
+            Err(e) => return Err(e.into()),
+        };
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+        let _ = editor.add_history_entry(line);
+        match line {
+            "exit" | "quit" => break,
+            "help" => println!("{HELP}"),
+            _ => {
+                // Connected per statement so ingests can take the write lock in between.
+                let result = crate::query_db().and_then(|conn| run_line(&conn, line));
+                if let Err(e) = result {
+                    eprintln!("error: {e:#}");
+                }
+            }
+        }
+    }
+    if let Err(e) = editor.save_history(&history) {
+        tracing::warn!("could not save shell history: {e}");
+    }
+    Ok(())
+}
+
+fn run_line(conn: &Connection, line: &str) -> Result<()> {
+    match query_args(line) {
+        Some(args) => run_query_line(conn, args),
+        None => run_sql(conn, line),
+    }
+}
+
+/// Split a `query ...` line (or one starting at the query subcommand) into CLI args, or
+/// `None` for SQL.
+fn query_args(line: &str) -> Option<Vec<String>> {
+    let first = line.split_whitespace().next()?;
+    let prefix = match first {
+        "query" => vec!["lotel"],
+        "traces" | "trace" | "metrics" | "logs" | "aggregate" => vec!["lotel", "query"],
+        _ => return None,
+    };
+    let words = shlex::split(line)?;
+    Some(prefix.into_iter().map(String::from).chain(words).collect())
+}
+
+fn run_query_line(conn: &Connection, args: Vec<String>) -> Result<()> {
+    let cli = match Cli::try_parse_from(args) {
+        Ok(cli) => cli,
+        Err(e) => {
+            // Covers --help as well as usage errors.
+            print!("{e}");
+            return Ok(());
+        }
+    };
+    let Command::Query {
+        fresh,
+        stream,
+        fields,
+        explain,
+        watch,
+        subcommand,
+    } = cli.command
+    else {
+        unreachable!("query_args always starts with `query`");
+    };
+    if fresh || watch.is_some() {
+        eprintln!("--fresh and --watch are ignored in the shell");
+    }
+    let output = if stream {
+        QueryOutput::Ndjson
+    } else {
+        QueryOutput::Json
+    };
+    run_query(conn, output, fields.as_deref(), explain, subcommand)
+}
+
+fn run_sql(conn: &Connection, sql: &str) -> Result<()> {
+    let mut stmt = conn.prepare(sql)?;
+    let mut rows = stmt.query([])?;
+    let headers = rows.as_ref().map(|s| s.column_names()).unwrap_or_default();
+    let mut cells = Vec::new();
+    while let Some(row) = rows.next()? {
+        let values = (0..headers.len())
+            .map(|i| row.get::<_, Value>(i).map(cell_text))
+            .collect::<duckdb::Result<Vec<_>>>()?;
+        cells.push(values);
+    }
+    print!("{}", table::render(&headers, &cells));
+    eprintln!(
+        "({} row{})",
+        cells.len(),
+        if cells.len() == 1 { "" } else { "s" }
+    );
+    Ok(())
+}
+
+fn cell_text(value: Value) -> String {
+    match value {
+        Value::Null => "NULL".into(),
+        Value::Boolean(b) => b.to_string(),
+        Value::TinyInt(n) => n.to_string(),
+        Value::SmallInt(n) => n.to_string(),
+        Value::Int(n) => n.to_string(),
+        Value::BigInt(n) => n.to_string(),
+        Value::HugeInt(n) => n.to_string(),
+        Value::UTinyInt(n) => n.to_string(),
+        Value::USmallInt(n) => n.to_string(),
+        Value::UInt(n) => n.to_string(),
+        Value::UBigInt(n) => n.to_string(),
+        Value::Float(n) => n.to_string(),
+        Value::Double(n) => n.to_string(),
+        Value::Text(s) => s,
+        Value::Timestamp(unit, n) => {
+            let micros = match unit {
+                TimeUnit::Second => n.saturating_mul(1_000_000),
+                TimeUnit::Millisecond => n.saturating_mul(1_000),
+                TimeUnit::Microsecond => n,
+                TimeUnit::Nanosecond => n / 1_000,
+            };
+            chrono::DateTime::from_timestamp_micros(micros)
+                .map(|t| time::display_tz().render(t.naive_utc()))
+                .unwrap_or_else(|| n.to_string())
+        }
+        Value::Date32(days) => chrono::NaiveDate::from_ymd_opt(1970, 1, 1)
+            .and_then(|epoch| epoch.checked_add_signed(chrono::Duration::days(days.into())))
+            .map(|d| d.to_string())
+            .unwrap_or_else(|| days.to_string()),
+        Value::Blob(bytes) => format!("<{} bytes>", bytes.len()),
+        other => format!("{other:?}"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn routes_query_lines_and_sql() {
+        assert_eq!(
+            query_args("traces --service 'my app' --since 1h").unwrap(),
+            [
+                "lotel",
+                "query",
+                "traces",
+                "--service",
+                "my app",
+                "--since",
+                "1h"
+            ]
+        );
+        assert_eq!(
+            query_args("query logs --limit 5").unwrap(),
+            ["lotel", "query", "logs", "--limit", "5"]
+        );
+        assert!(query_args("SELECT * FROM traces").is_none());
+    }
+
+    #[test]
+    fn completes_commands_flags_and_sql() {
+        let words = |p: &str| -> Vec<String> {
+            complete_word(p)
+                .into_iter()
+                .map(|c| c.replacement)
+                .collect()
+        };
+        assert_eq!(words("tr"), ["traces"]);
+        assert_eq!(
+            words("--s"),
+            ["--service", "--since", "--stream", "--status"]
+        );
+        assert_eq!(words("sel"), ["SELECT"]);
+        assert!(words("").is_empty());
+    }
+
+    #[test]
+    fn renders_cells() {
+        assert_eq!(cell_text(Value::Null), "NULL");
+        assert_eq!(cell_text(Value::Text("api".into())), "api");
+        assert_eq!(
+            cell_text(Value::Timestamp(
+                TimeUnit::Microsecond,
+                1_710_000_000_000_000
+            )),
+            "2024-03-09T16:00:00"
+        );
+        assert_eq!(cell_text(Value::Date32(19_791)), "2024-03-09");
+    }
+}
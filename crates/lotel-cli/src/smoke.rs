@@ -0,0 +1,579 @@
+//! `lotel smoke`: one span, metric point, and log record sent through the whole pipeline —
+//! collector, JSONL files, ingest, query — with a PASS/FAIL line per stage, so "nothing
+//! shows up" narrows down to the stage that lost the data.
+
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::time::{Duration, Instant};
+
+use anyhow::{Context, Result, bail};
+use opentelemetry_proto::tonic::collector::logs::v1::ExportLogsServiceRequest;
+use opentelemetry_proto::tonic::collector::logs::v1::logs_service_client::LogsServiceClient;
+use opentelemetry_proto::tonic::collector::metrics::v1::ExportMetricsServiceRequest;
+use opentelemetry_proto::tonic::collector::metrics::v1::metrics_service_client::MetricsServiceClient;
+use opentelemetry_proto::tonic::collector::trace::v1::ExportTraceServiceRequest;
+use opentelemetry_proto::tonic::collector::trace::v1::trace_service_client::TraceServiceClient;
+use opentelemetry_proto::tonic::common::v1::{AnyValue, any_value};
+use opentelemetry_proto::tonic::logs::v1::{LogRecord, ResourceLogs, ScopeLogs};
+use opentelemetry_proto::tonic::metrics::v1::{
+    Gauge, Metric, NumberDataPoint, ResourceMetrics, ScopeMetrics, metric, number_data_point,
+};
+use opentelemetry_proto::tonic::trace::v1::{ResourceSpans, ScopeSpans, Span};
+use serde::Serialize;
+
+use crate::daemon;
+use crate::generate::{resource, string_attr, unix_nanos};
+use crate::style;
+
+/// Service the probe telemetry is sent as; `prune --all --service lotel-smoke` removes it.
+pub const SERVICE_NAME: &str = "lotel-smoke";
+/// Span and metric name of the probe.
+const PROBE_NAME: &str = "lotel.smoke";
+/// Attribute carrying the run ID, which tells this run's rows from earlier runs'.
+const RUN_ATTR: &str = "lotel.smoke.run";
+const SIGNALS: [&str; 3] = ["traces", "metrics", "logs"];
+const KIND_INTERNAL: i32 = 1;
+const SEVERITY_INFO: i32 = 9;
+const POLL_INTERVAL: Duration = Duration::from_millis(250);
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Outcome {
+    Pass,
+    Fail,
+    /// Not run because an earlier stage failed.
+    Skip,
+}
+
+#[derive(Debug, Serialize)]
+pub struct Stage {
+    pub name: &'static str,
+    pub outcome: Outcome,
+    pub detail: String,
+    /// What to check next, for a failed stage.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub hint: Option<String>,
+    pub elapsed_ms: u64,
+}
+
+#[derive(Debug, Serialize)]
+pub struct SmokeReport {
+    pub passed: bool,
+    pub run: String,
+    pub stages: Vec<Stage>,
+}
+
+impl SmokeReport {
+    fn stage(&mut self, name: &'static str, hint: &str, f: impl FnOnce() -> Result<String>) {
+        if !self.passed {
+            self.stages.push(Stage {
+                name,
+                outcome: Outcome::Skip,
+                detail: "an earlier stage failed".into(),
+                hint: None,
+                elapsed_ms: 0,
+            });
+            return;
+        }
+        let start = Instant::now();
+        let result = f();
+        self.passed = result.is_ok();
+        let (outcome, detail, hint) = match result {
+            Ok(detail) => (Outcome::Pass, detail, None),
+            Err(e) => (Outcome::Fail, format!("{e:#}"), Some(hint.to_string())),
+        };
+        self.stages.push(Stage {
+            name,
+            outcome,
+            detail,
+            hint,
+            elapsed_ms: start.elapsed().as_millis() as u64,
+        });
+    }
+
+    /// One line per stage, e.g. `PASS  send      1 span, 1 metric point, 1 log record`.
+    pub fn render(&self, color: bool) -> String {
+        let width = self.stages.iter().map(|s| s.name.len()).max().unwrap_or(0);
+        let mut out = String::new();
+        for stage in &self.stages {
+            let (label, code) = match stage.outcome {
+                Outcome::Pass => ("PASS", style::GREEN),
+                Outcome::Fail => ("FAIL", style::RED),
+                Outcome::Skip => ("SKIP", style::DIM),
+            };
+            let label = if color {
+                format!("{code}{label}{}", style::RESET)
+            } else {
+                label.to_string()
+            };
+            out.push_str(&format!(
+                "{label}  {:width$}  {}\n",
+                stage.name, stage.detail
+            ));
+            if let Some(hint) = &stage.hint {
+                out.push_str(&format!("      {:width$}  {hint}\n", ""));
+            }
+        }
+        out
+    }
+}
+
+/// The telemetry one smoke run sends, all tagged with its run ID.
+pub struct Probe {
+    /// Hex trace ID of the probe span, also used as the run ID.
+    pub run: String,
+    trace_id: [u8; 16],
+    span_id: [u8; 8],
+    sent_ns: u64,
+}
+
+impl Probe {
+    pub fn new(trace_id: [u8; 16], span_id: [u8; 8], sent_ns: u64) -> Self {
+        Self {
+            run: trace_id.iter().map(|b| format!("{b:02x}")).collect(),
+            trace_id,
+            span_id,
+            sent_ns,
+        }
+    }
+
+    fn log_body(&self) -> String {
+        format!("lotel smoke test {}", self.run)
+    }
+
+    pub fn requests(
+        &self,
+    ) -> (
+        ExportTraceServiceRequest,
+        ExportMetricsServiceRequest,
+        ExportLogsServiceRequest,
+    ) {
+        let run = string_attr(RUN_ATTR, &self.run);
+        let traces = ExportTraceServiceRequest {
+            resource_spans: vec![ResourceSpans {
+                resource: Some(resource(SERVICE_NAME)),
+                scope_spans: vec![ScopeSpans {
+                    spans: vec![Span {
+                        trace_id: self.trace_id.to_vec(),
+                        span_id: self.span_id.to_vec(),
+                        name: PROBE_NAME.into(),
+                        kind: KIND_INTERNAL,
+                        start_time_unix_nano: self.sent_ns.saturating_sub(1_000_000),
+                        end_time_unix_nano: self.sent_ns,
+                        attributes: vec![run.clone()],
+                        ..Default::default()
+                    }],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+        };
+        let metrics = ExportMetricsServiceRequest {
+            resource_metrics: vec![ResourceMetrics {
+                resource: Some(resource(SERVICE_NAME)),
+                scope_metrics: vec![ScopeMetrics {
+                    metrics: vec![Metric {
+                        name: PROBE_NAME.into(),
+                        description: "lotel smoke test probe".into(),
+                        data: Some(metric::Data::Gauge(Gauge {
+                            data_points: vec![NumberDataPoint {
+                                attributes: vec![run.clone()],
+                                time_unix_nano: self.sent_ns,
+                                value: Some(number_data_point::Value::AsDouble(1.0)),
+                                ..Default::default()
+                            }],
+                        })),
+                        ..Default::default()
+                    }],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+        };
+        let logs = ExportLogsServiceRequest {
+            resource_logs: vec![ResourceLogs {
+                resource: Some(resource(SERVICE_NAME)),
+                scope_logs: vec![ScopeLogs {
+                    log_records: vec![LogRecord {
+                        time_unix_nano: self.sent_ns,
+                        observed_time_unix_nano: self.sent_ns,
+                        severity_number: SEVERITY_INFO,
+                        severity_text: "INFO".into(),
+                        body: Some(AnyValue {
+                            value: Some(any_value::Value::StringValue(self.log_body())),
+                        }),
+                        attributes: vec![run],
+                        trace_id: self.trace_id.to_vec(),
+                        span_id: self.span_id.to_vec(),
+                        ..Default::default()
+                    }],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+        };
+        (traces, metrics, logs)
+    }
+}
+
+/// The probe's rows as stored.
+struct Found {
+    span: lotel_storage::TraceResult,
+    metric: lotel_storage::MetricResult,
+    log: lotel_storage::LogResult,
+}
+
+/// Run every stage against the collector's gRPC `endpoint`, giving the data `timeout` to
+/// reach each of the files and the database.
+pub fn run(endpoint: &str, timeout: Duration) -> SmokeReport {
+    let probe = Probe::new(
+        crate::selftel::random_id(),
+        crate::selftel::random_id(),
+        unix_nanos(),
+    );
+    let mut report = SmokeReport {
+        passed: true,
+        run: probe.run.clone(),
+        stages: Vec::new(),
+    };
+    let mut data_path = PathBuf::new();
+    let mut offsets = HashMap::new();
+    let mut found = None;
+
+    report.stage(
+        "collector",
+        "check `lotel-cli status` and the collector log in ~/.lotel",
+        collector,
+    );
+    report.stage(
+        "send",
+        "check receivers.otlp.protocols.grpc in the collector config, or pass --endpoint",
+        || {
+            data_path = lotel_collector::config::data_path().map_err(|e| anyhow::anyhow!("{e}"))?;
+            offsets = file_sizes(&data_path);
+            send(endpoint, &probe)?;
+            Ok(format!(
+                "1 span, 1 metric point, 1 log record to {endpoint}"
+            ))
+        },
+    );
+    report.stage(
+        "write",
+        "the collector accepted the data but did not write it: check the file exporters and \
+         service.pipelines in the collector config",
+        || written(&data_path, &offsets, &probe.run, timeout),
+    );
+    report.stage(
+        "ingest",
+        "check `lotel-cli db health`, and run `lotel-cli ingest` to see its errors",
+        || {
+            let start = Instant::now();
+            found = Some(ingested(&probe, timeout)?);
+            Ok(format!(
+                "stored after {:.1}s",
+                start.elapsed().as_secs_f64()
+            ))
+        },
+    );
+    report.stage(
+        "query",
+        "the stored rows differ from what was sent; check the ingestion rules in the config",
+        || match &found {
+            Some(found) => matches(&probe, found),
+            None => bail!("nothing was stored"),
+        },
+    );
+    report
+}
+
+fn collector() -> Result<String> {
+    if let Some(state) = daemon::read_state(None)?
+        && daemon::is_running(&state)
+    {
+        let url = crate::health_url(&state);
+        if !crate::check_health_sync(&url) {
+            bail!(
+                "running (PID {}) but its health check at {url} fails",
+                state.pid
+            );
+        }
+        return Ok(format!("running (PID {})", state.pid));
+    }
+    crate::cmd_start(true, None, &Default::default())?;
+    let pid = daemon::read_state(None)?
+        .context("collector state missing after start")?
+        .pid;
+    Ok(format!("started (PID {pid})"))
+}
+
+fn send(endpoint: &str, probe: &Probe) -> Result<()> {
+    let (traces, metrics, logs) = probe.requests();
+    // A collector started with `--auth` refuses exports without its token.
+    let token = match daemon::read_state(None)? {
+        Some(state) if state.options.receivers.auth => {
+            crate::auth::read_token(&daemon::instance_dir(None)?)?
+        }
+        _ => None,
+    };
+    let token = token.as_deref();
+    let rt = tokio::runtime::Runtime::new()?;
+    rt.block_on(async {
+        let channel = tonic::transport::Endpoint::from_shared(endpoint.to_string())
+            .with_context(|| format!("invalid endpoint {endpoint:?}"))?
+            .connect_timeout(Duration::from_secs(5))
+            .connect()
+            .await
+            .with_context(|| format!("connecting to {endpoint}"))?;
+        TraceServiceClient::new(channel.clone())
+            .export(authorize(tonic::Request::new(traces), token)?)
+            .await
+            .context("exporting traces")?;
+        MetricsServiceClient::new(channel.clone())
+            .export(authorize(tonic::Request::new(metrics), token)?)
+            .await
+            .context("exporting metrics")?;
+        LogsServiceClient::new(channel)
+            .export(authorize(tonic::Request::new(logs), token)?)
+            .await
+            .context("exporting logs")?;
+        Ok(())
+    })
+}
+
+/// `request` with the collector's bearer token, if it has one.
+fn authorize<T>(mut request: tonic::Request<T>, token: Option<&str>) -> Result<tonic::Request<T>> {
+    if let Some(token) = token {
+        let value = format!("Bearer {token}")
+            .parse()
+            .context("invalid auth token")?;
+        request.metadata_mut().insert("authorization", value);
+    }
+    Ok(request)
+}
+
+fn signal_file(data_path: &Path, signal: &str) -> PathBuf {
+    data_path.join(signal).join(format!("{signal}.jsonl"))
+}
+
+/// Current size of each signal's JSONL file, so only what is written after them is searched.
+fn file_sizes(data_path: &Path) -> HashMap<&'static str, u64> {
+    SIGNALS
+        .iter()
+        .map(|&signal| {
+            let size = std::fs::metadata(signal_file(data_path, signal))
+                .map(|m| m.len())
+                .unwrap_or(0);
+            (signal, size)
+        })
+        .collect()
+}
+
+/// Wait until every signal's file has a line mentioning `run` after its recorded offset.
+fn written(
+    data_path: &Path,
+    offsets: &HashMap<&'static str, u64>,
+    run: &str,
+    timeout: Duration,
+) -> Result<String> {
+    let start = Instant::now();
+    let mut missing: Vec<&str> = SIGNALS.to_vec();
+    loop {
+        missing.retain(|signal| {
+            let offset = offsets.get(signal).copied().unwrap_or(0);
+            !contains_after(&signal_file(data_path, signal), offset, run)
+        });
+        if missing.is_empty() {
+            return Ok(format!(
+                "in the traces, metrics, and logs files after {:.1}s",
+                start.elapsed().as_secs_f64()
+            ));
+        }
+        if start.elapsed() >= timeout {
+            bail!(
+                "not in the {} file(s) under {} after {}s",
+                missing.join(", "),
+                data_path.display(),
+                timeout.as_secs()
+            );
+        }
+        std::thread::sleep(POLL_INTERVAL);
+    }
+}
+
+/// Whether `needle` appears in `path` past `offset`. A file that shrank was rotated or
+/// truncated, so it is searched from the start.
+fn contains_after(path: &Path, offset: u64, needle: &str) -> bool {
+    let Ok(data) = std::fs::read(path) else {
+        return false;
+    };
+    let offset = if (data.len() as u64) < offset {
+        0
+    } else {
+        offset as usize
+    };
+    String::from_utf8_lossy(&data[offset..]).contains(needle)
+}
+
+/// Ingest until the probe's rows are queryable. Ingest is skipped while the collector's own
+/// ingest holds the lock, and a store that is busy is retried, until `timeout`.
+fn ingested(probe: &Probe, timeout: Duration) -> Result<Found> {
+    let start = Instant::now();
+    loop {
+        let attempt = crate::fresh_ingest(true).and_then(|()| lookup(probe));
+        match attempt {
+            Ok(Some(found)) => return Ok(found),
+            Ok(None) if start.elapsed() >= timeout => {
+                bail!("not in the database after {}s", timeout.as_secs())
+            }
+            Err(e) if start.elapsed() >= timeout => {
+                return Err(e.context(format!("not stored after {}s", timeout.as_secs())));
+            }
+            _ => std::thread::sleep(POLL_INTERVAL),
+        }
+    }
+}
+
+/// Query the probe's rows back through the configured backend.
+fn lookup(probe: &Probe) -> Result<Option<Found>> {
+    let storage = crate::storage_config()?;
+    let store = lotel_storage::Store::open_default(&storage, true)?;
+    let since = chrono::DateTime::from_timestamp_nanos(probe.sent_ns as i64).naive_utc()
+        - chrono::Duration::minutes(1);
+    let by_trace = lotel_storage::QueryOptions {
+        trace_id: Some(probe.run.clone()),
+        ..Default::default()
+    };
+    let by_service = lotel_storage::QueryOptions {
+        service: Some(SERVICE_NAME.into()),
+        since: Some(since),
+        ..Default::default()
+    };
+    let backend = store.backend();
+    let span = backend.query_traces(&by_trace)?.into_iter().next();
+    let log = backend.query_logs(&by_trace)?.into_iter().next();
+    let metric = backend
+        .query_metrics(&by_service)?
+        .into_iter()
+        .find(|m| tagged(&m.attributes, &probe.run));
+    store.close()?;
+    Ok(match (span, metric, log) {
+        (Some(span), Some(metric), Some(log)) => Some(Found { span, metric, log }),
+        _ => None,
+    })
+}
+
+fn tagged(attributes: &Option<serde_json::Value>, run: &str) -> bool {
+    attributes
+        .as_ref()
+        .and_then(|a| a.get(RUN_ATTR))
+        .and_then(|v| v.as_str())
+        == Some(run)
+}
+
+/// Compare the stored rows with what [`Probe::requests`] sent.
+fn matches(probe: &Probe, found: &Found) -> Result<String> {
+    let mut diffs = Vec::new();
+    let mut check = |what: &str, ok: bool| {
+        if !ok {
+            diffs.push(what.to_string());
+        }
+    };
+    check("span service", found.span.service_name == SERVICE_NAME);
+    check("span name", found.span.name == PROBE_NAME);
+    check("span duration", found.span.duration_ns == 1_000_000);
+    check(
+        "span attributes",
+        tagged(&found.span.attributes, &probe.run),
+    );
+    check("metric name", found.metric.metric_name == PROBE_NAME);
+    check("metric value", found.metric.value == 1.0);
+    check(
+        "log body",
+        found.log.body.as_deref() == Some(probe.log_body().as_str()),
+    );
+    check(
+        "log severity",
+        found.log.severity_number == Some(SEVERITY_INFO),
+    );
+    check("log attributes", tagged(&found.log.attributes, &probe.run));
+    if !diffs.is_empty() {
+        bail!(
+            "stored rows differ from what was sent: {}",
+            diffs.join(", ")
+        );
+    }
+    Ok(format!("span, metric, and log match (trace {})", probe.run))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn probe() -> Probe {
+        Probe::new([0xab; 16], [0x01; 8], 1_710_000_000_000_000_000)
+    }
+
+    #[test]
+    fn probe_tags_every_signal_with_the_run() {
+        let probe = probe();
+        assert_eq!(probe.run, "ab".repeat(16));
+        let (traces, metrics, logs) = probe.requests();
+
+        let span = &traces.resource_spans[0].scope_spans[0].spans[0];
+        assert_eq!(
+            span.end_time_unix_nano - span.start_time_unix_nano,
+            1_000_000
+        );
+        assert_eq!(span.attributes[0].key, RUN_ATTR);
+
+        let Some(metric::Data::Gauge(gauge)) =
+            &metrics.resource_metrics[0].scope_metrics[0].metrics[0].data
+        else {
+            panic!("expected a gauge");
+        };
+        assert_eq!(gauge.data_points[0].attributes[0].key, RUN_ATTR);
+
+        let log = &logs.resource_logs[0].scope_logs[0].log_records[0];
+        assert_eq!(log.trace_id, span.trace_id);
+        assert_eq!(log.span_id, span.span_id);
+    }
+
+    #[test]
+    fn stages_after_a_failure_are_skipped() {
+        let mut report = SmokeReport {
+            passed: true,
+            run: "r".into(),
+            stages: Vec::new(),
+        };
+        report.stage("collector", "", || Ok("running (PID 42)".into()));
+        report.stage("send", "check the endpoint", || bail!("connection refused"));
+        report.stage("write", "", || panic!("must not run"));
+
+        assert!(!report.passed);
+        let outcomes: Vec<Outcome> = report.stages.iter().map(|s| s.outcome).collect();
+        assert_eq!(outcomes, [Outcome::Pass, Outcome::Fail, Outcome::Skip]);
+        assert_eq!(
+            report.render(false),
+            "PASS  collector  running (PID 42)\n\
+             FAIL  send       connection refused\n\
+             \x20                check the endpoint\n\
+             SKIP  write      an earlier stage failed\n"
+        );
+    }
+
+    #[test]
+    fn searches_only_new_data() {
+        let dir = std::env::temp_dir().join(format!("lotel-smoke-{}", std::process::id()));
+        std::fs::create_dir_all(&dir).unwrap();
+        let file = dir.join("traces.jsonl");
+        std::fs::write(&file, "old run-1\n").unwrap();
+        let offset = std::fs::metadata(&file).unwrap().len();
+        std::fs::write(&file, "old run-1\nnew run-2\n").unwrap();
+        assert!(contains_after(&file, offset, "run-2"));
+        assert!(!contains_after(&file, offset, "run-1"));
+        // Rotated: shorter than the offset, so searched from the start.
+        std::fs::write(&file, "run-1\n").unwrap();
+        assert!(contains_after(&file, offset, "run-1"));
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,36 @@
+//! Terminal styling shared by the human-readable renderers (`tail`, waterfalls).
+
+use std::io::IsTerminal;
+
+pub const RESET: &str = "\x1b[0m";
+pub const DIM: &str = "\x1b[2m";
+pub const RED: &str = "\x1b[31m";
+pub const YELLOW: &str = "\x1b[33m";
+pub const GREEN: &str = "\x1b[32m";
+
+/// Whether to color output: stdout is a terminal, `NO_COLOR` is unset, and the user did not
+/// opt out.
+pub fn color_enabled(no_color: bool) -> bool {
+    !no_color && std::env::var_os("NO_COLOR").is_none() && std::io::stdout().is_terminal()
+}
+
+/// Compact duration such as `850µs`, `12.3ms`, or `1.50s`.
+pub fn format_duration_ns(ns: i64) -> String {
+    match ns {
+        n if n >= 1_000_000_000 => format!("{:.2}s", n as f64 / 1e9),
+        n if n >= 1_000_000 => format!("{:.1}ms", n as f64 / 1e6),
+        n => format!("{}µs", n / 1_000),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn formats_durations() {
+        assert_eq!(format_duration_ns(850_000), "850µs");
+        assert_eq!(format_duration_ns(12_345_678), "12.3ms");
+        assert_eq!(format_duration_ns(1_500_000_000), "1.50s");
+    }
+}
@@ -0,0 +1,109 @@
+//! Plain-text tables for interactive output (`shell` SQL results, `query --watch`).
+
+use crate::json::Json;
+
+/// Render `rows` under `headers` as left-aligned columns with a separator line.
+pub fn render(headers: &[String], rows: &[Vec<String>]) -> String {
+    let mut widths: Vec<usize> = headers.iter().map(|h| h.chars().count()).collect();
+    for row in rows {
+        for (width, cell) in widths.iter_mut().zip(row) {
+            *width = (*width).max(cell.chars().count());
+        }
+    }
+
+    let line = |cells: &[String]| -> String {
+        let padded: Vec<String> = cells
+            .iter()
+            .zip(&widths)
+            .map(|(cell, &width)| format!("{cell:<width$}"))
+            .collect();
+        padded.join("  ").trim_end().to_string()
+    };
+
+    let mut out = line(headers);
+    out.push('\n');
+    let rule: Vec<String> = widths.iter().map(|&w| "-".repeat(w)).collect();
+    out.push_str(&rule.join("  "));
+    out.push('\n');
+    for row in rows {
+        out.push_str(&line(row));
+        out.push('\n');
+    }
+    out
+}
+
+/// Flatten JSON results into table cells: an array of objects (or a single object) becomes
+/// one row each, with columns in order of first appearance. Nested values are shown as JSON.
+pub fn from_json(value: &Json) -> (Vec<String>, Vec<Vec<String>>) {
+    let objects: Vec<&Json> = match value {
+        Json::Array(items) => items
+            .iter()
+            .filter(|item| matches!(item, Json::Object(_)))
+            .collect(),
+        Json::Object(_) => vec![value],
+        _ => Vec::new(),
+    };
+    let mut headers: Vec<String> = Vec::new();
+    for object in &objects {
+        if let Json::Object(entries) = object {
+            for (key, _) in entries {
+                if !headers.contains(key) {
+                    headers.push(key.clone());
+                }
+            }
+        }
+    }
+    let rows = objects
+        .iter()
+        .map(|object| {
+            headers
+                .iter()
+                .map(|h| match object.get(h) {
+                    None | Some(Json::Null) => String::new(),
+                    Some(Json::String(s)) => s.clone(),
+                    Some(other) => other.to_string(),
+                })
+                .collect()
+        })
+        .collect();
+    (headers, rows)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn aligns_columns() {
+        let headers = vec!["service".to_string(), "n".to_string()];
+        let rows = vec![
+            vec!["api".to_string(), "12".to_string()],
+            vec!["checkout".to_string(), "3".to_string()],
+        ];
+        assert_eq!(
+            render(&headers, &rows),
+            "service   n\n--------  --\napi       12\ncheckout  3\n"
+        );
+    }
+
+    #[test]
+    fn flattens_json_rows() {
+        let value: Json = serde_json::from_str(
+            r#"[
+                {"name": "GET /", "duration_ns": 5},
+                {"name": "POST /", "attributes": {"k": "v"}, "duration_ns": null}
+            ]"#,
+        )
+        .unwrap();
+        let (headers, rows) = from_json(&value);
+        assert_eq!(headers, ["name", "duration_ns", "attributes"]);
+        assert_eq!(rows[0], ["GET /", "5", ""]);
+        assert_eq!(rows[1], ["POST /", "", "{\"k\":\"v\"}"]);
+
+        let (headers, rows) = from_json(&Json::from(serde_json::json!({"count": 3})));
+        assert_eq!(
+            (headers, rows),
+            (vec!["count".to_string()], vec![vec!["3".to_string()]])
+        );
+    }
+}
@@ -0,0 +1,246 @@
+//! `lotel tail`: follow telemetry as it is ingested, one line per record.
+
+use std::collections::HashMap;
+use std::hash::Hash;
+use std::io::Write;
+use std::time::Duration;
+
+use anyhow::Result;
+use chrono::{NaiveDateTime, Utc};
+use duckdb::Connection;
+
+use crate::style::{DIM, GREEN, RED, RESET, YELLOW, format_duration_ns};
+use crate::time;
+
+/// With Parquet storage, how far behind the newest record seen a late-arriving one is still
+/// shown. The collector batches and ingests periodically, so records can land out of order.
+const LATE_ARRIVAL: chrono::Duration = chrono::Duration::seconds(30);
+
+/// Settings shared by the tail commands.
+pub struct Follow {
+    /// Poll interval.
+    pub interval: Duration,
+    /// Show records from this time on; `None` starts at now.
+    pub since: Option<NaiveDateTime>,
+    pub color: bool,
+    /// Run an incremental ingest each round (unless another ingest holds the lock).
+    pub ingest: fn() -> Result<()>,
+}
+
+/// Position in a feed of one signal. Stored tables are followed in ingest order, so each
+/// record is returned once however old its timestamp (a long span is exported after it
+/// ends). Parquet storage keeps no ingest order; there the feed is re-queried from slightly
+/// before the newest record seen, and records in the overlap are returned once.
+pub struct Cursor<K> {
+    signal: lotel_storage::Signal,
+    since: Option<NaiveDateTime>,
+    /// The last row read, once the first poll has found the stored table.
+    read: Option<i64>,
+    start: NaiveDateTime,
+    newest: NaiveDateTime,
+    seen: HashMap<K, NaiveDateTime>,
+}
+
+impl<K: Eq + Hash> Cursor<K> {
+    /// Start with records from `since` on, or with those ingested from now on.
+    pub fn new(signal: lotel_storage::Signal, since: Option<NaiveDateTime>) -> Self {
+        let start = since.unwrap_or_else(|| Utc::now().naive_utc());
+        Self {
+            signal,
+            since,
+            read: None,
+            start,
+            newest: start,
+            seen: HashMap::new(),
+        }
+    }
+
+    /// The records matching `opts` that this cursor has not returned yet.
+    pub fn poll<T>(
+        &mut self,
+        conn: &Connection,
+        opts: &lotel_storage::QueryOptions,
+        fetch: impl Fn(&Connection, &lotel_storage::QueryOptions) -> Result<Vec<T>>,
+        key: impl Fn(&T) -> K,
+        time_of: impl Fn(&T) -> NaiveDateTime,
+    ) -> Result<Vec<T>> {
+        let mut opts = opts.clone();
+        let Some(range) = lotel_storage::appended(conn, self.signal, self.read)? else {
+            opts.since = Some(self.window_start());
+            let records = fetch(conn, &opts)?;
+            let records = records
+                .into_iter()
+                .filter(|record| self.advance(key(record), time_of(record)))
+                .collect();
+            self.trim();
+            return Ok(records);
+        };
+        let first = self.read.is_none();
+        self.read = Some(range.through());
+        if first && self.since.is_none() {
+            return Ok(Vec::new());
+        }
+        opts.since = self.since;
+        opts.appended = Some(range);
+        fetch(conn, &opts)
+    }
+
+    /// Lower time bound of the next poll of Parquet storage.
+    fn window_start(&self) -> NaiveDateTime {
+        (self.newest - LATE_ARRIVAL).max(self.start)
+    }
+
+    /// Record a polled record; true the first time `key` is seen.
+    fn advance(&mut self, key: K, at: NaiveDateTime) -> bool {
+        self.newest = self.newest.max(at);
+        self.seen.insert(key, at).is_none()
+    }
+
+    /// Forget keys too old to be returned by the next poll. Call once per poll.
+    fn trim(&mut self) {
+        let horizon = self.newest - LATE_ARRIVAL;
+        self.seen.retain(|_, at| *at >= horizon);
+    }
+}
+
+/// Poll `fetch` for records past the cursor, print each new one with `render`, and repeat
+/// until interrupted. `key` and `time_of` are used to follow Parquet storage by time.
+pub fn follow<T, K: Eq + Hash>(
+    settings: &Follow,
+    signal: lotel_storage::Signal,
+    opts: lotel_storage::QueryOptions,
+    fetch: impl Fn(&Connection, &lotel_storage::QueryOptions) -> Result<Vec<T>>,
+    key: impl Fn(&T) -> K,
+    time_of: impl Fn(&T) -> NaiveDateTime,
+    render: impl Fn(&T) -> String,
+) -> Result<()> {
+    let mut cursor = Cursor::new(signal, settings.since);
+    let mut out = std::io::stdout();
+    loop {
+        (settings.ingest)()?;
+        let records = {
+            // Closed between polls so ingests can take the write lock.
+            let conn = crate::query_db()?;
+            cursor.poll(&conn, &opts, &fetch, &key, &time_of)?
+        };
+        for record in &records {
+            writeln!(out, "{}", render(record))?;
+        }
+        out.flush()?;
+        std::thread::sleep(settings.interval);
+    }
+}
+
+/// `lotel tail logs`: timestamp, severity, service, body, and the trace ID when present.
+pub fn render_log(log: &lotel_storage::LogResult, color: bool) -> String {
+    let severity = log.severity.as_deref().unwrap_or("-");
+    let (on, off) = match log.severity_number {
+        _ if !color => ("", ""),
+        Some(n) if n >= 17 => (RED, RESET),
+        Some(n) if n >= 13 => (YELLOW, RESET),
+        Some(n) if n >= 9 => (GREEN, RESET),
+        _ => (DIM, RESET),
+    };
+    let mut line = format!(
+        "{} {on}{severity:<5}{off} [{}] {}",
+        time::display_tz().render(log.timestamp),
+        log.service_name,
+        log.body.as_deref().unwrap_or("")
+    );
+    if let Some(trace_id) = &log.trace_id {
+        let (dim, reset) = if color { (DIM, RESET) } else { ("", "") };
+        line.push_str(&format!(" {dim}trace={trace_id}{reset}"));
+    }
+    line
+}
+
+/// `lotel tail traces`: start time, status, service, span name, duration, and trace ID.
+pub fn render_span(span: &lotel_storage::TraceResult, color: bool) -> String {
+    let (status, on, off) = match span.status.as_str() {
+        "ERROR" if color => ("ERR", RED, RESET),
+        "ERROR" => ("ERR", "", ""),
+        "OK" if color => ("OK", GREEN, RESET),
+        "OK" => ("OK", "", ""),
+        _ => ("-", "", ""),
+    };
+    let (dim, reset) = if color { (DIM, RESET) } else { ("", "") };
+    format!(
+        "{} {on}{status:<3}{off} [{}] {} {} {dim}trace={}{reset}",
+        time::display_tz().render(span.start_time),
+        span.service_name,
+        span.name,
+        format_duration_ns(span.duration_ns),
+        span.trace_id
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn log(severity_number: i32, trace_id: Option<&str>) -> lotel_storage::LogResult {
+        lotel_storage::LogResult {
+            timestamp: "2024-03-09T16:00:00".parse().unwrap(),
+            severity: Some("ERROR".into()),
+            severity_number: Some(severity_number),
+            body: Some("payment declined".into()),
+            service_name: "payments".into(),
+            trace_id: trace_id.map(String::from),
+            span_id: None,
+            attributes: None,
+        }
+    }
+
+    #[test]
+    fn cursor_emits_overlapping_records_once() {
+        let at = |s: &str| -> NaiveDateTime { s.parse().unwrap() };
+        let mut cursor = Cursor::new(lotel_storage::Signal::Logs, Some(at("2024-03-09T16:00:00")));
+        assert_eq!(cursor.window_start(), at("2024-03-09T16:00:00"));
+        assert!(cursor.advance("a", at("2024-03-09T16:01:00")));
+        assert!(!cursor.advance("a", at("2024-03-09T16:01:00")));
+        cursor.trim();
+        assert_eq!(cursor.window_start(), at("2024-03-09T16:00:30"));
+        // A late arrival inside the overlap is still new.
+        assert!(cursor.advance("b", at("2024-03-09T16:00:45")));
+    }
+
+    #[test]
+    fn renders_log_lines() {
+        assert_eq!(
+            render_log(&log(17, Some("abc123")), false),
+            "2024-03-09T16:00:00 ERROR [payments] payment declined trace=abc123"
+        );
+        assert_eq!(
+            render_log(&log(17, None), true),
+            "2024-03-09T16:00:00 \x1b[31mERROR\x1b[0m [payments] payment declined"
+        );
+    }
+
+    #[test]
+    fn renders_span_lines() {
+        let span = lotel_storage::TraceResult {
+            trace_id: "abc123".into(),
+            span_id: "s1".into(),
+            parent_span_id: None,
+            name: "POST /checkout".into(),
+            kind: 2,
+            kind_name: "SERVER".into(),
+            start_time: "2024-03-09T16:00:00".parse().unwrap(),
+            end_time: None,
+            duration_ns: 12_345_678,
+            status_code: 2,
+            status: "ERROR".into(),
+            service_name: "checkout".into(),
+            attributes: None,
+            trace_state: None,
+            flags: None,
+            dropped_attributes_count: None,
+            dropped_events_count: None,
+            dropped_links_count: None,
+        };
+        assert_eq!(
+            render_span(&span, false),
+            "2024-03-09T16:00:00 ERR [checkout] POST /checkout 12.3ms trace=abc123"
+        );
+    }
+}
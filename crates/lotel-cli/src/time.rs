@@ -1,36 +1,179 @@
+use std::sync::OnceLock;
+
 use anyhow::{Result, bail};
-use chrono::{Duration, NaiveDateTime, Utc};
+use chrono::{Duration, Local, NaiveDateTime, NaiveTime, SecondsFormat, TimeZone, Utc};
+pub use lotel_storage::parse_duration;
+
+use crate::json::Json;
+
+/// Keys whose values are rendered in the `--tz` zone.
+const TIME_KEYS: &[&str] = &[
+    "start_time",
+    "end_time",
+    "timestamp",
+    "run_started_at",
+    "first_seen",
+    "bucket_start",
+    "last_seen",
+    "finished_at",
+    "started_at",
+];
+
+/// Time zone for rendered timestamps and for where `today`/`yesterday` begin (`--tz`).
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum DisplayTz {
+    Utc,
+    Local,
+    Named(chrono_tz::Tz),
+}
+
+impl DisplayTz {
+    /// Parse `local`, `UTC`, or an IANA zone name such as `Europe/Berlin`.
+    pub fn parse(s: &str) -> Result<Self> {
+        match s {
+            _ if s.eq_ignore_ascii_case("utc") => Ok(Self::Utc),
+            _ if s.eq_ignore_ascii_case("local") => Ok(Self::Local),
+            _ => s.parse().map(Self::Named).map_err(|_| {
+                anyhow::anyhow!(
+                    "unknown time zone {s:?} (expected local, UTC, or e.g. Europe/Berlin)"
+                )
+            }),
+        }
+    }
+
+    /// Render a UTC timestamp. UTC keeps the naive form stored in the database; other zones
+    /// get an RFC 3339 string with their offset.
+    pub fn render(self, utc: NaiveDateTime) -> String {
+        match self {
+            Self::Utc => utc.format("%Y-%m-%dT%H:%M:%S%.f").to_string(),
+            Self::Local => rfc3339(&Local, utc),
+            Self::Named(tz) => rfc3339(&tz, utc),
+        }
+    }
+
+    /// UTC instant of the local midnight `days_back` days before the day containing `now`.
+    fn midnight(self, now: NaiveDateTime, days_back: i64) -> NaiveDateTime {
+        match self {
+            Self::Utc => midnight_in(&Utc, now, days_back),
+            Self::Local => midnight_in(&Local, now, days_back),
+            Self::Named(tz) => midnight_in(&tz, now, days_back),
+        }
+    }
+}
+
+fn rfc3339<Z: TimeZone>(zone: &Z, utc: NaiveDateTime) -> String
+where
+    Z::Offset: std::fmt::Display,
+{
+    zone.from_utc_datetime(&utc)
+        .to_rfc3339_opts(SecondsFormat::AutoSi, false)
+}
+
+fn midnight_in<Z: TimeZone>(zone: &Z, now: NaiveDateTime, days_back: i64) -> NaiveDateTime {
+    let date = zone.from_utc_datetime(&now).date_naive() - Duration::days(days_back);
+    let midnight = date.and_time(NaiveTime::MIN);
+    // A DST gap at midnight moves the start of the day to the first valid instant.
+    zone.from_local_datetime(&midnight)
+        .earliest()
+        .map(|t| t.naive_utc())
+        .unwrap_or(midnight)
+}
+
+static DISPLAY_TZ: OnceLock<DisplayTz> = OnceLock::new();
+
+/// Set the process-wide `--tz`; called once at startup.
+pub fn set_display_tz(tz: DisplayTz) {
+    let _ = DISPLAY_TZ.set(tz);
+}
+
+pub fn display_tz() -> DisplayTz {
+    DISPLAY_TZ.get().copied().unwrap_or(DisplayTz::Utc)
+}
+
+/// Rewrite timestamp fields of serialized output into the `--tz` zone. A no-op for UTC.
+pub fn localize_json(value: &mut Json) {
+    let tz = display_tz();
+    if tz != DisplayTz::Utc {
+        localize_with(tz, value);
+    }
+}
+
+fn localize_with(tz: DisplayTz, value: &mut Json) {
+    let rows: Vec<&mut Json> = match value {
+        Json::Array(items) => items.iter_mut().collect(),
+        row => vec![row],
+    };
+    for row in rows {
+        let Json::Object(entries) = row else {
+            continue;
+        };
+        for (key, v) in entries {
+            if TIME_KEYS.contains(&key.as_str())
+                && let Json::String(s) = v
+                && let Some(t) = s.parse::<NaiveDateTime>().ok().or_else(|| {
+                    chrono::DateTime::parse_from_rfc3339(s)
+                        .ok()
+                        .map(|t| t.naive_utc())
+                })
+            {
+                *s = tz.render(t);
+            }
+        }
+    }
+}
 
-/// Parse a time string as RFC 3339 or a relative duration (e.g. "1h", "24h", "7d").
+/// Parse a time string as RFC 3339, a relative duration meaning that long ago (e.g. "1h",
+/// "24h", "7d"), or one of `now`, `today`, and `yesterday` (the latter two at midnight in the
+/// `--tz` zone).
 pub fn parse_time(s: &str) -> Result<NaiveDateTime> {
     // Try RFC 3339 first.
     if let Ok(dt) = chrono::DateTime::parse_from_rfc3339(s) {
         return Ok(dt.naive_utc());
     }
+    let now = Utc::now().naive_utc();
+    match s.trim() {
+        "now" => return Ok(now),
+        "today" => return Ok(display_tz().midnight(now, 0)),
+        "yesterday" => return Ok(display_tz().midnight(now, 1)),
+        _ => {}
+    }
     // Try relative duration.
     let dur = parse_duration(s)?;
-    Ok(Utc::now().naive_utc() - dur)
+    Ok(now - dur)
 }
 
-/// Parse a duration string. Supports "Nd" for days, and standard h/m/s suffixes.
-pub fn parse_duration(s: &str) -> Result<Duration> {
-    let s = s.trim();
-    if s.is_empty() {
-        bail!("empty duration string");
+/// Parse `--last`: a duration up to now (e.g. "15m"), `today` (midnight until now), or
+/// `yesterday` (the whole previous day).
+pub fn parse_last(s: &str) -> Result<(NaiveDateTime, NaiveDateTime)> {
+    let now = Utc::now().naive_utc();
+    match s.trim() {
+        "today" => Ok((parse_time("today")?, now)),
+        "yesterday" => Ok((parse_time("yesterday")?, parse_time("today")?)),
+        _ => Ok((now - parse_duration(s)?, now)),
     }
+}
 
-    let (num_str, suffix) = s.split_at(s.len() - 1);
-    let value: i64 = num_str
-        .parse()
-        .map_err(|_| anyhow::anyhow!("cannot parse {s:?} as duration"))?;
-
-    match suffix {
-        "d" => Ok(Duration::days(value)),
-        "h" => Ok(Duration::hours(value)),
-        "m" => Ok(Duration::minutes(value)),
-        "s" => Ok(Duration::seconds(value)),
-        _ => bail!("cannot parse {s:?} as duration (unknown suffix {suffix:?})"),
+/// Parse a window written as `start..end`, e.g. `2h..1h` or `1h..now`. Each side is
+/// anything [`parse_time`] accepts; `now` is the current time.
+pub fn parse_window(s: &str) -> Result<(NaiveDateTime, NaiveDateTime)> {
+    let Some((start, end)) = s.split_once("..") else {
+        bail!("invalid window {s:?} (expected start..end, e.g. 2h..1h)");
+    };
+    let parse = |t: &str| match t.trim() {
+        "" => Ok(Utc::now().naive_utc()),
+        t => parse_time(t),
+    };
+    let (start, end) = (parse(start)?, parse(end)?);
+    if start >= end {
+        bail!("invalid window {s:?}: start must be before end");
     }
+    Ok((start, end))
+}
+
+/// Parse a duration such as `500ms` or `2s` into fractional milliseconds.
+pub fn parse_millis(s: &str) -> Result<f64> {
+    let dur = parse_duration(s)?;
+    Ok(dur.num_microseconds().unwrap_or(i64::MAX) as f64 / 1000.0)
 }
 
 #[cfg(test)]
@@ -38,33 +181,88 @@ mod tests {
     use super::*;
 
     #[test]
-    fn parse_duration_days() {
-        let d = parse_duration("7d").unwrap();
-        assert_eq!(d, Duration::days(7));
+    fn parse_window_relative() {
+        let (start, end) = parse_window("2h..1h").unwrap();
+        assert!((end - start - Duration::hours(1)).num_seconds().abs() < 5);
+        let (start, end) = parse_window("1h..now").unwrap();
+        assert!(end - start >= Duration::hours(1));
+        assert!(parse_window("1h..2h").is_err());
+        assert!(parse_window("1h").is_err());
     }
 
     #[test]
-    fn parse_duration_hours() {
-        let d = parse_duration("24h").unwrap();
-        assert_eq!(d, Duration::hours(24));
+    fn parse_time_rfc3339() {
+        let t = parse_time("2024-01-15T10:30:00Z").unwrap();
+        assert_eq!(t.to_string(), "2024-01-15 10:30:00");
     }
 
     #[test]
-    fn parse_duration_minutes() {
-        let d = parse_duration("30m").unwrap();
-        assert_eq!(d, Duration::minutes(30));
+    fn parse_time_keywords() {
+        let today = parse_time("today").unwrap();
+        assert_eq!(today.time(), NaiveTime::MIN);
+        assert_eq!(today.date(), Utc::now().date_naive());
+        assert_eq!(parse_time("yesterday").unwrap(), today - Duration::days(1));
+        assert!(parse_time("now").unwrap() >= today);
     }
 
     #[test]
-    fn parse_duration_seconds() {
-        let d = parse_duration("60s").unwrap();
-        assert_eq!(d, Duration::seconds(60));
+    fn display_tz_parse_and_render() {
+        assert_eq!(DisplayTz::parse("utc").unwrap(), DisplayTz::Utc);
+        assert_eq!(DisplayTz::parse("Local").unwrap(), DisplayTz::Local);
+        assert!(DisplayTz::parse("Mars/Olympus").is_err());
+
+        let t: NaiveDateTime = "2024-03-09T16:00:00.5".parse().unwrap();
+        assert_eq!(DisplayTz::Utc.render(t), "2024-03-09T16:00:00.500");
+        let berlin = DisplayTz::parse("Europe/Berlin").unwrap();
+        assert_eq!(berlin.render(t), "2024-03-09T17:00:00.500+01:00");
     }
 
     #[test]
-    fn parse_time_rfc3339() {
-        let t = parse_time("2024-01-15T10:30:00Z").unwrap();
-        assert_eq!(t.to_string(), "2024-01-15 10:30:00");
+    fn localize_rewrites_time_keys_only() {
+        let tz = DisplayTz::parse("America/New_York").unwrap();
+        let mut value: Json = serde_json::from_str(
+            r#"[{
+                "start_time": "2024-07-01T12:00:00",
+                "started_at": "2024-07-01T12:00:00Z",
+                "name": "2024-07-01T12:00:00",
+                "attributes": {"timestamp": "2024-07-01T12:00:00"}
+            }]"#,
+        )
+        .unwrap();
+        localize_with(tz, &mut value);
+        let Json::Array(rows) = &value else {
+            panic!("{value}");
+        };
+        let field = |key| match rows[0].get(key) {
+            Some(Json::String(s)) => s.clone(),
+            other => panic!("{key}: {other:?}"),
+        };
+        assert_eq!(field("start_time"), "2024-07-01T08:00:00-04:00");
+        assert_eq!(field("started_at"), "2024-07-01T08:00:00-04:00");
+        assert_eq!(field("name"), "2024-07-01T12:00:00");
+        assert_eq!(
+            rows[0].get("attributes").unwrap().to_string(),
+            r#"{"timestamp":"2024-07-01T12:00:00"}"#
+        );
+    }
+
+    #[test]
+    fn midnight_follows_zone() {
+        let tz = DisplayTz::parse("Asia/Tokyo").unwrap();
+        let now: NaiveDateTime = "2024-03-09T20:00:00".parse().unwrap();
+        // 05:00 on the 10th in Tokyo; its midnight is 15:00 UTC on the 9th.
+        assert_eq!(tz.midnight(now, 0).to_string(), "2024-03-09 15:00:00");
+        assert_eq!(tz.midnight(now, 1).to_string(), "2024-03-08 15:00:00");
+    }
+
+    #[test]
+    fn parse_last_bounds() {
+        let (since, until) = parse_last("15m").unwrap();
+        assert_eq!(until - since, Duration::minutes(15));
+        let (since, until) = parse_last("yesterday").unwrap();
+        assert_eq!(until - since, Duration::days(1));
+        assert_eq!(until, parse_time("today").unwrap());
+        assert!(parse_last("soon").is_err());
     }
 
     #[test]
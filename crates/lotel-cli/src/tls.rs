@@ -0,0 +1,146 @@
+//! Local TLS material for `lotel start --tls`: a CA and a `localhost` server certificate it
+//! signs, made with the `openssl` command and kept in the collector's `tls` directory so SDKs
+//! trust the same CA across restarts.
+
+use std::path::{Path, PathBuf};
+use std::process::Command;
+
+use anyhow::{Context, Result, bail};
+
+/// The certificate files of one collector.
+#[derive(Debug, Clone, PartialEq)]
+pub struct TlsFiles {
+    /// The CA certificate SDKs verify the collector with.
+    pub ca_cert: PathBuf,
+    pub server_cert: PathBuf,
+    pub server_key: PathBuf,
+}
+
+impl TlsFiles {
+    pub fn in_dir(dir: &Path) -> Self {
+        Self {
+            ca_cert: dir.join("ca.pem"),
+            server_cert: dir.join("server.pem"),
+            server_key: dir.join("server.key"),
+        }
+    }
+
+    fn exist(&self) -> bool {
+        [&self.ca_cert, &self.server_cert, &self.server_key]
+            .iter()
+            .all(|path| path.is_file())
+    }
+}
+
+/// The certificates in `dir`, generating the CA and server certificate unless all of them
+/// are already there.
+pub fn ensure_certificates(dir: &Path) -> Result<TlsFiles> {
+    let files = TlsFiles::in_dir(dir);
+    if files.exist() {
+        return Ok(files);
+    }
+    std::fs::create_dir_all(dir)?;
+    let ca_key = dir.join("ca.key");
+    let csr = dir.join("server.csr");
+    let extensions = dir.join("server.ext");
+    std::fs::write(
+        &extensions,
+        "subjectAltName=DNS:localhost,IP:127.0.0.1,IP:::1\n\
+         basicConstraints=CA:FALSE\n\
+         keyUsage=critical,digitalSignature,keyEncipherment\n\
+         extendedKeyUsage=serverAuth\n",
+    )?;
+
+    let ec_key = [
+        "-newkey",
+        "ec",
+        "-pkeyopt",
+        "ec_paramgen_curve:prime256v1",
+        "-nodes",
+    ];
+    run(Command::new("openssl")
+        .args(["req", "-x509", "-days", "3650"])
+        .args(ec_key)
+        .arg("-keyout")
+        .arg(&ca_key)
+        .arg("-out")
+        .arg(&files.ca_cert)
+        .args(["-subj", "/CN=lotel local CA"])
+        .args(["-addext", "basicConstraints=critical,CA:TRUE"])
+        .args(["-addext", "keyUsage=critical,keyCertSign,cRLSign"]))?;
+    run(Command::new("openssl")
+        .arg("req")
+        .args(ec_key)
+        .arg("-keyout")
+        .arg(&files.server_key)
+        .arg("-out")
+        .arg(&csr)
+        .args(["-subj", "/CN=localhost"]))?;
+    let serial = format!("0x{:x}", chrono::Utc::now().timestamp_micros());
+    run(Command::new("openssl")
+        .args(["x509", "-req", "-days", "825", "-set_serial", &serial])
+        .arg("-in")
+        .arg(&csr)
+        .arg("-CA")
+        .arg(&files.ca_cert)
+        .arg("-CAkey")
+        .arg(&ca_key)
+        .arg("-extfile")
+        .arg(&extensions)
+        .arg("-out")
+        .arg(&files.server_cert))?;
+
+    for path in [&csr, &extensions] {
+        let _ = std::fs::remove_file(path);
+    }
+    #[cfg(unix)]
+    for key in [&ca_key, &files.server_key] {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(key, std::fs::Permissions::from_mode(0o600))?;
+    }
+    Ok(files)
+}
+
+fn run(command: &mut Command) -> Result<()> {
+    let output = command
+        .output()
+        .context("running openssl to generate TLS certificates (is it installed?)")?;
+    if !output.status.success() {
+        bail!(
+            "generating TLS certificates: {}",
+            String::from_utf8_lossy(&output.stderr).trim()
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn generates_certificates_once() {
+        if Command::new("openssl").arg("version").output().is_err() {
+            return;
+        }
+        let dir = std::env::temp_dir().join(format!("lotel-tls-{}", std::process::id()));
+        let files = ensure_certificates(&dir).unwrap();
+        assert_eq!(files, TlsFiles::in_dir(&dir));
+        let ca = std::fs::read(&files.ca_cert).unwrap();
+        assert!(String::from_utf8_lossy(&ca).contains("BEGIN CERTIFICATE"));
+
+        let verify = Command::new("openssl")
+            .arg("verify")
+            .arg("-CAfile")
+            .arg(&files.ca_cert)
+            .arg(&files.server_cert)
+            .output()
+            .unwrap();
+        assert!(verify.status.success());
+
+        // A second start keeps the CA SDKs already trust.
+        ensure_certificates(&dir).unwrap();
+        assert_eq!(std::fs::read(&files.ca_cert).unwrap(), ca);
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
+}
@@ -0,0 +1,204 @@
+//! `lotel version`: build info, the version of the running collector, and whether what it
+//! writes is something this build ingests. The collector is lotel itself (`lotel start`
+//! spawns this binary), so its version is the lotel release that started it, recorded in
+//! the state file.
+
+use std::collections::HashMap;
+
+use lotel_collector::config::FileExporter;
+use serde::Serialize;
+
+use crate::daemon::CollectorState;
+
+pub const VERSION: &str = env!("CARGO_PKG_VERSION");
+
+/// Oldest collector release whose JSONL this build's ingest is tested against. Raise it
+/// when the file format changes incompatibly.
+pub const MIN_COMPATIBLE_COLLECTOR: &str = "0.1.0";
+
+/// File exporter formats the collector writes and ingest reads.
+const SUPPORTED_FORMATS: &[&str] = &["json"];
+
+#[derive(Debug, Serialize)]
+pub struct VersionReport {
+    pub version: &'static str,
+    pub commit: &'static str,
+    pub rustc: &'static str,
+    pub target: &'static str,
+    pub collector: CollectorVersion,
+    pub exporters: Vec<ExporterFormat>,
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub warnings: Vec<String>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct CollectorVersion {
+    pub running: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub pid: Option<u32>,
+    /// Release that started the collector; absent if it predates recording versions.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub version: Option<String>,
+    /// Releases this build is tested with, e.g. `0.1.0 - 0.3.0`.
+    pub tested_range: String,
+    /// Whether `version` is in `tested_range`; absent when not running or unknown.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub compatible: Option<bool>,
+}
+
+#[derive(Debug, Serialize)]
+pub struct ExporterFormat {
+    pub name: String,
+    pub format: String,
+    pub compatible: bool,
+}
+
+/// Build the report from the collector state (`running` if its process is alive) and the
+/// configured file exporters.
+pub fn report(
+    state: Option<&CollectorState>,
+    running: bool,
+    exporters: &HashMap<String, FileExporter>,
+) -> VersionReport {
+    let mut warnings = Vec::new();
+    let version = state.filter(|_| running).and_then(|s| s.version.clone());
+    let compatible = version.as_deref().map(in_tested_range);
+    let tested_range = format!("{MIN_COMPATIBLE_COLLECTOR} - {VERSION}");
+    match (&version, compatible) {
+        (Some(v), Some(false)) => warnings.push(format!(
+            "the running collector is lotel {v}, outside the tested range {tested_range}; \
+             restart it with `lotel-cli upgrade`"
+        )),
+        (None, _) if running => warnings.push(
+            "the running collector was started by a lotel release that did not record its \
+             version; run `lotel-cli upgrade` to check compatibility"
+                .to_string(),
+        ),
+        _ => {}
+    }
+
+    let mut exporters: Vec<ExporterFormat> = exporters
+        .iter()
+        .map(|(name, exporter)| ExporterFormat {
+            name: name.clone(),
+            format: exporter.format.clone(),
+            compatible: SUPPORTED_FORMATS.contains(&exporter.format.as_str()),
+        })
+        .collect();
+    exporters.sort_by(|a, b| a.name.cmp(&b.name));
+    for exporter in exporters.iter().filter(|e| !e.compatible) {
+        warnings.push(format!(
+            "exporter {} has format {:?}, but lotel only writes and ingests json; \
+             the setting is ignored",
+            exporter.name, exporter.format
+        ));
+    }
+
+    VersionReport {
+        version: VERSION,
+        commit: env!("LOTEL_COMMIT"),
+        rustc: env!("LOTEL_RUSTC_VERSION"),
+        target: env!("LOTEL_TARGET"),
+        collector: CollectorVersion {
+            running,
+            pid: state.filter(|_| running).map(|s| s.pid),
+            version,
+            tested_range,
+            compatible,
+        },
+        exporters,
+        warnings,
+    }
+}
+
+fn in_tested_range(version: &str) -> bool {
+    match (
+        parse(version),
+        parse(MIN_COMPATIBLE_COLLECTOR),
+        parse(VERSION),
+    ) {
+        (Some(v), Some(min), Some(max)) => min <= v && v <= max,
+        _ => false,
+    }
+}
+
+/// `major.minor.patch`, ignoring pre-release and build suffixes.
+fn parse(version: &str) -> Option<(u64, u64, u64)> {
+    let core = version.split(['-', '+']).next()?;
+    let mut parts = core.split('.').map(|p| p.parse::<u64>().ok());
+    Some((parts.next()??, parts.next()??, parts.next()??))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn state(version: Option<&str>) -> CollectorState {
+        CollectorState {
+            pid: 42,
+            started_at: "2024-03-09T16:00:00Z".into(),
+            config_path: "/tmp/config.yaml".into(),
+            data_path: "/tmp/data".into(),
+            version: version.map(String::from),
+            commit: None,
+            identity: Default::default(),
+            options: Default::default(),
+        }
+    }
+
+    fn exporters(formats: &[(&str, &str)]) -> HashMap<String, FileExporter> {
+        formats
+            .iter()
+            .map(|(name, format)| {
+                let exporter = FileExporter {
+                    path: format!("/tmp/{name}.jsonl"),
+                    format: format.to_string(),
+                };
+                (name.to_string(), exporter)
+            })
+            .collect()
+    }
+
+    #[test]
+    fn checks_the_collector_version() {
+        let current = report(Some(&state(Some(VERSION))), true, &HashMap::new());
+        assert_eq!(current.collector.compatible, Some(true));
+        assert_eq!(current.collector.pid, Some(42));
+        assert!(current.warnings.is_empty());
+
+        let future = report(Some(&state(Some("999.0.0"))), true, &HashMap::new());
+        assert_eq!(future.collector.compatible, Some(false));
+        assert!(future.warnings[0].contains("outside the tested range"));
+
+        let unrecorded = report(Some(&state(None)), true, &HashMap::new());
+        assert_eq!(unrecorded.collector.compatible, None);
+        assert_eq!(unrecorded.warnings.len(), 1);
+
+        let stopped = report(Some(&state(Some("999.0.0"))), false, &HashMap::new());
+        assert_eq!(stopped.collector.version, None);
+        assert!(stopped.warnings.is_empty());
+    }
+
+    #[test]
+    fn warns_on_formats_lotel_does_not_write() {
+        let report = report(
+            None,
+            false,
+            &exporters(&[("file/traces", "json"), ("file/logs", "proto")]),
+        );
+        assert_eq!(report.exporters[0].name, "file/logs");
+        assert!(!report.exporters[0].compatible);
+        assert!(report.exporters[1].compatible);
+        assert_eq!(report.warnings.len(), 1);
+        assert!(report.warnings[0].contains("file/logs"));
+    }
+
+    #[test]
+    fn parses_versions() {
+        assert_eq!(parse("0.1.0"), Some((0, 1, 0)));
+        assert_eq!(parse("1.2.3-rc.1+abc"), Some((1, 2, 3)));
+        assert_eq!(parse("1.2"), None);
+        assert!(in_tested_range(VERSION));
+        assert!(!in_tested_range("0.0.1"));
+    }
+}
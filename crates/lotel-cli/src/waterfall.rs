@@ -0,0 +1,198 @@
+//! `lotel query trace <id> --waterfall`: a trace's spans as nested, time-aligned bars.
+
+use std::collections::{HashMap, HashSet};
+
+use lotel_storage::TraceResult;
+
+use crate::style::{DIM, RED, RESET, format_duration_ns};
+
+/// Width of the span-name column, including indentation.
+const LABEL_WIDTH: usize = 40;
+
+/// A span placed in the waterfall: its depth in the tree and its offset from trace start.
+struct Row<'a> {
+    span: &'a TraceResult,
+    depth: usize,
+    offset_ns: i64,
+    critical: bool,
+}
+
+/// Render `spans` (all from one trace) as a waterfall `width` characters wide. Spans are
+/// nested under their parents in start order; `*` marks the critical path (from each root,
+/// the child that finishes last) and `!` marks errors.
+pub fn render(spans: &[TraceResult], width: usize, color: bool) -> String {
+    let Some(t0) = spans.iter().map(|s| s.start_time).min() else {
+        return String::new();
+    };
+    let offset = |s: &TraceResult| (s.start_time - t0).num_nanoseconds().unwrap_or(0);
+    let end = |s: &TraceResult| offset(s) + s.duration_ns;
+    let total = spans.iter().map(end).max().unwrap_or(0).max(1);
+
+    let ids: HashSet<&str> = spans.iter().map(|s| s.span_id.as_str()).collect();
+    let mut children: HashMap<&str, Vec<&TraceResult>> = HashMap::new();
+    let mut roots = Vec::new();
+    for span in spans {
+        match span.parent_span_id.as_deref() {
+            Some(parent) if ids.contains(parent) => children.entry(parent).or_default().push(span),
+            // Roots, and orphans whose parent was not captured.
+            _ => roots.push(span),
+        }
+    }
+    for list in children.values_mut().chain(std::iter::once(&mut roots)) {
+        list.sort_by_key(|s| (s.start_time, s.span_id.clone()));
+    }
+
+    let mut critical = HashSet::new();
+    for root in &roots {
+        let mut current = *root;
+        critical.insert(current.span_id.as_str());
+        while let Some(last) = children
+            .get(current.span_id.as_str())
+            .and_then(|c| c.iter().max_by_key(|s| end(s)))
+        {
+            current = last;
+            critical.insert(current.span_id.as_str());
+        }
+    }
+
+    let mut rows = Vec::new();
+    let mut stack: Vec<(&TraceResult, usize)> = roots.iter().rev().map(|s| (*s, 0)).collect();
+    while let Some((span, depth)) = stack.pop() {
+        rows.push(Row {
+            span,
+            depth,
+            offset_ns: offset(span),
+            critical: critical.contains(span.span_id.as_str()),
+        });
+        if let Some(kids) = children.get(span.span_id.as_str()) {
+            stack.extend(kids.iter().rev().map(|s| (*s, depth + 1)));
+        }
+    }
+
+    let trace_id = &spans[0].trace_id;
+    let mut out = format!(
+        "trace {trace_id}  {} spans  {}\n",
+        spans.len(),
+        format_duration_ns(total)
+    );
+    for row in rows {
+        out.push_str(&render_row(&row, total, width, color));
+        out.push('\n');
+    }
+    out
+}
+
+fn render_row(row: &Row<'_>, total: i64, width: usize, color: bool) -> String {
+    let span = row.span;
+    let error = span.status == "ERROR";
+    let marker = match (row.critical, error) {
+        (_, true) => '!',
+        (true, false) => '*',
+        (false, false) => ' ',
+    };
+    let label = truncate(
+        &format!(
+            "{}{} ({})",
+            "  ".repeat(row.depth),
+            span.name,
+            span.service_name
+        ),
+        LABEL_WIDTH,
+    );
+
+    let scale = |ns: i64| (ns as f64 / total as f64 * width as f64).round() as usize;
+    let start = scale(row.offset_ns).min(width.saturating_sub(1));
+    let len = scale(span.duration_ns).clamp(1, width - start);
+    let bar = format!(
+        "{}{}{}",
+        " ".repeat(start),
+        "█".repeat(len),
+        " ".repeat(width - start - len)
+    );
+    let (on, off) = match (color, error, row.critical) {
+        (false, _, _) => ("", ""),
+        (true, true, _) => (RED, RESET),
+        (true, false, false) => (DIM, RESET),
+        (true, false, true) => ("", ""),
+    };
+    format!(
+        "{marker} {label:<LABEL_WIDTH$} |{on}{bar}{off}| {:>8}",
+        format_duration_ns(span.duration_ns)
+    )
+}
+
+fn truncate(s: &str, max: usize) -> String {
+    if s.chars().count() <= max {
+        return s.to_string();
+    }
+    let mut out: String = s.chars().take(max - 1).collect();
+    out.push('…');
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn span(
+        id: &str,
+        parent: Option<&str>,
+        start_ms: i64,
+        dur_ms: i64,
+        error: bool,
+    ) -> TraceResult {
+        let t0: chrono::NaiveDateTime = "2024-03-09T16:00:00".parse().unwrap();
+        TraceResult {
+            trace_id: "t1".into(),
+            span_id: id.into(),
+            parent_span_id: parent.map(String::from),
+            name: format!("op-{id}"),
+            kind: 2,
+            kind_name: "SERVER".into(),
+            start_time: t0 + chrono::Duration::milliseconds(start_ms),
+            end_time: None,
+            duration_ns: dur_ms * 1_000_000,
+            status_code: if error { 2 } else { 0 },
+            status: if error { "ERROR" } else { "UNSET" }.into(),
+            service_name: "api".into(),
+            attributes: None,
+            trace_state: None,
+            flags: None,
+            dropped_attributes_count: None,
+            dropped_events_count: None,
+            dropped_links_count: None,
+        }
+    }
+
+    #[test]
+    fn nests_and_aligns_spans() {
+        let spans = vec![
+            span("c", Some("a"), 50, 50, true),
+            span("a", None, 0, 100, false),
+            span("b", Some("a"), 0, 40, false),
+        ];
+        let out = render(&spans, 10, false);
+        let lines: Vec<&str> = out.lines().collect();
+        assert_eq!(lines[0], "trace t1  3 spans  100.0ms");
+        assert!(lines[1].starts_with("* op-a (api)"));
+        assert!(lines[1].contains("|██████████|"));
+        assert!(lines[2].starts_with("    op-b (api)"));
+        assert!(lines[2].contains("|████      |"));
+        assert!(lines[3].starts_with("!   op-c (api)"));
+        assert!(lines[3].contains("|     █████|"));
+        assert!(lines[3].ends_with("50.0ms"));
+    }
+
+    #[test]
+    fn orphans_render_as_roots() {
+        let spans = vec![span("x", Some("missing"), 0, 10, false)];
+        let out = render(&spans, 10, false);
+        assert!(out.lines().nth(1).unwrap().starts_with("* op-x (api)"));
+    }
+
+    #[test]
+    fn truncates_long_labels() {
+        assert_eq!(truncate("abcdef", 4), "abc…");
+        assert_eq!(truncate("abc", 4), "abc");
+    }
+}
@@ -0,0 +1,100 @@
+use std::path::Path;
+use std::process::{Child, Command, Stdio};
+use std::time::Duration;
+
+use lotel_proto::query::v1::query_service_client::QueryServiceClient;
+use lotel_proto::query::v1::{AttrFilter, QueryRequest, StatusRequest, attr_filter};
+
+const LOTEL: &str = env!("CARGO_BIN_EXE_lotel-cli");
+
+/// A `lotel-cli` command confined to `home`, with its data in `home/data`.
+fn lotel(home: &Path) -> Command {
+    let mut cmd = Command::new(LOTEL);
+    cmd.env("HOME", home)
+        .env("LOTEL_DATA_DIR", home.join("data"))
+        .stdout(Stdio::null())
+        .stderr(Stdio::null());
+    cmd
+}
+
+fn span_line(service: &str, span_id: &str, name: &str) -> String {
+    format!(
+        r#"{{"resourceSpans":[{{"resource":{{"attributes":[{{"key":"service.name","value":{{"stringValue":"{service}"}}}}]}},"scopeSpans":[{{"spans":[{{"traceId":"5b8efff798038103d269b633813fc60c","spanId":"{span_id}","name":"{name}","kind":2,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000000005000000","status":{{"code":0}},"attributes":[{{"key":"http.route","value":{{"stringValue":"/orders"}}}}]}}]}}]}}]}}"#
+    )
+}
+
+struct Server(Child);
+
+impl Drop for Server {
+    fn drop(&mut self) {
+        let _ = self.0.kill();
+        let _ = self.0.wait();
+    }
+}
+
+/// Spans ingested from the JSONL files come back through `serve --grpc` and the
+/// generated client.
+#[tokio::test]
+async fn grpc_query_roundtrip() {
+    let home = tempfile::TempDir::new().unwrap();
+    let traces = home.path().join("data/traces");
+    std::fs::create_dir_all(&traces).unwrap();
+    std::fs::write(
+        traces.join("traces.jsonl"),
+        [
+            span_line("checkout", "eee19b7ec3c1b174", "POST /orders"),
+            span_line("payments", "eee19b7ec3c1b175", "charge"),
+        ]
+        .join("\n")
+            + "\n",
+    )
+    .unwrap();
+    let status = lotel(home.path()).arg("ingest").status().unwrap();
+    assert!(status.success(), "ingest failed: {status}");
+
+    let port = std::net::TcpListener::bind("127.0.0.1:0")
+        .unwrap()
+        .local_addr()
+        .unwrap()
+        .port();
+    let _server = Server(
+        lotel(home.path())
+            .args(["serve", "--grpc", &format!("127.0.0.1:{port}")])
+            .spawn()
+            .unwrap(),
+    );
+    let mut client = None;
+    for _ in 0..100 {
+        match QueryServiceClient::connect(format!("http://127.0.0.1:{port}")).await {
+            Ok(c) => {
+                client = Some(c);
+                break;
+            }
+            Err(_) => tokio::time::sleep(Duration::from_millis(100)).await,
+        }
+    }
+    let mut client = client.expect("serve --grpc did not start listening");
+
+    let spans = client
+        .query_traces(QueryRequest {
+            service: Some("checkout".to_string()),
+            attrs: vec![AttrFilter {
+                key: "http.route".to_string(),
+                op: attr_filter::Op::Eq as i32,
+                value: "/orders".to_string(),
+            }],
+            ..Default::default()
+        })
+        .await
+        .unwrap()
+        .into_inner()
+        .spans;
+    assert_eq!(spans.len(), 1);
+    assert_eq!(spans[0].name, "POST /orders");
+    assert_eq!(spans[0].span_id, "eee19b7ec3c1b174");
+    assert_eq!(spans[0].duration_ns, 5_000_000);
+    assert_eq!(spans[0].start_time.map(|t| t.seconds), Some(1_710_000_000));
+
+    let status = client.status(StatusRequest {}).await.unwrap().into_inner();
+    assert!(!status.running);
+}
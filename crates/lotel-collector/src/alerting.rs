@@ -0,0 +1,103 @@
+//! Alert webhooks: `ingestion.alerts` rules are checked after each ingestion pass, and each
+//! time a rule starts or stops breaching a Slack-compatible JSON payload is POSTed.
+
+use serde::Deserialize;
+
+/// The `ingestion.alerts` config section.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct AlertsConfig {
+    /// Receives one POST per alert transition; Slack incoming webhooks accept it as-is.
+    pub webhook: String,
+    pub rules: Vec<lotel_storage::AlertRule>,
+}
+
+/// Evaluates alert rules on the ingestion thread and posts transitions from the runtime.
+pub struct Alerter {
+    evaluator: lotel_storage::AlertEvaluator,
+    webhook: String,
+    client: reqwest::Client,
+    runtime: tokio::runtime::Handle,
+}
+
+impl Alerter {
+    /// Must be called from within the tokio runtime that will send the webhooks.
+    pub fn new(config: &AlertsConfig) -> Result<Self, Box<dyn std::error::Error>> {
+        Ok(Self {
+            evaluator: lotel_storage::AlertEvaluator::new(&config.rules)?,
+            webhook: config.webhook.clone(),
+            client: reqwest::Client::new(),
+            runtime: tokio::runtime::Handle::current(),
+        })
+    }
+
+    /// Evaluate the rules against the freshly ingested data and notify on transitions.
+    pub fn check(
+        &mut self,
+        conn: &duckdb::Connection,
+    ) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+        let now = chrono::Utc::now().naive_utc();
+        for event in self.evaluator.evaluate(conn, now)? {
+            if event.firing {
+                tracing::warn!(
+                    "Alert {:?} firing for {}: {}",
+                    event.rule,
+                    event.service,
+                    event.message
+                );
+            } else {
+                tracing::info!("Alert {:?} resolved for {}", event.rule, event.service);
+            }
+            let request = self.client.post(&self.webhook).json(&payload(&event));
+            self.runtime.spawn(async move {
+                match request.send().await {
+                    Ok(resp) if !resp.status().is_success() => {
+                        tracing::error!("Alert webhook returned {}", resp.status());
+                    }
+                    Ok(_) => {}
+                    Err(e) => tracing::error!("Alert webhook failed: {e}"),
+                }
+            });
+        }
+        Ok(())
+    }
+}
+
+/// Slack reads `text`; other receivers can use the structured event under `lotel`.
+fn payload(event: &lotel_storage::AlertEvent) -> serde_json::Value {
+    let text = if event.firing {
+        format!(
+            "[FIRING] lotel alert \"{}\" for {}: {} over the last {}",
+            event.rule, event.service, event.message, event.window
+        )
+    } else {
+        format!(
+            "[RESOLVED] lotel alert \"{}\" for {}: {}",
+            event.rule, event.service, event.message
+        )
+    };
+    serde_json::json!({ "text": text, "lotel": event })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn slack_payload_text() {
+        let event = lotel_storage::AlertEvent {
+            rule: "checkout errors".into(),
+            service: "checkout".into(),
+            firing: true,
+            window: "5m".into(),
+            message: "error rate 16.7% > 5.0% (2 of 12 requests)".into(),
+            stats: None,
+        };
+        let body = payload(&event);
+        assert_eq!(
+            body["text"],
+            "[FIRING] lotel alert \"checkout errors\" for checkout: error rate 16.7% > 5.0% (2 of 12 requests) over the last 5m"
+        );
+        assert_eq!(body["lotel"]["service"], "checkout");
+    }
+}
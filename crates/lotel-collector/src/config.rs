@@ -55,13 +55,15 @@ exporters:
 extensions:
   health_check:
     endpoint: 0.0.0.0:13133
+  zpages:
+    endpoint: localhost:55679
 
 ingestion:
   interval: 2m
   enabled: true
 
 service:
-  extensions: [health_check]
+  extensions: [health_check, zpages]
   pipelines:
     traces:
       receivers: [otlp]
@@ -94,6 +96,15 @@ pub struct CollectorConfig {
     pub service: Service,
     #[serde(default)]
     pub ingestion: Option<IngestionConfig>,
+    /// Scheduled pruning while the collector runs.
+    #[serde(default)]
+    pub retention: Option<crate::retention::RetentionConfig>,
+    /// Which database ingestion writes to and queries read from (DuckDB by default).
+    #[serde(default)]
+    pub storage: lotel_storage::StorageConfig,
+    /// `KEY=VALUE` variables `lotel start` sets in the collector process's environment.
+    #[serde(default)]
+    pub environment: Vec<String>,
 }
 
 #[derive(Debug, Deserialize, PartialEq)]
@@ -104,6 +115,27 @@ pub struct IngestionConfig {
     /// Enable or disable periodic ingestion.
     #[serde(default = "default_true")]
     pub enabled: bool,
+    /// Attribute scrubbing / PII redaction rules applied to every ingested row.
+    #[serde(default)]
+    pub scrub: Option<lotel_storage::ScrubConfig>,
+    /// Fraction of traces and logs to keep (e.g., "10%"). Errors are always kept.
+    #[serde(default)]
+    pub sample: Option<String>,
+    /// Rows committed per transaction while ingesting a file (default 50000; 0 commits each
+    /// file once).
+    #[serde(default)]
+    pub batch_rows: Option<usize>,
+    /// Parse trace files with DuckDB's `read_json` instead of in Rust; faster on large
+    /// files. Ignored with scrub rules, sampling, or a non-DuckDB backend.
+    #[serde(default)]
+    pub read_json: bool,
+    /// Cancel an ingestion pass that runs longer than this (e.g., "10m"). Its open batch
+    /// rolls back and the next pass resumes from the last commit. Unset lets passes finish.
+    #[serde(default)]
+    pub timeout: Option<String>,
+    /// Alert rules checked after each ingestion pass, with the webhook they notify.
+    #[serde(default)]
+    pub alerts: Option<crate::alerting::AlertsConfig>,
 }
 
 fn default_ingestion_interval() -> String {
@@ -126,10 +158,40 @@ pub struct OtlpReceiver {
 
 #[derive(Debug, Deserialize, PartialEq)]
 pub struct OtlpProtocols {
-    pub grpc: Endpoint,
+    pub grpc: GrpcEndpoint,
     pub http: Endpoint,
 }
 
+#[derive(Debug, Deserialize, PartialEq)]
+pub struct GrpcEndpoint {
+    /// `host:port`, or `unix://<path>` for a unix domain socket.
+    pub endpoint: String,
+    /// Serve OTLP/gRPC over TLS with this certificate.
+    #[serde(default)]
+    pub tls: Option<TlsSettings>,
+}
+
+impl GrpcEndpoint {
+    /// The socket path of a `unix://` endpoint, with placeholders expanded like exporter paths.
+    pub fn unix_socket(&self) -> Result<Option<PathBuf>, ConfigError> {
+        self.endpoint
+            .strip_prefix(UNIX_SCHEME)
+            .map(resolve_path)
+            .transpose()
+    }
+}
+
+/// Prefix of endpoints that are unix domain sockets.
+pub const UNIX_SCHEME: &str = "unix://";
+
+/// PEM files of a TLS server certificate; paths take the same placeholders as exporter paths.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct TlsSettings {
+    pub cert_file: String,
+    pub key_file: String,
+}
+
 #[derive(Debug, Deserialize, PartialEq)]
 pub struct Endpoint {
     pub endpoint: String,
@@ -138,6 +200,9 @@ pub struct Endpoint {
 #[derive(Debug, Deserialize, PartialEq)]
 pub struct Processors {
     pub batch: BatchProcessor,
+    /// Refuse exports while the collector's memory is over a limit.
+    #[serde(default)]
+    pub memory_limiter: Option<crate::processor::memory_limiter::MemoryLimiterConfig>,
 }
 
 #[derive(Debug, Deserialize, PartialEq)]
@@ -156,6 +221,12 @@ pub struct FileExporter {
 #[derive(Debug, Deserialize, PartialEq)]
 pub struct Extensions {
     pub health_check: Endpoint,
+    /// Serve collector internals for debugging.
+    #[serde(default)]
+    pub zpages: Option<crate::extension::zpages::ZpagesConfig>,
+    /// Require a bearer token on exports.
+    #[serde(default)]
+    pub bearertokenauth: Option<crate::extension::bearer_auth::BearerTokenAuthConfig>,
 }
 
 #[derive(Debug, Deserialize, PartialEq)]
@@ -188,11 +259,49 @@ fn home_dir() -> Result<PathBuf, ConfigError> {
     dirs::home_dir().ok_or(ConfigError::NoHome)
 }
 
-/// Returns the data directory path: ~/.lotel/data/
+/// Returns the data directory path: ~/.lotel/data/, or `LOTEL_DATA_DIR` when set.
 pub fn data_path() -> Result<PathBuf, ConfigError> {
+    if let Some(dir) = std::env::var_os(lotel_storage::DATA_DIR_ENV).filter(|d| !d.is_empty()) {
+        return Ok(PathBuf::from(dir));
+    }
     Ok(home_dir()?.join(LOTEL_DIR).join("data"))
 }
 
+/// Expand the placeholders a config path may contain: `${DATA_DIR}` (the data directory,
+/// see [`data_path`]) anywhere, and `~/` at the start. This is the only substitution config
+/// values get.
+pub fn resolve_path(path: &str) -> Result<PathBuf, ConfigError> {
+    let path = if path.contains("${DATA_DIR}") {
+        path.replace("${DATA_DIR}", &data_path()?.display().to_string())
+    } else {
+        path.to_string()
+    };
+    Ok(match path.strip_prefix("~/") {
+        Some(stripped) => home_dir()?.join(stripped),
+        None => PathBuf::from(path),
+    })
+}
+
+/// `endpoint` (`host:port`) with its port replaced.
+pub fn with_port(endpoint: &str, port: u16) -> String {
+    match endpoint.rsplit_once(':') {
+        Some((host, _)) => format!("{host}:{port}"),
+        None => format!("{endpoint}:{port}"),
+    }
+}
+
+/// Split a `KEY=VALUE` environment entry, from `lotel start --env` or the `environment`
+/// list. The value may be empty and may contain `=`.
+pub fn parse_env_var(entry: &str) -> Result<(String, String), String> {
+    let (key, value) = entry
+        .split_once('=')
+        .ok_or_else(|| format!("invalid environment entry {entry:?} (expected KEY=VALUE)"))?;
+    if key.is_empty() || key.contains(char::is_whitespace) || entry.contains('\0') {
+        return Err(format!("invalid environment variable name in {entry:?}"));
+    }
+    Ok((key.to_string(), value.to_string()))
+}
+
 /// Resolve the config file path.
 ///
 /// 1. Check CWD for `lotel-collector.yaml`
@@ -245,29 +354,13 @@ pub fn load_config() -> Result<CollectorConfig, ConfigError> {
     parse_config(&content)
 }
 
-/// Parse a duration string supporting "Nh", "Nm", "Ns", "Nms".
+/// Parse a config duration such as "2m" or "500ms" (see [`lotel_storage::parse_duration`]),
+/// falling back to 2 minutes when it is invalid or negative.
 pub fn parse_duration(s: &str) -> std::time::Duration {
-    if let Some(ms) = s.strip_suffix("ms")
-        && let Ok(n) = ms.parse::<u64>()
-    {
-        return std::time::Duration::from_millis(n);
-    }
-    if let Some(hours) = s.strip_suffix('h')
-        && let Ok(n) = hours.parse::<f64>()
-    {
-        return std::time::Duration::from_secs_f64(n * 3600.0);
-    }
-    if let Some(mins) = s.strip_suffix('m')
-        && let Ok(n) = mins.parse::<f64>()
-    {
-        return std::time::Duration::from_secs_f64(n * 60.0);
-    }
-    if let Some(secs) = s.strip_suffix('s')
-        && let Ok(n) = secs.parse::<f64>()
-    {
-        return std::time::Duration::from_secs_f64(n);
-    }
-    std::time::Duration::from_secs(120) // Default 2 minutes.
+    lotel_storage::parse_duration(s)
+        .ok()
+        .and_then(|d| d.to_std().ok())
+        .unwrap_or(std::time::Duration::from_secs(120))
 }
 
 #[cfg(test)]
@@ -301,7 +394,12 @@ mod tests {
 
         assert_eq!(config.extensions.health_check.endpoint, "0.0.0.0:13133");
 
-        assert_eq!(config.service.extensions, vec!["health_check"]);
+        assert_eq!(
+            config.extensions.zpages.as_ref().unwrap().endpoint,
+            "localhost:55679"
+        );
+
+        assert_eq!(config.service.extensions, vec!["health_check", "zpages"]);
         assert_eq!(config.service.pipelines.len(), 3);
 
         let traces_pipeline = config.service.pipelines.get("traces").unwrap();
@@ -348,6 +446,42 @@ service:
         assert!(config.ingestion.is_none());
     }
 
+    #[test]
+    fn parse_ingestion_alerts() {
+        let yaml = DEFAULT_CONFIG.replace(
+            "  enabled: true\n",
+            "  enabled: true\n  alerts:\n    webhook: http://localhost:9000/hook\n    rules:\n      - name: checkout errors\n        service: checkout\n        max_error_rate: 5%\n",
+        );
+        let config = parse_config(&yaml).expect("should parse alert rules");
+        let alerts = config.ingestion.unwrap().alerts.unwrap();
+        assert_eq!(alerts.webhook, "http://localhost:9000/hook");
+        assert_eq!(alerts.rules[0].service.as_deref(), Some("checkout"));
+        assert_eq!(alerts.rules[0].max_error_rate.as_deref(), Some("5%"));
+        assert_eq!(alerts.rules[0].window, "5m");
+    }
+
+    #[test]
+    fn parse_storage_backend() {
+        let config = parse_config(DEFAULT_CONFIG).unwrap();
+        assert_eq!(config.storage.backend, lotel_storage::BackendKind::Duckdb);
+        let yaml = format!("{DEFAULT_CONFIG}storage:\n  backend: sqlite\n");
+        let config = parse_config(&yaml).expect("should parse storage section");
+        assert_eq!(config.storage.backend, lotel_storage::BackendKind::Sqlite);
+    }
+
+    #[test]
+    fn parse_ingestion_scrub_rules() {
+        let yaml = DEFAULT_CONFIG.replace(
+            "  enabled: true\n",
+            "  enabled: true\n  scrub:\n    drop_keys: [http.request.header.authorization]\n    hash_keys: [user.id]\n    redact_patterns: ['\\S+@\\S+']\n",
+        );
+        let config = parse_config(&yaml).expect("should parse scrub rules");
+        let scrub = config.ingestion.unwrap().scrub.unwrap();
+        assert_eq!(scrub.drop_keys, vec!["http.request.header.authorization"]);
+        assert_eq!(scrub.hash_keys, vec!["user.id"]);
+        assert_eq!(scrub.redact_patterns, vec![r"\S+@\S+"]);
+    }
+
     #[test]
     fn parse_duration_minutes() {
         assert_eq!(parse_duration("2m"), std::time::Duration::from_secs(120));
@@ -380,6 +514,46 @@ service:
         );
     }
 
+    #[test]
+    fn resolves_path_placeholders() {
+        let data = data_path().unwrap();
+        assert_eq!(
+            resolve_path("${DATA_DIR}/traces/traces.jsonl").unwrap(),
+            data.join("traces/traces.jsonl")
+        );
+        assert_eq!(
+            resolve_path("~/.lotel/data/logs/logs.jsonl").unwrap(),
+            data.join("logs/logs.jsonl")
+        );
+        assert_eq!(
+            resolve_path("/var/otel/metrics.jsonl").unwrap(),
+            PathBuf::from("/var/otel/metrics.jsonl")
+        );
+    }
+
+    #[test]
+    fn replaces_endpoint_ports() {
+        assert_eq!(with_port("0.0.0.0:4318", 4320), "0.0.0.0:4320");
+        assert_eq!(with_port("[::1]:4317", 4321), "[::1]:4321");
+        assert_eq!(with_port("localhost", 13134), "localhost:13134");
+    }
+
+    #[test]
+    fn parses_env_entries() {
+        assert_eq!(
+            parse_env_var("LOTEL_LOG=debug").unwrap(),
+            ("LOTEL_LOG".to_string(), "debug".to_string())
+        );
+        assert_eq!(
+            parse_env_var("TOKEN=a=b").unwrap(),
+            ("TOKEN".to_string(), "a=b".to_string())
+        );
+        assert_eq!(parse_env_var("EMPTY=").unwrap().1, "");
+        for bad in ["NOVALUE", "=value", "MY VAR=1"] {
+            assert!(parse_env_var(bad).is_err(), "{bad}");
+        }
+    }
+
     #[test]
     fn data_path_is_under_home() {
         let path = data_path().expect("data_path should succeed");
@@ -0,0 +1,207 @@
+//! Five-field cron expressions (`minute hour day-of-month month day-of-week`) for scheduled
+//! retention. Fields take `*`, numbers, ranges (`1-5`), steps (`*/15`, `0-30/10`), and
+//! comma-separated lists; `@hourly`, `@daily`, `@weekly`, and `@monthly` are shorthands.
+
+use chrono::{Datelike, Duration, NaiveDateTime, Timelike};
+
+/// A parsed cron expression.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct CronSchedule {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    /// Cron matches either day field when both are restricted, and both otherwise.
+    days_restricted: bool,
+    weekdays_restricted: bool,
+}
+
+impl CronSchedule {
+    pub fn parse(expr: &str) -> Result<Self, String> {
+        let expanded = match expr.trim() {
+            "@hourly" => "0 * * * *",
+            "@daily" | "@midnight" => "0 0 * * *",
+            "@weekly" => "0 0 * * 0",
+            "@monthly" => "0 0 1 * *",
+            other => other,
+        };
+        let fields: Vec<&str> = expanded.split_whitespace().collect();
+        let [minute, hour, day, month, weekday] = fields[..] else {
+            return Err(format!(
+                "invalid cron expression {expr:?}: expected 5 fields (minute hour day month weekday)"
+            ));
+        };
+        let field = |text: &str, name: &str, min: u32, max: u32| {
+            parse_field(text, min, max)
+                .map_err(|e| format!("invalid cron expression {expr:?}: {name} field: {e}"))
+        };
+        let mut weekdays = field(weekday, "weekday", 0, 7)?;
+        // 7 is Sunday too.
+        if weekdays & (1 << 7) != 0 {
+            weekdays |= 1;
+        }
+        Ok(Self {
+            minutes: field(minute, "minute", 0, 59)?,
+            hours: field(hour, "hour", 0, 23)?,
+            days: field(day, "day", 1, 31)?,
+            months: field(month, "month", 1, 12)?,
+            weekdays,
+            days_restricted: day != "*",
+            weekdays_restricted: weekday != "*",
+        })
+    }
+
+    /// The first matching minute strictly after `after`, or `None` if nothing matches within
+    /// five years (e.g. February 30th).
+    pub fn next_after(&self, after: NaiveDateTime) -> Option<NaiveDateTime> {
+        let mut t = after.with_second(0)?.with_nanosecond(0)? + Duration::minutes(1);
+        let limit = after + Duration::days(5 * 366);
+        while t <= limit {
+            if !self.matches_day(t) {
+                t = t.date().succ_opt()?.and_hms_opt(0, 0, 0)?;
+            } else if !bit(self.hours, t.hour()) {
+                t = t.with_minute(0)? + Duration::hours(1);
+            } else if !bit(self.minutes, t.minute()) {
+                t += Duration::minutes(1);
+            } else {
+                return Some(t);
+            }
+        }
+        None
+    }
+
+    fn matches_day(&self, t: NaiveDateTime) -> bool {
+        if !bit(self.months, t.month()) {
+            return false;
+        }
+        let day = bit(self.days, t.day());
+        let weekday = bit(self.weekdays, t.weekday().num_days_from_sunday());
+        if self.days_restricted && self.weekdays_restricted {
+            day || weekday
+        } else {
+            day && weekday
+        }
+    }
+}
+
+fn bit(set: u64, n: u32) -> bool {
+    set & (1 << n) != 0
+}
+
+/// The set of values a field matches, as a bitmask.
+fn parse_field(text: &str, min: u32, max: u32) -> Result<u64, String> {
+    let mut set = 0;
+    for part in text.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => {
+                let step: u32 = step
+                    .parse()
+                    .ok()
+                    .filter(|&s| s > 0)
+                    .ok_or_else(|| format!("invalid step {step:?}"))?;
+                (range, step)
+            }
+            None => (part, 1),
+        };
+        let value = |s: &str| -> Result<u32, String> {
+            s.parse()
+                .ok()
+                .filter(|v| (min..=max).contains(v))
+                .ok_or_else(|| format!("{s:?} is not a number from {min} to {max}"))
+        };
+        let (start, end) = match range.split_once('-') {
+            _ if range == "*" => (min, max),
+            Some((a, b)) => (value(a)?, value(b)?),
+            // `5/15` runs from 5 to the end of the range.
+            None if step > 1 => (value(range)?, max),
+            None => (value(range)?, value(range)?),
+        };
+        if start > end {
+            return Err(format!("range {range:?} is backwards"));
+        }
+        for v in (start..=end).step_by(step as usize) {
+            set |= 1 << v;
+        }
+    }
+    Ok(set)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn at(s: &str) -> NaiveDateTime {
+        NaiveDateTime::parse_from_str(s, "%Y-%m-%d %H:%M").unwrap()
+    }
+
+    fn next(expr: &str, after: &str) -> NaiveDateTime {
+        CronSchedule::parse(expr)
+            .unwrap()
+            .next_after(at(after))
+            .unwrap()
+    }
+
+    #[test]
+    fn finds_next_fire_time() {
+        assert_eq!(
+            next("0 3 * * *", "2024-03-10 02:59"),
+            at("2024-03-10 03:00")
+        );
+        assert_eq!(
+            next("0 3 * * *", "2024-03-10 03:00"),
+            at("2024-03-11 03:00")
+        );
+        assert_eq!(
+            next("*/15 * * * *", "2024-03-10 10:46"),
+            at("2024-03-10 11:00")
+        );
+        assert_eq!(
+            next("30 1 1 * *", "2024-12-05 00:00"),
+            at("2025-01-01 01:30")
+        );
+        assert_eq!(next("@hourly", "2024-03-10 10:00"), at("2024-03-10 11:00"));
+        // 2024-03-10 is a Sunday.
+        assert_eq!(
+            next("0 0 * * 1-5", "2024-03-09 12:00"),
+            at("2024-03-11 00:00")
+        );
+        assert_eq!(
+            next("0 0 * * 7", "2024-03-04 00:00"),
+            at("2024-03-10 00:00")
+        );
+    }
+
+    #[test]
+    fn restricted_day_fields_match_either() {
+        // The 15th, or any Monday.
+        assert_eq!(
+            next("0 0 15 * 1", "2024-03-12 00:00"),
+            at("2024-03-15 00:00")
+        );
+        assert_eq!(
+            next("0 0 15 * 1", "2024-03-15 00:00"),
+            at("2024-03-18 00:00")
+        );
+    }
+
+    #[test]
+    fn never_matching_schedule_has_no_next() {
+        let schedule = CronSchedule::parse("0 0 30 2 *").unwrap();
+        assert_eq!(schedule.next_after(at("2024-01-01 00:00")), None);
+    }
+
+    #[test]
+    fn rejects_invalid_expressions() {
+        for expr in [
+            "0 3 * *",
+            "60 * * * *",
+            "0 24 * * *",
+            "*/0 * * * *",
+            "5-1 * * * *",
+            "x * * * *",
+        ] {
+            assert!(CronSchedule::parse(expr).is_err(), "{expr}");
+        }
+    }
+}
@@ -0,0 +1,67 @@
+//! Bearer token authentication: with the `extensions.bearertokenauth` section, both OTLP
+//! receivers refuse exports that do not carry `Authorization: Bearer <token>` (gRPC
+//! `UNAUTHENTICATED`, HTTP 401), so only apps given the token can push telemetry.
+
+use std::sync::Arc;
+
+use serde::Deserialize;
+
+/// The `extensions.bearertokenauth` config section.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct BearerTokenAuthConfig {
+    pub token: String,
+}
+
+/// Shared by the receivers; lets everything through unless it has a token.
+#[derive(Debug, Clone, Default)]
+pub struct BearerAuth {
+    token: Option<Arc<str>>,
+}
+
+impl BearerAuth {
+    pub fn new(token: &str) -> Self {
+        Self {
+            token: Some(token.into()),
+        }
+    }
+
+    /// Whether a request with this `Authorization` header value may export.
+    pub fn allows(&self, authorization: Option<&str>) -> bool {
+        let Some(token) = &self.token else {
+            return true;
+        };
+        let Some((scheme, given)) = authorization.and_then(|value| value.split_once(' ')) else {
+            return false;
+        };
+        // Compare every byte, so the time taken does not tell how much of a guess matched.
+        scheme.eq_ignore_ascii_case("bearer")
+            && given.len() == token.len()
+            && given
+                .bytes()
+                .zip(token.bytes())
+                .fold(0, |diff, (a, b)| diff | (a ^ b))
+                == 0
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn checks_the_bearer_token() {
+        let auth = BearerAuth::new("s3cret");
+        assert!(auth.allows(Some("Bearer s3cret")));
+        assert!(auth.allows(Some("bearer s3cret")));
+        for header in [
+            None,
+            Some("Bearer s3cre"),
+            Some("Basic s3cret"),
+            Some("s3cret"),
+        ] {
+            assert!(!auth.allows(header), "{header:?}");
+        }
+        assert!(BearerAuth::default().allows(None));
+    }
+}
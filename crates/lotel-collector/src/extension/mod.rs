@@ -1 +1,3 @@
+pub mod bearer_auth;
 pub mod health;
+pub mod zpages;
@@ -0,0 +1,300 @@
+//! zPages: live collector internals over HTTP for debugging pipeline stalls.
+//!
+//! - `/debug/servicez`: uptime, endpoints, memory use, and whether the memory limiter refuses
+//! - `/debug/pipelinez`: exports accepted and refused per receiver, and how full the queues
+//!   between receivers, batch processor, and exporter are
+//! - `/debug/pprof/threads?seconds=N`: CPU time each collector thread used over N seconds
+//!   (Linux only), the closest a native binary gets to a Go CPU profile
+
+use std::collections::HashMap;
+use std::net::SocketAddr;
+use std::sync::Arc;
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::{Duration, Instant};
+
+use axum::extract::{Query, State};
+use axum::http::StatusCode;
+use axum::routing::get;
+use axum::{Json, Router};
+use serde::{Deserialize, Serialize};
+use tokio::sync::mpsc;
+use tokio_util::sync::CancellationToken;
+
+use crate::pipeline::SignalData;
+use crate::processor::memory_limiter::{self, MemoryGate};
+
+/// The `extensions.zpages` config section.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct ZpagesConfig {
+    pub endpoint: String,
+}
+
+/// Exports a receiver let through or turned away; shared with the receiver.
+#[derive(Debug, Clone, Default)]
+pub struct ReceiverStats {
+    accepted: Arc<AtomicU64>,
+    refused: Arc<AtomicU64>,
+}
+
+impl ReceiverStats {
+    pub fn record(&self, accepted: bool) {
+        let counter = if accepted {
+            &self.accepted
+        } else {
+            &self.refused
+        };
+        counter.fetch_add(1, Ordering::Relaxed);
+    }
+}
+
+/// What the pages report on.
+pub struct ZpagesExtension {
+    pub endpoint: SocketAddr,
+    /// Endpoints to show on servicez, by name.
+    pub endpoints: Vec<(&'static str, String)>,
+    pub gate: MemoryGate,
+    pub grpc: ReceiverStats,
+    pub http: ReceiverStats,
+    /// The receiver → processor and processor → exporter queues; weak, so the pages never
+    /// keep a queue open during shutdown.
+    pub queues: Vec<(&'static str, mpsc::WeakSender<SignalData>)>,
+}
+
+struct Pages {
+    started: Instant,
+    extension: ZpagesExtension,
+}
+
+impl ZpagesExtension {
+    pub async fn run(
+        self,
+        cancel: CancellationToken,
+    ) -> Result<(), Box<dyn std::error::Error + Send + Sync>> {
+        let pages = Arc::new(Pages {
+            started: Instant::now(),
+            extension: self,
+        });
+        let endpoint = pages.extension.endpoint;
+        let app = Router::new()
+            .route("/debug/servicez", get(servicez))
+            .route("/debug/pipelinez", get(pipelinez))
+            .route("/debug/pprof/threads", get(threads))
+            .with_state(pages);
+
+        let listener = tokio::net::TcpListener::bind(endpoint).await?;
+        axum::serve(listener, app)
+            .with_graceful_shutdown(cancel.cancelled_owned())
+            .await?;
+
+        Ok(())
+    }
+}
+
+#[derive(Serialize)]
+struct Servicez {
+    uptime_secs: f64,
+    version: &'static str,
+    endpoints: HashMap<&'static str, String>,
+    memory_mib: Option<u64>,
+    refusing_exports: bool,
+}
+
+async fn servicez(State(pages): State<Arc<Pages>>) -> Json<Servicez> {
+    let extension = &pages.extension;
+    Json(Servicez {
+        uptime_secs: pages.started.elapsed().as_secs_f64(),
+        version: env!("CARGO_PKG_VERSION"),
+        endpoints: extension.endpoints.iter().cloned().collect(),
+        memory_mib: memory_limiter::resident_bytes().map(|b| b / (1024 * 1024)),
+        refusing_exports: extension.gate.is_refusing(),
+    })
+}
+
+#[derive(Serialize)]
+struct Pipelinez {
+    receivers: HashMap<&'static str, ReceiverCounts>,
+    queues: HashMap<&'static str, QueueDepth>,
+}
+
+#[derive(Serialize)]
+struct ReceiverCounts {
+    accepted: u64,
+    refused: u64,
+}
+
+/// A queue that stays full means the stage reading it is stalled.
+#[derive(Serialize)]
+struct QueueDepth {
+    queued: usize,
+    capacity: usize,
+}
+
+async fn pipelinez(State(pages): State<Arc<Pages>>) -> Json<Pipelinez> {
+    let extension = &pages.extension;
+    let counts = |stats: &ReceiverStats| ReceiverCounts {
+        accepted: stats.accepted.load(Ordering::Relaxed),
+        refused: stats.refused.load(Ordering::Relaxed),
+    };
+    Json(Pipelinez {
+        receivers: HashMap::from([
+            ("otlp/grpc", counts(&extension.grpc)),
+            ("otlp/http", counts(&extension.http)),
+        ]),
+        queues: extension
+            .queues
+            .iter()
+            .filter_map(|(name, queue)| {
+                let queue = queue.upgrade()?;
+                Some((
+                    *name,
+                    QueueDepth {
+                        queued: queue.max_capacity() - queue.capacity(),
+                        capacity: queue.max_capacity(),
+                    },
+                ))
+            })
+            .collect(),
+    })
+}
+
+#[derive(Deserialize)]
+struct ProfileParams {
+    #[serde(default = "default_profile_seconds")]
+    seconds: u64,
+}
+
+fn default_profile_seconds() -> u64 {
+    5
+}
+
+#[derive(Debug, Serialize, PartialEq)]
+struct ThreadProfile {
+    seconds: u64,
+    /// Busiest first.
+    threads: Vec<ThreadCpu>,
+}
+
+#[derive(Debug, Serialize, PartialEq)]
+struct ThreadCpu {
+    name: String,
+    tid: u32,
+    /// Share of one core over the profile, in percent.
+    cpu_percent: f64,
+}
+
+async fn threads(
+    Query(params): Query<ProfileParams>,
+) -> Result<Json<ThreadProfile>, (StatusCode, String)> {
+    if !(1..=300).contains(&params.seconds) {
+        return Err((
+            StatusCode::BAD_REQUEST,
+            "seconds must be from 1 to 300".to_string(),
+        ));
+    }
+    let unsupported = || {
+        (
+            StatusCode::NOT_IMPLEMENTED,
+            "thread profiles need /proc (Linux)".to_string(),
+        )
+    };
+    let before = thread_times().ok_or_else(unsupported)?;
+    tokio::time::sleep(Duration::from_secs(params.seconds)).await;
+    let after = thread_times().ok_or_else(unsupported)?;
+    Ok(Json(profile(&before, &after, params.seconds)))
+}
+
+/// Clock ticks per second of `/proc` CPU times (`USER_HZ`, 100 on every Linux target).
+const TICKS_PER_SEC: f64 = 100.0;
+
+/// CPU time used by each thread of this process so far, in clock ticks, by thread ID.
+fn thread_times() -> Option<HashMap<u32, (String, u64)>> {
+    let mut times = HashMap::new();
+    for entry in std::fs::read_dir("/proc/self/task").ok()? {
+        let entry = entry.ok()?;
+        let Ok(tid) = entry.file_name().to_string_lossy().parse::<u32>() else {
+            continue;
+        };
+        // The thread may have exited since the listing.
+        let Ok(stat) = std::fs::read_to_string(entry.path().join("stat")) else {
+            continue;
+        };
+        if let Some(parsed) = parse_thread_stat(&stat) {
+            times.insert(tid, parsed);
+        }
+    }
+    Some(times)
+}
+
+/// The name and user + system CPU ticks of a `/proc/<pid>/task/<tid>/stat` line.
+fn parse_thread_stat(stat: &str) -> Option<(String, u64)> {
+    // The name is in parentheses and may itself contain spaces or parentheses.
+    let open = stat.find('(')?;
+    let close = stat.rfind(')')?;
+    let name = stat[open + 1..close].to_string();
+    let fields: Vec<&str> = stat[close + 1..].split_whitespace().collect();
+    // After the name: state is field 3, utime field 14, stime field 15.
+    let utime: u64 = fields.get(11)?.parse().ok()?;
+    let stime: u64 = fields.get(12)?.parse().ok()?;
+    Some((name, utime + stime))
+}
+
+fn profile(
+    before: &HashMap<u32, (String, u64)>,
+    after: &HashMap<u32, (String, u64)>,
+    seconds: u64,
+) -> ThreadProfile {
+    let mut threads: Vec<ThreadCpu> = after
+        .iter()
+        .map(|(&tid, (name, ticks))| {
+            let start = before.get(&tid).map_or(0, |(_, t)| *t);
+            let used = ticks.saturating_sub(start) as f64 / TICKS_PER_SEC;
+            ThreadCpu {
+                name: name.clone(),
+                tid,
+                cpu_percent: (used / seconds as f64 * 1000.0).round() / 10.0,
+            }
+        })
+        .collect();
+    threads.sort_by(|a, b| {
+        b.cpu_percent
+            .total_cmp(&a.cpu_percent)
+            .then(a.tid.cmp(&b.tid))
+    });
+    ThreadProfile { seconds, threads }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_thread_stat() {
+        let stat = "4242 (tokio-rt (1)) S 1 4242 4242 0 -1 4194368 120 0 0 0 250 50 0 0 20 0";
+        assert_eq!(
+            parse_thread_stat(stat),
+            Some(("tokio-rt (1)".to_string(), 300))
+        );
+        assert_eq!(parse_thread_stat("4242 (short) S 1"), None);
+    }
+
+    #[test]
+    fn profiles_cpu_per_thread() {
+        let before = HashMap::from([
+            (1, ("main".to_string(), 100)),
+            (2, ("worker".to_string(), 10)),
+        ]);
+        let after = HashMap::from([
+            (1, ("main".to_string(), 110)),
+            (2, ("worker".to_string(), 210)),
+            (3, ("blocking".to_string(), 50)),
+        ]);
+        let profile = profile(&before, &after, 2);
+        let cpu: Vec<_> = profile
+            .threads
+            .iter()
+            .map(|t| (t.name.as_str(), t.cpu_percent))
+            .collect();
+        assert_eq!(cpu, [("worker", 100.0), ("blocking", 25.0), ("main", 5.0)]);
+    }
+}
@@ -1,75 +1,93 @@
 //! Periodic ingestion task that runs alongside the collector pipeline.
 //!
-//! Spawns a dedicated OS thread for DuckDB work (Connection is !Send),
+//! Spawns a dedicated OS thread for database work (connections are !Send),
 //! and an async ticker that sends signals to the thread on each interval.
+//! Shutdown and the pass timeout interrupt a pass in flight through a
+//! [`lotel_storage::Cancel`].
 
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
 use std::time::Duration;
 
 use tokio_util::sync::CancellationToken;
 
+use crate::alerting::Alerter;
+
+/// When ingestion passes run, and how long one may take.
+pub struct Schedule {
+    pub interval: Duration,
+    pub timeout: Option<Duration>,
+}
+
 /// Run the periodic ingestion task.
 ///
-/// Opens a DuckDB connection and incrementally ingests new JSONL data
-/// on the configured interval. Errors are logged but never crash the collector.
+/// Opens the configured storage backend and incrementally ingests new JSONL data
+/// on the configured interval, then checks alert rules (if any) against it.
+/// Errors are logged but never crash the collector.
 pub async fn run_ingestion_task(
-    interval: Duration,
+    schedule: Schedule,
     data_path: PathBuf,
+    storage: lotel_storage::StorageConfig,
     db_path: PathBuf,
+    mut ingester: lotel_storage::IncrementalIngester,
+    mut alerter: Option<Alerter>,
     cancel: CancellationToken,
 ) {
     let (tx, rx) = std::sync::mpsc::channel::<()>();
+    let stop = lotel_storage::Cancel::new();
+    let thread_stop = stop.clone();
+    let timeout = schedule.timeout;
 
-    // Spawn a dedicated OS thread for blocking DuckDB work.
+    // Spawn a dedicated OS thread for blocking database work.
     let thread_handle = std::thread::spawn(move || {
-        let conn = match lotel_storage::open_db(&db_path) {
-            Ok(c) => c,
-            Err(e) => {
-                tracing::error!("Failed to open DuckDB for ingestion: {e}");
-                return;
+        let mut pass = |kind: &str| {
+            let pass_cancel = thread_stop.child();
+            let _deadline = timeout.map(|t| pass_cancel.deadline(t));
+            match ingest_once(
+                &mut ingester,
+                alerter.as_mut(),
+                &storage,
+                &db_path,
+                &data_path,
+                &pass_cancel,
+            ) {
+                Ok(report) if report.total() > 0 => {
+                    tracing::info!("{kind} ingestion: {report}");
+                }
+                Ok(_) => {}
+                Err(_) if thread_stop.is_cancelled() => {
+                    tracing::info!("{kind} ingestion interrupted by shutdown");
+                }
+                Err(e) if pass_cancel.is_cancelled() => {
+                    tracing::warn!(
+                        "{kind} ingestion timed out after {timeout:?}; the next pass resumes \
+                         from the last commit: {e}"
+                    );
+                }
+                Err(e) => {
+                    tracing::error!("{kind} ingestion failed: {e:#}");
+                }
             }
         };
-        let mut ingester = lotel_storage::IncrementalIngester::new();
-
-        // Load persisted cursors so we resume from last position after restart.
-        if let Err(e) = ingester.load_cursors(&conn) {
-            tracing::warn!("Failed to load ingestion cursors: {e}; starting from offset 0");
-        }
 
         // Ingest new data from last cursor position (or offset 0 if no cursor).
-        match ingester.ingest_new(&conn, &data_path) {
-            Ok(report) if report.total() > 0 => {
-                tracing::info!("Initial ingestion: {report}");
-            }
-            Ok(_) => {}
-            Err(e) => {
-                tracing::error!("Initial ingestion failed: {e}");
-            }
-        }
+        pass("Initial");
 
         // Wait for ticks from the async side.
         while rx.recv().is_ok() {
-            match ingester.ingest_new(&conn, &data_path) {
-                Ok(report) if report.total() > 0 => {
-                    tracing::info!("Periodic ingestion: {report}");
-                }
-                Ok(_) => {}
-                Err(e) => {
-                    tracing::error!("Periodic ingestion failed: {e}");
-                }
-            }
+            pass("Periodic");
         }
 
         tracing::info!("Ingestion thread exiting");
     });
 
     // Async ticker that sends signals to the blocking thread.
-    let mut ticker = tokio::time::interval(interval);
+    let mut ticker = tokio::time::interval(schedule.interval);
     ticker.tick().await; // Consume the immediate first tick.
 
     loop {
         tokio::select! {
             _ = cancel.cancelled() => {
+                stop.cancel();
                 drop(tx);
                 break;
             }
@@ -87,3 +105,38 @@ pub async fn run_ingestion_task(
         tracing::error!("Ingestion thread panicked: {e:?}");
     }
 }
+
+/// Run one ingest pass. The database is opened only for the duration of the pass so
+/// read-only query commands can open it between ticks.
+fn ingest_once(
+    ingester: &mut lotel_storage::IncrementalIngester,
+    alerter: Option<&mut Alerter>,
+    storage: &lotel_storage::StorageConfig,
+    db_path: &Path,
+    data_path: &Path,
+    cancel: &lotel_storage::Cancel,
+) -> Result<lotel_storage::IngestReport, Box<dyn std::error::Error + Send + Sync>> {
+    // A manual `lotel ingest` may hold the lock; skip this tick rather than block.
+    let _lock = match lotel_storage::IngestLock::try_acquire(db_path) {
+        Ok(lock) => lock,
+        Err(e) => {
+            tracing::debug!("Skipping ingestion: {e}");
+            return Ok(lotel_storage::IngestReport::default());
+        }
+    };
+    let data_dir = db_path.parent().unwrap_or(data_path);
+    let store = lotel_storage::Store::open(storage, data_dir, false)?.with_cancel(cancel);
+    *ingester = std::mem::take(ingester).with_cancel(cancel.clone());
+    // Reload persisted cursors: a manual ingest may have advanced them since the last tick.
+    store.backend().load_cursors(ingester)?;
+    let report = store.backend().ingest_new(ingester, data_path)?;
+    // The pipeline only builds an alerter for backends that query through DuckDB.
+    if let Some(alerter) = alerter
+        && let Some(conn) = store.backend().duckdb()
+        && let Err(e) = alerter.check(conn)
+    {
+        tracing::error!("Alert evaluation failed: {e}");
+    }
+    store.close()?;
+    Ok(report)
+}
@@ -1,6 +1,8 @@
 //! lotel-collector: OTLP collector for receiving and forwarding telemetry data.
 
+pub mod alerting;
 pub mod config;
+pub mod cron;
 pub mod exporter;
 pub mod extension;
 pub mod ingestion;
@@ -8,6 +10,7 @@ pub mod model;
 pub mod pipeline;
 pub mod processor;
 pub mod receiver;
+pub mod retention;
 
 #[cfg(test)]
 mod proto_check;
@@ -61,6 +64,77 @@ impl Collector {
         Ok(Self { config })
     }
 
+    /// Apply `lotel start --memory/--cpus`: the memory limiter refuses exports over
+    /// `memory_mib`, and DuckDB gets half of it and `cpus` threads unless `storage` sets them.
+    pub fn with_resource_limits(mut self, memory_mib: Option<u64>, cpus: Option<usize>) -> Self {
+        let storage = &mut self.config.storage;
+        if let Some(mib) = memory_mib {
+            self.config.processors.memory_limiter =
+                Some(processor::memory_limiter::MemoryLimiterConfig {
+                    limit_mib: mib,
+                    check_interval: "1s".to_string(),
+                });
+            storage
+                .memory_limit
+                .get_or_insert_with(|| format!("{}MiB", (mib / 2).max(1)));
+        }
+        if let Some(cpus) = cpus {
+            storage.threads.get_or_insert(cpus);
+        }
+        self
+    }
+
+    /// Apply `lotel start --otlp-grpc-port/--otlp-http-port/--health-port/--zpages-port`,
+    /// keeping each endpoint's host.
+    pub fn with_ports(
+        mut self,
+        grpc: Option<u16>,
+        http: Option<u16>,
+        health: Option<u16>,
+        zpages: Option<u16>,
+    ) -> Self {
+        let protocols = &mut self.config.receivers.otlp.protocols;
+        for (endpoint, port) in [
+            (&mut protocols.grpc.endpoint, grpc),
+            (&mut protocols.http.endpoint, http),
+            (&mut self.config.extensions.health_check.endpoint, health),
+        ] {
+            if let Some(port) = port {
+                *endpoint = config::with_port(endpoint, port);
+            }
+        }
+        if let (Some(zpages), Some(port)) = (&mut self.config.extensions.zpages, zpages) {
+            zpages.endpoint = config::with_port(&zpages.endpoint, port);
+        }
+        self
+    }
+
+    /// Apply `lotel start --unix-socket`: OTLP/gRPC listens on the socket at `path` instead
+    /// of its port.
+    pub fn with_unix_socket(mut self, path: &Path) -> Self {
+        self.config.receivers.otlp.protocols.grpc.endpoint =
+            format!("{}{}", config::UNIX_SCHEME, path.display());
+        self
+    }
+
+    /// Apply `lotel start --tls`: serve OTLP/gRPC over TLS with this certificate and key.
+    pub fn with_tls(mut self, cert_file: &Path, key_file: &Path) -> Self {
+        self.config.receivers.otlp.protocols.grpc.tls = Some(config::TlsSettings {
+            cert_file: cert_file.display().to_string(),
+            key_file: key_file.display().to_string(),
+        });
+        self
+    }
+
+    /// Apply `lotel start --auth`: the receivers require this bearer token.
+    pub fn with_bearer_token(mut self, token: &str) -> Self {
+        self.config.extensions.bearertokenauth =
+            Some(extension::bearer_auth::BearerTokenAuthConfig {
+                token: token.to_string(),
+            });
+        self
+    }
+
     /// Start the collector pipeline.
     pub fn start(self) -> Result<CollectorHandle, Box<dyn std::error::Error>> {
         let health_endpoint = format!("http://{}", self.config.extensions.health_check.endpoint);
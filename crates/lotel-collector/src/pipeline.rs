@@ -1,7 +1,6 @@
 //! Collector pipeline types and orchestration.
 
 use std::net::SocketAddr;
-use std::path::PathBuf;
 use std::sync::Arc;
 use std::sync::atomic::{AtomicBool, Ordering};
 use std::time::Duration;
@@ -13,13 +12,18 @@ use tokio::sync::mpsc;
 use tokio::task::JoinHandle;
 use tokio_util::sync::CancellationToken;
 
-use crate::config::{CollectorConfig, parse_duration};
+use crate::alerting::Alerter;
+use crate::config::{CollectorConfig, parse_duration, resolve_path};
 use crate::exporter::file::FileExporter;
+use crate::extension::bearer_auth::BearerAuth;
 use crate::extension::health::HealthCheckExtension;
+use crate::extension::zpages::{ReceiverStats, ZpagesExtension};
 use crate::ingestion;
 use crate::processor::batch::BatchProcessor;
-use crate::receiver::grpc::OtlpGrpcReceiver;
+use crate::processor::memory_limiter::{MemoryGate, MemoryLimiter};
+use crate::receiver::grpc::{Listen, OtlpGrpcReceiver};
 use crate::receiver::http::OtlpHttpReceiver;
+use crate::retention;
 
 /// Data flowing through the collector pipeline.
 #[derive(Debug, Clone)]
@@ -54,7 +58,10 @@ impl Pipeline {
         let ready = Arc::new(AtomicBool::new(false));
 
         // Parse endpoints from config.
-        let grpc_addr: SocketAddr = config.receivers.otlp.protocols.grpc.endpoint.parse()?;
+        let grpc_listen = match config.receivers.otlp.protocols.grpc.unix_socket()? {
+            Some(path) => Listen::Unix(path),
+            None => Listen::Tcp(config.receivers.otlp.protocols.grpc.endpoint.parse()?),
+        };
         let http_addr: SocketAddr = config.receivers.otlp.protocols.http.endpoint.parse()?;
         let health_addr: SocketAddr = config.extensions.health_check.endpoint.parse()?;
 
@@ -63,31 +70,17 @@ impl Pipeline {
         let batch_size = config.processors.batch.send_batch_size;
         let batch_max = config.processors.batch.send_batch_max_size;
 
-        // Resolve exporter paths from config.
-        let home = dirs::home_dir().unwrap_or_else(|| PathBuf::from("."));
-        let resolve_path = |path: &str| -> PathBuf {
-            if let Some(stripped) = path.strip_prefix("~/") {
-                home.join(stripped)
-            } else {
-                PathBuf::from(path)
-            }
+        // Resolve exporter paths from config, defaulting to the data directory.
+        let exporter_path = |signal: &str| {
+            let path = match config.exporters.get(&format!("file/{signal}")) {
+                Some(exporter) => exporter.path.clone(),
+                None => format!("${{DATA_DIR}}/{signal}/{signal}.jsonl"),
+            };
+            resolve_path(&path)
         };
-
-        let traces_path = config
-            .exporters
-            .get("file/traces")
-            .map(|e| resolve_path(&e.path))
-            .unwrap_or_else(|| home.join(".lotel/data/traces/traces.jsonl"));
-        let metrics_path = config
-            .exporters
-            .get("file/metrics")
-            .map(|e| resolve_path(&e.path))
-            .unwrap_or_else(|| home.join(".lotel/data/metrics/metrics.jsonl"));
-        let logs_path = config
-            .exporters
-            .get("file/logs")
-            .map(|e| resolve_path(&e.path))
-            .unwrap_or_else(|| home.join(".lotel/data/logs/logs.jsonl"));
+        let traces_path = exporter_path("traces")?;
+        let metrics_path = exporter_path("metrics")?;
+        let logs_path = exporter_path("logs")?;
 
         // Derive data_path for ingestion before paths are moved into exporter.
         // traces_path is like ~/.lotel/data/traces/traces.jsonl → grandparent is data dir.
@@ -115,8 +108,45 @@ impl Pipeline {
             }
         }));
 
+        // Spawn memory limiter (if configured); receivers refuse exports while it is over.
+        let gate = MemoryGate::default();
+        if let Some(ref limiter_config) = config.processors.memory_limiter {
+            if limiter_config.limit_mib == 0 {
+                return Err("processors.memory_limiter.limit_mib must be at least 1".into());
+            }
+            let limiter = MemoryLimiter {
+                limit_bytes: limiter_config.limit_mib * 1024 * 1024,
+                check_interval: parse_batch_timeout(&limiter_config.check_interval),
+                gate: gate.clone(),
+            };
+            handles.push(tokio::spawn(limiter.run(cancel.clone())));
+        }
+
+        // Receivers require the bearer token, if one is configured.
+        let auth = match config.extensions.bearertokenauth {
+            Some(ref auth) if auth.token.is_empty() => {
+                return Err("extensions.bearertokenauth.token must not be empty".into());
+            }
+            Some(ref auth) => BearerAuth::new(&auth.token),
+            None => BearerAuth::default(),
+        };
+
         // Spawn gRPC receiver.
-        let grpc_receiver = OtlpGrpcReceiver::new(grpc_addr, recv_tx.clone());
+        let grpc_stats = ReceiverStats::default();
+        let mut grpc_receiver = OtlpGrpcReceiver::listening(grpc_listen, recv_tx.clone())
+            .with_memory_gate(gate.clone())
+            .with_auth(auth.clone())
+            .with_stats(grpc_stats.clone());
+        if let Some(ref tls) = config.receivers.otlp.protocols.grpc.tls {
+            let read = |path: &str| -> Result<Vec<u8>, Box<dyn std::error::Error>> {
+                let path = resolve_path(path)?;
+                std::fs::read(&path)
+                    .map_err(|e| format!("reading TLS file {}: {e}", path.display()).into())
+            };
+            let identity =
+                tonic::transport::Identity::from_pem(read(&tls.cert_file)?, read(&tls.key_file)?);
+            grpc_receiver = grpc_receiver.with_tls(identity);
+        }
         let grpc_cancel = cancel.clone();
         handles.push(tokio::spawn(async move {
             if let Err(e) = grpc_receiver.serve(grpc_cancel).await {
@@ -124,8 +154,41 @@ impl Pipeline {
             }
         }));
 
+        // Spawn zPages (if configured).
+        let http_stats = ReceiverStats::default();
+        if let Some(ref zpages) = config.extensions.zpages {
+            let protocols = &config.receivers.otlp.protocols;
+            let zpages_ext = ZpagesExtension {
+                endpoint: zpages.endpoint.parse()?,
+                endpoints: vec![
+                    ("otlp/grpc", protocols.grpc.endpoint.clone()),
+                    ("otlp/http", protocols.http.endpoint.clone()),
+                    (
+                        "health_check",
+                        config.extensions.health_check.endpoint.clone(),
+                    ),
+                ],
+                gate: gate.clone(),
+                grpc: grpc_stats,
+                http: http_stats.clone(),
+                queues: vec![
+                    ("receivers_to_batch", recv_tx.downgrade()),
+                    ("batch_to_exporter", proc_tx.downgrade()),
+                ],
+            };
+            let zpages_cancel = cancel.clone();
+            handles.push(tokio::spawn(async move {
+                if let Err(e) = zpages_ext.run(zpages_cancel).await {
+                    tracing::error!("zpages error: {e}");
+                }
+            }));
+        }
+
         // Spawn HTTP receiver.
-        let http_receiver = OtlpHttpReceiver::new(http_addr, recv_tx);
+        let http_receiver = OtlpHttpReceiver::new(http_addr, recv_tx)
+            .with_memory_gate(gate)
+            .with_auth(auth)
+            .with_stats(http_stats);
         let http_cancel = cancel.clone();
         handles.push(tokio::spawn(async move {
             if let Err(e) = http_receiver.serve(http_cancel).await {
@@ -159,17 +222,69 @@ impl Pipeline {
             }
         }));
 
+        // Spawn scheduled retention (if configured); it shares the ingest lock with ingestion.
+        if let Some(ref retention_config) = config.retention {
+            let policy = retention::RetentionPolicy::new(retention_config)?;
+            let storage = config.storage.clone();
+            lotel_storage::set_resource_limits(storage.resource_limits());
+            let db_path = ingest_data_path.join(storage.backend.file_name());
+            let retention_cancel = cancel.clone();
+            handles.push(tokio::spawn(retention::run_retention_task(
+                policy,
+                storage,
+                db_path,
+                retention_cancel,
+            )));
+        }
+
         // Spawn periodic ingestion task (if configured).
         if let Some(ref ingestion_config) = config.ingestion
             && ingestion_config.enabled
         {
-            let interval = parse_duration(&ingestion_config.interval);
-            let db_path = ingest_data_path.join("lotel.db");
+            let schedule = ingestion::Schedule {
+                interval: parse_duration(&ingestion_config.interval),
+                timeout: ingestion_config.timeout.as_deref().map(parse_duration),
+            };
+            let storage = config.storage.clone();
+            lotel_storage::set_resource_limits(storage.resource_limits());
+            let db_path = ingest_data_path.join(storage.backend.file_name());
+            let scrubber = match &ingestion_config.scrub {
+                Some(rules) => lotel_storage::Scrubber::new(rules)?,
+                None => lotel_storage::Scrubber::default(),
+            };
+            let sampler = match &ingestion_config.sample {
+                Some(rate) => lotel_storage::Sampler::parse(rate)?,
+                None => lotel_storage::Sampler::default(),
+            };
+            let batch_rows = ingestion_config
+                .batch_rows
+                .unwrap_or(lotel_storage::DEFAULT_BATCH_ROWS);
+            let read_json = ingestion_config.read_json;
+            if ingestion_config.alerts.is_some() && !storage.backend.uses_duckdb() {
+                return Err("ingestion.alerts needs the duckdb or parquet storage backend".into());
+            }
+            let alerter = ingestion_config
+                .alerts
+                .as_ref()
+                .map(Alerter::new)
+                .transpose()?;
 
             let ingest_cancel = cancel.clone();
             handles.push(tokio::spawn(async move {
-                ingestion::run_ingestion_task(interval, ingest_data_path, db_path, ingest_cancel)
-                    .await;
+                ingestion::run_ingestion_task(
+                    schedule,
+                    ingest_data_path,
+                    storage,
+                    db_path,
+                    lotel_storage::IncrementalIngester::new()
+                        .with_scrubber(scrubber)
+                        .with_sampler(sampler)
+                        .with_batch_rows(batch_rows)
+                        .with_read_json(read_json),
+                    alerter,
+                    ingest_cancel,
+                )
+                .await;
             }));
         }
 
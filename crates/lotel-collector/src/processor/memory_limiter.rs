@@ -0,0 +1,120 @@
+//! Memory limiter: samples the collector's resident memory and, while it is over the limit,
+//! makes the receivers refuse exports with a retryable error (gRPC `RESOURCE_EXHAUSTED`,
+//! HTTP 503) so SDKs back off instead of the collector growing without bound.
+
+use std::sync::Arc;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::Duration;
+
+use serde::Deserialize;
+use tokio_util::sync::CancellationToken;
+
+/// The `processors.memory_limiter` config section.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct MemoryLimiterConfig {
+    /// Resident memory, in MiB, above which exports are refused.
+    pub limit_mib: u64,
+    /// How often memory is sampled.
+    #[serde(default = "default_check_interval")]
+    pub check_interval: String,
+}
+
+fn default_check_interval() -> String {
+    "1s".to_string()
+}
+
+/// Shared between the limiter and the receivers; open unless memory is over the limit.
+#[derive(Debug, Clone, Default)]
+pub struct MemoryGate {
+    refusing: Arc<AtomicBool>,
+}
+
+impl MemoryGate {
+    /// Whether receivers should refuse exports right now.
+    pub fn is_refusing(&self) -> bool {
+        self.refusing.load(Ordering::Relaxed)
+    }
+
+    fn set(&self, refusing: bool) {
+        self.refusing.store(refusing, Ordering::Relaxed);
+    }
+}
+
+pub struct MemoryLimiter {
+    pub limit_bytes: u64,
+    pub check_interval: Duration,
+    pub gate: MemoryGate,
+}
+
+impl MemoryLimiter {
+    /// Sample memory every `check_interval` until cancelled, logging each transition.
+    pub async fn run(self, cancel: CancellationToken) {
+        let mut ticker = tokio::time::interval(self.check_interval);
+        loop {
+            tokio::select! {
+                _ = cancel.cancelled() => break,
+                _ = ticker.tick() => {}
+            }
+            let Some(rss) = resident_bytes() else {
+                tracing::warn!("Cannot read the collector's memory use; memory_limiter is off");
+                break;
+            };
+            let over = rss > self.limit_bytes;
+            if over != self.gate.is_refusing() {
+                let mib = rss / (1024 * 1024);
+                let limit = self.limit_bytes / (1024 * 1024);
+                if over {
+                    tracing::warn!("Memory use {mib} MiB is over {limit} MiB; refusing exports");
+                } else {
+                    tracing::info!("Memory use {mib} MiB is back under {limit} MiB");
+                }
+                self.gate.set(over);
+            }
+        }
+        self.gate.set(false);
+    }
+}
+
+/// Resident set size of this process.
+#[cfg(target_os = "linux")]
+pub fn resident_bytes() -> Option<u64> {
+    // statm reports pages: size, resident, ...
+    let statm = std::fs::read_to_string("/proc/self/statm").ok()?;
+    let pages: u64 = statm.split_whitespace().nth(1)?.parse().ok()?;
+    Some(pages * 4096)
+}
+
+/// Resident set size of this process, from `ps` where there is no procfs (macOS, BSDs).
+#[cfg(not(target_os = "linux"))]
+pub fn resident_bytes() -> Option<u64> {
+    let output = std::process::Command::new("ps")
+        .args(["-o", "rss=", "-p", &std::process::id().to_string()])
+        .output()
+        .ok()?;
+    let kib: u64 = String::from_utf8(output.stdout).ok()?.trim().parse().ok()?;
+    Some(kib * 1024)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn refuses_while_over_the_limit() {
+        let gate = MemoryGate::default();
+        let cancel = CancellationToken::new();
+        let limiter = MemoryLimiter {
+            limit_bytes: 1,
+            check_interval: Duration::from_millis(10),
+            gate: gate.clone(),
+        };
+        let task = tokio::spawn(limiter.run(cancel.clone()));
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        assert!(gate.is_refusing());
+
+        cancel.cancel();
+        task.await.unwrap();
+        assert!(!gate.is_refusing());
+    }
+}
@@ -1,4 +1,6 @@
 use std::net::SocketAddr;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
 
 use opentelemetry_proto::tonic::collector::logs::v1::{
     ExportLogsServiceRequest, ExportLogsServiceResponse,
@@ -14,48 +16,180 @@ use opentelemetry_proto::tonic::collector::trace::v1::{
 };
 use tokio::sync::mpsc;
 use tokio_util::sync::CancellationToken;
-use tonic::{Request, Response, Status};
+use tonic::transport::{Identity, Server, ServerTlsConfig};
+use tonic::{Code, Request, Response, Status};
 
+use crate::extension::bearer_auth::BearerAuth;
+use crate::extension::zpages::ReceiverStats;
 use crate::pipeline::SignalData;
+use crate::processor::memory_limiter::MemoryGate;
 
 /// OTLP gRPC receiver that forwards data through a channel.
 pub struct OtlpGrpcReceiver {
-    endpoint: SocketAddr,
+    listen: Listen,
     tx: mpsc::Sender<SignalData>,
+    gate: MemoryGate,
+    auth: BearerAuth,
+    stats: ReceiverStats,
+    tls: Option<Identity>,
 }
 
 impl OtlpGrpcReceiver {
     pub fn new(endpoint: SocketAddr, tx: mpsc::Sender<SignalData>) -> Self {
-        Self { endpoint, tx }
+        Self::listening(Listen::Tcp(endpoint), tx)
+    }
+
+    pub fn listening(listen: Listen, tx: mpsc::Sender<SignalData>) -> Self {
+        Self {
+            listen,
+            tx,
+            gate: MemoryGate::default(),
+            auth: BearerAuth::default(),
+            stats: ReceiverStats::default(),
+            tls: None,
+        }
+    }
+
+    /// Refuse exports with `UNAUTHENTICATED` unless `auth` allows their `authorization`.
+    pub fn with_auth(mut self, auth: BearerAuth) -> Self {
+        self.auth = auth;
+        self
+    }
+
+    /// Count accepted and refused exports in `stats`.
+    pub fn with_stats(mut self, stats: ReceiverStats) -> Self {
+        self.stats = stats;
+        self
+    }
+
+    /// Serve over TLS with this server certificate.
+    pub fn with_tls(mut self, identity: Identity) -> Self {
+        self.tls = Some(identity);
+        self
+    }
+
+    /// Refuse exports with `RESOURCE_EXHAUSTED` while `gate` is refusing.
+    pub fn with_memory_gate(mut self, gate: MemoryGate) -> Self {
+        self.gate = gate;
+        self
     }
 
     pub async fn serve(self, cancel: CancellationToken) -> Result<(), Box<dyn std::error::Error>> {
+        let admission = Admission {
+            gate: self.gate,
+            auth: self.auth,
+            stats: self.stats,
+        };
         let trace_svc = TraceServiceServer::new(TraceHandler {
             tx: self.tx.clone(),
+            admission: admission.clone(),
         });
         let metrics_svc = MetricsServiceServer::new(MetricsHandler {
             tx: self.tx.clone(),
+            admission: admission.clone(),
+        });
+        let logs_svc = LogsServiceServer::new(LogsHandler {
+            tx: self.tx,
+            admission,
         });
-        let logs_svc = LogsServiceServer::new(LogsHandler { tx: self.tx });
-
-        let listener = tokio::net::TcpListener::bind(self.endpoint).await?;
 
-        tonic::transport::Server::builder()
+        let mut server = Server::builder();
+        if let Some(identity) = self.tls {
+            server = server.tls_config(ServerTlsConfig::new().identity(identity))?;
+        }
+        let router = server
             .add_service(trace_svc)
             .add_service(metrics_svc)
-            .add_service(logs_svc)
-            .serve_with_incoming_shutdown(
-                tokio_stream::wrappers::TcpListenerStream::new(listener),
-                cancel.cancelled(),
-            )
-            .await?;
+            .add_service(logs_svc);
+
+        match self.listen {
+            Listen::Tcp(endpoint) => {
+                let listener = tokio::net::TcpListener::bind(endpoint).await?;
+                router
+                    .serve_with_incoming_shutdown(
+                        tokio_stream::wrappers::TcpListenerStream::new(listener),
+                        cancel.cancelled(),
+                    )
+                    .await?;
+            }
+            Listen::Unix(path) => {
+                let listener = bind_unix(&path)?;
+                let served = router
+                    .serve_with_incoming_shutdown(
+                        tokio_stream::wrappers::UnixListenerStream::new(listener),
+                        cancel.cancelled(),
+                    )
+                    .await;
+                let _ = std::fs::remove_file(&path);
+                served?;
+            }
+        }
 
         Ok(())
     }
 }
 
+/// Where the receiver accepts connections.
+pub enum Listen {
+    Tcp(SocketAddr),
+    /// A unix domain socket, which keeps telemetry off the network and needs no free port.
+    Unix(PathBuf),
+}
+
+/// Bind a socket only this user can connect to. A socket file nothing listens on is left by
+/// a collector that did not shut down cleanly, and is replaced.
+fn bind_unix(path: &Path) -> Result<tokio::net::UnixListener, Box<dyn std::error::Error>> {
+    if path.exists() {
+        if std::os::unix::net::UnixStream::connect(path).is_ok() {
+            return Err(format!("{} is in use by another process", path.display()).into());
+        }
+        std::fs::remove_file(path)?;
+    }
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    let listener = tokio::net::UnixListener::bind(path)?;
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o600))?;
+    Ok(listener)
+}
+
+/// What every export must pass before it reaches the pipeline.
+#[derive(Clone)]
+struct Admission {
+    gate: MemoryGate,
+    auth: BearerAuth,
+    stats: ReceiverStats,
+}
+
+impl Admission {
+    fn check<T>(&self, request: &Request<T>) -> Result<(), Status> {
+        let admitted = self.admit(request);
+        self.stats.record(admitted.is_ok());
+        admitted
+    }
+
+    fn admit<T>(&self, request: &Request<T>) -> Result<(), Status> {
+        let authorization = request.metadata().get("authorization");
+        if !self
+            .auth
+            .allows(authorization.and_then(|v| v.to_str().ok()))
+        {
+            return Err(Status::unauthenticated("missing or wrong bearer token"));
+        }
+        // SDKs retry this one.
+        if self.gate.is_refusing() {
+            return Err(Status::new(
+                Code::ResourceExhausted,
+                "collector is over its memory limit",
+            ));
+        }
+        Ok(())
+    }
+}
+
 struct TraceHandler {
     tx: mpsc::Sender<SignalData>,
+    admission: Admission,
 }
 
 #[tonic::async_trait]
@@ -64,6 +198,7 @@ impl TraceService for TraceHandler {
         &self,
         request: Request<ExportTraceServiceRequest>,
     ) -> Result<Response<ExportTraceServiceResponse>, Status> {
+        self.admission.check(&request)?;
         self.tx
             .send(SignalData::Traces(request.into_inner()))
             .await
@@ -76,6 +211,7 @@ impl TraceService for TraceHandler {
 
 struct MetricsHandler {
     tx: mpsc::Sender<SignalData>,
+    admission: Admission,
 }
 
 #[tonic::async_trait]
@@ -84,6 +220,7 @@ impl MetricsService for MetricsHandler {
         &self,
         request: Request<ExportMetricsServiceRequest>,
     ) -> Result<Response<ExportMetricsServiceResponse>, Status> {
+        self.admission.check(&request)?;
         self.tx
             .send(SignalData::Metrics(request.into_inner()))
             .await
@@ -96,6 +233,7 @@ impl MetricsService for MetricsHandler {
 
 struct LogsHandler {
     tx: mpsc::Sender<SignalData>,
+    admission: Admission,
 }
 
 #[tonic::async_trait]
@@ -104,6 +242,7 @@ impl LogsService for LogsHandler {
         &self,
         request: Request<ExportLogsServiceRequest>,
     ) -> Result<Response<ExportLogsServiceResponse>, Status> {
+        self.admission.check(&request)?;
         self.tx
             .send(SignalData::Logs(request.into_inner()))
             .await
@@ -175,4 +314,20 @@ mod tests {
         cancel.cancel();
         server_handle.await.unwrap();
     }
+
+    #[tokio::test]
+    async fn unix_socket_replaces_only_stale_files() {
+        let dir = std::env::temp_dir().join(format!("lotel-grpc-sock-{}", std::process::id()));
+        let path = dir.join("otlp.sock");
+        let listener = bind_unix(&path).unwrap();
+        let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
+        assert!(bind_unix(&path).is_err());
+
+        // Dropping the listener leaves the file behind, like a crashed collector.
+        drop(listener);
+        assert!(path.exists());
+        bind_unix(&path).unwrap();
+        std::fs::remove_dir_all(&dir).unwrap();
+    }
 }
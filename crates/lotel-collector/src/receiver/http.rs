@@ -2,7 +2,7 @@ use std::net::SocketAddr;
 
 use axum::Json;
 use axum::extract::State;
-use axum::http::StatusCode;
+use axum::http::{HeaderMap, StatusCode, header};
 use axum::routing::post;
 use opentelemetry_proto::tonic::collector::logs::v1::ExportLogsServiceRequest;
 use opentelemetry_proto::tonic::collector::metrics::v1::ExportMetricsServiceRequest;
@@ -10,26 +10,64 @@ use opentelemetry_proto::tonic::collector::trace::v1::ExportTraceServiceRequest;
 use tokio::sync::mpsc;
 use tokio_util::sync::CancellationToken;
 
+use crate::extension::bearer_auth::BearerAuth;
+use crate::extension::zpages::ReceiverStats;
 use crate::pipeline::SignalData;
+use crate::processor::memory_limiter::MemoryGate;
 
 /// OTLP HTTP receiver that forwards data through a channel.
 pub struct OtlpHttpReceiver {
     endpoint: SocketAddr,
     tx: mpsc::Sender<SignalData>,
+    gate: MemoryGate,
+    auth: BearerAuth,
+    stats: ReceiverStats,
 }
 
 #[derive(Clone)]
 struct AppState {
     tx: mpsc::Sender<SignalData>,
+    gate: MemoryGate,
+    auth: BearerAuth,
+    stats: ReceiverStats,
 }
 
 impl OtlpHttpReceiver {
     pub fn new(endpoint: SocketAddr, tx: mpsc::Sender<SignalData>) -> Self {
-        Self { endpoint, tx }
+        Self {
+            endpoint,
+            tx,
+            gate: MemoryGate::default(),
+            auth: BearerAuth::default(),
+            stats: ReceiverStats::default(),
+        }
+    }
+
+    /// Refuse exports with 503 Service Unavailable while `gate` is refusing.
+    pub fn with_memory_gate(mut self, gate: MemoryGate) -> Self {
+        self.gate = gate;
+        self
+    }
+
+    /// Refuse exports with 401 Unauthorized unless `auth` allows their `Authorization`.
+    pub fn with_auth(mut self, auth: BearerAuth) -> Self {
+        self.auth = auth;
+        self
+    }
+
+    /// Count accepted and refused exports in `stats`.
+    pub fn with_stats(mut self, stats: ReceiverStats) -> Self {
+        self.stats = stats;
+        self
     }
 
     pub async fn serve(self, cancel: CancellationToken) -> Result<(), Box<dyn std::error::Error>> {
-        let state = AppState { tx: self.tx };
+        let state = AppState {
+            tx: self.tx,
+            gate: self.gate,
+            auth: self.auth,
+            stats: self.stats,
+        };
 
         let app = axum::Router::new()
             .route("/v1/traces", post(handle_traces))
@@ -48,29 +86,47 @@ impl OtlpHttpReceiver {
 
 async fn handle_traces(
     State(state): State<AppState>,
+    headers: HeaderMap,
     Json(request): Json<ExportTraceServiceRequest>,
 ) -> StatusCode {
-    match state.tx.send(SignalData::Traces(request)).await {
-        Ok(()) => StatusCode::OK,
-        Err(_) => StatusCode::INTERNAL_SERVER_ERROR,
-    }
+    forward(&state, &headers, SignalData::Traces(request)).await
 }
 
 async fn handle_metrics(
     State(state): State<AppState>,
+    headers: HeaderMap,
     Json(request): Json<ExportMetricsServiceRequest>,
 ) -> StatusCode {
-    match state.tx.send(SignalData::Metrics(request)).await {
-        Ok(()) => StatusCode::OK,
-        Err(_) => StatusCode::INTERNAL_SERVER_ERROR,
-    }
+    forward(&state, &headers, SignalData::Metrics(request)).await
 }
 
 async fn handle_logs(
     State(state): State<AppState>,
+    headers: HeaderMap,
     Json(request): Json<ExportLogsServiceRequest>,
 ) -> StatusCode {
-    match state.tx.send(SignalData::Logs(request)).await {
+    forward(&state, &headers, SignalData::Logs(request)).await
+}
+
+async fn forward(state: &AppState, headers: &HeaderMap, data: SignalData) -> StatusCode {
+    let status = admit(state, headers, data).await;
+    state.stats.record(status.is_success());
+    status
+}
+
+async fn admit(state: &AppState, headers: &HeaderMap, data: SignalData) -> StatusCode {
+    let authorization = headers.get(header::AUTHORIZATION);
+    if !state
+        .auth
+        .allows(authorization.and_then(|v| v.to_str().ok()))
+    {
+        return StatusCode::UNAUTHORIZED;
+    }
+    // 503 is retryable for OTLP/HTTP exporters, so SDKs back off until memory drops.
+    if state.gate.is_refusing() {
+        return StatusCode::SERVICE_UNAVAILABLE;
+    }
+    match state.tx.send(data).await {
         Ok(()) => StatusCode::OK,
         Err(_) => StatusCode::INTERNAL_SERVER_ERROR,
     }
@@ -0,0 +1,226 @@
+//! Scheduled retention: the `retention` config section prunes the database on a cron
+//! schedule while the collector runs, recording each run in `prune_history`.
+
+use std::path::{Path, PathBuf};
+
+use serde::Deserialize;
+use tokio_util::sync::CancellationToken;
+
+use crate::cron::CronSchedule;
+use lotel_storage::{PruneFilter, PruneReport, PruneRun, Signal};
+
+type Error = Box<dyn std::error::Error + Send + Sync>;
+
+/// The `retention` config section. At least one of `older_than` and the `keep_*` limits is
+/// required; they combine like the `lotel prune` flags of the same names.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct RetentionConfig {
+    /// Cron expression in local time, e.g. "0 3 * * *" for 03:00 every day.
+    pub schedule: String,
+    /// Delete records older than this (e.g. "7d", "1d12h").
+    #[serde(default)]
+    pub older_than: Option<String>,
+    #[serde(default)]
+    pub keep_traces: Option<u64>,
+    #[serde(default)]
+    pub keep_metrics: Option<u64>,
+    #[serde(default)]
+    pub keep_logs: Option<u64>,
+    /// Apply the `keep_*` limits to each service separately.
+    #[serde(default)]
+    pub per_service: bool,
+    /// Only prune this service's records.
+    #[serde(default)]
+    pub service: Option<String>,
+}
+
+/// A validated [`RetentionConfig`].
+#[derive(Debug)]
+pub struct RetentionPolicy {
+    schedule: CronSchedule,
+    max_age: Option<chrono::Duration>,
+    limits: Vec<(Signal, u64)>,
+    per_service: bool,
+    filter: PruneFilter,
+}
+
+impl RetentionPolicy {
+    pub fn new(config: &RetentionConfig) -> Result<Self, String> {
+        let schedule = CronSchedule::parse(&config.schedule)?;
+        let max_age = config.older_than.as_deref().map(parse_age).transpose()?;
+        let limits: Vec<_> = [
+            (Signal::Traces, config.keep_traces),
+            (Signal::Metrics, config.keep_metrics),
+            (Signal::Logs, config.keep_logs),
+        ]
+        .into_iter()
+        .filter_map(|(signal, keep)| keep.map(|n| (signal, n)))
+        .collect();
+        if limits.iter().any(|&(_, n)| n == 0) {
+            return Err("retention keep_* limits must be at least 1".into());
+        }
+        if max_age.is_none() && limits.is_empty() {
+            return Err(
+                "retention needs older_than or one of keep_traces, keep_metrics, keep_logs".into(),
+            );
+        }
+        if config.per_service && limits.is_empty() {
+            return Err("retention.per_service needs a keep_* limit".into());
+        }
+        Ok(Self {
+            schedule,
+            max_age,
+            limits,
+            per_service: config.per_service,
+            filter: PruneFilter::service(config.service.as_deref()),
+        })
+    }
+
+    /// Prune once: the age threshold first, then the count limits on what it left.
+    fn apply(&self, backend: &dyn lotel_storage::Backend) -> Result<Vec<PruneReport>, Error> {
+        let mut reports = match self.max_age {
+            Some(age) => {
+                let cutoff = chrono::Utc::now().naive_utc() - age;
+                backend.prune_matching(cutoff, &self.filter, false)?
+            }
+            None => Vec::new(),
+        };
+        for &(signal, n) in &self.limits {
+            reports.extend(backend.prune_keep(signal, n, &self.filter, self.per_service, false)?);
+        }
+        Ok(reports)
+    }
+}
+
+/// Parse an age such as `7d`, `12h`, or `1d12h` (see [`lotel_storage::parse_duration`]).
+fn parse_age(s: &str) -> Result<chrono::Duration, String> {
+    lotel_storage::parse_duration(s).map_err(|e| format!("invalid retention age: {e}"))
+}
+
+/// Run the retention task until `cancel` fires.
+///
+/// Each run waits for the ingest lock, so it never overlaps an ingestion pass or a manual
+/// `lotel ingest`. Failures are logged and recorded, and never stop the collector.
+pub async fn run_retention_task(
+    policy: RetentionPolicy,
+    storage: lotel_storage::StorageConfig,
+    db_path: PathBuf,
+    cancel: CancellationToken,
+) {
+    let policy = std::sync::Arc::new(policy);
+    loop {
+        let now = chrono::Local::now().naive_local();
+        let Some(next) = policy.schedule.next_after(now) else {
+            tracing::warn!("Retention schedule never fires; scheduled pruning is off");
+            return;
+        };
+        tracing::debug!("Next scheduled prune at {next}");
+        let wait = (next - now).to_std().unwrap_or_default();
+        tokio::select! {
+            _ = cancel.cancelled() => return,
+            _ = tokio::time::sleep(wait) => {}
+        }
+
+        let stop = lotel_storage::Cancel::new();
+        let (policy, storage, db_path, pass_stop) = (
+            policy.clone(),
+            storage.clone(),
+            db_path.clone(),
+            stop.clone(),
+        );
+        let mut pass = tokio::task::spawn_blocking(move || {
+            prune_once(&policy, &storage, &db_path, &pass_stop)
+        });
+        let result = tokio::select! {
+            result = &mut pass => result,
+            _ = cancel.cancelled() => {
+                stop.cancel();
+                let _ = pass.await;
+                tracing::info!("Scheduled prune interrupted by shutdown");
+                return;
+            }
+        };
+        match result {
+            Ok(Ok(run)) => tracing::info!(
+                "Scheduled prune deleted {} spans, {} metric points, {} log records",
+                run.traces,
+                run.metrics,
+                run.logs
+            ),
+            Ok(Err(e)) => tracing::error!("Scheduled prune failed: {e:#}"),
+            Err(e) => tracing::error!("Scheduled prune panicked: {e:?}"),
+        }
+    }
+}
+
+/// Run one scheduled prune and record it, failed or not, in `prune_history`.
+fn prune_once(
+    policy: &RetentionPolicy,
+    storage: &lotel_storage::StorageConfig,
+    db_path: &Path,
+    cancel: &lotel_storage::Cancel,
+) -> Result<PruneRun, Error> {
+    let _lock = lotel_storage::IngestLock::acquire(db_path)?;
+    let started_at = chrono::Utc::now().naive_utc();
+    let data_dir = db_path.parent().unwrap_or(Path::new("."));
+    let store = lotel_storage::Store::open(storage, data_dir, false)?.with_cancel(cancel);
+    let (run, result) = match policy.apply(store.backend()) {
+        Ok(reports) => (
+            PruneRun::from_reports(started_at, "schedule", &reports),
+            Ok(()),
+        ),
+        Err(e) => (
+            PruneRun::failed(started_at, "schedule", e.to_string()),
+            Err(e),
+        ),
+    };
+    let recorded = store.backend().record_prune(&run);
+    store.close()?;
+    result?;
+    recorded?;
+    Ok(run)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config(yaml: &str) -> RetentionConfig {
+        serde_yaml::from_str(yaml).unwrap()
+    }
+
+    #[test]
+    fn builds_policy_from_config() {
+        let policy = RetentionPolicy::new(&config(
+            "schedule: \"0 3 * * *\"\nolder_than: 1d12h\nkeep_logs: 1000\nper_service: true",
+        ))
+        .unwrap();
+        assert_eq!(policy.max_age, Some(chrono::Duration::hours(36)));
+        assert_eq!(policy.limits, vec![(Signal::Logs, 1000)]);
+        assert!(policy.per_service);
+    }
+
+    #[test]
+    fn parses_ages_like_the_cli() {
+        assert_eq!(parse_age("1mo"), Ok(chrono::Duration::days(30)));
+        assert_eq!(
+            parse_age("1h500ms"),
+            Ok(chrono::Duration::milliseconds(3_600_500))
+        );
+        assert!(parse_age("7y").is_err());
+    }
+
+    #[test]
+    fn rejects_incomplete_policies() {
+        for yaml in [
+            "schedule: \"0 3 * * *\"",
+            "schedule: \"0 3 * *\"\nolder_than: 7d",
+            "schedule: \"0 3 * * *\"\nolder_than: 7 days",
+            "schedule: \"0 3 * * *\"\nolder_than: 7d\nper_service: true",
+            "schedule: \"0 3 * * *\"\nkeep_traces: 0",
+        ] {
+            assert!(RetentionPolicy::new(&config(yaml)).is_err(), "{yaml}");
+        }
+    }
+}
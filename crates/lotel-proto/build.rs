@@ -0,0 +1,13 @@
+use std::path::PathBuf;
+
+fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let root = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("../../proto");
+    // The vendored protoc and its well-known types, so building needs no system install.
+    // SAFETY: build scripts are single-threaded.
+    unsafe { std::env::set_var("PROTOC", protoc_bin_vendored::protoc_bin_path()?) };
+    tonic_prost_build::configure().compile_protos(
+        &[root.join("lotel/query/v1/query.proto")],
+        &[root, protoc_bin_vendored::include_path()?],
+    )?;
+    Ok(())
+}
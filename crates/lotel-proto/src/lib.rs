@@ -0,0 +1,26 @@
+//! The lotel gRPC query API served by `lotel serve --grpc`: message types, a client, and the
+//! server trait, generated from `proto/lotel/query/v1/query.proto`.
+//!
+//! ```no_run
+//! # async fn run() -> Result<(), Box<dyn std::error::Error>> {
+//! use lotel_proto::query::v1::QueryRequest;
+//! use lotel_proto::query::v1::query_service_client::QueryServiceClient;
+//!
+//! let mut client = QueryServiceClient::connect("http://127.0.0.1:4320").await?;
+//! let request = QueryRequest {
+//!     service: Some("checkout".into()),
+//!     ..Default::default()
+//! };
+//! let spans = client.query_traces(request).await?.into_inner().spans;
+//! # Ok(())
+//! # }
+//! ```
+
+/// `google.protobuf.Timestamp` and the other well-known types the messages use.
+pub use prost_types;
+
+pub mod query {
+    pub mod v1 {
+        tonic::include_proto!("lotel.query.v1");
+    }
+}
@@ -0,0 +1,267 @@
+//! Alert rules: RED thresholds over a trailing window, evaluated repeatedly (the collector
+//! does so after each ingest pass) and reported only when a rule starts or stops breaching.
+
+use std::collections::HashSet;
+
+use anyhow::{Context, Result, bail};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::QueryOptions;
+use crate::stats::{RedStats, red_metrics};
+
+/// One rule as written in the `ingestion.alerts.rules` config section. Rules without a
+/// service are checked per service.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct AlertRule {
+    pub name: String,
+    #[serde(default)]
+    pub service: Option<String>,
+    /// Trailing window, e.g. `5m`.
+    #[serde(default = "default_window")]
+    pub window: String,
+    /// Error-rate limit of entry spans, e.g. `5%` or `0.05`.
+    #[serde(default)]
+    pub max_error_rate: Option<String>,
+    /// p95 latency limit of entry spans in milliseconds.
+    #[serde(default)]
+    pub max_p95_ms: Option<f64>,
+    /// Windows with fewer entry spans than this never breach.
+    #[serde(default = "default_min_requests")]
+    pub min_requests: i64,
+}
+
+fn default_window() -> String {
+    "5m".to_string()
+}
+
+fn default_min_requests() -> i64 {
+    1
+}
+
+/// A rule starting (`firing`) or stopping to breach for one service.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+pub struct AlertEvent {
+    pub rule: String,
+    pub service: String,
+    pub firing: bool,
+    pub window: String,
+    /// The violated limits, or why the alert resolved.
+    pub message: String,
+    /// RED stats of the window; absent when the service had no entry spans.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub stats: Option<RedStats>,
+}
+
+struct CompiledRule {
+    rule: AlertRule,
+    window: chrono::Duration,
+    max_error_rate: Option<f64>,
+}
+
+/// Evaluates rules and remembers which (rule, service) pairs are firing.
+pub struct AlertEvaluator {
+    rules: Vec<CompiledRule>,
+    firing: HashSet<(usize, String)>,
+}
+
+impl AlertEvaluator {
+    pub fn new(rules: &[AlertRule]) -> Result<Self> {
+        let rules = rules
+            .iter()
+            .map(|rule| {
+                if rule.max_error_rate.is_none() && rule.max_p95_ms.is_none() {
+                    bail!(
+                        "alert rule {:?} needs max_error_rate or max_p95_ms",
+                        rule.name
+                    );
+                }
+                Ok(CompiledRule {
+                    rule: rule.clone(),
+                    window: parse_window(&rule.window)?,
+                    max_error_rate: rule.max_error_rate.as_deref().map(parse_rate).transpose()?,
+                })
+            })
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            rules,
+            firing: HashSet::new(),
+        })
+    }
+
+    /// Check every rule over the window ending at `now` and return the transitions since the
+    /// previous call.
+    pub fn evaluate(&mut self, conn: &Connection, now: NaiveDateTime) -> Result<Vec<AlertEvent>> {
+        let mut events = Vec::new();
+        for (i, compiled) in self.rules.iter().enumerate() {
+            let rule = &compiled.rule;
+            let opts = QueryOptions {
+                service: rule.service.clone(),
+                since: Some(now - compiled.window),
+                until: Some(now),
+                ..Default::default()
+            };
+            let stats = red_metrics(conn, &opts, false)?;
+
+            let mut breaching = HashSet::new();
+            for s in &stats {
+                let violations = violations(compiled, s);
+                if violations.is_empty() {
+                    continue;
+                }
+                breaching.insert(s.service_name.clone());
+                if self.firing.insert((i, s.service_name.clone())) {
+                    events.push(AlertEvent {
+                        rule: rule.name.clone(),
+                        service: s.service_name.clone(),
+                        firing: true,
+                        window: rule.window.clone(),
+                        message: violations.join(", "),
+                        stats: Some(s.clone()),
+                    });
+                }
+            }
+
+            let mut resolved: Vec<String> = self
+                .firing
+                .iter()
+                .filter(|(r, service)| *r == i && !breaching.contains(service))
+                .map(|(_, service)| service.clone())
+                .collect();
+            resolved.sort();
+            for service in resolved {
+                self.firing.remove(&(i, service.clone()));
+                let stats = stats.iter().find(|s| s.service_name == service).cloned();
+                events.push(AlertEvent {
+                    rule: rule.name.clone(),
+                    message: match stats {
+                        Some(_) => "back within limits".to_string(),
+                        None => "no traffic in window".to_string(),
+                    },
+                    service,
+                    firing: false,
+                    window: rule.window.clone(),
+                    stats,
+                });
+            }
+        }
+        Ok(events)
+    }
+}
+
+fn violations(compiled: &CompiledRule, s: &RedStats) -> Vec<String> {
+    let mut out = Vec::new();
+    if s.requests < compiled.rule.min_requests {
+        return out;
+    }
+    if let Some(max) = compiled.max_error_rate
+        && s.error_rate > max
+    {
+        out.push(format!(
+            "error rate {:.1}% > {:.1}% ({} of {} requests)",
+            s.error_rate * 100.0,
+            max * 100.0,
+            s.errors,
+            s.requests
+        ));
+    }
+    if let Some(max) = compiled.rule.max_p95_ms
+        && s.p95_ms > max
+    {
+        out.push(format!("p95 {:.1}ms > {max}ms", s.p95_ms));
+    }
+    out
+}
+
+/// Parse a window such as `90s`, `5m`, or `1h` (see [`crate::parse_duration`]).
+fn parse_window(s: &str) -> Result<chrono::Duration> {
+    let window = crate::parse_duration(s).context("invalid alert window")?;
+    if window <= chrono::Duration::zero() {
+        bail!("alert window {s:?} must be positive");
+    }
+    Ok(window)
+}
+
+/// Parse a rate such as `5%` or `0.05`.
+fn parse_rate(s: &str) -> Result<f64> {
+    let s = s.trim();
+    let rate = match s.strip_suffix('%') {
+        Some(pct) => pct.trim().parse::<f64>().map(|p| p / 100.0),
+        None => s.parse::<f64>(),
+    };
+    match rate {
+        Ok(r) if (0.0..=1.0).contains(&r) => Ok(r),
+        _ => bail!("invalid error rate {s:?} (expected e.g. \"5%\" or \"0.05\")"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn insert_span(conn: &Connection, span_id: &str, service: &str, status: i32, sec: u32) {
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, NULL, 'GET /', 2, ?, NULL, 1000000, ?, ?, '{}', '2024-03-09')",
+            duckdb::params![
+                span_id,
+                span_id,
+                format!("2024-03-09 16:00:{sec:02}"),
+                status,
+                service
+            ],
+        )
+        .unwrap();
+    }
+
+    #[test]
+    fn fires_once_and_resolves() {
+        let conn = db::open_in_memory().unwrap();
+        for i in 0..10 {
+            insert_span(&conn, &format!("ok{i}"), "checkout", 0, i);
+        }
+        insert_span(&conn, "err1", "checkout", 2, 20);
+        insert_span(&conn, "err2", "checkout", 2, 21);
+        insert_span(&conn, "ok", "payments", 0, 22);
+
+        let rule: AlertRule =
+            serde_json::from_str(r#"{"name": "errors", "max_error_rate": "5%"}"#).unwrap();
+        let mut evaluator = AlertEvaluator::new(&[rule]).unwrap();
+        let now: NaiveDateTime = "2024-03-09T16:01:00".parse().unwrap();
+
+        let events = evaluator.evaluate(&conn, now).unwrap();
+        assert_eq!(events.len(), 1);
+        assert!(events[0].firing);
+        assert_eq!(events[0].service, "checkout");
+        assert_eq!(
+            events[0].message,
+            "error rate 16.7% > 5.0% (2 of 12 requests)"
+        );
+
+        // Still breaching: no new event.
+        assert!(evaluator.evaluate(&conn, now).unwrap().is_empty());
+
+        // The window has moved past every span.
+        let later = now + chrono::Duration::minutes(10);
+        let events = evaluator.evaluate(&conn, later).unwrap();
+        assert_eq!(events.len(), 1);
+        assert!(!events[0].firing);
+        assert_eq!(events[0].message, "no traffic in window");
+    }
+
+    #[test]
+    fn rejects_bad_rules() {
+        let rule = |json: &str| -> AlertRule { serde_json::from_str(json).unwrap() };
+        assert!(AlertEvaluator::new(&[rule(r#"{"name": "x"}"#)]).is_err());
+        assert!(
+            AlertEvaluator::new(&[rule(r#"{"name": "x", "max_p95_ms": 5, "window": "5x"}"#)])
+                .is_err()
+        );
+        assert!(
+            AlertEvaluator::new(&[rule(r#"{"name": "x", "max_error_rate": "150%"}"#)]).is_err()
+        );
+        assert!(AlertEvaluator::new(&[rule(r#"{"name": "x", "max_p95_ms": 5}"#)]).is_ok());
+    }
+}
@@ -0,0 +1,312 @@
+//! Archival tier: `lotel archive` moves old telemetry to Parquet files in object storage
+//! (or any directory) and records them in the `archives` table. Query connections then
+//! union the archived files back in through DuckDB's httpfs extension.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde::Serialize;
+
+use crate::db::sql_string;
+
+const SIGNALS: [(&str, &str); 3] = [
+    ("traces", "start_time"),
+    ("metrics", "timestamp"),
+    ("logs", "timestamp"),
+];
+
+#[derive(Debug, Serialize)]
+pub struct ArchiveReport {
+    pub signal: String,
+    pub archived: i64,
+    /// The Parquet file written; absent on a dry run or when nothing was old enough.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub location: Option<String>,
+    pub cutoff: String,
+}
+
+/// Move telemetry older than `cutoff` to one Parquet file per signal under `dest`
+/// (`s3://bucket/prefix`, another httpfs URL, or a local directory). Each signal is copied,
+/// registered, and deleted in one transaction. If `dry_run`, only counts the rows.
+pub fn archive(
+    conn: &Connection,
+    cutoff: NaiveDateTime,
+    dest: &str,
+    dry_run: bool,
+) -> Result<Vec<ArchiveReport>> {
+    let dest = if is_remote(dest) || dry_run {
+        dest.trim_end_matches('/').to_string()
+    } else {
+        local_dest(dest)?
+    };
+    let dest = dest.as_str();
+    if !dry_run && is_remote(dest) {
+        load_httpfs(conn, dest)?;
+    }
+
+    let now = chrono::Utc::now().naive_utc();
+    let stamp = now.format("%Y%m%dT%H%M%S%.6f");
+    let cutoff_str = cutoff.format("%Y-%m-%dT%H:%M:%S").to_string();
+    let mut reports = Vec::new();
+
+    for (signal, time_col) in SIGNALS {
+        let count: i64 = conn
+            .query_row(
+                &format!("SELECT COUNT(*) FROM {signal} WHERE {time_col} < ?"),
+                duckdb::params![cutoff],
+                |row| row.get(0),
+            )
+            .with_context(|| format!("counting {signal} for archive"))?;
+
+        let mut location = None;
+        if !dry_run && count > 0 {
+            if !is_remote(dest) {
+                let dir = Path::new(dest).join(signal);
+                std::fs::create_dir_all(&dir)
+                    .with_context(|| format!("creating {}", dir.display()))?;
+            }
+            let file = format!("{dest}/{signal}/{stamp}.parquet");
+            archive_signal(conn, signal, time_col, cutoff, &file, now)
+                .with_context(|| format!("archiving {signal} to {file}"))?;
+            location = Some(file);
+        }
+
+        reports.push(ArchiveReport {
+            signal: signal.to_string(),
+            archived: count,
+            location,
+            cutoff: cutoff_str.clone(),
+        });
+    }
+
+    Ok(reports)
+}
+
+/// A local destination as the absolute path it is recorded under, so query connections find
+/// the files from any working directory: `~/` is expanded and the directory created first.
+fn local_dest(dest: &str) -> Result<String> {
+    let path = match dest.strip_prefix("~/") {
+        Some(rest) => dirs::home_dir().context("no home directory")?.join(rest),
+        None => PathBuf::from(dest),
+    };
+    std::fs::create_dir_all(&path).with_context(|| format!("creating {}", path.display()))?;
+    let path =
+        std::fs::canonicalize(&path).with_context(|| format!("resolving {}", path.display()))?;
+    path.to_str()
+        .map(String::from)
+        .with_context(|| format!("archive directory {} is not valid UTF-8", path.display()))
+}
+
+fn archive_signal(
+    conn: &Connection,
+    signal: &str,
+    time_col: &str,
+    cutoff: NaiveDateTime,
+    file: &str,
+    now: NaiveDateTime,
+) -> Result<()> {
+    // COPY takes no parameters, so the cutoff is inlined as a literal we format ourselves.
+    let cutoff_sql = format!("TIMESTAMP '{}'", cutoff.format("%Y-%m-%d %H:%M:%S%.6f"));
+    conn.execute_batch("BEGIN TRANSACTION")?;
+    let result = (|| -> Result<()> {
+        conn.execute_batch(&format!(
+            "COPY (SELECT * FROM {signal} WHERE {time_col} < {cutoff_sql}) TO {} (FORMAT parquet)",
+            sql_string(file)
+        ))?;
+        conn.execute(
+            &format!(
+                "INSERT INTO archives
+                 SELECT ?, ?, MIN({time_col}), MAX({time_col}), COUNT(*), ?
+                 FROM {signal} WHERE {time_col} < ?"
+            ),
+            duckdb::params![signal, file, now, cutoff],
+        )?;
+        // Trace summaries stay: queries still see the archived spans they describe.
+        conn.execute(
+            &format!("DELETE FROM {signal} WHERE {time_col} < ?"),
+            duckdb::params![cutoff],
+        )?;
+        Ok(())
+    })();
+    match result {
+        Ok(()) => {
+            conn.execute_batch("COMMIT")?;
+            Ok(())
+        }
+        Err(e) => {
+            let _ = conn.execute_batch("ROLLBACK");
+            Err(e)
+        }
+    }
+}
+
+/// Shadow the signal tables with temporary views that also read the archived Parquet files,
+/// so every query sees archived rows. Does nothing until something has been archived.
+/// Archives that cannot be read (a moved directory, no network) are left out with a warning
+/// rather than failing every query.
+pub fn attach_archives(conn: &Connection) -> Result<()> {
+    // Databases created before the archive tier have no registry yet.
+    let has_registry: bool = conn.query_row(
+        "SELECT COUNT(*) > 0 FROM information_schema.tables
+         WHERE table_schema = 'main' AND table_name = 'archives'",
+        [],
+        |row| row.get(0),
+    )?;
+    if !has_registry {
+        return Ok(());
+    }
+
+    let mut stmt = conn.prepare("SELECT signal, location FROM archives ORDER BY archived_at")?;
+    let mut archives: Vec<(String, String)> = stmt
+        .query_map([], |row| Ok((row.get(0)?, row.get(1)?)))?
+        .collect::<duckdb::Result<_>>()?;
+    if let Some((_, remote)) = archives.iter().find(|(_, loc)| is_remote(loc))
+        && let Err(err) = load_httpfs(conn, remote)
+    {
+        tracing::warn!("Leaving out remote archives: {err:#}");
+        archives.retain(|(_, loc)| !is_remote(loc));
+    }
+    archives.retain(|(_, loc)| {
+        let readable = is_remote(loc) || Path::new(loc).is_file();
+        if !readable {
+            tracing::warn!("Leaving out archive {loc}: file not found");
+        }
+        readable
+    });
+    if archives.is_empty() {
+        return Ok(());
+    }
+
+    // The views live in the temp catalog, which resolves first, so name the stored tables
+    // through their own catalog to avoid the view reading itself.
+    let catalog: String = conn.query_row("SELECT current_database()", [], |row| row.get(0))?;
+    let catalog = format!("\"{}\"", catalog.replace('"', "\"\""));
+    for (signal, _) in SIGNALS {
+        let files: Vec<String> = archives
+            .iter()
+            .filter(|(s, _)| s == signal)
+            .map(|(_, loc)| sql_string(loc))
+            .collect();
+        if files.is_empty() {
+            continue;
+        }
+        let attached = conn.execute_batch(&format!(
+            "CREATE OR REPLACE TEMP VIEW {signal} AS
+             SELECT * FROM {catalog}.main.{signal}
+             UNION ALL BY NAME
+             SELECT * FROM read_parquet([{}], union_by_name = true)",
+            files.join(", ")
+        ));
+        if let Err(err) = attached {
+            tracing::warn!("Leaving out archived {signal}: {err}");
+        }
+    }
+    Ok(())
+}
+
+/// Anything with a URL scheme goes through httpfs; the rest is a local path.
+fn is_remote(location: &str) -> bool {
+    location.contains("://")
+}
+
+/// Load httpfs and, for S3, pick up credentials from the AWS chain (environment variables,
+/// `~/.aws`, instance roles).
+fn load_httpfs(conn: &Connection, location: &str) -> Result<()> {
+    conn.execute_batch("INSTALL httpfs; LOAD httpfs;")
+        .context("loading the DuckDB httpfs extension")?;
+    if location.starts_with("s3://") {
+        conn.execute_batch(
+            "CREATE SECRET IF NOT EXISTS lotel_archive (TYPE s3, PROVIDER credential_chain)",
+        )
+        .context("loading S3 credentials")?;
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn archives_old_rows_and_queries_them_back() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let conn = db::open_in_memory().unwrap();
+        for (id, time) in [
+            ("old", "2024-01-01 00:00:00"),
+            ("new", "2024-12-01 00:00:00"),
+        ] {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, name, start_time, service_name, attributes, date)
+                 VALUES (?, 's1', 'op', ?, 'svc', '{}', CAST(? AS DATE))",
+                duckdb::params![id, time, time],
+            )
+            .unwrap();
+        }
+        let cutoff =
+            NaiveDateTime::parse_from_str("2024-06-01 00:00:00", "%Y-%m-%d %H:%M:%S").unwrap();
+        let dest = tmp.path().join("archive");
+        let dest = dest.to_str().unwrap();
+
+        let reports = archive(&conn, cutoff, dest, true).unwrap();
+        assert_eq!(reports[0].archived, 1);
+        assert!(reports[0].location.is_none());
+
+        let reports = archive(&conn, cutoff, dest, false).unwrap();
+        assert_eq!(reports[0].archived, 1);
+        assert!(reports[0].location.as_ref().unwrap().ends_with(".parquet"));
+        assert!(reports[1].location.is_none());
+        let local: i64 = conn
+            .query_row("SELECT COUNT(*) FROM traces", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(local, 1);
+
+        attach_archives(&conn).unwrap();
+        let ids: Vec<String> = conn
+            .prepare("SELECT trace_id FROM traces ORDER BY start_time")
+            .unwrap()
+            .query_map([], |row| row.get(0))
+            .unwrap()
+            .map(|r| r.unwrap())
+            .collect();
+        assert_eq!(ids, vec!["old", "new"]);
+    }
+
+    #[test]
+    fn relative_destinations_resolve_from_any_directory() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let elsewhere = tempfile::TempDir::new().unwrap();
+        let cwd = std::env::current_dir().unwrap();
+        let conn = db::open_in_memory().unwrap();
+        conn.execute(
+            "INSERT INTO logs (timestamp, body, service_name, date)
+             VALUES ('2024-01-01 00:00:00', 'old', 'svc', '2024-01-01')",
+            [],
+        )
+        .unwrap();
+        let cutoff =
+            NaiveDateTime::parse_from_str("2024-06-01 00:00:00", "%Y-%m-%d %H:%M:%S").unwrap();
+
+        std::env::set_current_dir(tmp.path()).unwrap();
+        let reports = archive(&conn, cutoff, "archive", false);
+        std::env::set_current_dir(elsewhere.path()).unwrap();
+        let attached = attach_archives(&conn);
+        std::env::set_current_dir(cwd).unwrap();
+
+        let location = reports.unwrap()[2].location.clone().unwrap();
+        assert!(Path::new(&location).is_absolute(), "{location}");
+        attached.unwrap();
+        let bodies: i64 = conn
+            .query_row("SELECT COUNT(*) FROM logs WHERE body = 'old'", [], |row| {
+                row.get(0)
+            })
+            .unwrap();
+        assert_eq!(bodies, 1);
+
+        // A moved archive is left out instead of breaking the connection.
+        std::fs::remove_file(&location).unwrap();
+        attach_archives(&conn).unwrap();
+    }
+}
@@ -0,0 +1,226 @@
+//! Declarative telemetry assertions for gating CI runs on captured spans and logs.
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, append_span_filters, append_where};
+use crate::sample::{SEVERITY_ERROR, STATUS_ERROR};
+
+/// Conditions the matching spans and logs must satisfy. Unset fields are not checked.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Assertion {
+    /// Fail if any span has status ERROR.
+    pub no_error_spans: bool,
+    /// Maximum allowed p95 span duration in milliseconds.
+    pub max_p95_ms: Option<f64>,
+    /// Minimum number of spans that must have been captured.
+    pub min_spans: Option<i64>,
+    /// Fail if any log record is ERROR or worse.
+    pub no_error_logs: bool,
+    /// Minimum number of log records that must have been captured.
+    pub min_logs: Option<i64>,
+}
+
+impl Assertion {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+}
+
+/// Outcome of a single check.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CheckResult {
+    pub check: String,
+    pub passed: bool,
+    pub actual: f64,
+    pub limit: f64,
+    pub message: String,
+}
+
+/// Outcome of every check in an [`Assertion`].
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AssertReport {
+    pub passed: bool,
+    pub checks: Vec<CheckResult>,
+}
+
+/// Evaluate `assertion` against the spans matching `opts`.
+pub fn evaluate_assertion(
+    conn: &Connection,
+    opts: &QueryOptions,
+    assertion: &Assertion,
+) -> Result<AssertReport> {
+    let mut query = format!(
+        "SELECT COUNT(*),
+                COUNT(*) FILTER (WHERE status_code = {STATUS_ERROR}),
+                quantile_cont(duration_ns, 0.95) / 1e6
+         FROM traces WHERE 1=1"
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut query, &mut params, opts);
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let (spans, errors, p95): (i64, i64, Option<f64>) = conn
+        .query_row(&query, param_refs.as_slice(), |row| {
+            Ok((row.get(0)?, row.get(1)?, row.get(2)?))
+        })
+        .context("evaluating span assertions")?;
+
+    let mut checks = Vec::new();
+    if assertion.no_error_spans {
+        checks.push(CheckResult {
+            check: "no_error_spans".into(),
+            passed: errors == 0,
+            actual: errors as f64,
+            limit: 0.0,
+            message: format!("{errors} error spans (expected none)"),
+        });
+    }
+    if let Some(max) = assertion.max_p95_ms {
+        let p95 = p95.unwrap_or(0.0);
+        checks.push(CheckResult {
+            check: "max_p95_ms".into(),
+            passed: p95 <= max,
+            actual: p95,
+            limit: max,
+            message: format!("p95 span duration {p95:.1}ms (limit {max}ms)"),
+        });
+    }
+    if let Some(min) = assertion.min_spans {
+        checks.push(CheckResult {
+            check: "min_spans".into(),
+            passed: spans >= min,
+            actual: spans as f64,
+            limit: min as f64,
+            message: format!("{spans} spans captured (expected at least {min})"),
+        });
+    }
+
+    if assertion.no_error_logs || assertion.min_logs.is_some() {
+        check_logs(conn, opts, assertion, &mut checks)?;
+    }
+
+    Ok(AssertReport {
+        passed: checks.iter().all(|c| c.passed),
+        checks,
+    })
+}
+
+fn check_logs(
+    conn: &Connection,
+    opts: &QueryOptions,
+    assertion: &Assertion,
+    checks: &mut Vec<CheckResult>,
+) -> Result<()> {
+    let mut query = format!(
+        "SELECT COUNT(*), COUNT(*) FILTER (WHERE severity_number >= {SEVERITY_ERROR})
+         FROM logs WHERE 1=1"
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_where(&mut query, &mut params, opts, "timestamp");
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let (logs, errors): (i64, i64) = conn
+        .query_row(&query, param_refs.as_slice(), |row| {
+            Ok((row.get(0)?, row.get(1)?))
+        })
+        .context("evaluating log assertions")?;
+
+    if assertion.no_error_logs {
+        checks.push(CheckResult {
+            check: "no_error_logs".into(),
+            passed: errors == 0,
+            actual: errors as f64,
+            limit: 0.0,
+            message: format!("{errors} ERROR-or-worse logs (expected none)"),
+        });
+    }
+    if let Some(min) = assertion.min_logs {
+        checks.push(CheckResult {
+            check: "min_logs".into(),
+            passed: logs >= min,
+            actual: logs as f64,
+            limit: min as f64,
+            message: format!("{logs} logs captured (expected at least {min})"),
+        });
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn setup() -> Connection {
+        let conn = db::open_in_memory().unwrap();
+        for (i, (ms, status)) in [(100i64, 0), (200, 0), (900, 2)].iter().enumerate() {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, 's', NULL, 'op', 2, '2024-03-09 16:00:00', NULL, ?, ?, 'api', '{}', '2024-03-09')",
+                duckdb::params![format!("t{i}"), ms * 1_000_000, status],
+            )
+            .unwrap();
+        }
+        conn
+    }
+
+    #[test]
+    fn reports_each_check() {
+        let conn = setup();
+        let assertion = Assertion {
+            no_error_spans: true,
+            max_p95_ms: Some(500.0),
+            min_spans: Some(3),
+            ..Default::default()
+        };
+        let report = evaluate_assertion(&conn, &QueryOptions::default(), &assertion).unwrap();
+        assert!(!report.passed);
+        let status: Vec<(&str, bool)> = report
+            .checks
+            .iter()
+            .map(|c| (c.check.as_str(), c.passed))
+            .collect();
+        assert_eq!(
+            status,
+            [
+                ("no_error_spans", false),
+                ("max_p95_ms", false),
+                ("min_spans", true)
+            ]
+        );
+    }
+
+    #[test]
+    fn passes_on_clean_spans() {
+        let conn = setup();
+        let opts = QueryOptions {
+            status_code: Some(0),
+            ..Default::default()
+        };
+        let assertion = Assertion {
+            no_error_spans: true,
+            max_p95_ms: Some(500.0),
+            min_spans: Some(2),
+            ..Default::default()
+        };
+        assert!(evaluate_assertion(&conn, &opts, &assertion).unwrap().passed);
+    }
+
+    #[test]
+    fn checks_logs() {
+        let conn = setup();
+        conn.execute(
+            "INSERT INTO logs VALUES ('2024-03-09 16:00:00', 'ERROR', 17, 'boom', 'api', NULL, NULL, '{}', '2024-03-09')",
+            [],
+        )
+        .unwrap();
+        let assertion = Assertion {
+            no_error_logs: true,
+            min_logs: Some(1),
+            ..Default::default()
+        };
+        let report = evaluate_assertion(&conn, &QueryOptions::default(), &assertion).unwrap();
+        assert!(!report.passed);
+        assert!(!report.checks[0].passed);
+        assert!(report.checks[1].passed);
+    }
+}
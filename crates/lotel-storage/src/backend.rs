@@ -0,0 +1,418 @@
+//! Storage backends, selected with `storage.backend` in the collector config. DuckDB (the
+//! default) and Parquet files queried through DuckDB support every command; SQLite (lighter)
+//! and ClickHouse (for very large captures) cover ingest, row queries, and pruning.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Result, bail};
+use chrono::NaiveDateTime;
+use serde::{Deserialize, Serialize};
+
+use crate::cancel::{Cancel, Watch};
+use crate::clickhouse::{ClickHouseBackend, ClickHouseConfig};
+#[cfg(feature = "duckdb")]
+use crate::db::DbConfig;
+use crate::db::ResourceLimits;
+use crate::history::PruneRun;
+use crate::ingest_incremental::{FileTrim, IncrementalIngester, IngestReport};
+#[cfg(feature = "duckdb")]
+use crate::parquet::ParquetBackend;
+use crate::prune::{PruneFilter, PruneReport};
+use crate::query::{LogResult, MetricResult, QueryOptions, Signal, TraceResult};
+use crate::sqlite::SqliteBackend;
+
+/// Which database stores the ingested telemetry.
+#[derive(Debug, Clone, Copy, Default, Deserialize, Serialize, PartialEq, Eq)]
+#[serde(rename_all = "lowercase")]
+pub enum BackendKind {
+    #[default]
+    Duckdb,
+    Sqlite,
+    Clickhouse,
+    Parquet,
+}
+
+impl BackendKind {
+    /// Database file name inside the data directory. ClickHouse keeps its data on the
+    /// server, so the name only places its ingest lock; Parquet keeps its cursors there.
+    pub fn file_name(self) -> &'static str {
+        match self {
+            Self::Duckdb => "lotel.db",
+            Self::Sqlite => "lotel.sqlite",
+            Self::Clickhouse => "lotel.clickhouse",
+            Self::Parquet => "lotel-parquet.db",
+        }
+    }
+
+    /// Whether queries run on DuckDB, so every command is available.
+    pub fn uses_duckdb(self) -> bool {
+        matches!(self, Self::Duckdb | Self::Parquet)
+    }
+}
+
+/// The `storage` config section.
+#[derive(Debug, Clone, Default, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct StorageConfig {
+    #[serde(default)]
+    pub backend: BackendKind,
+    /// Server settings for the ClickHouse backend.
+    #[serde(default)]
+    pub clickhouse: Option<ClickHouseConfig>,
+    /// DuckDB memory cap (e.g. "1GB"); 2GB by default.
+    #[serde(default)]
+    pub memory_limit: Option<String>,
+    /// DuckDB worker threads; up to 4 by default.
+    #[serde(default)]
+    pub threads: Option<usize>,
+}
+
+impl StorageConfig {
+    /// The DuckDB limits this config asks for, defaults filled in.
+    pub fn resource_limits(&self) -> ResourceLimits {
+        let defaults = ResourceLimits::default();
+        ResourceLimits {
+            memory_limit: self.memory_limit.clone().unwrap_or(defaults.memory_limit),
+            threads: self.threads.unwrap_or(defaults.threads),
+        }
+    }
+}
+
+/// Operations every backend supports. Analytics beyond these run on DuckDB only; callers
+/// reach them through [`Backend::duckdb`].
+pub trait Backend {
+    fn kind(&self) -> BackendKind;
+
+    /// Resume from the persisted per-file cursors.
+    fn load_cursors(&self, ingester: &mut IncrementalIngester) -> Result<()>;
+
+    fn ingest_new(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+    ) -> Result<IngestReport>;
+
+    fn consume(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64>;
+
+    /// Drop the JSONL lines older than `cutoff` from the front of the raw files; see
+    /// [`IncrementalIngester::trim_files`].
+    fn trim_files(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>>;
+
+    /// Delete all telemetry and ingest cursors, for a full re-ingest.
+    fn clear(&self) -> Result<()>;
+
+    fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>>;
+    fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>>;
+    fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>>;
+
+    /// Delete `signal`'s records older than `cutoff` that match `filter`.
+    fn prune_signal(
+        &self,
+        signal: Signal,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<PruneReport>;
+
+    fn prune(
+        &self,
+        cutoff: NaiveDateTime,
+        service: Option<&str>,
+        dry_run: bool,
+    ) -> Result<Vec<PruneReport>> {
+        self.prune_matching(cutoff, &PruneFilter::service(service), dry_run)
+    }
+
+    /// Delete records older than `cutoff` that match `filter`, for each signal it applies to.
+    fn prune_matching(
+        &self,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<Vec<PruneReport>> {
+        [Signal::Traces, Signal::Metrics, Signal::Logs]
+            .into_iter()
+            .filter(|&signal| filter.applies_to(signal))
+            .map(|signal| self.prune_signal(signal, cutoff, filter, dry_run))
+            .collect()
+    }
+
+    /// Time of the `n`-th newest record of `signal` matching `filter` per service, or overall
+    /// (as `None`) unless `per_service`; see [`crate::prune::nth_newest`].
+    fn nth_newest(
+        &self,
+        signal: Signal,
+        n: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+    ) -> Result<Vec<(Option<String>, NaiveDateTime)>>;
+
+    /// Delete all but the newest `keep` records of `signal` matching `filter`, counted per
+    /// service when `per_service`, with one report per pruned group. Records sharing the
+    /// time of the `keep`-th newest are kept too.
+    fn prune_keep(
+        &self,
+        signal: Signal,
+        keep: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+        dry_run: bool,
+    ) -> Result<Vec<PruneReport>> {
+        self.nth_newest(signal, keep, filter, per_service)?
+            .into_iter()
+            .map(|(svc, cutoff)| {
+                self.prune_signal(signal, cutoff, &filter.for_service(svc), dry_run)
+            })
+            .collect()
+    }
+
+    /// Append a run to the `prune_history` log.
+    fn record_prune(&self, run: &PruneRun) -> Result<()>;
+
+    /// The most recent prune runs, newest first.
+    fn prune_history(&self, limit: usize) -> Result<Vec<PruneRun>>;
+
+    /// The DuckDB connection, for the commands only DuckDB-based backends support.
+    #[cfg(feature = "duckdb")]
+    fn duckdb(&self) -> Option<&duckdb::Connection> {
+        None
+    }
+
+    /// Interrupt this backend's running queries when `cancel` fires, while the guards live.
+    /// Backends that cannot interrupt a query return none and stop between ingest steps.
+    fn watch(&self, _cancel: &Cancel) -> Vec<Watch> {
+        Vec::new()
+    }
+
+    /// Close the connections, reporting errors that dropping would swallow.
+    fn close(self: Box<Self>) -> Result<()> {
+        Ok(())
+    }
+}
+
+/// The default backend, wrapping the functions the rest of the crate provides.
+#[cfg(feature = "duckdb")]
+pub struct DuckDbBackend {
+    conn: duckdb::Connection,
+}
+
+#[cfg(feature = "duckdb")]
+impl DuckDbBackend {
+    pub fn new(conn: duckdb::Connection) -> Self {
+        Self { conn }
+    }
+}
+
+#[cfg(feature = "duckdb")]
+impl Backend for DuckDbBackend {
+    fn kind(&self) -> BackendKind {
+        BackendKind::Duckdb
+    }
+
+    fn load_cursors(&self, ingester: &mut IncrementalIngester) -> Result<()> {
+        ingester.load_cursors(&self.conn)
+    }
+
+    fn ingest_new(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+    ) -> Result<IngestReport> {
+        ingester.ingest_new(&self.conn, data_path)
+    }
+
+    fn consume(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        ingester.consume(&self.conn, data_path, archive_dir)
+    }
+
+    fn trim_files(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        ingester.trim_files(&self.conn, data_path, cutoff, dry_run)
+    }
+
+    fn clear(&self) -> Result<()> {
+        crate::ingest::clear_signal_tables(&self.conn)?;
+        crate::ingest::clear_ingest_cursors(&self.conn)
+    }
+
+    fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+        crate::query::query_traces(&self.conn, opts)
+    }
+
+    fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+        crate::query::query_metrics(&self.conn, opts)
+    }
+
+    fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>> {
+        crate::query::query_logs(&self.conn, opts)
+    }
+
+    fn prune_signal(
+        &self,
+        signal: Signal,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<PruneReport> {
+        crate::prune::prune_signal(&self.conn, signal, cutoff, filter, dry_run)
+    }
+
+    fn nth_newest(
+        &self,
+        signal: Signal,
+        n: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+    ) -> Result<Vec<(Option<String>, NaiveDateTime)>> {
+        crate::prune::nth_newest(&self.conn, signal, n, filter, per_service)
+    }
+
+    fn record_prune(&self, run: &PruneRun) -> Result<()> {
+        crate::history::record_prune(&self.conn, run)
+    }
+
+    fn prune_history(&self, limit: usize) -> Result<Vec<PruneRun>> {
+        crate::history::prune_history(&self.conn, limit)
+    }
+
+    fn duckdb(&self) -> Option<&duckdb::Connection> {
+        Some(&self.conn)
+    }
+
+    fn watch(&self, cancel: &Cancel) -> Vec<Watch> {
+        vec![cancel.watch(&self.conn)]
+    }
+
+    fn close(self: Box<Self>) -> Result<()> {
+        self.conn.close().map_err(|(_, e)| e)?;
+        Ok(())
+    }
+}
+
+/// Path of the `kind` database in the default data directory (~/.lotel/data).
+pub fn backend_db_path(kind: BackendKind) -> Result<PathBuf> {
+    Ok(crate::db::default_db_path()?.with_file_name(kind.file_name()))
+}
+
+/// Open the configured backend; `path` is the database file for the embedded ones.
+/// `read_only` applies to DuckDB; SQLite readers never block its writer. DuckDB instances get
+/// the config's resource limits.
+#[cfg_attr(not(feature = "duckdb"), allow(unused_variables))]
+pub fn open_backend(
+    config: &StorageConfig,
+    path: &Path,
+    read_only: bool,
+) -> Result<Box<dyn Backend>> {
+    Ok(match config.backend {
+        #[cfg(feature = "duckdb")]
+        BackendKind::Duckdb => {
+            let db_config = DbConfig {
+                limits: config.resource_limits(),
+                ..if read_only {
+                    DbConfig::read_only()
+                } else {
+                    DbConfig::default()
+                }
+            };
+            Box::new(DuckDbBackend::new(crate::db::open_db_with(
+                path, &db_config,
+            )?))
+        }
+        BackendKind::Sqlite => Box::new(SqliteBackend::open(path)?),
+        BackendKind::Clickhouse => Box::new(ClickHouseBackend::open(
+            &config.clickhouse.clone().unwrap_or_default(),
+        )?),
+        #[cfg(feature = "duckdb")]
+        BackendKind::Parquet => Box::new(ParquetBackend::open(
+            &parquet_dir(path),
+            path,
+            read_only,
+            &config.resource_limits(),
+        )?),
+        #[cfg(not(feature = "duckdb"))]
+        BackendKind::Duckdb | BackendKind::Parquet => {
+            bail!("this build of lotel has no duckdb feature; use the sqlite or clickhouse backend")
+        }
+    })
+}
+
+/// A read-only DuckDB connection for the analytics commands, or an error for backends
+/// that do not query through DuckDB.
+#[cfg(feature = "duckdb")]
+pub fn open_query_db(config: &StorageConfig) -> Result<duckdb::Connection> {
+    match config.backend {
+        BackendKind::Duckdb => {
+            let conn = crate::db::default_db_read_only()?;
+            crate::archive::attach_archives(&conn)?;
+            Ok(conn)
+        }
+        BackendKind::Parquet => {
+            let path = backend_db_path(BackendKind::Parquet)?;
+            let limits = config.resource_limits();
+            Ok(ParquetBackend::open(&parquet_dir(&path), &path, true, &limits)?.into_connection())
+        }
+        BackendKind::Sqlite | BackendKind::Clickhouse => {
+            bail!("this command needs the duckdb or parquet storage backend")
+        }
+    }
+}
+
+/// Parquet files live in `parquet/` next to the state database.
+#[cfg(feature = "duckdb")]
+fn parquet_dir(state_path: &Path) -> PathBuf {
+    state_path.with_file_name("parquet")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_storage_config() {
+        let config: StorageConfig = serde_json::from_str(r#"{"backend": "sqlite"}"#).unwrap();
+        assert_eq!(config.backend, BackendKind::Sqlite);
+        assert_eq!(config.backend.file_name(), "lotel.sqlite");
+        let config: StorageConfig = serde_json::from_str("{}").unwrap();
+        assert_eq!(config.backend, BackendKind::Duckdb);
+        assert!(serde_json::from_str::<StorageConfig>(r#"{"backend": "mysql"}"#).is_err());
+
+        let config: StorageConfig = serde_json::from_str(
+            r#"{"backend": "clickhouse", "clickhouse": {"url": "http://ch:8123", "user": "lotel"}}"#,
+        )
+        .unwrap();
+        let clickhouse = config.clickhouse.unwrap();
+        assert_eq!(clickhouse.url, "http://ch:8123");
+        assert_eq!(clickhouse.database, "lotel");
+        assert_eq!(clickhouse.user.as_deref(), Some("lotel"));
+
+        let config: StorageConfig =
+            serde_json::from_str(r#"{"memory_limit": "512MB", "threads": 2}"#).unwrap();
+        let limits = config.resource_limits();
+        assert_eq!(limits.memory_limit, "512MB");
+        assert_eq!(limits.threads, 2);
+        let limits = StorageConfig::default().resource_limits();
+        assert_eq!(limits.memory_limit, "2GB");
+        assert!((1..=4).contains(&limits.threads));
+    }
+}
@@ -0,0 +1,142 @@
+//! Query result cache for long-running readers such as `lotel serve`, where dashboards and
+//! scrapers repeat the same queries between ingests.
+
+use std::collections::{HashMap, VecDeque};
+use std::fmt::Debug;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::SystemTime;
+
+use anyhow::Result;
+
+/// Size and modification time of the database file and its WAL. Any write, such as an
+/// ingest, changes it.
+type Generation = [(u64, Option<SystemTime>); 2];
+
+/// Results keyed by query and parameters, all dropped when the database changes on disk.
+/// The oldest entry is evicted once `capacity` is reached.
+pub struct QueryCache<V> {
+    db_path: PathBuf,
+    capacity: usize,
+    state: Mutex<CacheState<V>>,
+}
+
+struct CacheState<V> {
+    generation: Option<Generation>,
+    entries: HashMap<String, V>,
+    order: VecDeque<String>,
+}
+
+impl<V: Clone> QueryCache<V> {
+    /// Cache results read from the database at `db_path`. A `capacity` of 0 disables it.
+    pub fn new(db_path: impl Into<PathBuf>, capacity: usize) -> Self {
+        Self {
+            db_path: db_path.into(),
+            capacity,
+            state: Mutex::new(CacheState {
+                generation: None,
+                entries: HashMap::new(),
+                order: VecDeque::new(),
+            }),
+        }
+    }
+
+    /// The cached result for `key`, or `compute`'s, which is cached if the database did not
+    /// change meanwhile. Errors are not cached. The lock is not held while computing, so
+    /// concurrent misses on one key may both compute.
+    pub fn get_or_try_insert(&self, key: &str, compute: impl FnOnce() -> Result<V>) -> Result<V> {
+        if self.capacity == 0 {
+            return compute();
+        }
+        let generation = generation(&self.db_path);
+        {
+            let mut state = self.state.lock().unwrap_or_else(|e| e.into_inner());
+            if state.generation != Some(generation) {
+                state.generation = Some(generation);
+                state.entries.clear();
+                state.order.clear();
+            }
+            if let Some(value) = state.entries.get(key) {
+                return Ok(value.clone());
+            }
+        }
+
+        let value = compute()?;
+        let mut state = self.state.lock().unwrap_or_else(|e| e.into_inner());
+        if state.generation == Some(generation)
+            && generation == self::generation(&self.db_path)
+            && !state.entries.contains_key(key)
+        {
+            if state.order.len() >= self.capacity
+                && let Some(oldest) = state.order.pop_front()
+            {
+                state.entries.remove(&oldest);
+            }
+            state.order.push_back(key.to_string());
+            state.entries.insert(key.to_string(), value.clone());
+        }
+        Ok(value)
+    }
+}
+
+/// A cache key from a query (a name or SQL text) and its parameters. Runs of whitespace in
+/// the query are collapsed so formatting differences do not split entries; parameters are
+/// kept verbatim.
+pub fn cache_key(query: &str, params: &impl Debug) -> String {
+    let query = query.split_whitespace().collect::<Vec<_>>().join(" ");
+    format!("{query} {params:?}")
+}
+
+fn generation(db_path: &Path) -> Generation {
+    let stat = |p: &Path| match std::fs::metadata(p) {
+        Ok(m) => (m.len(), m.modified().ok()),
+        Err(_) => (0, None),
+    };
+    [stat(db_path), stat(&db_path.with_extension("db.wal"))]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn caches_until_the_database_changes() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let db = tmp.path().join("lotel.db");
+        std::fs::write(&db, "v1").unwrap();
+        let cache = QueryCache::new(&db, 2);
+        let mut calls = 0;
+        let mut get = |key: &str| {
+            cache
+                .get_or_try_insert(key, || {
+                    calls += 1;
+                    Ok(calls)
+                })
+                .unwrap()
+        };
+        assert_eq!(get("a"), 1);
+        assert_eq!(get("a"), 1);
+        assert_eq!(get("b"), 2);
+
+        // A third key evicts the oldest.
+        assert_eq!(get("c"), 3);
+        assert_eq!(get("a"), 4);
+
+        // A write (here, a size change) invalidates everything.
+        std::fs::write(&db, "v2 longer").unwrap();
+        assert_eq!(get("c"), 5);
+    }
+
+    #[test]
+    fn keys_ignore_whitespace_differences() {
+        assert_eq!(
+            cache_key("SELECT  *\n FROM traces", &("svc", 1)),
+            cache_key("SELECT * FROM traces", &("svc", 1))
+        );
+        assert_ne!(
+            cache_key("traces", &("svc", 1)),
+            cache_key("traces", &("svc", 2))
+        );
+        assert_ne!(cache_key("traces", &"a  b"), cache_key("traces", &"a b"));
+    }
+}
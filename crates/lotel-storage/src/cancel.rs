@@ -0,0 +1,233 @@
+//! Cancellation of storage work in flight. A [`Cancel`] interrupts the running query on every
+//! connection it watches (DuckDB checks for interrupts between vectors, so long scans stop
+//! promptly), and [`Cancel::check`] lets multi-step work such as ingest stop between steps.
+//! The CLI cancels on Ctrl-C; `serve` and the collector cancel on a deadline.
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::mpsc::{self, RecvTimeoutError};
+use std::sync::{Arc, Mutex, Weak};
+use std::time::Duration;
+
+use anyhow::Result;
+#[cfg(feature = "duckdb")]
+use duckdb::Connection;
+
+/// The error of cancelled work. Interrupted queries report their own error with this as
+/// context, so test with `err.is::<Cancelled>()`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Cancelled;
+
+impl std::fmt::Display for Cancelled {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str("operation cancelled")
+    }
+}
+
+impl std::error::Error for Cancelled {}
+
+type Interrupt = Arc<dyn Fn() + Send + Sync>;
+
+/// A cancellation signal shared by clones. Once cancelled it stays cancelled.
+#[derive(Clone, Default)]
+pub struct Cancel(Arc<Inner>);
+
+#[derive(Default)]
+struct Inner {
+    cancelled: AtomicBool,
+    next_id: AtomicU64,
+    watched: Mutex<HashMap<u64, Interrupt>>,
+    /// Registration with the parent of a [`Cancel::child`].
+    parent: Mutex<Option<Watch>>,
+}
+
+impl Cancel {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// A signal that is cancelled with this one, but can also be cancelled (or time out)
+    /// on its own.
+    pub fn child(&self) -> Cancel {
+        let child = Cancel::new();
+        let weak: Weak<Inner> = Arc::downgrade(&child.0);
+        let link = self.watch_with(move || {
+            if let Some(inner) = weak.upgrade() {
+                Cancel(inner).cancel();
+            }
+        });
+        *lock(&child.0.parent) = Some(link);
+        child
+    }
+
+    /// Cancel: interrupt every watched connection, and fail later checks.
+    pub fn cancel(&self) {
+        self.0.cancelled.store(true, Ordering::SeqCst);
+        // Call outside the lock: an interrupt may drop the last handle on a child, whose
+        // registration then removes itself from this map.
+        let interrupts: Vec<Interrupt> = lock(&self.0.watched).values().cloned().collect();
+        for interrupt in interrupts {
+            interrupt();
+        }
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.0.cancelled.load(Ordering::SeqCst)
+    }
+
+    /// Fail with [`Cancelled`] once cancelled.
+    pub fn check(&self) -> Result<()> {
+        if self.is_cancelled() {
+            return Err(Cancelled.into());
+        }
+        Ok(())
+    }
+
+    /// Interrupt `conn`'s running query when cancelled, until the returned guard drops.
+    /// DuckDB only interrupts a query in progress, so pair this with [`Cancel::run`] or
+    /// [`Cancel::check`] between queries.
+    #[cfg(feature = "duckdb")]
+    pub fn watch(&self, conn: &Connection) -> Watch {
+        let handle = conn.interrupt_handle();
+        self.watch_with(move || handle.interrupt())
+    }
+
+    /// [`Cancel::watch`] with any interrupt function.
+    pub fn watch_with(&self, interrupt: impl Fn() + Send + Sync + 'static) -> Watch {
+        let id = self.0.next_id.fetch_add(1, Ordering::Relaxed);
+        let interrupt: Interrupt = Arc::new(interrupt);
+        lock(&self.0.watched).insert(id, interrupt.clone());
+        // A cancel racing with the insert may not have seen it.
+        if self.is_cancelled() {
+            interrupt();
+        }
+        Watch {
+            cancel: self.clone(),
+            id,
+        }
+    }
+
+    /// Cancel after `timeout` unless the returned guard drops first.
+    pub fn deadline(&self, timeout: Duration) -> Deadline {
+        let (stop, stopped) = mpsc::channel::<()>();
+        let cancel = self.clone();
+        std::thread::spawn(move || {
+            if let Err(RecvTimeoutError::Timeout) = stopped.recv_timeout(timeout) {
+                cancel.cancel();
+            }
+        });
+        Deadline { _stop: stop }
+    }
+
+    /// Run `f` unless already cancelled. If it fails after a cancel (typically an
+    /// interrupted query), the error gets [`Cancelled`] as context.
+    pub fn run<T>(&self, f: impl FnOnce() -> Result<T>) -> Result<T> {
+        self.check()?;
+        f().map_err(|e| {
+            if self.is_cancelled() && !e.is::<Cancelled>() {
+                e.context(Cancelled)
+            } else {
+                e
+            }
+        })
+    }
+}
+
+/// Registration from [`Cancel::watch`]; dropping it stops the watch.
+pub struct Watch {
+    cancel: Cancel,
+    id: u64,
+}
+
+impl Drop for Watch {
+    fn drop(&mut self) {
+        lock(&self.cancel.0.watched).remove(&self.id);
+    }
+}
+
+/// Guard from [`Cancel::deadline`]; dropping it disarms the deadline.
+pub struct Deadline {
+    _stop: mpsc::Sender<()>,
+}
+
+fn lock<T>(mutex: &Mutex<T>) -> std::sync::MutexGuard<'_, T> {
+    mutex.lock().unwrap_or_else(|e| e.into_inner())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::atomic::AtomicUsize;
+
+    #[test]
+    fn cancel_interrupts_watchers_and_children() {
+        let cancel = Cancel::new();
+        let hits = Arc::new(AtomicUsize::new(0));
+        let counter = |hits: &Arc<AtomicUsize>| {
+            let hits = hits.clone();
+            move || {
+                hits.fetch_add(1, Ordering::SeqCst);
+            }
+        };
+        let watch = cancel.watch_with(counter(&hits));
+        let dropped = cancel.watch_with(counter(&hits));
+        drop(dropped);
+        let child = cancel.child();
+        assert!(child.check().is_ok());
+
+        cancel.cancel();
+        assert_eq!(hits.load(Ordering::SeqCst), 1);
+        assert!(child.is_cancelled());
+        assert!(cancel.check().unwrap_err().is::<Cancelled>());
+
+        // Watching after the cancel interrupts right away.
+        let _late = cancel.watch_with(counter(&hits));
+        assert_eq!(hits.load(Ordering::SeqCst), 2);
+        drop(watch);
+
+        // Errors of work that was cancelled are marked as such.
+        let err = cancel.run(|| -> Result<()> { Ok(()) }).unwrap_err();
+        assert!(err.is::<Cancelled>());
+        let child = Cancel::new();
+        let err = child
+            .run(|| -> Result<()> {
+                child.cancel();
+                anyhow::bail!("INTERRUPT Error: Interrupted!")
+            })
+            .unwrap_err();
+        assert!(err.is::<Cancelled>());
+        assert!(format!("{err:#}").contains("Interrupted"));
+    }
+
+    #[test]
+    fn deadline_cancels_unless_dropped() {
+        let cancel = Cancel::new();
+        drop(cancel.deadline(Duration::from_millis(10)));
+        std::thread::sleep(Duration::from_millis(50));
+        assert!(!cancel.is_cancelled());
+
+        let _deadline = cancel.deadline(Duration::from_millis(10));
+        std::thread::sleep(Duration::from_millis(200));
+        assert!(cancel.is_cancelled());
+    }
+
+    #[test]
+    #[cfg(feature = "duckdb")]
+    fn interrupts_a_running_query() {
+        let conn = crate::db::open_in_memory().unwrap();
+        let cancel = Cancel::new();
+        let _watch = cancel.watch(&conn);
+        let _deadline = cancel.deadline(Duration::from_millis(100));
+        let err = cancel
+            .run(|| {
+                conn.query_row(
+                    "SELECT COUNT(*) FROM range(10000000000) a, range(10) b WHERE a.range % 7 = b.range",
+                    [],
+                    |row| row.get::<_, i64>(0),
+                )
+                .map_err(Into::into)
+            })
+            .unwrap_err();
+        assert!(err.is::<Cancelled>());
+    }
+}
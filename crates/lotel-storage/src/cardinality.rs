@@ -0,0 +1,125 @@
+//! Attribute cardinality: distinct values and rows per attribute key, for spotting
+//! high-cardinality keys worth dropping with the scrub allowlist/denylist.
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, Signal, append_where};
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct AttributeCardinality {
+    pub signal: String,
+    pub key: String,
+    pub distinct_values: i64,
+    /// Rows that carry the key.
+    pub rows: i64,
+    /// `rows` as a share of the signal's rows matching the filters.
+    pub row_fraction: f64,
+}
+
+/// Top-level attribute keys of `signal` rows matching `opts` (service, time range,
+/// attribute filters), by distinct-value count descending. `opts.limit` caps the keys.
+pub fn attribute_cardinality(
+    conn: &Connection,
+    signal: Signal,
+    opts: &QueryOptions,
+) -> Result<Vec<AttributeCardinality>> {
+    let mut rows = format!("SELECT attributes FROM {} WHERE 1=1", signal.table());
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_where(&mut rows, &mut params, opts, signal.time_column());
+
+    let mut query = format!(
+        "WITH matched AS ({rows}),
+        total AS (SELECT COUNT(*) AS n FROM matched),
+        pairs AS (
+            SELECT k.key,
+                   json_extract(m.attributes, '$.\"' || replace(k.key, '\"', '\\\"') || '\"') AS value
+            FROM matched m, unnest(json_keys(m.attributes)) AS k(key)
+            WHERE json_type(m.attributes) = 'OBJECT'
+        )
+        SELECT key,
+               COUNT(DISTINCT CAST(value AS VARCHAR)),
+               COUNT(*),
+               COUNT(*) / MAX(total.n)
+        FROM pairs, total
+        GROUP BY key
+        ORDER BY 2 DESC, 3 DESC, key"
+    );
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        query.push_str(&format!(" LIMIT {limit}"));
+    }
+
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(AttributeCardinality {
+                signal: signal.table().to_string(),
+                key: row.get(0)?,
+                distinct_values: row.get(1)?,
+                rows: row.get(2)?,
+                row_fraction: row.get(3)?,
+            })
+        })
+        .with_context(|| format!("computing attribute cardinality of {}", signal.table()))?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn ranks_keys_by_distinct_values() {
+        let conn = db::open_in_memory().unwrap();
+        let attrs = [
+            r#"{"http.method":"GET","user.id":"1"}"#,
+            r#"{"http.method":"GET","user.id":"2"}"#,
+            r#"{"http.method":"POST","user.id":"3"}"#,
+            r#"{"http.method":"GET"}"#,
+        ];
+        for (i, attrs) in attrs.iter().enumerate() {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', ?, NULL, 'op', 2, '2024-03-09 16:00:00', '2024-03-09 16:00:01', 1000, 0, 'api', ?, '2024-03-09')",
+                duckdb::params![format!("s{i}"), attrs],
+            )
+            .unwrap();
+        }
+
+        let keys = attribute_cardinality(&conn, Signal::Traces, &QueryOptions::default()).unwrap();
+        assert_eq!(
+            keys,
+            vec![
+                AttributeCardinality {
+                    signal: "traces".into(),
+                    key: "user.id".into(),
+                    distinct_values: 3,
+                    rows: 3,
+                    row_fraction: 0.75,
+                },
+                AttributeCardinality {
+                    signal: "traces".into(),
+                    key: "http.method".into(),
+                    distinct_values: 2,
+                    rows: 4,
+                    row_fraction: 1.0,
+                },
+            ]
+        );
+
+        let opts = QueryOptions {
+            service: Some("other".into()),
+            ..Default::default()
+        };
+        assert!(
+            attribute_cardinality(&conn, Signal::Logs, &opts)
+                .unwrap()
+                .is_empty()
+        );
+    }
+}
@@ -0,0 +1,878 @@
+//! ClickHouse storage backend over the HTTP interface, for captures too large for an embedded
+//! database. It supports ingest, the row queries, and pruning against a server the user runs
+//! (e.g. `docker run -p 8123:8123 clickhouse/clickhouse-server`).
+
+use std::cell::RefCell;
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result, bail};
+use chrono::NaiveDateTime;
+use serde::Deserialize;
+use serde::de::DeserializeOwned;
+use serde_json::json;
+
+use crate::backend::{Backend, BackendKind};
+use crate::history::{IngestHistoryEntry, PruneRun};
+use crate::ingest::ParsedRows;
+use crate::ingest_incremental::{
+    FileTrim, IncrementalIngester, IngestReport, IngestStore, cursor_key,
+};
+use crate::prune::{PruneFilter, PruneReport};
+use crate::query::{
+    AttrFilter, AttrOp, LogResult, MetricResult, QueryOptions, Signal, TraceResult, span_kind_name,
+    status_code_name,
+};
+
+/// The `storage.clickhouse` config section.
+#[derive(Debug, Clone, Deserialize, PartialEq)]
+#[serde(deny_unknown_fields)]
+pub struct ClickHouseConfig {
+    /// HTTP interface of the server.
+    #[serde(default = "default_url")]
+    pub url: String,
+    /// Created on first use.
+    #[serde(default = "default_database")]
+    pub database: String,
+    #[serde(default)]
+    pub user: Option<String>,
+    #[serde(default)]
+    pub password: Option<String>,
+}
+
+impl Default for ClickHouseConfig {
+    fn default() -> Self {
+        Self {
+            url: default_url(),
+            database: default_database(),
+            user: None,
+            password: None,
+        }
+    }
+}
+
+fn default_url() -> String {
+    "http://localhost:8123".to_string()
+}
+
+fn default_database() -> String {
+    "lotel".to_string()
+}
+
+const SCHEMA: [&str; 6] = [
+    "CREATE TABLE IF NOT EXISTS traces (
+        trace_id                 String,
+        span_id                  String,
+        parent_span_id           Nullable(String),
+        name                     String,
+        kind                     Int32,
+        start_time               DateTime64(9),
+        end_time                 Nullable(DateTime64(9)),
+        duration_ns              Int64,
+        status_code              Int32,
+        service_name             LowCardinality(String),
+        attributes               String,
+        date                     Date,
+        trace_state              Nullable(String),
+        flags                    Nullable(UInt32),
+        dropped_attributes_count Nullable(UInt32),
+        dropped_events_count     Nullable(UInt32),
+        dropped_links_count      Nullable(UInt32)
+    ) ENGINE = MergeTree PARTITION BY date ORDER BY (service_name, start_time)",
+    "CREATE TABLE IF NOT EXISTS metrics (
+        metric_name             LowCardinality(String),
+        metric_type             LowCardinality(String),
+        value                   Float64,
+        timestamp               DateTime64(9),
+        service_name            LowCardinality(String),
+        aggregation_temporality Nullable(Int32),
+        is_monotonic            Nullable(Bool),
+        unit                    Nullable(String),
+        attributes              String,
+        date                    Date
+    ) ENGINE = MergeTree PARTITION BY date ORDER BY (metric_name, service_name, timestamp)",
+    "CREATE TABLE IF NOT EXISTS logs (
+        timestamp       DateTime64(9),
+        severity        Nullable(String),
+        severity_number Nullable(Int32),
+        body            Nullable(String),
+        service_name    LowCardinality(String),
+        trace_id        Nullable(String),
+        span_id         Nullable(String),
+        attributes      String,
+        date            Date
+    ) ENGINE = MergeTree PARTITION BY date ORDER BY (service_name, timestamp)",
+    // Cursors only move through inserts; the newest row per file wins.
+    "CREATE TABLE IF NOT EXISTS ingest_cursors (
+        file_path   String,
+        byte_offset UInt64,
+        updated_at  DateTime64(6) DEFAULT now64(6)
+    ) ENGINE = ReplacingMergeTree(updated_at) ORDER BY file_path",
+    "CREATE TABLE IF NOT EXISTS ingest_history (
+        run_started_at DateTime64(6),
+        finished_at    DateTime64(6),
+        signal         LowCardinality(String),
+        file_path      String,
+        start_offset   UInt64,
+        end_offset     UInt64,
+        rows           Int64,
+        error          Nullable(String)
+    ) ENGINE = MergeTree ORDER BY run_started_at",
+    "CREATE TABLE IF NOT EXISTS prune_history (
+        started_at  DateTime64(6),
+        finished_at DateTime64(6),
+        trigger     LowCardinality(String),
+        traces      Int64,
+        metrics     Int64,
+        logs        Int64,
+        error       Nullable(String)
+    ) ENGINE = MergeTree ORDER BY started_at",
+];
+
+/// Rows and cursors of the file being ingested, sent on commit.
+#[derive(Default)]
+struct Pending {
+    inserts: Vec<(&'static str, String)>,
+    cursors: Vec<(String, u64)>,
+}
+
+pub struct ClickHouseBackend {
+    config: ClickHouseConfig,
+    client: reqwest::blocking::Client,
+    pending: RefCell<Option<Pending>>,
+}
+
+impl ClickHouseBackend {
+    /// Connect, creating the database and tables if needed.
+    pub fn open(config: &ClickHouseConfig) -> Result<Self> {
+        if config.database.is_empty()
+            || !config
+                .database
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '_')
+        {
+            bail!("invalid clickhouse database name {:?}", config.database);
+        }
+        let backend = Self {
+            config: config.clone(),
+            client: reqwest::blocking::Client::new(),
+            pending: RefCell::new(None),
+        };
+        backend
+            .request(
+                None,
+                &format!("CREATE DATABASE IF NOT EXISTS {}", config.database),
+                &Params::default(),
+                None,
+            )
+            .with_context(|| format!("connecting to clickhouse at {}", config.url))?;
+        for stmt in SCHEMA {
+            backend.execute(stmt, &Params::default())?;
+        }
+        Ok(backend)
+    }
+
+    /// Send one statement. With `data`, the statement goes in the URL and `data` is the body
+    /// (inserts); otherwise the statement is the body.
+    fn request(
+        &self,
+        database: Option<&str>,
+        sql: &str,
+        params: &Params,
+        data: Option<String>,
+    ) -> Result<String> {
+        let mut query: Vec<(String, String)> =
+            vec![("output_format_json_quote_64bit_integers".into(), "0".into())];
+        if let Some(db) = database {
+            query.push(("database".into(), db.to_string()));
+        }
+        query.extend(params.url_params());
+        let body = match data {
+            Some(data) => {
+                query.push(("query".into(), sql.to_string()));
+                data
+            }
+            None => sql.to_string(),
+        };
+        let mut req = self.client.post(&self.config.url).query(&query).body(body);
+        if let Some(user) = &self.config.user {
+            req = req.header("X-ClickHouse-User", user);
+        }
+        if let Some(password) = &self.config.password {
+            req = req.header("X-ClickHouse-Key", password);
+        }
+        let resp = req.send().context("sending clickhouse request")?;
+        let status = resp.status();
+        let text = resp.text().context("reading clickhouse response")?;
+        if !status.is_success() {
+            bail!("clickhouse returned {status}: {}", text.trim());
+        }
+        Ok(text)
+    }
+
+    fn execute(&self, sql: &str, params: &Params) -> Result<()> {
+        self.request(Some(&self.config.database), sql, params, None)?;
+        Ok(())
+    }
+
+    fn insert(&self, table: &str, rows: String) -> Result<()> {
+        self.request(
+            Some(&self.config.database),
+            &format!("INSERT INTO {table} FORMAT JSONEachRow"),
+            &Params::default(),
+            Some(rows),
+        )
+        .with_context(|| format!("inserting into {table}"))?;
+        Ok(())
+    }
+
+    fn select<T: DeserializeOwned>(&self, sql: &str, params: &Params) -> Result<Vec<T>> {
+        let text = self.request(
+            Some(&self.config.database),
+            &format!("{sql} FORMAT JSONEachRow"),
+            params,
+            None,
+        )?;
+        text.lines()
+            .map(|line| serde_json::from_str(line).context("decoding clickhouse row"))
+            .collect()
+    }
+
+    fn query<T: DeserializeOwned>(&self, signal: Signal, opts: &QueryOptions) -> Result<Vec<T>> {
+        let mut params = Params::default();
+        let from = from_clause(signal, opts, &mut params);
+        self.select(&format!("SELECT {}{from}", columns(signal)), &params)
+            .with_context(|| format!("querying {}", signal.table()))
+    }
+}
+
+impl Backend for ClickHouseBackend {
+    fn kind(&self) -> BackendKind {
+        BackendKind::Clickhouse
+    }
+
+    fn load_cursors(&self, ingester: &mut IncrementalIngester) -> Result<()> {
+        ingester.load_cursors_from(self)
+    }
+
+    fn ingest_new(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+    ) -> Result<IngestReport> {
+        ingester.ingest_into(self, data_path)
+    }
+
+    fn consume(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        ingester.consume_from(self, data_path, archive_dir)
+    }
+
+    fn trim_files(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        ingester.trim_files_from(self, data_path, cutoff, dry_run)
+    }
+
+    fn clear(&self) -> Result<()> {
+        for table in ["traces", "metrics", "logs", "ingest_cursors"] {
+            self.execute(&format!("TRUNCATE TABLE {table}"), &Params::default())
+                .with_context(|| format!("clearing {table}"))?;
+        }
+        Ok(())
+    }
+
+    fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+        let mut spans: Vec<TraceResult> = self.query(Signal::Traces, opts)?;
+        for span in &mut spans {
+            span.kind_name = span_kind_name(span.kind).to_string();
+            span.status = status_code_name(span.status_code).to_string();
+            parse_attributes(&mut span.attributes);
+        }
+        Ok(spans)
+    }
+
+    fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+        let mut metrics: Vec<MetricResult> = self.query(Signal::Metrics, opts)?;
+        for metric in &mut metrics {
+            parse_attributes(&mut metric.attributes);
+        }
+        Ok(metrics)
+    }
+
+    fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>> {
+        let mut logs: Vec<LogResult> = self.query(Signal::Logs, opts)?;
+        for log in &mut logs {
+            parse_attributes(&mut log.attributes);
+        }
+        Ok(logs)
+    }
+
+    fn prune_signal(
+        &self,
+        signal: Signal,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<PruneReport> {
+        #[derive(Deserialize)]
+        struct Count {
+            n: i64,
+        }
+
+        let mut params = Params::default();
+        let cutoff_param = params.push("DateTime64(9)", ch_time(cutoff));
+        let from = format!(
+            " FROM {} WHERE {} < {cutoff_param}{}",
+            signal.table(),
+            signal.time_column(),
+            prune_conditions(signal, filter, &mut params)
+        );
+        let count = self
+            .select::<Count>(&format!("SELECT count() AS n{from}"), &params)
+            .with_context(|| format!("counting {} for prune", signal.table()))?
+            .first()
+            .map_or(0, |c| c.n);
+        if !dry_run && count > 0 {
+            self.execute(&format!("DELETE{from}"), &params)
+                .with_context(|| format!("pruning {}", signal.table()))?;
+        }
+        Ok(PruneReport {
+            signal: signal.table().to_string(),
+            service_name: filter.service.clone(),
+            deleted: count,
+            cutoff: cutoff.format("%Y-%m-%dT%H:%M:%S").to_string(),
+        })
+    }
+
+    fn nth_newest(
+        &self,
+        signal: Signal,
+        n: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+    ) -> Result<Vec<(Option<String>, NaiveDateTime)>> {
+        #[derive(Deserialize)]
+        struct Nth {
+            svc: String,
+            t: NaiveDateTime,
+        }
+
+        let mut params = Params::default();
+        let conditions = prune_conditions(signal, filter, &mut params);
+        let ranked = crate::prune::ranked_by_time(signal, per_service, &conditions);
+        let n_param = params.push("UInt64", n.to_string());
+        let rows = self
+            .select::<Nth>(
+                &format!(
+                    "SELECT svc, replaceOne(toString(t), ' ', 'T') AS t FROM ({ranked}) \
+                     WHERE rn = {n_param}"
+                ),
+                &params,
+            )
+            .with_context(|| format!("finding the newest {n} {}", signal.table()))?;
+        Ok(rows
+            .into_iter()
+            .map(|row| (per_service.then_some(row.svc), row.t))
+            .collect())
+    }
+
+    fn record_prune(&self, run: &PruneRun) -> Result<()> {
+        let row = json!({
+            "started_at": ch_time(run.started_at),
+            "finished_at": ch_time(run.finished_at),
+            "trigger": run.trigger,
+            "traces": run.traces,
+            "metrics": run.metrics,
+            "logs": run.logs,
+            "error": run.error,
+        });
+        self.insert("prune_history", json_lines(&[row]))
+            .context("recording prune history")
+    }
+
+    fn prune_history(&self, limit: usize) -> Result<Vec<PruneRun>> {
+        #[derive(Deserialize)]
+        struct Row {
+            started_at: NaiveDateTime,
+            finished_at: NaiveDateTime,
+            trigger: String,
+            traces: i64,
+            metrics: i64,
+            logs: i64,
+            error: Option<String>,
+        }
+
+        let mut params = Params::default();
+        let limit = params.push("UInt64", limit.to_string());
+        let rows = self
+            .select::<Row>(
+                &format!(
+                    "SELECT replaceOne(toString(started_at), ' ', 'T') AS started_at, \
+                     replaceOne(toString(finished_at), ' ', 'T') AS finished_at, \
+                     trigger, traces, metrics, logs, error \
+                     FROM prune_history ORDER BY started_at DESC LIMIT {limit}"
+                ),
+                &params,
+            )
+            .context("querying prune history")?;
+        Ok(rows
+            .into_iter()
+            .map(|row| PruneRun {
+                started_at: row.started_at,
+                finished_at: row.finished_at,
+                trigger: row.trigger,
+                traces: row.traces,
+                metrics: row.metrics,
+                logs: row.logs,
+                error: row.error,
+            })
+            .collect())
+    }
+}
+
+/// ClickHouse has no multi-statement transactions, so a file's rows and cursor are buffered
+/// from `begin` and inserted on `commit`, rows first. A failure between the inserts can
+/// leave rows without their cursor, which are then ingested again on the next pass.
+impl IngestStore for ClickHouseBackend {
+    fn cursors(&self) -> Result<Vec<(PathBuf, u64)>> {
+        #[derive(Deserialize)]
+        struct Cursor {
+            file_path: String,
+            byte_offset: u64,
+        }
+
+        let cursors: Vec<Cursor> = self
+            .select(
+                "SELECT file_path, argMax(byte_offset, updated_at) AS byte_offset \
+                 FROM ingest_cursors GROUP BY file_path",
+                &Params::default(),
+            )
+            .context("querying cursors")?;
+        Ok(cursors
+            .into_iter()
+            .map(|c| (PathBuf::from(c.file_path), c.byte_offset))
+            .collect())
+    }
+
+    fn begin(&self) -> Result<()> {
+        *self.pending.borrow_mut() = Some(Pending::default());
+        Ok(())
+    }
+
+    fn append(&self, batches: &[ParsedRows]) -> Result<usize> {
+        let mut pending = self.pending.borrow_mut();
+        let pending = pending
+            .as_mut()
+            .context("clickhouse append outside begin/commit")?;
+        let mut written = 0;
+        for batch in batches {
+            let (table, lines): (&'static str, Vec<serde_json::Value>) = match batch {
+                ParsedRows::Spans(rows) => (
+                    "traces",
+                    rows.iter()
+                        .map(|row| {
+                            json!({
+                                "trace_id": row.trace_id,
+                                "span_id": row.span_id,
+                                "parent_span_id": row.parent_span_id,
+                                "name": row.name,
+                                "kind": row.kind,
+                                "start_time": row.start_time.map(ch_time),
+                                "end_time": row.end_time.map(ch_time),
+                                "duration_ns": row.duration_ns,
+                                "status_code": row.status_code,
+                                "service_name": row.service_name,
+                                "attributes": row.attributes,
+                                "date": row.date.map(|d| d.to_string()),
+                                "trace_state": row.trace_state,
+                                "flags": row.flags,
+                                "dropped_attributes_count": row.dropped_attributes_count,
+                                "dropped_events_count": row.dropped_events_count,
+                                "dropped_links_count": row.dropped_links_count,
+                            })
+                        })
+                        .collect(),
+                ),
+                ParsedRows::Metrics(rows) => (
+                    "metrics",
+                    rows.iter()
+                        .map(|row| {
+                            json!({
+                                "metric_name": row.metric_name,
+                                "metric_type": row.metric_type,
+                                "value": row.value,
+                                "timestamp": row.timestamp.map(ch_time),
+                                "service_name": row.service_name,
+                                "aggregation_temporality": row.temporality,
+                                "is_monotonic": row.monotonic,
+                                "unit": row.unit,
+                                "attributes": row.attributes,
+                                "date": row.date.map(|d| d.to_string()),
+                            })
+                        })
+                        .collect(),
+                ),
+                ParsedRows::Logs(rows) => (
+                    "logs",
+                    rows.iter()
+                        .map(|row| {
+                            json!({
+                                "timestamp": ch_time(row.timestamp),
+                                "severity": row.severity,
+                                "severity_number": row.severity_number,
+                                "body": row.body,
+                                "service_name": row.service_name,
+                                "trace_id": row.trace_id,
+                                "span_id": row.span_id,
+                                "attributes": row.attributes,
+                                "date": row.date.to_string(),
+                            })
+                        })
+                        .collect(),
+                ),
+            };
+            written += lines.len();
+            if !lines.is_empty() {
+                pending.inserts.push((table, json_lines(&lines)));
+            }
+        }
+        Ok(written)
+    }
+
+    fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()> {
+        let key = cursor_key(file_path)?.to_string();
+        match self.pending.borrow_mut().as_mut() {
+            Some(pending) => pending.cursors.push((key, offset)),
+            None => self.insert(
+                "ingest_cursors",
+                json_lines(&[json!({ "file_path": key, "byte_offset": offset })]),
+            )?,
+        }
+        Ok(())
+    }
+
+    fn delete_cursor(&self, file_path: &Path) -> Result<()> {
+        let mut params = Params::default();
+        let key = params.push("String", cursor_key(file_path)?.to_string());
+        self.execute(
+            &format!("DELETE FROM ingest_cursors WHERE file_path = {key}"),
+            &params,
+        )
+        .context("deleting ingest cursor")
+    }
+
+    fn commit(&self) -> Result<()> {
+        let Some(pending) = self.pending.borrow_mut().take() else {
+            return Ok(());
+        };
+        for (table, rows) in pending.inserts {
+            self.insert(table, rows)?;
+        }
+        if !pending.cursors.is_empty() {
+            let cursors: Vec<_> = pending
+                .cursors
+                .iter()
+                .map(|(path, offset)| json!({ "file_path": path, "byte_offset": offset }))
+                .collect();
+            self.insert("ingest_cursors", json_lines(&cursors))
+                .context("saving ingest cursor")?;
+        }
+        Ok(())
+    }
+
+    fn rollback(&self) -> Result<()> {
+        self.pending.borrow_mut().take();
+        Ok(())
+    }
+
+    fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()> {
+        let row = json!({
+            "run_started_at": ch_time(entry.run_started_at),
+            "finished_at": ch_time(entry.finished_at),
+            "signal": entry.signal,
+            "file_path": entry.file_path,
+            "start_offset": entry.start_offset,
+            "end_offset": entry.end_offset,
+            "rows": entry.rows,
+            "error": entry.error,
+        });
+        self.insert("ingest_history", json_lines(&[row]))
+            .context("recording ingest history")
+    }
+}
+
+/// Named query parameters (`{p0:String}`), sent as `param_p0` URL parameters.
+#[derive(Default)]
+struct Params {
+    values: Vec<String>,
+}
+
+impl Params {
+    /// Add a value and return its placeholder.
+    fn push(&mut self, ty: &str, value: String) -> String {
+        let placeholder = format!("{{p{}:{ty}}}", self.values.len());
+        self.values.push(value);
+        placeholder
+    }
+
+    fn url_params(&self) -> impl Iterator<Item = (String, String)> + '_ {
+        self.values
+            .iter()
+            .enumerate()
+            .map(|(i, v)| (format!("param_p{i}"), v.clone()))
+    }
+}
+
+/// Columns in result-field order; times are rendered as `YYYY-MM-DDTHH:MM:SS.f` so they
+/// deserialize straight into `NaiveDateTime`.
+fn columns(signal: Signal) -> &'static str {
+    match signal {
+        Signal::Traces => {
+            "trace_id, span_id, parent_span_id, name, kind, replaceOne(toString(start_time), ' ', 'T') AS start_time, replaceOne(toString(end_time), ' ', 'T') AS end_time, duration_ns, status_code, service_name, attributes, trace_state, flags, dropped_attributes_count, dropped_events_count, dropped_links_count"
+        }
+        Signal::Metrics => {
+            "metric_name, metric_type, value, replaceOne(toString(timestamp), ' ', 'T') AS timestamp, service_name, aggregation_temporality, is_monotonic, unit, attributes"
+        }
+        Signal::Logs => {
+            "replaceOne(toString(timestamp), ' ', 'T') AS timestamp, severity, severity_number, body, service_name, trace_id, span_id, attributes"
+        }
+    }
+}
+
+/// `FROM`, filters, ordering, and limit, mirroring [`crate::query::from_clause`].
+fn from_clause(signal: Signal, opts: &QueryOptions, params: &mut Params) -> String {
+    let time_col = signal.time_column();
+    let mut query = format!(" FROM {} WHERE 1=1", signal.table());
+    if let Some(svc) = &opts.service {
+        let p = params.push("String", svc.clone());
+        query.push_str(&format!(" AND service_name = {p}"));
+    }
+    if let Some(since) = opts.since {
+        let p = params.push("DateTime64(9)", ch_time(since));
+        query.push_str(&format!(" AND {time_col} >= {p}"));
+    }
+    if let Some(until) = opts.until {
+        let p = params.push("DateTime64(9)", ch_time(until));
+        query.push_str(&format!(" AND {time_col} <= {p}"));
+    }
+    for filter in &opts.attrs {
+        let keys = [filter.key.as_str()];
+        push_json_filter(&mut query, params, "attributes", &keys, filter);
+    }
+    if signal != Signal::Metrics
+        && let Some(trace_id) = &opts.trace_id
+    {
+        let p = params.push("String", crate::ids::normalize_id(trace_id));
+        query.push_str(&format!(" AND trace_id = {p}"));
+    }
+    match signal {
+        Signal::Traces => {
+            if let Some(kind) = opts.kind {
+                let p = params.push("Int32", kind.to_string());
+                query.push_str(&format!(" AND kind = {p}"));
+            }
+            if let Some(code) = opts.status_code {
+                let p = params.push("Int32", code.to_string());
+                query.push_str(&format!(" AND status_code = {p}"));
+            }
+            if let Some(min) = opts.min_duration_ns {
+                let p = params.push("Int64", min.to_string());
+                query.push_str(&format!(" AND duration_ns >= {p}"));
+            }
+        }
+        Signal::Metrics => {}
+        Signal::Logs => {
+            if let Some(min) = opts.min_severity {
+                let p = params.push("Int32", min.to_string());
+                query.push_str(&format!(" AND severity_number >= {p}"));
+            }
+            for filter in &opts.body_fields {
+                let keys: Vec<&str> = filter.key.split('.').collect();
+                push_json_filter(&mut query, params, "ifNull(body, '')", &keys, filter);
+            }
+        }
+    }
+
+    query.push_str(&format!(" ORDER BY {time_col} ASC"));
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        query.push_str(&format!(" LIMIT {limit}"));
+    }
+    query
+}
+
+/// Compare the value under `keys` in `json`: numerically against JSON numbers for numeric
+/// filters, otherwise as text. A missing key is NULL, so it only matches `!=`.
+/// A prune filter as ` AND ...` conditions, mirroring [`crate::prune::filter_conditions`].
+fn prune_conditions(signal: Signal, filter: &PruneFilter, params: &mut Params) -> String {
+    let mut cond = String::new();
+    if let Some(svc) = &filter.service {
+        let p = params.push("String", svc.clone());
+        cond.push_str(&format!(" AND service_name = {p}"));
+    }
+    if let Some(name) = &filter.name {
+        match crate::prune::name_column(signal) {
+            Some(column) => {
+                let p = params.push("String", glob_to_like(name));
+                cond.push_str(&format!(" AND {column} LIKE {p}"));
+            }
+            None => cond.push_str(" AND 0"),
+        }
+    }
+    for attr in &filter.attrs {
+        let keys = [attr.key.as_str()];
+        push_json_filter(&mut cond, params, "attributes", &keys, attr);
+    }
+    cond
+}
+
+/// A `*` glob as a `LIKE` pattern, escaping the characters `LIKE` treats specially.
+fn glob_to_like(glob: &str) -> String {
+    let mut pattern = String::new();
+    for c in glob.chars() {
+        match c {
+            '*' => pattern.push('%'),
+            '%' | '_' | '\\' => {
+                pattern.push('\\');
+                pattern.push(c);
+            }
+            c => pattern.push(c),
+        }
+    }
+    pattern
+}
+
+fn push_json_filter(
+    query: &mut String,
+    params: &mut Params,
+    json: &str,
+    keys: &[&str],
+    filter: &AttrFilter,
+) {
+    let path: Vec<String> = keys
+        .iter()
+        .map(|k| params.push("String", k.to_string()))
+        .collect();
+    let at = format!("{json}, {}", path.join(", "));
+    let (value, rhs) = match filter.value.parse::<f64>() {
+        Ok(n) => (
+            format!(
+                "if(JSONType({at}) IN ('Int64', 'UInt64', 'Double'), JSONExtractFloat({at}), NULL)"
+            ),
+            params.push("Float64", n.to_string()),
+        ),
+        Err(_) => (
+            format!(
+                "if(JSONHas({at}), if(JSONType({at}) = 'String', JSONExtractString({at}), JSONExtractRaw({at})), NULL)"
+            ),
+            params.push("String", filter.value.clone()),
+        ),
+    };
+    match filter.op {
+        AttrOp::Ne => query.push_str(&format!(" AND ({value} IS NULL OR {value} != {rhs})")),
+        op => query.push_str(&format!(" AND {value} {} {rhs}", op.sql())),
+    }
+}
+
+/// Attributes are stored as JSON text; return them as JSON.
+fn parse_attributes(attributes: &mut Option<serde_json::Value>) {
+    if let Some(serde_json::Value::String(text)) = attributes {
+        *attributes = serde_json::from_str(text).ok();
+    }
+}
+
+fn json_lines(rows: &[serde_json::Value]) -> String {
+    let mut out = String::new();
+    for row in rows {
+        out.push_str(&row.to_string());
+        out.push('\n');
+    }
+    out
+}
+
+fn ch_time(t: NaiveDateTime) -> String {
+    t.format("%Y-%m-%d %H:%M:%S%.9f").to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn builds_prune_conditions() {
+        let filter = PruneFilter {
+            service: Some("cron".into()),
+            name: Some("health_*".into()),
+            attrs: vec![AttrFilter::parse("http.route=/healthz").unwrap()],
+        };
+        let mut params = Params::default();
+        let cond = prune_conditions(Signal::Traces, &filter, &mut params);
+        assert!(cond.starts_with(" AND service_name = {p0:String} AND name LIKE {p1:String}"));
+        assert_eq!(params.values[1], "health\\_%");
+        assert_eq!(params.values[2], "http.route");
+
+        let mut params = Params::default();
+        assert!(prune_conditions(Signal::Logs, &filter, &mut params).contains(" AND 0"));
+    }
+
+    #[test]
+    fn builds_parameterized_filters() {
+        let opts = QueryOptions {
+            service: Some("checkout".into()),
+            since: Some("2024-03-09T16:00:00".parse().unwrap()),
+            attrs: vec![
+                AttrFilter::parse("retries>2").unwrap(),
+                AttrFilter::parse("http.method!=GET").unwrap(),
+            ],
+            limit: Some(10),
+            ..Default::default()
+        };
+        let mut params = Params::default();
+        let sql = from_clause(Signal::Traces, &opts, &mut params);
+        assert!(sql.starts_with(
+            " FROM traces WHERE 1=1 AND service_name = {p0:String} AND start_time >= {p1:DateTime64(9)}"
+        ));
+        assert!(sql.contains("JSONExtractFloat(attributes, {p2:String}), NULL) > {p3:Float64}"));
+        assert!(sql.contains("IS NULL OR if(JSONHas(attributes, {p4:String})"));
+        assert!(sql.ends_with(" ORDER BY start_time ASC LIMIT 10"));
+        assert_eq!(
+            params.values,
+            [
+                "checkout",
+                "2024-03-09 16:00:00.000000000",
+                "retries",
+                "2",
+                "http.method",
+                "GET"
+            ]
+        );
+
+        // Body fields address nested keys one segment per argument.
+        let opts = QueryOptions {
+            body_fields: vec![AttrFilter::parse("user.id=42").unwrap()],
+            ..Default::default()
+        };
+        let mut params = Params::default();
+        let sql = from_clause(Signal::Logs, &opts, &mut params);
+        assert!(sql.contains("JSONType(ifNull(body, ''), {p0:String}, {p1:String})"));
+        assert_eq!(params.values, ["user", "id", "42"]);
+    }
+
+    #[test]
+    fn decodes_rows() {
+        let line = r#"{"trace_id":"t1","span_id":"s1","parent_span_id":null,"name":"GET /","kind":2,"start_time":"2024-03-09T16:00:00.025000000","end_time":null,"duration_ns":1000,"status_code":2,"service_name":"checkout","attributes":"{\"retries\":3}","trace_state":null,"flags":null,"dropped_attributes_count":null,"dropped_events_count":null,"dropped_links_count":null}"#;
+        let mut span: TraceResult = serde_json::from_str(line).unwrap();
+        parse_attributes(&mut span.attributes);
+        assert_eq!(span.start_time.to_string(), "2024-03-09 16:00:00.025");
+        assert_eq!(span.attributes.unwrap()["retries"], 3);
+    }
+}
@@ -0,0 +1,205 @@
+//! Trace completeness: spans whose parent never arrived and traces without exactly one root,
+//! the usual symptoms of broken context propagation (or of a service not exporting).
+
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, append_span_filters};
+
+/// A span whose `parent_span_id` does not exist in the store.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct OrphanSpan {
+    pub trace_id: String,
+    pub span_id: String,
+    pub parent_span_id: String,
+    pub name: String,
+    pub service_name: String,
+    pub start_time: NaiveDateTime,
+}
+
+/// A trace with no root span, several roots, or orphan spans.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct IncompleteTrace {
+    pub trace_id: String,
+    pub start_time: NaiveDateTime,
+    pub span_count: i64,
+    pub root_spans: i64,
+    pub orphan_spans: i64,
+    pub services: Vec<String>,
+    /// `no_root`, `multiple_roots`, and/or `orphan_spans`.
+    pub issues: Vec<String>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct CompletenessReport {
+    /// Traces with at least one span matching the filters.
+    pub traces_checked: i64,
+    pub incomplete_traces: Vec<IncompleteTrace>,
+    pub orphan_spans: Vec<OrphanSpan>,
+}
+
+const IS_ROOT: &str = "(t.parent_span_id IS NULL OR t.parent_span_id = '')";
+const IS_ORPHAN: &str = "(t.parent_span_id <> '' AND NOT EXISTS (
+    SELECT 1 FROM traces p WHERE p.trace_id = t.trace_id AND p.span_id = t.parent_span_id))";
+
+/// Check every trace that has a span matching `opts`. Parents are looked up across the whole
+/// store, not just the filtered window. `opts.limit` caps each list (not the counts).
+pub fn trace_completeness(conn: &Connection, opts: &QueryOptions) -> Result<CompletenessReport> {
+    let mut matched = String::from("SELECT DISTINCT trace_id FROM traces WHERE 1=1");
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut matched, &mut params, opts);
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let limit = match opts.limit {
+        Some(limit) if limit > 0 => format!(" LIMIT {limit}"),
+        _ => String::new(),
+    };
+
+    let traces_checked = conn
+        .query_row(
+            &format!("SELECT COUNT(*) FROM ({matched})"),
+            param_refs.as_slice(),
+            |row| row.get(0),
+        )
+        .context("counting traces")?;
+
+    let query = format!(
+        "WITH matched AS ({matched})
+        SELECT t.trace_id,
+               MIN(t.start_time),
+               COUNT(*),
+               COUNT(*) FILTER (WHERE {IS_ROOT}),
+               COUNT(*) FILTER (WHERE {IS_ORPHAN}),
+               to_json(list_sort(list(DISTINCT t.service_name)))::VARCHAR
+        FROM traces t JOIN matched USING (trace_id)
+        GROUP BY t.trace_id
+        HAVING COUNT(*) FILTER (WHERE {IS_ROOT}) <> 1 OR COUNT(*) FILTER (WHERE {IS_ORPHAN}) > 0
+        ORDER BY MIN(t.start_time){limit}"
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let incomplete_traces = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            let root_spans: i64 = row.get(3)?;
+            let orphan_spans: i64 = row.get(4)?;
+            let services: Option<String> = row.get(5)?;
+            let mut issues = Vec::new();
+            match root_spans {
+                0 => issues.push("no_root".to_string()),
+                1 => {}
+                _ => issues.push("multiple_roots".to_string()),
+            }
+            if orphan_spans > 0 {
+                issues.push("orphan_spans".to_string());
+            }
+            Ok(IncompleteTrace {
+                trace_id: row.get(0)?,
+                start_time: row.get(1)?,
+                span_count: row.get(2)?,
+                root_spans,
+                orphan_spans,
+                services: services
+                    .and_then(|s| serde_json::from_str(&s).ok())
+                    .unwrap_or_default(),
+                issues,
+            })
+        })
+        .context("checking trace completeness")?
+        .collect::<duckdb::Result<Vec<_>>>()?;
+
+    let query = format!(
+        "WITH matched AS ({matched})
+        SELECT t.trace_id, t.span_id, t.parent_span_id, t.name, t.service_name, t.start_time
+        FROM traces t JOIN matched USING (trace_id)
+        WHERE {IS_ORPHAN}
+        ORDER BY t.start_time, t.span_id{limit}"
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let orphan_spans = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(OrphanSpan {
+                trace_id: row.get(0)?,
+                span_id: row.get(1)?,
+                parent_span_id: row.get(2)?,
+                name: row.get(3)?,
+                service_name: row.get(4)?,
+                start_time: row.get(5)?,
+            })
+        })
+        .context("finding orphan spans")?
+        .collect::<duckdb::Result<Vec<_>>>()?;
+
+    Ok(CompletenessReport {
+        traces_checked,
+        incomplete_traces,
+        orphan_spans,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn finds_orphans_and_rootless_traces() {
+        let conn = db::open_in_memory().unwrap();
+        // (trace, span, parent, service, start second)
+        let spans = [
+            // Complete.
+            ("t1", "a", None, "frontend", 0),
+            ("t1", "b", Some("a"), "checkout", 1),
+            // Root present, but checkout's parent span (from an unexported proxy) is missing.
+            ("t2", "c", None, "frontend", 2),
+            ("t2", "d", Some("gone"), "checkout, eu", 3),
+            // Context lost entirely: only an orphan.
+            ("t3", "e", Some("lost"), "payments", 4),
+        ];
+        for (trace_id, span_id, parent, service, sec) in spans {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, ?, 'op', 2, ?, NULL, 1000, 0, ?, '{}', '2024-03-09')",
+                duckdb::params![
+                    trace_id,
+                    span_id,
+                    parent,
+                    format!("2024-03-09 16:00:0{sec}"),
+                    service
+                ],
+            )
+            .unwrap();
+        }
+
+        let report = trace_completeness(&conn, &QueryOptions::default()).unwrap();
+        assert_eq!(report.traces_checked, 3);
+        let traces: Vec<(&str, &[String])> = report
+            .incomplete_traces
+            .iter()
+            .map(|t| (t.trace_id.as_str(), t.issues.as_slice()))
+            .collect();
+        assert_eq!(
+            traces,
+            [
+                ("t2", &["orphan_spans".to_string()][..]),
+                ("t3", &["no_root".to_string(), "orphan_spans".into()][..]),
+            ]
+        );
+        assert_eq!(
+            report.incomplete_traces[0].services,
+            ["checkout, eu", "frontend"]
+        );
+        let orphans: Vec<&str> = report
+            .orphan_spans
+            .iter()
+            .map(|s| s.span_id.as_str())
+            .collect();
+        assert_eq!(orphans, ["d", "e"]);
+
+        let opts = QueryOptions {
+            service: Some("payments".into()),
+            ..Default::default()
+        };
+        let report = trace_completeness(&conn, &opts).unwrap();
+        assert_eq!(report.traces_checked, 1);
+        assert_eq!(report.orphan_spans[0].parent_span_id, "lost");
+    }
+}
@@ -1,7 +1,15 @@
+#[cfg(feature = "duckdb")]
 use std::fs;
+#[cfg(feature = "duckdb")]
 use std::path::Path;
+use std::path::PathBuf;
+use std::sync::OnceLock;
+use std::time::Duration;
 
+#[cfg(feature = "duckdb")]
 use duckdb::Connection;
+#[cfg(feature = "duckdb")]
+use serde::Serialize;
 use thiserror::Error;
 
 #[derive(Debug, Error)]
@@ -13,39 +21,446 @@ pub enum StorageError {
         path: String,
         source: std::io::Error,
     },
+    #[cfg(feature = "duckdb")]
+    #[error("database {path} is locked by another process after {attempts} attempts: {source}")]
+    Locked {
+        path: String,
+        attempts: u32,
+        source: duckdb::Error,
+    },
+    #[error("replacing {path}: {source}")]
+    Replace {
+        path: String,
+        source: std::io::Error,
+    },
+    #[cfg(feature = "duckdb")]
     #[error("duckdb error: {0}")]
     DuckDb(#[from] duckdb::Error),
 }
 
+/// DuckDB resource caps applied to every connection, so a query on a laptop leaves memory
+/// and cores for everything else. DuckDB spills larger sorts and joins to disk.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ResourceLimits {
+    /// `memory_limit` setting, e.g. "2GB".
+    pub memory_limit: String,
+    /// `threads` setting.
+    pub threads: usize,
+}
+
+impl Default for ResourceLimits {
+    fn default() -> Self {
+        Self {
+            memory_limit: "2GB".to_string(),
+            threads: std::thread::available_parallelism()
+                .map(|n| n.get())
+                .unwrap_or(1)
+                .min(4),
+        }
+    }
+}
+
+static RESOURCE_LIMITS: OnceLock<ResourceLimits> = OnceLock::new();
+
+/// Set the process-wide limits from config and flags; called once at startup. Later calls
+/// are ignored.
+pub fn set_resource_limits(limits: ResourceLimits) {
+    let _ = RESOURCE_LIMITS.set(limits);
+}
+
+/// The limits new connections get: those set at startup, or the defaults.
+pub fn resource_limits() -> ResourceLimits {
+    RESOURCE_LIMITS.get().cloned().unwrap_or_default()
+}
+
+/// Apply `limits` to a connection's database instance.
+#[cfg(feature = "duckdb")]
+pub(crate) fn apply_limits(conn: &Connection, limits: &ResourceLimits) -> duckdb::Result<()> {
+    conn.execute_batch(&format!(
+        "SET memory_limit = {}; SET threads = {};",
+        sql_string(&limits.memory_limit),
+        limits.threads.max(1)
+    ))
+}
+
+/// Environment variable holding the encryption key. When set, databases are created and
+/// opened encrypted with it (DuckDB's AES-GCM encryption); the collector daemon inherits it
+/// from `lotel start`.
+pub const ENCRYPTION_KEY_ENV: &str = "LOTEL_DB_KEY";
+
+/// Environment variable overriding the data directory (~/.lotel/data). Named collectors run
+/// with it set to their own directory; commands pointed at one read its database.
+pub const DATA_DIR_ENV: &str = "LOTEL_DATA_DIR";
+
+/// Connection settings shared by every command that opens the database, so ingest and
+/// query paths agree on how to coexist with DuckDB's single-writer lock.
+#[derive(Clone)]
+pub struct DbConfig {
+    /// Open without write access. Multiple read-only processes may share the file,
+    /// but not while a writer holds it.
+    pub read_only: bool,
+    /// Attempts made while another process holds the file lock.
+    pub attempts: u32,
+    /// Delay before the first retry; doubled after each failed attempt.
+    pub backoff: Duration,
+    /// Key the database file is encrypted with; read from `LOTEL_DB_KEY` by default.
+    pub encryption_key: Option<String>,
+    /// Memory and thread caps; [`resource_limits`] by default.
+    pub limits: ResourceLimits,
+}
+
+impl Default for DbConfig {
+    fn default() -> Self {
+        Self {
+            read_only: false,
+            attempts: 5,
+            backoff: Duration::from_millis(50),
+            encryption_key: std::env::var(ENCRYPTION_KEY_ENV)
+                .ok()
+                .filter(|k| !k.is_empty()),
+            limits: resource_limits(),
+        }
+    }
+}
+
+// Hand-written so the key never reaches a log line.
+impl std::fmt::Debug for DbConfig {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("DbConfig")
+            .field("read_only", &self.read_only)
+            .field("attempts", &self.attempts)
+            .field("backoff", &self.backoff)
+            .field("encrypted", &self.encryption_key.is_some())
+            .field("limits", &self.limits)
+            .finish()
+    }
+}
+
+impl DbConfig {
+    /// Settings for query commands: read-only, retrying while an ingest holds the lock.
+    pub fn read_only() -> Self {
+        Self {
+            read_only: true,
+            attempts: 8,
+            ..Self::default()
+        }
+    }
+}
+
 /// Open a DuckDB connection at the given path, creating parent directories
 /// and running migrations.
+#[cfg(feature = "duckdb")]
 pub fn open_db(path: &Path) -> Result<Connection, StorageError> {
+    open_db_with(path, &DbConfig::default())
+}
+
+/// Open a DuckDB connection with explicit access settings. Read-only opens of a
+/// database that does not exist yet, or that an older lotel wrote, create or migrate it
+/// first.
+#[cfg(feature = "duckdb")]
+pub fn open_db_with(path: &Path, config: &DbConfig) -> Result<Connection, StorageError> {
     if let Some(parent) = path.parent() {
         fs::create_dir_all(parent).map_err(|e| StorageError::CreateDir {
             path: parent.display().to_string(),
             source: e,
         })?;
     }
-    let conn = Connection::open(path)?;
-    migrate(&conn)?;
-    Ok(conn)
+    if config.read_only && (!path.exists() || outdated(path, config)?) {
+        // Create or migrate; the writable connection closes at the end of the statement.
+        open_db_with(
+            path,
+            &DbConfig {
+                read_only: false,
+                ..config.clone()
+            },
+        )?;
+    }
+
+    let mut delay = config.backoff;
+    let mut attempt = 1;
+    loop {
+        match connect(path, config.read_only, config.encryption_key.as_deref()) {
+            Ok(conn) => {
+                apply_limits(&conn, &config.limits)?;
+                if !config.read_only {
+                    migrate(&conn)?;
+                }
+                return Ok(conn);
+            }
+            Err(e) if is_lock_conflict(&e) && attempt < config.attempts.max(1) => {
+                tracing::debug!("{} is locked, retrying in {delay:?}", path.display());
+                std::thread::sleep(delay);
+                delay *= 2;
+                attempt += 1;
+            }
+            Err(e) if is_lock_conflict(&e) => {
+                return Err(StorageError::Locked {
+                    path: path.display().to_string(),
+                    attempts: attempt,
+                    source: e,
+                });
+            }
+            Err(e) => return Err(e.into()),
+        }
+    }
+}
+
+/// Whether the database at `path` lacks tables or columns `migrate` would add.
+#[cfg(feature = "duckdb")]
+fn outdated(path: &Path, config: &DbConfig) -> Result<bool, StorageError> {
+    match connect(path, true, config.encryption_key.as_deref()) {
+        Ok(conn) => needs_migration(&conn),
+        // A writer holds the database, and writers migrate when they open it.
+        Err(e) if is_lock_conflict(&e) => Ok(false),
+        Err(e) => Err(e.into()),
+    }
+}
+
+#[cfg(feature = "duckdb")]
+fn connect(path: &Path, read_only: bool, key: Option<&str>) -> duckdb::Result<Connection> {
+    if let Some(key) = key {
+        // Encrypted files can only be attached; `USE` makes it the default catalog so
+        // unqualified table names resolve as they do for a plain open.
+        let conn = Connection::open_in_memory()?;
+        let mode = if read_only { ", READ_ONLY" } else { "" };
+        conn.execute_batch(&format!(
+            "ATTACH {} AS lotel (ENCRYPTION_KEY {}{mode}); USE lotel;",
+            sql_string(&path.to_string_lossy()),
+            sql_string(key)
+        ))?;
+        return Ok(conn);
+    }
+    if read_only {
+        let config = duckdb::Config::default().access_mode(duckdb::AccessMode::ReadOnly)?;
+        Connection::open_with_flags(path, config)
+    } else {
+        Connection::open(path)
+    }
+}
+
+/// DuckDB reports a conflicting file lock as an IO error mentioning the lock.
+#[cfg(feature = "duckdb")]
+fn is_lock_conflict(e: &duckdb::Error) -> bool {
+    e.to_string().contains("Could not set lock")
+}
+
+/// Rewrite the unencrypted database at `path` encrypted with `key`. The caller must hold
+/// the ingest lock.
+#[cfg(feature = "duckdb")]
+pub fn encrypt_db(path: &Path, key: &str) -> Result<(), StorageError> {
+    rewrite_db(path, None, Some(key), false, &resource_limits())
+}
+
+/// Sizes reported by [`compact_db`].
+#[cfg(feature = "duckdb")]
+#[derive(Debug, Serialize)]
+pub struct CompactReport {
+    pub path: String,
+    pub before_bytes: u64,
+    pub after_bytes: u64,
+    pub sorted: bool,
+}
+
+/// Rewrite the database at `path` into a fresh file, dropping the space that deleted rows
+/// leave behind (DuckDB does not shrink a file in place). With `sort`, telemetry is
+/// rewritten ordered by day, service, and time so zone maps prune well again. The caller
+/// must hold the ingest lock.
+#[cfg(feature = "duckdb")]
+pub fn compact_db(
+    path: &Path,
+    config: &DbConfig,
+    sort: bool,
+) -> Result<CompactReport, StorageError> {
+    let before_bytes = db_file_bytes(path);
+    let key = config.encryption_key.as_deref();
+    rewrite_db(path, key, key, sort, &config.limits)?;
+    Ok(CompactReport {
+        path: path.display().to_string(),
+        before_bytes,
+        after_bytes: db_file_bytes(path),
+        sorted: sort,
+    })
+}
+
+/// Size of the database file plus its write-ahead log.
+#[cfg(feature = "duckdb")]
+fn db_file_bytes(path: &Path) -> u64 {
+    let size = |p: &Path| fs::metadata(p).map(|m| m.len()).unwrap_or(0);
+    size(path) + size(&path.with_extension("db.wal"))
+}
+
+/// Copy every table of `path` into a freshly migrated file next to it, then rename the copy
+/// over the original, so a failure leaves the original untouched.
+#[cfg(feature = "duckdb")]
+fn rewrite_db(
+    path: &Path,
+    from_key: Option<&str>,
+    to_key: Option<&str>,
+    sort: bool,
+    limits: &ResourceLimits,
+) -> Result<(), StorageError> {
+    let tmp = path.with_extension("db.rewrite");
+    let replace_err = |source| StorageError::Replace {
+        path: path.display().to_string(),
+        source,
+    };
+    if tmp.exists() {
+        fs::remove_file(&tmp).map_err(replace_err)?;
+    }
+    let options = |key: Option<&str>| match key {
+        Some(key) => format!(" (ENCRYPTION_KEY {})", sql_string(key)),
+        None => String::new(),
+    };
+    {
+        let conn = Connection::open_in_memory()?;
+        apply_limits(&conn, limits)?;
+        // Checkpointing first folds the old WAL into the file being copied.
+        conn.execute_batch(&format!(
+            "ATTACH {} AS old{};
+             CHECKPOINT old;
+             ATTACH {} AS new{};
+             USE new;",
+            sql_string(&path.to_string_lossy()),
+            options(from_key),
+            sql_string(&tmp.to_string_lossy()),
+            options(to_key)
+        ))?;
+        migrate(&conn)?;
+
+        let tables: Vec<String> = conn
+            .prepare(
+                "SELECT table_name FROM information_schema.tables
+                 WHERE table_catalog = 'old' AND table_schema = 'main'
+                   AND table_type = 'BASE TABLE'",
+            )?
+            .query_map([], |row| row.get(0))?
+            .collect::<duckdb::Result<_>>()?;
+        for table in &tables {
+            let order = match (sort, table.as_str()) {
+                (true, "traces") => " ORDER BY date, service_name, start_time",
+                (true, "metrics" | "logs") => " ORDER BY date, service_name, timestamp",
+                _ => "",
+            };
+            let table = format!("\"{}\"", table.replace('"', "\"\""));
+            conn.execute_batch(&format!(
+                "CREATE TABLE IF NOT EXISTS new.main.{table} AS FROM old.main.{table} LIMIT 0;
+                 INSERT INTO new.main.{table} BY NAME SELECT * FROM old.main.{table}{order};"
+            ))?;
+        }
+        conn.execute_batch("USE memory; DETACH new; DETACH old;")?;
+    }
+    fs::rename(&tmp, path).map_err(replace_err)
+}
+
+/// `s` as a SQL string literal, for statements that take no parameters (`ATTACH`, `COPY`,
+/// `SET`, and table functions such as `read_parquet`).
+#[cfg(feature = "duckdb")]
+pub(crate) fn sql_string(s: &str) -> String {
+    format!("'{}'", s.replace('\'', "''"))
+}
+
+/// `path` as a SQL string literal; DuckDB takes paths as UTF-8 text.
+#[cfg(feature = "duckdb")]
+pub(crate) fn sql_path(path: &Path) -> anyhow::Result<String> {
+    match path.to_str() {
+        Some(s) => Ok(sql_string(s)),
+        None => anyhow::bail!("path {} is not valid UTF-8", path.display()),
+    }
 }
 
 /// Open an in-memory DuckDB with migrations applied (for testing).
+#[cfg(feature = "duckdb")]
 pub fn open_in_memory() -> Result<Connection, StorageError> {
     let conn = Connection::open_in_memory()?;
     migrate(&conn)?;
     Ok(conn)
 }
 
+/// Path of the default DuckDB: ~/.lotel/data/lotel.db, or lotel.db in `LOTEL_DATA_DIR`.
+pub fn default_db_path() -> Result<PathBuf, StorageError> {
+    if let Some(dir) = std::env::var_os(DATA_DIR_ENV).filter(|d| !d.is_empty()) {
+        return Ok(PathBuf::from(dir).join("lotel.db"));
+    }
+    let home = dirs::home_dir().ok_or(StorageError::NoHome)?;
+    Ok(home.join(".lotel").join("data").join("lotel.db"))
+}
+
 /// Open the default DuckDB at ~/.lotel/data/lotel.db.
+#[cfg(feature = "duckdb")]
 pub fn default_db() -> Result<Connection, StorageError> {
-    let home = dirs::home_dir().ok_or(StorageError::NoHome)?;
-    let db_path = home.join(".lotel").join("data").join("lotel.db");
-    open_db(&db_path)
+    open_db(&default_db_path()?)
+}
+
+/// Open the default DuckDB read-only, for query commands.
+#[cfg(feature = "duckdb")]
+pub fn default_db_read_only() -> Result<Connection, StorageError> {
+    open_db_with(&default_db_path()?, &DbConfig::read_only())
+}
+
+/// Span fields added after the initial schema, with their types; ALTER keeps existing
+/// databases usable.
+#[cfg(feature = "duckdb")]
+const ADDED_TRACE_COLUMNS: [(&str, &str); 5] = [
+    ("trace_state", "VARCHAR"),
+    ("flags", "UINTEGER"),
+    ("dropped_attributes_count", "UINTEGER"),
+    ("dropped_events_count", "UINTEGER"),
+    ("dropped_links_count", "UINTEGER"),
+];
+
+#[cfg(feature = "duckdb")]
+const TRACES_INDEX: &str = "CREATE INDEX IF NOT EXISTS traces_trace_id_idx ON traces (trace_id)";
+
+/// Tables `migrate` creates.
+#[cfg(feature = "duckdb")]
+const TABLES: [&str; 9] = [
+    "traces",
+    "metrics",
+    "logs",
+    "ingest_cursors",
+    "ingest_history",
+    "prune_history",
+    "archives",
+    "trace_summaries",
+    "trace_summary_staging",
+];
+
+#[cfg(feature = "duckdb")]
+fn needs_migration(conn: &Connection) -> Result<bool, StorageError> {
+    let existing: Vec<String> = conn
+        .prepare(
+            "SELECT table_name FROM information_schema.tables
+             WHERE table_catalog = current_database() AND table_schema = 'main'",
+        )?
+        .query_map([], |row| row.get(0))?
+        .collect::<duckdb::Result<_>>()?;
+    Ok(TABLES
+        .iter()
+        .any(|table| !existing.iter().any(|t| t == table))
+        || !missing_trace_columns(conn)?.is_empty())
+}
+
+/// The [`ADDED_TRACE_COLUMNS`] the `traces` table of the current database lacks.
+#[cfg(feature = "duckdb")]
+fn missing_trace_columns(
+    conn: &Connection,
+) -> Result<Vec<(&'static str, &'static str)>, StorageError> {
+    let existing: Vec<String> = conn
+        .prepare(
+            "SELECT column_name FROM information_schema.columns
+             WHERE table_catalog = current_database() AND table_schema = 'main'
+               AND table_name = 'traces'",
+        )?
+        .query_map([], |row| row.get(0))?
+        .collect::<duckdb::Result<_>>()?;
+    Ok(ADDED_TRACE_COLUMNS
+        .into_iter()
+        .filter(|(column, _)| !existing.iter().any(|c| c == column))
+        .collect())
 }
 
 /// Run schema migrations, creating tables if they don't exist.
+#[cfg(feature = "duckdb")]
 fn migrate(conn: &Connection) -> Result<(), StorageError> {
     let stmts = [
         "CREATE TABLE IF NOT EXISTS traces (
@@ -91,14 +506,95 @@ fn migrate(conn: &Connection) -> Result<(), StorageError> {
             file_path    VARCHAR NOT NULL PRIMARY KEY,
             byte_offset  UBIGINT NOT NULL
         )",
+        // One row per file per ingest run; inspected with `lotel ingest history`.
+        "CREATE TABLE IF NOT EXISTS ingest_history (
+            run_started_at TIMESTAMP NOT NULL,
+            finished_at    TIMESTAMP NOT NULL,
+            signal         VARCHAR NOT NULL,
+            file_path      VARCHAR NOT NULL,
+            start_offset   UBIGINT NOT NULL,
+            end_offset     UBIGINT NOT NULL,
+            rows           BIGINT NOT NULL,
+            error          VARCHAR
+        )",
+        // One row per prune run; inspected with `lotel prune history`.
+        "CREATE TABLE IF NOT EXISTS prune_history (
+            started_at  TIMESTAMP NOT NULL,
+            finished_at TIMESTAMP NOT NULL,
+            trigger     VARCHAR NOT NULL,
+            traces      BIGINT NOT NULL,
+            metrics     BIGINT NOT NULL,
+            logs        BIGINT NOT NULL,
+            error       VARCHAR
+        )",
+        // Parquet files written by `lotel archive`; query connections union them back in.
+        "CREATE TABLE IF NOT EXISTS archives (
+            signal      VARCHAR NOT NULL,
+            location    VARCHAR NOT NULL,
+            min_time    TIMESTAMP,
+            max_time    TIMESTAMP,
+            rows        BIGINT NOT NULL,
+            archived_at TIMESTAMP NOT NULL
+        )",
+        // Per-trace rollups maintained at ingest (see summaries.rs); the staging table holds
+        // one batch's contributions until they are merged.
+        "CREATE TABLE IF NOT EXISTS trace_summaries (
+            trace_id        VARCHAR NOT NULL PRIMARY KEY,
+            root_name       VARCHAR,
+            root_service    VARCHAR,
+            root_start_time TIMESTAMP,
+            services        VARCHAR[] NOT NULL,
+            start_time      TIMESTAMP NOT NULL,
+            end_time        TIMESTAMP,
+            duration_ns     BIGINT NOT NULL,
+            span_count      BIGINT NOT NULL,
+            has_error       BOOLEAN NOT NULL
+        )",
+        "CREATE TABLE IF NOT EXISTS trace_summary_staging (
+            trace_id        VARCHAR NOT NULL,
+            root_name       VARCHAR,
+            root_service    VARCHAR,
+            root_start_time TIMESTAMP,
+            services        VARCHAR NOT NULL,
+            start_time      TIMESTAMP NOT NULL,
+            end_time        TIMESTAMP,
+            span_count      BIGINT NOT NULL,
+            has_error       BOOLEAN NOT NULL
+        )",
+        // Point lookups by trace (`query trace`, log correlation) use these ART indexes;
+        // service and time filters rely on zone maps over clustered appends instead.
+        TRACES_INDEX,
+        "CREATE INDEX IF NOT EXISTS logs_trace_id_idx ON logs (trace_id)",
     ];
     for stmt in &stmts {
         conn.execute(stmt, [])?;
     }
+    // DuckDB refuses to add columns to an indexed table, even with IF NOT EXISTS, so the
+    // trace index is dropped and recreated around the ALTERs, and only when one is due.
+    let missing = missing_trace_columns(conn)?;
+    if !missing.is_empty() {
+        conn.execute("DROP INDEX IF EXISTS traces_trace_id_idx", [])?;
+        for (column, ty) in missing {
+            conn.execute(&format!("ALTER TABLE traces ADD COLUMN {column} {ty}"), [])?;
+        }
+        conn.execute(TRACES_INDEX, [])?;
+    }
+    // Spans stored before the summary table existed are summarized once.
+    let backfill: bool = conn.query_row(
+        "SELECT NOT EXISTS (FROM trace_summaries) AND EXISTS (FROM traces)",
+        [],
+        |row| row.get(0),
+    )?;
+    if backfill {
+        conn.execute_batch(&format!(
+            "INSERT INTO trace_summaries {}",
+            crate::summaries::summary_select("true")
+        ))?;
+    }
     Ok(())
 }
 
-#[cfg(test)]
+#[cfg(all(test, feature = "duckdb"))]
 mod tests {
     use super::*;
 
@@ -118,7 +614,174 @@ mod tests {
             .unwrap()
             .map(|r| r.unwrap())
             .collect();
-        assert_eq!(tables, vec!["ingest_cursors", "logs", "metrics", "traces"]);
+        assert_eq!(
+            tables,
+            vec![
+                "archives",
+                "ingest_cursors",
+                "ingest_history",
+                "logs",
+                "metrics",
+                "prune_history",
+                "trace_summaries",
+                "trace_summary_staging",
+                "traces"
+            ]
+        );
+    }
+
+    #[test]
+    fn read_only_open_creates_missing_db() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let path = tmp.path().join("lotel.db");
+
+        let conn = open_db_with(&path, &DbConfig::read_only()).unwrap();
+        let count: i64 = conn
+            .query_row("SELECT COUNT(*) FROM traces", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(count, 0);
+        assert!(conn.execute("DELETE FROM traces", []).is_err());
+    }
+
+    #[test]
+    fn read_only_open_migrates_old_db() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let path = tmp.path().join("lotel.db");
+        let config = DbConfig {
+            encryption_key: None,
+            ..DbConfig::default()
+        };
+        // A database from before `archives` and the span flags existed.
+        open_db_with(&path, &config)
+            .unwrap()
+            .execute_batch(
+                "DROP TABLE archives;
+                 DROP INDEX traces_trace_id_idx;
+                 ALTER TABLE traces DROP COLUMN flags;",
+            )
+            .unwrap();
+
+        let conn = open_db_with(
+            &path,
+            &DbConfig {
+                encryption_key: None,
+                ..DbConfig::read_only()
+            },
+        )
+        .unwrap();
+        assert!(!needs_migration(&conn).unwrap());
+        let count: i64 = conn
+            .query_row("SELECT COUNT(*) FROM archives", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(count, 0);
+    }
+
+    #[test]
+    fn reopens_migrated_db_writable() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let path = tmp.path().join("lotel.db");
+        let config = DbConfig {
+            encryption_key: None,
+            ..DbConfig::default()
+        };
+
+        // The first connection closes at the end of its statement; the second open
+        // migrates a database whose trace index already exists.
+        open_db_with(&path, &config).unwrap();
+        let conn = open_db_with(&path, &config).unwrap();
+        assert!(missing_trace_columns(&conn).unwrap().is_empty());
+        let indexes: i64 = conn
+            .query_row(
+                "SELECT COUNT(*) FROM duckdb_indexes() WHERE index_name = 'traces_trace_id_idx'",
+                [],
+                |row| row.get(0),
+            )
+            .unwrap();
+        assert_eq!(indexes, 1);
+    }
+
+    #[test]
+    fn encrypts_existing_db() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let path = tmp.path().join("lotel.db");
+        let plain = DbConfig {
+            encryption_key: None,
+            ..DbConfig::default()
+        };
+        // Each connection is a temporary, closed before the next open.
+        open_db_with(&path, &plain)
+            .unwrap()
+            .execute("INSERT INTO ingest_cursors VALUES ('traces.jsonl', 42)", [])
+            .unwrap();
+
+        encrypt_db(&path, "hunter2").unwrap();
+        let encrypted = DbConfig {
+            encryption_key: Some("hunter2".to_string()),
+            ..DbConfig::read_only()
+        };
+        let offset: u64 = open_db_with(&path, &encrypted)
+            .unwrap()
+            .query_row("SELECT byte_offset FROM ingest_cursors", [], |row| {
+                row.get(0)
+            })
+            .unwrap();
+        assert_eq!(offset, 42);
+
+        let wrong = DbConfig {
+            encryption_key: Some("wrong".to_string()),
+            ..encrypted
+        };
+        assert!(open_db_with(&path, &wrong).is_err());
+        assert!(open_db_with(&path, &plain).is_err());
+    }
+
+    #[test]
+    fn compact_keeps_rows_and_sorts() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let path = tmp.path().join("lotel.db");
+        let config = DbConfig {
+            encryption_key: None,
+            ..DbConfig::default()
+        };
+        {
+            let conn = open_db_with(&path, &config).unwrap();
+            for (svc, time) in [
+                ("b", "2024-01-01 00:00:02"),
+                ("a", "2024-01-01 00:00:01"),
+                ("a", "2023-01-01 00:00:00"),
+            ] {
+                conn.execute(
+                    "INSERT INTO logs (timestamp, service_name, date)
+                     VALUES (CAST(? AS TIMESTAMP), ?, CAST(? AS DATE))",
+                    duckdb::params![time, svc, time],
+                )
+                .unwrap();
+            }
+            conn.execute("DELETE FROM logs WHERE date < '2024-01-01'", [])
+                .unwrap();
+            conn.execute("INSERT INTO ingest_cursors VALUES ('logs.jsonl', 7)", [])
+                .unwrap();
+        }
+
+        let report = compact_db(&path, &config, true).unwrap();
+        assert!(report.sorted);
+        assert!(report.before_bytes > 0 && report.after_bytes > 0);
+
+        let conn = open_db_with(&path, &config).unwrap();
+        let services: Vec<String> = conn
+            .prepare("SELECT service_name FROM logs")
+            .unwrap()
+            .query_map([], |row| row.get(0))
+            .unwrap()
+            .map(|r| r.unwrap())
+            .collect();
+        assert_eq!(services, vec!["a", "b"]);
+        let offset: u64 = conn
+            .query_row("SELECT byte_offset FROM ingest_cursors", [], |row| {
+                row.get(0)
+            })
+            .unwrap();
+        assert_eq!(offset, 7);
     }
 
     #[test]
@@ -152,7 +815,12 @@ mod tests {
                 "status_code",
                 "service_name",
                 "attributes",
-                "date"
+                "date",
+                "trace_state",
+                "flags",
+                "dropped_attributes_count",
+                "dropped_events_count",
+                "dropped_links_count"
             ]
         );
     }
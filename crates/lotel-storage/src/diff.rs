@@ -0,0 +1,127 @@
+//! Compare RED metrics between a baseline and a current window to catch regressions.
+
+use anyhow::Result;
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::QueryOptions;
+use crate::stats::{RedStats, red_metrics};
+
+/// Change of one metric between the two windows.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct MetricDelta {
+    pub metric: String,
+    pub baseline: f64,
+    pub current: f64,
+    /// Relative change, e.g. 0.25 for +25%; absent when the baseline is zero.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub change: Option<f64>,
+    pub regression: bool,
+}
+
+/// Window comparison for one service.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ServiceDiff {
+    pub service_name: String,
+    pub regression: bool,
+    pub metrics: Vec<MetricDelta>,
+}
+
+/// Compare per-service RED metrics of `current` against `baseline`.
+///
+/// Latency percentiles and the error rate regress when they grow by more than `threshold`
+/// (relative, e.g. 0.1 for 10%); an error rate rising from zero always regresses. The
+/// request rate is reported but never flagged. Only services seen in both windows are
+/// compared.
+pub fn diff_windows(
+    conn: &Connection,
+    baseline: &QueryOptions,
+    current: &QueryOptions,
+    threshold: f64,
+) -> Result<Vec<ServiceDiff>> {
+    let before = red_metrics(conn, baseline, false)?;
+    let after = red_metrics(conn, current, false)?;
+
+    let mut diffs = Vec::new();
+    for cur in &after {
+        let Some(base) = before.iter().find(|b| b.service_name == cur.service_name) else {
+            continue;
+        };
+        let metrics = compare(base, cur, threshold);
+        diffs.push(ServiceDiff {
+            service_name: cur.service_name.clone(),
+            regression: metrics.iter().any(|m| m.regression),
+            metrics,
+        });
+    }
+    Ok(diffs)
+}
+
+fn compare(base: &RedStats, cur: &RedStats, threshold: f64) -> Vec<MetricDelta> {
+    let delta = |metric: &str, baseline: f64, current: f64, flagged: bool| {
+        let change = (baseline != 0.0).then(|| (current - baseline) / baseline);
+        let regression = flagged
+            && match change {
+                Some(c) => c > threshold,
+                None => current > 0.0,
+            };
+        MetricDelta {
+            metric: metric.to_string(),
+            baseline,
+            current,
+            change,
+            regression,
+        }
+    };
+    vec![
+        delta("rate_per_sec", base.rate_per_sec, cur.rate_per_sec, false),
+        delta("error_rate", base.error_rate, cur.error_rate, true),
+        delta("p50_ms", base.p50_ms, cur.p50_ms, true),
+        delta("p95_ms", base.p95_ms, cur.p95_ms, true),
+        delta("p99_ms", base.p99_ms, cur.p99_ms, true),
+    ]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn flags_latency_and_error_regressions() {
+        let conn = db::open_in_memory().unwrap();
+        let spans = [
+            ("16:00:00", 100, 0),
+            ("16:00:10", 100, 0),
+            ("17:00:00", 100, 0),
+            ("17:00:10", 150, 2),
+        ];
+        for (i, (at, ms, status)) in spans.iter().enumerate() {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, 's', NULL, 'op', 2, ?, NULL, ?, ?, 'api', '{}', '2024-03-09')",
+                duckdb::params![format!("t{i}"), format!("2024-03-09 {at}"), ms * 1_000_000i64, status],
+            )
+            .unwrap();
+        }
+        let window = |from: &str, to: &str| QueryOptions {
+            since: Some(format!("2024-03-09T{from}").parse().unwrap()),
+            until: Some(format!("2024-03-09T{to}").parse().unwrap()),
+            ..Default::default()
+        };
+
+        let diffs = diff_windows(
+            &conn,
+            &window("15:30:00", "16:30:00"),
+            &window("16:30:00", "17:30:00"),
+            0.1,
+        )
+        .unwrap();
+        assert_eq!(diffs.len(), 1);
+        assert!(diffs[0].regression);
+        let by_name = |m: &str| diffs[0].metrics.iter().find(|d| d.metric == m).unwrap();
+        assert!(by_name("error_rate").regression);
+        assert!(by_name("p95_ms").regression);
+        assert!(!by_name("rate_per_sec").regression);
+        assert_eq!(by_name("rate_per_sec").change, Some(0.0));
+    }
+}
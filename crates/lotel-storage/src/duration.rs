@@ -0,0 +1,115 @@
+//! The duration syntax shared by CLI flags and the collector config (`--older-than`,
+//! `retention.older_than`, alert windows, the ingestion interval).
+
+use anyhow::{Result, bail};
+use chrono::Duration;
+
+/// Parse a duration string: one or more `<N><unit>` parts such as `90s` or `1d12h`. Units
+/// are `mo` (30 days), `w`, `d`, `h`, `m`, `s`, and `ms`.
+pub fn parse_duration(s: &str) -> Result<Duration> {
+    let s = s.trim();
+    if s.is_empty() {
+        bail!("empty duration string");
+    }
+
+    let mut total = Duration::zero();
+    let mut rest = s;
+    while !rest.is_empty() {
+        let digits = rest
+            .find(|c: char| !c.is_ascii_digit())
+            .unwrap_or(rest.len());
+        let unit_len = rest[digits..]
+            .find(|c: char| c.is_ascii_digit())
+            .unwrap_or(rest.len() - digits);
+        let (num_str, unit) = (&rest[..digits], &rest[digits..digits + unit_len]);
+        let value: i64 = num_str
+            .parse()
+            .map_err(|_| anyhow::anyhow!("cannot parse {s:?} as duration"))?;
+        let part = match unit {
+            "mo" => value.checked_mul(30).and_then(Duration::try_days),
+            "w" => Duration::try_weeks(value),
+            "d" => Duration::try_days(value),
+            "h" => Duration::try_hours(value),
+            "m" => Duration::try_minutes(value),
+            "s" => Duration::try_seconds(value),
+            "ms" => Duration::try_milliseconds(value),
+            "" => bail!("cannot parse {s:?} as duration (missing unit after {num_str})"),
+            _ => bail!("cannot parse {s:?} as duration (unknown suffix {unit:?})"),
+        };
+        total = match part.and_then(|part| total.checked_add(&part)) {
+            Some(total) => total,
+            None => bail!("cannot parse {s:?} as duration (duration out of range)"),
+        };
+        rest = &rest[digits + unit_len..];
+    }
+    Ok(total)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_duration_days() {
+        let d = parse_duration("7d").unwrap();
+        assert_eq!(d, Duration::days(7));
+    }
+
+    #[test]
+    fn parse_duration_hours() {
+        let d = parse_duration("24h").unwrap();
+        assert_eq!(d, Duration::hours(24));
+    }
+
+    #[test]
+    fn parse_duration_minutes() {
+        let d = parse_duration("30m").unwrap();
+        assert_eq!(d, Duration::minutes(30));
+    }
+
+    #[test]
+    fn parse_duration_seconds() {
+        let d = parse_duration("60s").unwrap();
+        assert_eq!(d, Duration::seconds(60));
+    }
+
+    #[test]
+    fn parse_duration_millis() {
+        let d = parse_duration("300ms").unwrap();
+        assert_eq!(d, Duration::milliseconds(300));
+    }
+
+    #[test]
+    fn parse_duration_weeks_and_months() {
+        assert_eq!(parse_duration("1w").unwrap(), Duration::days(7));
+        assert_eq!(parse_duration("2mo").unwrap(), Duration::days(60));
+    }
+
+    #[test]
+    fn parse_duration_compound() {
+        assert_eq!(
+            parse_duration("1d12h").unwrap(),
+            Duration::days(1) + Duration::hours(12)
+        );
+        assert_eq!(
+            parse_duration("1m30s500ms").unwrap(),
+            Duration::milliseconds(90_500)
+        );
+        assert!(parse_duration("1d12").is_err());
+        assert!(parse_duration("h").is_err());
+        assert!(parse_duration("3y").is_err());
+    }
+
+    #[test]
+    fn parse_duration_out_of_range() {
+        for s in [
+            "99999999999w",
+            "9999999999999999mo",
+            "9223372036854775807s",
+            "60000000000d60000000000d",
+        ] {
+            let err = parse_duration(s).unwrap_err().to_string();
+            assert!(err.contains("duration out of range"), "{s}: {err}");
+        }
+    }
+}
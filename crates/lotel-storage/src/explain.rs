@@ -0,0 +1,100 @@
+//! `query --explain`: the SQL a row query runs, its bound parameters, and DuckDB's
+//! `EXPLAIN ANALYZE` plan.
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use duckdb::types::{ToSql, ToSqlOutput, Value, ValueRef};
+use serde::Serialize;
+
+use crate::db::sql_string;
+use crate::fields::{Field, select_list};
+use crate::query::{QueryOptions, Signal, from_clause};
+
+#[derive(Debug, Serialize)]
+pub struct QueryExplain {
+    pub sql: String,
+    /// Bound values in placeholder order, rendered as SQL literals.
+    pub params: Vec<String>,
+    /// `EXPLAIN ANALYZE` output. The query is executed to produce it.
+    pub plan: String,
+}
+
+/// Explain the query that [`crate::for_each_trace`] (and the metric and log equivalents)
+/// would run for `opts`, or the [`crate::for_each_projected`] one when `fields` is given.
+pub fn explain_query(
+    conn: &Connection,
+    signal: Signal,
+    opts: &QueryOptions,
+    fields: Option<&[Field]>,
+) -> Result<QueryExplain> {
+    let mut params: Vec<Box<dyn ToSql>> = Vec::new();
+    let columns = match fields {
+        Some(fields) => select_list(fields),
+        None => signal.columns().to_string(),
+    };
+    let sql = format!("SELECT {columns}{}", from_clause(signal, opts, &mut params));
+
+    let mut stmt = conn.prepare(&format!("EXPLAIN ANALYZE {sql}"))?;
+    let param_refs: Vec<&dyn ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| row.get::<_, String>(1))
+        .with_context(|| format!("explaining {} query", signal.table()))?;
+    let plan = rows.collect::<duckdb::Result<Vec<_>>>()?.join("\n");
+
+    let params = params
+        .iter()
+        .map(|p| p.to_sql().map(|v| sql_literal(&v)))
+        .collect::<duckdb::Result<_>>()?;
+    Ok(QueryExplain { sql, params, plan })
+}
+
+fn sql_literal(value: &ToSqlOutput<'_>) -> String {
+    match value {
+        ToSqlOutput::Borrowed(ValueRef::Null) | ToSqlOutput::Owned(Value::Null) => "NULL".into(),
+        ToSqlOutput::Borrowed(ValueRef::Text(bytes)) => sql_string(&String::from_utf8_lossy(bytes)),
+        ToSqlOutput::Owned(Value::Text(text)) => sql_string(text),
+        ToSqlOutput::Owned(Value::Boolean(b)) => b.to_string(),
+        ToSqlOutput::Owned(Value::Int(n)) => n.to_string(),
+        ToSqlOutput::Owned(Value::BigInt(n)) => n.to_string(),
+        ToSqlOutput::Owned(Value::Double(n)) => n.to_string(),
+        ToSqlOutput::Borrowed(other) => format!("{other:?}"),
+        ToSqlOutput::Owned(other) => format!("{other:?}"),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn explains_sql_params_and_plan() {
+        let conn = db::open_in_memory().unwrap();
+        let opts = QueryOptions {
+            service: Some("o'brien".into()),
+            limit: Some(5),
+            ..Default::default()
+        };
+        let explain = explain_query(&conn, Signal::Logs, &opts, None).unwrap();
+        assert!(explain.sql.starts_with("SELECT timestamp, severity"));
+        assert!(explain.sql.contains("FROM logs WHERE"));
+        assert!(explain.sql.ends_with("ORDER BY timestamp ASC LIMIT 5"));
+        assert_eq!(explain.params, ["'o''brien'"]);
+        assert!(!explain.plan.is_empty());
+
+        let fields = crate::parse_fields(Signal::Traces, "trace_id,duration_ns").unwrap();
+        let explain = explain_query(
+            &conn,
+            Signal::Traces,
+            &QueryOptions::default(),
+            Some(&fields),
+        )
+        .unwrap();
+        assert!(
+            explain
+                .sql
+                .starts_with("SELECT trace_id, duration_ns FROM traces")
+        );
+        assert!(explain.params.is_empty());
+    }
+}
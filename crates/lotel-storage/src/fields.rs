@@ -0,0 +1,255 @@
+//! Column projection for `query --fields`: SELECT only the requested columns and return each
+//! row as a JSON object holding just those keys.
+
+use anyhow::{Context, Result, bail};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde_json::{Map, Value};
+
+use crate::query::{QueryOptions, Signal, from_clause, span_kind_name, status_code_name};
+
+/// How a field is read from the row and rendered as JSON.
+#[derive(Debug, Clone, Copy)]
+enum FieldType {
+    Text,
+    Int,
+    Float,
+    Bool,
+    Time,
+    /// JSON stored as text, e.g. attributes.
+    Json,
+    /// Integer column rendered through [`span_kind_name`].
+    KindName,
+    /// Integer column rendered through [`status_code_name`].
+    StatusName,
+}
+
+/// A selectable output field, named as in the full query output.
+#[derive(Debug, Clone, Copy)]
+pub struct Field {
+    name: &'static str,
+    expr: &'static str,
+    ty: FieldType,
+}
+
+impl Field {
+    pub fn name(&self) -> &'static str {
+        self.name
+    }
+}
+
+const fn field(name: &'static str, expr: &'static str, ty: FieldType) -> Field {
+    Field { name, expr, ty }
+}
+
+const TRACE_FIELDS: &[Field] = &[
+    field("trace_id", "trace_id", FieldType::Text),
+    field("span_id", "span_id", FieldType::Text),
+    field("parent_span_id", "parent_span_id", FieldType::Text),
+    field("name", "name", FieldType::Text),
+    field("kind", "kind", FieldType::Int),
+    field("kind_name", "kind", FieldType::KindName),
+    field("start_time", "start_time", FieldType::Time),
+    field("end_time", "end_time", FieldType::Time),
+    field("duration_ns", "duration_ns", FieldType::Int),
+    field("status_code", "status_code", FieldType::Int),
+    field("status", "status_code", FieldType::StatusName),
+    field("service_name", "service_name", FieldType::Text),
+    field("attributes", "CAST(attributes AS VARCHAR)", FieldType::Json),
+    field("trace_state", "trace_state", FieldType::Text),
+    field("flags", "flags", FieldType::Int),
+    field(
+        "dropped_attributes_count",
+        "dropped_attributes_count",
+        FieldType::Int,
+    ),
+    field(
+        "dropped_events_count",
+        "dropped_events_count",
+        FieldType::Int,
+    ),
+    field("dropped_links_count", "dropped_links_count", FieldType::Int),
+];
+
+const METRIC_FIELDS: &[Field] = &[
+    field("metric_name", "metric_name", FieldType::Text),
+    field("metric_type", "metric_type", FieldType::Text),
+    field("value", "value", FieldType::Float),
+    field("timestamp", "timestamp", FieldType::Time),
+    field("service_name", "service_name", FieldType::Text),
+    field(
+        "aggregation_temporality",
+        "aggregation_temporality",
+        FieldType::Int,
+    ),
+    field("is_monotonic", "is_monotonic", FieldType::Bool),
+    field("unit", "unit", FieldType::Text),
+    field("attributes", "CAST(attributes AS VARCHAR)", FieldType::Json),
+];
+
+const LOG_FIELDS: &[Field] = &[
+    field("timestamp", "timestamp", FieldType::Time),
+    field("severity", "severity", FieldType::Text),
+    field("severity_number", "severity_number", FieldType::Int),
+    field("body", "body", FieldType::Text),
+    field("service_name", "service_name", FieldType::Text),
+    field("trace_id", "trace_id", FieldType::Text),
+    field("span_id", "span_id", FieldType::Text),
+    field("attributes", "CAST(attributes AS VARCHAR)", FieldType::Json),
+];
+
+fn fields_of(signal: Signal) -> &'static [Field] {
+    match signal {
+        Signal::Traces => TRACE_FIELDS,
+        Signal::Metrics => METRIC_FIELDS,
+        Signal::Logs => LOG_FIELDS,
+    }
+}
+
+/// Resolve a comma-separated field list such as `trace_id,name,duration_ns`, keeping the
+/// given order and dropping duplicates.
+pub fn parse_fields(signal: Signal, spec: &str) -> Result<Vec<Field>> {
+    let available = fields_of(signal);
+    let mut fields: Vec<Field> = Vec::new();
+    for name in spec.split(',').map(str::trim).filter(|n| !n.is_empty()) {
+        let Some(field) = available.iter().find(|f| f.name == name) else {
+            let names: Vec<&str> = available.iter().map(|f| f.name).collect();
+            bail!(
+                "unknown {} field {name:?} (available: {})",
+                signal.table(),
+                names.join(", ")
+            );
+        };
+        if !fields.iter().any(|f| f.name == name) {
+            fields.push(*field);
+        }
+    }
+    if fields.is_empty() {
+        bail!("no fields given");
+    }
+    Ok(fields)
+}
+
+/// Run the `signal` query for `opts`, selecting only `fields`, and hand each row to `f` as
+/// a JSON object in field order.
+pub fn for_each_projected(
+    conn: &Connection,
+    signal: Signal,
+    opts: &QueryOptions,
+    fields: &[Field],
+    mut f: impl FnMut(Map<String, Value>) -> Result<()>,
+) -> Result<()> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let query = format!(
+        "SELECT {}{}",
+        select_list(fields),
+        from_clause(signal, opts, &mut params)
+    );
+
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            let mut object = Map::new();
+            for (i, field) in fields.iter().enumerate() {
+                object.insert(field.name.to_string(), read_value(row, i, field.ty)?);
+            }
+            Ok(object)
+        })
+        .with_context(|| format!("querying {}", signal.table()))?;
+
+    for row in rows {
+        f(row?)?;
+    }
+    Ok(())
+}
+
+/// The SELECT expressions for `fields`.
+pub(crate) fn select_list(fields: &[Field]) -> String {
+    let columns: Vec<&str> = fields.iter().map(|f| f.expr).collect();
+    columns.join(", ")
+}
+
+/// Collecting form of [`for_each_projected`].
+pub fn query_projected(
+    conn: &Connection,
+    signal: Signal,
+    opts: &QueryOptions,
+    fields: &[Field],
+) -> Result<Vec<Map<String, Value>>> {
+    let mut results = Vec::new();
+    for_each_projected(conn, signal, opts, fields, |row| {
+        results.push(row);
+        Ok(())
+    })?;
+    Ok(results)
+}
+
+fn read_value(row: &duckdb::Row<'_>, i: usize, ty: FieldType) -> duckdb::Result<Value> {
+    Ok(match ty {
+        FieldType::Text => row.get::<_, Option<String>>(i)?.into(),
+        FieldType::Int => row.get::<_, Option<i64>>(i)?.into(),
+        FieldType::Float => row.get::<_, Option<f64>>(i)?.into(),
+        FieldType::Bool => row.get::<_, Option<bool>>(i)?.into(),
+        // Same rendering as the typed results' chrono serialization.
+        FieldType::Time => row
+            .get::<_, Option<NaiveDateTime>>(i)?
+            .and_then(|t| serde_json::to_value(t).ok())
+            .unwrap_or(Value::Null),
+        FieldType::Json => row
+            .get::<_, Option<String>>(i)?
+            .and_then(|s| serde_json::from_str(&s).ok())
+            .unwrap_or(Value::Null),
+        FieldType::KindName => span_kind_name(row.get(i)?).into(),
+        FieldType::StatusName => status_code_name(row.get(i)?).into(),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn parse_fields_validates_names() {
+        let fields = parse_fields(Signal::Traces, "trace_id, name,trace_id,status").unwrap();
+        let names: Vec<&str> = fields.iter().map(|f| f.name()).collect();
+        assert_eq!(names, ["trace_id", "name", "status"]);
+
+        let err = parse_fields(Signal::Logs, "body,duration_ns").unwrap_err();
+        assert!(
+            err.to_string()
+                .contains("unknown logs field \"duration_ns\"")
+        );
+        assert!(parse_fields(Signal::Metrics, " , ").is_err());
+    }
+
+    #[test]
+    fn projects_only_requested_fields() {
+        let conn = db::open_in_memory().unwrap();
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', 's1', NULL, 'op', 2, '2024-03-09 16:00:00', NULL, 5000, 2, 'api', '{\"k\":\"v\"}', '2024-03-09')",
+            [],
+        )
+        .unwrap();
+        let fields = parse_fields(
+            Signal::Traces,
+            "name,duration_ns,kind_name,status,start_time,attributes",
+        )
+        .unwrap();
+        let rows =
+            query_projected(&conn, Signal::Traces, &QueryOptions::default(), &fields).unwrap();
+        assert_eq!(rows.len(), 1);
+        assert_eq!(
+            Value::Object(rows[0].clone()),
+            serde_json::json!({
+                "name": "op",
+                "duration_ns": 5000,
+                "kind_name": "SERVER",
+                "status": "ERROR",
+                "start_time": "2024-03-09T16:00:00",
+                "attributes": {"k": "v"},
+            })
+        );
+    }
+}
@@ -0,0 +1,198 @@
+//! Folded-stack output (as read by `flamegraph.pl`, inferno, and speedscope) from span trees.
+//!
+//! Each span contributes its self time (duration minus that of its direct children, floored
+//! at zero) to the stack of span names from its root down to itself. Identical stacks are
+//! summed, so across many traces the result is aggregated by span name.
+
+use std::collections::{BTreeMap, HashMap};
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde::Serialize;
+
+use crate::query::{QueryOptions, append_span_filters};
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct FoldedStack {
+    /// Span names from the root down, separated by `;`.
+    pub stack: String,
+    /// Summed self time in microseconds.
+    pub self_us: i64,
+}
+
+struct Span {
+    span_id: String,
+    parent_span_id: Option<String>,
+    name: String,
+    duration_ns: i64,
+}
+
+/// Fold the span trees of every trace containing a span that matches `opts`. Whole traces are
+/// folded, not just the matching spans, so stacks always start at the root. `opts.limit`
+/// counts traces.
+pub fn folded_stacks(conn: &Connection, opts: &QueryOptions) -> Result<Vec<FoldedStack>> {
+    let mut matched = String::from("SELECT DISTINCT trace_id FROM traces WHERE 1=1");
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut matched, &mut params, opts);
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        matched.push_str(&format!(" ORDER BY trace_id LIMIT {limit}"));
+    }
+
+    let query = format!(
+        "WITH matched AS ({matched})
+        SELECT t.trace_id, t.span_id, t.parent_span_id, t.name, t.duration_ns
+        FROM traces t JOIN matched USING (trace_id)
+        ORDER BY t.trace_id"
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                Span {
+                    span_id: row.get(1)?,
+                    parent_span_id: row.get(2)?,
+                    name: row.get(3)?,
+                    duration_ns: row.get(4)?,
+                },
+            ))
+        })
+        .context("querying spans for flamegraph")?;
+
+    // Rows arrive grouped by trace, so only one trace is held in memory at a time.
+    let mut totals: BTreeMap<String, i64> = BTreeMap::new();
+    let mut current: Option<String> = None;
+    let mut trace: Vec<Span> = Vec::new();
+    for row in rows {
+        let (trace_id, span) = row?;
+        if current.as_ref() != Some(&trace_id) {
+            fold_trace(&trace, &mut totals);
+            trace.clear();
+            current = Some(trace_id);
+        }
+        trace.push(span);
+    }
+    fold_trace(&trace, &mut totals);
+
+    Ok(totals
+        .into_iter()
+        .map(|(stack, self_ns)| FoldedStack {
+            stack,
+            self_us: self_ns / 1_000,
+        })
+        .filter(|s| s.self_us > 0)
+        .collect())
+}
+
+/// Add the self time of each span in one trace to `totals`, keyed by its stack.
+fn fold_trace(spans: &[Span], totals: &mut BTreeMap<String, i64>) {
+    let by_id: HashMap<&str, &Span> = spans.iter().map(|s| (s.span_id.as_str(), s)).collect();
+    let mut child_ns: HashMap<&str, i64> = HashMap::new();
+    for span in spans {
+        if let Some(parent) = parent_of(span, &by_id) {
+            *child_ns.entry(parent.span_id.as_str()).or_default() += span.duration_ns;
+        }
+    }
+
+    for span in spans {
+        let self_ns = (span.duration_ns - child_ns.get(span.span_id.as_str()).unwrap_or(&0)).max(0);
+        let mut frames = vec![frame(&span.name)];
+        let mut node = span;
+        // Bounded by the trace size in case parent links form a cycle.
+        while let Some(parent) = parent_of(node, &by_id)
+            && frames.len() <= spans.len()
+        {
+            frames.push(frame(&parent.name));
+            node = parent;
+        }
+        frames.reverse();
+        *totals.entry(frames.join(";")).or_default() += self_ns;
+    }
+}
+
+/// The captured parent of `span`; spans whose parent is missing are treated as roots.
+fn parent_of<'a>(span: &Span, by_id: &HashMap<&str, &'a Span>) -> Option<&'a Span> {
+    span.parent_span_id
+        .as_deref()
+        .filter(|p| !p.is_empty())
+        .and_then(|p| by_id.get(p).copied())
+}
+
+/// A span name as a frame: `;` separates frames and each stack must stay on one line.
+fn frame(name: &str) -> String {
+    name.replace(';', ":").replace(['\n', '\r'], " ")
+}
+
+/// Render stacks in the folded format: one `frame;frame;frame value` line each.
+pub fn to_folded(stacks: &[FoldedStack]) -> String {
+    stacks
+        .iter()
+        .map(|s| format!("{} {}\n", s.stack, s.self_us))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn setup() -> Connection {
+        let conn = db::open_in_memory().unwrap();
+        // (trace, span, parent, name, service, duration ms)
+        let spans = [
+            ("t1", "a", None, "GET /cart", "frontend", 100),
+            ("t1", "b", Some("a"), "SELECT cart", "frontend", 30),
+            ("t1", "c", Some("a"), "POST /price", "pricing", 50),
+            ("t2", "d", None, "GET /cart", "frontend", 40),
+            ("t2", "e", Some("d"), "SELECT cart", "frontend", 10),
+            // Parent not captured: folded as a root.
+            ("t3", "f", Some("gone"), "consume;batch", "worker", 5),
+        ];
+        for (trace_id, span_id, parent, name, service, ms) in spans {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, ?, ?, 2, '2024-03-09 16:00:00', '2024-03-09 16:00:01', ?, 0, ?, '{}', '2024-03-09')",
+                duckdb::params![trace_id, span_id, parent, name, ms * 1_000_000i64, service],
+            )
+            .unwrap();
+        }
+        conn
+    }
+
+    #[test]
+    fn folds_and_aggregates_by_span_name() {
+        let conn = setup();
+        let stacks = folded_stacks(&conn, &QueryOptions::default()).unwrap();
+        assert_eq!(
+            to_folded(&stacks),
+            "GET /cart 50000\n\
+             GET /cart;POST /price 50000\n\
+             GET /cart;SELECT cart 40000\n\
+             consume:batch 5000\n"
+        );
+    }
+
+    #[test]
+    fn folds_whole_traces_matching_filters() {
+        let conn = setup();
+        let opts = QueryOptions {
+            service: Some("pricing".into()),
+            ..Default::default()
+        };
+        let stacks = folded_stacks(&conn, &opts).unwrap();
+        assert_eq!(
+            to_folded(&stacks),
+            "GET /cart 20000\nGET /cart;POST /price 50000\nGET /cart;SELECT cart 30000\n"
+        );
+
+        let opts = QueryOptions {
+            trace_id: Some("t2".into()),
+            ..Default::default()
+        };
+        let stacks = folded_stacks(&conn, &opts).unwrap();
+        assert_eq!(stacks.len(), 2);
+        assert_eq!(stacks[0].self_us, 30_000);
+    }
+}
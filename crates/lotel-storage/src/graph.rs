@@ -0,0 +1,192 @@
+//! Service dependency graph derived from captured spans.
+//!
+//! An edge `a -> b` is recorded when a span in service `b` has a parent span in service `a`,
+//! or when a client/producer span in `a` names `b` in its `peer.service` attribute (for calls
+//! into uninstrumented services such as databases).
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, append_where};
+use crate::sample::STATUS_ERROR;
+
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ServiceEdge {
+    pub source: String,
+    pub target: String,
+    pub calls: i64,
+    pub errors: i64,
+}
+
+/// Compute service-to-service edges over the spans matching `opts`.
+pub fn service_graph(conn: &Connection, opts: &QueryOptions) -> Result<Vec<ServiceEdge>> {
+    let mut spans = String::from("SELECT * FROM traces WHERE 1=1");
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_where(&mut spans, &mut params, opts, "start_time");
+
+    let query = format!(
+        "WITH spans AS ({spans}),
+        parent_edges AS (
+            SELECT p.service_name AS source, c.service_name AS target, c.status_code
+            FROM spans c
+            JOIN spans p ON c.trace_id = p.trace_id AND c.parent_span_id = p.span_id
+            WHERE c.service_name <> p.service_name
+        ),
+        peer_edges AS (
+            SELECT s.service_name AS source,
+                   json_extract_string(s.attributes, '$.\"peer.service\"') AS target,
+                   s.status_code
+            FROM spans s
+            WHERE s.kind IN (3, 4)
+              AND json_extract_string(s.attributes, '$.\"peer.service\"') IS NOT NULL
+              AND json_extract_string(s.attributes, '$.\"peer.service\"') <> s.service_name
+              AND NOT EXISTS (
+                  SELECT 1 FROM spans c
+                  WHERE c.trace_id = s.trace_id AND c.parent_span_id = s.span_id
+                    AND c.service_name <> s.service_name
+              )
+        )
+        SELECT source, target, COUNT(*), COUNT(*) FILTER (WHERE status_code = {STATUS_ERROR})
+        FROM (SELECT * FROM parent_edges UNION ALL SELECT * FROM peer_edges)
+        GROUP BY source, target
+        ORDER BY source, target"
+    );
+
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(ServiceEdge {
+                source: row.get(0)?,
+                target: row.get(1)?,
+                calls: row.get(2)?,
+                errors: row.get(3)?,
+            })
+        })
+        .context("building service graph")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// Render edges as a Graphviz DOT digraph; edges with errors are drawn red.
+pub fn graph_to_dot(edges: &[ServiceEdge]) -> String {
+    let mut out = String::from("digraph services {\n    rankdir=LR;\n");
+    for e in edges {
+        let color = if e.errors > 0 { ", color=red" } else { "" };
+        out.push_str(&format!(
+            "    {} -> {} [label=\"{}\"{color}];\n",
+            dot_id(&e.source),
+            dot_id(&e.target),
+            edge_label(e)
+        ));
+    }
+    out.push_str("}\n");
+    out
+}
+
+/// Render edges as a Mermaid flowchart.
+pub fn graph_to_mermaid(edges: &[ServiceEdge]) -> String {
+    let mut nodes: Vec<&str> = edges
+        .iter()
+        .flat_map(|e| [e.source.as_str(), e.target.as_str()])
+        .collect();
+    nodes.sort_unstable();
+    nodes.dedup();
+    let node_id = |name: &str| nodes.binary_search(&name).map(|i| format!("n{i}"));
+
+    let mut out = String::from("flowchart LR\n");
+    for (i, name) in nodes.iter().enumerate() {
+        out.push_str(&format!("    n{i}[\"{}\"]\n", name.replace('"', "#quot;")));
+    }
+    for e in edges {
+        if let (Ok(from), Ok(to)) = (node_id(&e.source), node_id(&e.target)) {
+            out.push_str(&format!("    {from} -->|{}| {to}\n", edge_label(e)));
+        }
+    }
+    out
+}
+
+fn edge_label(edge: &ServiceEdge) -> String {
+    if edge.errors > 0 {
+        format!("{} calls, {} errors", edge.calls, edge.errors)
+    } else {
+        format!("{} calls", edge.calls)
+    }
+}
+
+fn dot_id(name: &str) -> String {
+    format!("\"{}\"", name.replace('\\', "\\\\").replace('"', "\\\""))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn setup() -> Connection {
+        let conn = db::open_in_memory().unwrap();
+        let pg = r#"{"peer.service":"postgres"}"#;
+        let checkout = r#"{"peer.service":"checkout"}"#;
+        // (trace, span, parent, service, kind, status, attributes)
+        let spans = [
+            ("t1", "a1", None, "frontend", 2, 0, "{}"),
+            ("t1", "a2", Some("a1"), "frontend", 3, 0, "{}"),
+            ("t1", "b1", Some("a2"), "checkout", 2, 2, "{}"),
+            ("t1", "b2", Some("b1"), "checkout", 3, 0, pg),
+            // Has peer.service but its callee is instrumented, so the parent edge wins.
+            ("t2", "c1", None, "frontend", 3, 0, checkout),
+            ("t2", "c2", Some("c1"), "checkout", 2, 0, "{}"),
+        ];
+        for (trace_id, span_id, parent, service, kind, status, attrs) in spans {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, ?, 'op', ?, '2024-03-09 16:00:00', '2024-03-09 16:00:01', 1000000000, ?, ?, ?, '2024-03-09')",
+                duckdb::params![trace_id, span_id, parent, kind, status, service, attrs],
+            )
+            .unwrap();
+        }
+        conn
+    }
+
+    #[test]
+    fn edges_from_parents_and_peer_service() {
+        let conn = setup();
+        let edges = service_graph(&conn, &QueryOptions::default()).unwrap();
+        assert_eq!(
+            edges,
+            vec![
+                ServiceEdge {
+                    source: "checkout".into(),
+                    target: "postgres".into(),
+                    calls: 1,
+                    errors: 0,
+                },
+                ServiceEdge {
+                    source: "frontend".into(),
+                    target: "checkout".into(),
+                    calls: 2,
+                    errors: 1,
+                },
+            ]
+        );
+    }
+
+    #[test]
+    fn renders_dot_and_mermaid() {
+        let edges = vec![ServiceEdge {
+            source: "frontend".into(),
+            target: "checkout".into(),
+            calls: 3,
+            errors: 1,
+        }];
+        let dot = graph_to_dot(&edges);
+        assert!(
+            dot.contains("\"frontend\" -> \"checkout\" [label=\"3 calls, 1 errors\", color=red];")
+        );
+
+        let mermaid = graph_to_mermaid(&edges);
+        assert!(mermaid.starts_with("flowchart LR\n"));
+        assert!(mermaid.contains("n1[\"frontend\"]"));
+        assert!(mermaid.contains("n1 -->|3 calls, 1 errors| n0"));
+    }
+}
@@ -0,0 +1,226 @@
+//! Ingestion history: one row per file per ingest run, for debugging missing data. Prune
+//! runs get one row each, so retention can be audited after the fact.
+
+#[cfg(feature = "duckdb")]
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+#[cfg(feature = "duckdb")]
+use duckdb::Connection;
+use serde::Serialize;
+
+use crate::prune::PruneReport;
+
+/// A single file processed during an ingest run.
+#[derive(Debug, Serialize)]
+pub struct IngestHistoryEntry {
+    pub run_started_at: NaiveDateTime,
+    pub finished_at: NaiveDateTime,
+    pub signal: String,
+    pub file_path: String,
+    pub start_offset: u64,
+    pub end_offset: u64,
+    pub rows: i64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+/// Record one history entry.
+#[cfg(feature = "duckdb")]
+pub fn record_ingest(conn: &Connection, entry: &IngestHistoryEntry) -> Result<()> {
+    conn.execute(
+        "INSERT INTO ingest_history (run_started_at, finished_at, signal, file_path, start_offset, end_offset, rows, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+        duckdb::params![
+            entry.run_started_at,
+            entry.finished_at,
+            entry.signal,
+            entry.file_path,
+            entry.start_offset,
+            entry.end_offset,
+            entry.rows,
+            entry.error.as_deref(),
+        ],
+    )
+    .context("recording ingest history")?;
+    Ok(())
+}
+
+/// Return the most recent history entries, newest first.
+#[cfg(feature = "duckdb")]
+pub fn ingest_history(conn: &Connection, limit: usize) -> Result<Vec<IngestHistoryEntry>> {
+    let mut stmt = conn.prepare(&format!(
+        "SELECT run_started_at, finished_at, signal, file_path, start_offset, end_offset, rows, error \
+         FROM ingest_history ORDER BY run_started_at DESC, finished_at DESC LIMIT {limit}"
+    ))?;
+    let rows = stmt
+        .query_map([], |row| {
+            Ok(IngestHistoryEntry {
+                run_started_at: row.get(0)?,
+                finished_at: row.get(1)?,
+                signal: row.get(2)?,
+                file_path: row.get(3)?,
+                start_offset: row.get(4)?,
+                end_offset: row.get(5)?,
+                rows: row.get(6)?,
+                error: row.get(7)?,
+            })
+        })
+        .context("querying ingest history")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// One prune run, scheduled by the collector or started with `lotel prune`.
+#[derive(Debug, Serialize)]
+pub struct PruneRun {
+    pub started_at: NaiveDateTime,
+    pub finished_at: NaiveDateTime,
+    /// `schedule` or `manual`.
+    pub trigger: String,
+    pub traces: i64,
+    pub metrics: i64,
+    pub logs: i64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl PruneRun {
+    /// A run that deleted what `reports` list, finishing now.
+    pub fn from_reports(started_at: NaiveDateTime, trigger: &str, reports: &[PruneReport]) -> Self {
+        let deleted = |signal: &str| {
+            reports
+                .iter()
+                .filter(|r| r.signal == signal)
+                .map(|r| r.deleted)
+                .sum()
+        };
+        Self {
+            started_at,
+            finished_at: chrono::Utc::now().naive_utc(),
+            trigger: trigger.to_string(),
+            traces: deleted("traces"),
+            metrics: deleted("metrics"),
+            logs: deleted("logs"),
+            error: None,
+        }
+    }
+
+    /// A run that failed with `error`, finishing now.
+    pub fn failed(started_at: NaiveDateTime, trigger: &str, error: String) -> Self {
+        Self {
+            error: Some(error),
+            ..Self::from_reports(started_at, trigger, &[])
+        }
+    }
+}
+
+/// Record one prune run.
+#[cfg(feature = "duckdb")]
+pub fn record_prune(conn: &Connection, run: &PruneRun) -> Result<()> {
+    conn.execute(
+        "INSERT INTO prune_history (started_at, finished_at, trigger, traces, metrics, logs, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+        duckdb::params![
+            run.started_at,
+            run.finished_at,
+            run.trigger,
+            run.traces,
+            run.metrics,
+            run.logs,
+            run.error.as_deref(),
+        ],
+    )
+    .context("recording prune history")?;
+    Ok(())
+}
+
+/// Return the most recent prune runs, newest first.
+#[cfg(feature = "duckdb")]
+pub fn prune_history(conn: &Connection, limit: usize) -> Result<Vec<PruneRun>> {
+    let mut stmt = conn.prepare(&format!(
+        "SELECT started_at, finished_at, trigger, traces, metrics, logs, error \
+         FROM prune_history ORDER BY started_at DESC LIMIT {limit}"
+    ))?;
+    let rows = stmt
+        .query_map([], |row| {
+            Ok(PruneRun {
+                started_at: row.get(0)?,
+                finished_at: row.get(1)?,
+                trigger: row.get(2)?,
+                traces: row.get(3)?,
+                metrics: row.get(4)?,
+                logs: row.get(5)?,
+                error: row.get(6)?,
+            })
+        })
+        .context("querying prune history")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+#[cfg(all(test, feature = "duckdb"))]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn record_and_read_history() {
+        let conn = db::open_in_memory().unwrap();
+        let started = chrono::DateTime::from_timestamp(1_710_000_000, 0)
+            .unwrap()
+            .naive_utc();
+
+        for (signal, error) in [("traces", None), ("logs", Some("bad line".to_string()))] {
+            record_ingest(
+                &conn,
+                &IngestHistoryEntry {
+                    run_started_at: started,
+                    finished_at: started,
+                    signal: signal.to_string(),
+                    file_path: format!("/data/{signal}/{signal}.jsonl"),
+                    start_offset: 0,
+                    end_offset: 100,
+                    rows: 3,
+                    error,
+                },
+            )
+            .unwrap();
+        }
+
+        let entries = ingest_history(&conn, 10).unwrap();
+        assert_eq!(entries.len(), 2);
+        assert!(
+            entries
+                .iter()
+                .any(|e| e.error.as_deref() == Some("bad line"))
+        );
+        assert_eq!(ingest_history(&conn, 1).unwrap().len(), 1);
+    }
+
+    #[test]
+    fn record_and_read_prune_runs() {
+        let conn = db::open_in_memory().unwrap();
+        let started = chrono::DateTime::from_timestamp(1_710_000_000, 0)
+            .unwrap()
+            .naive_utc();
+        let reports =
+            [("traces", 4), ("traces", 2), ("logs", 1)].map(|(signal, deleted)| PruneReport {
+                signal: signal.to_string(),
+                service_name: None,
+                deleted,
+                cutoff: "2024-03-01T00:00:00".to_string(),
+            });
+
+        record_prune(
+            &conn,
+            &PruneRun::from_reports(started, "schedule", &reports),
+        )
+        .unwrap();
+        let later = started + chrono::Duration::days(1);
+        record_prune(&conn, &PruneRun::failed(later, "manual", "locked".into())).unwrap();
+
+        let runs = prune_history(&conn, 10).unwrap();
+        assert_eq!(runs.len(), 2);
+        assert_eq!(runs[0].error.as_deref(), Some("locked"));
+        assert_eq!((runs[1].traces, runs[1].metrics, runs[1].logs), (6, 0, 1));
+        assert_eq!(runs[1].trigger, "schedule");
+    }
+}
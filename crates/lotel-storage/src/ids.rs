@@ -0,0 +1,43 @@
+//! Trace and span ID normalization.
+//!
+//! The OTLP/JSON spec encodes IDs as hex, but some marshalers emit base64 (the protobuf
+//! `bytes` JSON mapping) or uppercase hex. IDs are stored as lowercase hex so lookups and
+//! joins work regardless of which exporter wrote the data.
+
+use base64::Engine;
+use base64::engine::general_purpose::{STANDARD, URL_SAFE};
+
+/// Normalize a trace or span ID to lowercase hex. Values that are neither hex nor base64
+/// are returned trimmed but otherwise unchanged.
+pub fn normalize_id(raw: &str) -> String {
+    let id = raw.trim();
+    if id.len().is_multiple_of(2) && id.bytes().all(|b| b.is_ascii_hexdigit()) {
+        return id.to_ascii_lowercase();
+    }
+    match STANDARD.decode(id).or_else(|_| URL_SAFE.decode(id)) {
+        Ok(bytes) if !bytes.is_empty() => hex::encode(bytes),
+        _ => id.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn normalizes_hex_and_base64() {
+        let hex_id = "5b8efff798038103d269b633813fc60c";
+        assert_eq!(normalize_id(hex_id), hex_id);
+        assert_eq!(normalize_id(&hex_id.to_uppercase()), hex_id);
+        assert_eq!(normalize_id("W47/95gDgQPSabYzgT/GDA=="), hex_id);
+        assert_eq!(normalize_id("W47_95gDgQPSabYzgT_GDA=="), hex_id);
+        assert_eq!(normalize_id("eee19b7ec3c1b174"), "eee19b7ec3c1b174");
+        assert_eq!(normalize_id("7uGbfsPBsXQ="), "eee19b7ec3c1b174");
+    }
+
+    #[test]
+    fn leaves_other_values_alone() {
+        assert_eq!(normalize_id(""), "");
+        assert_eq!(normalize_id("not an id!"), "not an id!");
+    }
+}
@@ -0,0 +1,752 @@
+//! One-shot imports of telemetry exported by other tools, written through the same
+//! appenders as JSONL ingestion so imported rows are indistinguishable from collected ones.
+
+use std::collections::{HashMap, HashSet};
+
+use anyhow::{Context, Result, bail};
+use chrono::{DateTime, NaiveDateTime};
+use duckdb::Connection;
+use serde::Deserialize;
+use serde_json::Value;
+
+use crate::ids::normalize_id;
+use crate::ingest::{MetricRow, ParsedRows, SpanRow, append_rows};
+use crate::ingest_incremental::IngestReport;
+use crate::query::{parse_span_kind, parse_status_code};
+use crate::sample::STATUS_ERROR;
+use crate::scrub::Scrubber;
+use crate::series::TEMPORALITY_CUMULATIVE;
+
+/// Import a Jaeger trace JSON document: the UI's "Download JSON" / query API response
+/// (`{"data": [trace, ...]}`), a bare array of traces, or a single trace. Span logs are
+/// not imported; spans already in the store (same trace and span ID) are skipped.
+pub fn import_jaeger(conn: &Connection, json: &str, scrubber: &Scrubber) -> Result<IngestReport> {
+    let doc: Value = serde_json::from_str(json).context("parsing Jaeger JSON")?;
+    let traces = match doc {
+        Value::Object(mut obj) if obj.contains_key("data") => {
+            obj.remove("data").unwrap_or_default()
+        }
+        Value::Object(obj) => Value::Array(vec![Value::Object(obj)]),
+        array @ Value::Array(_) => array,
+        _ => bail!("expected a Jaeger trace object or array"),
+    };
+    let traces: Vec<JaegerTrace> =
+        serde_json::from_value(traces).context("reading Jaeger traces")?;
+
+    let mut rows = Vec::new();
+    for trace in &traces {
+        for span in &trace.spans {
+            let process = span.process.as_ref().or_else(|| {
+                span.process_id
+                    .as_ref()
+                    .and_then(|id| trace.processes.get(id))
+            });
+            rows.push(jaeger_span_row(span, process, scrubber)?);
+        }
+    }
+    Ok(IngestReport {
+        traces: write_spans(conn, rows)?,
+        ..Default::default()
+    })
+}
+
+#[derive(Deserialize)]
+struct JaegerTrace {
+    #[serde(default)]
+    spans: Vec<JaegerSpan>,
+    #[serde(default)]
+    processes: HashMap<String, JaegerProcess>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct JaegerSpan {
+    #[serde(rename = "traceID")]
+    trace_id: String,
+    #[serde(rename = "spanID")]
+    span_id: String,
+    operation_name: String,
+    #[serde(default)]
+    references: Vec<JaegerReference>,
+    /// Microseconds since the Unix epoch.
+    start_time: i64,
+    /// Microseconds.
+    #[serde(default)]
+    duration: i64,
+    #[serde(default)]
+    tags: Vec<JaegerTag>,
+    #[serde(rename = "processID")]
+    process_id: Option<String>,
+    /// Inline process, used by some exporters instead of `processID`.
+    process: Option<JaegerProcess>,
+    flags: Option<u32>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct JaegerReference {
+    ref_type: String,
+    #[serde(rename = "spanID")]
+    span_id: String,
+}
+
+#[derive(Deserialize)]
+struct JaegerTag {
+    key: String,
+    #[serde(default)]
+    value: Value,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct JaegerProcess {
+    service_name: String,
+}
+
+fn jaeger_span_row(
+    span: &JaegerSpan,
+    process: Option<&JaegerProcess>,
+    scrubber: &Scrubber,
+) -> Result<SpanRow> {
+    let start_time = DateTime::from_timestamp_micros(span.start_time)
+        .with_context(|| format!("span {} has an invalid startTime", span.span_id))?
+        .naive_utc();
+    let duration_ns = span.duration.saturating_mul(1000);
+    let end_time = start_time + chrono::Duration::nanoseconds(duration_ns);
+
+    // Jaeger carries OTel's span kind and status as tags; the rest become attributes.
+    let mut kind = 0;
+    let mut status_code = 0;
+    let mut attrs = serde_json::Map::new();
+    for tag in &span.tags {
+        match (tag.key.as_str(), &tag.value) {
+            ("span.kind", Value::String(k)) => kind = parse_span_kind(k).unwrap_or(0),
+            ("otel.status_code", Value::String(s)) => {
+                status_code = parse_status_code(s).unwrap_or(status_code)
+            }
+            ("error", Value::Bool(true)) => status_code = STATUS_ERROR,
+            ("error", Value::String(s)) if s == "true" => status_code = STATUS_ERROR,
+            _ => {
+                attrs.insert(tag.key.clone(), tag.value.clone());
+            }
+        }
+    }
+    let mut attrs = Value::Object(attrs);
+    scrubber.scrub_attrs(&mut attrs);
+
+    // The parent is the CHILD_OF reference, or FOLLOWS_FROM when that is all there is.
+    let parent = span
+        .references
+        .iter()
+        .find(|r| r.ref_type == "CHILD_OF")
+        .or_else(|| span.references.first());
+
+    Ok(SpanRow {
+        trace_id: padded_id(&span.trace_id, 32),
+        span_id: padded_id(&span.span_id, 16),
+        parent_span_id: parent.map(|r| padded_id(&r.span_id, 16)),
+        name: span.operation_name.clone(),
+        kind,
+        start_time: Some(start_time),
+        end_time: Some(end_time),
+        duration_ns,
+        status_code,
+        service_name: process
+            .map(|p| p.service_name.clone())
+            .unwrap_or_else(|| "unknown".to_string()),
+        attributes: serde_json::to_string(&attrs)?,
+        date: Some(start_time.date()),
+        trace_state: None,
+        flags: span.flags.filter(|&n| n != 0),
+        dropped_attributes_count: None,
+        dropped_events_count: None,
+        dropped_links_count: None,
+    })
+}
+
+/// Import Zipkin v2 JSON: an array of spans (`/api/v2/spans` POST body), or an array of
+/// traces (`/api/v2/traces` response). Spans already in the store are skipped.
+pub fn import_zipkin(conn: &Connection, json: &str, scrubber: &Scrubber) -> Result<IngestReport> {
+    let doc: Value = serde_json::from_str(json).context("parsing Zipkin JSON")?;
+    let Value::Array(items) = doc else {
+        bail!("expected a Zipkin span array");
+    };
+    let mut spans = Vec::new();
+    for item in items {
+        match item {
+            Value::Array(trace) => spans.extend(trace),
+            span => spans.push(span),
+        }
+    }
+    let spans: Vec<ZipkinSpan> =
+        serde_json::from_value(Value::Array(spans)).context("reading Zipkin spans")?;
+
+    let rows = spans
+        .iter()
+        .map(|span| zipkin_span_row(span, scrubber))
+        .collect::<Result<_>>()?;
+    Ok(IngestReport {
+        traces: write_spans(conn, rows)?,
+        ..Default::default()
+    })
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ZipkinSpan {
+    trace_id: String,
+    id: String,
+    parent_id: Option<String>,
+    #[serde(default)]
+    name: Option<String>,
+    kind: Option<String>,
+    /// Microseconds since the Unix epoch.
+    timestamp: i64,
+    /// Microseconds.
+    #[serde(default)]
+    duration: i64,
+    local_endpoint: Option<ZipkinEndpoint>,
+    remote_endpoint: Option<ZipkinEndpoint>,
+    #[serde(default)]
+    annotations: Vec<ZipkinAnnotation>,
+    #[serde(default)]
+    tags: serde_json::Map<String, Value>,
+}
+
+#[derive(Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct ZipkinEndpoint {
+    service_name: Option<String>,
+}
+
+#[derive(Deserialize, serde::Serialize)]
+struct ZipkinAnnotation {
+    timestamp: i64,
+    value: String,
+}
+
+fn zipkin_span_row(span: &ZipkinSpan, scrubber: &Scrubber) -> Result<SpanRow> {
+    let start_time = DateTime::from_timestamp_micros(span.timestamp)
+        .with_context(|| format!("span {} has an invalid timestamp", span.id))?
+        .naive_utc();
+    let duration_ns = span.duration.saturating_mul(1000);
+    let end_time = start_time + chrono::Duration::nanoseconds(duration_ns);
+
+    // Zipkin marks failed spans with an `error` tag whatever its value; OTel exporters
+    // also write `otel.status_code`.
+    let mut attrs = span.tags.clone();
+    let mut status_code = 0;
+    if let Some(Value::String(s)) = attrs.remove("otel.status_code") {
+        status_code = parse_status_code(&s).unwrap_or(0);
+    }
+    if attrs.remove("error").is_some() {
+        status_code = STATUS_ERROR;
+    }
+    if let Some(peer) = span
+        .remote_endpoint
+        .as_ref()
+        .and_then(|e| e.service_name.clone())
+    {
+        attrs.entry("peer.service").or_insert(Value::String(peer));
+    }
+    // The traces table has no events; keep annotations with the span.
+    if !span.annotations.is_empty() {
+        attrs.insert(
+            "zipkin.annotations".to_string(),
+            serde_json::to_value(&span.annotations)?,
+        );
+    }
+    let mut attrs = Value::Object(attrs);
+    scrubber.scrub_attrs(&mut attrs);
+
+    Ok(SpanRow {
+        trace_id: padded_id(&span.trace_id, 32),
+        span_id: padded_id(&span.id, 16),
+        parent_span_id: span.parent_id.as_deref().map(|id| padded_id(id, 16)),
+        name: span.name.clone().unwrap_or_default(),
+        kind: span
+            .kind
+            .as_deref()
+            .and_then(|k| parse_span_kind(k).ok())
+            .unwrap_or(0),
+        start_time: Some(start_time),
+        end_time: Some(end_time),
+        duration_ns,
+        status_code,
+        service_name: span
+            .local_endpoint
+            .as_ref()
+            .and_then(|e| e.service_name.clone())
+            .unwrap_or_else(|| "unknown".to_string()),
+        attributes: serde_json::to_string(&attrs)?,
+        date: Some(start_time.date()),
+        trace_state: None,
+        flags: None,
+        dropped_attributes_count: None,
+        dropped_events_count: None,
+        dropped_links_count: None,
+    })
+}
+
+/// Import Prometheus text exposition or OpenMetrics: a scrape saved to a file, or a
+/// snapshot dump. Samples without a timestamp are stored at `default_time`. The `job` label
+/// becomes the service name. Points already in the store are skipped.
+pub fn import_openmetrics(
+    conn: &Connection,
+    text: &str,
+    default_time: NaiveDateTime,
+    scrubber: &Scrubber,
+) -> Result<IngestReport> {
+    let rows = parse_openmetrics(text, default_time, scrubber)?;
+    Ok(IngestReport {
+        metrics: write_metrics(conn, rows)?,
+        ..Default::default()
+    })
+}
+
+/// The metric family a sample belongs to, from its `# TYPE` and `# UNIT` lines.
+#[derive(Default)]
+struct Family {
+    name: String,
+    kind: String,
+    unit: Option<String>,
+}
+
+fn parse_openmetrics(
+    text: &str,
+    default_time: NaiveDateTime,
+    scrubber: &Scrubber,
+) -> Result<Vec<MetricRow>> {
+    let mut family = Family::default();
+    let mut rows = Vec::new();
+    for (i, line) in text.lines().enumerate() {
+        let line = line.trim();
+        if let Some(comment) = line.strip_prefix('#') {
+            let mut words = comment.split_whitespace();
+            match (words.next(), words.next(), words.next()) {
+                (Some("TYPE"), Some(name), Some(kind)) => {
+                    family = Family {
+                        name: name.to_string(),
+                        kind: kind.to_string(),
+                        unit: None,
+                    }
+                }
+                (Some("UNIT"), Some(name), Some(unit)) if name == family.name => {
+                    family.unit = Some(unit.to_string())
+                }
+                _ => {}
+            }
+            continue;
+        }
+        if line.is_empty() {
+            continue;
+        }
+        let sample = parse_sample(line).with_context(|| format!("line {}: {line}", i + 1))?;
+        if let Some(row) = sample_row(&family, sample, default_time, scrubber)? {
+            rows.push(row);
+        }
+    }
+    Ok(rows)
+}
+
+struct Sample<'a> {
+    name: &'a str,
+    labels: serde_json::Map<String, Value>,
+    value: f64,
+    timestamp: Option<NaiveDateTime>,
+}
+
+/// Parse `name{label="value",...} value [timestamp] [# exemplar]`.
+fn parse_sample(line: &str) -> Result<Sample<'_>> {
+    let name_end = line
+        .find(|c: char| c == '{' || c.is_whitespace())
+        .context("missing value")?;
+    let name = &line[..name_end];
+    let mut rest = &line[name_end..];
+    let mut labels = serde_json::Map::new();
+    if let Some(body) = rest.strip_prefix('{') {
+        let (parsed, after) = parse_labels(body)?;
+        labels = parsed;
+        rest = after;
+    }
+    // Exemplars follow the timestamp after " # ".
+    let rest = rest.split(" # ").next().unwrap_or_default();
+    let mut fields = rest.split_whitespace();
+    let value = fields.next().context("missing value")?;
+    let value: f64 = value
+        .parse()
+        .with_context(|| format!("invalid value {value:?}"))?;
+    let timestamp = fields.next().map(parse_sample_time).transpose()?;
+    Ok(Sample {
+        name,
+        labels,
+        value,
+        timestamp,
+    })
+}
+
+/// Parse label pairs up to the closing brace, returning them and the text after it.
+fn parse_labels(mut s: &str) -> Result<(serde_json::Map<String, Value>, &str)> {
+    let mut labels = serde_json::Map::new();
+    loop {
+        s = s.trim_start_matches([',', ' ']);
+        if let Some(rest) = s.strip_prefix('}') {
+            return Ok((labels, rest));
+        }
+        let (key, rest) = s.split_once('=').context("unterminated label set")?;
+        let rest = rest
+            .strip_prefix('"')
+            .context("label value must be quoted")?;
+        let mut value = String::new();
+        let mut chars = rest.char_indices();
+        let end = loop {
+            match chars.next() {
+                Some((i, '"')) => break i,
+                Some((_, '\\')) => match chars.next() {
+                    Some((_, 'n')) => value.push('\n'),
+                    Some((_, c)) => value.push(c),
+                    None => bail!("unterminated label value"),
+                },
+                Some((_, c)) => value.push(c),
+                None => bail!("unterminated label value"),
+            }
+        };
+        labels.insert(key.trim().to_string(), Value::String(value));
+        s = &rest[end + 1..];
+    }
+}
+
+/// Prometheus text timestamps are integer milliseconds, OpenMetrics ones (possibly
+/// fractional) seconds; anything below 1e11 is taken as seconds.
+fn parse_sample_time(s: &str) -> Result<NaiveDateTime> {
+    let t: f64 = s
+        .parse()
+        .with_context(|| format!("invalid timestamp {s:?}"))?;
+    let micros = if s.contains('.') || t.abs() < 1e11 {
+        t * 1e6
+    } else {
+        t * 1e3
+    };
+    DateTime::from_timestamp_micros(micros.round() as i64)
+        .map(|t| t.naive_utc())
+        .with_context(|| format!("timestamp {s:?} out of range"))
+}
+
+/// Map a sample onto a metrics row, as the OTLP ingest path would have stored it: counters
+/// as cumulative monotonic sums, histograms and summaries as their `_sum` under the family
+/// name. Buckets, quantiles, and `_created` samples have no equivalent and are skipped.
+fn sample_row(
+    family: &Family,
+    sample: Sample<'_>,
+    default_time: NaiveDateTime,
+    scrubber: &Scrubber,
+) -> Result<Option<MetricRow>> {
+    let suffix = sample
+        .name
+        .strip_prefix(family.name.as_str())
+        .filter(|_| !family.name.is_empty());
+    let (name, metric_type, temporality, monotonic) = match (family.kind.as_str(), suffix) {
+        (_, Some("_created")) => return Ok(None),
+        ("counter", Some("" | "_total")) => {
+            (sample.name, "sum", Some(TEMPORALITY_CUMULATIVE), Some(true))
+        }
+        ("histogram" | "summary", Some("_sum")) => (
+            family.name.as_str(),
+            "histogram",
+            Some(TEMPORALITY_CUMULATIVE),
+            None,
+        ),
+        ("histogram" | "summary", Some("_count")) => {
+            (sample.name, "sum", Some(TEMPORALITY_CUMULATIVE), Some(true))
+        }
+        ("histogram" | "summary", Some("" | "_bucket")) => return Ok(None),
+        _ => (sample.name, "gauge", None, None),
+    };
+
+    let mut labels = sample.labels;
+    let service_name = match labels.remove("job") {
+        Some(Value::String(job)) => job,
+        _ => "unknown".to_string(),
+    };
+    let mut attrs = Value::Object(labels);
+    scrubber.scrub_attrs(&mut attrs);
+    let timestamp = sample.timestamp.unwrap_or(default_time);
+    Ok(Some(MetricRow {
+        metric_name: name.to_string(),
+        metric_type,
+        value: sample.value,
+        timestamp: Some(timestamp),
+        service_name,
+        temporality,
+        monotonic,
+        unit: family.unit.clone(),
+        attributes: serde_json::to_string(&attrs)?,
+        date: Some(timestamp.date()),
+    }))
+}
+
+/// Append metric points not already stored (same name, service, attributes, and time).
+fn write_metrics(conn: &Connection, rows: Vec<MetricRow>) -> Result<usize> {
+    let mut existing: HashSet<(String, String, String, NaiveDateTime)> = HashSet::new();
+    let names: HashSet<&str> = rows.iter().map(|r| r.metric_name.as_str()).collect();
+    let mut stmt = conn.prepare(
+        "SELECT service_name, CAST(attributes AS VARCHAR), timestamp FROM metrics \
+         WHERE metric_name = ?",
+    )?;
+    for name in names {
+        let points = stmt.query_map(duckdb::params![name], |row| {
+            Ok((name.to_string(), row.get(0)?, row.get(1)?, row.get(2)?))
+        })?;
+        for point in points {
+            existing.insert(point?);
+        }
+    }
+    let rows: Vec<MetricRow> = rows
+        .into_iter()
+        .filter(|r| {
+            existing.insert((
+                r.metric_name.clone(),
+                r.service_name.clone(),
+                r.attributes.clone(),
+                r.timestamp.unwrap_or_default(),
+            ))
+        })
+        .collect();
+
+    let tx = conn.unchecked_transaction()?;
+    let written = append_rows(&tx, &[ParsedRows::Metrics(rows)])?;
+    tx.commit()?;
+    Ok(written)
+}
+
+/// Normalize an ID, restoring the leading zeros Jaeger and Zipkin drop from hex IDs.
+fn padded_id(raw: &str, hex_len: usize) -> String {
+    let id = raw.trim();
+    if !id.is_empty() && id.len() < hex_len && id.bytes().all(|b| b.is_ascii_hexdigit()) {
+        return format!("{id:0>hex_len$}").to_ascii_lowercase();
+    }
+    normalize_id(id)
+}
+
+/// Append spans not already stored, in one transaction. Returns the number written.
+fn write_spans(conn: &Connection, rows: Vec<SpanRow>) -> Result<usize> {
+    let mut existing: HashSet<(String, String)> = HashSet::new();
+    let trace_ids: HashSet<&str> = rows.iter().map(|r| r.trace_id.as_str()).collect();
+    let mut stmt = conn.prepare("SELECT span_id FROM traces WHERE trace_id = ?")?;
+    for trace_id in trace_ids {
+        let spans = stmt.query_map(duckdb::params![trace_id], |row| row.get::<_, String>(0))?;
+        for span_id in spans {
+            existing.insert((trace_id.to_string(), span_id?));
+        }
+    }
+    let rows: Vec<SpanRow> = rows
+        .into_iter()
+        .filter(|r| existing.insert((r.trace_id.clone(), r.span_id.clone())))
+        .collect();
+
+    let tx = conn.unchecked_transaction()?;
+    let written = append_rows(&tx, &[ParsedRows::Spans(rows)])?;
+    tx.commit()?;
+    Ok(written)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    const JAEGER: &str = r#"{
+      "data": [{
+        "traceID": "4bf92f3577b34da6a3ce929d0e0e4736",
+        "spans": [
+          {
+            "traceID": "4bf92f3577b34da6a3ce929d0e0e4736",
+            "spanID": "f67a9a6fc0b3c23",
+            "operationName": "GET /checkout",
+            "references": [],
+            "startTime": 1710000000000000,
+            "duration": 25000,
+            "tags": [
+              {"key": "span.kind", "type": "string", "value": "server"},
+              {"key": "http.status_code", "type": "int64", "value": 500},
+              {"key": "error", "type": "bool", "value": true}
+            ],
+            "logs": [{"timestamp": 1710000000001000, "fields": []}],
+            "processID": "p1"
+          },
+          {
+            "traceID": "4bf92f3577b34da6a3ce929d0e0e4736",
+            "spanID": "00f067aa0ba902b7",
+            "operationName": "charge",
+            "references": [{"refType": "CHILD_OF", "traceID": "4bf92f3577b34da6a3ce929d0e0e4736", "spanID": "f67a9a6fc0b3c23"}],
+            "startTime": 1710000000005000,
+            "duration": 10000,
+            "tags": [{"key": "span.kind", "type": "string", "value": "client"}],
+            "processID": "p2"
+          }
+        ],
+        "processes": {
+          "p1": {"serviceName": "checkout", "tags": []},
+          "p2": {"serviceName": "payments", "tags": []}
+        }
+      }]
+    }"#;
+
+    #[test]
+    fn imports_jaeger_traces_once() {
+        let conn = db::open_in_memory().unwrap();
+        let report = import_jaeger(&conn, JAEGER, &Scrubber::default()).unwrap();
+        assert_eq!(report.traces, 2);
+
+        let (name, kind, status, service, attrs, duration): (String, i32, i32, String, String, i64) = conn
+            .query_row(
+                "SELECT name, kind, status_code, service_name, CAST(attributes AS VARCHAR), duration_ns FROM traces WHERE span_id = '0f67a9a6fc0b3c23'",
+                [],
+                |row| Ok((row.get(0)?, row.get(1)?, row.get(2)?, row.get(3)?, row.get(4)?, row.get(5)?)),
+            )
+            .unwrap();
+        assert_eq!(
+            (name.as_str(), kind, status, service.as_str(), duration),
+            ("GET /checkout", 2, 2, "checkout", 25_000_000)
+        );
+        assert_eq!(attrs, r#"{"http.status_code":500}"#);
+        let (start, parent): (chrono::NaiveDateTime, String) = conn
+            .query_row(
+                "SELECT start_time, parent_span_id FROM traces WHERE span_id = '00f067aa0ba902b7'",
+                [],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .unwrap();
+        assert_eq!(start.to_string(), "2024-03-09 16:00:00.005");
+        assert_eq!(parent, "0f67a9a6fc0b3c23");
+
+        // Importing the same dump again adds nothing.
+        let report = import_jaeger(&conn, JAEGER, &Scrubber::default()).unwrap();
+        assert_eq!(report.traces, 0);
+    }
+
+    const OPENMETRICS: &str = r#"# HELP http_requests Requests served.
+# TYPE http_requests counter
+http_requests_total{job="checkout",route="/pay",code="200"} 1027 1710000000.5
+http_requests_created{job="checkout",route="/pay",code="200"} 1709990000
+# TYPE queue_depth gauge
+# UNIT queue_depth items
+queue_depth{job="worker",queue="a \"b\""} 3
+# TYPE rpc_seconds histogram
+rpc_seconds_bucket{job="checkout",le="0.1"} 8 1710000000000
+rpc_seconds_bucket{job="checkout",le="+Inf"} 10 1710000000000
+rpc_seconds_sum{job="checkout"} 1.5 1710000000000
+rpc_seconds_count{job="checkout"} 10 1710000000000 # {trace_id="abc"} 0.2 1710000000
+# EOF
+"#;
+
+    #[test]
+    fn imports_openmetrics_samples() {
+        let conn = db::open_in_memory().unwrap();
+        let now: NaiveDateTime = "2024-03-10T00:00:00".parse().unwrap();
+        let report = import_openmetrics(&conn, OPENMETRICS, now, &Scrubber::default()).unwrap();
+        assert_eq!(report.metrics, 4);
+
+        let rows: Vec<String> = conn
+            .prepare(
+                "SELECT concat_ws(' ', metric_name, metric_type, value, timestamp, service_name, unit, attributes) FROM metrics ORDER BY metric_name",
+            )
+            .unwrap()
+            .query_map([], |row| row.get(0))
+            .unwrap()
+            .map(Result::unwrap)
+            .collect();
+        assert_eq!(
+            rows,
+            [
+                r#"http_requests_total sum 1027.0 2024-03-09 16:00:00.5 checkout {"route":"/pay","code":"200"}"#,
+                r#"queue_depth gauge 3.0 2024-03-10 00:00:00 worker items {"queue":"a \"b\""}"#,
+                r#"rpc_seconds histogram 1.5 2024-03-09 16:00:00 checkout {}"#,
+                r#"rpc_seconds_count sum 10.0 2024-03-09 16:00:00 checkout {}"#,
+            ]
+        );
+
+        // Re-importing the same file adds nothing.
+        let report = import_openmetrics(&conn, OPENMETRICS, now, &Scrubber::default()).unwrap();
+        assert_eq!(report.metrics, 0);
+    }
+
+    #[test]
+    fn rejects_malformed_samples() {
+        let now = NaiveDateTime::default();
+        let err = parse_openmetrics("up{job=\"a\" 1\n", now, &Scrubber::default())
+            .err()
+            .unwrap();
+        assert!(format!("{err:#}").starts_with("line 1: "));
+        assert!(parse_openmetrics("up one\n", now, &Scrubber::default()).is_err());
+    }
+
+    const ZIPKIN: &str = r#"[[
+      {
+        "traceId": "a3ce929d0e0e4736",
+        "id": "f67a9a6fc0b3c23",
+        "name": "get /checkout",
+        "kind": "SERVER",
+        "timestamp": 1710000000000000,
+        "duration": 25000,
+        "localEndpoint": {"serviceName": "checkout", "ipv4": "10.0.0.1"},
+        "tags": {"http.method": "GET", "error": "payment declined"}
+      },
+      {
+        "traceId": "a3ce929d0e0e4736",
+        "parentId": "f67a9a6fc0b3c23",
+        "id": "00f067aa0ba902b7",
+        "name": "charge",
+        "kind": "CLIENT",
+        "timestamp": 1710000000005000,
+        "duration": 10000,
+        "localEndpoint": {"serviceName": "checkout"},
+        "remoteEndpoint": {"serviceName": "payments"},
+        "annotations": [{"timestamp": 1710000000006000, "value": "retry"}]
+      }
+    ]]"#;
+
+    #[test]
+    fn imports_zipkin_spans() {
+        let conn = db::open_in_memory().unwrap();
+        let report = import_zipkin(&conn, ZIPKIN, &Scrubber::default()).unwrap();
+        assert_eq!(report.traces, 2);
+
+        let rows: Vec<(String, Option<String>, i32, i32, String, String)> = conn
+            .prepare(
+                "SELECT trace_id, parent_span_id, kind, status_code, service_name, CAST(attributes AS VARCHAR) FROM traces ORDER BY start_time",
+            )
+            .unwrap()
+            .query_map([], |row| {
+                Ok((row.get(0)?, row.get(1)?, row.get(2)?, row.get(3)?, row.get(4)?, row.get(5)?))
+            })
+            .unwrap()
+            .map(Result::unwrap)
+            .collect();
+        assert_eq!(rows[0].0, "0000000000000000a3ce929d0e0e4736");
+        assert_eq!(
+            (
+                &rows[0].1,
+                rows[0].2,
+                rows[0].3,
+                rows[0].4.as_str(),
+                rows[0].5.as_str()
+            ),
+            (&None, 2, 2, "checkout", r#"{"http.method":"GET"}"#)
+        );
+        assert_eq!(
+            (
+                rows[1].1.as_deref(),
+                rows[1].2,
+                rows[1].3,
+                rows[1].5.as_str()
+            ),
+            (
+                Some("0f67a9a6fc0b3c23"),
+                3,
+                0,
+                r#"{"peer.service":"payments","zipkin.annotations":[{"timestamp":1710000000006000,"value":"retry"}]}"#
+            )
+        );
+    }
+}
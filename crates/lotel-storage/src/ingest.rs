@@ -1,14 +1,24 @@
+#[cfg(feature = "duckdb")]
 use std::io::{BufRead, BufReader};
+#[cfg(feature = "duckdb")]
 use std::path::Path;
 
-use anyhow::{Context, Result};
-use duckdb::{Connection, Transaction};
+#[cfg(feature = "duckdb")]
+use anyhow::Context;
+use anyhow::Result;
+#[cfg(feature = "duckdb")]
+use duckdb::Connection;
 use serde::Deserialize;
 use serde_json::Value;
 
+use crate::ids::normalize_id;
+use crate::sample::{SEVERITY_ERROR, STATUS_ERROR, Sampler};
+use crate::scrub::Scrubber;
+
 /// Delete all rows from the `ingest_cursors` table.
 /// Used by `lotel ingest --full` to remove stale cursor entries for files that may
 /// no longer exist.
+#[cfg(feature = "duckdb")]
 pub fn clear_ingest_cursors(conn: &Connection) -> Result<()> {
     conn.execute("DELETE FROM ingest_cursors", [])
         .context("clearing ingest_cursors")?;
@@ -18,9 +28,10 @@ pub fn clear_ingest_cursors(conn: &Connection) -> Result<()> {
 /// Delete all rows from the signal tables (traces, metrics, logs).
 /// Used by `lotel ingest --full` to prevent duplicates when re-ingesting from byte 0.
 /// Does not touch `ingest_cursors` — those are overwritten by subsequent ingestion.
+#[cfg(feature = "duckdb")]
 pub fn clear_signal_tables(conn: &Connection) -> Result<()> {
     let tx = conn.unchecked_transaction()?;
-    for table in ["traces", "metrics", "logs"] {
+    for table in ["traces", "metrics", "logs", "trace_summaries"] {
         tx.execute(&format!("DELETE FROM {table}"), [])
             .with_context(|| format!("clearing {table}"))?;
     }
@@ -29,21 +40,16 @@ pub fn clear_signal_tables(conn: &Connection) -> Result<()> {
 }
 
 /// Ingest all JSONL files from data_path into the database.
+#[cfg(feature = "duckdb")]
 pub fn ingest_all(conn: &Connection, data_path: &Path) -> Result<()> {
-    for (signal, ingest_fn) in [
-        (
-            "traces",
-            ingest_traces as fn(&Connection, &Path) -> Result<()>,
-        ),
-        (
-            "metrics",
-            ingest_metrics as fn(&Connection, &Path) -> Result<()>,
-        ),
-        ("logs", ingest_logs as fn(&Connection, &Path) -> Result<()>),
+    for (signal, parse_fn) in [
+        ("traces", parse_trace_line as ParseLineFn),
+        ("metrics", parse_metric_line as ParseLineFn),
+        ("logs", parse_log_line as ParseLineFn),
     ] {
         let file = data_path.join(signal).join(format!("{signal}.jsonl"));
         if file.exists() {
-            ingest_fn(conn, &file).with_context(|| format!("ingesting {signal}"))?;
+            ingest_file(conn, &file, parse_fn).with_context(|| format!("ingesting {signal}"))?;
         }
     }
     Ok(())
@@ -99,6 +105,24 @@ struct OtlpValue {
     bool_value: Option<bool>,
     #[serde(alias = "double_value")]
     double_value: Option<f64>,
+    #[serde(alias = "bytes_value")]
+    bytes_value: Option<String>,
+    #[serde(alias = "array_value")]
+    array_value: Option<OtlpArray>,
+    #[serde(alias = "kvlist_value")]
+    kvlist_value: Option<OtlpKvList>,
+}
+
+#[derive(Deserialize)]
+struct OtlpArray {
+    #[serde(default)]
+    values: Vec<OtlpValue>,
+}
+
+#[derive(Deserialize)]
+struct OtlpKvList {
+    #[serde(default)]
+    values: Vec<OtlpAttr>,
 }
 
 impl OtlpValue {
@@ -119,8 +143,51 @@ impl OtlpValue {
         if let Some(d) = self.double_value {
             return format!("{d}");
         }
+        if let Some(b) = &self.bytes_value {
+            return b.clone();
+        }
+        if self.array_value.is_some() || self.kvlist_value.is_some() {
+            return self.to_json().to_string();
+        }
         String::new()
     }
+
+    /// Convert to JSON, keeping ints, doubles, and bools as native JSON types.
+    fn to_json(&self) -> Value {
+        if let Some(s) = &self.string_value {
+            return Value::String(s.clone());
+        }
+        if let Some(v) = &self.int_value {
+            return match v {
+                // Proto JSON encodes int64 as a string.
+                Value::String(s) => s
+                    .parse::<i64>()
+                    .map(Value::from)
+                    .unwrap_or_else(|_| Value::String(s.clone())),
+                Value::Number(n) => Value::Number(n.clone()),
+                _ => Value::String(String::new()),
+            };
+        }
+        if let Some(b) = self.bool_value {
+            return Value::Bool(b);
+        }
+        if let Some(d) = self.double_value {
+            // NaN and infinities have no JSON number form.
+            return serde_json::Number::from_f64(d)
+                .map(Value::Number)
+                .unwrap_or_else(|| Value::String(format!("{d}")));
+        }
+        if let Some(b) = &self.bytes_value {
+            return Value::String(b.clone());
+        }
+        if let Some(arr) = &self.array_value {
+            return Value::Array(arr.values.iter().map(|v| v.to_json()).collect());
+        }
+        if let Some(kv) = &self.kvlist_value {
+            return flatten_attrs(&kv.values);
+        }
+        Value::String(String::new())
+    }
 }
 
 fn extract_service_name(attrs: &[OtlpAttr]) -> String {
@@ -140,9 +207,9 @@ fn flatten_attrs(attrs: &[OtlpAttr]) -> serde_json::Value {
         let val = attr
             .value
             .as_ref()
-            .map(|v| v.as_string())
-            .unwrap_or_default();
-        map.insert(attr.key.clone(), Value::String(val));
+            .map(|v| v.to_json())
+            .unwrap_or_else(|| Value::String(String::new()));
+        map.insert(attr.key.clone(), val);
     }
     Value::Object(map)
 }
@@ -195,6 +262,15 @@ struct SpanJson {
     end_time_unix_nano: OtlpNano,
     status: Option<SpanStatus>,
     attributes: Option<Vec<OtlpAttr>>,
+    #[serde(alias = "trace_state")]
+    trace_state: Option<String>,
+    flags: Option<u32>,
+    #[serde(alias = "dropped_attributes_count")]
+    dropped_attributes_count: Option<u32>,
+    #[serde(alias = "dropped_events_count")]
+    dropped_events_count: Option<u32>,
+    #[serde(alias = "dropped_links_count")]
+    dropped_links_count: Option<u32>,
 }
 
 #[derive(Deserialize)]
@@ -202,14 +278,35 @@ struct SpanStatus {
     code: Option<i32>,
 }
 
-/// Ingest a single JSON line of trace data. Returns the number of spans ingested.
-pub(crate) fn ingest_trace_line(tx: &Transaction, line: &str) -> Result<usize> {
+/// A flattened span ready for insertion into the `traces` table.
+pub(crate) struct SpanRow {
+    pub(crate) trace_id: String,
+    pub(crate) span_id: String,
+    pub(crate) parent_span_id: Option<String>,
+    pub(crate) name: String,
+    pub(crate) kind: i32,
+    pub(crate) start_time: Option<chrono::NaiveDateTime>,
+    pub(crate) end_time: Option<chrono::NaiveDateTime>,
+    pub(crate) duration_ns: i64,
+    pub(crate) status_code: i32,
+    pub(crate) service_name: String,
+    pub(crate) attributes: String,
+    pub(crate) date: Option<chrono::NaiveDate>,
+    pub(crate) trace_state: Option<String>,
+    pub(crate) flags: Option<u32>,
+    pub(crate) dropped_attributes_count: Option<u32>,
+    pub(crate) dropped_events_count: Option<u32>,
+    pub(crate) dropped_links_count: Option<u32>,
+}
+
+/// Parse a single JSON line of trace data into span rows.
+pub(crate) fn parse_trace_line(line: &str, scrubber: &Scrubber) -> Result<ParsedRows> {
     let batch: TraceBatch = match serde_json::from_str(line) {
         Ok(b) => b,
-        Err(_) => return Ok(0),
+        Err(_) => return Ok(ParsedRows::Spans(Vec::new())),
     };
 
-    let mut count = 0;
+    let mut rows = Vec::new();
     for rs in &batch.resource_spans {
         let svc_name = rs
             .resource
@@ -220,65 +317,59 @@ pub(crate) fn ingest_trace_line(tx: &Transaction, line: &str) -> Result<usize> {
 
         for ss in &rs.scope_spans {
             for span in &ss.spans {
-                insert_span(tx, span, &svc_name)?;
-                count += 1;
+                rows.push(span_row(span, &svc_name, scrubber)?);
             }
         }
     }
-    Ok(count)
-}
-
-fn ingest_traces(conn: &Connection, file: &Path) -> Result<()> {
-    let f = std::fs::File::open(file)?;
-    let reader = BufReader::with_capacity(1024 * 1024, f);
-
-    let tx = conn.unchecked_transaction()?;
-
-    for line in reader.lines() {
-        let line = line?;
-        if line.trim().is_empty() {
-            continue;
-        }
-        ingest_trace_line(&tx, &line)?;
-    }
-
-    tx.commit()?;
-    Ok(())
+    Ok(ParsedRows::Spans(rows))
 }
 
-fn insert_span(tx: &Transaction, span: &SpanJson, svc_name: &str) -> Result<()> {
+fn span_row(span: &SpanJson, svc_name: &str, scrubber: &Scrubber) -> Result<SpanRow> {
     let start_time = span.start_time_unix_nano.to_datetime();
     let end_time = span.end_time_unix_nano.to_datetime();
     let duration_ns = match (start_time, end_time) {
         (Some(s), Some(e)) => (e - s).num_nanoseconds().unwrap_or(0),
         _ => 0,
     };
-    let attrs = span
+    let mut attrs = span
         .attributes
         .as_ref()
         .map(|a| flatten_attrs(a))
         .unwrap_or(Value::Object(serde_json::Map::new()));
-    let attrs_str = serde_json::to_string(&attrs)?;
-    let date_str = start_time.map(|t| t.format("%Y-%m-%d").to_string());
-
-    tx.execute(
-        "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-        duckdb::params![
-            span.trace_id.as_deref().unwrap_or(""),
-            span.span_id.as_deref().unwrap_or(""),
-            span.parent_span_id.as_deref(),
-            span.name.as_deref().unwrap_or(""),
-            span.kind.unwrap_or(0),
-            start_time,
-            end_time,
-            duration_ns,
-            span.status.as_ref().and_then(|s| s.code).unwrap_or(0),
-            svc_name,
-            attrs_str,
-            date_str.as_deref(),
-        ],
-    )?;
-    Ok(())
+    scrubber.scrub_attrs(&mut attrs);
+
+    Ok(SpanRow {
+        trace_id: span
+            .trace_id
+            .as_deref()
+            .map(normalize_id)
+            .unwrap_or_default(),
+        span_id: span
+            .span_id
+            .as_deref()
+            .map(normalize_id)
+            .unwrap_or_default(),
+        parent_span_id: span
+            .parent_span_id
+            .as_deref()
+            .map(normalize_id)
+            .filter(|s| !s.is_empty()),
+        name: span.name.clone().unwrap_or_default(),
+        kind: span.kind.unwrap_or(0),
+        start_time,
+        end_time,
+        duration_ns,
+        status_code: span.status.as_ref().and_then(|s| s.code).unwrap_or(0),
+        service_name: svc_name.to_string(),
+        attributes: serde_json::to_string(&attrs)?,
+        date: start_time.map(|t| t.date()),
+        trace_state: span.trace_state.clone().filter(|s| !s.is_empty()),
+        // Zero is the proto3 default, so it is stored as NULL like an absent field.
+        flags: span.flags.filter(|&n| n != 0),
+        dropped_attributes_count: span.dropped_attributes_count.filter(|&n| n != 0),
+        dropped_events_count: span.dropped_events_count.filter(|&n| n != 0),
+        dropped_links_count: span.dropped_links_count.filter(|&n| n != 0),
+    })
 }
 
 // --- Metrics ingestion ---
@@ -444,14 +535,28 @@ fn extract_data_points(m: &MetricJson) -> Vec<MetricPoint> {
     points
 }
 
-/// Ingest a single JSON line of metric data. Returns the number of data points ingested.
-pub(crate) fn ingest_metric_line(tx: &Transaction, line: &str) -> Result<usize> {
+/// A flattened metric data point ready for insertion into the `metrics` table.
+pub(crate) struct MetricRow {
+    pub(crate) metric_name: String,
+    pub(crate) metric_type: &'static str,
+    pub(crate) value: f64,
+    pub(crate) timestamp: Option<chrono::NaiveDateTime>,
+    pub(crate) service_name: String,
+    pub(crate) temporality: Option<i32>,
+    pub(crate) monotonic: Option<bool>,
+    pub(crate) unit: Option<String>,
+    pub(crate) attributes: String,
+    pub(crate) date: Option<chrono::NaiveDate>,
+}
+
+/// Parse a single JSON line of metric data into one row per data point.
+pub(crate) fn parse_metric_line(line: &str, scrubber: &Scrubber) -> Result<ParsedRows> {
     let batch: MetricBatch = match serde_json::from_str(line) {
         Ok(b) => b,
-        Err(_) => return Ok(0),
+        Err(_) => return Ok(ParsedRows::Metrics(Vec::new())),
     };
 
-    let mut count = 0;
+    let mut rows = Vec::new();
     for rm in &batch.resource_metrics {
         let svc_name = rm
             .resource
@@ -462,49 +567,25 @@ pub(crate) fn ingest_metric_line(tx: &Transaction, line: &str) -> Result<usize>
 
         for sm in &rm.scope_metrics {
             for m in &sm.metrics {
-                for dp in extract_data_points(m) {
-                    let attrs_str = serde_json::to_string(&dp.attributes)?;
-                    let date_str = dp.timestamp.map(|t| t.format("%Y-%m-%d").to_string());
-
-                    tx.execute(
-                        "INSERT INTO metrics (metric_name, metric_type, value, timestamp, service_name, aggregation_temporality, is_monotonic, unit, attributes, date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-                        duckdb::params![
-                            m.name,
-                            dp.metric_type,
-                            dp.value,
-                            dp.timestamp,
-                            svc_name,
-                            dp.temporality,
-                            dp.monotonic,
-                            m.unit.as_deref(),
-                            attrs_str,
-                            date_str.as_deref(),
-                        ],
-                    )?;
-                    count += 1;
+                for mut dp in extract_data_points(m) {
+                    scrubber.scrub_attrs(&mut dp.attributes);
+                    rows.push(MetricRow {
+                        metric_name: m.name.clone(),
+                        metric_type: dp.metric_type,
+                        value: dp.value,
+                        timestamp: dp.timestamp,
+                        service_name: svc_name.clone(),
+                        temporality: dp.temporality,
+                        monotonic: dp.monotonic,
+                        unit: m.unit.clone(),
+                        attributes: serde_json::to_string(&dp.attributes)?,
+                        date: dp.timestamp.map(|t| t.date()),
+                    });
                 }
             }
         }
     }
-    Ok(count)
-}
-
-fn ingest_metrics(conn: &Connection, file: &Path) -> Result<()> {
-    let f = std::fs::File::open(file)?;
-    let reader = BufReader::with_capacity(1024 * 1024, f);
-
-    let tx = conn.unchecked_transaction()?;
-
-    for line in reader.lines() {
-        let line = line?;
-        if line.trim().is_empty() {
-            continue;
-        }
-        ingest_metric_line(&tx, &line)?;
-    }
-
-    tx.commit()?;
-    Ok(())
+    Ok(ParsedRows::Metrics(rows))
 }
 
 // --- Logs ingestion ---
@@ -550,14 +631,39 @@ struct LogRecordJson {
     attributes: Option<Vec<OtlpAttr>>,
 }
 
-/// Ingest a single JSON line of log data. Returns the number of log records ingested.
-pub(crate) fn ingest_log_line(tx: &Transaction, line: &str) -> Result<usize> {
+/// A flattened log record ready for insertion into the `logs` table.
+pub(crate) struct LogRow {
+    pub(crate) timestamp: chrono::NaiveDateTime,
+    pub(crate) severity: Option<String>,
+    pub(crate) severity_number: Option<i32>,
+    pub(crate) body: Option<String>,
+    pub(crate) service_name: String,
+    pub(crate) trace_id: Option<String>,
+    pub(crate) span_id: Option<String>,
+    pub(crate) attributes: String,
+    pub(crate) date: chrono::NaiveDate,
+}
+
+/// Render a log body: structured (array/kvlist) bodies are stored as JSON text so they can
+/// be queried with `json_extract`, scalars as plain text.
+fn log_body(body: &OtlpValue, scrubber: &Scrubber) -> String {
+    if body.array_value.is_some() || body.kvlist_value.is_some() {
+        let mut value = body.to_json();
+        scrubber.redact_value(&mut value);
+        value.to_string()
+    } else {
+        scrubber.redact(&body.as_string())
+    }
+}
+
+/// Parse a single JSON line of log data into log rows.
+pub(crate) fn parse_log_line(line: &str, scrubber: &Scrubber) -> Result<ParsedRows> {
     let batch: LogBatch = match serde_json::from_str(line) {
         Ok(b) => b,
-        Err(_) => return Ok(0),
+        Err(_) => return Ok(ParsedRows::Logs(Vec::new())),
     };
 
-    let mut count = 0;
+    let mut rows = Vec::new();
     for rl in &batch.resource_logs {
         let svc_name = rl
             .resource
@@ -573,57 +679,244 @@ pub(crate) fn ingest_log_line(tx: &Transaction, line: &str) -> Result<usize> {
                     .to_datetime()
                     .or_else(|| lr.observed_time_unix_nano.to_datetime())
                     .unwrap_or_else(|| chrono::Utc::now().naive_utc());
-                let attrs = lr
+                let mut attrs = lr
                     .attributes
                     .as_ref()
                     .map(|a| flatten_attrs(a))
                     .unwrap_or(Value::Object(serde_json::Map::new()));
-                let attrs_str = serde_json::to_string(&attrs)?;
-                let body_str = lr.body.as_ref().map(|b| b.as_string());
-                let date_str = ts.format("%Y-%m-%d").to_string();
-                let trace_id = lr.trace_id.as_deref().filter(|s| !s.is_empty());
-                let span_id = lr.span_id.as_deref().filter(|s| !s.is_empty());
-
-                tx.execute(
-                    "INSERT INTO logs (timestamp, severity, severity_number, body, service_name, trace_id, span_id, attributes, date) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
-                    duckdb::params![
-                        ts,
-                        lr.severity_text.as_deref(),
-                        lr.severity_number,
-                        body_str.as_deref(),
-                        svc_name,
-                        trace_id,
-                        span_id,
-                        attrs_str,
-                        date_str.as_str(),
-                    ],
-                )?;
-                count += 1;
+                scrubber.scrub_attrs(&mut attrs);
+
+                rows.push(LogRow {
+                    timestamp: ts,
+                    severity: lr.severity_text.clone(),
+                    severity_number: lr.severity_number,
+                    body: lr.body.as_ref().map(|b| log_body(b, scrubber)),
+                    service_name: svc_name.clone(),
+                    trace_id: lr
+                        .trace_id
+                        .as_deref()
+                        .map(normalize_id)
+                        .filter(|s| !s.is_empty()),
+                    span_id: lr
+                        .span_id
+                        .as_deref()
+                        .map(normalize_id)
+                        .filter(|s| !s.is_empty()),
+                    attributes: serde_json::to_string(&attrs)?,
+                    date: ts.date(),
+                });
+            }
+        }
+    }
+    Ok(ParsedRows::Logs(rows))
+}
+
+// --- Parallel parsing ---
+
+/// Number of lines parsed and appended together as one batch.
+pub(crate) const PARSE_CHUNK_LINES: usize = 4096;
+
+/// Parses one JSONL line into rows. Must be pure so it can run on worker threads.
+pub(crate) type ParseLineFn = fn(&str, &Scrubber) -> Result<ParsedRows>;
+
+/// Rows parsed from a single JSONL line, not yet written to the database.
+pub(crate) enum ParsedRows {
+    Spans(Vec<SpanRow>),
+    Metrics(Vec<MetricRow>),
+    Logs(Vec<LogRow>),
+}
+
+impl ParsedRows {
+    /// Drop rows outside the sample. Error spans and ERROR-or-worse logs are always kept;
+    /// metrics are never sampled.
+    pub(crate) fn sample(&mut self, sampler: &Sampler) {
+        if sampler.is_noop() {
+            return;
+        }
+        match self {
+            ParsedRows::Spans(spans) => {
+                spans.retain(|s| s.status_code == STATUS_ERROR || sampler.keeps(&s.trace_id))
             }
+            ParsedRows::Metrics(_) => {}
+            ParsedRows::Logs(logs) => logs.retain(|l| {
+                if l.severity_number.is_some_and(|n| n >= SEVERITY_ERROR) {
+                    return true;
+                }
+                match &l.trace_id {
+                    Some(trace_id) => sampler.keeps(trace_id),
+                    None => sampler.keeps(&format!(
+                        "{}{}",
+                        l.timestamp,
+                        l.body.as_deref().unwrap_or_default()
+                    )),
+                }
+            }),
+        }
+    }
+}
+
+/// Write parsed rows through DuckDB appenders, one per table, within the connection's open
+/// transaction. Returns the number of rows written.
+#[cfg(feature = "duckdb")]
+pub(crate) fn append_rows(conn: &Connection, batches: &[ParsedRows]) -> Result<usize> {
+    let mut spans = Vec::new();
+    let mut metrics = Vec::new();
+    let mut logs = Vec::new();
+    for batch in batches {
+        match batch {
+            ParsedRows::Spans(rows) => spans.extend(rows),
+            ParsedRows::Metrics(rows) => metrics.extend(rows),
+            ParsedRows::Logs(rows) => logs.extend(rows),
+        }
+    }
+    // Clustering each batch by service and time narrows the per-row-group min/max that
+    // DuckDB keeps (zone maps), so service- and time-filtered scans skip more row groups.
+    spans.sort_by(|a, b| (&a.service_name, a.start_time).cmp(&(&b.service_name, b.start_time)));
+    metrics.sort_by(|a, b| (&a.service_name, a.timestamp).cmp(&(&b.service_name, b.timestamp)));
+    logs.sort_by(|a, b| (&a.service_name, a.timestamp).cmp(&(&b.service_name, b.timestamp)));
+
+    if !spans.is_empty() {
+        let mut appender = conn
+            .appender("traces")
+            .context("creating traces appender")?;
+        for row in &spans {
+            appender.append_row(duckdb::params![
+                row.trace_id,
+                row.span_id,
+                row.parent_span_id.as_deref(),
+                row.name,
+                row.kind,
+                row.start_time,
+                row.end_time,
+                row.duration_ns,
+                row.status_code,
+                row.service_name,
+                row.attributes,
+                row.date,
+                row.trace_state.as_deref(),
+                row.flags,
+                row.dropped_attributes_count,
+                row.dropped_events_count,
+                row.dropped_links_count,
+            ])?;
         }
+        appender.flush().context("flushing traces appender")?;
+        crate::summaries::upsert(conn, &spans)?;
     }
-    Ok(count)
+
+    if !metrics.is_empty() {
+        let mut appender = conn
+            .appender("metrics")
+            .context("creating metrics appender")?;
+        for row in &metrics {
+            appender.append_row(duckdb::params![
+                row.metric_name,
+                row.metric_type,
+                row.value,
+                row.timestamp,
+                row.service_name,
+                row.temporality,
+                row.monotonic,
+                row.unit.as_deref(),
+                row.attributes,
+                row.date,
+            ])?;
+        }
+        appender.flush().context("flushing metrics appender")?;
+    }
+
+    if !logs.is_empty() {
+        let mut appender = conn.appender("logs").context("creating logs appender")?;
+        for row in &logs {
+            appender.append_row(duckdb::params![
+                row.timestamp,
+                row.severity.as_deref(),
+                row.severity_number,
+                row.body.as_deref(),
+                row.service_name,
+                row.trace_id.as_deref(),
+                row.span_id.as_deref(),
+                row.attributes,
+                row.date,
+            ])?;
+        }
+        appender.flush().context("flushing logs appender")?;
+    }
+
+    Ok(spans.len() + metrics.len() + logs.len())
 }
 
-fn ingest_logs(conn: &Connection, file: &Path) -> Result<()> {
+/// Ingest an entire JSONL file in one transaction, parsing and appending in chunks.
+#[cfg(feature = "duckdb")]
+fn ingest_file(conn: &Connection, file: &Path, parse_fn: ParseLineFn) -> Result<()> {
     let f = std::fs::File::open(file)?;
     let reader = BufReader::with_capacity(1024 * 1024, f);
 
     let tx = conn.unchecked_transaction()?;
+    let mut lines = Vec::with_capacity(PARSE_CHUNK_LINES);
 
     for line in reader.lines() {
         let line = line?;
         if line.trim().is_empty() {
             continue;
         }
-        ingest_log_line(&tx, &line)?;
+        lines.push(line);
+        if lines.len() >= PARSE_CHUNK_LINES {
+            append_rows(
+                &tx,
+                &parse_lines(&lines, parse_fn, &Scrubber::default(), 1)?,
+            )?;
+            lines.clear();
+        }
     }
+    append_rows(
+        &tx,
+        &parse_lines(&lines, parse_fn, &Scrubber::default(), 1)?,
+    )?;
 
     tx.commit()?;
     Ok(())
 }
 
-#[cfg(test)]
+/// Parse lines across up to `workers` threads. Results are returned in input order so the
+/// single writer inserts rows exactly as a sequential ingest would.
+pub(crate) fn parse_lines(
+    lines: &[String],
+    parse_fn: ParseLineFn,
+    scrubber: &Scrubber,
+    workers: usize,
+) -> Result<Vec<ParsedRows>> {
+    let workers = workers.clamp(1, lines.len().max(1));
+    if workers == 1 {
+        return lines.iter().map(|l| parse_fn(l.trim(), scrubber)).collect();
+    }
+
+    let chunk_size = lines.len().div_ceil(workers);
+    std::thread::scope(|s| {
+        let handles: Vec<_> = lines
+            .chunks(chunk_size)
+            .map(|chunk| {
+                s.spawn(move || {
+                    chunk
+                        .iter()
+                        .map(|l| parse_fn(l.trim(), scrubber))
+                        .collect::<Result<Vec<_>>>()
+                })
+            })
+            .collect();
+
+        let mut parsed = Vec::with_capacity(lines.len());
+        for handle in handles {
+            let chunk = handle
+                .join()
+                .map_err(|_| anyhow::anyhow!("ingest parse worker panicked"))??;
+            parsed.extend(chunk);
+        }
+        Ok(parsed)
+    })
+}
+
+#[cfg(all(test, feature = "duckdb"))]
 mod tests {
     use super::*;
     use crate::db;
@@ -643,7 +936,7 @@ mod tests {
         let data = r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-svc"}}]},"scopeSpans":[{"spans":[{"traceId":"abc123","spanId":"def456","name":"test-span","kind":1,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000001000000000","status":{"code":0},"attributes":[{"key":"http.method","value":{"stringValue":"GET"}}]}]}]}]}"#;
         std::fs::write(&file, format!("{data}\n")).unwrap();
 
-        ingest_traces(&conn, &file).unwrap();
+        ingest_file(&conn, &file, parse_trace_line).unwrap();
 
         let count: i64 = conn
             .query_row("SELECT COUNT(*) FROM traces", [], |row| row.get(0))
@@ -663,6 +956,36 @@ mod tests {
         assert_eq!(svc, "test-svc");
     }
 
+    #[test]
+    fn ingest_traces_keeps_span_fidelity_fields() {
+        let conn = setup_db();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let file = tmp.path().join("traces.jsonl");
+
+        let data = r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"abc123","spanId":"def456","name":"test-span","startTimeUnixNano":"1710000000000000000","traceState":"vendor=1","flags":257,"droppedAttributesCount":3,"droppedEventsCount":1,"droppedLinksCount":0}]}]}]}"#;
+        std::fs::write(&file, format!("{data}\n")).unwrap();
+
+        ingest_file(&conn, &file, parse_trace_line).unwrap();
+
+        let spans = crate::query_traces(&conn, &Default::default()).unwrap();
+        assert_eq!(spans[0].trace_state.as_deref(), Some("vendor=1"));
+        assert_eq!(spans[0].flags, Some(257));
+        assert_eq!(spans[0].dropped_attributes_count, Some(3));
+        assert_eq!(spans[0].dropped_events_count, Some(1));
+        assert_eq!(spans[0].dropped_links_count, None);
+    }
+
+    #[test]
+    fn ids_normalized_to_lowercase_hex() {
+        let line = r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"W47/95gDgQPSabYzgT/GDA==","spanId":"EEE19B7EC3C1B174","parentSpanId":"","name":"b64","startTimeUnixNano":"1710000000000000000"}]}]}]}"#;
+        let ParsedRows::Spans(spans) = parse_trace_line(line, &Scrubber::default()).unwrap() else {
+            panic!("expected spans");
+        };
+        assert_eq!(spans[0].trace_id, "5b8efff798038103d269b633813fc60c");
+        assert_eq!(spans[0].span_id, "eee19b7ec3c1b174");
+        assert_eq!(spans[0].parent_span_id, None);
+    }
+
     #[test]
     fn ingest_metrics_jsonl() {
         let conn = setup_db();
@@ -674,7 +997,7 @@ mod tests {
         let data = r#"{"resourceMetrics":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-svc"}}]},"scopeMetrics":[{"metrics":[{"name":"http.requests","unit":"1","sum":{"dataPoints":[{"timeUnixNano":"1710000000000000000","asDouble":42.0,"attributes":[]}],"aggregationTemporality":2,"isMonotonic":true}}]}]}]}"#;
         std::fs::write(&file, format!("{data}\n")).unwrap();
 
-        ingest_metrics(&conn, &file).unwrap();
+        ingest_file(&conn, &file, parse_metric_line).unwrap();
 
         let count: i64 = conn
             .query_row("SELECT COUNT(*) FROM metrics", [], |row| row.get(0))
@@ -698,7 +1021,7 @@ mod tests {
         let data = r#"{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-svc"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1710000000000000000","severityText":"INFO","severityNumber":9,"body":{"stringValue":"hello world"},"attributes":[]}]}]}]}"#;
         std::fs::write(&file, format!("{data}\n")).unwrap();
 
-        ingest_logs(&conn, &file).unwrap();
+        ingest_file(&conn, &file, parse_log_line).unwrap();
 
         let count: i64 = conn
             .query_row("SELECT COUNT(*) FROM logs", [], |row| row.get(0))
@@ -723,7 +1046,7 @@ mod tests {
         let data = r#"{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-svc"}}]},"scopeLogs":[{"logRecords":[{"observedTimeUnixNano":"1710000000000000000","severityText":"WARN","severityNumber":13,"body":{"stringValue":"observed only"},"attributes":[]}]}]}]}"#;
         std::fs::write(&file, format!("{data}\n")).unwrap();
 
-        ingest_logs(&conn, &file).unwrap();
+        ingest_file(&conn, &file, parse_log_line).unwrap();
 
         let count: i64 = conn
             .query_row("SELECT COUNT(*) FROM logs", [], |row| row.get(0))
@@ -755,7 +1078,7 @@ mod tests {
         let data = r#"{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test-svc"}}]},"scopeLogs":[{"logRecords":[{"severityText":"ERROR","severityNumber":17,"body":{"stringValue":"no timestamp"},"attributes":[]}]}]}]}"#;
         std::fs::write(&file, format!("{data}\n")).unwrap();
 
-        ingest_logs(&conn, &file).unwrap();
+        ingest_file(&conn, &file, parse_log_line).unwrap();
 
         let count: i64 = conn
             .query_row("SELECT COUNT(*) FROM logs", [], |row| row.get(0))
@@ -768,6 +1091,68 @@ mod tests {
         assert_eq!(body, "no timestamp");
     }
 
+    #[test]
+    fn parse_lines_preserves_order_across_workers() {
+        let lines: Vec<String> = (0..10)
+            .map(|i| {
+                format!(
+                    r#"{{"resourceSpans":[{{"scopeSpans":[{{"spans":[{{"traceId":"t{i}","spanId":"s{i}","name":"span-{i}","startTimeUnixNano":"1710000000000000000"}}]}}]}}]}}"#
+                )
+            })
+            .collect();
+
+        let parsed = parse_lines(&lines, parse_trace_line, &Scrubber::default(), 4).unwrap();
+        let names: Vec<&str> = parsed
+            .iter()
+            .flat_map(|rows| match rows {
+                ParsedRows::Spans(spans) => spans.iter().map(|s| s.name.as_str()).collect(),
+                _ => Vec::new(),
+            })
+            .collect();
+        let expected: Vec<String> = (0..10).map(|i| format!("span-{i}")).collect();
+        assert_eq!(names, expected);
+    }
+
+    #[test]
+    fn attributes_keep_native_types() {
+        let line = r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"t1","spanId":"s1","name":"typed","startTimeUnixNano":"1710000000000000000","attributes":[{"key":"retries","value":{"intValue":"5"}},{"key":"ratio","value":{"doubleValue":0.5}},{"key":"cached","value":{"boolValue":true}},{"key":"http.method","value":{"stringValue":"GET"}}]}]}]}]}"#;
+        let ParsedRows::Spans(spans) = parse_trace_line(line, &Scrubber::default()).unwrap() else {
+            panic!("expected spans");
+        };
+        let attrs: Value = serde_json::from_str(&spans[0].attributes).unwrap();
+        assert_eq!(attrs["retries"], Value::from(5));
+        assert_eq!(attrs["ratio"], Value::from(0.5));
+        assert_eq!(attrs["cached"], Value::Bool(true));
+        assert_eq!(attrs["http.method"], Value::from("GET"));
+    }
+
+    #[test]
+    fn nested_attribute_values() {
+        let line = r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"t1","spanId":"s1","name":"nested","startTimeUnixNano":"1710000000000000000","attributes":[{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"intValue":"2"}]}}},{"key":"user","value":{"kvlistValue":{"values":[{"key":"id","value":{"intValue":"42"}},{"key":"roles","value":{"arrayValue":{"values":[{"stringValue":"admin"}]}}}]}}}]}]}]}]}"#;
+        let ParsedRows::Spans(spans) = parse_trace_line(line, &Scrubber::default()).unwrap() else {
+            panic!("expected spans");
+        };
+        let attrs: Value = serde_json::from_str(&spans[0].attributes).unwrap();
+        assert_eq!(attrs["tags"], serde_json::json!(["a", 2]));
+        assert_eq!(
+            attrs["user"],
+            serde_json::json!({"id": 42, "roles": ["admin"]})
+        );
+    }
+
+    #[test]
+    fn structured_log_body_stored_as_json() {
+        let line = r#"{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"timeUnixNano":"1710000000000000000","body":{"kvlistValue":{"values":[{"key":"user","value":{"kvlistValue":{"values":[{"key":"id","value":{"intValue":"42"}}]}}},{"key":"msg","value":{"stringValue":"login"}}]}}}]}]}]}"#;
+        let ParsedRows::Logs(logs) = parse_log_line(line, &Scrubber::default()).unwrap() else {
+            panic!("expected logs");
+        };
+        let body: Value = serde_json::from_str(logs[0].body.as_deref().unwrap()).unwrap();
+        assert_eq!(
+            body,
+            serde_json::json!({"user": {"id": 42}, "msg": "login"})
+        );
+    }
+
     #[test]
     fn ingest_all_skips_missing() {
         let conn = setup_db();
@@ -780,7 +1165,7 @@ mod tests {
     fn clear_signal_tables_removes_all_rows() {
         let conn = setup_db();
         conn.execute(
-            "INSERT INTO traces VALUES ('t1','s1',NULL,'x',1,'2024-01-01 00:00:00','2024-01-01 00:00:01',1000000000,0,'svc','{}','2024-01-01')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1','s1',NULL,'x',1,'2024-01-01 00:00:00','2024-01-01 00:00:01',1000000000,0,'svc','{}','2024-01-01')",
             [],
         ).unwrap();
         conn.execute(
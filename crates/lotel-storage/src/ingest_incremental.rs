@@ -5,9 +5,23 @@ use std::io::{BufRead, BufReader, Seek, SeekFrom};
 use std::path::{Path, PathBuf};
 
 use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+#[cfg(feature = "duckdb")]
 use duckdb::Connection;
+use serde::Serialize;
 
-use crate::ingest::{ingest_log_line, ingest_metric_line, ingest_trace_line};
+use crate::cancel::Cancel;
+use crate::history::IngestHistoryEntry;
+#[cfg(feature = "duckdb")]
+use crate::history::record_ingest;
+#[cfg(feature = "duckdb")]
+use crate::ingest::append_rows;
+use crate::ingest::{
+    PARSE_CHUNK_LINES, ParseLineFn, ParsedRows, parse_lines, parse_log_line, parse_metric_line,
+    parse_trace_line,
+};
+use crate::sample::Sampler;
+use crate::scrub::Scrubber;
 
 /// Report of how many records were ingested in a single run.
 #[derive(Debug, Default)]
@@ -33,12 +47,236 @@ impl std::fmt::Display for IngestReport {
     }
 }
 
-type IngestLineFn = fn(&duckdb::Transaction<'_>, &str) -> Result<usize>;
+/// A raw JSONL file removed whole by [`IncrementalIngester::trim_files`].
+#[derive(Debug, Serialize)]
+pub struct FileTrim {
+    pub signal: String,
+    pub file_path: String,
+    pub lines: u64,
+    pub bytes: u64,
+}
+
+/// The signals, each exported to `<data>/<signal>/<signal>.jsonl`.
+const SIGNALS: [&str; 3] = ["traces", "metrics", "logs"];
+
+/// How long to wait after rotating a file before reading it to the end and deleting it:
+/// an export the collector opened before the rename finishes writing within this time.
+const ROTATION_GRACE: std::time::Duration = std::time::Duration::from_secs(1);
+
+/// Rows written per transaction by default; see [`IncrementalIngester::with_batch_rows`].
+pub const DEFAULT_BATCH_ROWS: usize = 50_000;
+
+/// Default worker count: one per available CPU.
+pub fn default_workers() -> usize {
+    std::thread::available_parallelism()
+        .map(|n| n.get())
+        .unwrap_or(1)
+}
+
+/// Where [`IncrementalIngester`] writes rows, cursors, and history. Each batch of a file's
+/// rows is written in one transaction together with the cursor just past it.
+pub(crate) trait IngestStore {
+    fn cursors(&self) -> Result<Vec<(PathBuf, u64)>>;
+    fn begin(&self) -> Result<()>;
+    fn append(&self, rows: &[ParsedRows]) -> Result<usize>;
+    fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()>;
+    /// Forget the cursor of a file that was deleted.
+    fn delete_cursor(&self, file_path: &Path) -> Result<()>;
+    fn commit(&self) -> Result<()>;
+    fn rollback(&self) -> Result<()>;
+    fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()>;
+
+    /// The DuckDB connection rows are appended through, for the `read_json` fast path.
+    #[cfg(feature = "duckdb")]
+    fn duckdb(&self) -> Option<&Connection> {
+        None
+    }
+}
+
+#[cfg(feature = "duckdb")]
+impl IngestStore for Connection {
+    fn cursors(&self) -> Result<Vec<(PathBuf, u64)>> {
+        let mut stmt = self
+            .prepare("SELECT file_path, byte_offset FROM ingest_cursors")
+            .context("preparing cursor select")?;
+        let mut rows = stmt.query([]).context("querying cursors")?;
+        let mut cursors = Vec::new();
+        while let Some(row) = rows.next().context("reading cursor row")? {
+            let path: String = row.get(0)?;
+            cursors.push((PathBuf::from(path), row.get(1)?));
+        }
+        Ok(cursors)
+    }
+
+    fn begin(&self) -> Result<()> {
+        Ok(self.execute_batch("BEGIN TRANSACTION")?)
+    }
+
+    fn append(&self, rows: &[ParsedRows]) -> Result<usize> {
+        append_rows(self, rows)
+    }
+
+    fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()> {
+        self.execute(
+            "INSERT INTO ingest_cursors (file_path, byte_offset) VALUES (?, ?) \
+             ON CONFLICT (file_path) DO UPDATE SET byte_offset = excluded.byte_offset",
+            duckdb::params![cursor_key(file_path)?, offset],
+        )
+        .context("saving ingest cursor")?;
+        Ok(())
+    }
+
+    fn delete_cursor(&self, file_path: &Path) -> Result<()> {
+        self.execute(
+            "DELETE FROM ingest_cursors WHERE file_path = ?",
+            duckdb::params![cursor_key(file_path)?],
+        )
+        .context("deleting ingest cursor")?;
+        Ok(())
+    }
+
+    fn commit(&self) -> Result<()> {
+        Ok(self.execute_batch("COMMIT")?)
+    }
+
+    fn rollback(&self) -> Result<()> {
+        Ok(self.execute_batch("ROLLBACK")?)
+    }
+
+    fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()> {
+        record_ingest(self, entry)
+    }
+
+    fn duckdb(&self) -> Option<&Connection> {
+        Some(self)
+    }
+}
+
+/// Whether the first complete line of a JSONL file has only records older than `cutoff_ns`.
+fn starts_older(path: &Path, cutoff_ns: i64) -> Result<bool> {
+    let reader = BufReader::new(
+        std::fs::File::open(path).with_context(|| format!("opening {}", path.display()))?,
+    );
+    for line in reader.lines() {
+        let line = line?;
+        if !line.trim().is_empty() {
+            return Ok(newest_time_ns(&line).is_some_and(|t| t < cutoff_ns));
+        }
+    }
+    Ok(false)
+}
+
+/// The number of lines in a JSONL file if all of its records are older than `cutoff_ns`;
+/// `None` if a line is newer, has no readable timestamp, or is still being written.
+fn lines_if_all_older(path: &Path, cutoff_ns: i64) -> Result<Option<u64>> {
+    let mut reader = BufReader::new(
+        std::fs::File::open(path).with_context(|| format!("opening {}", path.display()))?,
+    );
+    let mut lines = 0;
+    let mut line = String::new();
+    loop {
+        line.clear();
+        if reader.read_line(&mut line)? == 0 {
+            return Ok(Some(lines));
+        }
+        let complete = line.ends_with('\n');
+        if !complete
+            || !line.trim().is_empty() && newest_time_ns(&line).is_none_or(|t| t >= cutoff_ns)
+        {
+            return Ok(None);
+        }
+        lines += 1;
+    }
+}
+
+/// The newest `*UnixNano` timestamp anywhere in an OTLP JSON export line.
+fn newest_time_ns(line: &str) -> Option<i64> {
+    fn walk(value: &serde_json::Value, newest: &mut Option<i64>) {
+        match value {
+            serde_json::Value::Object(map) => {
+                for (key, value) in map {
+                    let time = match value {
+                        _ if !key.ends_with("UnixNano") => None,
+                        serde_json::Value::String(s) => s.parse().ok(),
+                        other => other.as_i64(),
+                    };
+                    match time {
+                        Some(t) => *newest = Some(newest.map_or(t, |n: i64| n.max(t))),
+                        None => walk(value, newest),
+                    }
+                }
+            }
+            serde_json::Value::Array(items) => items.iter().for_each(|v| walk(v, newest)),
+            _ => {}
+        }
+    }
+    let value: serde_json::Value = serde_json::from_str(line).ok()?;
+    let mut newest = None;
+    walk(&value, &mut newest);
+    newest
+}
+
+/// The file the collector appends a signal's exports to.
+fn live_path(data_path: &Path, signal: &str) -> PathBuf {
+    data_path.join(signal).join(format!("{signal}.jsonl"))
+}
+
+/// Files rotated aside from a signal's live file, oldest first.
+fn rotated_paths(data_path: &Path, signal: &str) -> Result<Vec<PathBuf>> {
+    let dir = data_path.join(signal);
+    let entries = match std::fs::read_dir(&dir) {
+        Ok(entries) => entries,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+        Err(e) => return Err(e).with_context(|| format!("listing {}", dir.display())),
+    };
+    let prefix = format!("{signal}.jsonl.");
+    let mut paths = Vec::new();
+    for entry in entries {
+        let name = entry?.file_name();
+        // Skips the `read_json` scratch file, which shares the prefix.
+        if name
+            .to_str()
+            .and_then(|name| name.strip_prefix(&prefix))
+            .is_some_and(|stamp| stamp.starts_with(|c: char| c.is_ascii_digit()))
+        {
+            paths.push(dir.join(name));
+        }
+    }
+    // The timestamps sort chronologically.
+    paths.sort();
+    Ok(paths)
+}
+
+/// Cursors are keyed by the file's path as text.
+pub(crate) fn cursor_key(file_path: &Path) -> Result<&str> {
+    file_path
+        .to_str()
+        .ok_or_else(|| anyhow::anyhow!("file path is not valid UTF-8: {}", file_path.display()))
+}
 
 /// Tracks byte offsets per JSONL file to only ingest new data.
-#[derive(Default)]
 pub struct IncrementalIngester {
     offsets: HashMap<PathBuf, u64>,
+    workers: usize,
+    batch_rows: usize,
+    read_json: bool,
+    scrubber: Scrubber,
+    sampler: Sampler,
+    cancel: Cancel,
+}
+
+impl Default for IncrementalIngester {
+    fn default() -> Self {
+        Self {
+            offsets: HashMap::new(),
+            workers: default_workers(),
+            batch_rows: DEFAULT_BATCH_ROWS,
+            read_json: false,
+            scrubber: Scrubber::default(),
+            sampler: Sampler::default(),
+            cancel: Cancel::default(),
+        }
+    }
 }
 
 impl IncrementalIngester {
@@ -46,119 +284,472 @@ impl IncrementalIngester {
         Self::default()
     }
 
+    /// Set the number of threads used to parse JSON lines. Inserts always happen on a
+    /// single writer.
+    pub fn with_workers(mut self, workers: usize) -> Self {
+        self.workers = workers.max(1);
+        self
+    }
+
+    /// Commit once at least `rows` rows are pending, so a failure only loses the current
+    /// batch and memory stays bounded; the next run resumes from the last commit. Batches end
+    /// on parse chunk boundaries. 0 writes each file in a single transaction.
+    pub fn with_batch_rows(mut self, rows: usize) -> Self {
+        self.batch_rows = rows;
+        self
+    }
+
+    /// Parse trace files with DuckDB's `read_json` instead of in Rust (see
+    /// [`crate::read_json`]). Applies to DuckDB-based stores without scrub rules or sampling;
+    /// each file is then written in one transaction regardless of the batch size.
+    pub fn with_read_json(mut self, enabled: bool) -> Self {
+        self.read_json = enabled;
+        self
+    }
+
+    /// Apply scrub rules to every row before it is written.
+    pub fn with_scrubber(mut self, scrubber: Scrubber) -> Self {
+        self.scrubber = scrubber;
+        self
+    }
+
+    /// Keep only a sample of traces and logs; see [`Sampler`].
+    pub fn with_sampler(mut self, sampler: Sampler) -> Self {
+        self.sampler = sampler;
+        self
+    }
+
+    /// Stop at the next parse chunk once `cancel` fires, rolling back the open batch; earlier
+    /// batches stay committed. Watch the store's connection too to interrupt the write itself.
+    pub fn with_cancel(mut self, cancel: Cancel) -> Self {
+        self.cancel = cancel;
+        self
+    }
+
     /// Load persisted cursors from the `ingest_cursors` table in DuckDB.
     /// Call this after `new()` to resume from where the last ingestion left off.
+    #[cfg(feature = "duckdb")]
     pub fn load_cursors(&mut self, conn: &Connection) -> Result<()> {
-        let mut stmt = conn
-            .prepare("SELECT file_path, byte_offset FROM ingest_cursors")
-            .context("preparing cursor select")?;
-        let mut rows = stmt.query([]).context("querying cursors")?;
-        while let Some(row) = rows.next().context("reading cursor row")? {
-            let path: String = row.get(0)?;
-            let offset: u64 = row.get(1)?;
-            self.offsets.insert(PathBuf::from(path), offset);
-        }
+        self.load_cursors_from(conn)
+    }
+
+    pub(crate) fn load_cursors_from(&mut self, store: &dyn IngestStore) -> Result<()> {
+        self.offsets.extend(store.cursors()?);
         Ok(())
     }
 
     /// Ingest new data from all three signal files starting from tracked offsets.
+    /// Every file processed is recorded in `ingest_history`, including failures.
+    #[cfg(feature = "duckdb")]
     pub fn ingest_new(&mut self, conn: &Connection, data_path: &Path) -> Result<IngestReport> {
+        self.ingest_into(conn, data_path)
+    }
+
+    pub(crate) fn ingest_into(
+        &mut self,
+        store: &dyn IngestStore,
+        data_path: &Path,
+    ) -> Result<IngestReport> {
         let mut report = IngestReport::default();
+        let run_started_at = chrono::Utc::now().naive_utc();
 
-        let signals: [(&str, IngestLineFn); 3] = [
-            ("traces", ingest_trace_line as IngestLineFn),
-            ("metrics", ingest_metric_line as IngestLineFn),
-            ("logs", ingest_log_line as IngestLineFn),
-        ];
+        for signal in SIGNALS {
+            self.cancel.check()?;
+            // Rotated files first: their lines are older than the live file's.
+            let mut paths = rotated_paths(data_path, signal)?;
+            paths.push(live_path(data_path, signal));
+            for file_path in paths {
+                let ingested = self.ingest_path(store, signal, &file_path, run_started_at)?;
+                match signal {
+                    "traces" => report.traces += ingested,
+                    "metrics" => report.metrics += ingested,
+                    "logs" => report.logs += ingested,
+                    _ => {}
+                }
+            }
+        }
 
-        for (signal, ingest_fn) in &signals {
-            let file_path = data_path.join(signal).join(format!("{signal}.jsonl"));
-            if !file_path.exists() {
-                continue;
+        Ok(report)
+    }
+
+    /// Ingest what `file_path` holds past its cursor, recording the pass in `ingest_history`.
+    fn ingest_path(
+        &mut self,
+        store: &dyn IngestStore,
+        signal: &str,
+        file_path: &Path,
+        run_started_at: NaiveDateTime,
+    ) -> Result<usize> {
+        if !file_path.exists() {
+            return Ok(0);
+        }
+
+        let metadata = std::fs::metadata(file_path)
+            .with_context(|| format!("reading metadata for {signal}"))?;
+        let file_size = metadata.len();
+        let mut offset = self.offsets.get(file_path).copied().unwrap_or(0);
+
+        if file_size < offset {
+            // File was truncated or replaced — reset cursor to beginning.
+            tracing::warn!(
+                "{signal} file shrank from {offset} to {file_size} bytes; \
+                 resetting cursor"
+            );
+            offset = 0;
+            self.offsets.insert(file_path.to_path_buf(), 0);
+            // Fall through to ingest from 0.
+        } else if file_size == offset {
+            return Ok(0); // No new data.
+        }
+
+        let parse_fn: ParseLineFn = match signal {
+            "traces" => parse_trace_line,
+            "metrics" => parse_metric_line,
+            _ => parse_log_line,
+        };
+        let read_json = self.read_json
+            && signal == "traces"
+            && self.scrubber.is_empty()
+            && self.sampler.is_noop();
+        let span = tracing::info_span!(
+            "ingest_file",
+            signal,
+            bytes = file_size - offset,
+            rows = tracing::field::Empty,
+            error = tracing::field::Empty,
+        );
+        let (ingested, result) =
+            span.in_scope(|| self.ingest_file(store, file_path, offset, parse_fn, read_json));
+        span.record("rows", ingested);
+        if let Err(e) = &result {
+            span.record("error", format!("{e:#}"));
+        }
+        store.record_ingest(&IngestHistoryEntry {
+            run_started_at,
+            finished_at: chrono::Utc::now().naive_utc(),
+            signal: signal.to_string(),
+            file_path: file_path.display().to_string(),
+            start_offset: offset,
+            end_offset: self.offsets.get(file_path).copied().unwrap_or(offset),
+            rows: ingested as i64,
+            error: result.as_ref().err().map(|e| format!("{e:#}")),
+        })?;
+        result.with_context(|| format!("ingesting {signal}"))?;
+        Ok(ingested)
+    }
+
+    /// Reclaim the disk space of ingested JSONL so raw files do not keep growing alongside
+    /// the database. Each live file with ingested bytes is rotated aside (see
+    /// [`Self::rotate`]); every rotated file is then ingested to its end and deleted. The
+    /// live files are never rewritten, so the collector's appends cannot be lost. When
+    /// `archive_dir` is set, rotated files are appended to
+    /// `<archive_dir>/<signal>-<timestamp>.jsonl` first. Returns the bytes reclaimed.
+    #[cfg(feature = "duckdb")]
+    pub fn consume(
+        &mut self,
+        conn: &Connection,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        self.consume_from(conn, data_path, archive_dir)
+    }
+
+    pub(crate) fn consume_from(
+        &mut self,
+        store: &dyn IngestStore,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        let run_started_at = chrono::Utc::now().naive_utc();
+        let stamp = chrono::Utc::now().format("%Y%m%dT%H%M%SZ");
+        let mut reclaimed = 0;
+
+        let mut rotated_any = false;
+        for signal in SIGNALS {
+            let live = live_path(data_path, signal);
+            if live.exists() && self.offsets.get(&live).is_some_and(|&offset| offset > 0) {
+                self.rotate(store, &live)?;
+                rotated_any = true;
+            }
+        }
+        if rotated_any {
+            std::thread::sleep(ROTATION_GRACE);
+        }
+
+        for signal in SIGNALS {
+            for file_path in rotated_paths(data_path, signal)? {
+                // Lines appended after the last ingest moved along with the file.
+                self.ingest_path(store, signal, &file_path, run_started_at)?;
+
+                if let Some(dir) = archive_dir {
+                    std::fs::create_dir_all(dir)
+                        .with_context(|| format!("creating {}", dir.display()))?;
+                    let archive_path = dir.join(format!("{signal}-{stamp}.jsonl"));
+                    let mut archive = std::fs::OpenOptions::new()
+                        .create(true)
+                        .append(true)
+                        .open(&archive_path)
+                        .with_context(|| format!("opening {}", archive_path.display()))?;
+                    let mut file = std::fs::File::open(&file_path)
+                        .with_context(|| format!("opening {}", file_path.display()))?;
+                    std::io::copy(&mut file, &mut archive)
+                        .with_context(|| format!("archiving {signal}"))?;
+                }
+
+                reclaimed += std::fs::metadata(&file_path)?.len();
+                std::fs::remove_file(&file_path)
+                    .with_context(|| format!("removing {}", file_path.display()))?;
+                store.delete_cursor(&file_path)?;
+                self.offsets.remove(&file_path);
             }
+        }
+
+        Ok(reclaimed)
+    }
+
+    /// Rename a live signal file aside as `<signal>.jsonl.<timestamp>`, moving its cursor
+    /// along. The exporter opens the path for every export, so its next one starts a new
+    /// live file; an export it had opened just before the rename still lands in the rotated
+    /// file, which is why callers wait [`ROTATION_GRACE`] before reading it to the end.
+    fn rotate(&mut self, store: &dyn IngestStore, live: &Path) -> Result<PathBuf> {
+        let stamp = chrono::Utc::now().format("%Y%m%dT%H%M%S%.9fZ");
+        let mut name = live.file_name().unwrap_or_default().to_os_string();
+        name.push(format!(".{stamp}"));
+        let rotated = live.with_file_name(name);
+        let offset = self.offsets.get(live).copied().unwrap_or(0);
+
+        // Both cursors move with the rename, or neither does.
+        store.begin()?;
+        let result = store
+            .save_cursor(&rotated, offset)
+            .and_then(|()| store.save_cursor(live, 0))
+            .and_then(|()| {
+                std::fs::rename(live, &rotated)
+                    .with_context(|| format!("rotating {}", live.display()))
+            })
+            .and_then(|()| store.commit());
+        if result.is_err()
+            && let Err(rollback) = store.rollback()
+        {
+            tracing::debug!("rollback after failed rotation: {rollback:#}");
+        }
+        result?;
+
+        self.offsets.insert(rotated.clone(), offset);
+        self.offsets.insert(live.to_path_buf(), 0);
+        Ok(rotated)
+    }
+
+    /// Remove the raw JSONL whose records are all older than `cutoff`, for
+    /// `prune --include-files`. Files are only ever removed whole, never rewritten: a live
+    /// file that starts with older lines is rotated aside (see [`Self::rotate`]), and a
+    /// rotated file is deleted once every line in it is older than `cutoff`, so one that also
+    /// holds newer lines waits for a later prune. Old lines not yet ingested are dropped with
+    /// the rest. A dry run rotates nothing and reports the files that would go.
+    #[cfg(feature = "duckdb")]
+    pub fn trim_files(
+        &mut self,
+        conn: &Connection,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        self.trim_files_from(conn, data_path, cutoff, dry_run)
+    }
+
+    pub(crate) fn trim_files_from(
+        &mut self,
+        store: &dyn IngestStore,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        let cutoff_ns = cutoff.and_utc().timestamp_nanos_opt().unwrap_or(i64::MAX);
 
-            let metadata = std::fs::metadata(&file_path)
-                .with_context(|| format!("reading metadata for {signal}"))?;
-            let file_size = metadata.len();
-            let mut offset = self.offsets.get(&file_path).copied().unwrap_or(0);
-
-            if file_size < offset {
-                // File was truncated or rotated — reset cursor to beginning.
-                tracing::warn!(
-                    "{signal} file shrank from {offset} to {file_size} bytes; \
-                     resetting cursor"
-                );
-                offset = 0;
-                self.offsets.insert(file_path.clone(), 0);
-                // Fall through to ingest from 0.
-            } else if file_size == offset {
-                continue; // No new data.
+        let mut rotated_any = false;
+        for signal in SIGNALS {
+            let live = live_path(data_path, signal);
+            if !dry_run && live.exists() && starts_older(&live, cutoff_ns)? {
+                self.rotate(store, &live)?;
+                rotated_any = true;
             }
+        }
+        if rotated_any {
+            std::thread::sleep(ROTATION_GRACE);
+        }
 
-            let ingested = self.ingest_file(conn, &file_path, offset, *ingest_fn)?;
-            match *signal {
-                "traces" => report.traces = ingested,
-                "metrics" => report.metrics = ingested,
-                "logs" => report.logs = ingested,
-                _ => {}
+        let mut trims = Vec::new();
+        for signal in SIGNALS {
+            let mut paths = rotated_paths(data_path, signal)?;
+            if dry_run {
+                // Would be rotated, then removed if nothing in it is newer.
+                paths.push(live_path(data_path, signal));
+            }
+            for file_path in paths {
+                if !file_path.exists() {
+                    continue;
+                }
+                let Some(lines) = lines_if_all_older(&file_path, cutoff_ns)? else {
+                    continue;
+                };
+                let bytes = std::fs::metadata(&file_path)?.len();
+                if !dry_run {
+                    std::fs::remove_file(&file_path)
+                        .with_context(|| format!("removing {}", file_path.display()))?;
+                    store.delete_cursor(&file_path)?;
+                    self.offsets.remove(&file_path);
+                }
+                trims.push(FileTrim {
+                    signal: signal.to_string(),
+                    file_path: file_path.display().to_string(),
+                    lines,
+                    bytes,
+                });
             }
         }
 
-        Ok(report)
+        Ok(trims)
     }
 
+    /// Ingest the rows after `offset`. Returns the rows committed, which on failure covers
+    /// the batches committed before it, and the outcome.
+    #[cfg_attr(not(feature = "duckdb"), allow(unused_variables))]
     fn ingest_file(
         &mut self,
-        conn: &Connection,
+        store: &dyn IngestStore,
         file_path: &Path,
         offset: u64,
-        ingest_fn: IngestLineFn,
-    ) -> Result<usize> {
+        parse_fn: ParseLineFn,
+        read_json: bool,
+    ) -> (usize, Result<()>) {
+        let mut committed = Committed { rows: 0, offset };
+        let cancel = self.cancel.clone();
+        let result = cancel.run(|| {
+            store.begin()?;
+            #[cfg(feature = "duckdb")]
+            if let Some(conn) = store.duckdb().filter(|_| read_json) {
+                return self.write_file_read_json(store, conn, file_path, &mut committed);
+            }
+            self.write_file(store, file_path, parse_fn, &mut committed)
+        });
+        if result.is_err()
+            && let Err(rollback) = store.rollback()
+        {
+            tracing::debug!("rollback after failed ingest: {rollback:#}");
+        }
+        self.offsets
+            .insert(file_path.to_path_buf(), committed.offset);
+        (committed.rows, result)
+    }
+
+    /// Append the rows after `committed.offset` inside the open transaction, committing
+    /// every `batch_rows` rows and once at the end. `committed` tracks what is durable.
+    fn write_file(
+        &self,
+        store: &dyn IngestStore,
+        file_path: &Path,
+        parse_fn: ParseLineFn,
+        committed: &mut Committed,
+    ) -> Result<()> {
         let mut file = std::fs::File::open(file_path)?;
-        file.seek(SeekFrom::Start(offset))?;
+        file.seek(SeekFrom::Start(committed.offset))?;
         let mut reader = BufReader::new(file);
 
-        let tx = conn.unchecked_transaction()?;
-        let mut total_count = 0;
-        let mut new_offset = offset;
-        let mut line = String::new();
+        let mut total_count = committed.rows;
+        let mut new_offset = committed.offset;
+        let mut batch_start = total_count;
+        let mut lines = Vec::with_capacity(PARSE_CHUNK_LINES);
+        // Save the cursor atomically within the same transaction as the data.
+        let mut commit = |rows: usize, offset: u64| -> Result<()> {
+            store.save_cursor(file_path, offset)?;
+            store.commit()?;
+            *committed = Committed { rows, offset };
+            Ok(())
+        };
 
         loop {
-            line.clear();
+            let mut line = String::new();
             let bytes_read = reader.read_line(&mut line)?;
             if bytes_read == 0 {
                 break;
             }
             new_offset += bytes_read as u64;
 
-            let trimmed = line.trim();
-            if trimmed.is_empty() {
+            if line.trim().is_empty() {
                 continue;
             }
-            total_count += ingest_fn(&tx, trimmed)?;
+            lines.push(line);
+            if lines.len() >= PARSE_CHUNK_LINES {
+                total_count += self.write_chunk(store, &lines, parse_fn)?;
+                lines.clear();
+                if self.batch_rows > 0 && total_count - batch_start >= self.batch_rows {
+                    commit(total_count, new_offset)?;
+                    batch_start = total_count;
+                    store.begin()?;
+                }
+            }
         }
+        total_count += self.write_chunk(store, &lines, parse_fn)?;
+        commit(total_count, new_offset)
+    }
 
-        // Save cursor atomically within the same transaction as the data.
-        let path_str = file_path.to_str().ok_or_else(|| {
-            anyhow::anyhow!("file path is not valid UTF-8: {}", file_path.display())
-        })?;
-        tx.execute(
-            "INSERT INTO ingest_cursors (file_path, byte_offset) VALUES (?, ?) \
-             ON CONFLICT (file_path) DO UPDATE SET byte_offset = excluded.byte_offset",
-            duckdb::params![path_str, new_offset],
-        )
-        .context("saving ingest cursor")?;
+    /// [`Self::write_file`] for trace files through [`crate::read_json`], in one transaction.
+    /// The lines are staged in a scratch file next to the source.
+    #[cfg(feature = "duckdb")]
+    fn write_file_read_json(
+        &self,
+        store: &dyn IngestStore,
+        conn: &Connection,
+        file_path: &Path,
+        committed: &mut Committed,
+    ) -> Result<()> {
+        let scratch = file_path.with_extension("jsonl.read_json");
+        let result = (|| {
+            let (fallback, new_offset) =
+                crate::read_json::split_lines(file_path, committed.offset, &scratch)?;
+            let mut rows = crate::read_json::append_spans(conn, &scratch)?;
+            for lines in fallback.chunks(PARSE_CHUNK_LINES) {
+                rows += self.write_chunk(store, lines, parse_trace_line)?;
+            }
+            store.save_cursor(file_path, new_offset)?;
+            store.commit()?;
+            *committed = Committed {
+                rows,
+                offset: new_offset,
+            };
+            Ok(())
+        })();
+        let _ = std::fs::remove_file(&scratch);
+        result
+    }
 
-        tx.commit()?;
-        self.offsets.insert(file_path.to_path_buf(), new_offset);
-        Ok(total_count)
+    /// Parse a chunk of lines on the worker pool, apply sampling, and append the rows.
+    fn write_chunk(
+        &self,
+        store: &dyn IngestStore,
+        lines: &[String],
+        parse_fn: ParseLineFn,
+    ) -> Result<usize> {
+        self.cancel.check()?;
+        let mut parsed = parse_lines(lines, parse_fn, &self.scrubber, self.workers)?;
+        for rows in &mut parsed {
+            rows.sample(&self.sampler);
+        }
+        store.append(&parsed)
     }
 }
 
-#[cfg(test)]
+/// Rows and file offset covered by committed transactions.
+struct Committed {
+    rows: usize,
+    offset: u64,
+}
+
+#[cfg(all(test, feature = "duckdb"))]
 mod tests {
     use super::*;
     use crate::db;
+    use std::io::Write;
 
     #[test]
     fn incremental_ingest_no_duplicates() {
@@ -338,4 +929,435 @@ mod tests {
             "cursor should be at end of file after full re-ingest"
         );
     }
+
+    #[test]
+    fn parallel_workers_ingest_all_lines() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+
+        let mut data = String::new();
+        for i in 0..50 {
+            data.push_str(&format!(
+                r#"{{"resourceSpans":[{{"resource":{{"attributes":[{{"key":"service.name","value":{{"stringValue":"svc-a"}}}}]}},"scopeSpans":[{{"spans":[{{"traceId":"t{i}","spanId":"s{i}","name":"span-{i}","kind":1,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000001000000000","status":{{"code":0}},"attributes":[]}}]}}]}}]}}"#
+            ));
+            data.push('\n');
+        }
+        std::fs::write(&file, data).unwrap();
+
+        let mut ingester = IncrementalIngester::new().with_workers(4);
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(report.traces, 50);
+
+        let count: i64 = conn
+            .query_row("SELECT COUNT(DISTINCT span_id) FROM traces", [], |row| {
+                row.get(0)
+            })
+            .unwrap();
+        assert_eq!(count, 50);
+    }
+
+    /// An OTLP trace export line with one span.
+    fn span_line(span_id: &str, start: &str) -> String {
+        format!(
+            r#"{{"resourceSpans":[{{"resource":{{"attributes":[{{"key":"service.name","value":{{"stringValue":"svc-a"}}}}]}},"scopeSpans":[{{"spans":[{{"traceId":"aaa","spanId":"{span_id}","name":"span","kind":1,"startTimeUnixNano":"{start}","endTimeUnixNano":"{start}","status":{{"code":0}},"attributes":[]}}]}}]}}]}}"#
+        )
+    }
+
+    /// Append one line the way the file exporter does: open, write, close.
+    fn export(file: &Path, line: &str) {
+        let mut out = std::fs::OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(file)
+            .unwrap();
+        out.write_all(format!("{line}\n").as_bytes()).unwrap();
+    }
+
+    fn trace_count(conn: &Connection) -> i64 {
+        conn.query_row("SELECT COUNT(*) FROM traces", [], |row| row.get(0))
+            .unwrap()
+    }
+
+    fn cursor_count(conn: &Connection) -> i64 {
+        conn.query_row("SELECT COUNT(*) FROM ingest_cursors", [], |row| row.get(0))
+            .unwrap()
+    }
+
+    #[test]
+    fn consume_rotates_and_removes_ingested_files() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+
+        let line1 = span_line("111", "1710000000000000000");
+        std::fs::write(&file, format!("{line1}\n")).unwrap();
+
+        let mut ingester = IncrementalIngester::new();
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+
+        let archive = tmp.path().join("archive");
+        let reclaimed = ingester.consume(&conn, tmp.path(), Some(&archive)).unwrap();
+        assert_eq!(reclaimed, line1.len() as u64 + 1);
+        // The live file is renamed away, never rewritten; the exporter starts a new one.
+        assert!(!file.exists());
+        assert!(rotated_paths(tmp.path(), "traces").unwrap().is_empty());
+
+        let archived: Vec<_> = std::fs::read_dir(&archive).unwrap().collect();
+        assert_eq!(archived.len(), 1);
+
+        let cursor_offset: u64 = conn
+            .query_row(
+                "SELECT byte_offset FROM ingest_cursors WHERE file_path = ?",
+                duckdb::params![file.to_str().unwrap()],
+                |row| row.get(0),
+            )
+            .unwrap();
+        assert_eq!(cursor_offset, 0);
+
+        // Re-ingesting after consume must not duplicate rows.
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(report.traces, 0);
+        export(&file, &span_line("222", "1710000000000000000"));
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(report.traces, 1);
+        // The rotated file's cursor went with it; only the live file keeps one.
+        ingester.consume(&conn, tmp.path(), None).unwrap();
+        export(&file, &span_line("333", "1710000000000000000"));
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(cursor_count(&conn), 1);
+    }
+
+    #[test]
+    fn consume_keeps_lines_appended_concurrently() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+        for i in 0..10 {
+            export(&file, &span_line(&format!("a{i}"), "1710000000000000000"));
+        }
+
+        let mut ingester = IncrementalIngester::new();
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+        let appender = {
+            let file = file.clone();
+            std::thread::spawn(move || {
+                for i in 0..300 {
+                    export(&file, &span_line(&format!("b{i}"), "1710000000000000000"));
+                    std::thread::sleep(std::time::Duration::from_millis(5));
+                }
+            })
+        };
+        ingester.consume(&conn, tmp.path(), None).unwrap();
+        appender.join().unwrap();
+
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(trace_count(&conn), 310);
+    }
+
+    #[test]
+    fn trim_files_removes_files_once_all_lines_are_old() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+
+        let old = span_line("111", "1710000000000000000");
+        let new = span_line("222", "1720000000000000000");
+        std::fs::write(&file, format!("{old}\n{new}\n")).unwrap();
+
+        let mut ingester = IncrementalIngester::new();
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+        let at = |secs| {
+            chrono::DateTime::from_timestamp(secs, 0)
+                .unwrap()
+                .naive_utc()
+        };
+
+        // The file holds a newer line too, so none of it goes yet.
+        let trims = ingester
+            .trim_files(&conn, tmp.path(), at(1_715_000_000), true)
+            .unwrap();
+        assert!(trims.is_empty());
+        let trims = ingester
+            .trim_files(&conn, tmp.path(), at(1_715_000_000), false)
+            .unwrap();
+        assert!(trims.is_empty());
+        // It was rotated aside so it can go whole later; its cursor moved along.
+        assert!(!file.exists());
+        let rotated = rotated_paths(tmp.path(), "traces").unwrap();
+        assert_eq!(rotated.len(), 1);
+        assert_eq!(
+            std::fs::read_to_string(&rotated[0]).unwrap(),
+            format!("{old}\n{new}\n")
+        );
+        assert_eq!(ingester.ingest_new(&conn, tmp.path()).unwrap().traces, 0);
+
+        let trims = ingester
+            .trim_files(&conn, tmp.path(), at(1_725_000_000), true)
+            .unwrap();
+        assert_eq!(
+            (trims[0].lines, trims[0].bytes),
+            (2, (old.len() + new.len()) as u64 + 2)
+        );
+        assert!(rotated[0].exists());
+        ingester
+            .trim_files(&conn, tmp.path(), at(1_725_000_000), false)
+            .unwrap();
+        assert!(!rotated[0].exists());
+
+        export(&file, &span_line("333", "1730000000000000000"));
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(report.traces, 1);
+        assert_eq!(cursor_count(&conn), 1);
+    }
+
+    #[test]
+    fn trim_files_keeps_lines_appended_concurrently() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let conn = db::open_in_memory().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+        for i in 0..10 {
+            export(&file, &span_line(&format!("old{i}"), "1710000000000000000"));
+        }
+
+        let appender = {
+            let file = file.clone();
+            std::thread::spawn(move || {
+                for i in 0..300 {
+                    export(&file, &span_line(&format!("new{i}"), "1720000000000000000"));
+                    std::thread::sleep(std::time::Duration::from_millis(5));
+                }
+            })
+        };
+        let cutoff = chrono::DateTime::from_timestamp(1_715_000_000, 0)
+            .unwrap()
+            .naive_utc();
+        let mut ingester = IncrementalIngester::new();
+        ingester
+            .trim_files(&conn, tmp.path(), cutoff, false)
+            .unwrap();
+        appender.join().unwrap();
+
+        let mut remaining = String::new();
+        for path in rotated_paths(tmp.path(), "traces").unwrap() {
+            remaining.push_str(&std::fs::read_to_string(path).unwrap());
+        }
+        if file.exists() {
+            remaining.push_str(&std::fs::read_to_string(&file).unwrap());
+        }
+        for i in 0..300 {
+            assert!(
+                remaining.contains(&format!(r#""spanId":"new{i}""#)),
+                "new{i} lost"
+            );
+        }
+    }
+
+    #[test]
+    fn finds_newest_timestamp_in_export_line() {
+        let line = r#"{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"timeUnixNano":"0","observedTimeUnixNano":"1710000000000000005"},{"timeUnixNano":1710000000000000009}]}]}]}"#;
+        assert_eq!(newest_time_ns(line), Some(1_710_000_000_000_000_009));
+        assert_eq!(newest_time_ns(r#"{"resourceSpans":[]}"#), None);
+        assert_eq!(newest_time_ns("not json"), None);
+    }
+
+    #[test]
+    fn ingest_runs_are_recorded_in_history() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+
+        let line1 = r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc-a"}}]},"scopeSpans":[{"spans":[{"traceId":"aaa","spanId":"111","name":"span-1","kind":1,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000001000000000","status":{"code":0},"attributes":[]}]}]}]}"#;
+        std::fs::write(&file, format!("{line1}\n")).unwrap();
+
+        let mut ingester = IncrementalIngester::new();
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+        // Nothing new: no history row is written for skipped files.
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+
+        let entries = crate::history::ingest_history(&conn, 10).unwrap();
+        assert_eq!(entries.len(), 1);
+        assert_eq!(entries[0].signal, "traces");
+        assert_eq!(entries[0].rows, 1);
+        assert_eq!(entries[0].start_offset, 0);
+        assert_eq!(entries[0].end_offset, line1.len() as u64 + 1);
+        assert!(entries[0].error.is_none());
+    }
+
+    #[test]
+    fn scrubber_applies_to_ingested_logs() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let logs_dir = tmp.path().join("logs");
+        std::fs::create_dir_all(&logs_dir).unwrap();
+        let file = logs_dir.join("logs.jsonl");
+
+        let line = r#"{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc-a"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1710000000000000000","severityText":"INFO","body":{"stringValue":"login by bob@example.com"},"attributes":[{"key":"auth.token","value":{"stringValue":"s3cret"}}]}]}]}]}"#;
+        std::fs::write(&file, format!("{line}\n")).unwrap();
+
+        let scrubber = Scrubber::new(&crate::scrub::ScrubConfig {
+            drop_keys: vec!["auth.*".into()],
+            redact_patterns: vec![r"\S+@\S+".into()],
+            ..Default::default()
+        })
+        .unwrap();
+        let mut ingester = IncrementalIngester::new().with_scrubber(scrubber);
+        ingester.ingest_new(&conn, tmp.path()).unwrap();
+
+        let (body, attrs): (String, String) = conn
+            .query_row(
+                "SELECT body, CAST(attributes AS VARCHAR) FROM logs",
+                [],
+                |row| Ok((row.get(0)?, row.get(1)?)),
+            )
+            .unwrap();
+        assert_eq!(body, "login by [REDACTED]");
+        assert_eq!(attrs, "{}");
+    }
+
+    #[test]
+    fn sampling_keeps_error_spans() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let file = traces_dir.join("traces.jsonl");
+
+        let mut data = String::new();
+        for i in 0..200 {
+            let code = if i % 10 == 0 { 2 } else { 0 };
+            data.push_str(&format!(
+                r#"{{"resourceSpans":[{{"scopeSpans":[{{"spans":[{{"traceId":"t{i}","spanId":"s{i}","name":"span-{i}","startTimeUnixNano":"1710000000000000000","status":{{"code":{code}}}}}]}}]}}]}}"#
+            ));
+            data.push('\n');
+        }
+        std::fs::write(&file, data).unwrap();
+
+        let mut ingester = IncrementalIngester::new().with_sampler(Sampler::parse("10%").unwrap());
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert!(report.traces < 200, "sampling should drop spans");
+
+        let errors: i64 = conn
+            .query_row(
+                "SELECT COUNT(*) FROM traces WHERE status_code = 2",
+                [],
+                |row| row.get(0),
+            )
+            .unwrap();
+        assert_eq!(errors, 20, "every error span must be kept");
+    }
+
+    /// Delegates to a connection but fails the `fail_at`-th append.
+    struct FailingStore<'a> {
+        conn: &'a Connection,
+        appends: std::cell::Cell<usize>,
+        fail_at: usize,
+    }
+
+    impl IngestStore for FailingStore<'_> {
+        fn cursors(&self) -> Result<Vec<(PathBuf, u64)>> {
+            self.conn.cursors()
+        }
+        fn begin(&self) -> Result<()> {
+            IngestStore::begin(self.conn)
+        }
+        fn append(&self, rows: &[ParsedRows]) -> Result<usize> {
+            self.appends.set(self.appends.get() + 1);
+            if self.appends.get() == self.fail_at {
+                anyhow::bail!("disk full");
+            }
+            self.conn.append(rows)
+        }
+        fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()> {
+            self.conn.save_cursor(file_path, offset)
+        }
+        fn delete_cursor(&self, file_path: &Path) -> Result<()> {
+            self.conn.delete_cursor(file_path)
+        }
+        fn commit(&self) -> Result<()> {
+            IngestStore::commit(self.conn)
+        }
+        fn rollback(&self) -> Result<()> {
+            IngestStore::rollback(self.conn)
+        }
+        fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()> {
+            self.conn.record_ingest(entry)
+        }
+    }
+
+    #[test]
+    fn failed_batch_keeps_earlier_commits_and_resumes() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+
+        let total = PARSE_CHUNK_LINES + 10;
+        let mut data = String::new();
+        for i in 0..total {
+            data.push_str(&format!(
+                r#"{{"resourceSpans":[{{"scopeSpans":[{{"spans":[{{"traceId":"t{i}","spanId":"s{i}","name":"span-{i}","startTimeUnixNano":"1710000000000000000","status":{{}}}}]}}]}}]}}"#
+            ));
+            data.push('\n');
+        }
+        std::fs::write(traces_dir.join("traces.jsonl"), data).unwrap();
+        let count = |conn: &Connection| -> usize {
+            conn.query_row("SELECT COUNT(*) FROM traces", [], |row| {
+                row.get::<_, i64>(0)
+            })
+            .unwrap() as usize
+        };
+
+        // The first chunk commits as its own batch; the second fails and rolls back.
+        let store = FailingStore {
+            conn: &conn,
+            appends: std::cell::Cell::new(0),
+            fail_at: 2,
+        };
+        let mut ingester = IncrementalIngester::new().with_batch_rows(1);
+        assert!(ingester.ingest_into(&store, tmp.path()).is_err());
+        assert_eq!(count(&conn), PARSE_CHUNK_LINES);
+        let entries = crate::history::ingest_history(&conn, 10).unwrap();
+        assert_eq!(entries[0].rows, PARSE_CHUNK_LINES as i64);
+        assert!(entries[0].error.is_some());
+
+        // A fresh run resumes from the committed cursor without duplicates.
+        let mut ingester = IncrementalIngester::new();
+        ingester.load_cursors(&conn).unwrap();
+        let report = ingester.ingest_new(&conn, tmp.path()).unwrap();
+        assert_eq!(report.traces, 10);
+        assert_eq!(count(&conn), total);
+    }
+
+    #[test]
+    fn cancelled_ingest_writes_nothing_and_resumes() {
+        let conn = db::open_in_memory().unwrap();
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces_dir = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces_dir).unwrap();
+        let line = r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"aaa","spanId":"111","name":"span-1","startTimeUnixNano":"1710000000000000000"}]}]}]}"#;
+        std::fs::write(traces_dir.join("traces.jsonl"), format!("{line}\n")).unwrap();
+
+        let cancel = Cancel::new();
+        cancel.cancel();
+        let mut ingester = IncrementalIngester::new().with_cancel(cancel);
+        let err = ingester.ingest_new(&conn, tmp.path()).unwrap_err();
+        assert!(err.is::<crate::cancel::Cancelled>());
+
+        let mut ingester = IncrementalIngester::new();
+        ingester.load_cursors(&conn).unwrap();
+        assert_eq!(ingester.ingest_new(&conn, tmp.path()).unwrap().traces, 1);
+    }
 }
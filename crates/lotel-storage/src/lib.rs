@@ -1,17 +1,144 @@
-//! lotel-storage: DuckDB-backed storage for telemetry data.
+//! lotel-storage: DuckDB-backed storage for telemetry data, with optional Parquet, SQLite,
+//! and ClickHouse backends.
 
+#[cfg(feature = "duckdb")]
+pub mod alerts;
+#[cfg(feature = "duckdb")]
+pub mod archive;
+#[cfg(feature = "duckdb")]
+pub mod assertions;
+pub mod backend;
+pub mod cache;
+pub mod cancel;
+#[cfg(feature = "duckdb")]
+pub mod cardinality;
+pub mod clickhouse;
+#[cfg(feature = "duckdb")]
+pub mod completeness;
 pub mod db;
+#[cfg(feature = "duckdb")]
+pub mod diff;
+pub mod duration;
+#[cfg(feature = "duckdb")]
+pub mod explain;
+#[cfg(feature = "duckdb")]
+pub mod fields;
+#[cfg(feature = "duckdb")]
+pub mod flamegraph;
+#[cfg(feature = "duckdb")]
+pub mod graph;
+pub mod history;
+pub mod ids;
+#[cfg(feature = "duckdb")]
+pub mod import;
 pub mod ingest;
 pub mod ingest_incremental;
+pub mod lock;
+#[cfg(feature = "duckdb")]
+pub mod otlp;
+#[cfg(feature = "duckdb")]
+pub mod parquet;
+#[cfg(feature = "duckdb")]
+pub mod patterns;
+#[cfg(feature = "duckdb")]
+pub mod prom;
 pub mod prune;
 pub mod query;
+#[cfg(feature = "duckdb")]
+pub mod read_json;
+pub mod sample;
+pub mod scrub;
+#[cfg(feature = "duckdb")]
+pub mod series;
+pub mod sqlite;
+#[cfg(feature = "duckdb")]
+pub mod stats;
+pub mod store;
+#[cfg(feature = "duckdb")]
+pub mod summaries;
 
 // Re-export key types and functions at crate root.
-pub use db::{default_db, open_db, open_in_memory};
+#[cfg(feature = "duckdb")]
+pub use alerts::{AlertEvaluator, AlertEvent, AlertRule};
+#[cfg(feature = "duckdb")]
+pub use archive::{ArchiveReport, archive, attach_archives};
+#[cfg(feature = "duckdb")]
+pub use assertions::{AssertReport, Assertion, CheckResult, evaluate_assertion};
+pub use backend::{Backend, BackendKind, StorageConfig, backend_db_path, open_backend};
+#[cfg(feature = "duckdb")]
+pub use backend::{DuckDbBackend, open_query_db};
+pub use cache::{QueryCache, cache_key};
+pub use cancel::{Cancel, Cancelled};
+#[cfg(feature = "duckdb")]
+pub use cardinality::{AttributeCardinality, attribute_cardinality};
+pub use clickhouse::{ClickHouseBackend, ClickHouseConfig};
+#[cfg(feature = "duckdb")]
+pub use completeness::{CompletenessReport, IncompleteTrace, OrphanSpan, trace_completeness};
+#[cfg(feature = "duckdb")]
+pub use db::{
+    CompactReport, compact_db, default_db, default_db_read_only, encrypt_db, open_db, open_db_with,
+    open_in_memory,
+};
+pub use db::{
+    DATA_DIR_ENV, DbConfig, ENCRYPTION_KEY_ENV, ResourceLimits, default_db_path, resource_limits,
+    set_resource_limits,
+};
+#[cfg(feature = "duckdb")]
+pub use diff::{MetricDelta, ServiceDiff, diff_windows};
+pub use duration::parse_duration;
+#[cfg(feature = "duckdb")]
+pub use explain::{QueryExplain, explain_query};
+#[cfg(feature = "duckdb")]
+pub use fields::{Field, for_each_projected, parse_fields, query_projected};
+#[cfg(feature = "duckdb")]
+pub use flamegraph::{FoldedStack, folded_stacks, to_folded};
+#[cfg(feature = "duckdb")]
+pub use graph::{ServiceEdge, graph_to_dot, graph_to_mermaid, service_graph};
+pub use history::{IngestHistoryEntry, PruneRun};
+#[cfg(feature = "duckdb")]
+pub use history::{ingest_history, prune_history, record_ingest, record_prune};
+pub use ids::normalize_id;
+#[cfg(feature = "duckdb")]
+pub use import::{import_jaeger, import_openmetrics, import_zipkin};
+#[cfg(feature = "duckdb")]
 pub use ingest::{clear_ingest_cursors, clear_signal_tables, ingest_all};
-pub use ingest_incremental::{IncrementalIngester, IngestReport};
-pub use prune::{PruneReport, prune};
+pub use ingest_incremental::{
+    DEFAULT_BATCH_ROWS, FileTrim, IncrementalIngester, IngestReport, default_workers,
+};
+pub use lock::IngestLock;
+#[cfg(feature = "duckdb")]
+pub use otlp::export_otlp_json;
+#[cfg(feature = "duckdb")]
+pub use parquet::ParquetBackend;
+#[cfg(feature = "duckdb")]
+pub use patterns::{LogPattern, log_patterns, log_template};
+#[cfg(feature = "duckdb")]
+pub use prom::prometheus_exposition;
+#[cfg(feature = "duckdb")]
+pub use prune::prune;
+pub use prune::{PruneFilter, PruneReport};
 pub use query::{
-    LogResult, MetricAggregation, MetricResult, QueryOptions, TraceResult, aggregate_metrics,
-    query_logs, query_metrics, query_traces,
+    Appended, AttrFilter, AttrOp, LogResult, MetricAggregation, MetricFn, MetricFnResult,
+    MetricResult, QueryOptions, Signal, TraceResult, TraceSummary, parse_severity, parse_span_kind,
+    parse_status_code, span_kind_name, status_code_name,
+};
+#[cfg(feature = "duckdb")]
+pub use query::{
+    aggregate_metric_fn, aggregate_metrics, appended, for_each_log, for_each_metric,
+    for_each_trace, for_each_trace_root, metric_names, query_logs, query_metrics,
+    query_trace_roots, query_traces, service_names,
+};
+pub use sample::Sampler;
+pub use scrub::{ScrubConfig, Scrubber};
+#[cfg(feature = "duckdb")]
+pub use series::{
+    BucketedSeries, RatePoint, Temporality, TemporalityConverter, bucketed_series, counter_rate,
+};
+pub use sqlite::SqliteBackend;
+#[cfg(feature = "duckdb")]
+pub use stats::{
+    RedStats, SloReport, SloTarget, SpanSort, SpanStats, red_metrics, slo_report, top_spans,
 };
+pub use store::{Store, StoreHealth};
+#[cfg(feature = "duckdb")]
+pub use summaries::rebuild_trace_summaries;
@@ -0,0 +1,81 @@
+//! Advisory file lock that serializes ingest runs against the same database.
+
+use std::fs::{File, OpenOptions};
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result, bail};
+
+/// Holds the ingest lock for a database until dropped.
+#[derive(Debug)]
+pub struct IngestLock {
+    _file: File,
+    path: PathBuf,
+}
+
+impl IngestLock {
+    /// Lock file path used for the database at `db_path`.
+    pub fn lock_path(db_path: &Path) -> PathBuf {
+        db_path.with_extension("ingest.lock")
+    }
+
+    /// Acquire the lock without blocking. Fails with a clear error if another ingest
+    /// (manual or the collector's periodic task) currently holds it.
+    pub fn try_acquire(db_path: &Path) -> Result<Self> {
+        let path = Self::lock_path(db_path);
+        let file = open_lock_file(&path)?;
+        match file.try_lock() {
+            Ok(()) => Ok(Self { _file: file, path }),
+            Err(std::fs::TryLockError::WouldBlock) => bail!(
+                "another ingest is running (lock held on {}); retry later or pass --wait",
+                path.display()
+            ),
+            Err(std::fs::TryLockError::Error(e)) => {
+                Err(e).with_context(|| format!("locking {}", path.display()))
+            }
+        }
+    }
+
+    /// Acquire the lock, blocking until any other ingest releases it.
+    pub fn acquire(db_path: &Path) -> Result<Self> {
+        let path = Self::lock_path(db_path);
+        let file = open_lock_file(&path)?;
+        file.lock()
+            .with_context(|| format!("locking {}", path.display()))?;
+        Ok(Self { _file: file, path })
+    }
+
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+}
+
+fn open_lock_file(path: &Path) -> Result<File> {
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent)
+            .with_context(|| format!("creating {}", parent.display()))?;
+    }
+    OpenOptions::new()
+        .create(true)
+        .truncate(false)
+        .write(true)
+        .open(path)
+        .with_context(|| format!("opening {}", path.display()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn second_try_acquire_fails_until_released() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let db_path = tmp.path().join("lotel.db");
+
+        let lock = IngestLock::try_acquire(&db_path).unwrap();
+        let err = IngestLock::try_acquire(&db_path).unwrap_err();
+        assert!(err.to_string().contains("another ingest is running"));
+
+        drop(lock);
+        IngestLock::try_acquire(&db_path).unwrap();
+    }
+}
@@ -0,0 +1,382 @@
+//! OTLP JSON export: the inverse of ingest. Stored rows are written back as
+//! `ExportTraceServiceRequest` / `ExportMetricsServiceRequest` / `ExportLogsServiceRequest`
+//! JSON lines, as the collector's file exporter writes them, so any OTLP-consuming tool
+//! (including `lotel ingest`) can read them.
+//!
+//! Each line holds one resource (a service) and up to [`BATCH_SIZE`] records. What ingest
+//! does not store cannot come back: scopes, resource attributes other than `service.name`,
+//! span events and links, and histogram buckets. Log bodies are written as strings.
+
+use std::collections::HashMap;
+use std::io::Write;
+
+use anyhow::Result;
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde_json::{Value, json};
+
+use crate::query::{
+    LogResult, MetricResult, QueryOptions, Signal, TraceResult, for_each_log, for_each_metric,
+    for_each_trace,
+};
+
+/// Records per line, per service.
+pub const BATCH_SIZE: usize = 512;
+
+/// Write the rows of `signal` matching `opts` to `out` as OTLP JSON lines. Returns the
+/// number of records written.
+pub fn export_otlp_json(
+    conn: &Connection,
+    signal: Signal,
+    opts: &QueryOptions,
+    out: &mut dyn Write,
+) -> Result<usize> {
+    match signal {
+        Signal::Traces => {
+            let mut batches = Batcher::new(out, spans_line);
+            for_each_trace(conn, opts, |span| {
+                batches.push(span.service_name.clone(), span)
+            })?;
+            batches.finish()
+        }
+        Signal::Metrics => {
+            let mut batches = Batcher::new(out, metrics_line);
+            for_each_metric(conn, opts, |point| {
+                batches.push(point.service_name.clone(), point)
+            })?;
+            batches.finish()
+        }
+        Signal::Logs => {
+            let mut batches = Batcher::new(out, logs_line);
+            for_each_log(conn, opts, |log| {
+                batches.push(log.service_name.clone(), log)
+            })?;
+            batches.finish()
+        }
+    }
+}
+
+/// Buffers records per service and writes a line whenever a service's buffer fills.
+struct Batcher<'a, T> {
+    out: &'a mut dyn Write,
+    render: fn(&str, Vec<T>) -> Value,
+    pending: HashMap<String, Vec<T>>,
+    written: usize,
+}
+
+impl<'a, T> Batcher<'a, T> {
+    fn new(out: &'a mut dyn Write, render: fn(&str, Vec<T>) -> Value) -> Self {
+        Self {
+            out,
+            render,
+            pending: HashMap::new(),
+            written: 0,
+        }
+    }
+
+    fn push(&mut self, service: String, record: T) -> Result<()> {
+        let batch = self.pending.entry(service.clone()).or_default();
+        batch.push(record);
+        if batch.len() >= BATCH_SIZE {
+            let records = std::mem::take(batch);
+            self.write(&service, records)?;
+        }
+        Ok(())
+    }
+
+    fn write(&mut self, service: &str, records: Vec<T>) -> Result<()> {
+        self.written += records.len();
+        serde_json::to_writer(&mut *self.out, &(self.render)(service, records))?;
+        writeln!(self.out)?;
+        Ok(())
+    }
+
+    fn finish(mut self) -> Result<usize> {
+        let mut pending: Vec<_> = std::mem::take(&mut self.pending).into_iter().collect();
+        pending.sort_by(|a, b| a.0.cmp(&b.0));
+        for (service, records) in pending {
+            if !records.is_empty() {
+                self.write(&service, records)?;
+            }
+        }
+        self.out.flush()?;
+        Ok(self.written)
+    }
+}
+
+fn resource(service: &str) -> Value {
+    json!({ "attributes": [{ "key": "service.name", "value": { "stringValue": service } }] })
+}
+
+fn spans_line(service: &str, spans: Vec<TraceResult>) -> Value {
+    let spans: Vec<Value> = spans.into_iter().map(span_json).collect();
+    json!({
+        "resourceSpans": [{ "resource": resource(service), "scopeSpans": [{ "spans": spans }] }]
+    })
+}
+
+fn span_json(span: TraceResult) -> Value {
+    let start = unix_nano(span.start_time);
+    let status = match span.status_code {
+        0 => json!({}),
+        code => json!({ "code": code }),
+    };
+    let mut out = json!({
+        "traceId": span.trace_id,
+        "spanId": span.span_id,
+        "name": span.name,
+        "kind": span.kind,
+        "startTimeUnixNano": start.to_string(),
+        "attributes": key_values(span.attributes),
+        "status": status,
+    });
+    let fields = out.as_object_mut().expect("span is an object");
+    if let Some(parent) = span.parent_span_id.filter(|p| !p.is_empty()) {
+        fields.insert("parentSpanId".into(), parent.into());
+    }
+    // The stored end is truncated to microseconds; the duration keeps full precision.
+    if span.end_time.is_some() {
+        let end = start + span.duration_ns;
+        fields.insert("endTimeUnixNano".into(), end.to_string().into());
+    }
+    if let Some(state) = span.trace_state {
+        fields.insert("traceState".into(), state.into());
+    }
+    if let Some(flags) = span.flags {
+        fields.insert("flags".into(), flags.into());
+    }
+    for (key, count) in [
+        ("droppedAttributesCount", span.dropped_attributes_count),
+        ("droppedEventsCount", span.dropped_events_count),
+        ("droppedLinksCount", span.dropped_links_count),
+    ] {
+        if let Some(count) = count {
+            fields.insert(key.into(), count.into());
+        }
+    }
+    out
+}
+
+fn metrics_line(service: &str, points: Vec<MetricResult>) -> Value {
+    // One metric per (name, type, temporality, monotonicity, unit), in first-seen order.
+    type Key = (String, String, Option<i32>, Option<bool>, Option<String>);
+    let mut metrics: Vec<(Key, Vec<Value>)> = Vec::new();
+    for point in points {
+        let key = (
+            point.metric_name,
+            point.metric_type,
+            point.aggregation_temporality,
+            point.is_monotonic,
+            point.unit,
+        );
+        let mut dp = json!({
+            "attributes": key_values(point.attributes),
+            "timeUnixNano": unix_nano(point.timestamp).to_string(),
+        });
+        // Only a histogram's sum is stored.
+        let value_key = if key.1 == "histogram" {
+            "sum"
+        } else {
+            "asDouble"
+        };
+        dp[value_key] = json!(point.value);
+        match metrics.iter_mut().find(|(k, _)| *k == key) {
+            Some((_, dps)) => dps.push(dp),
+            None => metrics.push((key, vec![dp])),
+        }
+    }
+
+    let metrics: Vec<Value> = metrics
+        .into_iter()
+        .map(|((name, metric_type, temporality, monotonic, unit), dps)| {
+            let mut data = json!({ "dataPoints": dps });
+            if let Some(temporality) = temporality {
+                data["aggregationTemporality"] = temporality.into();
+            }
+            if let Some(monotonic) = monotonic {
+                data["isMonotonic"] = monotonic.into();
+            }
+            let data_key = match metric_type.as_str() {
+                "sum" | "histogram" => metric_type.as_str(),
+                _ => "gauge",
+            };
+            let mut metric = json!({ "name": name, data_key: data });
+            if let Some(unit) = unit {
+                metric["unit"] = unit.into();
+            }
+            metric
+        })
+        .collect();
+    json!({
+        "resourceMetrics": [{
+            "resource": resource(service),
+            "scopeMetrics": [{ "metrics": metrics }],
+        }]
+    })
+}
+
+fn logs_line(service: &str, logs: Vec<LogResult>) -> Value {
+    let records: Vec<Value> = logs
+        .into_iter()
+        .map(|log| {
+            let mut record = json!({
+                "timeUnixNano": unix_nano(log.timestamp).to_string(),
+                "attributes": key_values(log.attributes),
+            });
+            if let Some(n) = log.severity_number {
+                record["severityNumber"] = n.into();
+            }
+            if let Some(text) = log.severity {
+                record["severityText"] = text.into();
+            }
+            if let Some(body) = log.body {
+                record["body"] = json!({ "stringValue": body });
+            }
+            if let Some(id) = log.trace_id.filter(|id| !id.is_empty()) {
+                record["traceId"] = id.into();
+            }
+            if let Some(id) = log.span_id.filter(|id| !id.is_empty()) {
+                record["spanId"] = id.into();
+            }
+            record
+        })
+        .collect();
+    json!({
+        "resourceLogs": [{
+            "resource": resource(service),
+            "scopeLogs": [{ "logRecords": records }],
+        }]
+    })
+}
+
+fn unix_nano(t: NaiveDateTime) -> i64 {
+    t.and_utc().timestamp_nanos_opt().unwrap_or(0)
+}
+
+/// Stored attributes as an OTLP `KeyValue` list.
+fn key_values(attrs: Option<Value>) -> Vec<Value> {
+    match attrs {
+        Some(Value::Object(map)) => map
+            .into_iter()
+            .map(|(key, value)| json!({ "key": key, "value": any_value(value) }))
+            .collect(),
+        _ => Vec::new(),
+    }
+}
+
+/// A JSON value as an OTLP `AnyValue`; integers become int64 strings, as proto JSON has them.
+fn any_value(value: Value) -> Value {
+    match value {
+        Value::String(s) => json!({ "stringValue": s }),
+        Value::Bool(b) => json!({ "boolValue": b }),
+        Value::Number(n) if n.is_i64() || n.is_u64() => json!({ "intValue": n.to_string() }),
+        Value::Number(n) => json!({ "doubleValue": n }),
+        Value::Array(values) => {
+            let values: Vec<Value> = values.into_iter().map(any_value).collect();
+            json!({ "arrayValue": { "values": values } })
+        }
+        Value::Object(map) => {
+            json!({ "kvlistValue": { "values": key_values(Some(Value::Object(map))) } })
+        }
+        Value::Null => json!({}),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+    use crate::ingest::{append_rows, parse_log_line, parse_metric_line, parse_trace_line};
+    use crate::query::{query_logs, query_metrics, query_traces};
+    use crate::scrub::Scrubber;
+
+    /// Export every signal from `conn` and ingest the lines into a fresh database.
+    fn round_trip(conn: &Connection) -> Connection {
+        let copy = db::open_in_memory().unwrap();
+        let parsers = [
+            (Signal::Traces, parse_trace_line as fn(&str, &Scrubber) -> _),
+            (Signal::Metrics, parse_metric_line),
+            (Signal::Logs, parse_log_line),
+        ];
+        for (signal, parse) in parsers {
+            let mut out = Vec::new();
+            export_otlp_json(conn, signal, &QueryOptions::default(), &mut out).unwrap();
+            let tx = copy.unchecked_transaction().unwrap();
+            for line in String::from_utf8(out).unwrap().lines() {
+                let rows = parse(line, &Scrubber::default()).unwrap();
+                append_rows(&tx, &[rows]).unwrap();
+            }
+            tx.commit().unwrap();
+        }
+        copy
+    }
+
+    #[test]
+    fn round_trips_through_ingest() {
+        let conn = db::open_in_memory().unwrap();
+        conn.execute_batch(
+            r#"
+            INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date, trace_state, flags)
+            VALUES ('4bf92f3577b34da6a3ce929d0e0e4736', '00f067aa0ba902b7', NULL, 'GET /checkout', 2, '2024-03-09 16:00:00.000001', '2024-03-09 16:00:00.025001', 25000000, 2, 'checkout', '{"http.status_code":500,"ok":false,"ratio":0.5,"tags":["a","b"],"db":{"system":"pg"}}', '2024-03-09', 'k=v', 1),
+                   ('4bf92f3577b34da6a3ce929d0e0e4736', '0f67a9a6fc0b3c23', '00f067aa0ba902b7', 'charge', 3, '2024-03-09 16:00:00.005', '2024-03-09 16:00:00.015', 10000000, 0, 'payments', '{}', '2024-03-09', NULL, NULL);
+            INSERT INTO metrics VALUES
+                ('http.requests', 'sum', 42.0, '2024-03-09 16:00:00', 'checkout', 2, true, '1', '{"route":"/pay"}', '2024-03-09'),
+                ('queue.depth', 'gauge', 3.5, '2024-03-09 16:00:00.5', 'checkout', NULL, NULL, NULL, '{}', '2024-03-09'),
+                ('rpc.duration', 'histogram', 1.5, '2024-03-09 16:00:01', 'payments', 2, NULL, 's', '{}', '2024-03-09');
+            INSERT INTO logs VALUES
+                ('2024-03-09 16:00:00.002', 'ERROR', 17, 'card declined', 'checkout', '4bf92f3577b34da6a3ce929d0e0e4736', '00f067aa0ba902b7', '{"attempt":2}', '2024-03-09');
+            "#,
+        )
+        .unwrap();
+
+        let copy = round_trip(&conn);
+        let opts = QueryOptions::default();
+        fn json<T: serde::Serialize>(rows: &T) -> String {
+            serde_json::to_string(rows).unwrap()
+        }
+        assert_eq!(
+            json(&query_traces(&copy, &opts).unwrap()),
+            json(&query_traces(&conn, &opts).unwrap())
+        );
+        assert_eq!(
+            json(&query_metrics(&copy, &opts).unwrap()),
+            json(&query_metrics(&conn, &opts).unwrap())
+        );
+        assert_eq!(
+            json(&query_logs(&copy, &opts).unwrap()),
+            json(&query_logs(&conn, &opts).unwrap())
+        );
+    }
+
+    #[test]
+    fn batches_per_service() {
+        let conn = db::open_in_memory().unwrap();
+        for i in 0..BATCH_SIZE + 1 {
+            conn.execute(
+                "INSERT INTO logs VALUES ('2024-03-09 16:00:00', 'INFO', 9, ?, ?, NULL, NULL, '{}', '2024-03-09')",
+                duckdb::params![format!("line {i}"), if i == 0 { "b" } else { "a" }],
+            )
+            .unwrap();
+        }
+        let mut out = Vec::new();
+        let written =
+            export_otlp_json(&conn, Signal::Logs, &QueryOptions::default(), &mut out).unwrap();
+        assert_eq!(written, BATCH_SIZE + 1);
+        let lines: Vec<Value> = String::from_utf8(out)
+            .unwrap()
+            .lines()
+            .map(|l| serde_json::from_str(l).unwrap())
+            .collect();
+        let sizes: Vec<usize> = lines
+            .iter()
+            .map(|l| {
+                l["resourceLogs"][0]["scopeLogs"][0]["logRecords"]
+                    .as_array()
+                    .unwrap()
+                    .len()
+            })
+            .collect();
+        // Service "a" fills a batch as it goes; "b" is flushed at the end.
+        assert_eq!(sizes, [BATCH_SIZE, 1]);
+    }
+}
@@ -0,0 +1,498 @@
+//! Parquet storage mode: ingested rows land in date-partitioned Parquet files
+//! (`parquet/<signal>/date=YYYY-MM-DD/*.parquet`) that DuckDB queries through views, so
+//! every command keeps working, pruning deletes files, and other tools can read the data.
+//!
+//! A small DuckDB file (`lotel-parquet.db`) holds ingest cursors and history, and stages a
+//! file's rows until they are written out on commit.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+use chrono::{NaiveDate, NaiveDateTime};
+use duckdb::Connection;
+
+use crate::backend::{Backend, BackendKind};
+use crate::cancel::{Cancel, Watch};
+use crate::db::{DbConfig, ResourceLimits, sql_path};
+use crate::history::{IngestHistoryEntry, PruneRun};
+use crate::ingest::ParsedRows;
+use crate::ingest_incremental::{FileTrim, IncrementalIngester, IngestReport, IngestStore};
+use crate::prune::{PruneFilter, PruneReport};
+use crate::query::{LogResult, MetricResult, QueryOptions, Signal, TraceResult};
+
+const SIGNALS: [Signal; 3] = [Signal::Traces, Signal::Metrics, Signal::Logs];
+
+/// Columns and types of each view, matching the tables `db::migrate` creates.
+fn view_columns(signal: Signal) -> &'static [(&'static str, &'static str)] {
+    match signal {
+        Signal::Traces => &[
+            ("trace_id", "VARCHAR"),
+            ("span_id", "VARCHAR"),
+            ("parent_span_id", "VARCHAR"),
+            ("name", "VARCHAR"),
+            ("kind", "INTEGER"),
+            ("start_time", "TIMESTAMP"),
+            ("end_time", "TIMESTAMP"),
+            ("duration_ns", "BIGINT"),
+            ("status_code", "INTEGER"),
+            ("service_name", "VARCHAR"),
+            ("attributes", "JSON"),
+            ("date", "DATE"),
+            ("trace_state", "VARCHAR"),
+            ("flags", "UINTEGER"),
+            ("dropped_attributes_count", "UINTEGER"),
+            ("dropped_events_count", "UINTEGER"),
+            ("dropped_links_count", "UINTEGER"),
+        ],
+        Signal::Metrics => &[
+            ("metric_name", "VARCHAR"),
+            ("metric_type", "VARCHAR"),
+            ("value", "DOUBLE"),
+            ("timestamp", "TIMESTAMP"),
+            ("service_name", "VARCHAR"),
+            ("aggregation_temporality", "INTEGER"),
+            ("is_monotonic", "BOOLEAN"),
+            ("unit", "VARCHAR"),
+            ("attributes", "JSON"),
+            ("date", "DATE"),
+        ],
+        Signal::Logs => &[
+            ("timestamp", "TIMESTAMP"),
+            ("severity", "VARCHAR"),
+            ("severity_number", "INTEGER"),
+            ("body", "VARCHAR"),
+            ("service_name", "VARCHAR"),
+            ("trace_id", "VARCHAR"),
+            ("span_id", "VARCHAR"),
+            ("attributes", "JSON"),
+            ("date", "DATE"),
+        ],
+    }
+}
+
+pub struct ParquetBackend {
+    dir: PathBuf,
+    /// Cursor, history, and staging database; only opened for writing.
+    state: Option<Connection>,
+    /// In-memory database with one view per signal over the Parquet files.
+    views: Connection,
+}
+
+impl ParquetBackend {
+    /// Open the Parquet files under `dir`, with the state database at `state_path` unless
+    /// `read_only`. Both DuckDB instances get `limits`.
+    pub fn open(
+        dir: &Path,
+        state_path: &Path,
+        read_only: bool,
+        limits: &ResourceLimits,
+    ) -> Result<Self> {
+        for signal in SIGNALS {
+            let path = dir.join(signal.table());
+            std::fs::create_dir_all(&path)
+                .with_context(|| format!("creating directory {}", path.display()))?;
+        }
+        let state = if read_only {
+            None
+        } else {
+            let config = DbConfig {
+                limits: limits.clone(),
+                ..DbConfig::default()
+            };
+            Some(crate::db::open_db_with(state_path, &config)?)
+        };
+        let views = Connection::open_in_memory()?;
+        crate::db::apply_limits(&views, limits)?;
+        let backend = Self {
+            dir: dir.to_path_buf(),
+            state,
+            views,
+        };
+        backend.create_views()?;
+        Ok(backend)
+    }
+
+    /// The in-memory connection whose `traces`, `metrics`, and `logs` views read the
+    /// Parquet files, for callers that query with SQL.
+    pub fn into_connection(self) -> Connection {
+        self.views
+    }
+
+    /// (Re)create each view. `read_parquet` fails on a glob without matches, so signals
+    /// without files get an empty view of the same shape.
+    fn create_views(&self) -> Result<()> {
+        for signal in SIGNALS {
+            let columns = view_columns(signal);
+            let source = if partition_files(&self.dir.join(signal.table()))?.is_empty() {
+                let cols: Vec<String> = columns
+                    .iter()
+                    .map(|(name, ty)| format!("CAST(NULL AS {ty}) AS {name}"))
+                    .collect();
+                format!("SELECT {} WHERE false", cols.join(", "))
+            } else {
+                let cols: Vec<String> = columns
+                    .iter()
+                    .map(|(name, ty)| format!("CAST({name} AS {ty}) AS {name}"))
+                    .collect();
+                let glob = self.dir.join(signal.table()).join("*").join("*.parquet");
+                format!(
+                    "SELECT {} FROM read_parquet({}, hive_partitioning = true, union_by_name = true)",
+                    cols.join(", "),
+                    sql_path(&glob)?
+                )
+            };
+            self.views
+                .execute_batch(&format!(
+                    "CREATE OR REPLACE VIEW {} AS {source}",
+                    signal.table()
+                ))
+                .with_context(|| format!("creating {} view", signal.table()))?;
+        }
+        Ok(())
+    }
+
+    fn writer(&self) -> Result<&Connection> {
+        self.state
+            .as_ref()
+            .context("parquet storage was opened read-only")
+    }
+}
+
+impl Backend for ParquetBackend {
+    fn kind(&self) -> BackendKind {
+        BackendKind::Parquet
+    }
+
+    fn load_cursors(&self, ingester: &mut IncrementalIngester) -> Result<()> {
+        ingester.load_cursors(self.writer()?)
+    }
+
+    fn ingest_new(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+    ) -> Result<IngestReport> {
+        ingester.ingest_into(self, data_path)
+    }
+
+    fn consume(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        ingester.consume_from(self, data_path, archive_dir)
+    }
+
+    fn trim_files(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        ingester.trim_files_from(self, data_path, cutoff, dry_run)
+    }
+
+    fn clear(&self) -> Result<()> {
+        crate::ingest::clear_ingest_cursors(self.writer()?)?;
+        for signal in SIGNALS {
+            let path = self.dir.join(signal.table());
+            std::fs::remove_dir_all(&path)
+                .and_then(|()| std::fs::create_dir_all(&path))
+                .with_context(|| format!("clearing {}", path.display()))?;
+        }
+        self.create_views()
+    }
+
+    fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+        crate::query::query_traces(&self.views, opts)
+    }
+
+    fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+        crate::query::query_metrics(&self.views, opts)
+    }
+
+    fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>> {
+        crate::query::query_logs(&self.views, opts)
+    }
+
+    /// The files of a partition entirely older than the cutoff are deleted; a partition with
+    /// some rows to keep is rewritten as one new file without the pruned rows. Only the files
+    /// that were counted are removed, so a file an ingest adds meanwhile survives.
+    fn prune_signal(
+        &self,
+        signal: Signal,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<PruneReport> {
+        let mut params: Vec<Box<dyn duckdb::types::ToSql>> = vec![Box::new(cutoff)];
+        let cond = format!(
+            "{} < ?{}",
+            signal.time_column(),
+            crate::prune::filter_conditions(signal, filter, &mut params)
+        );
+        let param_refs: Vec<&dyn duckdb::types::ToSql> =
+            params.iter().map(|p| p.as_ref()).collect();
+
+        let mut deleted = 0;
+        for (date, partition) in partitions(&self.dir.join(signal.table()))? {
+            if date > cutoff.date() {
+                continue;
+            }
+            let files = partition_files(&partition)?;
+            if files.is_empty() {
+                continue;
+            }
+            let source = format!(
+                "read_parquet([{}])",
+                files
+                    .iter()
+                    .map(|f| sql_path(f))
+                    .collect::<Result<Vec<_>>>()?
+                    .join(", ")
+            );
+            let (total, matching): (i64, i64) = self
+                .views
+                .query_row(
+                    &format!("SELECT COUNT(*), COUNT(*) FILTER (WHERE {cond}) FROM {source}"),
+                    param_refs.as_slice(),
+                    |row| Ok((row.get(0)?, row.get(1)?)),
+                )
+                .with_context(|| format!("counting {} for prune", partition.display()))?;
+            deleted += matching;
+            if dry_run || matching == 0 {
+                continue;
+            }
+            if matching == total {
+                for file in &files {
+                    std::fs::remove_file(file)
+                        .with_context(|| format!("deleting {}", file.display()))?;
+                }
+                // Fails, and keeps the partition, when an ingest added a file meanwhile.
+                let _ = std::fs::remove_dir(&partition);
+                continue;
+            }
+            let nanos = chrono::Utc::now().timestamp_nanos_opt().unwrap_or_default();
+            let rewritten = partition.join(format!("pruned-{nanos}.parquet"));
+            self.views
+                .execute(
+                    &format!(
+                        "COPY (SELECT * FROM {source} WHERE NOT ({cond})) TO {} (FORMAT parquet)",
+                        sql_path(&rewritten)?
+                    ),
+                    param_refs.as_slice(),
+                )
+                .with_context(|| format!("rewriting {}", partition.display()))?;
+            for file in files {
+                std::fs::remove_file(&file)
+                    .with_context(|| format!("deleting {}", file.display()))?;
+            }
+        }
+        self.create_views()?;
+        Ok(PruneReport {
+            signal: signal.table().to_string(),
+            service_name: filter.service.clone(),
+            deleted,
+            cutoff: cutoff.format("%Y-%m-%dT%H:%M:%S").to_string(),
+        })
+    }
+
+    fn nth_newest(
+        &self,
+        signal: Signal,
+        n: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+    ) -> Result<Vec<(Option<String>, NaiveDateTime)>> {
+        crate::prune::nth_newest(&self.views, signal, n, filter, per_service)
+    }
+
+    // The log lives in the state database, which read-only opens skip.
+    fn record_prune(&self, run: &PruneRun) -> Result<()> {
+        crate::history::record_prune(self.writer()?, run)
+    }
+
+    fn prune_history(&self, limit: usize) -> Result<Vec<PruneRun>> {
+        crate::history::prune_history(self.writer()?, limit)
+    }
+
+    fn duckdb(&self) -> Option<&Connection> {
+        Some(&self.views)
+    }
+
+    fn watch(&self, cancel: &Cancel) -> Vec<Watch> {
+        let mut watches = vec![cancel.watch(&self.views)];
+        watches.extend(self.state.as_ref().map(|state| cancel.watch(state)));
+        watches
+    }
+
+    fn close(self: Box<Self>) -> Result<()> {
+        if let Some(state) = self.state {
+            state.close().map_err(|(_, e)| e)?;
+        }
+        self.views.close().map_err(|(_, e)| e)?;
+        Ok(())
+    }
+}
+
+/// Rows are staged in the state database's signal tables and written out as new Parquet
+/// files just before the transaction (with the file's cursor) commits. Should the commit
+/// itself fail, the files stay and those rows are ingested again on the next pass.
+impl IngestStore for ParquetBackend {
+    fn cursors(&self) -> Result<Vec<(PathBuf, u64)>> {
+        self.writer()?.cursors()
+    }
+
+    fn begin(&self) -> Result<()> {
+        IngestStore::begin(self.writer()?)
+    }
+
+    fn append(&self, rows: &[ParsedRows]) -> Result<usize> {
+        self.writer()?.append(rows)
+    }
+
+    fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()> {
+        self.writer()?.save_cursor(file_path, offset)
+    }
+
+    fn delete_cursor(&self, file_path: &Path) -> Result<()> {
+        self.writer()?.delete_cursor(file_path)
+    }
+
+    fn commit(&self) -> Result<()> {
+        let conn = self.writer()?;
+        for signal in SIGNALS {
+            let table = signal.table();
+            let staged: i64 =
+                conn.query_row(&format!("SELECT COUNT(*) FROM {table}"), [], |row| {
+                    row.get(0)
+                })?;
+            if staged == 0 {
+                continue;
+            }
+            conn.execute_batch(&format!(
+                "COPY {table} TO {} (FORMAT parquet, PARTITION_BY (date), APPEND); DELETE FROM {table}",
+                sql_path(&self.dir.join(table))?
+            ))
+            .with_context(|| format!("writing {table} parquet files"))?;
+        }
+        // Summaries only serve DuckDB's own tables; the views group spans instead.
+        conn.execute_batch("DELETE FROM trace_summaries")?;
+        IngestStore::commit(conn)?;
+        self.create_views()
+    }
+
+    fn rollback(&self) -> Result<()> {
+        IngestStore::rollback(self.writer()?)
+    }
+
+    fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()> {
+        self.writer()?.record_ingest(entry)
+    }
+
+    fn duckdb(&self) -> Option<&Connection> {
+        self.state.as_ref()
+    }
+}
+
+/// `date=YYYY-MM-DD` partition directories under a signal directory.
+fn partitions(dir: &Path) -> Result<Vec<(NaiveDate, PathBuf)>> {
+    let mut out = Vec::new();
+    for entry in std::fs::read_dir(dir).with_context(|| format!("reading {}", dir.display()))? {
+        let path = entry?.path();
+        let date = path
+            .file_name()
+            .and_then(|n| n.to_str())
+            .and_then(|n| n.strip_prefix("date="))
+            .and_then(|d| d.parse().ok());
+        if let Some(date) = date
+            && path.is_dir()
+        {
+            out.push((date, path));
+        }
+    }
+    out.sort();
+    Ok(out)
+}
+
+/// Parquet files in `dir` or, for a signal directory, in its partitions.
+fn partition_files(dir: &Path) -> Result<Vec<PathBuf>> {
+    let mut files = Vec::new();
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return Ok(files);
+    };
+    for entry in entries {
+        let path = entry?.path();
+        if path.is_dir() {
+            files.extend(partition_files(&path)?);
+        } else if path.extension().is_some_and(|e| e == "parquet") {
+            files.push(path);
+        }
+    }
+    Ok(files)
+}
+
+/// A path as a single-quoted SQL string literal.
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ingests_to_partitions_and_prunes_by_file() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let data = tmp.path().join("data");
+        let traces = data.join("traces");
+        std::fs::create_dir_all(&traces).unwrap();
+        let span = |day: u32, id: &str| {
+            format!(
+                r#"{{"resourceSpans":[{{"resource":{{"attributes":[{{"key":"service.name","value":{{"stringValue":"checkout"}}}}]}},"scopeSpans":[{{"spans":[{{"traceId":"{id}","spanId":"00f067aa0ba902b7","name":"GET /","kind":2,"startTimeUnixNano":"{}","endTimeUnixNano":"{}","status":{{}}}}]}}]}}]}}"#,
+                1_709_251_200_000_000_000u64 + u64::from(day) * 86_400_000_000_000,
+                1_709_251_200_001_000_000u64 + u64::from(day) * 86_400_000_000_000,
+            )
+        };
+        std::fs::write(
+            traces.join("traces.jsonl"),
+            format!(
+                "{}\n{}\n",
+                span(0, "4bf92f3577b34da6a3ce929d0e0e4736"),
+                span(2, "5bf92f3577b34da6a3ce929d0e0e4736")
+            ),
+        )
+        .unwrap();
+
+        let dir = tmp.path().join("parquet");
+        let limits = ResourceLimits::default();
+        let backend =
+            ParquetBackend::open(&dir, &tmp.path().join("state.db"), false, &limits).unwrap();
+        let mut ingester = IncrementalIngester::new();
+        backend.load_cursors(&mut ingester).unwrap();
+        assert_eq!(backend.ingest_new(&mut ingester, &data).unwrap().traces, 2);
+        assert!(dir.join("traces/date=2024-03-01").is_dir());
+        assert!(dir.join("traces/date=2024-03-03").is_dir());
+        assert_eq!(
+            backend
+                .query_traces(&QueryOptions::default())
+                .unwrap()
+                .len(),
+            2
+        );
+
+        // A read-only backend sees the same files.
+        let reader =
+            ParquetBackend::open(&dir, &tmp.path().join("state.db"), true, &limits).unwrap();
+        assert_eq!(
+            reader.query_traces(&QueryOptions::default()).unwrap().len(),
+            2
+        );
+
+        let cutoff = "2024-03-02T00:00:00".parse().unwrap();
+        let reports = backend.prune(cutoff, None, false).unwrap();
+        assert_eq!(reports[0].deleted, 1);
+        assert!(!dir.join("traces/date=2024-03-01").exists());
+        let spans = backend.query_traces(&QueryOptions::default()).unwrap();
+        assert_eq!(spans.len(), 1);
+        assert_eq!(spans[0].trace_id, "5bf92f3577b34da6a3ce929d0e0e4736");
+    }
+}
@@ -0,0 +1,195 @@
+//! Log pattern clustering: bodies reduced to templates by masking variable tokens.
+//!
+//! Tokens containing a digit (counts, durations, IDs, IPs, timestamps) become `<*>`, as do
+//! hex strings of eight or more characters; in `key=value` and `key:value` tokens only the
+//! value is masked. Messages that differ only in those values share a pattern.
+
+use std::collections::{BTreeSet, HashMap};
+
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, Signal, from_clause};
+
+/// Placeholder for a masked token.
+pub const WILDCARD: &str = "<*>";
+
+/// One log template and how often it occurred.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LogPattern {
+    pub pattern: String,
+    pub count: i64,
+    /// Share of all matched records.
+    pub fraction: f64,
+    pub services: Vec<String>,
+    pub first_seen: NaiveDateTime,
+    pub last_seen: NaiveDateTime,
+    /// The first body seen with this pattern.
+    pub example: String,
+}
+
+/// Group the bodies of logs matching `opts` by template, most frequent first. `opts.limit`
+/// caps the number of patterns returned, not the records scanned.
+pub fn log_patterns(conn: &Connection, opts: &QueryOptions) -> Result<Vec<LogPattern>> {
+    let scan = QueryOptions {
+        limit: None,
+        ..opts.clone()
+    };
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let query = format!(
+        "SELECT timestamp, service_name, COALESCE(body, ''){}",
+        from_clause(Signal::Logs, &scan, &mut params)
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok((
+                row.get::<_, NaiveDateTime>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, String>(2)?,
+            ))
+        })
+        .context("querying logs for patterns")?;
+
+    let mut groups: HashMap<String, (LogPattern, BTreeSet<String>)> = HashMap::new();
+    let mut total = 0i64;
+    for row in rows {
+        let (timestamp, service, body) = row?;
+        total += 1;
+        let pattern = log_template(&body);
+        let (group, services) = groups.entry(pattern.clone()).or_insert_with(|| {
+            let group = LogPattern {
+                pattern,
+                count: 0,
+                fraction: 0.0,
+                services: Vec::new(),
+                first_seen: timestamp,
+                last_seen: timestamp,
+                example: body,
+            };
+            (group, BTreeSet::new())
+        });
+        group.count += 1;
+        // Rows arrive in timestamp order.
+        group.last_seen = timestamp;
+        services.insert(service);
+    }
+
+    let mut patterns: Vec<LogPattern> = groups
+        .into_values()
+        .map(|(mut group, services)| {
+            group.fraction = group.count as f64 / total as f64;
+            group.services = services.into_iter().collect();
+            group
+        })
+        .collect();
+    patterns.sort_by(|a, b| b.count.cmp(&a.count).then(a.pattern.cmp(&b.pattern)));
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        patterns.truncate(limit);
+    }
+    Ok(patterns)
+}
+
+/// Reduce a log body to its template. Whitespace runs collapse to a single space.
+pub fn log_template(body: &str) -> String {
+    body.split_whitespace()
+        .map(mask_token)
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+fn mask_token(token: &str) -> String {
+    const TRIM: &[char] = &['"', '\'', '(', ')', '[', ']', '{', '}', ',', ';', '.'];
+    let core = token.trim_matches(TRIM);
+    if core.is_empty() {
+        return token.to_string();
+    }
+    let lead = &token[..token.find(core).unwrap_or(0)];
+    let trail = &token[lead.len() + core.len()..];
+
+    let masked = match core.split_once(['=', ':']) {
+        // `key=value` keeps the key; a bare `12:30:01` is all value.
+        Some((key, value)) if !key.is_empty() && !is_variable(key) => {
+            let sep = &core[key.len()..key.len() + 1];
+            if value.is_empty() || !is_variable(value) {
+                return token.to_string();
+            }
+            format!("{key}{sep}{WILDCARD}")
+        }
+        _ if is_variable(core) => WILDCARD.to_string(),
+        _ => return token.to_string(),
+    };
+    format!("{lead}{masked}{trail}")
+}
+
+fn is_variable(s: &str) -> bool {
+    s.bytes().any(|b| b.is_ascii_digit())
+        || (s.len() >= 8 && s.bytes().all(|b| b.is_ascii_hexdigit()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn masks_variable_tokens() {
+        assert_eq!(
+            log_template("GET /users/42 took 12.5ms from 10.0.0.1"),
+            "GET <*> took <*> from <*>"
+        );
+        assert_eq!(
+            log_template("user_id=42 status=ok   retry:3 (attempt 2)."),
+            "user_id=<*> status=ok retry:<*> (attempt <*>)."
+        );
+        assert_eq!(
+            log_template("cache miss for deadbeefcafe at 12:30:01"),
+            "cache miss for <*> at <*>"
+        );
+        assert_eq!(log_template("connection reset"), "connection reset");
+    }
+
+    #[test]
+    fn groups_logs_by_pattern() {
+        let conn = db::open_in_memory().unwrap();
+        let rows = [
+            ("2024-03-09 16:00:00", "api", "request 1 done in 5ms"),
+            ("2024-03-09 16:00:01", "api", "request 2 done in 7ms"),
+            ("2024-03-09 16:00:02", "worker", "request 3 done in 9ms"),
+            ("2024-03-09 16:00:03", "api", "shutting down"),
+        ];
+        for (ts, service, body) in rows {
+            conn.execute(
+                "INSERT INTO logs VALUES (?, 'INFO', 9, ?, ?, NULL, NULL, '{}', '2024-03-09')",
+                duckdb::params![ts, body, service],
+            )
+            .unwrap();
+        }
+
+        let patterns = log_patterns(&conn, &QueryOptions::default()).unwrap();
+        assert_eq!(patterns.len(), 2);
+        assert_eq!(patterns[0].pattern, "request <*> done in <*>");
+        assert_eq!(patterns[0].count, 3);
+        assert_eq!(patterns[0].fraction, 0.75);
+        assert_eq!(patterns[0].services, ["api", "worker"]);
+        assert_eq!(patterns[0].example, "request 1 done in 5ms");
+        assert_eq!(
+            patterns[0].last_seen,
+            "2024-03-09T16:00:02".parse::<NaiveDateTime>().unwrap()
+        );
+
+        let opts = QueryOptions {
+            service: Some("api".into()),
+            limit: Some(1),
+            ..Default::default()
+        };
+        let patterns = log_patterns(&conn, &opts).unwrap();
+        assert_eq!(patterns.len(), 1);
+        assert_eq!(patterns[0].count, 2);
+    }
+}
@@ -0,0 +1,403 @@
+//! Prometheus text exposition of stored metrics and of RED metrics derived from spans.
+//!
+//! Each series (metric, service, attribute set) exposes its latest value; delta sums are
+//! summed into the running total Prometheus expects. Monotonic sums become counters, other
+//! sums and gauges become gauges, and histograms (stored as their sum) become untyped
+//! `_sum` series. Span-derived series follow the OTel spanmetrics connector: a call counter and
+//! a duration histogram per service, span name, kind, and status.
+
+use std::collections::BTreeMap;
+use std::fmt::Write as _;
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde_json::Value;
+
+use crate::query::{span_kind_name, status_code_name};
+use crate::series::TEMPORALITY_DELTA;
+
+/// Upper bounds (seconds) of the span duration histogram buckets.
+pub const DURATION_BUCKETS: [f64; 12] = [
+    0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0,
+];
+
+/// One exposed sample before rendering.
+struct Sample {
+    labels: Vec<(String, String)>,
+    value: f64,
+}
+
+/// A metric family: `# HELP`/`# TYPE` lines and its samples.
+struct Family {
+    kind: &'static str,
+    help: String,
+    /// Samples keyed by name suffix (`""`, `_bucket`, `_sum`, `_count`).
+    samples: Vec<(&'static str, Sample)>,
+}
+
+/// Render every stored metric plus the span metrics in the Prometheus text format.
+pub fn prometheus_exposition(conn: &Connection) -> Result<String> {
+    let mut families: BTreeMap<String, Family> = BTreeMap::new();
+    stored_metrics(conn, &mut families)?;
+    span_metrics(conn, &mut families)?;
+
+    let mut out = String::new();
+    for (name, family) in &families {
+        let _ = writeln!(out, "# HELP {name} {}", escape_help(&family.help));
+        let _ = writeln!(out, "# TYPE {name} {}", family.kind);
+        for (suffix, sample) in &family.samples {
+            let _ = writeln!(
+                out,
+                "{name}{suffix}{} {}",
+                render_labels(&sample.labels),
+                render_value(sample.value)
+            );
+        }
+    }
+    Ok(out)
+}
+
+fn stored_metrics(conn: &Connection, families: &mut BTreeMap<String, Family>) -> Result<()> {
+    let query = format!(
+        "SELECT metric_name, metric_type, bool_or(is_monotonic), MAX(unit), service_name,
+                CAST(attributes AS VARCHAR),
+                CASE WHEN MAX(aggregation_temporality) = {TEMPORALITY_DELTA}
+                     THEN SUM(value) ELSE arg_max(value, timestamp) END
+         FROM metrics
+         GROUP BY metric_name, metric_type, service_name, CAST(attributes AS VARCHAR)
+         ORDER BY metric_name, service_name, CAST(attributes AS VARCHAR)"
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let rows = stmt
+        .query_map([], |row| {
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, Option<bool>>(2)?,
+                row.get::<_, Option<String>>(3)?,
+                row.get::<_, String>(4)?,
+                row.get::<_, Option<String>>(5)?,
+                row.get::<_, Option<f64>>(6)?,
+            ))
+        })
+        .context("reading latest metric values")?;
+
+    for row in rows {
+        let (metric, metric_type, monotonic, unit, service, attrs, value) = row?;
+        let base = sanitize_name(&metric);
+        let (name, kind) = match (metric_type.as_str(), monotonic) {
+            ("sum", Some(true)) => (counter_name(&base), "counter"),
+            ("histogram", _) => (format!("{base}_sum"), "untyped"),
+            _ => (base, "gauge"),
+        };
+        let family = families.entry(name).or_insert_with(|| Family {
+            kind,
+            help: match unit.as_deref() {
+                Some(unit) if !unit.is_empty() => format!("{metric} ({unit})"),
+                _ => metric.clone(),
+            },
+            samples: Vec::new(),
+        });
+        let mut labels = vec![("service_name".to_string(), service)];
+        labels.extend(attribute_labels(attrs.as_deref()));
+        family.samples.push((
+            "",
+            Sample {
+                labels,
+                value: value.unwrap_or(0.0),
+            },
+        ));
+    }
+    Ok(())
+}
+
+fn span_metrics(conn: &Connection, families: &mut BTreeMap<String, Family>) -> Result<()> {
+    let buckets: Vec<String> = DURATION_BUCKETS
+        .iter()
+        .map(|le| {
+            let ns = (le * 1e9).round() as i64;
+            format!("COUNT(*) FILTER (WHERE duration_ns <= {ns})")
+        })
+        .collect();
+    let query = format!(
+        "SELECT service_name, name, COALESCE(kind, 0), COALESCE(status_code, 0), COUNT(*),
+                COALESCE(SUM(duration_ns), 0) / 1e9, {}
+         FROM traces
+         GROUP BY ALL
+         ORDER BY service_name, name, 3, 4",
+        buckets.join(", ")
+    );
+    let mut stmt = conn.prepare(&query)?;
+    let rows = stmt
+        .query_map([], |row| {
+            let counts = (0..DURATION_BUCKETS.len())
+                .map(|i| row.get::<_, i64>(6 + i))
+                .collect::<duckdb::Result<Vec<_>>>()?;
+            Ok((
+                row.get::<_, String>(0)?,
+                row.get::<_, String>(1)?,
+                row.get::<_, i32>(2)?,
+                row.get::<_, i32>(3)?,
+                row.get::<_, i64>(4)?,
+                row.get::<_, f64>(5)?,
+                counts,
+            ))
+        })
+        .context("computing span metrics")?;
+
+    for row in rows {
+        let (service, span, kind, status, calls, seconds, counts) = row?;
+        let labels = vec![
+            ("service_name".to_string(), service),
+            ("span_name".to_string(), span),
+            (
+                "span_kind".to_string(),
+                format!("SPAN_KIND_{}", span_kind_name(kind)),
+            ),
+            (
+                "status_code".to_string(),
+                format!("STATUS_CODE_{}", status_code_name(status)),
+            ),
+        ];
+        families
+            .entry("lotel_span_calls_total".into())
+            .or_insert_with(|| Family {
+                kind: "counter",
+                help: "Spans recorded, by service, span name, kind, and status".into(),
+                samples: Vec::new(),
+            })
+            .samples
+            .push((
+                "",
+                Sample {
+                    labels: labels.clone(),
+                    value: calls as f64,
+                },
+            ));
+
+        let duration = &mut families
+            .entry("lotel_span_duration_seconds".into())
+            .or_insert_with(|| Family {
+                kind: "histogram",
+                help: "Span durations, by service, span name, kind, and status".into(),
+                samples: Vec::new(),
+            })
+            .samples;
+        for (le, count) in DURATION_BUCKETS
+            .iter()
+            .map(|le| render_value(*le))
+            .chain(std::iter::once("+Inf".to_string()))
+            .zip(counts.into_iter().chain(std::iter::once(calls)))
+        {
+            let mut labels = labels.clone();
+            labels.push(("le".into(), le));
+            duration.push((
+                "_bucket",
+                Sample {
+                    labels,
+                    value: count as f64,
+                },
+            ));
+        }
+        duration.push((
+            "_sum",
+            Sample {
+                labels: labels.clone(),
+                value: seconds,
+            },
+        ));
+        duration.push((
+            "_count",
+            Sample {
+                labels,
+                value: calls as f64,
+            },
+        ));
+    }
+    Ok(())
+}
+
+/// Attributes as label pairs, keys sanitized; nested values are rendered as JSON. Keys that
+/// sanitize to the same name (`http.route` and `http_route`) keep the first one in key order,
+/// and those that would clash with `service_name` or the reserved `__` prefix are dropped.
+fn attribute_labels(attrs: Option<&str>) -> Vec<(String, String)> {
+    let Some(Value::Object(map)) = attrs.and_then(|a| serde_json::from_str(a).ok()) else {
+        return Vec::new();
+    };
+    let mut labels: Vec<(String, String)> = Vec::new();
+    for (key, value) in map {
+        let name = sanitize_name(&key);
+        if name == "service_name"
+            || name.starts_with("__")
+            || labels.iter().any(|(n, _)| *n == name)
+        {
+            continue;
+        }
+        let value = match value {
+            Value::String(s) => s,
+            other => other.to_string(),
+        };
+        labels.push((name, value));
+    }
+    labels.sort();
+    labels
+}
+
+/// Replace characters Prometheus does not allow in metric and label names with `_`.
+fn sanitize_name(name: &str) -> String {
+    let mut out: String = name
+        .chars()
+        .map(|c| {
+            if c.is_ascii_alphanumeric() || c == '_' || c == ':' {
+                c
+            } else {
+                '_'
+            }
+        })
+        .collect();
+    if out.starts_with(|c: char| c.is_ascii_digit()) || out.is_empty() {
+        out.insert(0, '_');
+    }
+    out
+}
+
+fn counter_name(base: &str) -> String {
+    if base.ends_with("_total") {
+        base.to_string()
+    } else {
+        format!("{base}_total")
+    }
+}
+
+fn render_labels(labels: &[(String, String)]) -> String {
+    if labels.is_empty() {
+        return String::new();
+    }
+    let pairs: Vec<String> = labels
+        .iter()
+        .map(|(k, v)| {
+            let v = v
+                .replace('\\', "\\\\")
+                .replace('"', "\\\"")
+                .replace('\n', "\\n");
+            format!("{k}=\"{v}\"")
+        })
+        .collect();
+    format!("{{{}}}", pairs.join(","))
+}
+
+fn render_value(value: f64) -> String {
+    if value.is_nan() {
+        "NaN".into()
+    } else if value.is_infinite() {
+        if value > 0.0 { "+Inf" } else { "-Inf" }.into()
+    } else {
+        value.to_string()
+    }
+}
+
+fn escape_help(help: &str) -> String {
+    help.replace('\\', "\\\\").replace('\n', "\\n")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    #[test]
+    fn exposes_latest_values_and_span_metrics() {
+        let conn = db::open_in_memory().unwrap();
+        let metrics = [
+            (
+                "http.requests",
+                "sum",
+                10.0,
+                "16:00:00",
+                Some(2),
+                Some(true),
+                r#"{"http.route":"/a"}"#,
+            ),
+            (
+                "http.requests",
+                "sum",
+                25.0,
+                "16:01:00",
+                Some(2),
+                Some(true),
+                r#"{"http.route":"/a"}"#,
+            ),
+            ("jobs", "sum", 3.0, "16:00:00", Some(1), Some(true), "{}"),
+            ("jobs", "sum", 4.0, "16:01:00", Some(1), Some(true), "{}"),
+            (
+                "queue.depth",
+                "gauge",
+                7.0,
+                "16:00:00",
+                None,
+                None,
+                r#"{"q":"say \"hi\""}"#,
+            ),
+        ];
+        for (name, ty, value, time, temporality, monotonic, attrs) in metrics {
+            conn.execute(
+                "INSERT INTO metrics VALUES (?, ?, ?, ?, 'api', ?, ?, '1', ?, '2024-03-09')",
+                duckdb::params![
+                    name,
+                    ty,
+                    value,
+                    format!("2024-03-09 {time}"),
+                    temporality,
+                    monotonic,
+                    attrs
+                ],
+            )
+            .unwrap();
+        }
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', 's1', NULL, 'GET /', 2, '2024-03-09 16:00:00', NULL, 20000000, 2, 'api', '{}', '2024-03-09')",
+            [],
+        )
+        .unwrap();
+
+        let out = prometheus_exposition(&conn).unwrap();
+        assert!(out.contains("# TYPE http_requests_total counter\n"));
+        assert!(out.contains("http_requests_total{service_name=\"api\",http_route=\"/a\"} 25\n"));
+        assert!(out.contains("jobs_total{service_name=\"api\"} 7\n"));
+        assert!(out.contains("# TYPE queue_depth gauge\n"));
+        assert!(out.contains("queue_depth{service_name=\"api\",q=\"say \\\"hi\\\"\"} 7\n"));
+
+        let labels = "service_name=\"api\",span_name=\"GET /\",span_kind=\"SPAN_KIND_SERVER\",status_code=\"STATUS_CODE_ERROR\"";
+        assert!(out.contains(&format!("lotel_span_calls_total{{{labels}}} 1\n")));
+        assert!(out.contains(&format!(
+            "lotel_span_duration_seconds_bucket{{{labels},le=\"0.01\"}} 0\n"
+        )));
+        assert!(out.contains(&format!(
+            "lotel_span_duration_seconds_bucket{{{labels},le=\"0.025\"}} 1\n"
+        )));
+        assert!(out.contains(&format!(
+            "lotel_span_duration_seconds_bucket{{{labels},le=\"+Inf\"}} 1\n"
+        )));
+        assert!(out.contains(&format!(
+            "lotel_span_duration_seconds_sum{{{labels}}} 0.02\n"
+        )));
+    }
+
+    #[test]
+    fn sanitizes_names() {
+        assert_eq!(
+            sanitize_name("http.server.duration"),
+            "http_server_duration"
+        );
+        assert_eq!(sanitize_name("2xx"), "_2xx");
+        assert_eq!(counter_name("requests_total"), "requests_total");
+    }
+
+    #[test]
+    fn attribute_labels_are_unique_after_sanitizing() {
+        let labels = attribute_labels(Some(
+            r#"{"service.name":"web","http.route":"/a","http_route":"/b","__name__":"x"}"#,
+        ));
+        assert_eq!(labels, vec![("http_route".to_string(), "/a".to_string())]);
+    }
+}
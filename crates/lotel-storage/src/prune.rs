@@ -1,8 +1,13 @@
+#[cfg(feature = "duckdb")]
 use anyhow::{Context, Result};
+#[cfg(feature = "duckdb")]
 use chrono::NaiveDateTime;
+#[cfg(feature = "duckdb")]
 use duckdb::Connection;
 use serde::Serialize;
 
+use crate::query::{AttrFilter, Signal};
+
 #[derive(Debug, Serialize)]
 pub struct PruneReport {
     pub signal: String,
@@ -12,79 +17,221 @@ pub struct PruneReport {
     pub cutoff: String,
 }
 
+/// Which records a prune deletes, besides the age cutoff or count limit.
+#[derive(Debug, Clone, Default)]
+pub struct PruneFilter {
+    pub service: Option<String>,
+    /// Span or metric name; `*` matches any run of characters. Logs have no name, so a name
+    /// filter leaves them alone.
+    pub name: Option<String>,
+    /// Attribute filters, all of which must match.
+    pub attrs: Vec<AttrFilter>,
+}
+
+impl PruneFilter {
+    pub fn service(service: Option<&str>) -> Self {
+        Self {
+            service: service.map(String::from),
+            ..Default::default()
+        }
+    }
+
+    /// Whether records of `signal` can match.
+    pub fn applies_to(&self, signal: Signal) -> bool {
+        self.name.is_none() || name_column(signal).is_some()
+    }
+
+    /// The same filter restricted to one service.
+    pub(crate) fn for_service(&self, service: Option<String>) -> Self {
+        Self {
+            service: service.or_else(|| self.service.clone()),
+            ..self.clone()
+        }
+    }
+}
+
+/// Column holding a record's name, matched by [`PruneFilter::name`].
+pub(crate) fn name_column(signal: Signal) -> Option<&'static str> {
+    match signal {
+        Signal::Traces => Some("name"),
+        Signal::Metrics => Some("metric_name"),
+        Signal::Logs => None,
+    }
+}
+
 /// Prune telemetry data older than `cutoff`.
 /// If `dry_run`, returns what would be deleted without deleting.
+#[cfg(feature = "duckdb")]
 pub fn prune(
     conn: &Connection,
     cutoff: NaiveDateTime,
     service: Option<&str>,
     dry_run: bool,
 ) -> Result<Vec<PruneReport>> {
-    let signals = [
-        ("traces", "start_time"),
-        ("metrics", "timestamp"),
-        ("logs", "timestamp"),
-    ];
-
-    let cutoff_str = cutoff.format("%Y-%m-%dT%H:%M:%S").to_string();
-    let mut reports = Vec::new();
-
-    for (signal, time_col) in &signals {
-        let mut count_query = format!("SELECT COUNT(*) FROM {signal} WHERE {time_col} < ?");
-        let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
-        params.push(Box::new(cutoff));
-
-        if let Some(svc) = service {
-            count_query.push_str(" AND service_name = ?");
-            params.push(Box::new(svc.to_string()));
-        }
+    [Signal::Traces, Signal::Metrics, Signal::Logs]
+        .into_iter()
+        .map(|signal| {
+            prune_signal(
+                conn,
+                signal,
+                cutoff,
+                &PruneFilter::service(service),
+                dry_run,
+            )
+        })
+        .collect()
+}
 
-        let param_refs: Vec<&dyn duckdb::types::ToSql> =
-            params.iter().map(|p| p.as_ref()).collect();
-        let count: i64 = conn
-            .query_row(&count_query, param_refs.as_slice(), |row| row.get(0))
-            .with_context(|| format!("counting {signal} for prune"))?;
+/// Prune one signal's records older than `cutoff` that match `filter`.
+#[cfg(feature = "duckdb")]
+pub fn prune_signal(
+    conn: &Connection,
+    signal: Signal,
+    cutoff: NaiveDateTime,
+    filter: &PruneFilter,
+    dry_run: bool,
+) -> Result<PruneReport> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = vec![Box::new(cutoff)];
+    let cond = format!(
+        "{} < ?{}",
+        signal.time_column(),
+        filter_conditions(signal, filter, &mut params)
+    );
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let table = signal.table();
+    let count: i64 = conn
+        .query_row(
+            &format!("SELECT COUNT(*) FROM {table} WHERE {cond}"),
+            param_refs.as_slice(),
+            |row| row.get(0),
+        )
+        .with_context(|| format!("counting {table} for prune"))?;
 
-        if !dry_run && count > 0 {
-            let mut delete_query = format!("DELETE FROM {signal} WHERE {time_col} < ?");
-            let mut del_params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
-            del_params.push(Box::new(cutoff));
+    if !dry_run && count > 0 {
+        let traces = signal == Signal::Traces;
+        if traces {
+            // Remember which traces lose spans so their summaries can be recomputed.
+            conn.execute(
+                &format!(
+                    "CREATE OR REPLACE TEMP TABLE pruned_traces AS \
+                     SELECT DISTINCT trace_id FROM traces WHERE {cond}"
+                ),
+                param_refs.as_slice(),
+            )
+            .context("collecting pruned traces")?;
+        }
+        conn.execute(
+            &format!("DELETE FROM {table} WHERE {cond}"),
+            param_refs.as_slice(),
+        )
+        .with_context(|| format!("pruning {table}"))?;
+        if traces {
+            crate::summaries::refresh_pruned(conn)?;
+        }
+    }
 
-            if let Some(svc) = service {
-                delete_query.push_str(" AND service_name = ?");
-                del_params.push(Box::new(svc.to_string()));
-            }
+    Ok(PruneReport {
+        signal: table.to_string(),
+        service_name: filter.service.clone(),
+        deleted: count,
+        cutoff: cutoff.format("%Y-%m-%dT%H:%M:%S").to_string(),
+    })
+}
 
-            let del_refs: Vec<&dyn duckdb::types::ToSql> =
-                del_params.iter().map(|p| p.as_ref()).collect();
-            conn.execute(&delete_query, del_refs.as_slice())
-                .with_context(|| format!("pruning {signal}"))?;
+/// `filter` as ` AND ...` conditions on `signal`'s table for DuckDB, adding their values to
+/// `params`.
+#[cfg(feature = "duckdb")]
+pub(crate) fn filter_conditions(
+    signal: Signal,
+    filter: &PruneFilter,
+    params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
+) -> String {
+    let mut cond = String::new();
+    if let Some(svc) = &filter.service {
+        cond.push_str(" AND service_name = ?");
+        params.push(Box::new(svc.clone()));
+    }
+    if let Some(name) = &filter.name {
+        match name_column(signal) {
+            Some(column) => {
+                cond.push_str(&format!(" AND {column} GLOB ?"));
+                params.push(Box::new(name.clone()));
+            }
+            None => cond.push_str(" AND false"),
         }
+    }
+    for attr in &filter.attrs {
+        crate::query::append_json_filter(&mut cond, params, "attributes", attr.json_path(), attr);
+    }
+    cond
+}
 
-        reports.push(PruneReport {
-            signal: signal.to_string(),
-            service_name: service.map(String::from),
-            deleted: count,
-            cutoff: cutoff_str.clone(),
-        });
+/// Time of the `n`-th newest record of `signal` matching `filter`, per service when
+/// `per_service` and overall otherwise. Groups with fewer than `n` records are left out.
+/// Pruning each group below its time keeps its newest `n` records, plus any sharing the
+/// `n`-th one's time.
+#[cfg(feature = "duckdb")]
+pub fn nth_newest(
+    conn: &Connection,
+    signal: Signal,
+    n: u64,
+    filter: &PruneFilter,
+    per_service: bool,
+) -> Result<Vec<(Option<String>, NaiveDateTime)>> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let ranked = ranked_by_time(
+        signal,
+        per_service,
+        &filter_conditions(signal, filter, &mut params),
+    );
+    params.push(Box::new(n as i64));
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let mut stmt = conn.prepare(&format!("SELECT svc, t FROM ({ranked}) WHERE rn = ?"))?;
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok((row.get::<_, String>(0)?, row.get::<_, NaiveDateTime>(1)?))
+        })
+        .with_context(|| format!("finding the newest {n} {}", signal.table()))?;
+    let mut cutoffs = Vec::new();
+    for row in rows {
+        let (svc, t) = row?;
+        cutoffs.push((per_service.then_some(svc), t));
     }
+    Ok(cutoffs)
+}
 
-    Ok(reports)
+/// Records of `signal` matching `conditions` (` AND ...`, in the backend's dialect) numbered
+/// newest first as `rn`, per service (`svc`) when `per_service`; `svc` is empty otherwise.
+/// Shared by the backends' keep-last-N lookups.
+pub(crate) fn ranked_by_time(signal: Signal, per_service: bool, conditions: &str) -> String {
+    let time_col = signal.time_column();
+    let (svc, partition) = if per_service {
+        ("service_name", "PARTITION BY service_name ")
+    } else {
+        ("''", "")
+    };
+    format!(
+        "SELECT {svc} AS svc, {time_col} AS t, \
+         row_number() OVER ({partition}ORDER BY {time_col} DESC) AS rn \
+         FROM {} WHERE 1=1{conditions}",
+        signal.table()
+    )
 }
 
-#[cfg(test)]
+#[cfg(all(test, feature = "duckdb"))]
 mod tests {
     use super::*;
+    use crate::backend::Backend;
     use crate::db;
 
     fn setup_with_data() -> Connection {
         let conn = db::open_in_memory().unwrap();
         conn.execute(
-            "INSERT INTO traces VALUES ('t1', 's1', NULL, 'old', 1, '2024-01-01 00:00:00', '2024-01-01 00:00:01', 1000000000, 0, 'svc-a', '{}', '2024-01-01')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', 's1', NULL, 'old', 1, '2024-01-01 00:00:00', '2024-01-01 00:00:01', 1000000000, 0, 'svc-a', '{}', '2024-01-01')",
             [],
         ).unwrap();
         conn.execute(
-            "INSERT INTO traces VALUES ('t2', 's2', NULL, 'new', 1, '2024-12-01 00:00:00', '2024-12-01 00:00:01', 1000000000, 0, 'svc-a', '{}', '2024-12-01')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t2', 's2', NULL, 'new', 1, '2024-12-01 00:00:00', '2024-12-01 00:00:01', 1000000000, 0, 'svc-a', '{}', '2024-12-01')",
             [],
         ).unwrap();
         conn.execute(
@@ -133,12 +280,91 @@ mod tests {
         assert_eq!(count, 1); // Only the new trace remains.
     }
 
+    #[test]
+    fn keeps_the_newest_records() {
+        let conn = setup_with_data();
+        for (id, service, day) in [("t3", "svc-a", 2), ("t4", "svc-b", 3), ("t5", "svc-b", 4)] {
+            conn.execute(
+                &format!("INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('{id}', 's-{id}', NULL, 'x', 1, '2024-12-0{day} 00:00:00', '2024-12-0{day} 00:00:01', 1000000000, 0, '{service}', '{{}}', '2024-12-0{day}')"),
+                [],
+            ).unwrap();
+        }
+        let backend = crate::backend::DuckDbBackend::new(conn);
+
+        // Three newest spans overall: t5, t4, t3; t2 and t1 go.
+        let reports = backend
+            .prune_keep(Signal::Traces, 3, &PruneFilter::default(), false, true)
+            .unwrap();
+        assert_eq!(reports.len(), 1);
+        assert_eq!(reports[0].deleted, 2);
+
+        // Newest span of each service: svc-a keeps t3, svc-b keeps t5.
+        let reports = backend
+            .prune_keep(Signal::Traces, 1, &PruneFilter::default(), true, false)
+            .unwrap();
+        let mut deleted: Vec<(Option<String>, i64)> = reports
+            .into_iter()
+            .map(|r| (r.service_name, r.deleted))
+            .collect();
+        deleted.sort();
+        assert_eq!(
+            deleted,
+            [(Some("svc-a".into()), 2), (Some("svc-b".into()), 1)]
+        );
+        let ids: Vec<String> = backend
+            .query_traces(&Default::default())
+            .unwrap()
+            .into_iter()
+            .map(|t| t.trace_id)
+            .collect();
+        assert_eq!(ids.len(), 2);
+        assert!(ids.contains(&"t3".to_string()) && ids.contains(&"t5".to_string()));
+
+        // Fewer records than the limit: nothing to prune.
+        assert!(
+            backend
+                .prune_keep(Signal::Metrics, 10, &PruneFilter::default(), false, false)
+                .unwrap()
+                .is_empty()
+        );
+    }
+
+    #[test]
+    fn prunes_only_matching_records() {
+        let conn = setup_with_data();
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t3', 's3', NULL, 'health check', 1, '2024-12-02 00:00:00', '2024-12-02 00:00:01', 1000, 0, 'svc-a', '{\"http.route\": \"/healthz\"}', '2024-12-02')",
+            [],
+        ).unwrap();
+        let backend = crate::backend::DuckDbBackend::new(conn);
+        let everything = chrono::Utc::now().naive_utc();
+
+        let filter = PruneFilter {
+            service: Some("svc-a".into()),
+            name: Some("health*".into()),
+            ..Default::default()
+        };
+        let reports = backend.prune_matching(everything, &filter, false).unwrap();
+        // Logs have no name, so only traces and metrics are pruned.
+        assert_eq!(reports.len(), 2);
+        assert_eq!(reports[0].deleted, 1);
+        assert_eq!(reports[1].deleted, 0);
+
+        let filter = PruneFilter {
+            attrs: vec![AttrFilter::parse("http.route=/healthz").unwrap()],
+            ..Default::default()
+        };
+        let reports = backend.prune_matching(everything, &filter, true).unwrap();
+        assert_eq!(reports[0].deleted, 0);
+        assert_eq!(backend.query_traces(&Default::default()).unwrap().len(), 2);
+    }
+
     #[test]
     fn prune_with_service_filter() {
         let conn = setup_with_data();
         // Add data for a different service.
         conn.execute(
-            "INSERT INTO traces VALUES ('t3', 's3', NULL, 'other', 1, '2024-01-01 00:00:00', '2024-01-01 00:00:01', 1000000000, 0, 'svc-b', '{}', '2024-01-01')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t3', 's3', NULL, 'other', 1, '2024-01-01 00:00:00', '2024-01-01 00:00:01', 1000000000, 0, 'svc-b', '{}', '2024-01-01')",
             [],
         ).unwrap();
 
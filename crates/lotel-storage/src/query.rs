@@ -1,15 +1,225 @@
-use anyhow::{Context, Result};
+#[cfg(feature = "duckdb")]
+use anyhow::Context;
+use anyhow::{Result, bail};
 use chrono::NaiveDateTime;
+#[cfg(feature = "duckdb")]
 use duckdb::Connection;
 use serde::{Deserialize, Serialize};
 
 /// Common query parameters.
-#[derive(Debug, Default)]
+#[derive(Debug, Clone, Default)]
 pub struct QueryOptions {
     pub service: Option<String>,
     pub since: Option<NaiveDateTime>,
     pub until: Option<NaiveDateTime>,
     pub limit: Option<usize>,
+    /// Attribute filters, all of which must match.
+    pub attrs: Vec<AttrFilter>,
+    /// Only rows from this trace; hex or base64, normalized before matching. Used by
+    /// [`query_traces`] and [`query_logs`].
+    pub trace_id: Option<String>,
+    /// Only spans of this kind (see [`parse_span_kind`]). Used by [`query_traces`].
+    pub kind: Option<i32>,
+    /// Only spans with this status code (see [`parse_status_code`]). Used by [`query_traces`].
+    pub status_code: Option<i32>,
+    /// Filters on fields of structured (JSON) log bodies, keyed by dotted path such as
+    /// `user.id`. Only used by [`query_logs`].
+    pub body_fields: Vec<AttrFilter>,
+    /// Only logs at or above this severity number (see [`parse_severity`]). Used by
+    /// [`query_logs`].
+    pub min_severity: Option<i32>,
+    /// Only spans lasting at least this long. Used by [`query_traces`].
+    pub min_duration_ns: Option<i64>,
+    /// Only rows ingested within this range (see [`appended`]), whatever their timestamps.
+    pub appended: Option<Appended>,
+}
+
+/// The rows appended to a stored table between two polls, by DuckDB `rowid`.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Appended {
+    /// The stored table, qualified by catalog so archive views of the same name are skipped.
+    table: String,
+    after: i64,
+    through: i64,
+}
+
+impl Appended {
+    /// The last row in the range; pass it as `after` to get the rows appended since.
+    pub fn through(&self) -> i64 {
+        self.through
+    }
+}
+
+/// Comparison operator of an attribute filter.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AttrOp {
+    Eq,
+    Ne,
+    Gt,
+    Ge,
+    Lt,
+    Le,
+}
+
+impl AttrOp {
+    pub(crate) fn sql(self) -> &'static str {
+        match self {
+            AttrOp::Eq => "=",
+            AttrOp::Ne => "IS DISTINCT FROM",
+            AttrOp::Gt => ">",
+            AttrOp::Ge => ">=",
+            AttrOp::Lt => "<",
+            AttrOp::Le => "<=",
+        }
+    }
+}
+
+/// Attribute filter such as `http.method=GET` or `retries>3`.
+///
+/// Numeric values compare numerically (so `retries>3` matches `5` but not `"abc"`);
+/// anything else compares as a string.
+#[derive(Debug, Clone, PartialEq)]
+pub struct AttrFilter {
+    pub key: String,
+    pub op: AttrOp,
+    pub value: String,
+}
+
+impl AttrFilter {
+    pub fn parse(s: &str) -> Result<Self> {
+        let Some(idx) = s.find(['=', '!', '>', '<']) else {
+            bail!("invalid attribute filter {s:?} (expected key=value, key!=value, key>n, ...)");
+        };
+        let rest = &s[idx..];
+        let (op, len) = if rest.starts_with("!=") {
+            (AttrOp::Ne, 2)
+        } else if rest.starts_with(">=") {
+            (AttrOp::Ge, 2)
+        } else if rest.starts_with("<=") {
+            (AttrOp::Le, 2)
+        } else if rest.starts_with('=') {
+            (AttrOp::Eq, 1)
+        } else if rest.starts_with('>') {
+            (AttrOp::Gt, 1)
+        } else if rest.starts_with('<') {
+            (AttrOp::Lt, 1)
+        } else {
+            bail!("invalid attribute filter {s:?}: unknown operator");
+        };
+
+        let key = s[..idx].trim();
+        if key.is_empty() {
+            bail!("invalid attribute filter {s:?}: missing key");
+        }
+        let value = rest[len..].trim();
+        let numeric = value.parse::<f64>().is_ok();
+        if !matches!(op, AttrOp::Eq | AttrOp::Ne) && !numeric {
+            bail!(
+                "invalid attribute filter {s:?}: {} needs a numeric value",
+                &rest[..len]
+            );
+        }
+        Ok(Self {
+            key: key.to_string(),
+            op,
+            value: value.to_string(),
+        })
+    }
+
+    /// JSON path selecting this attribute; keys are quoted since they usually contain dots.
+    pub(crate) fn json_path(&self) -> String {
+        format!("$.{}", quote_path_segment(&self.key))
+    }
+
+    /// JSON path for a nested body field: `user.id` selects `{"user": {"id": ...}}`.
+    pub(crate) fn nested_json_path(&self) -> String {
+        let segments: Vec<String> = self.key.split('.').map(quote_path_segment).collect();
+        format!("$.{}", segments.join("."))
+    }
+}
+
+fn quote_path_segment(segment: &str) -> String {
+    format!("\"{}\"", segment.replace('"', "\\\""))
+}
+
+const SPAN_KINDS: [&str; 6] = [
+    "UNSPECIFIED",
+    "INTERNAL",
+    "SERVER",
+    "CLIENT",
+    "PRODUCER",
+    "CONSUMER",
+];
+const STATUS_CODES: [&str; 3] = ["UNSET", "OK", "ERROR"];
+
+/// Name of an OTLP span kind, e.g. `SERVER` for 2.
+pub fn span_kind_name(kind: i32) -> &'static str {
+    usize::try_from(kind)
+        .ok()
+        .and_then(|i| SPAN_KINDS.get(i))
+        .copied()
+        .unwrap_or("UNKNOWN")
+}
+
+/// Name of an OTLP status code, e.g. `ERROR` for 2.
+pub fn status_code_name(code: i32) -> &'static str {
+    usize::try_from(code)
+        .ok()
+        .and_then(|i| STATUS_CODES.get(i))
+        .copied()
+        .unwrap_or("UNKNOWN")
+}
+
+/// Parse a span kind given as a name (`server`, `SPAN_KIND_SERVER`) or its integer value.
+pub fn parse_span_kind(s: &str) -> Result<i32> {
+    match parse_enum(s, "SPAN_KIND_", &SPAN_KINDS) {
+        Some(kind) => Ok(kind),
+        None => bail!("invalid span kind {s:?} (expected e.g. server, client, internal)"),
+    }
+}
+
+/// Parse a status code given as a name (`error`, `STATUS_CODE_ERROR`) or its integer value.
+pub fn parse_status_code(s: &str) -> Result<i32> {
+    match parse_enum(s, "STATUS_CODE_", &STATUS_CODES) {
+        Some(code) => Ok(code),
+        None => bail!("invalid status {s:?} (expected unset, ok, or error)"),
+    }
+}
+
+/// Lowest severity number of each OTLP severity range, e.g. 17 for `ERROR`.
+const SEVERITIES: [(&str, i32); 6] = [
+    ("TRACE", 1),
+    ("DEBUG", 5),
+    ("INFO", 9),
+    ("WARN", 13),
+    ("ERROR", 17),
+    ("FATAL", 21),
+];
+
+/// Parse a log severity given as a name (`warn`, `SEVERITY_NUMBER_ERROR`) or a severity
+/// number from 1 to 24. Names map to the lowest number of their range.
+pub fn parse_severity(s: &str) -> Result<i32> {
+    let upper = s.trim().to_ascii_uppercase();
+    if let Ok(n) = upper.parse::<i32>()
+        && (1..=24).contains(&n)
+    {
+        return Ok(n);
+    }
+    let name = upper.strip_prefix("SEVERITY_NUMBER_").unwrap_or(&upper);
+    let name = if name == "WARNING" { "WARN" } else { name };
+    match SEVERITIES.iter().find(|(n, _)| *n == name) {
+        Some((_, number)) => Ok(*number),
+        None => bail!("invalid severity {s:?} (expected e.g. debug, info, warn, error, or 1-24)"),
+    }
+}
+
+fn parse_enum(s: &str, prefix: &str, names: &[&str]) -> Option<i32> {
+    let s = s.trim().to_ascii_uppercase();
+    if let Ok(n) = s.parse::<usize>() {
+        return (n < names.len()).then_some(n as i32);
+    }
+    let name = s.strip_prefix(prefix).unwrap_or(&s);
+    names.iter().position(|n| *n == name).map(|i| i as i32)
 }
 
 #[derive(Debug, Serialize, Deserialize)]
@@ -20,16 +230,32 @@ pub struct TraceResult {
     pub parent_span_id: Option<String>,
     pub name: String,
     pub kind: i32,
+    /// `kind` as a name, e.g. `SERVER`.
+    #[serde(default)]
+    pub kind_name: String,
     pub start_time: NaiveDateTime,
     pub end_time: Option<NaiveDateTime>,
     pub duration_ns: i64,
     pub status_code: i32,
+    /// `status_code` as a name, e.g. `ERROR`.
+    #[serde(default)]
+    pub status: String,
     pub service_name: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub attributes: Option<serde_json::Value>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub trace_state: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub flags: Option<u32>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dropped_attributes_count: Option<u32>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dropped_events_count: Option<u32>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub dropped_links_count: Option<u32>,
 }
 
-#[derive(Debug, Serialize, Deserialize)]
+#[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct MetricResult {
     pub metric_name: String,
     pub metric_type: String,
@@ -63,6 +289,27 @@ pub struct LogResult {
     pub attributes: Option<serde_json::Value>,
 }
 
+/// One record per trace, as returned by `query traces --roots`.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct TraceSummary {
+    pub trace_id: String,
+    /// Name of the root span; absent when the root was not captured.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub root_name: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub root_service: Option<String>,
+    pub start_time: NaiveDateTime,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub end_time: Option<NaiveDateTime>,
+    /// From the earliest span start to the latest span end.
+    pub duration_ns: i64,
+    pub span_count: i64,
+    pub has_error: bool,
+    /// Services with spans in the trace, sorted.
+    #[serde(default)]
+    pub services: Vec<String>,
+}
+
 #[derive(Debug, Serialize, Deserialize)]
 pub struct MetricAggregation {
     pub metric_name: String,
@@ -77,61 +324,342 @@ pub struct MetricAggregation {
     pub max: Option<f64>,
 }
 
-pub fn query_traces(conn: &Connection, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
-    let mut query = String::from(
-        "SELECT trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, CAST(attributes AS VARCHAR) FROM traces WHERE 1=1",
+/// A single-value metric aggregation for [`aggregate_metric_fn`].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum MetricFn {
+    /// The most recent point's value.
+    Last,
+    /// Sum over the window; for sums and histograms, the increase summed across series.
+    Sum,
+    /// Sample standard deviation of the point values.
+    Stddev,
+    /// Distinct values of an attribute key.
+    CountDistinct(String),
+}
+
+impl MetricFn {
+    pub fn name(&self) -> String {
+        match self {
+            Self::Last => "last".into(),
+            Self::Sum => "sum".into(),
+            Self::Stddev => "stddev".into(),
+            Self::CountDistinct(key) => format!("count_distinct({key})"),
+        }
+    }
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct MetricFnResult {
+    pub metric_name: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub service_name: Option<String>,
+    pub function: String,
+    /// Points in the window.
+    pub count: i64,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub value: Option<f64>,
+    /// Time of the point `last` took its value from.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub timestamp: Option<NaiveDateTime>,
+}
+
+/// The three telemetry tables.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Signal {
+    Traces,
+    Metrics,
+    Logs,
+}
+
+impl Signal {
+    pub fn table(self) -> &'static str {
+        match self {
+            Self::Traces => "traces",
+            Self::Metrics => "metrics",
+            Self::Logs => "logs",
+        }
+    }
+
+    /// Columns read by the typed query for this signal, in result-field order.
+    pub(crate) fn columns(self) -> &'static str {
+        match self {
+            Self::Traces => {
+                "trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, CAST(attributes AS VARCHAR), trace_state, flags, dropped_attributes_count, dropped_events_count, dropped_links_count"
+            }
+            Self::Metrics => {
+                "metric_name, metric_type, value, timestamp, service_name, aggregation_temporality, is_monotonic, unit, CAST(attributes AS VARCHAR)"
+            }
+            Self::Logs => {
+                "timestamp, severity, severity_number, body, service_name, trace_id, span_id, CAST(attributes AS VARCHAR)"
+            }
+        }
+    }
+
+    pub(crate) fn time_column(self) -> &'static str {
+        match self {
+            Self::Traces => "start_time",
+            Self::Metrics | Self::Logs => "timestamp",
+        }
+    }
+}
+
+/// The rows of `signal` appended after rowid `after` (every row when `None`) up to the last
+/// one now. DuckDB numbers rows in insertion order, so successive ranges follow ingest
+/// without gaps or repeats. `None` when the signal is not a stored table: Parquet views keep
+/// no ingest order.
+#[cfg(feature = "duckdb")]
+pub fn appended(conn: &Connection, signal: Signal, after: Option<i64>) -> Result<Option<Appended>> {
+    let catalog: String = conn.query_row("SELECT current_database()", [], |row| row.get(0))?;
+    let stored: bool = conn.query_row(
+        "SELECT COUNT(*) > 0 FROM information_schema.tables
+         WHERE table_catalog = ? AND table_schema = 'main' AND table_name = ?
+           AND table_type = 'BASE TABLE'",
+        duckdb::params![catalog, signal.table()],
+        |row| row.get(0),
+    )?;
+    if !stored {
+        return Ok(None);
+    }
+    let table = format!(
+        "\"{}\".main.{}",
+        catalog.replace('"', "\"\""),
+        signal.table()
     );
-    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let through: i64 = conn.query_row(
+        &format!("SELECT COALESCE(MAX(rowid), -1) FROM {table}"),
+        [],
+        |row| row.get(0),
+    )?;
+    // Checkpointing after a prune can renumber the remaining rows; pick up from the end.
+    let after = after.map_or(-1, |after| after.min(through));
+    Ok(Some(Appended {
+        table,
+        after,
+        through,
+    }))
+}
 
-    append_where(&mut query, &mut params, opts, "start_time");
+/// `FROM`, filters, ordering, and limit of a row query over `signal`, shared by the typed
+/// queries and `--fields` projections.
+#[cfg(feature = "duckdb")]
+pub(crate) fn from_clause(
+    signal: Signal,
+    opts: &QueryOptions,
+    params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
+) -> String {
+    let mut query = match &opts.appended {
+        Some(range) => format!(
+            " FROM {} WHERE rowid > {} AND rowid <= {}",
+            range.table, range.after, range.through
+        ),
+        None => format!(" FROM {} WHERE 1=1", signal.table()),
+    };
+    match signal {
+        Signal::Traces => append_span_filters(&mut query, params, opts),
+        Signal::Metrics => append_where(&mut query, params, opts, "timestamp"),
+        Signal::Logs => {
+            append_where(&mut query, params, opts, "timestamp");
+            append_trace_id(&mut query, params, opts);
+            if let Some(min) = opts.min_severity {
+                query.push_str(" AND severity_number >= ?");
+                params.push(Box::new(min));
+            }
+            // Plain-text bodies are not JSON; they simply never match a body field filter.
+            for filter in &opts.body_fields {
+                append_json_filter(
+                    &mut query,
+                    params,
+                    "CASE WHEN json_valid(body) THEN body END",
+                    filter.nested_json_path(),
+                    filter,
+                );
+            }
+        }
+    }
 
-    query.push_str(" ORDER BY start_time ASC");
+    query.push_str(&format!(" ORDER BY {} ASC", signal.time_column()));
     if let Some(limit) = opts.limit
         && limit > 0
     {
         query.push_str(&format!(" LIMIT {limit}"));
     }
+    query
+}
+
+#[cfg(feature = "duckdb")]
+pub fn query_traces(conn: &Connection, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+    let mut results = Vec::new();
+    for_each_trace(conn, opts, |span| {
+        results.push(span);
+        Ok(())
+    })?;
+    Ok(results)
+}
+
+/// Like [`query_traces`], but hands each span to `f` as it is scanned instead of collecting
+/// them, so huge result sets can be streamed out in constant memory.
+#[cfg(feature = "duckdb")]
+pub fn for_each_trace(
+    conn: &Connection,
+    opts: &QueryOptions,
+    mut f: impl FnMut(TraceResult) -> Result<()>,
+) -> Result<()> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let query = format!(
+        "SELECT {}{}",
+        Signal::Traces.columns(),
+        from_clause(Signal::Traces, opts, &mut params)
+    );
 
     let mut stmt = conn.prepare(&query)?;
     let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
     let rows = stmt
         .query_map(param_refs.as_slice(), |row| {
+            let kind: i32 = row.get(4)?;
+            let status_code: i32 = row.get(8)?;
             Ok(TraceResult {
                 trace_id: row.get(0)?,
                 span_id: row.get(1)?,
                 parent_span_id: row.get(2)?,
                 name: row.get(3)?,
-                kind: row.get(4)?,
+                kind,
+                kind_name: span_kind_name(kind).to_string(),
                 start_time: row.get(5)?,
                 end_time: row.get(6)?,
                 duration_ns: row.get(7)?,
-                status_code: row.get(8)?,
+                status_code,
+                status: status_code_name(status_code).to_string(),
                 service_name: row.get(9)?,
                 attributes: row
                     .get::<_, Option<String>>(10)?
                     .and_then(|s| serde_json::from_str(&s).ok()),
+                trace_state: row.get(11)?,
+                flags: row.get(12)?,
+                dropped_attributes_count: row.get(13)?,
+                dropped_events_count: row.get(14)?,
+                dropped_links_count: row.get(15)?,
             })
         })
         .context("querying traces")?;
 
-    rows.map(|r| r.map_err(Into::into)).collect()
+    for row in rows {
+        f(row?)?;
+    }
+    Ok(())
 }
 
-pub fn query_metrics(conn: &Connection, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
-    let mut query = String::from(
-        "SELECT metric_name, metric_type, value, timestamp, service_name, aggregation_temporality, is_monotonic, unit, CAST(attributes AS VARCHAR) FROM metrics WHERE 1=1",
-    );
+/// Summarize whole traces that contain at least one span matching `opts`.
+#[cfg(feature = "duckdb")]
+pub fn query_trace_roots(conn: &Connection, opts: &QueryOptions) -> Result<Vec<TraceSummary>> {
+    let mut results = Vec::new();
+    for_each_trace_root(conn, opts, |summary| {
+        results.push(summary);
+        Ok(())
+    })?;
+    Ok(results)
+}
+
+/// Streaming form of [`query_trace_roots`].
+#[cfg(feature = "duckdb")]
+pub fn for_each_trace_root(
+    conn: &Connection,
+    opts: &QueryOptions,
+    mut f: impl FnMut(TraceSummary) -> Result<()>,
+) -> Result<()> {
+    let mut matched = String::from("SELECT DISTINCT trace_id FROM traces WHERE 1=1");
     let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut matched, &mut params, opts);
 
-    append_where(&mut query, &mut params, opts, "timestamp");
+    let unfiltered = matched.ends_with("WHERE 1=1");
 
-    query.push_str(" ORDER BY timestamp ASC");
+    // Ingest keeps `trace_summaries` current; Parquet views have no such table, so their
+    // spans are grouped here instead.
+    let use_summaries = has_trace_summaries(conn)?;
+    let source = if use_summaries {
+        "trace_summaries".to_string()
+    } else {
+        format!(
+            "({})",
+            crate::summaries::summary_select("trace_id IN (SELECT trace_id FROM matched)")
+        )
+    };
+    let mut query = format!(
+        "WITH matched AS ({matched})
+        SELECT s.trace_id, s.root_name, s.root_service, s.start_time, s.end_time,
+               s.duration_ns, s.span_count, s.has_error, to_json(s.services)::VARCHAR
+        FROM {source} s"
+    );
+    // Without span filters every summarized trace matches, and no spans are read.
+    if !(use_summaries && unfiltered) {
+        query.push_str(" WHERE s.trace_id IN (SELECT trace_id FROM matched)");
+    }
+    query.push_str(" ORDER BY s.start_time ASC");
     if let Some(limit) = opts.limit
         && limit > 0
     {
         query.push_str(&format!(" LIMIT {limit}"));
     }
 
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(TraceSummary {
+                trace_id: row.get(0)?,
+                root_name: row.get(1)?,
+                root_service: row.get(2)?,
+                start_time: row.get(3)?,
+                end_time: row.get(4)?,
+                duration_ns: row.get(5)?,
+                span_count: row.get(6)?,
+                has_error: row.get(7)?,
+                services: row
+                    .get::<_, Option<String>>(8)?
+                    .and_then(|s| serde_json::from_str(&s).ok())
+                    .unwrap_or_default(),
+            })
+        })
+        .context("querying trace roots")?;
+
+    for row in rows {
+        f(row?)?;
+    }
+    Ok(())
+}
+
+#[cfg(feature = "duckdb")]
+fn has_trace_summaries(conn: &Connection) -> Result<bool> {
+    Ok(conn.query_row(
+        "SELECT COUNT(*) > 0 FROM information_schema.tables WHERE table_name = 'trace_summaries'",
+        [],
+        |row| row.get(0),
+    )?)
+}
+
+#[cfg(feature = "duckdb")]
+pub fn query_metrics(conn: &Connection, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+    let mut results = Vec::new();
+    for_each_metric(conn, opts, |point| {
+        results.push(point);
+        Ok(())
+    })?;
+    Ok(results)
+}
+
+/// Streaming form of [`query_metrics`].
+#[cfg(feature = "duckdb")]
+pub fn for_each_metric(
+    conn: &Connection,
+    opts: &QueryOptions,
+    mut f: impl FnMut(MetricResult) -> Result<()>,
+) -> Result<()> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let query = format!(
+        "SELECT {}{}",
+        Signal::Metrics.columns(),
+        from_clause(Signal::Metrics, opts, &mut params)
+    );
+
     let mut stmt = conn.prepare(&query)?;
     let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
     let rows = stmt
@@ -152,23 +680,35 @@ pub fn query_metrics(conn: &Connection, opts: &QueryOptions) -> Result<Vec<Metri
         })
         .context("querying metrics")?;
 
-    rows.map(|r| r.map_err(Into::into)).collect()
+    for row in rows {
+        f(row?)?;
+    }
+    Ok(())
 }
 
+#[cfg(feature = "duckdb")]
 pub fn query_logs(conn: &Connection, opts: &QueryOptions) -> Result<Vec<LogResult>> {
-    let mut query = String::from(
-        "SELECT timestamp, severity, severity_number, body, service_name, trace_id, span_id, CAST(attributes AS VARCHAR) FROM logs WHERE 1=1",
-    );
-    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
-
-    append_where(&mut query, &mut params, opts, "timestamp");
+    let mut results = Vec::new();
+    for_each_log(conn, opts, |log| {
+        results.push(log);
+        Ok(())
+    })?;
+    Ok(results)
+}
 
-    query.push_str(" ORDER BY timestamp ASC");
-    if let Some(limit) = opts.limit
-        && limit > 0
-    {
-        query.push_str(&format!(" LIMIT {limit}"));
-    }
+/// Streaming form of [`query_logs`].
+#[cfg(feature = "duckdb")]
+pub fn for_each_log(
+    conn: &Connection,
+    opts: &QueryOptions,
+    mut f: impl FnMut(LogResult) -> Result<()>,
+) -> Result<()> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let query = format!(
+        "SELECT {}{}",
+        Signal::Logs.columns(),
+        from_clause(Signal::Logs, opts, &mut params)
+    );
 
     let mut stmt = conn.prepare(&query)?;
     let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
@@ -189,9 +729,13 @@ pub fn query_logs(conn: &Connection, opts: &QueryOptions) -> Result<Vec<LogResul
         })
         .context("querying logs")?;
 
-    rows.map(|r| r.map_err(Into::into)).collect()
+    for row in rows {
+        f(row?)?;
+    }
+    Ok(())
 }
 
+#[cfg(feature = "duckdb")]
 pub fn aggregate_metrics(
     conn: &Connection,
     opts: &QueryOptions,
@@ -203,18 +747,7 @@ pub fn aggregate_metrics(
     let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
     params.push(Box::new(metric_name.to_string()));
 
-    if let Some(ref svc) = opts.service {
-        query.push_str(" AND service_name = ?");
-        params.push(Box::new(svc.clone()));
-    }
-    if let Some(since) = opts.since {
-        query.push_str(" AND timestamp >= ?");
-        params.push(Box::new(since));
-    }
-    if let Some(until) = opts.until {
-        query.push_str(" AND timestamp <= ?");
-        params.push(Box::new(until));
-    }
+    append_where(&mut query, &mut params, opts, "timestamp");
 
     let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
     conn.query_row(&query, param_refs.as_slice(), |row| {
@@ -230,7 +763,109 @@ pub fn aggregate_metrics(
     .context("aggregating metrics")
 }
 
-fn append_where(
+/// Resolve metric name patterns: names without `*` are kept as given, and globs such as
+/// `http_*` expand to the stored metric names (within `opts`) they match. Sorted, no
+/// duplicates.
+#[cfg(feature = "duckdb")]
+pub fn metric_names(
+    conn: &Connection,
+    opts: &QueryOptions,
+    patterns: &[String],
+) -> Result<Vec<String>> {
+    let mut names: Vec<String> = patterns
+        .iter()
+        .filter(|p| !p.contains('*'))
+        .cloned()
+        .collect();
+    let globs: Vec<&String> = patterns.iter().filter(|p| p.contains('*')).collect();
+    if !globs.is_empty() {
+        let mut query = String::from("SELECT DISTINCT metric_name FROM metrics WHERE 1=1");
+        let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+        append_where(&mut query, &mut params, opts, "timestamp");
+        let mut stmt = conn.prepare(&query)?;
+        let param_refs: Vec<&dyn duckdb::types::ToSql> =
+            params.iter().map(|p| p.as_ref()).collect();
+        let stored = stmt
+            .query_map(param_refs.as_slice(), |row| row.get::<_, String>(0))
+            .context("listing metric names")?;
+        for name in stored {
+            let name = name?;
+            if globs.iter().any(|g| crate::scrub::glob_match(g, &name)) {
+                names.push(name);
+            }
+        }
+    }
+    names.sort();
+    names.dedup();
+    Ok(names)
+}
+
+/// Service names starting with `prefix` across traces, metrics, and logs. Sorted, no
+/// duplicates.
+#[cfg(feature = "duckdb")]
+pub fn service_names(conn: &Connection, prefix: &str) -> Result<Vec<String>> {
+    let mut stmt = conn.prepare(
+        "SELECT service_name FROM traces WHERE starts_with(service_name, $1)
+         UNION SELECT service_name FROM metrics WHERE starts_with(service_name, $1)
+         UNION SELECT service_name FROM logs WHERE starts_with(service_name, $1)
+         ORDER BY 1",
+    )?;
+    let names = stmt
+        .query_map(duckdb::params![prefix], |row| row.get::<_, String>(0))
+        .context("listing service names")?
+        .collect::<std::result::Result<_, _>>()?;
+    Ok(names)
+}
+
+/// Aggregate `metric_name` over the points matching `opts` with one of the [`MetricFn`]s.
+#[cfg(feature = "duckdb")]
+pub fn aggregate_metric_fn(
+    conn: &Connection,
+    opts: &QueryOptions,
+    metric_name: &str,
+    func: &MetricFn,
+) -> Result<MetricFnResult> {
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    let value = match func {
+        MetricFn::Last => "arg_max(value, timestamp)",
+        MetricFn::Stddev => "stddev_samp(value)",
+        MetricFn::CountDistinct(key) => {
+            params.push(Box::new(format!("$.{}", quote_path_segment(key))));
+            "CAST(COUNT(DISTINCT json_extract_string(attributes, ?)) AS DOUBLE)"
+        }
+        // Cumulative points need per-series differencing; filled in below.
+        MetricFn::Sum => "NULL::DOUBLE",
+    };
+    let mut query =
+        format!("SELECT COUNT(*), {value}, MAX(timestamp) FROM metrics WHERE metric_name = ?");
+    params.push(Box::new(metric_name.to_string()));
+    append_where(&mut query, &mut params, opts, "timestamp");
+
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let mut result = conn
+        .query_row(&query, param_refs.as_slice(), |row| {
+            Ok(MetricFnResult {
+                metric_name: metric_name.to_string(),
+                service_name: opts.service.clone(),
+                function: func.name(),
+                count: row.get(0)?,
+                value: row.get(1)?,
+                timestamp: if *func == MetricFn::Last {
+                    row.get(2)?
+                } else {
+                    None
+                },
+            })
+        })
+        .with_context(|| format!("computing {} of {metric_name}", func.name()))?;
+    if *func == MetricFn::Sum && result.count > 0 {
+        result.value = Some(crate::series::window_sum(conn, opts, metric_name)?);
+    }
+    Ok(result)
+}
+
+#[cfg(feature = "duckdb")]
+pub(crate) fn append_where(
     query: &mut String,
     params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
     opts: &QueryOptions,
@@ -248,9 +883,72 @@ fn append_where(
         query.push_str(&format!(" AND {time_col} <= ?"));
         params.push(Box::new(until));
     }
+    for filter in &opts.attrs {
+        append_json_filter(query, params, "attributes", filter.json_path(), filter);
+    }
+}
+
+/// Common filters plus the span-only ones (trace ID, kind, status).
+#[cfg(feature = "duckdb")]
+pub(crate) fn append_span_filters(
+    query: &mut String,
+    params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
+    opts: &QueryOptions,
+) {
+    append_where(query, params, opts, "start_time");
+    append_trace_id(query, params, opts);
+    if let Some(kind) = opts.kind {
+        query.push_str(" AND kind = ?");
+        params.push(Box::new(kind));
+    }
+    if let Some(code) = opts.status_code {
+        query.push_str(" AND status_code = ?");
+        params.push(Box::new(code));
+    }
+    if let Some(min) = opts.min_duration_ns {
+        query.push_str(" AND duration_ns >= ?");
+        params.push(Box::new(min));
+    }
 }
 
-#[cfg(test)]
+#[cfg(feature = "duckdb")]
+fn append_trace_id(
+    query: &mut String,
+    params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
+    opts: &QueryOptions,
+) {
+    if let Some(ref trace_id) = opts.trace_id {
+        query.push_str(" AND trace_id = ?");
+        params.push(Box::new(crate::ids::normalize_id(trace_id)));
+    }
+}
+
+/// Append a condition comparing the value at `path` inside the JSON expression `json`.
+#[cfg(feature = "duckdb")]
+pub(crate) fn append_json_filter(
+    query: &mut String,
+    params: &mut Vec<Box<dyn duckdb::types::ToSql>>,
+    json: &str,
+    path: String,
+    filter: &AttrFilter,
+) {
+    let op = filter.op.sql();
+    params.push(Box::new(path));
+    match filter.value.parse::<f64>() {
+        Ok(n) => {
+            query.push_str(&format!(
+                " AND TRY_CAST(json_extract_string({json}, ?) AS DOUBLE) {op} ?"
+            ));
+            params.push(Box::new(n));
+        }
+        Err(_) => {
+            query.push_str(&format!(" AND json_extract_string({json}, ?) {op} ?"));
+            params.push(Box::new(filter.value.clone()));
+        }
+    }
+}
+
+#[cfg(all(test, feature = "duckdb"))]
 mod tests {
     use super::*;
     use crate::db;
@@ -258,11 +956,11 @@ mod tests {
     fn setup_with_data() -> Connection {
         let conn = db::open_in_memory().unwrap();
         conn.execute(
-            "INSERT INTO traces VALUES ('t1', 's1', NULL, 'span-1', 1, '2024-03-09 16:00:00', '2024-03-09 16:00:01', 1000000000, 0, 'svc-a', '{\"k\":\"v\"}', '2024-03-09')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', 's1', NULL, 'span-1', 1, '2024-03-09 16:00:00', '2024-03-09 16:00:01', 1000000000, 0, 'svc-a', '{\"k\":\"v\"}', '2024-03-09')",
             [],
         ).unwrap();
         conn.execute(
-            "INSERT INTO traces VALUES ('t2', 's2', 's1', 'span-2', 2, '2024-03-09 17:00:00', '2024-03-09 17:00:02', 2000000000, 0, 'svc-b', '{}', '2024-03-09')",
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t2', 's2', 's1', 'span-2', 2, '2024-03-09 17:00:00', '2024-03-09 17:00:02', 2000000000, 0, 'svc-b', '{}', '2024-03-09')",
             [],
         ).unwrap();
         conn.execute(
@@ -276,6 +974,26 @@ mod tests {
         conn
     }
 
+    #[test]
+    fn appended_follows_insert_order() {
+        let conn = setup_with_data();
+        let read = appended(&conn, Signal::Traces, None).unwrap().unwrap();
+        assert_eq!(read.through(), 1);
+
+        // A span that started long before the ones already read still follows them.
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, name, start_time, service_name, date) VALUES ('t3', 's3', 'span-3', '2024-03-09 15:00:00', 'svc-a', '2024-03-09')",
+            [],
+        ).unwrap();
+        let opts = QueryOptions {
+            appended: appended(&conn, Signal::Traces, Some(read.through())).unwrap(),
+            ..Default::default()
+        };
+        let results = query_traces(&conn, &opts).unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].name, "span-3");
+    }
+
     #[test]
     fn query_traces_all() {
         let conn = setup_with_data();
@@ -308,6 +1026,27 @@ mod tests {
         assert_eq!(results.len(), 1);
     }
 
+    #[test]
+    fn for_each_trace_streams_in_order_and_stops_on_error() {
+        let conn = setup_with_data();
+        let mut names = Vec::new();
+        for_each_trace(&conn, &QueryOptions::default(), |span| {
+            names.push(span.name);
+            Ok(())
+        })
+        .unwrap();
+        assert_eq!(names, ["span-1", "span-2"]);
+
+        let mut seen = 0;
+        let err = for_each_trace(&conn, &QueryOptions::default(), |_| {
+            seen += 1;
+            anyhow::bail!("stop")
+        })
+        .unwrap_err();
+        assert_eq!(err.to_string(), "stop");
+        assert_eq!(seen, 1);
+    }
+
     #[test]
     fn query_metrics_all() {
         let conn = setup_with_data();
@@ -325,6 +1064,194 @@ mod tests {
         assert_eq!(results[0].body.as_deref(), Some("hello"));
     }
 
+    #[test]
+    fn query_traces_min_duration() {
+        let conn = setup_with_data();
+        let opts = QueryOptions {
+            min_duration_ns: Some(1_500_000_000),
+            ..Default::default()
+        };
+        let results = query_traces(&conn, &opts).unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].name, "span-2");
+    }
+
+    #[test]
+    fn query_logs_min_severity() {
+        let conn = setup_with_data();
+        let opts = |min| QueryOptions {
+            min_severity: Some(min),
+            ..Default::default()
+        };
+        assert_eq!(query_logs(&conn, &opts(9)).unwrap().len(), 1);
+        assert!(query_logs(&conn, &opts(13)).unwrap().is_empty());
+    }
+
+    #[test]
+    fn parse_attr_filters() {
+        let f = AttrFilter::parse("retries>3").unwrap();
+        assert_eq!(
+            (f.key.as_str(), f.op, f.value.as_str()),
+            ("retries", AttrOp::Gt, "3")
+        );
+        let f = AttrFilter::parse("http.method!=GET").unwrap();
+        assert_eq!(f.op, AttrOp::Ne);
+        assert_eq!(AttrFilter::parse("x<=1.5").unwrap().op, AttrOp::Le);
+        assert!(AttrFilter::parse("retries").is_err());
+        assert!(AttrFilter::parse("=3").is_err());
+        assert!(AttrFilter::parse("method>GET").is_err());
+    }
+
+    #[test]
+    fn query_traces_with_attr_filters() {
+        let conn = setup_with_data();
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t3', 's3', NULL, 'retry', 1, '2024-03-09 18:00:00', '2024-03-09 18:00:01', 1000000000, 0, 'svc-a', '{\"retries\":5,\"http.method\":\"GET\"}', '2024-03-09')",
+            [],
+        ).unwrap();
+
+        let opts = QueryOptions {
+            attrs: vec![AttrFilter::parse("retries>3").unwrap()],
+            ..Default::default()
+        };
+        let results = query_traces(&conn, &opts).unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].name, "retry");
+
+        let opts = QueryOptions {
+            attrs: vec![AttrFilter::parse("retries>10").unwrap()],
+            ..Default::default()
+        };
+        assert!(query_traces(&conn, &opts).unwrap().is_empty());
+
+        let opts = QueryOptions {
+            attrs: vec![AttrFilter::parse("http.method=GET").unwrap()],
+            ..Default::default()
+        };
+        assert_eq!(query_traces(&conn, &opts).unwrap().len(), 1);
+
+        let opts = QueryOptions {
+            attrs: vec![AttrFilter::parse("k!=v").unwrap()],
+            ..Default::default()
+        };
+        assert_eq!(query_traces(&conn, &opts).unwrap().len(), 2);
+    }
+
+    #[test]
+    fn query_logs_with_body_fields() {
+        let conn = setup_with_data();
+        conn.execute(
+            "INSERT INTO logs VALUES ('2024-03-09 17:00:00', 'INFO', 9, '{\"user\":{\"id\":42,\"name\":\"ann\"}}', 'svc-a', NULL, NULL, '{}', '2024-03-09')",
+            [],
+        ).unwrap();
+
+        let opts = QueryOptions {
+            body_fields: vec![AttrFilter::parse("user.id=42").unwrap()],
+            ..Default::default()
+        };
+        let results = query_logs(&conn, &opts).unwrap();
+        assert_eq!(results.len(), 1);
+        assert!(results[0].body.as_deref().unwrap().contains("ann"));
+
+        let opts = QueryOptions {
+            body_fields: vec![AttrFilter::parse("user.name=bob").unwrap()],
+            ..Default::default()
+        };
+        assert!(query_logs(&conn, &opts).unwrap().is_empty());
+    }
+
+    #[test]
+    fn query_by_trace_id_accepts_any_encoding() {
+        let conn = setup_with_data();
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('5b8efff798038103d269b633813fc60c', 's9', NULL, 'lookup', 1, '2024-03-09 18:00:00', '2024-03-09 18:00:01', 1000000000, 0, 'svc-a', '{}', '2024-03-09')",
+            [],
+        ).unwrap();
+
+        for id in [
+            "5B8EFFF798038103D269B633813FC60C",
+            "W47/95gDgQPSabYzgT/GDA==",
+        ] {
+            let opts = QueryOptions {
+                trace_id: Some(id.to_string()),
+                ..Default::default()
+            };
+            let results = query_traces(&conn, &opts).unwrap();
+            assert_eq!(results.len(), 1, "{id}");
+            assert_eq!(results[0].name, "lookup");
+        }
+    }
+
+    #[test]
+    fn kind_and_status_names() {
+        assert_eq!(parse_span_kind("server").unwrap(), 2);
+        assert_eq!(parse_span_kind("SPAN_KIND_CLIENT").unwrap(), 3);
+        assert_eq!(parse_span_kind("5").unwrap(), 5);
+        assert!(parse_span_kind("backend").is_err());
+        assert_eq!(parse_status_code("Error").unwrap(), 2);
+        assert_eq!(parse_status_code("STATUS_CODE_OK").unwrap(), 1);
+        assert!(parse_status_code("3").is_err());
+        assert_eq!(span_kind_name(2), "SERVER");
+        assert_eq!(status_code_name(0), "UNSET");
+        assert_eq!(span_kind_name(9), "UNKNOWN");
+    }
+
+    #[test]
+    fn severity_names() {
+        assert_eq!(parse_severity("warn").unwrap(), 13);
+        assert_eq!(parse_severity("Warning").unwrap(), 13);
+        assert_eq!(parse_severity("SEVERITY_NUMBER_ERROR").unwrap(), 17);
+        assert_eq!(parse_severity("10").unwrap(), 10);
+        assert!(parse_severity("25").is_err());
+        assert!(parse_severity("loud").is_err());
+    }
+
+    #[test]
+    fn query_traces_by_kind() {
+        let conn = setup_with_data();
+        let opts = QueryOptions {
+            kind: Some(parse_span_kind("server").unwrap()),
+            ..Default::default()
+        };
+        let results = query_traces(&conn, &opts).unwrap();
+        assert_eq!(results.len(), 1);
+        assert_eq!(results[0].name, "span-2");
+        assert_eq!(results[0].kind_name, "SERVER");
+        assert_eq!(results[0].status, "UNSET");
+    }
+
+    #[test]
+    fn query_trace_roots_groups_spans() {
+        let conn = setup_with_data();
+        conn.execute(
+            "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES ('t1', 's1b', 's1', 'child', 3, '2024-03-09 16:00:00.5', '2024-03-09 16:00:03', 2500000000, 2, 'svc-b', '{}', '2024-03-09')",
+            [],
+        ).unwrap();
+
+        // Rows inserted with plain SQL bypass ingest's summary upkeep.
+        crate::summaries::rebuild_trace_summaries(&conn).unwrap();
+
+        // Filtering on the child's service still returns the whole trace.
+        let opts = QueryOptions {
+            service: Some("svc-b".to_string()),
+            ..Default::default()
+        };
+        let roots = query_trace_roots(&conn, &opts).unwrap();
+        assert_eq!(roots.len(), 2);
+        let t1 = roots.iter().find(|r| r.trace_id == "t1").unwrap();
+        assert_eq!(t1.root_name.as_deref(), Some("span-1"));
+        assert_eq!(t1.root_service.as_deref(), Some("svc-a"));
+        assert_eq!(t1.span_count, 2);
+        assert_eq!(t1.duration_ns, 3_000_000_000);
+        assert!(t1.has_error);
+        assert_eq!(t1.services, vec!["svc-a", "svc-b"]);
+
+        // t2's only span has a parent that was never captured.
+        let t2 = roots.iter().find(|r| r.trace_id == "t2").unwrap();
+        assert_eq!(t2.root_name, None);
+        assert!(!t2.has_error);
+    }
+
     #[test]
     fn aggregate_metrics_basic() {
         let conn = setup_with_data();
@@ -332,4 +1259,85 @@ mod tests {
         assert_eq!(agg.count, 1);
         assert!((agg.avg.unwrap() - 42.0).abs() < f64::EPSILON);
     }
+
+    #[test]
+    fn metric_names_expand_globs() {
+        let conn = setup_with_data();
+        let names = |patterns: &[&str]| {
+            let patterns: Vec<String> = patterns.iter().map(|p| p.to_string()).collect();
+            metric_names(&conn, &QueryOptions::default(), &patterns).unwrap()
+        };
+        assert_eq!(names(&["http.*"]), ["http.requests"]);
+        assert_eq!(
+            names(&["http.*", "http.requests", "db.calls"]),
+            ["db.calls", "http.requests"]
+        );
+        assert!(names(&["rpc.*"]).is_empty());
+    }
+
+    #[test]
+    fn service_names_by_prefix() {
+        let conn = setup_with_data();
+        assert_eq!(service_names(&conn, "").unwrap(), ["svc-a", "svc-b"]);
+        assert_eq!(service_names(&conn, "svc-b").unwrap(), ["svc-b"]);
+        assert!(service_names(&conn, "api").unwrap().is_empty());
+    }
+
+    #[test]
+    fn aggregate_metric_functions() {
+        let conn = db::open_in_memory().unwrap();
+        let points = [
+            (
+                "temp",
+                "gauge",
+                20.0,
+                "2024-03-09 16:00:00",
+                None,
+                r#"{"room":"a"}"#,
+            ),
+            (
+                "temp",
+                "gauge",
+                24.0,
+                "2024-03-09 16:01:00",
+                None,
+                r#"{"room":"b"}"#,
+            ),
+            (
+                "temp",
+                "gauge",
+                22.0,
+                "2024-03-09 16:00:30",
+                None,
+                r#"{"room":"a"}"#,
+            ),
+            ("hits", "sum", 10.0, "2024-03-09 16:00:00", Some(2), "{}"),
+            ("hits", "sum", 25.0, "2024-03-09 16:01:00", Some(2), "{}"),
+            ("hits", "sum", 5.0, "2024-03-09 16:02:00", Some(2), "{}"),
+        ];
+        for (name, ty, value, ts, temporality, attrs) in points {
+            conn.execute(
+                "INSERT INTO metrics VALUES (?, ?, ?, ?, 'api', ?, true, '1', ?, '2024-03-09')",
+                duckdb::params![name, ty, value, ts, temporality, attrs],
+            )
+            .unwrap();
+        }
+        let opts = QueryOptions::default();
+        let run =
+            |name: &str, func: MetricFn| aggregate_metric_fn(&conn, &opts, name, &func).unwrap();
+
+        let last = run("temp", MetricFn::Last);
+        assert_eq!(last.value, Some(24.0));
+        assert_eq!(last.timestamp.unwrap().to_string(), "2024-03-09 16:01:00");
+        assert_eq!(run("temp", MetricFn::Sum).value, Some(66.0));
+        assert!((run("temp", MetricFn::Stddev).value.unwrap() - 2.0).abs() < 1e-9);
+        let distinct = run("temp", MetricFn::CountDistinct("room".into()));
+        assert_eq!(
+            (distinct.function.as_str(), distinct.value),
+            ("count_distinct(room)", Some(2.0))
+        );
+        // Cumulative: 15 gained, then a reset to 5.
+        assert_eq!(run("hits", MetricFn::Sum).value, Some(20.0));
+        assert_eq!(run("missing", MetricFn::Sum).value, None);
+    }
 }
@@ -0,0 +1,241 @@
+//! Span ingest fast path: DuckDB reads the OTLP JSONL itself (`read_ndjson_objects`) and
+//! unnests it in SQL, so large trace files skip JSON parsing in Rust.
+//!
+//! The SQL covers camelCase OTLP JSON with scalar attribute values, which is what the
+//! collector writes. Other lines (snake_case keys, array or kvlist values) go through the
+//! regular parser, so the stored rows are the same either way.
+
+use std::fs::File;
+use std::io::{BufRead, BufReader, BufWriter, Seek, SeekFrom, Write};
+use std::path::Path;
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+
+use crate::db::sql_path;
+
+/// Scratch table holding one file's spans between the SQL parse and the append.
+const SCRATCH_TABLE: &str = "read_json_spans";
+
+/// Helpers mirroring `ingest.rs`: `normalize_id`, `OtlpValue::as_string` (service names),
+/// `OtlpValue::to_json`, and `flatten_attrs`.
+const MACROS: &str = r#"
+CREATE OR REPLACE TEMP MACRO lotel_id(raw) AS
+    CASE WHEN regexp_full_match(trim(raw), '([0-9a-fA-F]{2})*') THEN lower(trim(raw))
+         ELSE COALESCE(
+             NULLIF(TRY(lower(hex(from_base64(
+                 replace(replace(trim(raw), '-', '+'), '_', '/'))))), ''),
+             trim(raw))
+    END;
+CREATE OR REPLACE TEMP MACRO lotel_as_string(v) AS
+    COALESCE(v->>'stringValue', v->>'intValue', v->>'boolValue', v->>'doubleValue',
+             v->>'bytesValue', '');
+CREATE OR REPLACE TEMP MACRO lotel_service(attrs) AS
+    COALESCE(
+        lotel_as_string((list_filter(json_extract(attrs, '$[*]'),
+            a -> a->>'key' = 'service.name' AND a->'value' IS NOT NULL)[1])->'value'),
+        'unknown');
+CREATE OR REPLACE TEMP MACRO lotel_value(v) AS
+    CASE WHEN v->>'stringValue' IS NOT NULL THEN to_json(v->>'stringValue')::VARCHAR
+         WHEN json_type(v->'intValue') = 'VARCHAR' THEN
+             COALESCE(TRY_CAST(v->>'intValue' AS BIGINT)::VARCHAR,
+                      to_json(v->>'intValue')::VARCHAR)
+         WHEN v->>'intValue' IS NOT NULL THEN (v->'intValue')::VARCHAR
+         WHEN v->>'boolValue' IS NOT NULL THEN v->>'boolValue'
+         WHEN v->>'doubleValue' IS NOT NULL THEN to_json((v->>'doubleValue')::DOUBLE)::VARCHAR
+         WHEN v->>'bytesValue' IS NOT NULL THEN to_json(v->>'bytesValue')::VARCHAR
+         ELSE '""'
+    END;
+CREATE OR REPLACE TEMP MACRO lotel_attrs(attrs) AS
+    '{' || COALESCE(list_aggregate(list_transform(json_extract(attrs, '$[*]'),
+        a -> to_json(a->>'key')::VARCHAR || ':' || lotel_value(a->'value')),
+        'string_agg', ','), '') || '}';
+"#;
+
+/// Lines of `file_path` after `offset`: those the SQL handles are copied to `scratch`, the
+/// rest returned for the regular parser. Also returns the offset after the last line.
+pub(crate) fn split_lines(
+    file_path: &Path,
+    offset: u64,
+    scratch: &Path,
+) -> Result<(Vec<String>, u64)> {
+    let mut file = File::open(file_path)?;
+    file.seek(SeekFrom::Start(offset))?;
+    let mut reader = BufReader::with_capacity(1024 * 1024, file);
+    let mut out = BufWriter::new(
+        File::create(scratch).with_context(|| format!("creating {}", scratch.display()))?,
+    );
+
+    let mut fallback = Vec::new();
+    let mut new_offset = offset;
+    let mut line = String::new();
+    loop {
+        line.clear();
+        let bytes_read = reader.read_line(&mut line)?;
+        if bytes_read == 0 {
+            break;
+        }
+        new_offset += bytes_read as u64;
+        let trimmed = line.trim();
+        if trimmed.is_empty() {
+            continue;
+        }
+        if handled_in_sql(trimmed) {
+            out.write_all(trimmed.as_bytes())?;
+            out.write_all(b"\n")?;
+        } else {
+            fallback.push(trimmed.to_string());
+        }
+    }
+    out.flush()?;
+    Ok((fallback, new_offset))
+}
+
+fn handled_in_sql(line: &str) -> bool {
+    line.starts_with(r#"{"resourceSpans""#)
+        && !line.contains(r#""arrayValue""#)
+        && !line.contains(r#""kvlistValue""#)
+}
+
+/// Parse the spans in `scratch` and append them to `traces`, with their trace summaries,
+/// inside the connection's open transaction. Returns the spans written.
+pub(crate) fn append_spans(conn: &Connection, scratch: &Path) -> Result<usize> {
+    let path = sql_path(scratch)?;
+    conn.execute_batch(MACROS)
+        .context("creating read_json macros")?;
+    conn.execute_batch(&format!(
+        "CREATE OR REPLACE TEMP TABLE {SCRATCH_TABLE} AS
+         WITH resources AS (
+             SELECT unnest(json_extract(json, '$.resourceSpans[*]')) AS rs
+             FROM read_ndjson_objects({path}, ignore_errors = true,
+                                      maximum_object_size = 1073741824)
+         ),
+         scopes AS (
+             SELECT lotel_service(rs->'resource'->'attributes') AS service_name,
+                    unnest(json_extract(rs, '$.scopeSpans[*]')) AS ss
+             FROM resources
+         ),
+         spans AS (
+             SELECT service_name, unnest(json_extract(ss, '$.spans[*]')) AS s FROM scopes
+         ),
+         timed AS (
+             SELECT service_name, s,
+                    NULLIF(TRY_CAST(s->>'startTimeUnixNano' AS BIGINT), 0) AS start_ns,
+                    NULLIF(TRY_CAST(s->>'endTimeUnixNano' AS BIGINT), 0) AS end_ns
+             FROM spans
+         )
+         SELECT COALESCE(lotel_id(s->>'traceId'), '') AS trace_id,
+                COALESCE(lotel_id(s->>'spanId'), '') AS span_id,
+                NULLIF(lotel_id(s->>'parentSpanId'), '') AS parent_span_id,
+                COALESCE(s->>'name', '') AS name,
+                COALESCE(TRY_CAST(s->>'kind' AS INTEGER), 0) AS kind,
+                make_timestamp(start_ns // 1000) AS start_time,
+                make_timestamp(end_ns // 1000) AS end_time,
+                COALESCE(end_ns - start_ns, 0) AS duration_ns,
+                COALESCE(TRY_CAST(s->'status'->>'code' AS INTEGER), 0) AS status_code,
+                service_name,
+                lotel_attrs(s->'attributes') AS attributes,
+                make_timestamp(start_ns // 1000)::DATE AS date,
+                NULLIF(s->>'traceState', '') AS trace_state,
+                NULLIF(TRY_CAST(s->>'flags' AS UINTEGER), 0) AS flags,
+                NULLIF(TRY_CAST(s->>'droppedAttributesCount' AS UINTEGER), 0)
+                    AS dropped_attributes_count,
+                NULLIF(TRY_CAST(s->>'droppedEventsCount' AS UINTEGER), 0)
+                    AS dropped_events_count,
+                NULLIF(TRY_CAST(s->>'droppedLinksCount' AS UINTEGER), 0)
+                    AS dropped_links_count
+         FROM timed",
+    ))
+    .context("parsing spans with read_json")?;
+
+    let written: i64 = conn.query_row(
+        &format!("SELECT COUNT(*) FROM {SCRATCH_TABLE}"),
+        [],
+        |row| row.get(0),
+    )?;
+    if written > 0 {
+        // Clustered like `append_rows` clusters each batch.
+        conn.execute_batch(&format!(
+            "INSERT INTO traces BY NAME
+             SELECT * FROM {SCRATCH_TABLE} ORDER BY service_name, start_time"
+        ))
+        .context("appending spans")?;
+        crate::summaries::upsert_from(conn, SCRATCH_TABLE)?;
+    }
+    conn.execute_batch(&format!("DROP TABLE {SCRATCH_TABLE}"))?;
+    Ok(written as usize)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+    use crate::ingest::{append_rows, parse_trace_line};
+    use crate::scrub::Scrubber;
+
+    const COLUMNS: &str = "trace_id, span_id, parent_span_id, name, kind, start_time, end_time,
+        duration_ns, status_code, service_name, attributes::VARCHAR, date, trace_state, flags,
+        dropped_attributes_count";
+
+    fn rows(conn: &Connection) -> Vec<String> {
+        conn.prepare(&format!(
+            "SELECT CAST(ROW({COLUMNS}) AS VARCHAR) FROM traces ORDER BY span_id"
+        ))
+        .unwrap()
+        .query_map([], |row| row.get(0))
+        .unwrap()
+        .map(|r| r.unwrap())
+        .collect()
+    }
+
+    #[test]
+    fn matches_the_rust_parser() {
+        let lines = [
+            r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},"scopeSpans":[{"spans":[{"traceId":"4BF92F3577B34DA6A3CE929D0E0E4736","spanId":"00f067aa0ba902b7","name":"GET /","kind":2,"startTimeUnixNano":"1710000000123456789","endTimeUnixNano":"1710000001000000000","status":{"code":2},"attributes":[{"key":"http.status_code","value":{"intValue":"500"}},{"key":"ok","value":{"boolValue":false}},{"key":"ratio","value":{"doubleValue":0.25}},{"key":"route","value":{"stringValue":"/cart \"x\""}}],"traceState":"k=v","flags":1,"droppedAttributesCount":3}]}]}]}"#,
+            r#"{"resourceSpans":[{"scopeSpans":[{"spans":[{"traceId":"W47/95gDgQPSabYzgT/GDA==","spanId":"7uGbfsPBsXQ=","parentSpanId":"","name":"child","startTimeUnixNano":1710000000500000000}]}]}]}"#,
+            r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"cart"}}]},"scopeSpans":[{"spans":[{"traceId":"aa","spanId":"bb","name":"nested","attributes":[{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"}]}}}]}]}]}]}"#,
+            "not json",
+        ];
+
+        let expected = db::open_in_memory().unwrap();
+        let parsed: Vec<_> = lines
+            .iter()
+            .map(|l| parse_trace_line(l, &Scrubber::default()).unwrap())
+            .collect();
+        append_rows(&expected, &parsed).unwrap();
+
+        let tmp = tempfile::TempDir::new().unwrap();
+        let file = tmp.path().join("traces.jsonl");
+        std::fs::write(&file, lines.join("\n")).unwrap();
+        let scratch = tmp.path().join("scratch.jsonl");
+        let (fallback, offset) = split_lines(&file, 0, &scratch).unwrap();
+        assert_eq!(
+            fallback.len(),
+            2,
+            "nested values and invalid lines use the parser"
+        );
+        assert_eq!(offset, std::fs::metadata(&file).unwrap().len());
+
+        let conn = db::open_in_memory().unwrap();
+        assert_eq!(append_spans(&conn, &scratch).unwrap(), 2);
+        let parsed: Vec<_> = fallback
+            .iter()
+            .map(|l| parse_trace_line(l, &Scrubber::default()).unwrap())
+            .collect();
+        append_rows(&conn, &parsed).unwrap();
+
+        assert_eq!(rows(&conn), rows(&expected));
+        let summaries = |conn: &Connection| -> Vec<String> {
+            conn.prepare(
+                "SELECT CAST(ROW(trace_id, root_name, services, span_count, has_error) AS VARCHAR)
+                 FROM trace_summaries ORDER BY trace_id",
+            )
+            .unwrap()
+            .query_map([], |row| row.get(0))
+            .unwrap()
+            .map(|r| r.unwrap())
+            .collect()
+        };
+        assert_eq!(summaries(&conn), summaries(&expected));
+    }
+}
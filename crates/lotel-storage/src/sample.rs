@@ -0,0 +1,98 @@
+//! Ingest-time sampling for high-volume local load tests.
+//!
+//! Decisions are made per trace ID so a trace is kept or dropped as a whole, and error
+//! spans and ERROR-or-worse logs are always kept. Metrics are never sampled, since dropping
+//! data points would skew aggregates.
+
+use anyhow::{Result, bail};
+
+/// OTLP status code for errored spans.
+pub(crate) const STATUS_ERROR: i32 = 2;
+/// OTLP severity number where ERROR begins.
+pub(crate) const SEVERITY_ERROR: i32 = 17;
+
+/// Keeps a deterministic fraction of traces and logs.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Sampler {
+    rate: f64,
+}
+
+impl Default for Sampler {
+    fn default() -> Self {
+        Self { rate: 1.0 }
+    }
+}
+
+impl Sampler {
+    /// Parse a rate such as `10%` or `0.1`.
+    pub fn parse(s: &str) -> Result<Self> {
+        let s = s.trim();
+        let rate = match s.strip_suffix('%') {
+            Some(pct) => pct.trim().parse::<f64>().map(|p| p / 100.0),
+            None => s.parse::<f64>(),
+        };
+        match rate {
+            Ok(r) if r > 0.0 && r <= 1.0 => Ok(Self { rate: r }),
+            _ => bail!("invalid sample rate {s:?} (expected e.g. \"10%\" or \"0.1\")"),
+        }
+    }
+
+    pub fn rate(&self) -> f64 {
+        self.rate
+    }
+
+    pub fn is_noop(&self) -> bool {
+        self.rate >= 1.0
+    }
+
+    /// Whether rows keyed by `key` (normally a trace ID) fall inside the sample.
+    pub(crate) fn keeps(&self, key: &str) -> bool {
+        if self.is_noop() {
+            return true;
+        }
+        let bucket = fnv1a(key.as_bytes()) % 10_000;
+        (bucket as f64) < self.rate * 10_000.0
+    }
+}
+
+fn fnv1a(bytes: &[u8]) -> u64 {
+    let mut hash: u64 = 0xcbf2_9ce4_8422_2325;
+    for b in bytes {
+        hash ^= u64::from(*b);
+        hash = hash.wrapping_mul(0x0000_0100_0000_01b3);
+    }
+    hash
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parse_percent_and_fraction() {
+        assert_eq!(Sampler::parse("10%").unwrap().rate(), 0.1);
+        assert_eq!(Sampler::parse("0.25").unwrap().rate(), 0.25);
+        assert!(Sampler::parse("100%").unwrap().is_noop());
+        assert!(Sampler::parse("0%").is_err());
+        assert!(Sampler::parse("150%").is_err());
+        assert!(Sampler::parse("abc").is_err());
+    }
+
+    #[test]
+    fn keeps_roughly_the_requested_fraction() {
+        let sampler = Sampler::parse("10%").unwrap();
+        let kept = (0..10_000)
+            .filter(|i| sampler.keeps(&format!("trace-{i}")))
+            .count();
+        assert!((800..1200).contains(&kept), "kept {kept} of 10000");
+    }
+
+    #[test]
+    fn decisions_are_deterministic() {
+        let sampler = Sampler::parse("50%").unwrap();
+        for i in 0..100 {
+            let key = format!("{i:032x}");
+            assert_eq!(sampler.keeps(&key), sampler.keeps(&key));
+        }
+    }
+}
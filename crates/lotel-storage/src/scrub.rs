@@ -0,0 +1,232 @@
+//! Attribute scrubbing and PII redaction applied while ingesting, so sensitive values
+//! never reach the local database.
+
+use anyhow::{Context, Result};
+use regex::Regex;
+use serde::Deserialize;
+use serde_json::Value;
+use sha2::{Digest, Sha256};
+
+const REDACTED: &str = "[REDACTED]";
+
+/// Scrub rules as written in the `ingestion.scrub` config section.
+///
+/// Key patterns match attribute keys exactly, or as globs where `*` matches any run of
+/// characters (e.g. `http.request.header.*`).
+#[derive(Debug, Clone, Default, Deserialize, PartialEq)]
+pub struct ScrubConfig {
+    /// Allowlist: when non-empty, only attribute keys matching one of these are stored.
+    #[serde(default)]
+    pub keep_keys: Vec<String>,
+    /// Denylist: attribute keys removed entirely.
+    #[serde(default)]
+    pub drop_keys: Vec<String>,
+    /// Attribute keys whose values are replaced with a stable SHA-256 digest.
+    #[serde(default)]
+    pub hash_keys: Vec<String>,
+    /// Regexes whose matches are replaced with `[REDACTED]` in log bodies and string
+    /// attribute values.
+    #[serde(default)]
+    pub redact_patterns: Vec<String>,
+}
+
+/// Compiled scrub rules. The default scrubber leaves data untouched.
+#[derive(Debug, Clone, Default)]
+pub struct Scrubber {
+    keep_keys: Vec<String>,
+    drop_keys: Vec<String>,
+    hash_keys: Vec<String>,
+    patterns: Vec<Regex>,
+}
+
+impl Scrubber {
+    pub fn new(config: &ScrubConfig) -> Result<Self> {
+        let patterns = config
+            .redact_patterns
+            .iter()
+            .map(|p| Regex::new(p).with_context(|| format!("invalid redact pattern {p:?}")))
+            .collect::<Result<_>>()?;
+        Ok(Self {
+            keep_keys: config.keep_keys.clone(),
+            drop_keys: config.drop_keys.clone(),
+            hash_keys: config.hash_keys.clone(),
+            patterns,
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.keep_keys.is_empty()
+            && self.drop_keys.is_empty()
+            && self.hash_keys.is_empty()
+            && self.patterns.is_empty()
+    }
+
+    /// Apply keep/drop/hash/redact rules to a flattened attribute object in place.
+    pub fn scrub_attrs(&self, attrs: &mut Value) {
+        if self.is_empty() {
+            return;
+        }
+        let Value::Object(map) = attrs else {
+            return;
+        };
+        map.retain(|key, _| self.keeps(key));
+        for (key, value) in map.iter_mut() {
+            if self.hash_keys.iter().any(|p| glob_match(p, key)) {
+                *value = Value::String(hash_value(value));
+            } else {
+                self.redact_value(value);
+            }
+        }
+    }
+
+    /// Redact every string inside a (possibly nested) JSON value in place.
+    pub fn redact_value(&self, value: &mut Value) {
+        match value {
+            Value::String(s) => *s = self.redact(s),
+            Value::Array(items) => items.iter_mut().for_each(|v| self.redact_value(v)),
+            Value::Object(map) => map.values_mut().for_each(|v| self.redact_value(v)),
+            _ => {}
+        }
+    }
+
+    /// Whether an attribute key passes the allowlist and denylist.
+    fn keeps(&self, key: &str) -> bool {
+        (self.keep_keys.is_empty() || self.keep_keys.iter().any(|p| glob_match(p, key)))
+            && !self.drop_keys.iter().any(|p| glob_match(p, key))
+    }
+
+    /// Replace every redact-pattern match in `text`.
+    pub fn redact(&self, text: &str) -> String {
+        let mut out = text.to_string();
+        for re in &self.patterns {
+            if re.is_match(&out) {
+                out = re.replace_all(&out, REDACTED).into_owned();
+            }
+        }
+        out
+    }
+}
+
+fn hash_value(value: &Value) -> String {
+    let raw = match value {
+        Value::String(s) => s.clone(),
+        other => other.to_string(),
+    };
+    let digest = Sha256::digest(raw.as_bytes());
+    format!("sha256:{}", &hex::encode(digest)[..16])
+}
+
+/// Match `key` against a pattern where `*` matches any (possibly empty) substring.
+pub(crate) fn glob_match(pattern: &str, key: &str) -> bool {
+    if !pattern.contains('*') {
+        return pattern == key;
+    }
+    let mut parts = pattern.split('*');
+    let first = parts.next().unwrap_or_default();
+    let Some(mut rest) = key.strip_prefix(first) else {
+        return false;
+    };
+    let mut parts: Vec<&str> = parts.collect();
+    let last = parts.pop().unwrap_or_default();
+    for part in parts {
+        match rest.find(part) {
+            Some(idx) => rest = &rest[idx + part.len()..],
+            None => return false,
+        }
+    }
+    rest.len() >= last.len() && rest.ends_with(last)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn scrubber() -> Scrubber {
+        Scrubber::new(&ScrubConfig {
+            drop_keys: vec!["http.request.header.authorization".into()],
+            hash_keys: vec!["user.*".into()],
+            redact_patterns: vec![r"[\w.+-]+@[\w-]+\.[\w.]+".into()],
+            ..Default::default()
+        })
+        .unwrap()
+    }
+
+    #[test]
+    fn drops_hashes_and_redacts_attrs() {
+        let mut attrs = json!({
+            "http.request.header.authorization": "Bearer secret",
+            "user.id": "42",
+            "note": "contact bob@example.com",
+            "http.method": "GET",
+        });
+        scrubber().scrub_attrs(&mut attrs);
+
+        let map = attrs.as_object().unwrap();
+        assert!(!map.contains_key("http.request.header.authorization"));
+        assert!(map["user.id"].as_str().unwrap().starts_with("sha256:"));
+        assert_eq!(map["note"], "contact [REDACTED]");
+        assert_eq!(map["http.method"], "GET");
+    }
+
+    #[test]
+    fn redacts_nested_values() {
+        let mut value = json!({"user": {"email": "bob@example.com", "tags": ["x", "a@b.io"]}});
+        scrubber().redact_value(&mut value);
+        assert_eq!(
+            value,
+            json!({"user": {"email": "[REDACTED]", "tags": ["x", "[REDACTED]"]}})
+        );
+    }
+
+    #[test]
+    fn hashing_is_stable() {
+        let mut a = json!({"user.email": "a@b.c"});
+        let mut b = json!({"user.email": "a@b.c"});
+        scrubber().scrub_attrs(&mut a);
+        scrubber().scrub_attrs(&mut b);
+        assert_eq!(a, b);
+    }
+
+    #[test]
+    fn allowlist_and_denylist() {
+        let scrubber = Scrubber::new(&ScrubConfig {
+            keep_keys: vec!["http.*".into(), "thread.*".into()],
+            drop_keys: vec!["thread.id".into()],
+            ..Default::default()
+        })
+        .unwrap();
+        let mut attrs = json!({
+            "http.method": "GET",
+            "http.status_code": "200",
+            "thread.id": "17",
+            "thread.name": "main",
+            "process.pid": "42",
+        });
+        scrubber.scrub_attrs(&mut attrs);
+
+        let mut keys: Vec<&String> = attrs.as_object().unwrap().keys().collect();
+        keys.sort();
+        assert_eq!(keys, ["http.method", "http.status_code", "thread.name"]);
+    }
+
+    #[test]
+    fn glob_matching() {
+        assert!(glob_match("http.*", "http.method"));
+        assert!(glob_match("*.id", "thread.id"));
+        assert!(glob_match("a*c*e", "abcde"));
+        assert!(!glob_match("http.*", "rpc.method"));
+        assert!(!glob_match("a*a", "a"));
+        assert!(glob_match("exact", "exact"));
+    }
+
+    #[test]
+    fn invalid_pattern_is_an_error() {
+        let err = Scrubber::new(&ScrubConfig {
+            redact_patterns: vec!["(".into()],
+            ..Default::default()
+        })
+        .unwrap_err();
+        assert!(err.to_string().contains("invalid redact pattern"));
+    }
+}
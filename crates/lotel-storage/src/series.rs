@@ -0,0 +1,473 @@
+//! Per-series metric math. A series is one metric name, service, and attribute set; counter
+//! values only make sense relative to earlier points of the same series.
+
+use std::collections::{BTreeMap, HashMap};
+
+use anyhow::{Context, Result, bail};
+use chrono::{DateTime, NaiveDateTime};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{MetricResult, QueryOptions, append_where};
+
+/// OTLP `AggregationTemporality`.
+pub const TEMPORALITY_DELTA: i32 = 1;
+pub const TEMPORALITY_CUMULATIVE: i32 = 2;
+
+/// Target of [`TemporalityConverter`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Temporality {
+    Delta,
+    Cumulative,
+}
+
+impl Temporality {
+    /// The OTLP `AggregationTemporality` value.
+    pub fn code(self) -> i32 {
+        match self {
+            Self::Delta => TEMPORALITY_DELTA,
+            Self::Cumulative => TEMPORALITY_CUMULATIVE,
+        }
+    }
+}
+
+/// Increase and per-second rate of a counter over one time bucket, summed across series.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RatePoint {
+    pub metric_name: String,
+    pub bucket_start: NaiveDateTime,
+    pub increase: f64,
+    pub rate_per_sec: f64,
+    /// Series that contributed to the bucket.
+    pub series: i64,
+}
+
+/// One series of a metric downsampled to fixed-width buckets, for charting.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BucketedSeries {
+    /// Metric name, service, and attributes (omitted when empty).
+    pub name: String,
+    /// `(bucket start, value)` in time order.
+    pub points: Vec<(NaiveDateTime, f64)>,
+}
+
+/// One stored data point of a series, in timestamp order.
+pub(crate) struct SeriesPoint {
+    pub series: String,
+    pub metric_type: String,
+    pub timestamp: NaiveDateTime,
+    pub value: f64,
+    pub temporality: Option<i32>,
+    pub monotonic: Option<bool>,
+}
+
+/// Load the points of `metric_name` matching `opts`, grouped by series and ordered by time.
+pub(crate) fn series_points(
+    conn: &Connection,
+    opts: &QueryOptions,
+    metric_name: &str,
+) -> Result<Vec<SeriesPoint>> {
+    let mut query = String::from(
+        "SELECT service_name || ' ' || CAST(attributes AS VARCHAR), metric_type, timestamp, value,
+                aggregation_temporality, is_monotonic
+         FROM metrics WHERE metric_name = ?",
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = vec![Box::new(metric_name.to_string())];
+    append_where(&mut query, &mut params, opts, "timestamp");
+    query.push_str(" ORDER BY 1, timestamp");
+
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(SeriesPoint {
+                series: row.get(0)?,
+                metric_type: row.get(1)?,
+                timestamp: row.get(2)?,
+                value: row.get::<_, Option<f64>>(3)?.unwrap_or(0.0),
+                temporality: row.get(4)?,
+                monotonic: row.get(5)?,
+            })
+        })
+        .with_context(|| format!("querying points of {metric_name}"))?;
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// Running state of one series, fed its points in timestamp order.
+#[derive(Debug, Default)]
+struct SeriesState {
+    last_cumulative: Option<f64>,
+    total: Option<f64>,
+}
+
+impl SeriesState {
+    /// The increase a point adds to its series: the value itself for a delta point, the
+    /// difference from the previous point for a cumulative one. A cumulative value below its
+    /// predecessor is a counter reset, so the new value is the increase. The first cumulative
+    /// point of a series has no baseline and yields `None`.
+    fn increase(&mut self, temporality: Option<i32>, value: f64) -> Option<f64> {
+        if temporality == Some(TEMPORALITY_DELTA) {
+            return Some(value);
+        }
+        let baseline = self.last_cumulative.replace(value);
+        baseline.map(|b| if value >= b { value - b } else { value })
+    }
+}
+
+/// [`SeriesState::increase`] of every point; `points` are grouped by series.
+fn increases(points: &[SeriesPoint]) -> Vec<Option<f64>> {
+    let mut current: Option<&str> = None;
+    let mut state = SeriesState::default();
+    points
+        .iter()
+        .map(|p| {
+            if current != Some(p.series.as_str()) {
+                current = Some(&p.series);
+                state = SeriesState::default();
+            }
+            state.increase(p.temporality, p.value)
+        })
+        .collect()
+}
+
+/// Rewrites sum and histogram points to one temporality so series from SDKs configured
+/// differently compare directly. Gauges pass through unchanged. Points must be fed in
+/// timestamp order, as the metric queries return them.
+///
+/// To delta, each point becomes its increase over the previous point of its series, and the
+/// first cumulative point of a series (which has no baseline) is dropped. To cumulative,
+/// each point becomes the running total of increases since the first point in the query
+/// window, so totals restart at the window start and carry across counter resets.
+#[derive(Debug)]
+pub struct TemporalityConverter {
+    target: Temporality,
+    series: HashMap<String, SeriesState>,
+}
+
+impl TemporalityConverter {
+    pub fn new(target: Temporality) -> Self {
+        Self {
+            target,
+            series: HashMap::new(),
+        }
+    }
+
+    /// Convert the next point, or `None` when it has no value in the target temporality.
+    pub fn convert(&mut self, mut point: MetricResult) -> Option<MetricResult> {
+        if point.metric_type == "gauge" {
+            return Some(point);
+        }
+        let key = format!(
+            "{}\0{}\0{}",
+            point.metric_name,
+            point.service_name,
+            point
+                .attributes
+                .as_ref()
+                .map(|a| a.to_string())
+                .unwrap_or_default()
+        );
+        let state = self.series.entry(key).or_default();
+        let increase = state.increase(point.aggregation_temporality, point.value);
+        point.value = match self.target {
+            Temporality::Delta => increase?,
+            Temporality::Cumulative => {
+                // A cumulative first point starts the total at its own value.
+                let total = state
+                    .total
+                    .map_or(point.value, |t| t + increase.unwrap_or(0.0));
+                state.total = Some(total);
+                total
+            }
+        };
+        point.aggregation_temporality = Some(self.target.code());
+        Some(point)
+    }
+}
+
+/// Total of `metric_name` over the window: gauge values are added as-is, while sum and
+/// histogram points contribute their increase (so a cumulative series counts only what it
+/// gained between its first and last point in the window).
+pub(crate) fn window_sum(conn: &Connection, opts: &QueryOptions, metric_name: &str) -> Result<f64> {
+    let points = series_points(conn, opts, metric_name)?;
+    Ok(points
+        .iter()
+        .zip(increases(&points))
+        .map(|(point, increase)| match point.metric_type.as_str() {
+            "gauge" => point.value,
+            _ => increase.unwrap_or(0.0),
+        })
+        .sum())
+}
+
+/// `rate()` for a monotonic sum (or a histogram's sum): the increase per `bucket`, aligned
+/// to multiples of the bucket width since the Unix epoch, and that increase per second.
+/// Buckets without points are omitted.
+pub fn counter_rate(
+    conn: &Connection,
+    opts: &QueryOptions,
+    metric_name: &str,
+    bucket: chrono::Duration,
+) -> Result<Vec<RatePoint>> {
+    let width = bucket.num_seconds();
+    if width <= 0 {
+        bail!("rate bucket must be at least one second");
+    }
+    let points = series_points(conn, opts, metric_name)?;
+    if let Some(p) = points.iter().find(|p| {
+        p.metric_type == "gauge" || (p.metric_type == "sum" && p.monotonic == Some(false))
+    }) {
+        bail!(
+            "rate needs a monotonic counter; {metric_name} is a {}",
+            if p.metric_type == "gauge" {
+                "gauge"
+            } else {
+                "non-monotonic sum"
+            }
+        );
+    }
+
+    let mut buckets: BTreeMap<i64, (f64, Vec<&str>)> = BTreeMap::new();
+    for (point, increase) in points.iter().zip(increases(&points)) {
+        let Some(increase) = increase else { continue };
+        let start = point.timestamp.and_utc().timestamp().div_euclid(width) * width;
+        let (total, series) = buckets.entry(start).or_default();
+        *total += increase;
+        if series.last() != Some(&point.series.as_str()) {
+            series.push(&point.series);
+        }
+    }
+
+    buckets
+        .into_iter()
+        .map(|(start, (increase, series))| {
+            Ok(RatePoint {
+                metric_name: metric_name.to_string(),
+                bucket_start: DateTime::from_timestamp(start, 0)
+                    .context("bucket out of range")?
+                    .naive_utc(),
+                increase,
+                rate_per_sec: increase / width as f64,
+                series: series.len() as i64,
+            })
+        })
+        .collect()
+}
+
+/// Downsample each series of `metric_name` to `bucket`-wide buckets aligned to the Unix
+/// epoch. A bucket holds the mean of gauge points, the total of delta points, and the last
+/// value of cumulative points, so counters chart as their stored running totals.
+pub fn bucketed_series(
+    conn: &Connection,
+    opts: &QueryOptions,
+    metric_name: &str,
+    bucket: chrono::Duration,
+) -> Result<Vec<BucketedSeries>> {
+    let width = bucket.num_milliseconds();
+    if width <= 0 {
+        bail!("bucket must be at least one millisecond");
+    }
+    let points = series_points(conn, opts, metric_name)?;
+    points
+        .chunk_by(|a, b| a.series == b.series)
+        .map(|series| {
+            // Bucket start (ms) -> (value, points).
+            let mut buckets: BTreeMap<i64, (f64, usize)> = BTreeMap::new();
+            for point in series {
+                let start = point
+                    .timestamp
+                    .and_utc()
+                    .timestamp_millis()
+                    .div_euclid(width)
+                    * width;
+                let (value, n) = buckets.entry(start).or_default();
+                if point.metric_type == "gauge" || point.temporality == Some(TEMPORALITY_DELTA) {
+                    *value += point.value;
+                } else {
+                    *value = point.value;
+                }
+                *n += 1;
+            }
+            let gauge = series[0].metric_type == "gauge";
+            let points = buckets
+                .into_iter()
+                .map(|(start, (value, n))| {
+                    let start = DateTime::from_timestamp_millis(start)
+                        .context("bucket out of range")?
+                        .naive_utc();
+                    Ok((start, if gauge { value / n as f64 } else { value }))
+                })
+                .collect::<Result<_>>()?;
+            let key = &series[0].series;
+            Ok(BucketedSeries {
+                name: format!("{metric_name} {}", key.strip_suffix(" {}").unwrap_or(key)),
+                points,
+            })
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn insert(conn: &Connection, ts: &str, value: f64, temporality: i32, attrs: &str) {
+        conn.execute(
+            "INSERT INTO metrics VALUES ('requests', 'sum', ?, ?, 'api', ?, true, '1', ?, '2024-03-09')",
+            duckdb::params![value, ts, temporality, attrs],
+        )
+        .unwrap();
+    }
+
+    #[test]
+    fn rate_handles_resets_and_delta_points() {
+        let conn = db::open_in_memory().unwrap();
+        let a = r#"{"route":"/a"}"#;
+        // Cumulative series with a restart between 16:01:30 and 16:02:00.
+        insert(&conn, "2024-03-09 16:00:00", 100.0, 2, a);
+        insert(&conn, "2024-03-09 16:00:30", 160.0, 2, a);
+        insert(&conn, "2024-03-09 16:01:00", 220.0, 2, a);
+        insert(&conn, "2024-03-09 16:01:30", 280.0, 2, a);
+        insert(&conn, "2024-03-09 16:02:00", 30.0, 2, a);
+        // Delta series.
+        let b = r#"{"route":"/b"}"#;
+        insert(&conn, "2024-03-09 16:00:10", 6.0, 1, b);
+        insert(&conn, "2024-03-09 16:01:10", 12.0, 1, b);
+
+        let rate = counter_rate(
+            &conn,
+            &QueryOptions::default(),
+            "requests",
+            chrono::Duration::minutes(1),
+        )
+        .unwrap();
+        let got: Vec<(String, f64, f64, i64)> = rate
+            .iter()
+            .map(|p| {
+                (
+                    p.bucket_start.format("%H:%M").to_string(),
+                    p.increase,
+                    p.rate_per_sec,
+                    p.series,
+                )
+            })
+            .collect();
+        assert_eq!(
+            got,
+            [
+                ("16:00".to_string(), 66.0, 1.1, 2),
+                ("16:01".to_string(), 132.0, 2.2, 2),
+                ("16:02".to_string(), 30.0, 0.5, 1),
+            ]
+        );
+    }
+
+    #[test]
+    fn buckets_series_for_charting() {
+        let conn = db::open_in_memory().unwrap();
+        let a = r#"{"route":"/a"}"#;
+        insert(&conn, "2024-03-09 16:00:00", 100.0, 2, a);
+        insert(&conn, "2024-03-09 16:00:30", 160.0, 2, a);
+        insert(&conn, "2024-03-09 16:01:10", 220.0, 2, a);
+        insert(&conn, "2024-03-09 16:00:10", 6.0, 1, "{}");
+        insert(&conn, "2024-03-09 16:00:50", 4.0, 1, "{}");
+
+        let series = bucketed_series(
+            &conn,
+            &QueryOptions::default(),
+            "requests",
+            chrono::Duration::minutes(1),
+        )
+        .unwrap();
+        let got: Vec<(&str, Vec<(String, f64)>)> = series
+            .iter()
+            .map(|s| {
+                let points = s
+                    .points
+                    .iter()
+                    .map(|(t, v)| (t.format("%H:%M").to_string(), *v))
+                    .collect();
+                (s.name.as_str(), points)
+            })
+            .collect();
+        assert_eq!(
+            got,
+            [
+                (
+                    r#"requests api {"route":"/a"}"#,
+                    vec![("16:00".to_string(), 160.0), ("16:01".to_string(), 220.0)]
+                ),
+                ("requests api", vec![("16:00".to_string(), 10.0)]),
+            ]
+        );
+    }
+
+    #[test]
+    fn converts_temporality() {
+        let point = |ts: &str, value: f64, temporality: i32| MetricResult {
+            metric_name: "requests".into(),
+            metric_type: "sum".into(),
+            value,
+            timestamp: ts.parse().unwrap(),
+            service_name: "api".into(),
+            aggregation_temporality: Some(temporality),
+            is_monotonic: Some(true),
+            unit: None,
+            attributes: None,
+        };
+        let cumulative = [
+            point("2024-03-09T16:00:00", 100.0, 2),
+            point("2024-03-09T16:00:30", 160.0, 2),
+            point("2024-03-09T16:01:00", 20.0, 2),
+        ];
+        let delta = [
+            point("2024-03-09T16:00:00", 5.0, 1),
+            point("2024-03-09T16:00:30", 7.0, 1),
+        ];
+        let convert = |target: Temporality, points: &[MetricResult]| -> Vec<(f64, Option<i32>)> {
+            let mut converter = TemporalityConverter::new(target);
+            points
+                .iter()
+                .cloned()
+                .filter_map(|p| converter.convert(p))
+                .map(|p| (p.value, p.aggregation_temporality))
+                .collect()
+        };
+
+        assert_eq!(
+            convert(Temporality::Delta, &cumulative),
+            [(60.0, Some(1)), (20.0, Some(1))]
+        );
+        assert_eq!(
+            convert(Temporality::Cumulative, &cumulative),
+            [(100.0, Some(2)), (160.0, Some(2)), (180.0, Some(2))]
+        );
+        assert_eq!(
+            convert(Temporality::Cumulative, &delta),
+            [(5.0, Some(2)), (12.0, Some(2))]
+        );
+        assert_eq!(
+            convert(Temporality::Delta, &delta),
+            [(5.0, Some(1)), (7.0, Some(1))]
+        );
+    }
+
+    #[test]
+    fn rate_rejects_gauges() {
+        let conn = db::open_in_memory().unwrap();
+        conn.execute(
+            "INSERT INTO metrics VALUES ('cpu', 'gauge', 0.5, '2024-03-09 16:00:00', 'api', NULL, NULL, '1', '{}', '2024-03-09')",
+            [],
+        )
+        .unwrap();
+        let err = counter_rate(
+            &conn,
+            &QueryOptions::default(),
+            "cpu",
+            chrono::Duration::minutes(1),
+        )
+        .unwrap_err();
+        assert!(err.to_string().contains("cpu is a gauge"));
+    }
+}
@@ -0,0 +1,697 @@
+//! SQLite storage backend, for builds where DuckDB's bundled C++ library is a burden (e.g.
+//! cross-compiling). It keeps the same tables as DuckDB and supports ingest, the row
+//! queries, and pruning. Timestamps are stored as `YYYY-MM-DD HH:MM:SS.ffffff` text, which
+//! sorts and compares as time; attributes are JSON text read with SQLite's JSON functions.
+
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+use rusqlite::types::Value as SqlValue;
+use rusqlite::{Connection, params_from_iter};
+
+use crate::backend::{Backend, BackendKind};
+use crate::history::{IngestHistoryEntry, PruneRun};
+use crate::ingest::ParsedRows;
+use crate::ingest_incremental::{
+    FileTrim, IncrementalIngester, IngestReport, IngestStore, cursor_key,
+};
+use crate::prune::{PruneFilter, PruneReport};
+use crate::query::{
+    AttrFilter, LogResult, MetricResult, QueryOptions, Signal, TraceResult, span_kind_name,
+    status_code_name,
+};
+
+const SCHEMA: &str = "
+    CREATE TABLE IF NOT EXISTS traces (
+        trace_id                 TEXT NOT NULL,
+        span_id                  TEXT NOT NULL,
+        parent_span_id           TEXT,
+        name                     TEXT NOT NULL,
+        kind                     INTEGER,
+        start_time               TEXT NOT NULL,
+        end_time                 TEXT,
+        duration_ns              INTEGER,
+        status_code              INTEGER,
+        service_name             TEXT NOT NULL,
+        attributes               TEXT,
+        date                     TEXT NOT NULL,
+        trace_state              TEXT,
+        flags                    INTEGER,
+        dropped_attributes_count INTEGER,
+        dropped_events_count     INTEGER,
+        dropped_links_count      INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS metrics (
+        metric_name              TEXT NOT NULL,
+        metric_type              TEXT NOT NULL,
+        value                    REAL,
+        timestamp                TEXT NOT NULL,
+        service_name             TEXT NOT NULL,
+        aggregation_temporality  INTEGER,
+        is_monotonic             INTEGER,
+        unit                     TEXT,
+        attributes               TEXT,
+        date                     TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS logs (
+        timestamp       TEXT NOT NULL,
+        severity        TEXT,
+        severity_number INTEGER,
+        body            TEXT,
+        service_name    TEXT NOT NULL,
+        trace_id        TEXT,
+        span_id         TEXT,
+        attributes      TEXT,
+        date            TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS ingest_cursors (
+        file_path    TEXT NOT NULL PRIMARY KEY,
+        byte_offset  INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS ingest_history (
+        run_started_at TEXT NOT NULL,
+        finished_at    TEXT NOT NULL,
+        signal         TEXT NOT NULL,
+        file_path      TEXT NOT NULL,
+        start_offset   INTEGER NOT NULL,
+        end_offset     INTEGER NOT NULL,
+        rows           INTEGER NOT NULL,
+        error          TEXT
+    );
+    CREATE TABLE IF NOT EXISTS prune_history (
+        started_at  TEXT NOT NULL,
+        finished_at TEXT NOT NULL,
+        trigger     TEXT NOT NULL,
+        traces      INTEGER NOT NULL,
+        metrics     INTEGER NOT NULL,
+        logs        INTEGER NOT NULL,
+        error       TEXT
+    );
+";
+
+pub struct SqliteBackend {
+    conn: Connection,
+}
+
+impl SqliteBackend {
+    /// Open (creating if needed) and migrate the database at `path`.
+    pub fn open(path: &Path) -> Result<Self> {
+        if let Some(parent) = path.parent() {
+            std::fs::create_dir_all(parent)
+                .with_context(|| format!("creating directory {}", parent.display()))?;
+        }
+        let conn = Connection::open(path).with_context(|| format!("opening {}", path.display()))?;
+        // WAL lets queries read while the collector writes; writers wait for each other.
+        conn.pragma_update(None, "journal_mode", "WAL")?;
+        conn.busy_timeout(Duration::from_secs(5))?;
+        Self::with_connection(conn)
+    }
+
+    /// An in-memory database with the schema applied (for testing).
+    pub fn open_in_memory() -> Result<Self> {
+        Self::with_connection(Connection::open_in_memory()?)
+    }
+
+    fn with_connection(conn: Connection) -> Result<Self> {
+        conn.execute_batch(SCHEMA)
+            .context("creating sqlite tables")?;
+        Ok(Self { conn })
+    }
+
+    fn query<T>(
+        &self,
+        signal: Signal,
+        opts: &QueryOptions,
+        map: impl FnMut(&rusqlite::Row<'_>) -> rusqlite::Result<T>,
+    ) -> Result<Vec<T>> {
+        let mut params = Vec::new();
+        let query = format!(
+            "SELECT {}{}",
+            signal.columns().replace(" AS VARCHAR", " AS TEXT"),
+            from_clause(signal, opts, &mut params)
+        );
+        let mut stmt = self.conn.prepare(&query)?;
+        let rows = stmt
+            .query_map(params_from_iter(params), map)
+            .with_context(|| format!("querying {}", signal.table()))?;
+        Ok(rows.collect::<rusqlite::Result<_>>()?)
+    }
+}
+
+impl Backend for SqliteBackend {
+    fn kind(&self) -> BackendKind {
+        BackendKind::Sqlite
+    }
+
+    fn load_cursors(&self, ingester: &mut IncrementalIngester) -> Result<()> {
+        ingester.load_cursors_from(&self.conn)
+    }
+
+    fn ingest_new(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+    ) -> Result<IngestReport> {
+        ingester.ingest_into(&self.conn, data_path)
+    }
+
+    fn consume(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        archive_dir: Option<&Path>,
+    ) -> Result<u64> {
+        ingester.consume_from(&self.conn, data_path, archive_dir)
+    }
+
+    fn trim_files(
+        &self,
+        ingester: &mut IncrementalIngester,
+        data_path: &Path,
+        cutoff: NaiveDateTime,
+        dry_run: bool,
+    ) -> Result<Vec<FileTrim>> {
+        ingester.trim_files_from(&self.conn, data_path, cutoff, dry_run)
+    }
+
+    fn clear(&self) -> Result<()> {
+        self.conn
+            .execute_batch(
+                "BEGIN; DELETE FROM traces; DELETE FROM metrics; DELETE FROM logs; \
+                 DELETE FROM ingest_cursors; COMMIT;",
+            )
+            .context("clearing sqlite tables")
+    }
+
+    fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+        self.query(Signal::Traces, opts, |row| {
+            let kind: i32 = row.get(4)?;
+            let status_code: i32 = row.get(8)?;
+            Ok(TraceResult {
+                trace_id: row.get(0)?,
+                span_id: row.get(1)?,
+                parent_span_id: row.get(2)?,
+                name: row.get(3)?,
+                kind,
+                kind_name: span_kind_name(kind).to_string(),
+                start_time: parse_time(row, 5)?,
+                end_time: parse_opt_time(row, 6)?,
+                duration_ns: row.get(7)?,
+                status_code,
+                status: status_code_name(status_code).to_string(),
+                service_name: row.get(9)?,
+                attributes: parse_json(row, 10)?,
+                trace_state: row.get(11)?,
+                flags: row.get(12)?,
+                dropped_attributes_count: row.get(13)?,
+                dropped_events_count: row.get(14)?,
+                dropped_links_count: row.get(15)?,
+            })
+        })
+    }
+
+    fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+        self.query(Signal::Metrics, opts, |row| {
+            Ok(MetricResult {
+                metric_name: row.get(0)?,
+                metric_type: row.get(1)?,
+                value: row.get(2)?,
+                timestamp: parse_time(row, 3)?,
+                service_name: row.get(4)?,
+                aggregation_temporality: row.get(5)?,
+                is_monotonic: row.get(6)?,
+                unit: row.get(7)?,
+                attributes: parse_json(row, 8)?,
+            })
+        })
+    }
+
+    fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>> {
+        self.query(Signal::Logs, opts, |row| {
+            Ok(LogResult {
+                timestamp: parse_time(row, 0)?,
+                severity: row.get(1)?,
+                severity_number: row.get(2)?,
+                body: row.get(3)?,
+                service_name: row.get(4)?,
+                trace_id: row.get(5)?,
+                span_id: row.get(6)?,
+                attributes: parse_json(row, 7)?,
+            })
+        })
+    }
+
+    fn prune_signal(
+        &self,
+        signal: Signal,
+        cutoff: NaiveDateTime,
+        filter: &PruneFilter,
+        dry_run: bool,
+    ) -> Result<PruneReport> {
+        let mut params = vec![SqlValue::Text(sql_time(cutoff))];
+        let conditions = prune_conditions(signal, filter, &mut params);
+        let from = format!(
+            " FROM {} WHERE {} < ?{conditions}",
+            signal.table(),
+            signal.time_column()
+        );
+        let count: i64 = self
+            .conn
+            .query_row(
+                &format!("SELECT COUNT(*){from}"),
+                params_from_iter(&params),
+                |row| row.get(0),
+            )
+            .with_context(|| format!("counting {} for prune", signal.table()))?;
+        if !dry_run && count > 0 {
+            self.conn
+                .execute(&format!("DELETE{from}"), params_from_iter(&params))
+                .with_context(|| format!("pruning {}", signal.table()))?;
+        }
+        Ok(PruneReport {
+            signal: signal.table().to_string(),
+            service_name: filter.service.clone(),
+            deleted: count,
+            cutoff: cutoff.format("%Y-%m-%dT%H:%M:%S").to_string(),
+        })
+    }
+
+    fn nth_newest(
+        &self,
+        signal: Signal,
+        n: u64,
+        filter: &PruneFilter,
+        per_service: bool,
+    ) -> Result<Vec<(Option<String>, NaiveDateTime)>> {
+        let mut params = Vec::new();
+        let conditions = prune_conditions(signal, filter, &mut params);
+        let ranked = crate::prune::ranked_by_time(signal, per_service, &conditions);
+        params.push(SqlValue::Integer(n as i64));
+        let mut stmt = self
+            .conn
+            .prepare(&format!("SELECT svc, t FROM ({ranked}) WHERE rn = ?"))?;
+        let rows = stmt
+            .query_map(params_from_iter(&params), |row| {
+                Ok((row.get::<_, String>(0)?, parse_time(row, 1)?))
+            })
+            .with_context(|| format!("finding the newest {n} {}", signal.table()))?;
+        let mut cutoffs = Vec::new();
+        for row in rows {
+            let (svc, t) = row?;
+            cutoffs.push((per_service.then_some(svc), t));
+        }
+        Ok(cutoffs)
+    }
+
+    fn record_prune(&self, run: &PruneRun) -> Result<()> {
+        self.conn
+            .execute(
+                "INSERT INTO prune_history VALUES (?, ?, ?, ?, ?, ?, ?)",
+                rusqlite::params![
+                    sql_time(run.started_at),
+                    sql_time(run.finished_at),
+                    run.trigger,
+                    run.traces,
+                    run.metrics,
+                    run.logs,
+                    run.error,
+                ],
+            )
+            .context("recording prune history")?;
+        Ok(())
+    }
+
+    fn prune_history(&self, limit: usize) -> Result<Vec<PruneRun>> {
+        let mut stmt = self.conn.prepare(
+            "SELECT started_at, finished_at, trigger, traces, metrics, logs, error \
+             FROM prune_history ORDER BY started_at DESC LIMIT ?",
+        )?;
+        let rows = stmt
+            .query_map([limit as i64], |row| {
+                Ok(PruneRun {
+                    started_at: parse_time(row, 0)?,
+                    finished_at: parse_time(row, 1)?,
+                    trigger: row.get(2)?,
+                    traces: row.get(3)?,
+                    metrics: row.get(4)?,
+                    logs: row.get(5)?,
+                    error: row.get(6)?,
+                })
+            })
+            .context("querying prune history")?;
+        Ok(rows.collect::<rusqlite::Result<_>>()?)
+    }
+}
+
+impl IngestStore for Connection {
+    fn cursors(&self) -> Result<Vec<(PathBuf, u64)>> {
+        let mut stmt = self.prepare("SELECT file_path, byte_offset FROM ingest_cursors")?;
+        let rows = stmt
+            .query_map([], |row| {
+                let path: String = row.get(0)?;
+                let offset: i64 = row.get(1)?;
+                Ok((PathBuf::from(path), offset as u64))
+            })
+            .context("querying cursors")?;
+        Ok(rows.collect::<rusqlite::Result<_>>()?)
+    }
+
+    fn begin(&self) -> Result<()> {
+        Ok(self.execute_batch("BEGIN IMMEDIATE")?)
+    }
+
+    fn append(&self, batches: &[ParsedRows]) -> Result<usize> {
+        let mut written = 0;
+        for batch in batches {
+            written += match batch {
+                ParsedRows::Spans(rows) => {
+                    let mut stmt = self.prepare_cached(
+                        "INSERT INTO traces VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                    )?;
+                    for row in rows {
+                        stmt.execute(rusqlite::params![
+                            row.trace_id,
+                            row.span_id,
+                            row.parent_span_id,
+                            row.name,
+                            row.kind,
+                            row.start_time.map(sql_time),
+                            row.end_time.map(sql_time),
+                            row.duration_ns,
+                            row.status_code,
+                            row.service_name,
+                            row.attributes,
+                            row.date.map(|d| d.to_string()),
+                            row.trace_state,
+                            row.flags,
+                            row.dropped_attributes_count,
+                            row.dropped_events_count,
+                            row.dropped_links_count,
+                        ])?;
+                    }
+                    rows.len()
+                }
+                ParsedRows::Metrics(rows) => {
+                    let mut stmt = self.prepare_cached(
+                        "INSERT INTO metrics VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+                    )?;
+                    for row in rows {
+                        stmt.execute(rusqlite::params![
+                            row.metric_name,
+                            row.metric_type,
+                            row.value,
+                            row.timestamp.map(sql_time),
+                            row.service_name,
+                            row.temporality,
+                            row.monotonic,
+                            row.unit,
+                            row.attributes,
+                            row.date.map(|d| d.to_string()),
+                        ])?;
+                    }
+                    rows.len()
+                }
+                ParsedRows::Logs(rows) => {
+                    let mut stmt =
+                        self.prepare_cached("INSERT INTO logs VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")?;
+                    for row in rows {
+                        stmt.execute(rusqlite::params![
+                            sql_time(row.timestamp),
+                            row.severity,
+                            row.severity_number,
+                            row.body,
+                            row.service_name,
+                            row.trace_id,
+                            row.span_id,
+                            row.attributes,
+                            row.date.to_string(),
+                        ])?;
+                    }
+                    rows.len()
+                }
+            };
+        }
+        Ok(written)
+    }
+
+    fn save_cursor(&self, file_path: &Path, offset: u64) -> Result<()> {
+        self.execute(
+            "INSERT INTO ingest_cursors (file_path, byte_offset) VALUES (?, ?) \
+             ON CONFLICT (file_path) DO UPDATE SET byte_offset = excluded.byte_offset",
+            rusqlite::params![cursor_key(file_path)?, offset as i64],
+        )
+        .context("saving ingest cursor")?;
+        Ok(())
+    }
+
+    fn delete_cursor(&self, file_path: &Path) -> Result<()> {
+        self.execute(
+            "DELETE FROM ingest_cursors WHERE file_path = ?",
+            rusqlite::params![cursor_key(file_path)?],
+        )
+        .context("deleting ingest cursor")?;
+        Ok(())
+    }
+
+    fn commit(&self) -> Result<()> {
+        Ok(self.execute_batch("COMMIT")?)
+    }
+
+    fn rollback(&self) -> Result<()> {
+        Ok(self.execute_batch("ROLLBACK")?)
+    }
+
+    fn record_ingest(&self, entry: &IngestHistoryEntry) -> Result<()> {
+        self.execute(
+            "INSERT INTO ingest_history VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+            rusqlite::params![
+                sql_time(entry.run_started_at),
+                sql_time(entry.finished_at),
+                entry.signal,
+                entry.file_path,
+                entry.start_offset as i64,
+                entry.end_offset as i64,
+                entry.rows,
+                entry.error,
+            ],
+        )
+        .context("recording ingest history")?;
+        Ok(())
+    }
+}
+
+/// `FROM`, filters, ordering, and limit, mirroring [`crate::query::from_clause`].
+fn from_clause(signal: Signal, opts: &QueryOptions, params: &mut Vec<SqlValue>) -> String {
+    let time_col = signal.time_column();
+    let mut query = format!(" FROM {} WHERE 1=1", signal.table());
+    if let Some(svc) = &opts.service {
+        query.push_str(" AND service_name = ?");
+        params.push(SqlValue::Text(svc.clone()));
+    }
+    if let Some(since) = opts.since {
+        query.push_str(&format!(" AND {time_col} >= ?"));
+        params.push(SqlValue::Text(sql_time(since)));
+    }
+    if let Some(until) = opts.until {
+        query.push_str(&format!(" AND {time_col} <= ?"));
+        params.push(SqlValue::Text(sql_time(until)));
+    }
+    for filter in &opts.attrs {
+        push_json_filter(&mut query, params, "attributes", filter.json_path(), filter);
+    }
+    if signal != Signal::Metrics
+        && let Some(trace_id) = &opts.trace_id
+    {
+        query.push_str(" AND trace_id = ?");
+        params.push(SqlValue::Text(crate::ids::normalize_id(trace_id)));
+    }
+    match signal {
+        Signal::Traces => {
+            if let Some(kind) = opts.kind {
+                query.push_str(" AND kind = ?");
+                params.push(SqlValue::Integer(kind.into()));
+            }
+            if let Some(code) = opts.status_code {
+                query.push_str(" AND status_code = ?");
+                params.push(SqlValue::Integer(code.into()));
+            }
+            if let Some(min) = opts.min_duration_ns {
+                query.push_str(" AND duration_ns >= ?");
+                params.push(SqlValue::Integer(min));
+            }
+        }
+        Signal::Metrics => {}
+        Signal::Logs => {
+            if let Some(min) = opts.min_severity {
+                query.push_str(" AND severity_number >= ?");
+                params.push(SqlValue::Integer(min.into()));
+            }
+            for filter in &opts.body_fields {
+                push_json_filter(
+                    &mut query,
+                    params,
+                    "CASE WHEN json_valid(body) THEN body END",
+                    filter.nested_json_path(),
+                    filter,
+                );
+            }
+        }
+    }
+
+    query.push_str(&format!(" ORDER BY {time_col} ASC"));
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        query.push_str(&format!(" LIMIT {limit}"));
+    }
+    query
+}
+
+/// A prune filter as ` AND ...` conditions, mirroring [`crate::prune::filter_conditions`].
+fn prune_conditions(signal: Signal, filter: &PruneFilter, params: &mut Vec<SqlValue>) -> String {
+    let mut cond = String::new();
+    if let Some(svc) = &filter.service {
+        cond.push_str(" AND service_name = ?");
+        params.push(SqlValue::Text(svc.clone()));
+    }
+    if let Some(name) = &filter.name {
+        match crate::prune::name_column(signal) {
+            Some(column) => {
+                cond.push_str(&format!(" AND {column} GLOB ?"));
+                params.push(SqlValue::Text(name.clone()));
+            }
+            None => cond.push_str(" AND 0"),
+        }
+    }
+    for attr in &filter.attrs {
+        push_json_filter(&mut cond, params, "attributes", attr.json_path(), attr);
+    }
+    cond
+}
+
+/// Compare the value at `path` in `json`. SQLite's `CAST` turns any text into a number, so
+/// numeric filters only consider JSON numbers; string filters compare the value's text.
+fn push_json_filter(
+    query: &mut String,
+    params: &mut Vec<SqlValue>,
+    json: &str,
+    path: String,
+    filter: &AttrFilter,
+) {
+    let op = filter.op.sql();
+    match filter.value.parse::<f64>() {
+        Ok(n) => {
+            query.push_str(&format!(
+                " AND (CASE WHEN json_type({json}, ?) IN ('integer', 'real') \
+                 THEN json_extract({json}, ?) END) {op} ?"
+            ));
+            params.push(SqlValue::Text(path.clone()));
+            params.push(SqlValue::Text(path));
+            params.push(SqlValue::Real(n));
+        }
+        Err(_) => {
+            query.push_str(&format!(
+                " AND CAST(json_extract({json}, ?) AS TEXT) {op} ?"
+            ));
+            params.push(SqlValue::Text(path));
+            params.push(SqlValue::Text(filter.value.clone()));
+        }
+    }
+}
+
+fn sql_time(t: NaiveDateTime) -> String {
+    t.format("%Y-%m-%d %H:%M:%S%.6f").to_string()
+}
+
+fn parse_time(row: &rusqlite::Row<'_>, idx: usize) -> rusqlite::Result<NaiveDateTime> {
+    let text: String = row.get(idx)?;
+    NaiveDateTime::parse_from_str(&text, "%Y-%m-%d %H:%M:%S%.f").map_err(|e| {
+        rusqlite::Error::FromSqlConversionFailure(idx, rusqlite::types::Type::Text, Box::new(e))
+    })
+}
+
+fn parse_opt_time(row: &rusqlite::Row<'_>, idx: usize) -> rusqlite::Result<Option<NaiveDateTime>> {
+    match row.get::<_, Option<String>>(idx)? {
+        Some(_) => parse_time(row, idx).map(Some),
+        None => Ok(None),
+    }
+}
+
+fn parse_json(row: &rusqlite::Row<'_>, idx: usize) -> rusqlite::Result<Option<serde_json::Value>> {
+    Ok(row
+        .get::<_, Option<String>>(idx)?
+        .and_then(|s| serde_json::from_str(&s).ok()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn ingests_queries_and_prunes() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        for (signal, line) in [
+            (
+                "traces",
+                r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},"scopeSpans":[{"spans":[{"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7","name":"GET /pay","kind":2,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000000025000000","attributes":[{"key":"retries","value":{"intValue":"3"}}],"status":{"code":2}}]}]}]}"#,
+            ),
+            (
+                "logs",
+                r#"{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"checkout"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1710000000001000000","severityText":"ERROR","severityNumber":17,"body":{"stringValue":"card declined"},"attributes":[]}]}]}]}"#,
+            ),
+        ] {
+            let dir = tmp.path().join(signal);
+            std::fs::create_dir_all(&dir).unwrap();
+            std::fs::write(dir.join(format!("{signal}.jsonl")), format!("{line}\n")).unwrap();
+        }
+
+        let backend = SqliteBackend::open(&tmp.path().join("lotel.sqlite")).unwrap();
+        let mut ingester = IncrementalIngester::new();
+        let report = backend.ingest_new(&mut ingester, tmp.path()).unwrap();
+        assert_eq!((report.traces, report.logs), (1, 1));
+        // Cursors are stored: a new ingester picks up where this one stopped.
+        let mut ingester = IncrementalIngester::new();
+        backend.load_cursors(&mut ingester).unwrap();
+        let report = backend.ingest_new(&mut ingester, tmp.path()).unwrap();
+        assert_eq!(report.total(), 0);
+
+        let spans = backend
+            .query_traces(&QueryOptions {
+                attrs: vec![AttrFilter::parse("retries>2").unwrap()],
+                ..Default::default()
+            })
+            .unwrap();
+        assert_eq!(spans.len(), 1);
+        assert_eq!(spans[0].status, "ERROR");
+        assert_eq!(spans[0].duration_ns, 25_000_000);
+        assert_eq!(
+            spans[0].end_time.unwrap().to_string(),
+            "2024-03-09 16:00:00.025"
+        );
+
+        let logs = backend
+            .query_logs(&QueryOptions {
+                min_severity: Some(17),
+                since: Some("2024-03-09T16:00:00.001".parse().unwrap()),
+                ..Default::default()
+            })
+            .unwrap();
+        assert_eq!(logs.len(), 1);
+        assert_eq!(logs[0].body.as_deref(), Some("card declined"));
+
+        let cutoff = "2024-03-10T00:00:00".parse().unwrap();
+        let pruned = backend.prune(cutoff, None, false).unwrap();
+        assert_eq!(
+            pruned.iter().map(|r| r.deleted).collect::<Vec<_>>(),
+            [1, 0, 1]
+        );
+        assert!(
+            backend
+                .query_traces(&QueryOptions::default())
+                .unwrap()
+                .is_empty()
+        );
+    }
+}
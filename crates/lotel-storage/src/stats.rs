@@ -0,0 +1,381 @@
+//! Span statistics: per-operation latency percentiles, call counts, and error rates.
+
+use anyhow::{Context, Result};
+use duckdb::Connection;
+use serde::{Deserialize, Serialize};
+
+use crate::query::{QueryOptions, append_span_filters};
+use crate::sample::STATUS_ERROR;
+
+/// Latency and error statistics for one span name in one service.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SpanStats {
+    pub service_name: String,
+    pub name: String,
+    pub calls: i64,
+    pub errors: i64,
+    pub error_rate: f64,
+    pub p50_ms: f64,
+    pub p95_ms: f64,
+    pub p99_ms: f64,
+    pub max_ms: f64,
+}
+
+/// Rate/Errors/Duration for one service (or one route of it), computed from entry spans.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct RedStats {
+    pub service_name: String,
+    /// `http.route` (or the span name when absent); only set when grouping by route.
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub route: Option<String>,
+    pub requests: i64,
+    pub rate_per_sec: f64,
+    pub errors: i64,
+    pub error_rate: f64,
+    pub p50_ms: f64,
+    pub p95_ms: f64,
+    pub p99_ms: f64,
+}
+
+/// Latency target and objective for [`slo_report`].
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct SloTarget {
+    /// Requests at or under this latency (and not errored) are "good" / Apdex-satisfied.
+    pub latency_ms: f64,
+    /// Required fraction of good requests, e.g. 0.99.
+    pub objective: f64,
+}
+
+/// Apdex score and error-budget burn for one service.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct SloReport {
+    pub service_name: String,
+    pub requests: i64,
+    pub good: i64,
+    pub bad: i64,
+    /// `(satisfied + tolerating / 2) / requests`, where tolerating is up to 4x the target
+    /// latency and errors always count as frustrated.
+    pub apdex: f64,
+    /// Fraction of good requests.
+    pub sli: f64,
+    pub objective: f64,
+    /// How fast the error budget is being spent; above 1.0 the objective will be missed.
+    pub burn_rate: f64,
+    /// Fraction of the window's error budget left (negative once overspent).
+    pub error_budget_remaining: f64,
+    pub met: bool,
+}
+
+/// Spans that represent a request handled by the service: server and consumer spans, plus
+/// root spans so services without server instrumentation still show up.
+pub(crate) const ENTRY_SPANS: &str =
+    "(kind IN (2, 5) OR parent_span_id IS NULL OR parent_span_id = '')";
+
+/// Ranking used by [`top_spans`]; every ordering is descending.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default)]
+pub enum SpanSort {
+    #[default]
+    P95,
+    Calls,
+    ErrorRate,
+}
+
+impl SpanSort {
+    fn order_by(self) -> &'static str {
+        match self {
+            SpanSort::P95 => "p95_ms DESC",
+            SpanSort::Calls => "calls DESC",
+            SpanSort::ErrorRate => "error_rate DESC, calls DESC",
+        }
+    }
+}
+
+/// Rank span names (per service) over the spans matching `opts`.
+pub fn top_spans(conn: &Connection, opts: &QueryOptions, sort: SpanSort) -> Result<Vec<SpanStats>> {
+    let mut query = format!(
+        "SELECT service_name, name,
+                COUNT(*) AS calls,
+                COUNT(*) FILTER (WHERE status_code = {STATUS_ERROR}) AS errors,
+                errors::DOUBLE / calls AS error_rate,
+                quantile_cont(duration_ns, 0.5) / 1e6 AS p50_ms,
+                quantile_cont(duration_ns, 0.95) / 1e6 AS p95_ms,
+                quantile_cont(duration_ns, 0.99) / 1e6 AS p99_ms,
+                MAX(duration_ns) / 1e6 AS max_ms
+         FROM traces WHERE 1=1"
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut query, &mut params, opts);
+    query.push_str(&format!(
+        " GROUP BY service_name, name ORDER BY {}, service_name, name",
+        sort.order_by()
+    ));
+    if let Some(limit) = opts.limit
+        && limit > 0
+    {
+        query.push_str(&format!(" LIMIT {limit}"));
+    }
+
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            Ok(SpanStats {
+                service_name: row.get(0)?,
+                name: row.get(1)?,
+                calls: row.get(2)?,
+                errors: row.get(3)?,
+                error_rate: row.get(4)?,
+                p50_ms: row.get(5)?,
+                p95_ms: row.get(6)?,
+                p99_ms: row.get(7)?,
+                max_ms: row.get(8)?,
+            })
+        })
+        .context("computing span statistics")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// Compute RED metrics per service, or per service and route when `by_route` is set.
+///
+/// The request rate is taken over the `since..until` window when `since` is given, and over
+/// the span of observed start times otherwise.
+pub fn red_metrics(
+    conn: &Connection,
+    opts: &QueryOptions,
+    by_route: bool,
+) -> Result<Vec<RedStats>> {
+    let route = if by_route {
+        "COALESCE(json_extract_string(attributes, '$.\"http.route\"'), name)"
+    } else {
+        "NULL"
+    };
+    let mut query = format!(
+        "SELECT service_name, {route} AS route,
+                COUNT(*) AS requests,
+                COUNT(*) FILTER (WHERE status_code = {STATUS_ERROR}) AS errors,
+                quantile_cont(duration_ns, 0.5) / 1e6,
+                quantile_cont(duration_ns, 0.95) / 1e6,
+                quantile_cont(duration_ns, 0.99) / 1e6
+         FROM traces WHERE {ENTRY_SPANS}"
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+    append_span_filters(&mut query, &mut params, opts);
+    query.push_str(" GROUP BY ALL ORDER BY service_name, route");
+
+    let window = window_secs(conn, opts)?;
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            let requests: i64 = row.get(2)?;
+            let errors: i64 = row.get(3)?;
+            Ok(RedStats {
+                service_name: row.get(0)?,
+                route: row.get(1)?,
+                requests,
+                rate_per_sec: requests as f64 / window,
+                errors,
+                error_rate: errors as f64 / requests as f64,
+                p50_ms: row.get(4)?,
+                p95_ms: row.get(5)?,
+                p99_ms: row.get(6)?,
+            })
+        })
+        .context("computing RED metrics")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// Compute Apdex and SLO burn per service from entry spans matching `opts`.
+pub fn slo_report(
+    conn: &Connection,
+    opts: &QueryOptions,
+    target: &SloTarget,
+) -> Result<Vec<SloReport>> {
+    let t_ns = (target.latency_ms * 1e6) as i64;
+    let not_error = format!("status_code IS DISTINCT FROM {STATUS_ERROR}");
+    let mut query = format!(
+        "SELECT service_name,
+                COUNT(*),
+                COUNT(*) FILTER (WHERE {not_error} AND duration_ns <= ?),
+                COUNT(*) FILTER (WHERE {not_error} AND duration_ns > ? AND duration_ns <= ?)
+         FROM traces WHERE {ENTRY_SPANS}"
+    );
+    let mut params: Vec<Box<dyn duckdb::types::ToSql>> =
+        vec![Box::new(t_ns), Box::new(t_ns), Box::new(t_ns * 4)];
+    append_span_filters(&mut query, &mut params, opts);
+    query.push_str(" GROUP BY service_name ORDER BY service_name");
+
+    let budget = 1.0 - target.objective;
+    let mut stmt = conn.prepare(&query)?;
+    let param_refs: Vec<&dyn duckdb::types::ToSql> = params.iter().map(|p| p.as_ref()).collect();
+    let rows = stmt
+        .query_map(param_refs.as_slice(), |row| {
+            let requests: i64 = row.get(1)?;
+            let satisfied: i64 = row.get(2)?;
+            let tolerating: i64 = row.get(3)?;
+            let total = requests as f64;
+            let sli = satisfied as f64 / total;
+            let burn_rate = if budget > 0.0 {
+                (1.0 - sli) / budget
+            } else {
+                f64::INFINITY
+            };
+            Ok(SloReport {
+                service_name: row.get(0)?,
+                requests,
+                good: satisfied,
+                bad: requests - satisfied,
+                apdex: (satisfied as f64 + tolerating as f64 / 2.0) / total,
+                sli,
+                objective: target.objective,
+                burn_rate,
+                error_budget_remaining: 1.0 - burn_rate,
+                met: sli >= target.objective,
+            })
+        })
+        .context("computing SLO report")?;
+
+    rows.map(|r| r.map_err(Into::into)).collect()
+}
+
+/// Length of the query window in seconds (at least one second).
+pub(crate) fn window_secs(conn: &Connection, opts: &QueryOptions) -> Result<f64> {
+    let millis = match opts.since {
+        Some(since) => {
+            let until = opts.until.unwrap_or_else(|| chrono::Utc::now().naive_utc());
+            (until - since).num_milliseconds()
+        }
+        None => {
+            let mut query = String::from(
+                "SELECT date_diff('millisecond', MIN(start_time), MAX(start_time)) FROM traces WHERE 1=1",
+            );
+            let mut params: Vec<Box<dyn duckdb::types::ToSql>> = Vec::new();
+            append_span_filters(&mut query, &mut params, opts);
+            let param_refs: Vec<&dyn duckdb::types::ToSql> =
+                params.iter().map(|p| p.as_ref()).collect();
+            conn.query_row(&query, param_refs.as_slice(), |row| {
+                row.get::<_, Option<i64>>(0)
+            })
+            .context("measuring query window")?
+            .unwrap_or(0)
+        }
+    };
+    Ok((millis as f64 / 1000.0).max(1.0))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+
+    fn insert_spans(conn: &Connection, spans: &[(&str, &str, i64, i32)]) {
+        for (i, (service, name, duration_ms, status)) in spans.iter().enumerate() {
+            conn.execute(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date) VALUES (?, ?, NULL, ?, 2, '2024-03-09 16:00:00', '2024-03-09 16:00:01', ?, ?, ?, '{}', '2024-03-09')",
+                duckdb::params![
+                    format!("t{i}"),
+                    format!("s{i}"),
+                    name,
+                    duration_ms * 1_000_000,
+                    status,
+                    service
+                ],
+            )
+            .unwrap();
+        }
+    }
+
+    #[test]
+    fn red_per_service_and_route() {
+        let conn = db::open_in_memory().unwrap();
+        insert_spans(
+            &conn,
+            &[
+                ("api", "GET /users/1", 10, 0),
+                ("api", "GET /users/2", 30, 2),
+                ("api", "POST /orders", 100, 0),
+            ],
+        );
+        conn.execute(
+            "UPDATE traces SET attributes = '{\"http.route\":\"/users/:id\"}' WHERE name LIKE 'GET /users/%'",
+            [],
+        )
+        .unwrap();
+        let opts = QueryOptions {
+            since: Some("2024-03-09T15:59:00".parse().unwrap()),
+            until: Some("2024-03-09T16:00:00".parse().unwrap()),
+            ..Default::default()
+        };
+
+        let red = red_metrics(&conn, &opts, false).unwrap();
+        assert_eq!(red.len(), 1);
+        assert_eq!(red[0].requests, 3);
+        assert_eq!(red[0].errors, 1);
+        assert!((red[0].rate_per_sec - 0.05).abs() < 1e-9);
+
+        let by_route = red_metrics(&conn, &opts, true).unwrap();
+        let routes: Vec<_> = by_route
+            .iter()
+            .map(|r| r.route.as_deref().unwrap())
+            .collect();
+        assert_eq!(routes, ["/users/:id", "POST /orders"]);
+        assert!((by_route[0].error_rate - 0.5).abs() < 1e-9);
+    }
+
+    #[test]
+    fn apdex_and_burn_rate() {
+        let conn = db::open_in_memory().unwrap();
+        insert_spans(
+            &conn,
+            &[
+                ("api", "a", 100, 0),
+                ("api", "b", 200, 0),
+                ("api", "c", 600, 0),
+                ("api", "d", 100, 2),
+            ],
+        );
+        let target = SloTarget {
+            latency_ms: 300.0,
+            objective: 0.5,
+        };
+        let report = slo_report(&conn, &QueryOptions::default(), &target).unwrap();
+        assert_eq!(report.len(), 1);
+        let api = &report[0];
+        assert_eq!((api.requests, api.good, api.bad), (4, 2, 2));
+        // Two satisfied, one tolerating (600ms <= 4 * 300ms), one error.
+        assert!((api.apdex - 0.625).abs() < 1e-9);
+        assert!((api.burn_rate - 1.0).abs() < 1e-9);
+        assert!(api.met);
+    }
+
+    #[test]
+    fn ranks_by_p95_calls_and_errors() {
+        let conn = db::open_in_memory().unwrap();
+        insert_spans(
+            &conn,
+            &[
+                ("api", "GET /users", 10, 0),
+                ("api", "GET /users", 20, 0),
+                ("api", "GET /users", 30, 2),
+                ("api", "POST /orders", 500, 0),
+                ("db", "SELECT", 1, 2),
+            ],
+        );
+
+        let by_p95 = top_spans(&conn, &QueryOptions::default(), SpanSort::P95).unwrap();
+        assert_eq!(by_p95[0].name, "POST /orders");
+        assert!((by_p95[0].p95_ms - 500.0).abs() < 1e-9);
+
+        let by_calls = top_spans(&conn, &QueryOptions::default(), SpanSort::Calls).unwrap();
+        assert_eq!(by_calls[0].name, "GET /users");
+        assert_eq!(by_calls[0].calls, 3);
+        assert_eq!(by_calls[0].errors, 1);
+        assert!((by_calls[0].p50_ms - 20.0).abs() < 1e-9);
+
+        let by_errors = top_spans(&conn, &QueryOptions::default(), SpanSort::ErrorRate).unwrap();
+        assert_eq!(by_errors[0].service_name, "db");
+        assert!((by_errors[0].error_rate - 1.0).abs() < 1e-9);
+    }
+}
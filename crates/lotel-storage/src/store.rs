@@ -0,0 +1,164 @@
+//! `Store`: an open telemetry store, i.e. the configured backend in one data directory with
+//! the DuckDB limits from its own config. Nothing is process-wide, so several stores (other
+//! data directories, tests) can be open at once. A command opens the store it needs,
+//! uses it, and closes it, which releases DuckDB's file lock before the next open.
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result};
+#[cfg(feature = "duckdb")]
+use duckdb::Connection;
+use serde::Serialize;
+
+use crate::backend::{Backend, BackendKind, StorageConfig, open_backend};
+use crate::cancel::{Cancel, Watch};
+use crate::query::QueryOptions;
+
+pub struct Store {
+    kind: BackendKind,
+    path: PathBuf,
+    read_only: bool,
+    backend: Box<dyn Backend>,
+    watches: Vec<Watch>,
+}
+
+/// Result of [`Store::health`].
+#[derive(Debug, Serialize)]
+pub struct StoreHealth {
+    pub backend: BackendKind,
+    pub path: String,
+    pub read_only: bool,
+    pub healthy: bool,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub error: Option<String>,
+}
+
+impl Store {
+    /// Open the `config` backend with its database in `data_dir`. Read-only DuckDB stores
+    /// also see archived telemetry (see [`crate::archive`]).
+    pub fn open(config: &StorageConfig, data_dir: &Path, read_only: bool) -> Result<Self> {
+        let path = data_dir.join(config.backend.file_name());
+        let backend = open_backend(config, &path, read_only)
+            .with_context(|| format!("opening {}", path.display()))?;
+        #[cfg(feature = "duckdb")]
+        if read_only
+            && config.backend == BackendKind::Duckdb
+            && let Some(conn) = backend.duckdb()
+        {
+            crate::archive::attach_archives(conn)?;
+        }
+        Ok(Self {
+            kind: config.backend,
+            path,
+            read_only,
+            backend,
+            watches: Vec::new(),
+        })
+    }
+
+    /// Interrupt the store's running queries when `cancel` fires, until it is closed.
+    pub fn with_cancel(mut self, cancel: &Cancel) -> Self {
+        self.watches = self.backend.watch(cancel);
+        self
+    }
+
+    /// [`Store::open`] in the default data directory (~/.lotel/data).
+    pub fn open_default(config: &StorageConfig, read_only: bool) -> Result<Self> {
+        let dir = crate::db::default_db_path()?
+            .parent()
+            .map(Path::to_path_buf)
+            .context("default database path has no parent directory")?;
+        Self::open(config, &dir, read_only)
+    }
+
+    pub fn kind(&self) -> BackendKind {
+        self.kind
+    }
+
+    /// The database file (for ClickHouse, only where its ingest lock lives).
+    pub fn path(&self) -> &Path {
+        &self.path
+    }
+
+    pub fn backend(&self) -> &dyn Backend {
+        self.backend.as_ref()
+    }
+
+    /// The DuckDB connection, or an error for backends that do not query through DuckDB.
+    #[cfg(feature = "duckdb")]
+    pub fn duckdb(&self) -> Result<&Connection> {
+        self.backend
+            .duckdb()
+            .context("this command needs the duckdb or parquet storage backend")
+    }
+
+    /// Whether the store answers a query. Never fails; problems are reported in the result.
+    pub fn health(&self) -> StoreHealth {
+        let opts = QueryOptions {
+            limit: Some(1),
+            ..QueryOptions::default()
+        };
+        let error = self
+            .backend
+            .query_traces(&opts)
+            .err()
+            .map(|e| format!("{e:#}"));
+        StoreHealth {
+            backend: self.kind,
+            path: self.path.display().to_string(),
+            read_only: self.read_only,
+            healthy: error.is_none(),
+            error,
+        }
+    }
+
+    /// Close the backend's connections. Dropping a store also closes them, but silently.
+    pub fn close(self) -> Result<()> {
+        drop(self.watches);
+        self.backend
+            .close()
+            .with_context(|| format!("closing {}", self.path.display()))
+    }
+}
+
+#[cfg(all(test, feature = "duckdb"))]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn stores_in_separate_directories_are_independent() {
+        let a = tempfile::TempDir::new().unwrap();
+        let b = tempfile::TempDir::new().unwrap();
+        let config = StorageConfig::default();
+
+        let first = Store::open(&config, a.path(), false).unwrap();
+        let second = Store::open(&config, b.path(), false).unwrap();
+        first
+            .duckdb()
+            .unwrap()
+            .execute_batch(
+                "INSERT INTO traces (trace_id, span_id, parent_span_id, name, kind, start_time, end_time, duration_ns, status_code, service_name, attributes, date)
+                 VALUES ('t1', 's1', NULL, 'op', 1, '2024-01-01 00:00:00', '2024-01-01 00:00:01', 1000000000, 0, 'svc', '{}', '2024-01-01')",
+            )
+            .unwrap();
+        let count = |store: &Store| -> i64 {
+            store
+                .duckdb()
+                .unwrap()
+                .query_row("SELECT COUNT(*) FROM traces", [], |row| row.get(0))
+                .unwrap()
+        };
+        assert_eq!(count(&first), 1);
+        assert_eq!(count(&second), 0);
+        assert!(first.health().healthy);
+        first.close().unwrap();
+        second.close().unwrap();
+
+        // Closing released the file, so it opens again, here read-only.
+        let reopened = Store::open(&config, a.path(), true).unwrap();
+        assert_eq!(count(&reopened), 1);
+        let health = reopened.health();
+        assert!(health.healthy && health.read_only);
+        assert_eq!(health.backend, BackendKind::Duckdb);
+    }
+}
@@ -0,0 +1,272 @@
+//! `trace_summaries`: one row per trace (root span, services, span count, duration, error
+//! flag), kept current as spans are appended so `query traces --roots` reads it instead of
+//! grouping every span of the matched traces.
+
+use std::collections::{BTreeSet, HashMap};
+
+use anyhow::{Context, Result};
+use chrono::NaiveDateTime;
+use duckdb::Connection;
+
+use crate::ingest::SpanRow;
+use crate::sample::STATUS_ERROR;
+
+/// Condition selecting root spans.
+const ROOT: &str = "(parent_span_id IS NULL OR parent_span_id = '')";
+
+/// What one batch contributes to a trace's summary.
+#[derive(Default)]
+struct Partial<'a> {
+    /// Start, name, and service of the earliest root span in the batch.
+    root: Option<(NaiveDateTime, &'a str, &'a str)>,
+    services: BTreeSet<&'a str>,
+    start: Option<NaiveDateTime>,
+    end: Option<NaiveDateTime>,
+    spans: i64,
+    error: bool,
+}
+
+/// Merge a batch of appended spans into `trace_summaries`. Runs inside the caller's
+/// transaction, so summaries commit together with the spans.
+pub(crate) fn upsert(conn: &Connection, spans: &[&SpanRow]) -> Result<()> {
+    let mut partials: HashMap<&str, Partial> = HashMap::new();
+    for span in spans {
+        let p = partials.entry(&span.trace_id).or_default();
+        p.spans += 1;
+        p.error |= span.status_code == STATUS_ERROR;
+        p.services.insert(&span.service_name);
+        p.start = match (p.start, span.start_time) {
+            (Some(a), Some(b)) => Some(a.min(b)),
+            (a, b) => a.or(b),
+        };
+        p.end = p.end.max(span.end_time);
+        let is_root = span.parent_span_id.as_deref().is_none_or(str::is_empty);
+        if let (true, Some(start)) = (is_root, span.start_time)
+            && p.root.is_none_or(|(earliest, _, _)| start < earliest)
+        {
+            p.root = Some((start, &span.name, &span.service_name));
+        }
+    }
+
+    let mut appender = conn
+        .appender("trace_summary_staging")
+        .context("creating trace summary appender")?;
+    for (trace_id, p) in &partials {
+        let Some(start) = p.start else {
+            continue;
+        };
+        appender.append_row(duckdb::params![
+            trace_id,
+            p.root.map(|(_, name, _)| name),
+            p.root.map(|(_, _, service)| service),
+            p.root.map(|(start, _, _)| start),
+            serde_json::to_string(&p.services)?,
+            start,
+            p.end,
+            p.spans,
+            p.error,
+        ])?;
+    }
+    appender
+        .flush()
+        .context("flushing trace summary appender")?;
+    merge_staging(conn)
+}
+
+/// [`upsert`] for spans already in `table`, which has the columns of `traces`.
+pub(crate) fn upsert_from(conn: &Connection, table: &str) -> Result<()> {
+    conn.execute_batch(&format!(
+        "INSERT INTO trace_summary_staging
+         SELECT trace_id,
+                arg_min(name, start_time) FILTER (WHERE {ROOT} AND start_time IS NOT NULL),
+                arg_min(service_name, start_time)
+                    FILTER (WHERE {ROOT} AND start_time IS NOT NULL),
+                MIN(start_time) FILTER (WHERE {ROOT}),
+                to_json(list_sort(list(DISTINCT service_name)))::VARCHAR,
+                MIN(start_time),
+                MAX(end_time),
+                COUNT(*),
+                bool_or(status_code = {STATUS_ERROR})
+         FROM {table}
+         GROUP BY trace_id
+         HAVING MIN(start_time) IS NOT NULL"
+    ))
+    .context("staging trace summaries")?;
+    merge_staging(conn)
+}
+
+/// Merge `trace_summary_staging` into `trace_summaries` and empty it.
+fn merge_staging(conn: &Connection) -> Result<()> {
+    // Unqualified columns in DO UPDATE are the stored row; `excluded` is the batch.
+    conn.execute_batch(
+        "INSERT INTO trace_summaries
+         SELECT trace_id, root_name, root_service, root_start_time,
+                from_json(services, '[\"VARCHAR\"]'),
+                start_time, end_time,
+                COALESCE(epoch_ns(end_time) - epoch_ns(start_time), 0),
+                span_count, has_error
+         FROM trace_summary_staging
+         ON CONFLICT (trace_id) DO UPDATE SET
+             root_name = CASE WHEN root_start_time IS NULL
+                                OR excluded.root_start_time < root_start_time
+                              THEN excluded.root_name ELSE root_name END,
+             root_service = CASE WHEN root_start_time IS NULL
+                                   OR excluded.root_start_time < root_start_time
+                                 THEN excluded.root_service ELSE root_service END,
+             root_start_time = LEAST(root_start_time, excluded.root_start_time),
+             services = list_sort(list_distinct(list_concat(services, excluded.services))),
+             start_time = LEAST(start_time, excluded.start_time),
+             end_time = GREATEST(end_time, excluded.end_time),
+             duration_ns = COALESCE(
+                 epoch_ns(GREATEST(end_time, excluded.end_time))
+                     - epoch_ns(LEAST(start_time, excluded.start_time)),
+                 0),
+             span_count = span_count + excluded.span_count,
+             has_error = has_error OR excluded.has_error;
+         DELETE FROM trace_summary_staging;",
+    )
+    .context("updating trace summaries")?;
+    Ok(())
+}
+
+/// Summaries computed from the stored spans of the traces matching `filter`, a condition
+/// over `traces`; the columns match `trace_summaries`.
+pub(crate) fn summary_select(filter: &str) -> String {
+    format!(
+        "SELECT trace_id,
+                arg_min(name, start_time) FILTER (WHERE {ROOT}) AS root_name,
+                arg_min(service_name, start_time) FILTER (WHERE {ROOT}) AS root_service,
+                MIN(start_time) FILTER (WHERE {ROOT}) AS root_start_time,
+                list_sort(list(DISTINCT service_name)) AS services,
+                MIN(start_time) AS start_time,
+                MAX(end_time) AS end_time,
+                COALESCE(epoch_ns(MAX(end_time)) - epoch_ns(MIN(start_time)), 0) AS duration_ns,
+                COUNT(*) AS span_count,
+                bool_or(status_code = {STATUS_ERROR}) AS has_error
+         FROM traces WHERE {filter}
+         GROUP BY trace_id"
+    )
+}
+
+/// Recompute the summaries of traces whose ids are in the temp table `pruned_traces`, after
+/// some of their spans were deleted. Traces with no spans left lose their summary.
+pub(crate) fn refresh_pruned(conn: &Connection) -> Result<()> {
+    let filter = "trace_id IN (SELECT trace_id FROM pruned_traces)";
+    conn.execute_batch(&format!(
+        "DELETE FROM trace_summaries WHERE {filter};
+         INSERT INTO trace_summaries {};
+         DROP TABLE pruned_traces;",
+        summary_select(filter)
+    ))
+    .context("refreshing pruned trace summaries")?;
+    Ok(())
+}
+
+/// Rebuild every summary from the stored spans, for databases whose spans predate the
+/// table or were written without going through ingest.
+pub fn rebuild_trace_summaries(conn: &Connection) -> Result<()> {
+    conn.execute_batch(&format!(
+        "BEGIN TRANSACTION;
+         DELETE FROM trace_summaries;
+         INSERT INTO trace_summaries {};
+         COMMIT;",
+        summary_select("true")
+    ))
+    .context("rebuilding trace summaries")?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::db;
+    use crate::ingest::{ParsedRows, append_rows};
+
+    fn span(id: &str, parent: Option<&str>, service: &str, start: &str, status: i32) -> SpanRow {
+        let start = NaiveDateTime::parse_from_str(start, "%Y-%m-%d %H:%M:%S").unwrap();
+        SpanRow {
+            trace_id: "t1".to_string(),
+            span_id: id.to_string(),
+            parent_span_id: parent.map(String::from),
+            name: format!("op-{id}"),
+            kind: 1,
+            start_time: Some(start),
+            end_time: Some(start + chrono::Duration::seconds(1)),
+            duration_ns: 1_000_000_000,
+            status_code: status,
+            service_name: service.to_string(),
+            attributes: "{}".to_string(),
+            date: Some(start.date()),
+            trace_state: None,
+            flags: None,
+            dropped_attributes_count: None,
+            dropped_events_count: None,
+            dropped_links_count: None,
+        }
+    }
+
+    fn summary(conn: &Connection) -> (Option<String>, String, i64, i64, bool) {
+        conn.query_row(
+            "SELECT root_name, to_json(services)::VARCHAR, duration_ns, span_count, has_error
+             FROM trace_summaries WHERE trace_id = 't1'",
+            [],
+            |row| {
+                Ok((
+                    row.get(0)?,
+                    row.get(1)?,
+                    row.get(2)?,
+                    row.get(3)?,
+                    row.get(4)?,
+                ))
+            },
+        )
+        .unwrap()
+    }
+
+    #[test]
+    fn merges_batches_and_refreshes_after_prune() {
+        let conn = db::open_in_memory().unwrap();
+        // The child arrives before its root, in a separate batch.
+        let child = span("b", Some("a"), "svc-b", "2024-03-09 16:00:01", 2);
+        append_rows(&conn, &[ParsedRows::Spans(vec![child])]).unwrap();
+        assert_eq!(
+            summary(&conn),
+            (None, r#"["svc-b"]"#.into(), 1_000_000_000, 1, true)
+        );
+
+        let root = span("a", None, "svc-a", "2024-03-09 16:00:00", 0);
+        append_rows(&conn, &[ParsedRows::Spans(vec![root])]).unwrap();
+        let merged = summary(&conn);
+        assert_eq!(
+            merged,
+            (
+                Some("op-a".into()),
+                r#"["svc-a","svc-b"]"#.into(),
+                2_000_000_000,
+                2,
+                true
+            )
+        );
+
+        // A rebuild from the stored spans agrees with the incremental result.
+        rebuild_trace_summaries(&conn).unwrap();
+        assert_eq!(summary(&conn), merged);
+
+        conn.execute_batch(
+            "CREATE TEMP TABLE pruned_traces AS SELECT 't1' AS trace_id;
+             DELETE FROM traces WHERE span_id = 'b';",
+        )
+        .unwrap();
+        refresh_pruned(&conn).unwrap();
+        assert_eq!(
+            summary(&conn),
+            (
+                Some("op-a".into()),
+                r#"["svc-a"]"#.into(),
+                1_000_000_000,
+                1,
+                false
+            )
+        );
+    }
+}
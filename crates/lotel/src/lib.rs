@@ -0,0 +1,215 @@
+//! lotel: embeddable API for running a local OTLP collector and querying what it captured.
+//!
+//! [`Lotel`] ties the collector and storage crates to one data directory, so test harnesses
+//! and tools can start a collector, ingest its JSONL output into DuckDB, and query it
+//! without going through the CLI:
+//!
+//! ```no_run
+//! # async fn run() -> anyhow::Result<()> {
+//! let lotel = lotel::Lotel::new("/tmp/lotel-test");
+//! let collector = lotel.start_collector()?;
+//! collector.wait_healthy(std::time::Duration::from_secs(30)).await?;
+//! // ... exercise the application under test ...
+//! collector.shutdown().await;
+//!
+//! lotel.ingest()?;
+//! let spans = lotel.query_traces(&lotel::QueryOptions::default())?;
+//! # Ok(())
+//! # }
+//! ```
+
+pub mod testing;
+
+use std::path::{Path, PathBuf};
+
+use anyhow::{Context, Result, anyhow};
+use chrono::NaiveDateTime;
+
+pub use lotel_collector::config::CollectorConfig;
+pub use lotel_collector::{CollectorHandle, CollectorStatus};
+pub use lotel_storage::{
+    AttrFilter, AttrOp, IngestReport, LogResult, MetricAggregation, MetricResult, PruneReport,
+    QueryOptions, TraceResult, TraceSummary,
+};
+
+/// Name of the DuckDB file inside the data directory, matching the CLI and collector.
+const DB_FILE: &str = "lotel.db";
+
+/// Client for one lotel data directory: the collector's JSONL files and the DuckDB built
+/// from them.
+#[derive(Debug, Clone)]
+pub struct Lotel {
+    data_path: PathBuf,
+    db_path: PathBuf,
+}
+
+impl Lotel {
+    /// Use `data_path` for the collector's JSONL output and the database, e.g. a temp dir.
+    pub fn new(data_path: impl Into<PathBuf>) -> Self {
+        let data_path = data_path.into();
+        let db_path = data_path.join(DB_FILE);
+        Self { data_path, db_path }
+    }
+
+    /// Use the data directory shared with `lotel-cli` (`~/.lotel/data`).
+    pub fn with_defaults() -> Result<Self> {
+        let data_path = lotel_collector::config::data_path().map_err(|e| anyhow!("{e}"))?;
+        Ok(Self::new(data_path))
+    }
+
+    pub fn data_path(&self) -> &Path {
+        &self.data_path
+    }
+
+    pub fn db_path(&self) -> &Path {
+        &self.db_path
+    }
+
+    /// The default collector config with its file exporters writing under the data
+    /// directory. Adjust endpoints before passing it to [`Lotel::start_collector_with`].
+    pub fn collector_config(&self) -> Result<CollectorConfig> {
+        let mut config =
+            lotel_collector::config::parse_config(lotel_collector::config::DEFAULT_CONFIG)
+                .map_err(|e| anyhow!("{e}"))?;
+        for signal in ["traces", "metrics", "logs"] {
+            if let Some(exporter) = config.exporters.get_mut(&format!("file/{signal}")) {
+                exporter.path = self
+                    .data_path
+                    .join(signal)
+                    .join(format!("{signal}.jsonl"))
+                    .display()
+                    .to_string();
+            }
+        }
+        Ok(config)
+    }
+
+    /// Start an in-process collector with [`Lotel::collector_config`]. Must be called from
+    /// within a Tokio runtime.
+    pub fn start_collector(&self) -> Result<CollectorHandle> {
+        self.start_collector_with(self.collector_config()?)
+    }
+
+    /// Start an in-process collector with an explicit config. Its exporter paths should
+    /// point under [`Lotel::data_path`] for [`Lotel::ingest`] to pick up the output.
+    pub fn start_collector_with(&self, config: CollectorConfig) -> Result<CollectorHandle> {
+        lotel_collector::Collector::new(config)
+            .start()
+            .map_err(|e| anyhow!("starting collector: {e}"))
+    }
+
+    /// Ingest JSONL written since the last ingest into the database. Waits for any
+    /// concurrent ingest (e.g. the collector's periodic one) to finish first.
+    pub fn ingest(&self) -> Result<IngestReport> {
+        let _lock = lotel_storage::IngestLock::acquire(&self.db_path)?;
+        let conn = lotel_storage::open_db(&self.db_path)?;
+        let mut ingester = lotel_storage::IncrementalIngester::new();
+        ingester.load_cursors(&conn)?;
+        ingester
+            .ingest_new(&conn, &self.data_path)
+            .with_context(|| format!("ingesting {}", self.data_path.display()))
+    }
+
+    pub fn query_traces(&self, opts: &QueryOptions) -> Result<Vec<TraceResult>> {
+        lotel_storage::query_traces(&self.read()?, opts)
+    }
+
+    /// Call `f` with each matching span as it is scanned, without collecting them.
+    pub fn for_each_trace(
+        &self,
+        opts: &QueryOptions,
+        f: impl FnMut(TraceResult) -> Result<()>,
+    ) -> Result<()> {
+        lotel_storage::for_each_trace(&self.read()?, opts, f)
+    }
+
+    /// One summary per trace with a span matching `opts`.
+    pub fn query_trace_roots(&self, opts: &QueryOptions) -> Result<Vec<TraceSummary>> {
+        lotel_storage::query_trace_roots(&self.read()?, opts)
+    }
+
+    pub fn query_metrics(&self, opts: &QueryOptions) -> Result<Vec<MetricResult>> {
+        lotel_storage::query_metrics(&self.read()?, opts)
+    }
+
+    pub fn query_logs(&self, opts: &QueryOptions) -> Result<Vec<LogResult>> {
+        lotel_storage::query_logs(&self.read()?, opts)
+    }
+
+    pub fn for_each_metric(
+        &self,
+        opts: &QueryOptions,
+        f: impl FnMut(MetricResult) -> Result<()>,
+    ) -> Result<()> {
+        lotel_storage::for_each_metric(&self.read()?, opts, f)
+    }
+
+    pub fn for_each_log(
+        &self,
+        opts: &QueryOptions,
+        f: impl FnMut(LogResult) -> Result<()>,
+    ) -> Result<()> {
+        lotel_storage::for_each_log(&self.read()?, opts, f)
+    }
+
+    pub fn aggregate(&self, opts: &QueryOptions, metric_name: &str) -> Result<MetricAggregation> {
+        lotel_storage::aggregate_metrics(&self.read()?, opts, metric_name)
+    }
+
+    /// Delete telemetry older than `cutoff`, optionally for one service only.
+    pub fn prune(
+        &self,
+        cutoff: NaiveDateTime,
+        service: Option<&str>,
+        dry_run: bool,
+    ) -> Result<Vec<PruneReport>> {
+        let conn = lotel_storage::open_db(&self.db_path)?;
+        lotel_storage::prune(&conn, cutoff, service, dry_run)
+    }
+
+    fn read(&self) -> Result<duckdb::Connection> {
+        Ok(lotel_storage::open_db_with(
+            &self.db_path,
+            &lotel_storage::DbConfig::read_only(),
+        )?)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn collector_config_writes_under_data_path() {
+        let lotel = Lotel::new("/tmp/lotel-api");
+        let config = lotel.collector_config().unwrap();
+        assert_eq!(
+            config.exporters["file/logs"].path,
+            "/tmp/lotel-api/logs/logs.jsonl"
+        );
+        assert_eq!(lotel.db_path(), Path::new("/tmp/lotel-api/lotel.db"));
+    }
+
+    #[test]
+    fn ingest_then_query() {
+        let tmp = tempfile::TempDir::new().unwrap();
+        let traces = tmp.path().join("traces");
+        std::fs::create_dir_all(&traces).unwrap();
+        let line = r#"{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"svc-a"}}]},"scopeSpans":[{"spans":[{"traceId":"aaa","spanId":"111","name":"span-1","kind":1,"startTimeUnixNano":"1710000000000000000","endTimeUnixNano":"1710000001000000000","status":{"code":0},"attributes":[]}]}]}]}"#;
+        std::fs::write(traces.join("traces.jsonl"), format!("{line}\n")).unwrap();
+
+        let lotel = Lotel::new(tmp.path());
+        assert_eq!(lotel.ingest().unwrap().traces, 1);
+        assert_eq!(lotel.ingest().unwrap().traces, 0);
+
+        let spans = lotel.query_traces(&QueryOptions::default()).unwrap();
+        assert_eq!(spans.len(), 1);
+        assert_eq!(spans[0].service_name, "svc-a");
+        assert!(
+            lotel
+                .query_logs(&QueryOptions::default())
+                .unwrap()
+                .is_empty()
+        );
+    }
+}
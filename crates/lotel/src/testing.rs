@@ -0,0 +1,433 @@
+//! Helpers for integration tests that verify the telemetry an application emits.
+//!
+//! ```no_run
+//! use lotel::testing::{SpanMatcher, TestCollector, assert_contains};
+//!
+//! # async fn run() {
+//! let collector = TestCollector::start().await;
+//! // Point the application's OTLP exporter at `collector.http_endpoint()` and exercise it.
+//! let spans = collector.wait_for_spans("checkout", 2).await;
+//! assert_contains(&spans, &SpanMatcher::new().name("POST /orders").attr("http.status_code", 201));
+//! collector.shutdown().await;
+//! # }
+//! ```
+//!
+//! Helpers panic instead of returning errors, so failures surface as ordinary test failures.
+
+use std::fmt::Debug;
+use std::time::{Duration, Instant};
+
+use serde_json::Value;
+
+use crate::{CollectorHandle, LogResult, Lotel, MetricResult, QueryOptions, TraceResult};
+
+/// How long the `wait_for_*` helpers poll before failing the test.
+pub const DEFAULT_TIMEOUT: Duration = Duration::from_secs(10);
+
+const POLL_INTERVAL: Duration = Duration::from_millis(100);
+
+/// A collector on free local ports with a private temporary data directory.
+///
+/// Periodic ingestion is disabled; the `wait_for_*` helpers ingest on every poll instead.
+/// Call [`TestCollector::shutdown`] at the end of the test to stop the receivers.
+pub struct TestCollector {
+    lotel: Lotel,
+    handle: CollectorHandle,
+    grpc_endpoint: String,
+    http_endpoint: String,
+    timeout: Duration,
+    _dir: tempfile::TempDir,
+}
+
+impl TestCollector {
+    /// Start the collector and wait until it reports healthy. Must be called from within a
+    /// multi-threaded Tokio runtime.
+    pub async fn start() -> Self {
+        let dir = tempfile::TempDir::new().expect("creating temp data directory");
+        let lotel = Lotel::new(dir.path());
+        let mut config = lotel.collector_config().expect("building collector config");
+
+        let grpc_addr = free_local_addr();
+        let http_addr = free_local_addr();
+        config.receivers.otlp.protocols.grpc.endpoint = grpc_addr.clone();
+        config.receivers.otlp.protocols.http.endpoint = http_addr.clone();
+        config.extensions.health_check.endpoint = free_local_addr();
+        config.extensions.zpages = None;
+        config.processors.batch.timeout = "100ms".into();
+        config.ingestion = None;
+
+        let handle = lotel
+            .start_collector_with(config)
+            .expect("starting test collector");
+        handle
+            .wait_healthy(DEFAULT_TIMEOUT)
+            .await
+            .expect("waiting for test collector");
+
+        Self {
+            lotel,
+            handle,
+            grpc_endpoint: format!("http://{grpc_addr}"),
+            http_endpoint: format!("http://{http_addr}"),
+            timeout: DEFAULT_TIMEOUT,
+            _dir: dir,
+        }
+    }
+
+    /// Override [`DEFAULT_TIMEOUT`] for the `wait_for_*` helpers.
+    pub fn with_timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = timeout;
+        self
+    }
+
+    /// OTLP/gRPC endpoint, e.g. for `OTEL_EXPORTER_OTLP_ENDPOINT`.
+    pub fn grpc_endpoint(&self) -> &str {
+        &self.grpc_endpoint
+    }
+
+    /// OTLP/HTTP base URL; signals are posted to `/v1/{traces,metrics,logs}`.
+    pub fn http_endpoint(&self) -> &str {
+        &self.http_endpoint
+    }
+
+    /// Client for the collector's data directory, for queries beyond the helpers.
+    pub fn lotel(&self) -> &Lotel {
+        &self.lotel
+    }
+
+    /// Wait until at least `n` spans from `service` have been captured and return them all.
+    pub async fn wait_for_spans(&self, service: &str, n: usize) -> Vec<TraceResult> {
+        let opts = service_opts(service);
+        self.wait_for("spans", service, n, || self.lotel.query_traces(&opts))
+            .await
+    }
+
+    /// Wait until at least `n` log records from `service` have been captured.
+    pub async fn wait_for_logs(&self, service: &str, n: usize) -> Vec<LogResult> {
+        let opts = service_opts(service);
+        self.wait_for("logs", service, n, || self.lotel.query_logs(&opts))
+            .await
+    }
+
+    /// Wait until at least `n` metric data points from `service` have been captured.
+    pub async fn wait_for_metrics(&self, service: &str, n: usize) -> Vec<MetricResult> {
+        let opts = service_opts(service);
+        self.wait_for("metric points", service, n, || {
+            self.lotel.query_metrics(&opts)
+        })
+        .await
+    }
+
+    pub async fn shutdown(self) {
+        self.handle.shutdown().await;
+    }
+
+    async fn wait_for<T>(
+        &self,
+        what: &str,
+        service: &str,
+        n: usize,
+        query: impl Fn() -> anyhow::Result<Vec<T>>,
+    ) -> Vec<T> {
+        let start = Instant::now();
+        loop {
+            self.lotel.ingest().expect("ingesting collector output");
+            let rows = query().expect("querying captured telemetry");
+            if rows.len() >= n {
+                return rows;
+            }
+            if start.elapsed() > self.timeout {
+                panic!(
+                    "timed out after {:?} waiting for {n} {what} from {service:?}; got {}",
+                    self.timeout,
+                    rows.len()
+                );
+            }
+            tokio::time::sleep(POLL_INTERVAL).await;
+        }
+    }
+}
+
+fn service_opts(service: &str) -> QueryOptions {
+    QueryOptions {
+        service: Some(service.to_string()),
+        ..Default::default()
+    }
+}
+
+fn free_local_addr() -> String {
+    let listener = std::net::TcpListener::bind("127.0.0.1:0").expect("binding a free port");
+    let port = listener.local_addr().expect("reading bound port").port();
+    format!("127.0.0.1:{port}")
+}
+
+/// Predicate over captured records, used by [`assert_contains`] and [`assert_none`].
+pub trait Matcher<T> {
+    fn matches(&self, item: &T) -> bool;
+}
+
+/// Panic unless some item matches, listing the items on failure.
+pub fn assert_contains<T: Debug, M: Matcher<T> + Debug>(items: &[T], matcher: &M) {
+    if !items.iter().any(|item| matcher.matches(item)) {
+        panic!(
+            "no record matches {matcher:?} among {} captured: {items:#?}",
+            items.len()
+        );
+    }
+}
+
+/// Panic if any item matches, showing the first match.
+pub fn assert_none<T: Debug, M: Matcher<T> + Debug>(items: &[T], matcher: &M) {
+    if let Some(item) = items.iter().find(|item| matcher.matches(item)) {
+        panic!("expected no record matching {matcher:?}, found {item:#?}");
+    }
+}
+
+/// Number of items that match.
+pub fn count_matching<T, M: Matcher<T>>(items: &[T], matcher: &M) -> usize {
+    items.iter().filter(|item| matcher.matches(item)).count()
+}
+
+/// Matches spans on name, service, kind, status, and attributes. Unset fields match anything.
+#[derive(Debug, Clone, Default)]
+pub struct SpanMatcher {
+    name: Option<String>,
+    service: Option<String>,
+    kind: Option<i32>,
+    status_code: Option<i32>,
+    attrs: Vec<(String, Value)>,
+}
+
+impl SpanMatcher {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn name(mut self, name: impl Into<String>) -> Self {
+        self.name = Some(name.into());
+        self
+    }
+
+    pub fn service(mut self, service: impl Into<String>) -> Self {
+        self.service = Some(service.into());
+        self
+    }
+
+    /// OTLP span kind, e.g. 2 for SERVER.
+    pub fn kind(mut self, kind: i32) -> Self {
+        self.kind = Some(kind);
+        self
+    }
+
+    /// OTLP status code: 0 UNSET, 1 OK, 2 ERROR.
+    pub fn status(mut self, code: i32) -> Self {
+        self.status_code = Some(code);
+        self
+    }
+
+    pub fn attr(mut self, key: impl Into<String>, value: impl Into<Value>) -> Self {
+        self.attrs.push((key.into(), value.into()));
+        self
+    }
+}
+
+impl Matcher<TraceResult> for SpanMatcher {
+    fn matches(&self, span: &TraceResult) -> bool {
+        self.name.as_ref().is_none_or(|n| *n == span.name)
+            && self
+                .service
+                .as_ref()
+                .is_none_or(|s| *s == span.service_name)
+            && self.kind.is_none_or(|k| k == span.kind)
+            && self.status_code.is_none_or(|c| c == span.status_code)
+            && attrs_match(&self.attrs, span.attributes.as_ref())
+    }
+}
+
+/// Matches log records on service, minimum severity, body text, and attributes.
+#[derive(Debug, Clone, Default)]
+pub struct LogMatcher {
+    service: Option<String>,
+    min_severity: Option<i32>,
+    body_contains: Option<String>,
+    attrs: Vec<(String, Value)>,
+}
+
+impl LogMatcher {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn service(mut self, service: impl Into<String>) -> Self {
+        self.service = Some(service.into());
+        self
+    }
+
+    /// Minimum OTLP severity number, e.g. 17 for ERROR.
+    pub fn min_severity(mut self, severity_number: i32) -> Self {
+        self.min_severity = Some(severity_number);
+        self
+    }
+
+    pub fn body_contains(mut self, text: impl Into<String>) -> Self {
+        self.body_contains = Some(text.into());
+        self
+    }
+
+    pub fn attr(mut self, key: impl Into<String>, value: impl Into<Value>) -> Self {
+        self.attrs.push((key.into(), value.into()));
+        self
+    }
+}
+
+impl Matcher<LogResult> for LogMatcher {
+    fn matches(&self, log: &LogResult) -> bool {
+        self.service.as_ref().is_none_or(|s| *s == log.service_name)
+            && self
+                .min_severity
+                .is_none_or(|min| log.severity_number.is_some_and(|n| n >= min))
+            && self
+                .body_contains
+                .as_ref()
+                .is_none_or(|t| log.body.as_deref().is_some_and(|b| b.contains(t.as_str())))
+            && attrs_match(&self.attrs, log.attributes.as_ref())
+    }
+}
+
+/// Matches metric data points on name, service, value range, and attributes.
+#[derive(Debug, Clone, Default)]
+pub struct MetricMatcher {
+    name: Option<String>,
+    service: Option<String>,
+    min_value: Option<f64>,
+    max_value: Option<f64>,
+    attrs: Vec<(String, Value)>,
+}
+
+impl MetricMatcher {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    pub fn name(mut self, name: impl Into<String>) -> Self {
+        self.name = Some(name.into());
+        self
+    }
+
+    pub fn service(mut self, service: impl Into<String>) -> Self {
+        self.service = Some(service.into());
+        self
+    }
+
+    pub fn min_value(mut self, min: f64) -> Self {
+        self.min_value = Some(min);
+        self
+    }
+
+    pub fn max_value(mut self, max: f64) -> Self {
+        self.max_value = Some(max);
+        self
+    }
+
+    pub fn attr(mut self, key: impl Into<String>, value: impl Into<Value>) -> Self {
+        self.attrs.push((key.into(), value.into()));
+        self
+    }
+}
+
+impl Matcher<MetricResult> for MetricMatcher {
+    fn matches(&self, point: &MetricResult) -> bool {
+        self.name.as_ref().is_none_or(|n| *n == point.metric_name)
+            && self
+                .service
+                .as_ref()
+                .is_none_or(|s| *s == point.service_name)
+            && self.min_value.is_none_or(|min| point.value >= min)
+            && self.max_value.is_none_or(|max| point.value <= max)
+            && attrs_match(&self.attrs, point.attributes.as_ref())
+    }
+}
+
+/// Every expected attribute is present and equal. Numbers compare by value and a string
+/// expectation also matches a non-string attribute with the same text.
+fn attrs_match(expected: &[(String, Value)], actual: Option<&Value>) -> bool {
+    expected.iter().all(|(key, want)| {
+        let Some(got) = actual.and_then(|a| a.get(key)) else {
+            return false;
+        };
+        match (want, got) {
+            (Value::Number(w), Value::Number(g)) => w.as_f64() == g.as_f64(),
+            (Value::String(w), Value::String(g)) => w == g,
+            (Value::String(w), g) => {
+                let text = g.to_string();
+                text == *w
+            }
+            (w, g) => w == g,
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn span(name: &str, status_code: i32, attributes: Value) -> TraceResult {
+        serde_json::from_value(serde_json::json!({
+            "trace_id": "t1",
+            "span_id": "s1",
+            "name": name,
+            "kind": 2,
+            "start_time": "2024-03-09T16:00:00",
+            "duration_ns": 1_000_000,
+            "status_code": status_code,
+            "service_name": "checkout",
+            "attributes": attributes,
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn span_matcher_checks_every_field() {
+        let spans = [
+            span("GET /", 0, serde_json::json!({"http.status_code": 200})),
+            span(
+                "POST /orders",
+                2,
+                serde_json::json!({"http.status_code": 500}),
+            ),
+        ];
+        let matcher = SpanMatcher::new()
+            .name("POST /orders")
+            .service("checkout")
+            .kind(2)
+            .status(2)
+            .attr("http.status_code", 500);
+        assert_eq!(count_matching(&spans, &matcher), 1);
+        assert_contains(&spans, &SpanMatcher::new().attr("http.status_code", "200"));
+        assert_none(&spans, &SpanMatcher::new().attr("http.method", "GET"));
+    }
+
+    #[test]
+    #[should_panic(expected = "no record matches")]
+    fn assert_contains_panics_without_match() {
+        let spans = [span("GET /", 0, serde_json::json!({}))];
+        assert_contains(&spans, &SpanMatcher::new().status(2));
+    }
+
+    #[test]
+    fn log_matcher_checks_severity_and_body() {
+        let log: LogResult = serde_json::from_value(serde_json::json!({
+            "timestamp": "2024-03-09T16:00:00",
+            "severity_number": 17,
+            "body": "payment declined",
+            "service_name": "checkout",
+        }))
+        .unwrap();
+        let logs = [log];
+        assert_contains(
+            &logs,
+            &LogMatcher::new().min_severity(17).body_contains("declined"),
+        );
+        assert_none(&logs, &LogMatcher::new().min_severity(21));
+    }
+}
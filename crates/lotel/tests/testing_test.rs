@@ -0,0 +1,66 @@
+use lotel::testing::{SpanMatcher, TestCollector, assert_contains};
+use opentelemetry_proto::tonic::collector::trace::v1::ExportTraceServiceRequest;
+use opentelemetry_proto::tonic::common::v1::{AnyValue, KeyValue, any_value};
+use opentelemetry_proto::tonic::resource::v1::Resource;
+use opentelemetry_proto::tonic::trace::v1::{ResourceSpans, ScopeSpans, Span};
+
+fn string_attr(key: &str, value: &str) -> KeyValue {
+    KeyValue {
+        key: key.into(),
+        value: Some(AnyValue {
+            value: Some(any_value::Value::StringValue(value.into())),
+        }),
+    }
+}
+
+/// Spans posted to the test collector are visible through `wait_for_spans` and the matchers.
+#[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+async fn test_collector_captures_spans() {
+    let collector = TestCollector::start().await;
+
+    let now = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap()
+        .as_nanos() as u64;
+    let request = ExportTraceServiceRequest {
+        resource_spans: vec![ResourceSpans {
+            resource: Some(Resource {
+                attributes: vec![string_attr("service.name", "checkout")],
+                ..Default::default()
+            }),
+            scope_spans: vec![ScopeSpans {
+                spans: vec![Span {
+                    trace_id: vec![1; 16],
+                    span_id: vec![2; 8],
+                    name: "POST /orders".into(),
+                    kind: 2,
+                    start_time_unix_nano: now,
+                    end_time_unix_nano: now + 5_000_000,
+                    attributes: vec![string_attr("http.route", "/orders")],
+                    ..Default::default()
+                }],
+                ..Default::default()
+            }],
+            ..Default::default()
+        }],
+    };
+
+    let resp = reqwest::Client::new()
+        .post(format!("{}/v1/traces", collector.http_endpoint()))
+        .json(&request)
+        .send()
+        .await
+        .expect("send traces");
+    assert!(resp.status().is_success());
+
+    let spans = collector.wait_for_spans("checkout", 1).await;
+    assert_contains(
+        &spans,
+        &SpanMatcher::new()
+            .name("POST /orders")
+            .kind(2)
+            .attr("http.route", "/orders"),
+    );
+
+    collector.shutdown().await;
+}
@@ -0,0 +1,86 @@
+// Stand-in for tonic-prost-build output (signatures match the real generated code).
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct AttrFilter { pub key: ::prost::alloc::string::String, pub op: i32, pub value: ::prost::alloc::string::String }
+impl AttrFilter {
+    pub fn op(&self) -> attr_filter::Op { attr_filter::Op::try_from(self.op).unwrap_or_default() }
+    pub fn set_op(&mut self, value: attr_filter::Op) { self.op = value as i32; }
+}
+pub mod attr_filter {
+    #[derive(Clone, Copy, Debug, PartialEq, Eq, Hash, PartialOrd, Ord, Default)]
+    #[repr(i32)]
+    pub enum Op { #[default] Unspecified = 0, Eq = 1, Ne = 2, Gt = 3, Ge = 4, Lt = 5, Le = 6 }
+    impl TryFrom<i32> for Op { type Error = ::prost::UnknownEnumValue; fn try_from(v: i32) -> Result<Self, Self::Error> { match v { 0 => Ok(Op::Unspecified), 1 => Ok(Op::Eq), 2 => Ok(Op::Ne), 3 => Ok(Op::Gt), 4 => Ok(Op::Ge), 5 => Ok(Op::Lt), 6 => Ok(Op::Le), v => Err(::prost::UnknownEnumValue(v)) } } }
+}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct QueryRequest {
+    pub service: Option<String>, pub since: Option<::prost_types::Timestamp>, pub until: Option<::prost_types::Timestamp>,
+    pub limit: u32, pub attrs: Vec<AttrFilter>, pub trace_id: Option<String>, pub kind: Option<i32>, pub status_code: Option<i32>,
+    pub min_duration_ns: Option<i64>, pub min_severity: Option<i32>,
+}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct Span {
+    pub trace_id: String, pub span_id: String, pub parent_span_id: Option<String>, pub name: String, pub kind: i32,
+    pub start_time: Option<::prost_types::Timestamp>, pub end_time: Option<::prost_types::Timestamp>, pub duration_ns: i64,
+    pub status_code: i32, pub service_name: String, pub attributes: String,
+}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct QueryTracesResponse { pub spans: Vec<Span> }
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct MetricPoint {
+    pub metric_name: String, pub metric_type: String, pub value: f64, pub timestamp: Option<::prost_types::Timestamp>,
+    pub service_name: String, pub aggregation_temporality: Option<i32>, pub is_monotonic: Option<bool>, pub unit: Option<String>, pub attributes: String,
+}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct QueryMetricsResponse { pub points: Vec<MetricPoint> }
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct LogRecord {
+    pub timestamp: Option<::prost_types::Timestamp>, pub severity: Option<String>, pub severity_number: Option<i32>, pub body: Option<String>,
+    pub service_name: String, pub trace_id: Option<String>, pub span_id: Option<String>, pub attributes: String,
+}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct QueryLogsResponse { pub records: Vec<LogRecord> }
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct AggregateRequest { pub filter: Option<QueryRequest>, pub metrics: Vec<String> }
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct MetricAggregation { pub metric_name: String, pub service_name: Option<String>, pub count: i64, pub avg: Option<f64>, pub min: Option<f64>, pub max: Option<f64> }
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct AggregateResponse { pub aggregations: Vec<MetricAggregation> }
+#[derive(Clone, Copy, PartialEq, Debug, Default)]
+pub struct StatusRequest {}
+#[derive(Clone, PartialEq, Debug, Default)]
+pub struct StatusResponse { pub running: bool, pub healthy: bool, pub pid: Option<u32>, pub started_at: Option<::prost_types::Timestamp>, pub config_path: Option<String>, pub data_path: Option<String> }
+
+pub mod query_service_client {
+    use super::*;
+    #[derive(Debug, Clone)]
+    pub struct QueryServiceClient<T> { inner: T }
+    impl QueryServiceClient<tonic::transport::Channel> {
+        pub async fn connect<D>(dst: D) -> Result<Self, tonic::transport::Error> where D: TryInto<tonic::transport::Endpoint>, D::Error: Into<Box<dyn std::error::Error + Send + Sync>> { let _ = dst; unimplemented!() }
+    }
+    impl<T> QueryServiceClient<T> {
+        pub fn new(inner: T) -> Self { Self { inner } }
+        pub async fn query_traces(&mut self, request: impl tonic::IntoRequest<QueryRequest>) -> Result<tonic::Response<QueryTracesResponse>, tonic::Status> { let _ = (request, &self.inner); unimplemented!() }
+        pub async fn query_metrics(&mut self, request: impl tonic::IntoRequest<QueryRequest>) -> Result<tonic::Response<QueryMetricsResponse>, tonic::Status> { let _ = request; unimplemented!() }
+        pub async fn query_logs(&mut self, request: impl tonic::IntoRequest<QueryRequest>) -> Result<tonic::Response<QueryLogsResponse>, tonic::Status> { let _ = request; unimplemented!() }
+        pub async fn aggregate(&mut self, request: impl tonic::IntoRequest<AggregateRequest>) -> Result<tonic::Response<AggregateResponse>, tonic::Status> { let _ = request; unimplemented!() }
+        pub async fn status(&mut self, request: impl tonic::IntoRequest<StatusRequest>) -> Result<tonic::Response<StatusResponse>, tonic::Status> { let _ = request; unimplemented!() }
+    }
+}
+pub mod query_service_server {
+    use super::*;
+    #[allow(async_fn_in_trait)]
+    #[tonic::async_trait]
+    pub trait QueryService: std::marker::Send + std::marker::Sync + 'static {
+        async fn query_traces(&self, request: tonic::Request<QueryRequest>) -> std::result::Result<tonic::Response<QueryTracesResponse>, tonic::Status>;
+        async fn query_metrics(&self, request: tonic::Request<QueryRequest>) -> std::result::Result<tonic::Response<QueryMetricsResponse>, tonic::Status>;
+        async fn query_logs(&self, request: tonic::Request<QueryRequest>) -> std::result::Result<tonic::Response<QueryLogsResponse>, tonic::Status>;
+        async fn aggregate(&self, request: tonic::Request<AggregateRequest>) -> std::result::Result<tonic::Response<AggregateResponse>, tonic::Status>;
+        async fn status(&self, request: tonic::Request<StatusRequest>) -> std::result::Result<tonic::Response<StatusResponse>, tonic::Status>;
+    }
+    #[allow(dead_code)]
+    #[derive(Debug)]
+    pub struct QueryServiceServer<T> { inner: std::sync::Arc<T> }
+    impl<T: QueryService> QueryServiceServer<T> {
+        pub fn new(inner: T) -> Self { Self { inner: std::sync::Arc::new(inner) } }
+    }
+}